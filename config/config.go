@@ -100,6 +100,28 @@ func GetDBPath() string {
 	return fmt.Sprintf("%s/%s.db", GetDBFolderPath(), GetName())
 }
 
+// GetShopDBDriver returns the driver of the external shop database set via
+// XUI_SHOP_DB_DRIVER ("postgres" or "mysql"). It is empty when the shop tables
+// live in the panel's SQLite database.
+func GetShopDBDriver() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("XUI_SHOP_DB_DRIVER")))
+}
+
+// GetShopDBDSN returns the connection string of the external shop database set via XUI_SHOP_DB_DSN.
+func GetShopDBDSN() string {
+	return os.Getenv("XUI_SHOP_DB_DSN")
+}
+
+// GetShopKeyPath returns the path of the key encrypting sensitive shop order
+// fields, set via XUI_SHOP_KEY_FILE. It defaults to a file beside the database,
+// which backups of the database file alone then do not include.
+func GetShopKeyPath() string {
+	if keyPath := os.Getenv("XUI_SHOP_KEY_FILE"); keyPath != "" {
+		return keyPath
+	}
+	return fmt.Sprintf("%s/%s-shop.key", GetDBFolderPath(), GetName())
+}
+
 // GetLogFolder returns the path to the log folder based on environment variables or platform defaults.
 func GetLogFolder() string {
 	logFolderPath := os.Getenv("XUI_LOG_FOLDER")
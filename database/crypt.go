@@ -0,0 +1,213 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"gorm.io/gorm"
+)
+
+// FieldCipher encrypts the values of sensitive shop columns before they are
+// written and decrypts them after they are read. Seal must encrypt every value
+// it is given, and Open return values that were never sealed as they are.
+type FieldCipher interface {
+	Seal(plain string) (string, error)
+	Open(value string) (string, error)
+}
+
+// ErrFieldNotOpened is returned by FieldCipher.Open for a value that looks
+// sealed but does not open with the key.
+var ErrFieldNotOpened = errors.New("encrypted column does not open")
+
+// SecretColumns lists, per table, the columns whose values are stored
+// encrypted once a FieldCipher is set: payment details, what customers entered
+// at checkout and the passwords of node panels.
+var SecretColumns = map[string][]string{
+	"shop_orders":         {"receipt_file_id", "ocr_reference", "custom_fields", "contact_email", "phone"},
+	"shop_orders_archive": {"receipt_file_id", "ocr_reference", "custom_fields", "contact_email", "phone"},
+	"shop_order_payments": {"note"},
+	"shop_order_comments": {"body"},
+	"shop_nodes":          {"password"},
+}
+
+var (
+	fieldCipherMu sync.RWMutex
+	fieldCipher   FieldCipher
+)
+
+// SetFieldCipher sets the cipher of the SecretColumns. Until one is set the
+// columns are stored in plain text.
+func SetFieldCipher(c FieldCipher) {
+	fieldCipherMu.Lock()
+	defer fieldCipherMu.Unlock()
+	fieldCipher = c
+}
+
+func getFieldCipher() FieldCipher {
+	fieldCipherMu.RLock()
+	defer fieldCipherMu.RUnlock()
+	return fieldCipher
+}
+
+// sealedKey marks a statement whose SecretColumns sealColumns encrypted, so
+// they are opened again after it even when it failed.
+const sealedKey = "xui:sealed"
+
+// registerCryptCallbacks hooks the FieldCipher into target, sealing the
+// SecretColumns on create and update and opening them after every query. The
+// values of the caller's structs and maps are opened again once written, so
+// only the database sees them sealed. Raw SQL and Pluck bypass the cipher.
+func registerCryptCallbacks(target *gorm.DB) error {
+	if err := target.Callback().Create().Before("gorm:create").Register("xui:seal", sealColumns); err != nil {
+		return err
+	}
+	if err := target.Callback().Create().After("gorm:create").Register("xui:open", reopenColumns); err != nil {
+		return err
+	}
+	if err := target.Callback().Update().Before("gorm:update").Register("xui:seal", sealColumns); err != nil {
+		return err
+	}
+	if err := target.Callback().Update().After("gorm:update").Register("xui:open", reopenColumns); err != nil {
+		return err
+	}
+	return target.Callback().Query().After("gorm:query").Register("xui:open", openColumns)
+}
+
+func sealColumns(tx *gorm.DB) {
+	if tx.Error != nil {
+		return
+	}
+	if sealed, _ := tx.InstanceGet(sealedKey); sealed == true {
+		return
+	}
+	transformColumns(tx, FieldCipher.Seal)
+	tx.InstanceSet(sealedKey, true)
+}
+
+// reopenColumns gives the caller back the values sealColumns encrypted.
+func reopenColumns(tx *gorm.DB) {
+	if sealed, _ := tx.InstanceGet(sealedKey); sealed != true {
+		return
+	}
+	tx.InstanceSet(sealedKey, false)
+	transformColumns(tx, openValue)
+}
+
+func openColumns(tx *gorm.DB) {
+	if tx.Error == nil {
+		transformColumns(tx, openValue)
+	}
+}
+
+// openValue opens value. A value that does not open, such as one stored in
+// plain text that happens to look sealed, is returned as stored rather than
+// failing the whole query; a missing key still fails it.
+func openValue(c FieldCipher, value string) (string, error) {
+	plain, err := c.Open(value)
+	if errors.Is(err, ErrFieldNotOpened) {
+		logger.Warning("read encrypted column as stored:", err)
+		return value, nil
+	}
+	return plain, err
+}
+
+// transformColumns applies fn to the SecretColumns of the statement's model
+// values and update map.
+func transformColumns(tx *gorm.DB, fn func(FieldCipher, string) (string, error)) {
+	stmt := tx.Statement
+	columns := SecretColumns[stmt.Table]
+	if len(columns) == 0 {
+		return
+	}
+	c := getFieldCipher()
+	if c == nil {
+		return
+	}
+	apply := func(value string) string {
+		if value == "" {
+			return value
+		}
+		out, err := fn(c, value)
+		if err != nil {
+			tx.AddError(err)
+			return value
+		}
+		return out
+	}
+
+	if values, ok := stmt.Dest.(map[string]any); ok {
+		for key, value := range values {
+			s, ok := value.(string)
+			if !ok || !isSecretColumn(stmt, columns, key) {
+				continue
+			}
+			values[key] = apply(s)
+		}
+	}
+	if stmt.Schema == nil {
+		return
+	}
+	transformStructs(tx, stmt.ReflectValue, columns, apply)
+	// Updates with a struct other than the model's value write that struct.
+	dest := reflect.ValueOf(stmt.Dest)
+	if dest.Kind() == reflect.Pointer && !dest.IsNil() &&
+		(!stmt.ReflectValue.CanAddr() || dest.Pointer() != stmt.ReflectValue.UnsafeAddr()) {
+		transformStructs(tx, dest.Elem(), columns, apply)
+	}
+}
+
+func isSecretColumn(stmt *gorm.Statement, columns []string, key string) bool {
+	if stmt.Schema != nil {
+		if field := stmt.Schema.LookUpField(key); field != nil {
+			key = field.DBName
+		}
+	}
+	for _, column := range columns {
+		if column == key {
+			return true
+		}
+	}
+	return false
+}
+
+// transformStructs applies fn to the columns of rv, a model struct or a slice
+// of them. Values of other types, such as rows scanned into maps, are left
+// alone.
+func transformStructs(tx *gorm.DB, rv reflect.Value, columns []string, fn func(string) string) {
+	stmt := tx.Statement
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			transformStructs(tx, rv.Index(i), columns, fn)
+		}
+		return
+	case reflect.Pointer:
+		if !rv.IsNil() {
+			transformStructs(tx, rv.Elem(), columns, fn)
+		}
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+	if rv.Type() != stmt.Schema.ModelType || !rv.CanAddr() {
+		return
+	}
+	for _, column := range columns {
+		field := stmt.Schema.LookUpField(column)
+		if field == nil {
+			continue
+		}
+		value, _ := field.ValueOf(stmt.Context, rv)
+		s, ok := value.(string)
+		if !ok || s == "" {
+			continue
+		}
+		if err := field.Set(stmt.Context, rv, fn(s)); err != nil {
+			tx.AddError(err)
+		}
+	}
+}
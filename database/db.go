@@ -1,5 +1,6 @@
 // Package database provides database initialization, migration, and management utilities
-// for the 3x-ui panel using GORM with SQLite.
+// for the 3x-ui panel using GORM with SQLite. The shop tables can optionally be kept
+// in an external PostgreSQL or MySQL database.
 package database
 
 import (
@@ -38,9 +39,6 @@ func initModels() error {
 		&model.InboundClientIps{},
 		&xray.ClientTraffic{},
 		&model.HistoryOfSeeders{},
-		&model.ShopPackage{},
-		&model.ShopInbound{},
-		&model.ShopOrder{},
 	}
 	for _, model := range models {
 		if err := db.AutoMigrate(model); err != nil {
@@ -48,7 +46,7 @@ func initModels() error {
 			return err
 		}
 	}
-	return nil
+	return migrateShopModels(GetShopDB())
 }
 
 // initUser creates a default admin user if the users table is empty.
@@ -145,6 +143,26 @@ func InitDB(dbPath string) error {
 	if err != nil {
 		return err
 	}
+	if err := closeShopDB(); err != nil {
+		return err
+	}
+	if shopDB, err = openShopDB(c); err != nil {
+		return err
+	}
+	if err := registerChangeCallbacks(db); err != nil {
+		return err
+	}
+	if err := registerCryptCallbacks(db); err != nil {
+		return err
+	}
+	if shopDB != nil {
+		if err := registerChangeCallbacks(shopDB); err != nil {
+			return err
+		}
+		if err := registerCryptCallbacks(shopDB); err != nil {
+			return err
+		}
+	}
 
 	if err := initModels(); err != nil {
 		return err
@@ -163,6 +181,9 @@ func InitDB(dbPath string) error {
 
 // CloseDB closes the database connection if it exists.
 func CloseDB() error {
+	if err := closeShopDB(); err != nil {
+		return err
+	}
 	if db != nil {
 		sqlDB, err := db.DB()
 		if err != nil {
@@ -0,0 +1,270 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The baseline creates the shop tables as they were before versioned
+// migrations. Databases created earlier already have them, so AutoMigrate only
+// fills in what is missing there. The tables are frozen copies of the models
+// of that time; later columns come from the migrations adding them.
+func init() {
+	Register(Migration{
+		Version: 1,
+		Name:    "shop_baseline",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(baselineModels()...); err != nil {
+				return err
+			}
+			// Shop inbounds used to be unique per inbound ID only; remote nodes share ID ranges.
+			if tx.Migrator().HasIndex(&shopInboundV1{}, "idx_shop_inbounds_inbound_id") {
+				return tx.Migrator().DropIndex(&shopInboundV1{}, "idx_shop_inbounds_inbound_id")
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(baselineModels()...)
+		},
+	})
+}
+
+func baselineModels() []any {
+	return []any{
+		&shopPackageV1{},
+		&shopCategoryV1{},
+		&shopInboundV1{},
+		&shopNodeV1{},
+		&shopSubscriptionV1{},
+		&shopPaymentDestinationV1{},
+		&shopOrderCommentV1{},
+		&shopConversationV1{},
+		&shopAbuseLogV1{},
+		&shopCustomerV1{},
+		&shopBroadcastV1{},
+		&shopTicketV1{},
+		&shopTicketMessageV1{},
+		&shopOrderV1{},
+	}
+}
+
+type shopPackageV1 struct {
+	Id           int `gorm:"primaryKey;autoIncrement"`
+	Name         string
+	DataGB       int
+	DurationDays int
+	Price        int64
+	Type         string `gorm:"default:standard"`
+	Devices      int    `gorm:"default:1"`
+	BillingCycle string
+	IsActive     bool `gorm:"default:true"`
+	IsArchived   bool `gorm:"default:false;index"`
+	SortOrder    int  `gorm:"default:0;index"`
+	CategoryId   int  `gorm:"default:0;index"`
+	Description  string
+	ImageUrl     string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (shopPackageV1) TableName() string {
+	return "shop_packages"
+}
+
+type shopCategoryV1 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	Name      string
+	SortOrder int `gorm:"default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (shopCategoryV1) TableName() string {
+	return "shop_categories"
+}
+
+type shopNodeV1 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	Name      string
+	Url       string
+	Username  string
+	Password  string
+	SubUri    string
+	Enabled   bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (shopNodeV1) TableName() string {
+	return "shop_nodes"
+}
+
+type shopInboundV1 struct {
+	Id         int  `gorm:"primaryKey;autoIncrement"`
+	NodeId     int  `gorm:"default:0;uniqueIndex:idx_shop_inbound_node,priority:1"`
+	InboundId  int  `gorm:"uniqueIndex:idx_shop_inbound_node,priority:2"`
+	Enabled    bool `gorm:"default:true"`
+	MaxClients int  `gorm:"default:0"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (shopInboundV1) TableName() string {
+	return "shop_inbounds"
+}
+
+type shopAbuseLogV1 struct {
+	Id         int   `gorm:"primaryKey;autoIncrement"`
+	TelegramId int64 `gorm:"index"`
+	Kind       string
+	Detail     string
+	CreatedAt  time.Time
+}
+
+func (shopAbuseLogV1) TableName() string {
+	return "shop_abuse_logs"
+}
+
+type shopConversationV1 struct {
+	TelegramId int64 `gorm:"primaryKey;autoIncrement:false"`
+	State      string
+	Draft      string
+	UpdatedAt  time.Time
+}
+
+func (shopConversationV1) TableName() string {
+	return "shop_conversations"
+}
+
+type shopCustomerV1 struct {
+	TelegramId int64 `gorm:"primaryKey;autoIncrement:false"`
+	Language   string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (shopCustomerV1) TableName() string {
+	return "shop_customers"
+}
+
+type shopBroadcastV1 struct {
+	Id         int `gorm:"primaryKey;autoIncrement"`
+	Segment    string
+	Message    string
+	Recipients int
+	Sent       int
+	Failed     int
+	Status     string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+}
+
+func (shopBroadcastV1) TableName() string {
+	return "shop_broadcasts"
+}
+
+type shopTicketV1 struct {
+	Id         int   `gorm:"primaryKey;autoIncrement"`
+	TelegramId int64 `gorm:"index"`
+	OrderId    int
+	Status     string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (shopTicketV1) TableName() string {
+	return "shop_tickets"
+}
+
+type shopTicketMessageV1 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	TicketId  int `gorm:"index"`
+	FromAdmin bool
+	Author    string
+	Body      string
+	CreatedAt time.Time
+}
+
+func (shopTicketMessageV1) TableName() string {
+	return "shop_ticket_messages"
+}
+
+type shopOrderCommentV1 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	OrderId   int `gorm:"index"`
+	Author    string
+	Body      string
+	CreatedAt time.Time
+}
+
+func (shopOrderCommentV1) TableName() string {
+	return "shop_order_comments"
+}
+
+type shopPaymentDestinationV1 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	Name      string
+	Kind      string
+	Value     string
+	Holder    string
+	DailyCap  int64
+	SortOrder int `gorm:"default:0"`
+	Enabled   bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (shopPaymentDestinationV1) TableName() string {
+	return "shop_payment_destinations"
+}
+
+type shopSubscriptionV1 struct {
+	Id             int   `gorm:"primaryKey;autoIncrement"`
+	TelegramId     int64 `gorm:"index"`
+	PackageId      int
+	OrderId        int
+	Status         string    `gorm:"index"`
+	NextDueAt      time.Time `gorm:"index"`
+	RenewalOrderId int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (shopSubscriptionV1) TableName() string {
+	return "shop_subscriptions"
+}
+
+type shopOrderV1 struct {
+	Id                   int `gorm:"primaryKey;autoIncrement"`
+	TelegramId           int64
+	Phone                string
+	ContactEmail         string
+	NodeId               int `gorm:"default:0"`
+	InboundId            int
+	PackageId            *int
+	CustomDataGB         int
+	CustomDays           int
+	Price                int64
+	Status               string
+	PaymentDestinationId int `gorm:"default:0;index"`
+	ReceiptPath          string
+	ReceiptFileId        string
+	OcrAmount            int64
+	OcrReference         string
+	OcrMismatch          bool
+	ClientEmail          string
+	ClientId             string
+	ClientSubId          string
+	ClientEmails         string
+	PoolBytes            int64
+	SubscriptionId       int    `gorm:"default:0;index"`
+	UpgradeFromOrderId   int    `gorm:"default:0"`
+	ImportRef            string `gorm:"index"`
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+func (shopOrderV1) TableName() string {
+	return "shop_orders"
+}
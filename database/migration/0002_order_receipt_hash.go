@@ -0,0 +1,31 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopOrderV2 is the part of shop_orders this migration touches.
+type shopOrderV2 struct {
+	ReceiptHash string
+}
+
+func (shopOrderV2) TableName() string {
+	return "shop_orders"
+}
+
+// Orders keep the hash of receipts removed by the retention job.
+func init() {
+	Register(Migration{
+		Version: 2,
+		Name:    "order_receipt_hash",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&shopOrderV2{}, "ReceiptHash") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&shopOrderV2{}, "ReceiptHash")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&shopOrderV2{}, "ReceiptHash")
+		},
+	})
+}
@@ -0,0 +1,59 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderArchiveV3 is shop_orders_archive as this migration creates it: the
+// orders table of version 2 and the time an order was archived.
+type shopOrderArchiveV3 struct {
+	Id                   int `gorm:"primaryKey;autoIncrement"`
+	TelegramId           int64
+	Phone                string
+	ContactEmail         string
+	NodeId               int `gorm:"default:0"`
+	InboundId            int
+	PackageId            *int
+	CustomDataGB         int
+	CustomDays           int
+	Price                int64
+	Status               string
+	PaymentDestinationId int `gorm:"default:0;index"`
+	ReceiptPath          string
+	ReceiptFileId        string
+	ReceiptHash          string
+	OcrAmount            int64
+	OcrReference         string
+	OcrMismatch          bool
+	ClientEmail          string
+	ClientId             string
+	ClientSubId          string
+	ClientEmails         string
+	PoolBytes            int64
+	SubscriptionId       int    `gorm:"default:0;index"`
+	UpgradeFromOrderId   int    `gorm:"default:0"`
+	ImportRef            string `gorm:"index"`
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+	ArchivedAt           time.Time `gorm:"index"`
+}
+
+func (shopOrderArchiveV3) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Closed orders are moved to shop_orders_archive so shop_orders stays small.
+func init() {
+	Register(Migration{
+		Version: 3,
+		Name:    "order_archive",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&shopOrderArchiveV3{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&shopOrderArchiveV3{})
+		},
+	})
+}
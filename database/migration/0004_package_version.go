@@ -0,0 +1,31 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopPackageV4 is the part of shop_packages this migration touches.
+type shopPackageV4 struct {
+	Version int `gorm:"default:1"`
+}
+
+func (shopPackageV4) TableName() string {
+	return "shop_packages"
+}
+
+// Packages carry a version so concurrent edits are detected.
+func init() {
+	Register(Migration{
+		Version: 4,
+		Name:    "package_version",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&shopPackageV4{}, "Version") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&shopPackageV4{}, "Version")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&shopPackageV4{}, "Version")
+		},
+	})
+}
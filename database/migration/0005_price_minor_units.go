@@ -0,0 +1,108 @@
+package migration
+
+import (
+	"strconv"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// priceColumns lists the amount columns kept in the shop currency.
+var priceColumns = []struct{ table, column string }{
+	{"shop_packages", "price"},
+	{"shop_orders", "price"},
+	{"shop_orders", "ocr_amount"},
+	{"shop_orders_archive", "price"},
+	{"shop_orders_archive", "ocr_amount"},
+	{"shop_payment_destinations", "daily_cap"},
+}
+
+// minorUnitScales maps the shop currencies with a minor unit to the number of
+// minor units in one whole unit, as of this migration.
+var minorUnitScales = map[string]int64{
+	"USD":  100,
+	"EUR":  100,
+	"GBP":  100,
+	"RUB":  100,
+	"TRY":  100,
+	"AED":  100,
+	"USDT": 100,
+}
+
+// settingsDB returns the database holding the panel settings: tx itself when
+// the shop tables share the panel database, PanelDB otherwise.
+func settingsDB(tx *gorm.DB) *gorm.DB {
+	if tx.Migrator().HasTable(&model.Setting{}) {
+		return tx
+	}
+	return PanelDB
+}
+
+// panelSetting reads a setting, returning "" when it is unset or the panel
+// database is not available.
+func panelSetting(tx *gorm.DB, key string) (string, error) {
+	db := settingsDB(tx)
+	if db == nil {
+		return "", nil
+	}
+	var values []string
+	err := db.Model(&model.Setting{}).Where("key = ?", key).Pluck("value", &values).Error
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// scalePrices multiplies every stored amount by mul and divides it by div.
+func scalePrices(tx *gorm.DB, mul, div int64) error {
+	for _, c := range priceColumns {
+		if !tx.Migrator().HasTable(c.table) {
+			continue
+		}
+		err := tx.Exec("UPDATE "+c.table+" SET "+c.column+" = "+c.column+" * ? / ?", mul, div).Error
+		if err != nil {
+			return err
+		}
+	}
+	value, err := panelSetting(tx, "shopPricePerGB")
+	if err != nil || value == "" {
+		return err
+	}
+	perGb, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return settingsDB(tx).Model(&model.Setting{}).Where("key = ?", "shopPricePerGB").
+		Update("value", strconv.FormatInt(perGb*mul/div, 10)).Error
+}
+
+// Amounts move from whole units to minor units of the configured currency, so
+// prices such as 4.99 USD can be stored exactly. Currencies without a minor
+// unit, and shops without a currency, keep their amounts as they are.
+func init() {
+	Register(Migration{
+		Version: 5,
+		Name:    "price_minor_units",
+		Up: func(tx *gorm.DB) error {
+			currency, err := panelSetting(tx, "shopCurrency")
+			if err != nil {
+				return err
+			}
+			if scale := minorUnitScales[currency]; scale > 1 {
+				return scalePrices(tx, scale, 1)
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			currency, err := panelSetting(tx, "shopCurrency")
+			if err != nil {
+				return err
+			}
+			if scale := minorUnitScales[currency]; scale > 1 {
+				return scalePrices(tx, 1, scale)
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,49 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopInboundV6 is the part of shop_inbounds this migration touches.
+type shopInboundV6 struct {
+	Tags string
+}
+
+func (shopInboundV6) TableName() string {
+	return "shop_inbounds"
+}
+
+// shopPackageV6 is the part of shop_packages this migration touches.
+type shopPackageV6 struct {
+	InboundTag string
+}
+
+func (shopPackageV6) TableName() string {
+	return "shop_packages"
+}
+
+// Inbounds carry tags, and packages can require one to be provisioned on any
+// inbound carrying it.
+func init() {
+	Register(Migration{
+		Version: 6,
+		Name:    "inbound_tags",
+		Up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasColumn(&shopInboundV6{}, "Tags") {
+				if err := tx.Migrator().AddColumn(&shopInboundV6{}, "Tags"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasColumn(&shopPackageV6{}, "InboundTag") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&shopPackageV6{}, "InboundTag")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&shopPackageV6{}, "InboundTag"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&shopInboundV6{}, "Tags")
+		},
+	})
+}
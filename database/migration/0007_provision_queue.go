@@ -0,0 +1,71 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV7 is the part of shop_orders this migration touches.
+type shopOrderV7 struct {
+	ProvisionAttempts int `gorm:"default:0"`
+	ProvisionError    string
+	NextProvisionAt   time.Time `gorm:"index"`
+}
+
+func (shopOrderV7) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV7 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV7 struct {
+	ProvisionAttempts int `gorm:"default:0"`
+	ProvisionError    string
+	NextProvisionAt   time.Time
+}
+
+func (shopOrderArchiveV7) TableName() string {
+	return "shop_orders_archive"
+}
+
+var provisionQueueFields = []string{"ProvisionAttempts", "ProvisionError", "NextProvisionAt"}
+
+// Orders whose provisioning failed are retried by the provisioning queue,
+// which keeps the attempt count, last error and next retry on the order.
+func init() {
+	Register(Migration{
+		Version: 7,
+		Name:    "provision_queue",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV7{}, &shopOrderArchiveV7{}} {
+				for _, field := range provisionQueueFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			if tx.Migrator().HasIndex(&shopOrderV7{}, "NextProvisionAt") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&shopOrderV7{}, "NextProvisionAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasIndex(&shopOrderV7{}, "NextProvisionAt") {
+				if err := tx.Migrator().DropIndex(&shopOrderV7{}, "NextProvisionAt"); err != nil {
+					return err
+				}
+			}
+			for _, table := range []any{&shopOrderArchiveV7{}, &shopOrderV7{}} {
+				for _, field := range provisionQueueFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	})
+}
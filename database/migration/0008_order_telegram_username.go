@@ -0,0 +1,50 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopOrderV8 is the part of shop_orders this migration touches.
+type shopOrderV8 struct {
+	TelegramUsername string
+}
+
+func (shopOrderV8) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV8 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV8 struct {
+	TelegramUsername string
+}
+
+func (shopOrderArchiveV8) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Orders keep the customer's Telegram username for the client naming patterns.
+func init() {
+	Register(Migration{
+		Version: 8,
+		Name:    "order_telegram_username",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV8{}, &shopOrderArchiveV8{}} {
+				if tx.Migrator().HasColumn(table, "TelegramUsername") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "TelegramUsername"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV8{}, &shopOrderV8{}} {
+				if err := tx.Migrator().DropColumn(table, "TelegramUsername"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,70 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV9 is the part of shop_orders this migration touches.
+type shopOrderV9 struct {
+	Seats int `gorm:"default:0"`
+}
+
+func (shopOrderV9) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV9 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV9 struct {
+	Seats int `gorm:"default:0"`
+}
+
+func (shopOrderArchiveV9) TableName() string {
+	return "shop_orders_archive"
+}
+
+// shopOrderClientV9 is shop_order_clients as this migration creates it.
+type shopOrderClientV9 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	OrderId   int `gorm:"index"`
+	Email     string
+	ClientId  string
+	SubId     string
+	CreatedAt time.Time
+}
+
+func (shopOrderClientV9) TableName() string {
+	return "shop_order_clients"
+}
+
+// Bulk orders provision a number of seats at once, and every client an order
+// provisions is kept in shop_order_clients.
+func init() {
+	Register(Migration{
+		Version: 9,
+		Name:    "bulk_orders",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV9{}, &shopOrderArchiveV9{}} {
+				if tx.Migrator().HasColumn(table, "Seats") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "Seats"); err != nil {
+					return err
+				}
+			}
+			return tx.AutoMigrate(&shopOrderClientV9{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&shopOrderClientV9{}); err != nil {
+				return err
+			}
+			for _, table := range []any{&shopOrderArchiveV9{}, &shopOrderV9{}} {
+				if err := tx.Migrator().DropColumn(table, "Seats"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,75 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV10 is the part of shop_orders this migration touches.
+type shopOrderV10 struct {
+	ItemCount int `gorm:"default:0"`
+}
+
+func (shopOrderV10) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV10 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV10 struct {
+	ItemCount int `gorm:"default:0"`
+}
+
+func (shopOrderArchiveV10) TableName() string {
+	return "shop_orders_archive"
+}
+
+// shopOrderItemV10 is shop_order_items as this migration creates it.
+type shopOrderItemV10 struct {
+	Id            int `gorm:"primaryKey;autoIncrement"`
+	OrderId       int `gorm:"index"`
+	PackageId     int
+	Price         int64
+	NodeId        int `gorm:"default:0"`
+	InboundId     int
+	ClientEmail   string
+	ClientId      string
+	ClientSubId   string
+	ProvisionedAt time.Time
+	CreatedAt     time.Time
+}
+
+func (shopOrderItemV10) TableName() string {
+	return "shop_order_items"
+}
+
+// Cart orders buy several packages with one payment, each kept as a row of
+// shop_order_items.
+func init() {
+	Register(Migration{
+		Version: 10,
+		Name:    "order_items",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV10{}, &shopOrderArchiveV10{}} {
+				if tx.Migrator().HasColumn(table, "ItemCount") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "ItemCount"); err != nil {
+					return err
+				}
+			}
+			return tx.AutoMigrate(&shopOrderItemV10{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&shopOrderItemV10{}); err != nil {
+				return err
+			}
+			for _, table := range []any{&shopOrderArchiveV10{}, &shopOrderV10{}} {
+				if err := tx.Migrator().DropColumn(table, "ItemCount"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,53 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV11 is the part of shop_orders this migration touches.
+type shopOrderV11 struct {
+	ReminderSentAt time.Time
+}
+
+func (shopOrderV11) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV11 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV11 struct {
+	ReminderSentAt time.Time
+}
+
+func (shopOrderArchiveV11) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Unpaid orders remember when their customer was reminded to send the receipt,
+// so each order is reminded once.
+func init() {
+	Register(Migration{
+		Version: 11,
+		Name:    "order_reminder",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV11{}, &shopOrderArchiveV11{}} {
+				if tx.Migrator().HasColumn(table, "ReminderSentAt") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "ReminderSentAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV11{}, &shopOrderV11{}} {
+				if err := tx.Migrator().DropColumn(table, "ReminderSentAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,53 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopCustomerV12 is the part of shop_customers this migration touches.
+type shopCustomerV12 struct {
+	Username            string
+	FirstName           string
+	TotalSpent          int64
+	ActiveSubscriptions int  `gorm:"default:0"`
+	Banned              bool `gorm:"default:false"`
+	BanReason           string
+	LastSeenAt          time.Time
+}
+
+func (shopCustomerV12) TableName() string {
+	return "shop_customers"
+}
+
+// shopCustomerV12Columns are the profile columns this migration adds.
+var shopCustomerV12Columns = []string{"Username", "FirstName", "TotalSpent", "ActiveSubscriptions", "Banned", "BanReason", "LastSeenAt"}
+
+// Customers get a profile with their Telegram names, spend, subscriptions and
+// ban status.
+func init() {
+	Register(Migration{
+		Version: 12,
+		Name:    "customer_profile",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range shopCustomerV12Columns {
+				if tx.Migrator().HasColumn(&shopCustomerV12{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&shopCustomerV12{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, column := range shopCustomerV12Columns {
+				if err := tx.Migrator().DropColumn(&shopCustomerV12{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,37 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopSegmentV13 is shop_segments as this migration creates it.
+type shopSegmentV13 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	Name      string
+	Kind      string
+	MinSpent  int64
+	Days      int `gorm:"default:0"`
+	PackageId int `gorm:"default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (shopSegmentV13) TableName() string {
+	return "shop_segments"
+}
+
+// Saved customer segments target broadcasts and CSV exports.
+func init() {
+	Register(Migration{
+		Version: 13,
+		Name:    "segments",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&shopSegmentV13{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&shopSegmentV13{})
+		},
+	})
+}
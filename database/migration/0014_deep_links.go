@@ -0,0 +1,103 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopDeepLinkV14 is shop_deep_links as this migration creates it.
+type shopDeepLinkV14 struct {
+	Id          int    `gorm:"primaryKey;autoIncrement"`
+	Payload     string `gorm:"uniqueIndex"`
+	Clicks      int64  `gorm:"default:0"`
+	LastClickAt time.Time
+	CreatedAt   time.Time
+}
+
+func (shopDeepLinkV14) TableName() string {
+	return "shop_deep_links"
+}
+
+// shopCustomerV14 is the part of shop_customers this migration touches.
+type shopCustomerV14 struct {
+	ReferralCode string
+	DeepLink     string
+	DeepLinkAt   time.Time
+}
+
+func (shopCustomerV14) TableName() string {
+	return "shop_customers"
+}
+
+// shopOrderV14 is the part of shop_orders this migration touches.
+type shopOrderV14 struct {
+	DeepLink string `gorm:"index"`
+}
+
+func (shopOrderV14) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV14 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV14 struct {
+	DeepLink string `gorm:"index"`
+}
+
+func (shopOrderArchiveV14) TableName() string {
+	return "shop_orders_archive"
+}
+
+// shopCustomerV14Columns are the customer columns this migration adds.
+var shopCustomerV14Columns = []string{"ReferralCode", "DeepLink", "DeepLinkAt"}
+
+// Bot deep links count their clicks, and customers and orders remember the
+// link they came from.
+func init() {
+	Register(Migration{
+		Version: 14,
+		Name:    "deep_links",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&shopDeepLinkV14{}); err != nil {
+				return err
+			}
+			for _, column := range shopCustomerV14Columns {
+				if tx.Migrator().HasColumn(&shopCustomerV14{}, column) {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(&shopCustomerV14{}, column); err != nil {
+					return err
+				}
+			}
+			for _, table := range []any{&shopOrderV14{}, &shopOrderArchiveV14{}} {
+				if !tx.Migrator().HasColumn(table, "DeepLink") {
+					if err := tx.Migrator().AddColumn(table, "DeepLink"); err != nil {
+						return err
+					}
+				}
+				if !tx.Migrator().HasIndex(table, "DeepLink") {
+					if err := tx.Migrator().CreateIndex(table, "DeepLink"); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV14{}, &shopOrderV14{}} {
+				if err := tx.Migrator().DropIndex(table, "DeepLink"); err != nil {
+					return err
+				}
+				if err := tx.Migrator().DropColumn(table, "DeepLink"); err != nil {
+					return err
+				}
+			}
+			for _, column := range shopCustomerV14Columns {
+				if err := tx.Migrator().DropColumn(&shopCustomerV14{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropTable(&shopDeepLinkV14{})
+		},
+	})
+}
@@ -0,0 +1,47 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderStatusV15 is shop_order_statuses as this migration creates it.
+type shopOrderStatusV15 struct {
+	Id             int    `gorm:"primaryKey;autoIncrement"`
+	Code           string `gorm:"uniqueIndex"`
+	Label          string
+	Color          string
+	NotifyCustomer bool
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+func (shopOrderStatusV15) TableName() string {
+	return "shop_order_statuses"
+}
+
+// shopOrderTransitionV15 is shop_order_transitions as this migration creates it.
+type shopOrderTransitionV15 struct {
+	Id         int    `gorm:"primaryKey;autoIncrement"`
+	FromStatus string `gorm:"index"`
+	ToStatus   string
+}
+
+func (shopOrderTransitionV15) TableName() string {
+	return "shop_order_transitions"
+}
+
+// Admin-defined order statuses and the transitions allowed between them.
+func init() {
+	Register(Migration{
+		Version: 15,
+		Name:    "order_workflow",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&shopOrderStatusV15{}, &shopOrderTransitionV15{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&shopOrderStatusV15{}, &shopOrderTransitionV15{})
+		},
+	})
+}
@@ -0,0 +1,60 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV16 is the part of shop_orders this migration touches.
+type shopOrderV16 struct {
+	ScheduledAt time.Time `gorm:"index"`
+}
+
+func (shopOrderV16) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV16 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV16 struct {
+	ScheduledAt time.Time
+}
+
+func (shopOrderArchiveV16) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Approved orders can be scheduled to be provisioned at a later time.
+func init() {
+	Register(Migration{
+		Version: 16,
+		Name:    "order_schedule",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV16{}, &shopOrderArchiveV16{}} {
+				if tx.Migrator().HasColumn(table, "ScheduledAt") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "ScheduledAt"); err != nil {
+					return err
+				}
+			}
+			if tx.Migrator().HasIndex(&shopOrderV16{}, "ScheduledAt") {
+				return nil
+			}
+			return tx.Migrator().CreateIndex(&shopOrderV16{}, "ScheduledAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			if tx.Migrator().HasIndex(&shopOrderV16{}, "ScheduledAt") {
+				if err := tx.Migrator().DropIndex(&shopOrderV16{}, "ScheduledAt"); err != nil {
+					return err
+				}
+			}
+			for _, table := range []any{&shopOrderArchiveV16{}, &shopOrderV16{}} {
+				if err := tx.Migrator().DropColumn(table, "ScheduledAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,59 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopOrderV17 is the part of shop_orders this migration touches.
+type shopOrderV17 struct {
+	OriginalPrice int64 `gorm:"default:0"`
+	PriceNote     string
+}
+
+func (shopOrderV17) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV17 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV17 struct {
+	OriginalPrice int64 `gorm:"default:0"`
+	PriceNote     string
+}
+
+func (shopOrderArchiveV17) TableName() string {
+	return "shop_orders_archive"
+}
+
+var priceOverrideFields = []string{"OriginalPrice", "PriceNote"}
+
+// Admins can change the price charged for an order when approving it. The
+// order keeps the price it was placed at and the admin's reason.
+func init() {
+	Register(Migration{
+		Version: 17,
+		Name:    "order_price_override",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV17{}, &shopOrderArchiveV17{}} {
+				for _, field := range priceOverrideFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV17{}, &shopOrderV17{}} {
+				for _, field := range priceOverrideFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	})
+}
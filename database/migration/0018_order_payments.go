@@ -0,0 +1,78 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderPaymentV18 is shop_order_payments as this migration creates it.
+type shopOrderPaymentV18 struct {
+	Id        int `gorm:"primaryKey;autoIncrement"`
+	OrderId   int `gorm:"index"`
+	Amount    int64
+	Note      string
+	Author    string
+	CreatedAt time.Time
+}
+
+func (shopOrderPaymentV18) TableName() string {
+	return "shop_order_payments"
+}
+
+// shopOrderV18 is the part of shop_orders this migration touches.
+type shopOrderV18 struct {
+	PaidAmount     int64 `gorm:"default:0"`
+	WithheldDataGB int   `gorm:"default:0"`
+}
+
+func (shopOrderV18) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV18 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV18 struct {
+	PaidAmount     int64 `gorm:"default:0"`
+	WithheldDataGB int   `gorm:"default:0"`
+}
+
+func (shopOrderArchiveV18) TableName() string {
+	return "shop_orders_archive"
+}
+
+var orderPaymentFields = []string{"PaidAmount", "WithheldDataGB"}
+
+// Orders can be paid in installments. Each payment is kept on its own and the
+// order carries their sum and the traffic held back until it is fully paid.
+func init() {
+	Register(Migration{
+		Version: 18,
+		Name:    "order_payments",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&shopOrderPaymentV18{}); err != nil {
+				return err
+			}
+			for _, table := range []any{&shopOrderV18{}, &shopOrderArchiveV18{}} {
+				for _, field := range orderPaymentFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV18{}, &shopOrderV18{}} {
+				for _, field := range orderPaymentFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return tx.Migrator().DropTable(&shopOrderPaymentV18{})
+		},
+	})
+}
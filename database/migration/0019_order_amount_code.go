@@ -0,0 +1,51 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopOrderV19 is the part of shop_orders this migration touches.
+type shopOrderV19 struct {
+	AmountCode int64 `gorm:"default:0"`
+}
+
+func (shopOrderV19) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV19 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV19 struct {
+	AmountCode int64 `gorm:"default:0"`
+}
+
+func (shopOrderArchiveV19) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Orders awaiting payment get a small code added to their price so every
+// open order has a unique amount to match bank transfers by.
+func init() {
+	Register(Migration{
+		Version: 19,
+		Name:    "order_amount_code",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV19{}, &shopOrderArchiveV19{}} {
+				if tx.Migrator().HasColumn(table, "AmountCode") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "AmountCode"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV19{}, &shopOrderV19{}} {
+				if err := tx.Migrator().DropColumn(table, "AmountCode"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,59 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopOrderV20 is the part of shop_orders this migration touches.
+type shopOrderV20 struct {
+	HoldReason     string
+	HeldFromStatus string
+}
+
+func (shopOrderV20) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV20 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV20 struct {
+	HoldReason     string
+	HeldFromStatus string
+}
+
+func (shopOrderArchiveV20) TableName() string {
+	return "shop_orders_archive"
+}
+
+var orderHoldFields = []string{"HoldReason", "HeldFromStatus"}
+
+// Admins can put an order on hold while they wait for the customer. The order
+// keeps the question asked and the status it resumes to.
+func init() {
+	Register(Migration{
+		Version: 20,
+		Name:    "order_hold",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV20{}, &shopOrderArchiveV20{}} {
+				for _, field := range orderHoldFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV20{}, &shopOrderV20{}} {
+				for _, field := range orderHoldFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,105 @@
+package migration
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV21 is the part of shop_orders this migration touches.
+type shopOrderV21 struct {
+	Id        int
+	Number    string `gorm:"index"`
+	CreatedAt time.Time
+}
+
+func (shopOrderV21) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV21 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV21 struct {
+	Id        int
+	Number    string `gorm:"index"`
+	CreatedAt time.Time
+}
+
+func (shopOrderArchiveV21) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Orders get a random number customers can quote instead of their
+// auto-increment ID, which would reveal how many orders the shop takes.
+// Existing orders, live and archived, are numbered too.
+func init() {
+	Register(Migration{
+		Version: 21,
+		Name:    "order_number",
+		Up: func(tx *gorm.DB) error {
+			taken := map[string]bool{}
+			for _, table := range []any{&shopOrderV21{}, &shopOrderArchiveV21{}} {
+				if !tx.Migrator().HasColumn(table, "Number") {
+					if err := tx.Migrator().AddColumn(table, "Number"); err != nil {
+						return err
+					}
+				}
+				if !tx.Migrator().HasIndex(table, "Number") {
+					if err := tx.Migrator().CreateIndex(table, "Number"); err != nil {
+						return err
+					}
+				}
+				var numbers []string
+				if err := tx.Model(table).Where("number <> ''").Pluck("number", &numbers).Error; err != nil {
+					return err
+				}
+				for _, number := range numbers {
+					taken[number] = true
+				}
+			}
+			for _, table := range []string{"shop_orders", "shop_orders_archive"} {
+				var orders []shopOrderV21
+				if err := tx.Table(table).Where("number IS NULL OR number = ''").Order("id asc").Find(&orders).Error; err != nil {
+					return err
+				}
+				for _, order := range orders {
+					number, err := orderNumberV21(order.CreatedAt, taken)
+					if err != nil {
+						return err
+					}
+					if err := tx.Table(table).Where("id = ?", order.Id).Update("number", number).Error; err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV21{}, &shopOrderV21{}} {
+				if err := tx.Migrator().DropColumn(table, "Number"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// orderNumberV21 picks an order number of the year an order was created in
+// that is not taken yet, with more digits once six are crowded.
+func orderNumberV21(created time.Time, taken map[string]bool) (string, error) {
+	for attempt := 0; ; attempt++ {
+		digits := 6 + attempt/100
+		n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil))
+		if err != nil {
+			return "", err
+		}
+		number := fmt.Sprintf("ORD-%d-%0*d", created.Year(), digits, n.Int64())
+		if !taken[number] {
+			taken[number] = true
+			return number, nil
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV22 is the part of shop_orders this migration touches.
+type shopOrderV22 struct {
+	DeadlineWarnedAt time.Time
+}
+
+func (shopOrderV22) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV22 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV22 struct {
+	DeadlineWarnedAt time.Time
+}
+
+func (shopOrderArchiveV22) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Unpaid orders can be given a deadline for their receipt. An order records
+// when its customer was warned that half of it is gone.
+func init() {
+	Register(Migration{
+		Version: 22,
+		Name:    "receipt_deadline",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV22{}, &shopOrderArchiveV22{}} {
+				if tx.Migrator().HasColumn(table, "DeadlineWarnedAt") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "DeadlineWarnedAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV22{}, &shopOrderV22{}} {
+				if err := tx.Migrator().DropColumn(table, "DeadlineWarnedAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
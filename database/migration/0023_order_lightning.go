@@ -0,0 +1,75 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV23 is the part of shop_orders this migration touches.
+type shopOrderV23 struct {
+	LightningHash      string `gorm:"index"`
+	LightningInvoice   string
+	LightningSats      int64 `gorm:"default:0"`
+	LightningInvoiceAt time.Time
+}
+
+func (shopOrderV23) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV23 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV23 struct {
+	LightningHash      string `gorm:"index"`
+	LightningInvoice   string
+	LightningSats      int64 `gorm:"default:0"`
+	LightningInvoiceAt time.Time
+}
+
+func (shopOrderArchiveV23) TableName() string {
+	return "shop_orders_archive"
+}
+
+var orderLightningFields = []string{"LightningHash", "LightningInvoice", "LightningSats", "LightningInvoiceAt"}
+
+// Orders can be paid with a Lightning invoice. An order keeps its open
+// invoice so the customer is not billed twice and the payment can be watched.
+func init() {
+	Register(Migration{
+		Version: 23,
+		Name:    "order_lightning",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV23{}, &shopOrderArchiveV23{}} {
+				for _, field := range orderLightningFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+				if !tx.Migrator().HasIndex(table, "LightningHash") {
+					if err := tx.Migrator().CreateIndex(table, "LightningHash"); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV23{}, &shopOrderV23{}} {
+				if tx.Migrator().HasIndex(table, "LightningHash") {
+					if err := tx.Migrator().DropIndex(table, "LightningHash"); err != nil {
+						return err
+					}
+				}
+				for _, field := range orderLightningFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	})
+}
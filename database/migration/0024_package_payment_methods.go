@@ -0,0 +1,31 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopPackageV24 is the part of shop_packages this migration touches.
+type shopPackageV24 struct {
+	PaymentMethods string
+}
+
+func (shopPackageV24) TableName() string {
+	return "shop_packages"
+}
+
+// Packages can restrict the payment methods their orders are offered.
+func init() {
+	Register(Migration{
+		Version: 24,
+		Name:    "package_payment_methods",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&shopPackageV24{}, "PaymentMethods") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&shopPackageV24{}, "PaymentMethods")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&shopPackageV24{}, "PaymentMethods")
+		},
+	})
+}
@@ -0,0 +1,71 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV25 is the part of shop_orders this migration touches.
+type shopOrderV25 struct {
+	ChargebackAt     time.Time `gorm:"index"`
+	ChargebackReason string
+}
+
+func (shopOrderV25) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV25 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV25 struct {
+	ChargebackAt     time.Time `gorm:"index"`
+	ChargebackReason string
+}
+
+func (shopOrderArchiveV25) TableName() string {
+	return "shop_orders_archive"
+}
+
+var orderChargebackFields = []string{"ChargebackAt", "ChargebackReason"}
+
+// Orders whose payment was reversed are marked as charged back, keeping when
+// and why so revenue reports can account for them.
+func init() {
+	Register(Migration{
+		Version: 25,
+		Name:    "order_chargeback",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV25{}, &shopOrderArchiveV25{}} {
+				for _, field := range orderChargebackFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+				if !tx.Migrator().HasIndex(table, "ChargebackAt") {
+					if err := tx.Migrator().CreateIndex(table, "ChargebackAt"); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV25{}, &shopOrderV25{}} {
+				if tx.Migrator().HasIndex(table, "ChargebackAt") {
+					if err := tx.Migrator().DropIndex(table, "ChargebackAt"); err != nil {
+						return err
+					}
+				}
+				for _, field := range orderChargebackFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,35 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopRevenueGoalV26 is shop_revenue_goals as this migration creates it.
+type shopRevenueGoalV26 struct {
+	Id        int    `gorm:"primaryKey;autoIncrement"`
+	Month     string `gorm:"uniqueIndex"`
+	Amount    int64
+	ReachedAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (shopRevenueGoalV26) TableName() string {
+	return "shop_revenue_goals"
+}
+
+// Admins can set a revenue goal per month and are told when it is reached.
+func init() {
+	Register(Migration{
+		Version: 26,
+		Name:    "revenue_goals",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&shopRevenueGoalV26{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&shopRevenueGoalV26{})
+		},
+	})
+}
@@ -0,0 +1,65 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV27 is the part of shop_orders this migration touches.
+type shopOrderV27 struct {
+	FirstApprover    string
+	FirstApprovedAt  time.Time
+	SecondApprover   string
+	SecondApprovedAt time.Time
+}
+
+func (shopOrderV27) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV27 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV27 struct {
+	FirstApprover    string
+	FirstApprovedAt  time.Time
+	SecondApprover   string
+	SecondApprovedAt time.Time
+}
+
+func (shopOrderArchiveV27) TableName() string {
+	return "shop_orders_archive"
+}
+
+var orderSecondApprovalFields = []string{"FirstApprover", "FirstApprovedAt", "SecondApprover", "SecondApprovedAt"}
+
+// Orders above the second approval price record the two admins who approved
+// them, and when.
+func init() {
+	Register(Migration{
+		Version: 27,
+		Name:    "order_second_approval",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV27{}, &shopOrderArchiveV27{}} {
+				for _, field := range orderSecondApprovalFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV27{}, &shopOrderV27{}} {
+				for _, field := range orderSecondApprovalFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	})
+}
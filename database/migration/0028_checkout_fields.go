@@ -0,0 +1,74 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopCheckoutFieldV28 is shop_checkout_fields as this migration creates it.
+type shopCheckoutFieldV28 struct {
+	Id         int `gorm:"primaryKey;autoIncrement"`
+	Label      string
+	Kind       string
+	Options    string
+	Required   bool
+	PackageIds string
+	SortOrder  int `gorm:"default:0"`
+	Enabled    bool
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (shopCheckoutFieldV28) TableName() string {
+	return "shop_checkout_fields"
+}
+
+// shopOrderV28 is the part of shop_orders this migration touches.
+type shopOrderV28 struct {
+	CustomFields string
+}
+
+func (shopOrderV28) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV28 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV28 struct {
+	CustomFields string
+}
+
+func (shopOrderArchiveV28) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Admins can define extra questions the bot asks at checkout, whose answers
+// are stored on the order.
+func init() {
+	Register(Migration{
+		Version: 28,
+		Name:    "checkout_fields",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&shopCheckoutFieldV28{}); err != nil {
+				return err
+			}
+			for _, table := range []any{&shopOrderV28{}, &shopOrderArchiveV28{}} {
+				if tx.Migrator().HasColumn(table, "CustomFields") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "CustomFields"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV28{}, &shopOrderV28{}} {
+				if err := tx.Migrator().DropColumn(table, "CustomFields"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropTable(&shopCheckoutFieldV28{})
+		},
+	})
+}
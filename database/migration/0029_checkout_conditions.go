@@ -0,0 +1,32 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopCheckoutFieldV29 is the part of shop_checkout_fields this migration touches.
+type shopCheckoutFieldV29 struct {
+	ShowIf string
+}
+
+func (shopCheckoutFieldV29) TableName() string {
+	return "shop_checkout_fields"
+}
+
+// Checkout fields can be asked only when the order's package or an earlier
+// answer meets a condition.
+func init() {
+	Register(Migration{
+		Version: 29,
+		Name:    "checkout_conditions",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&shopCheckoutFieldV29{}, "ShowIf") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&shopCheckoutFieldV29{}, "ShowIf")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&shopCheckoutFieldV29{}, "ShowIf")
+		},
+	})
+}
@@ -0,0 +1,37 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopConfigTemplateV30 is shop_config_templates as this migration creates it.
+type shopConfigTemplateV30 struct {
+	Id        int    `gorm:"primaryKey;autoIncrement"`
+	Protocol  string `gorm:"index"`
+	FileName  string
+	Body      string
+	Enabled   bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (shopConfigTemplateV30) TableName() string {
+	return "shop_config_templates"
+}
+
+// Approved orders can be sent ready-made config files rendered from a
+// template per inbound protocol.
+func init() {
+	Register(Migration{
+		Version: 30,
+		Name:    "config_templates",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&shopConfigTemplateV30{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&shopConfigTemplateV30{})
+		},
+	})
+}
@@ -0,0 +1,39 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopShortLinkV31 is shop_short_links as this migration creates it.
+type shopShortLinkV31 struct {
+	Id        int    `gorm:"primaryKey;autoIncrement"`
+	Token     string `gorm:"uniqueIndex"`
+	OrderId   int    `gorm:"index"`
+	Email     string
+	TargetUrl string
+	ExpiresAt time.Time
+	Hits      int64 `gorm:"default:0"`
+	LastHitAt time.Time
+	RevokedAt time.Time
+	CreatedAt time.Time
+}
+
+func (shopShortLinkV31) TableName() string {
+	return "shop_short_links"
+}
+
+// Customers can be sent short links redirecting to their subscription URLs.
+func init() {
+	Register(Migration{
+		Version: 31,
+		Name:    "short_links",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&shopShortLinkV31{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&shopShortLinkV31{})
+		},
+	})
+}
@@ -0,0 +1,34 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderPauseV32 is shop_order_pauses as this migration creates it.
+type shopOrderPauseV32 struct {
+	Id           int `gorm:"primaryKey;autoIncrement"`
+	OrderId      int `gorm:"index"`
+	FreezeExpiry bool
+	PausedAt     time.Time
+	ResumedAt    time.Time
+}
+
+func (shopOrderPauseV32) TableName() string {
+	return "shop_order_pauses"
+}
+
+// Customers can pause the clients of their orders and resume them later.
+func init() {
+	Register(Migration{
+		Version: 32,
+		Name:    "order_pauses",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&shopOrderPauseV32{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&shopOrderPauseV32{})
+		},
+	})
+}
@@ -0,0 +1,31 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopSubscriptionV33 is the part of shop_subscriptions this migration touches.
+type shopSubscriptionV33 struct {
+	NextPackageId int `gorm:"default:0"`
+}
+
+func (shopSubscriptionV33) TableName() string {
+	return "shop_subscriptions"
+}
+
+// Customers can schedule a downgrade that their next renewal applies.
+func init() {
+	Register(Migration{
+		Version: 33,
+		Name:    "subscription_downgrade",
+		Up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&shopSubscriptionV33{}, "NextPackageId") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&shopSubscriptionV33{}, "NextPackageId")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&shopSubscriptionV33{}, "NextPackageId")
+		},
+	})
+}
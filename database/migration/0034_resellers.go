@@ -0,0 +1,108 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopResellerV34 is shop_resellers as this migration creates it.
+type shopResellerV34 struct {
+	Id                int `gorm:"primaryKey;autoIncrement"`
+	Name              string
+	KeyHash           string `gorm:"uniqueIndex"`
+	KeyPrefix         string
+	CommissionPercent int   `gorm:"default:0"`
+	Balance           int64 `gorm:"default:0"`
+	Enabled           bool  `gorm:"default:true"`
+	LastUsedAt        time.Time
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+func (shopResellerV34) TableName() string {
+	return "shop_resellers"
+}
+
+// shopResellerEntryV34 is shop_reseller_entries as this migration creates it.
+type shopResellerEntryV34 struct {
+	Id         int `gorm:"primaryKey;autoIncrement"`
+	ResellerId int `gorm:"index"`
+	OrderId    int `gorm:"default:0"`
+	Amount     int64
+	Commission int64 `gorm:"default:0"`
+	Balance    int64
+	Note       string
+	CreatedAt  time.Time
+}
+
+func (shopResellerEntryV34) TableName() string {
+	return "shop_reseller_entries"
+}
+
+// shopOrderV34 is the part of shop_orders this migration touches.
+type shopOrderV34 struct {
+	ResellerId  int `gorm:"default:0;index"`
+	ResellerRef string
+}
+
+func (shopOrderV34) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV34 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV34 struct {
+	ResellerId  int `gorm:"default:0;index"`
+	ResellerRef string
+}
+
+func (shopOrderArchiveV34) TableName() string {
+	return "shop_orders_archive"
+}
+
+var orderResellerFields = []string{"ResellerId", "ResellerRef"}
+
+// Resellers order through their own API keys and pay from a prepaid balance.
+// Their orders record the reseller and its reference for them.
+func init() {
+	Register(Migration{
+		Version: 34,
+		Name:    "resellers",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&shopResellerV34{}, &shopResellerEntryV34{}); err != nil {
+				return err
+			}
+			for _, table := range []any{&shopOrderV34{}, &shopOrderArchiveV34{}} {
+				for _, field := range orderResellerFields {
+					if tx.Migrator().HasColumn(table, field) {
+						continue
+					}
+					if err := tx.Migrator().AddColumn(table, field); err != nil {
+						return err
+					}
+				}
+				if !tx.Migrator().HasIndex(table, "ResellerId") {
+					if err := tx.Migrator().CreateIndex(table, "ResellerId"); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV34{}, &shopOrderV34{}} {
+				if tx.Migrator().HasIndex(table, "ResellerId") {
+					if err := tx.Migrator().DropIndex(table, "ResellerId"); err != nil {
+						return err
+					}
+				}
+				for _, field := range orderResellerFields {
+					if err := tx.Migrator().DropColumn(table, field); err != nil {
+						return err
+					}
+				}
+			}
+			return tx.Migrator().DropTable(&shopResellerEntryV34{}, &shopResellerV34{})
+		},
+	})
+}
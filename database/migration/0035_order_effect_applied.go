@@ -0,0 +1,53 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV35 is the part of shop_orders this migration touches.
+type shopOrderV35 struct {
+	EffectAppliedAt time.Time
+}
+
+func (shopOrderV35) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV35 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV35 struct {
+	EffectAppliedAt time.Time
+}
+
+func (shopOrderArchiveV35) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Renewals, upgrades and top-ups record when they were applied to their
+// client, so a provisioning retry does not apply them again.
+func init() {
+	Register(Migration{
+		Version: 35,
+		Name:    "order_effect_applied",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV35{}, &shopOrderArchiveV35{}} {
+				if tx.Migrator().HasColumn(table, "EffectAppliedAt") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "EffectAppliedAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV35{}, &shopOrderV35{}} {
+				if err := tx.Migrator().DropColumn(table, "EffectAppliedAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,27 @@
+package migration
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// Catalog sync reads the primary panel's catalog with a catalog token instead
+// of logging in as its admin, so the stored admin login is removed. It cannot
+// be brought back on the way down.
+func init() {
+	Register(Migration{
+		Version: 36,
+		Name:    "drop_sync_credentials",
+		Up: func(tx *gorm.DB) error {
+			db := settingsDB(tx)
+			if db == nil {
+				return nil
+			}
+			return db.Where("key IN ?", []string{"shopSyncUsername", "shopSyncPassword"}).Delete(&model.Setting{}).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			return nil
+		},
+	})
+}
@@ -0,0 +1,51 @@
+package migration
+
+import (
+	"gorm.io/gorm"
+)
+
+// shopOrderV37 is the part of shop_orders this migration touches.
+type shopOrderV37 struct {
+	UpgradeCredit int64 `gorm:"default:0"`
+}
+
+func (shopOrderV37) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV37 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV37 struct {
+	UpgradeCredit int64 `gorm:"default:0"`
+}
+
+func (shopOrderArchiveV37) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Upgrades record the credit they were given, so upgrading an upgraded plan
+// credits what was paid for it in all.
+func init() {
+	Register(Migration{
+		Version: 37,
+		Name:    "upgrade_credit",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV37{}, &shopOrderArchiveV37{}} {
+				if tx.Migrator().HasColumn(table, "UpgradeCredit") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "UpgradeCredit"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV37{}, &shopOrderV37{}} {
+				if err := tx.Migrator().DropColumn(table, "UpgradeCredit"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,53 @@
+package migration
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderV38 is the part of shop_orders this migration touches.
+type shopOrderV38 struct {
+	ProvisionClaimedAt time.Time
+}
+
+func (shopOrderV38) TableName() string {
+	return "shop_orders"
+}
+
+// shopOrderArchiveV38 is the part of shop_orders_archive this migration touches.
+type shopOrderArchiveV38 struct {
+	ProvisionClaimedAt time.Time
+}
+
+func (shopOrderArchiveV38) TableName() string {
+	return "shop_orders_archive"
+}
+
+// Orders are claimed for provisioning in the database, so panels sharing an
+// external shop database do not provision the same order twice.
+func init() {
+	Register(Migration{
+		Version: 38,
+		Name:    "provision_claim",
+		Up: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderV38{}, &shopOrderArchiveV38{}} {
+				if tx.Migrator().HasColumn(table, "ProvisionClaimedAt") {
+					continue
+				}
+				if err := tx.Migrator().AddColumn(table, "ProvisionClaimedAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, table := range []any{&shopOrderArchiveV38{}, &shopOrderV38{}} {
+				if err := tx.Migrator().DropColumn(table, "ProvisionClaimedAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+}
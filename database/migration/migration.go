@@ -0,0 +1,146 @@
+// Package migration applies versioned schema migrations to the shop tables.
+//
+// Every migration lives in its own file named after its version and registers
+// itself from init. Migrations run in version order, each in a transaction, and
+// applied versions are recorded in the shop_schema_migrations table so every
+// migration runs once per database. Migrations must be written against the
+// tables as they were at that version: add columns with Migrator().AddColumn
+// guarded by HasColumn rather than by re-running AutoMigrate on the current
+// models.
+package migration
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// Status reports whether a registered migration has been applied.
+type Status struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Applied   bool      `json:"applied"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// appliedMigration is a row of the shop_schema_migrations table.
+type appliedMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (appliedMigration) TableName() string {
+	return "shop_schema_migrations"
+}
+
+var migrations []Migration
+
+// PanelDB is the panel database. Migrations that depend on panel settings read
+// them from here, since the shop tables may live in an external database.
+var PanelDB *gorm.DB
+
+// Register adds a migration. It panics on duplicate versions so mistakes are
+// caught at startup.
+func Register(m Migration) {
+	for _, existing := range migrations {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("migration %d registered twice", m.Version))
+		}
+	}
+	migrations = append(migrations, m)
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+}
+
+func applied(db *gorm.DB) (map[int]appliedMigration, error) {
+	if err := db.AutoMigrate(&appliedMigration{}); err != nil {
+		return nil, err
+	}
+	var rows []appliedMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	done := make(map[int]appliedMigration, len(rows))
+	for _, row := range rows {
+		done[row.Version] = row
+	}
+	return done, nil
+}
+
+// Up applies every pending migration in version order.
+func Up(db *gorm.DB) error {
+	done, err := applied(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if _, ok := done[m.Version]; ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&appliedMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied shop migration %d %s", m.Version, m.Name)
+	}
+	return nil
+}
+
+// Down reverts the most recently applied migrations, newest first.
+func Down(db *gorm.DB, steps int) error {
+	done, err := applied(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := done[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return fmt.Errorf("migration %d %s cannot be reverted", m.Version, m.Name)
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&appliedMigration{Version: m.Version}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("revert migration %d %s: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Reverted shop migration %d %s", m.Version, m.Name)
+		steps--
+	}
+	return nil
+}
+
+// List returns the registered migrations and whether each has been applied.
+func List(db *gorm.DB) ([]Status, error) {
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Status, 0, len(migrations))
+	for _, m := range migrations {
+		row, ok := done[m.Version]
+		result = append(result, Status{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: row.AppliedAt})
+	}
+	return result, nil
+}
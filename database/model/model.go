@@ -126,40 +126,417 @@ type Client struct {
 
 // ShopPackage defines pre-built packages for users to purchase.
 type ShopPackage struct {
-	Id           int       `json:"id" gorm:"primaryKey;autoIncrement"`
-	Name         string    `json:"name"`
-	DataGB       int       `json:"dataGb"`
-	DurationDays int       `json:"durationDays"`
-	Price        int64     `json:"price"`
-	IsActive     bool      `json:"isActive" gorm:"default:true"`
-	CreatedAt    time.Time `json:"createdAt"`
-	UpdatedAt    time.Time `json:"updatedAt"`
+	Id             int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name           string    `json:"name" form:"name"`
+	DataGB         int       `json:"dataGb" form:"dataGb"`
+	DurationDays   int       `json:"durationDays" form:"durationDays"`
+	Price          int64     `json:"price" form:"price"`
+	Type           string    `json:"type" form:"type" gorm:"default:standard"` // standard or pooled
+	Devices        int       `json:"devices" form:"devices" gorm:"default:1"`  // Clients sharing the traffic of a pooled package
+	BillingCycle   string    `json:"billingCycle" form:"billingCycle"`         // weekly, monthly or quarterly for recurring packages
+	IsActive       bool      `json:"isActive" form:"isActive" gorm:"default:true"`
+	IsArchived     bool      `json:"isArchived" form:"isArchived" gorm:"default:false;index"` // Archived packages stay resolvable for past orders
+	SortOrder      int       `json:"sortOrder" form:"sortOrder" gorm:"default:0;index"`       // Display position in the bot and storefront
+	CategoryId     int       `json:"categoryId" form:"categoryId" gorm:"default:0;index"`     // Owning ShopCategory, 0 when uncategorized
+	Description    string    `json:"description" form:"description"`                          // Markdown shown as the photo caption in the bot
+	ImageUrl       string    `json:"imageUrl" form:"imageUrl"`                                // Banner image URL or Telegram file ID
+	Version        int       `json:"version" form:"version" gorm:"default:1"`                 // Incremented on every change to detect concurrent edits
+	InboundTag     string    `json:"inboundTag" form:"inboundTag"`                            // Provision on any inbound with this tag instead of the customer's choice
+	PaymentMethods string    `json:"paymentMethods" form:"paymentMethods"`                    // Comma-separated payment methods offered for the package, empty for all
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// ShopCategory groups packages in the bot menu (e.g. "Monthly", "Data-only").
+type ShopCategory struct {
+	Id        int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string    `json:"name" form:"name"`
+	SortOrder int       `json:"sortOrder" form:"sortOrder" gorm:"default:0"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ShopNode is a remote x-ui panel whose inbounds can be sold by this shop.
+type ShopNode struct {
+	Id        int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string    `json:"name" form:"name"`
+	Url       string    `json:"url" form:"url"` // Panel root URL including the web base path
+	Username  string    `json:"username" form:"username"`
+	Password  string    `json:"password,omitempty" form:"password"`
+	SubUri    string    `json:"subUri" form:"subUri"` // Subscription URI prefix sent to customers
+	Enabled   bool      `json:"enabled" form:"enabled"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 // ShopInbound marks which inbounds are available for user orders.
 type ShopInbound struct {
+	Id         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	NodeId     int       `json:"nodeId" gorm:"default:0;uniqueIndex:idx_shop_inbound_node,priority:1"` // 0 for local inbounds
+	InboundId  int       `json:"inboundId" gorm:"uniqueIndex:idx_shop_inbound_node,priority:2"`
+	Enabled    bool      `json:"enabled" gorm:"default:true"`
+	MaxClients int       `json:"maxClients" gorm:"default:0"` // 0 means unlimited
+	Tags       string    `json:"tags"`                        // Comma-separated lower-case tags packages can require
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ShopAbuseLog records a customer who went over a bot rate limit.
+type ShopAbuseLog struct {
+	Id         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	TelegramId int64     `json:"telegramId" gorm:"index"`
+	Kind       string    `json:"kind"` // message, order or receipt
+	Detail     string    `json:"detail"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ShopConversation stores a customer's unfinished bot order flow so it survives restarts.
+type ShopConversation struct {
+	TelegramId int64     `json:"telegramId" gorm:"primaryKey;autoIncrement:false"`
+	State      string    `json:"state"` // Pending bot input, e.g. shop_receipt_<orderId>
+	Draft      string    `json:"draft"` // JSON of the order being assembled
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ShopCustomer is the profile of a shop bot customer, kept up to date from their
+// bot interactions and orders.
+type ShopCustomer struct {
+	TelegramId          int64     `json:"telegramId" form:"telegramId" gorm:"primaryKey;autoIncrement:false"`
+	Username            string    `json:"username"`                                  // Telegram username, without the @
+	FirstName           string    `json:"firstName"`                                 // Telegram first name
+	Language            string    `json:"language" form:"language"`                  // Bot language code, e.g. en or fa
+	TotalSpent          int64     `json:"totalSpent"`                                // Sum of the customer's approved orders, archived ones included
+	ActiveSubscriptions int       `json:"activeSubscriptions" gorm:"default:0"`      // Recurring subscriptions currently active
+	Banned              bool      `json:"banned" form:"banned" gorm:"default:false"` // Banned customers cannot use the shop bot
+	BanReason           string    `json:"banReason" form:"banReason"`                // Admin note on why the customer was banned
+	LastSeenAt          time.Time `json:"lastSeenAt"`                                // Last interaction with the bot
+	ReferralCode        string    `json:"referralCode"`                              // Code of the first ref_ deep link the customer opened
+	DeepLink            string    `json:"deepLink"`                                  // Last deep link the customer opened the bot with
+	DeepLinkAt          time.Time `json:"deepLinkAt"`                                // When the customer last opened a deep link
+	CreatedAt           time.Time `json:"createdAt"`                                 // When the customer was first seen
+	UpdatedAt           time.Time `json:"updatedAt"`
+}
+
+// ShopDeepLink counts the customers who opened the bot through a deep-link
+// payload. Orders placed after the click carry the payload for conversion stats.
+type ShopDeepLink struct {
+	Id          int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	Payload     string    `json:"payload" gorm:"uniqueIndex"` // Start payload, such as pkg_5 or ref_ABC
+	Clicks      int64     `json:"clicks" gorm:"default:0"`
+	LastClickAt time.Time `json:"lastClickAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// ShopRevenueGoal is the revenue admins aim for in one calendar month of the
+// panel's time zone.
+type ShopRevenueGoal struct {
+	Id        int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Month     string    `json:"month" form:"month" gorm:"uniqueIndex"` // Month the goal is for, such as 2026-10
+	Amount    int64     `json:"amount" form:"amount"`                  // Revenue aimed for, in minor units
+	ReachedAt time.Time `json:"reachedAt"`                             // When the admins were told the goal was reached
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ShopOrderStatus is an admin-defined order status, such as AWAITING_STOCK,
+// added to the built-in order pipeline.
+type ShopOrderStatus struct {
+	Id             int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Code           string    `json:"code" form:"code" gorm:"uniqueIndex"`  // Upper-case status stored on orders
+	Label          string    `json:"label" form:"label"`                   // Name shown to admins and customers
+	Color          string    `json:"color" form:"color"`                   // Tag color in the orders table
+	NotifyCustomer bool      `json:"notifyCustomer" form:"notifyCustomer"` // Message the customer when an order enters the status
+	From           []string  `json:"from" form:"from" gorm:"-"`            // Statuses an order may be moved into this one from
+	To             []string  `json:"to" form:"to" gorm:"-"`                // Statuses an order in this one may be moved to
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// ShopCheckoutField is an extra question the bot asks at checkout, such as the
+// customer's preferred server country. Answers are stored on the order.
+type ShopCheckoutField struct {
+	Id         int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Label      string    `json:"label" form:"label"`           // Question shown to the customer, also naming the answer on the order
+	Kind       string    `json:"kind" form:"kind"`             // text, number or choice
+	Options    string    `json:"options" form:"options"`       // Comma-separated answers of a choice field
+	Required   bool      `json:"required" form:"required"`     // Customers cannot skip the question
+	PackageIds string    `json:"packageIds" form:"packageIds"` // Comma-separated packages the question is asked for, empty for every order
+	ShowIf     string    `json:"showIf" form:"showIf"`         // Conditions such as devices>1; answer.OS=Router, all of which must hold, empty to always ask
+	SortOrder  int       `json:"sortOrder" form:"sortOrder" gorm:"default:0"`
+	Enabled    bool      `json:"enabled" form:"enabled"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ShopConfigTemplate is a client config file, such as a WireGuard .conf, sent
+// with approved orders on inbounds of its protocol where a share link is not
+// enough. Its file name and body hold {{placeholders}} for the client.
+type ShopConfigTemplate struct {
+	Id        int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Protocol  string    `json:"protocol" form:"protocol" gorm:"index"` // Inbound protocol the file is sent for
+	FileName  string    `json:"fileName" form:"fileName"`              // Name of the sent file, such as {{email}}.conf
+	Body      string    `json:"body" form:"body"`
+	Enabled   bool      `json:"enabled" form:"enabled"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ShopShortLink is a short, random /s/ address redirecting to the subscription
+// URL of an order's client, sent to customers instead of the raw link.
+type ShopShortLink struct {
+	Id        int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	Token     string    `json:"token" gorm:"uniqueIndex"`
+	OrderId   int       `json:"orderId" gorm:"index"`
+	Email     string    `json:"email"` // Client the link belongs to
+	TargetUrl string    `json:"targetUrl"`
+	ExpiresAt time.Time `json:"expiresAt"` // Zero when the link does not expire
+	Hits      int64     `json:"hits" gorm:"default:0"`
+	LastHitAt time.Time `json:"lastHitAt"`
+	RevokedAt time.Time `json:"revokedAt"` // Set once the link is revoked or regenerated
+	CreatedAt time.Time `json:"createdAt"`
+
+	Url string `json:"url" gorm:"-"` // Public address of the link, filled in when listed
+}
+
+// ShopOrderPause is a time a customer paused the clients of an order.
+type ShopOrderPause struct {
+	Id           int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	OrderId      int       `json:"orderId" gorm:"index"`
+	FreezeExpiry bool      `json:"freezeExpiry"` // Whether resuming moves the clients' expiry back by the length of the pause
+	PausedAt     time.Time `json:"pausedAt"`
+	ResumedAt    time.Time `json:"resumedAt"` // Zero while the order is paused
+}
+
+// ShopOrderTransition is one allowed move of an order between two statuses in
+// the order workflow.
+type ShopOrderTransition struct {
+	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	FromStatus string `json:"fromStatus" gorm:"index"`
+	ToStatus   string `json:"toStatus"`
+}
+
+// ShopSegment is a saved customer filter used to target broadcasts and exports.
+type ShopSegment struct {
+	Id        int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string    `json:"name" form:"name"`
+	Kind      string    `json:"kind" form:"kind"`                            // high_spenders, recently_expired, never_purchased or package_buyers
+	MinSpent  int64     `json:"minSpent" form:"minSpent"`                    // Spend of high_spenders customers, in minor units
+	Days      int       `json:"days" form:"days" gorm:"default:0"`           // Look-back of recently_expired, in days
+	PackageId int       `json:"packageId" form:"packageId" gorm:"default:0"` // Package bought by package_buyers customers
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ShopBroadcast records an announcement sent to a segment of shop customers and its delivery.
+type ShopBroadcast struct {
+	Id         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	Segment    string    `json:"segment"`
+	Message    string    `json:"message"`
+	Recipients int       `json:"recipients"`
+	Sent       int       `json:"sent"`
+	Failed     int       `json:"failed"`
+	Status     string    `json:"status"` // running or done
+	CreatedAt  time.Time `json:"createdAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// ShopTicket is a support conversation a customer opened through the bot, optionally about one of their orders.
+type ShopTicket struct {
+	Id         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	TelegramId int64     `json:"telegramId" gorm:"index"`
+	OrderId    int       `json:"orderId"` // 0 for general questions
+	Status     string    `json:"status"`  // open, answered or closed
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ShopTicketMessage is one message of a support ticket.
+type ShopTicketMessage struct {
 	Id        int       `json:"id" gorm:"primaryKey;autoIncrement"`
-	InboundId int       `json:"inboundId" gorm:"uniqueIndex"`
-	Enabled   bool      `json:"enabled" gorm:"default:true"`
+	TicketId  int       `json:"ticketId" gorm:"index"`
+	FromAdmin bool      `json:"fromAdmin"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ShopOrderComment is an internal admin note on an order, never shown to the customer.
+type ShopOrderComment struct {
+	Id        int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	OrderId   int       `json:"orderId" gorm:"index"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ShopOrderPayment is one installment paid towards an order.
+type ShopOrderPayment struct {
+	Id        int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	OrderId   int       `json:"orderId" gorm:"index"`
+	Amount    int64     `json:"amount"`
+	Note      string    `json:"note"`
+	Author    string    `json:"author"` // Admin who recorded the payment
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ShopPaymentDestination is a bank card or wallet customers are asked to pay to.
+type ShopPaymentDestination struct {
+	Id        int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string    `json:"name" form:"name"`
+	Kind      string    `json:"kind" form:"kind"`   // card or wallet
+	Value     string    `json:"value" form:"value"` // Card number or wallet address
+	Holder    string    `json:"holder" form:"holder"`
+	DailyCap  int64     `json:"dailyCap" form:"dailyCap"` // Order total per day before the destination is skipped, 0 for no cap
+	SortOrder int       `json:"sortOrder" form:"sortOrder" gorm:"default:0"`
+	Enabled   bool      `json:"enabled" form:"enabled"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
 
-// ShopOrder tracks user requests and provisioning status.
-type ShopOrder struct {
+// ShopSubscription tracks the billing cycle of a client sold with a recurring package.
+type ShopSubscription struct {
 	Id             int       `json:"id" gorm:"primaryKey;autoIncrement"`
-	TelegramId     int64     `json:"telegramId"`
-	InboundId      int       `json:"inboundId"`
-	PackageId      *int      `json:"packageId"`
-	CustomDataGB   int       `json:"customDataGb"`
-	CustomDays     int       `json:"customDays"`
-	Price          int64     `json:"price"`
-	Status         string    `json:"status"`
-	ReceiptPath    string    `json:"receiptPath"`
-	ReceiptFileId  string    `json:"receiptFileId"`
-	ClientEmail    string    `json:"clientEmail"`
-	ClientId       string    `json:"clientId"`
-	ClientSubId    string    `json:"clientSubId"`
+	TelegramId     int64     `json:"telegramId" gorm:"index"`
+	PackageId      int       `json:"packageId"`
+	OrderId        int       `json:"orderId"` // Order that provisioned the clients
+	Status         string    `json:"status" gorm:"index"`
+	NextDueAt      time.Time `json:"nextDueAt" gorm:"index"`
+	RenewalOrderId int       `json:"renewalOrderId"`                 // Open renewal order, 0 when none
+	NextPackageId  int       `json:"nextPackageId" gorm:"default:0"` // Package the customer downgrades to at the next renewal, 0 when unchanged
 	CreatedAt      time.Time `json:"createdAt"`
 	UpdatedAt      time.Time `json:"updatedAt"`
 }
+
+// ShopOrder tracks user requests and provisioning status.
+type ShopOrder struct {
+	Id                   int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	Number               string    `json:"number" gorm:"index"` // Order number customers see, such as ORD-2026-482913, random so it does not reveal order volume
+	TelegramId           int64     `json:"telegramId"`
+	TelegramUsername     string    `json:"telegramUsername"`        // Customer's Telegram username when the order was placed
+	Phone                string    `json:"phone"`                   // Customer phone for SMS or WhatsApp notifications when not on Telegram
+	ContactEmail         string    `json:"contactEmail"`            // Customer address receiving the config and invoice by email
+	NodeId               int       `json:"nodeId" gorm:"default:0"` // ShopNode hosting the inbound, 0 for local
+	InboundId            int       `json:"inboundId"`
+	PackageId            *int      `json:"packageId"`
+	CustomDataGB         int       `json:"customDataGb"`
+	CustomDays           int       `json:"customDays"`
+	Price                int64     `json:"price"`
+	OriginalPrice        int64     `json:"originalPrice" gorm:"default:0"`  // Price before an admin changed it at approval, 0 when unchanged
+	PriceNote            string    `json:"priceNote"`                       // Why the admin changed the price
+	AmountCode           int64     `json:"amountCode" gorm:"default:0"`     // Added to the price to make the amount to pay unique, included in Price
+	PaidAmount           int64     `json:"paidAmount" gorm:"default:0"`     // Sum of the order's recorded payments, 0 when paid in one go
+	WithheldDataGB       int       `json:"withheldDataGb" gorm:"default:0"` // Traffic held back from a partially paid order until the balance is paid
+	Status               string    `json:"status"`
+	HoldReason           string    `json:"holdReason"`                                  // What the admin asked the customer while the order is on hold
+	HeldFromStatus       string    `json:"heldFromStatus"`                              // Status an order on hold resumes to
+	ChargebackAt         time.Time `json:"chargebackAt" gorm:"index"`                   // When the order's payment was reversed
+	ChargebackReason     string    `json:"chargebackReason"`                            // Why the payment was reversed, as given by the admin or gateway
+	FirstApprover        string    `json:"firstApprover"`                               // Admin who first approved an order needing a second approval
+	FirstApprovedAt      time.Time `json:"firstApprovedAt"`                             // When the first admin approved it
+	SecondApprover       string    `json:"secondApprover"`                              // Other admin who approved it after the first
+	SecondApprovedAt     time.Time `json:"secondApprovedAt"`                            // When the second admin approved it
+	PaymentDestinationId int       `json:"paymentDestinationId" gorm:"default:0;index"` // ShopPaymentDestination shown to the customer
+	ReceiptPath          string    `json:"receiptPath"`
+	ReceiptFileId        string    `json:"receiptFileId"`
+	ReceiptHash          string    `json:"receiptHash"`  // SHA-256 of a receipt removed by the retention job
+	OcrAmount            int64     `json:"ocrAmount"`    // Paid amount read from the receipt, 0 when unknown
+	OcrReference         string    `json:"ocrReference"` // Payment reference read from the receipt
+	OcrMismatch          bool      `json:"ocrMismatch"`  // Receipt amount differs from the order price
+	ClientEmail          string    `json:"clientEmail"`
+	ClientId             string    `json:"clientId"`
+	ClientSubId          string    `json:"clientSubId"`
+	ClientEmails         string    `json:"clientEmails"`                          // Comma-separated emails of a pooled or bulk order's clients
+	PoolBytes            int64     `json:"poolBytes"`                             // Traffic shared by a pooled order's clients, 0 for unlimited
+	Seats                int       `json:"seats" gorm:"default:0"`                // Clients provisioned by a bulk order, 0 for other orders
+	ItemCount            int       `json:"itemCount" gorm:"default:0"`            // Packages bought in one cart checkout, 0 for single-package orders
+	SubscriptionId       int       `json:"subscriptionId" gorm:"default:0;index"` // ShopSubscription renewed by this order
+	UpgradeFromOrderId   int       `json:"upgradeFromOrderId" gorm:"default:0"`   // Order whose client this order upgrades
+	UpgradeCredit        int64     `json:"upgradeCredit" gorm:"default:0"`        // Part of the upgraded order's payment counted toward this upgrade
+	ImportRef            string    `json:"importRef" gorm:"index"`                // Fingerprint of the spreadsheet row an imported order came from
+	ProvisionAttempts    int       `json:"provisionAttempts" gorm:"default:0"`    // Failed provisioning attempts of a queued order
+	ProvisionError       string    `json:"provisionError"`                        // Error of the last failed provisioning attempt
+	EffectAppliedAt      time.Time `json:"effectAppliedAt"`                       // When a renewal, upgrade or top-up was applied to its client
+	NextProvisionAt      time.Time `json:"nextProvisionAt" gorm:"index"`          // When the provisioning queue next retries the order
+	ProvisionClaimedAt   time.Time `json:"provisionClaimedAt"`                    // When a panel claimed the order to provision it, zero while unclaimed
+	ScheduledAt          time.Time `json:"scheduledAt" gorm:"index"`              // When a scheduled order is provisioned
+	ReminderSentAt       time.Time `json:"reminderSentAt"`                        // When the customer was reminded to send the receipt
+	DeadlineWarnedAt     time.Time `json:"deadlineWarnedAt"`                      // When the customer was warned the receipt deadline is half gone
+	LightningHash        string    `json:"lightningHash" gorm:"index"`            // Payment hash of the order's open Lightning invoice
+	LightningInvoice     string    `json:"lightningInvoice"`                      // BOLT11 payment request of that invoice
+	LightningSats        int64     `json:"lightningSats" gorm:"default:0"`        // Amount of that invoice in satoshis
+	LightningInvoiceAt   time.Time `json:"lightningInvoiceAt"`                    // When that invoice was created
+	DeepLink             string    `json:"deepLink" gorm:"index"`                 // Bot start payload the customer arrived with, such as pkg_5 or ref_ABC
+	CustomFields         string    `json:"customFields"`                          // JSON object of the checkout field answers, keyed by field label
+	ResellerId           int       `json:"resellerId" gorm:"default:0;index"`     // ShopReseller that placed the order through the reseller API, 0 for others
+	ResellerRef          string    `json:"resellerRef"`                           // Reseller's own reference for the order, such as its end-user's account
+	CreatedAt            time.Time `json:"createdAt"`
+	UpdatedAt            time.Time `json:"updatedAt"`
+
+	Clients []ShopOrderClient `json:"clients,omitempty" gorm:"-"` // Clients created by the current provisioning
+	Items   []ShopOrderItem   `json:"items,omitempty" gorm:"-"`   // Line items of a new cart order
+}
+
+// ShopOrderItem is one package of a cart order. Each item is provisioned as a
+// client of its own.
+type ShopOrderItem struct {
+	Id            int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	OrderId       int       `json:"orderId" gorm:"index"`
+	PackageId     int       `json:"packageId"`
+	Price         int64     `json:"price"` // Package price when the order was placed
+	NodeId        int       `json:"nodeId" gorm:"default:0"`
+	InboundId     int       `json:"inboundId"`
+	ClientEmail   string    `json:"clientEmail"`
+	ClientId      string    `json:"clientId"`
+	ClientSubId   string    `json:"clientSubId"`
+	ProvisionedAt time.Time `json:"provisionedAt"` // Zero until the item's client is created
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// ShopOrderClient is one client provisioned for an order.
+type ShopOrderClient struct {
+	Id        int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	OrderId   int       `json:"orderId" gorm:"index"`
+	Email     string    `json:"email"`
+	ClientId  string    `json:"clientId"`
+	SubId     string    `json:"subId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ShopReseller is a partner selling the shop's packages under its own brand
+// through the reseller API. Its orders are paid from a prepaid balance, at the
+// package price less its commission.
+type ShopReseller struct {
+	Id                int       `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name              string    `json:"name" form:"name"`
+	KeyHash           string    `json:"-" gorm:"uniqueIndex"`                                        // SHA-256 of the API key, which is only shown when it is issued
+	KeyPrefix         string    `json:"keyPrefix"`                                                   // First characters of the API key, to tell keys apart
+	CommissionPercent int       `json:"commissionPercent" form:"commissionPercent" gorm:"default:0"` // Share of the package price the reseller keeps
+	Balance           int64     `json:"balance" gorm:"default:0"`                                    // Prepaid credit orders are charged to, in minor units
+	Enabled           bool      `json:"enabled" form:"enabled" gorm:"default:true"`
+	LastUsedAt        time.Time `json:"lastUsedAt"`
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// ShopResellerEntry is a change of a reseller's balance: a credit from an
+// admin, or the charge for an order with the commission the reseller earned.
+type ShopResellerEntry struct {
+	Id         int       `json:"id" gorm:"primaryKey;autoIncrement"`
+	ResellerId int       `json:"resellerId" gorm:"index"`
+	OrderId    int       `json:"orderId" gorm:"default:0"`    // Order charged, 0 for credits
+	Amount     int64     `json:"amount"`                      // Added to the balance, negative for charges
+	Commission int64     `json:"commission" gorm:"default:0"` // Part of the order's package price the reseller kept
+	Balance    int64     `json:"balance"`                     // Balance after the entry
+	Note       string    `json:"note"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// ShopOrderArchive is a closed order moved out of shop_orders by the archival job.
+type ShopOrderArchive struct {
+	ShopOrder
+	ArchivedAt time.Time `json:"archivedAt" gorm:"index"`
+}
+
+func (ShopOrderArchive) TableName() string {
+	return "shop_orders_archive"
+}
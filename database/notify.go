@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+var (
+	tableListenersMu sync.RWMutex
+	tableListeners   []func(table string)
+)
+
+// OnTableChange registers fn to be called with the table name whenever rows are
+// created, updated or deleted through GORM in the panel or shop database.
+// Writes made in a transaction are reported once it commits, so listeners
+// dropping cached rows never see them read back before the change lands. Raw
+// SQL statements are not reported.
+func OnTableChange(fn func(table string)) {
+	tableListenersMu.Lock()
+	defer tableListenersMu.Unlock()
+	tableListeners = append(tableListeners, fn)
+}
+
+func notifyTables(tables ...string) {
+	tableListenersMu.RLock()
+	defer tableListenersMu.RUnlock()
+	for _, table := range tables {
+		for _, fn := range tableListeners {
+			fn(table)
+		}
+	}
+}
+
+func notifyTableChange(tx *gorm.DB) {
+	if tx.Error != nil || tx.Statement.Table == "" {
+		return
+	}
+	if pending, ok := tx.Statement.ConnPool.(*changeTx); ok {
+		pending.add(tx.Statement.Table)
+		return
+	}
+	notifyTables(tx.Statement.Table)
+}
+
+// changePool is the connection pool of a database whose transactions report
+// the tables written through them on commit.
+type changePool struct {
+	*sql.DB
+}
+
+func (p changePool) GetDBConn() (*sql.DB, error) {
+	return p.DB, nil
+}
+
+func (p changePool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	tx, err := p.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &changeTx{Tx: tx}, nil
+}
+
+// changeTx is a transaction collecting the tables written through it until it
+// commits. Tables of a rolled back transaction are never reported.
+type changeTx struct {
+	*sql.Tx
+	mu     sync.Mutex
+	tables []string
+}
+
+func (t *changeTx) add(table string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !slices.Contains(t.tables, table) {
+		t.tables = append(t.tables, table)
+	}
+}
+
+func (t *changeTx) Commit() error {
+	if err := t.Tx.Commit(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	tables := t.tables
+	t.tables = nil
+	t.mu.Unlock()
+	notifyTables(tables...)
+	return nil
+}
+
+// registerChangeCallbacks hooks notifyTableChange into target's write
+// callbacks, and wraps its connection pool so transactions report their
+// writes on commit.
+func registerChangeCallbacks(target *gorm.DB) error {
+	if sqlDB, ok := target.Statement.ConnPool.(*sql.DB); ok {
+		pool := changePool{DB: sqlDB}
+		target.ConnPool, target.Statement.ConnPool = pool, pool
+	}
+	if err := target.Callback().Create().After("gorm:create").Register("xui:table_change", notifyTableChange); err != nil {
+		return err
+	}
+	if err := target.Callback().Update().After("gorm:update").Register("xui:table_change", notifyTableChange); err != nil {
+		return err
+	}
+	return target.Callback().Delete().After("gorm:delete").Register("xui:table_change", notifyTableChange)
+}
@@ -0,0 +1,296 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/database/migration"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// shopDB is the external shop database, nil when the shop tables are kept in
+// the panel's SQLite database.
+var shopDB *gorm.DB
+
+// shopModels lists the tables owned by the shop, in the order their data is copied.
+func shopModels() []any {
+	return []any{
+		&model.ShopPackage{},
+		&model.ShopCategory{},
+		&model.ShopInbound{},
+		&model.ShopNode{},
+		&model.ShopSubscription{},
+		&model.ShopPaymentDestination{},
+		&model.ShopOrderComment{},
+		&model.ShopOrderPayment{},
+		&model.ShopOrderClient{},
+		&model.ShopOrderItem{},
+		&model.ShopConversation{},
+		&model.ShopAbuseLog{},
+		&model.ShopCustomer{},
+		&model.ShopDeepLink{},
+		&model.ShopRevenueGoal{},
+		&model.ShopSegment{},
+		&model.ShopOrderStatus{},
+		&model.ShopOrderTransition{},
+		&model.ShopCheckoutField{},
+		&model.ShopConfigTemplate{},
+		&model.ShopShortLink{},
+		&model.ShopOrderPause{},
+		&model.ShopReseller{},
+		&model.ShopResellerEntry{},
+		&model.ShopBroadcast{},
+		&model.ShopTicket{},
+		&model.ShopTicketMessage{},
+		&model.ShopOrder{},
+		&model.ShopOrderArchive{},
+	}
+}
+
+// openShopDB connects to the external shop database configured through
+// XUI_SHOP_DB_DRIVER and XUI_SHOP_DB_DSN. It returns nil when none is configured.
+func openShopDB(c *gorm.Config) (*gorm.DB, error) {
+	driver := config.GetShopDBDriver()
+	if driver == "" || driver == "sqlite" {
+		return nil, nil
+	}
+	dsn := config.GetShopDBDSN()
+	if dsn == "" {
+		return nil, errors.New("XUI_SHOP_DB_DSN is required for an external shop database")
+	}
+	var dialector gorm.Dialector
+	switch driver {
+	case "postgres":
+		dialector = postgres.Open(dsn)
+	case "mysql":
+		dialector = mysql.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unsupported shop database driver %q", driver)
+	}
+	return gorm.Open(dialector, c)
+}
+
+func closeShopDB() error {
+	if shopDB == nil {
+		return nil
+	}
+	sqlDB, err := shopDB.DB()
+	if err != nil {
+		return err
+	}
+	shopDB = nil
+	return sqlDB.Close()
+}
+
+// migrateShopModels brings the shop tables in target up to the latest schema version.
+func migrateShopModels(target *gorm.DB) error {
+	migration.PanelDB = db
+	if err := migration.Up(target); err != nil {
+		log.Printf("Error migrating shop schema: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetShopDB returns the database holding the shop tables: the external shop
+// database when one is configured, the panel database otherwise.
+func GetShopDB() *gorm.DB {
+	if shopDB != nil {
+		return shopDB
+	}
+	return db
+}
+
+// HasExternalShopDB reports whether the shop tables live outside the panel database.
+func HasExternalShopDB() bool {
+	return shopDB != nil
+}
+
+// MigrateShopData copies the shop tables of a panel SQLite database into the
+// external shop database. Tables that already hold rows in the external database
+// are left alone, so the command can be re-run after a partial failure.
+func MigrateShopData(sqlitePath string) error {
+	if shopDB == nil {
+		return errors.New("no external shop database is configured")
+	}
+	if _, err := os.Stat(sqlitePath); err != nil {
+		return err
+	}
+	src, err := gorm.Open(sqlite.Open(sqlitePath), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := src.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+
+	for _, m := range shopModels() {
+		stmt := &gorm.Statement{DB: shopDB}
+		if err := stmt.Parse(m); err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		if !src.Migrator().HasTable(m) {
+			log.Printf("Skipping %s: not present in %s", table, sqlitePath)
+			continue
+		}
+		var existing int64
+		if err := shopDB.Model(m).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			log.Printf("Skipping %s: already holds %d rows", table, existing)
+			continue
+		}
+
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(m).Elem())).Interface()
+		copied := 0
+		err := shopDB.Transaction(func(tx *gorm.DB) error {
+			return src.Model(m).FindInBatches(rows, 500, func(batch *gorm.DB, _ int) error {
+				copied += int(batch.RowsAffected)
+				return tx.Create(rows).Error
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("copy %s: %w", table, err)
+		}
+		if pk := stmt.Schema.PrioritizedPrimaryField; pk != nil && pk.AutoIncrement {
+			if err := resetSequence(shopDB, table, pk.DBName); err != nil {
+				return fmt.Errorf("reset %s id sequence: %w", table, err)
+			}
+		}
+		log.Printf("Copied %d rows into %s", copied, table)
+	}
+	return nil
+}
+
+// resetSequence moves a PostgreSQL serial sequence past the copied rows. MySQL
+// adjusts AUTO_INCREMENT on its own.
+func resetSequence(target *gorm.DB, table, column string) error {
+	if target.Dialector.Name() != "postgres" {
+		return nil
+	}
+	return target.Exec(fmt.Sprintf(
+		"SELECT setval(pg_get_serial_sequence('%[1]s', '%[2]s'), COALESCE(MAX(%[2]s), 0) + 1, false) FROM %[1]s", table, column,
+	)).Error
+}
+
+// DumpShopTables returns the rows of every shop table as JSON arrays of column
+// maps, keyed by table name. Rows are keyed by column name rather than through
+// the models' JSON tags, which leave out fields such as ShopReseller.KeyHash.
+func DumpShopTables() (map[string]json.RawMessage, error) {
+	target := GetShopDB()
+	tables := make(map[string]json.RawMessage)
+	for _, m := range shopModels() {
+		stmt := &gorm.Statement{DB: target}
+		if err := stmt.Parse(m); err != nil {
+			return nil, err
+		}
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(m).Elem()))
+		if err := target.Model(m).Find(rows.Interface()).Error; err != nil {
+			return nil, fmt.Errorf("dump %s: %w", stmt.Schema.Table, err)
+		}
+		columns := make([]map[string]any, rows.Elem().Len())
+		for i := range columns {
+			row := rows.Elem().Index(i)
+			columns[i] = make(map[string]any, len(stmt.Schema.Fields))
+			for _, field := range stmt.Schema.Fields {
+				if field.DBName != "" {
+					columns[i][field.DBName] = row.FieldByIndex(field.StructField.Index).Interface()
+				}
+			}
+		}
+		data, err := json.Marshal(columns)
+		if err != nil {
+			return nil, err
+		}
+		tables[stmt.Schema.Table] = data
+	}
+	return tables, nil
+}
+
+// RestoreShopTables replaces the rows of the shop tables found in tables, as
+// produced by DumpShopTables, in one transaction. Tables missing from the map
+// are left untouched. Rows of older backups, keyed by the models' JSON names,
+// are read too.
+func RestoreShopTables(tables map[string]json.RawMessage) error {
+	target := GetShopDB()
+	return target.Transaction(func(tx *gorm.DB) error {
+		for _, m := range shopModels() {
+			stmt := &gorm.Statement{DB: tx}
+			if err := stmt.Parse(m); err != nil {
+				return err
+			}
+			table := stmt.Schema.Table
+			data, ok := tables[table]
+			if !ok {
+				continue
+			}
+			rows, err := decodeShopRows(stmt.Schema, data)
+			if err != nil {
+				return fmt.Errorf("decode %s: %w", table, err)
+			}
+			if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(m).Error; err != nil {
+				return fmt.Errorf("clear %s: %w", table, err)
+			}
+			if rows.Elem().Len() == 0 {
+				continue
+			}
+			if err := tx.CreateInBatches(rows.Interface(), 200).Error; err != nil {
+				return fmt.Errorf("restore %s: %w", table, err)
+			}
+			if pk := stmt.Schema.PrioritizedPrimaryField; pk != nil && pk.AutoIncrement {
+				if err := resetSequence(tx, table, pk.DBName); err != nil {
+					return fmt.Errorf("reset %s id sequence: %w", table, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// decodeShopRows decodes a table's column maps into a pointer to a slice of its
+// model. Columns are matched by name, then by the JSON name older backups used.
+func decodeShopRows(sch *schema.Schema, data json.RawMessage) (reflect.Value, error) {
+	var columns []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return reflect.Value{}, err
+	}
+	byJSON := map[string]*schema.Field{}
+	for _, field := range sch.Fields {
+		if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" && field.DBName != "" {
+			byJSON[name] = field
+		}
+	}
+	rows := reflect.New(reflect.SliceOf(sch.ModelType))
+	rows.Elem().Set(reflect.MakeSlice(reflect.SliceOf(sch.ModelType), len(columns), len(columns)))
+	for i, row := range columns {
+		rv := rows.Elem().Index(i)
+		for key, raw := range row {
+			field := sch.LookUpField(key)
+			if field == nil || field.DBName != key {
+				field = byJSON[key]
+			}
+			if field == nil {
+				continue
+			}
+			if err := json.Unmarshal(raw, rv.FieldByIndex(field.StructField.Index).Addr().Interface()); err != nil {
+				return reflect.Value{}, fmt.Errorf("column %s: %w", key, err)
+			}
+		}
+	}
+	return rows, nil
+}
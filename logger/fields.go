@@ -0,0 +1,161 @@
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// Well-known structured log fields.
+const (
+	FieldRequestId = "request_id"
+	FieldOrderId   = "order_id"
+)
+
+// Fields are key/value pairs attached to a structured log entry.
+type Fields map[string]any
+
+// Entry logs messages with a fixed set of fields. Structured entries are
+// written as one JSON object per line and keep their fields in the log buffer,
+// so they can be looked up with QueryLogs.
+type Entry struct {
+	fields Fields
+}
+
+// LogRecord is a buffered log entry returned by QueryLogs.
+type LogRecord struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Fields  Fields `json:"fields,omitempty"`
+}
+
+type fieldsContextKey struct{}
+
+// WithFields returns an entry logging with the given fields.
+func WithFields(fields Fields) *Entry {
+	return (&Entry{}).WithFields(fields)
+}
+
+// WithFields returns a copy of the entry with additional fields.
+func (e *Entry) WithFields(fields Fields) *Entry {
+	merged := make(Fields, len(e.fields)+len(fields))
+	maps.Copy(merged, e.fields)
+	for k, v := range fields {
+		// Errors marshal to {}, keep their text instead.
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		merged[k] = v
+	}
+	return &Entry{fields: merged}
+}
+
+// NewContext returns a context carrying the fields of ctx plus the given ones.
+// Request handlers use it to pass the correlation IDs down to services.
+func NewContext(ctx context.Context, fields Fields) context.Context {
+	return context.WithValue(ctx, fieldsContextKey{}, FromContext(ctx).WithFields(fields).fields)
+}
+
+// FromContext returns an entry logging with the fields stored in ctx.
+func FromContext(ctx context.Context) *Entry {
+	if ctx == nil {
+		return &Entry{}
+	}
+	fields, _ := ctx.Value(fieldsContextKey{}).(Fields)
+	return &Entry{fields: fields}
+}
+
+// Debug logs a structured debug message.
+func (e *Entry) Debug(args ...any) {
+	msg := sprint(args...)
+	logger.Debug(formatEntry(msg, e.fields))
+	addFieldsToBuffer("DEBUG", msg, e.fields)
+}
+
+// Debugf logs a formatted structured debug message.
+func (e *Entry) Debugf(format string, args ...any) {
+	e.Debug(fmt.Sprintf(format, args...))
+}
+
+// Info logs a structured info message.
+func (e *Entry) Info(args ...any) {
+	msg := sprint(args...)
+	logger.Info(formatEntry(msg, e.fields))
+	addFieldsToBuffer("INFO", msg, e.fields)
+}
+
+// Infof logs a formatted structured info message.
+func (e *Entry) Infof(format string, args ...any) {
+	e.Info(fmt.Sprintf(format, args...))
+}
+
+// Warning logs a structured warning message.
+func (e *Entry) Warning(args ...any) {
+	msg := sprint(args...)
+	logger.Warning(formatEntry(msg, e.fields))
+	addFieldsToBuffer("WARNING", msg, e.fields)
+}
+
+// Warningf logs a formatted structured warning message.
+func (e *Entry) Warningf(format string, args ...any) {
+	e.Warning(fmt.Sprintf(format, args...))
+}
+
+// Error logs a structured error message.
+func (e *Entry) Error(args ...any) {
+	msg := sprint(args...)
+	logger.Error(formatEntry(msg, e.fields))
+	addFieldsToBuffer("ERROR", msg, e.fields)
+}
+
+// Errorf logs a formatted structured error message.
+func (e *Entry) Errorf(format string, args ...any) {
+	e.Error(fmt.Sprintf(format, args...))
+}
+
+// sprint joins args with spaces like the logging backend does.
+func sprint(args ...any) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
+
+// formatEntry renders a message and its fields as a JSON object. Messages
+// without fields are returned unchanged.
+func formatEntry(msg string, fields Fields) string {
+	if len(fields) == 0 {
+		return msg
+	}
+	obj := make(map[string]any, len(fields)+1)
+	maps.Copy(obj, fields)
+	obj["msg"] = msg
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Sprintf("%s %v", msg, fields)
+	}
+	return string(data)
+}
+
+// QueryLogs returns up to c buffered entries, newest first, whose field key
+// has the given value.
+func QueryLogs(key string, value any, c int) []LogRecord {
+	want := fmt.Sprint(value)
+	var output []LogRecord
+
+	logBufferMu.RLock()
+	defer logBufferMu.RUnlock()
+	for i := len(logBuffer) - 1; i >= 0 && len(output) < c; i-- {
+		v, ok := logBuffer[i].fields[key]
+		if !ok || fmt.Sprint(v) != want {
+			continue
+		}
+		output = append(output, LogRecord{
+			Time:    logBuffer[i].time,
+			Level:   logBuffer[i].level.String(),
+			Message: logBuffer[i].log,
+			Fields:  logBuffer[i].fields,
+		})
+	}
+	return output
+}
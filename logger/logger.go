@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/config"
@@ -24,13 +25,19 @@ var (
 	logFile *os.File
 
 	// logBuffer maintains recent log entries in memory for web UI retrieval
-	logBuffer []struct {
-		time  string
-		level logging.Level
-		log   string
-	}
+	logBuffer   []bufferedLog
+	logBufferMu sync.RWMutex
 )
 
+// bufferedLog is one entry of the in-memory log buffer. Fields are only set
+// for structured entries.
+type bufferedLog struct {
+	time   string
+	level  logging.Level
+	log    string
+	fields Fields
+}
+
 // InitLogger initializes dual logging backends: console/syslog and file.
 // Console logging uses the specified level, file logging always uses DEBUG level.
 func InitLogger(level logging.Level) {
@@ -187,20 +194,24 @@ func Errorf(format string, args ...any) {
 
 // addToBuffer adds a log entry to the in-memory ring buffer for web UI retrieval.
 func addToBuffer(level string, newLog string) {
+	addFieldsToBuffer(level, newLog, nil)
+}
+
+// addFieldsToBuffer adds a log entry with structured fields to the ring buffer.
+func addFieldsToBuffer(level string, newLog string, fields Fields) {
 	t := time.Now()
+	logLevel, _ := logging.LogLevel(level)
+
+	logBufferMu.Lock()
+	defer logBufferMu.Unlock()
 	if len(logBuffer) >= maxLogBufferSize {
 		logBuffer = logBuffer[1:]
 	}
-
-	logLevel, _ := logging.LogLevel(level)
-	logBuffer = append(logBuffer, struct {
-		time  string
-		level logging.Level
-		log   string
-	}{
-		time:  t.Format(timeFormat),
-		level: logLevel,
-		log:   newLog,
+	logBuffer = append(logBuffer, bufferedLog{
+		time:   t.Format(timeFormat),
+		level:  logLevel,
+		log:    newLog,
+		fields: fields,
 	})
 }
 
@@ -209,9 +220,11 @@ func GetLogs(c int, level string) []string {
 	var output []string
 	logLevel, _ := logging.LogLevel(level)
 
+	logBufferMu.RLock()
+	defer logBufferMu.RUnlock()
 	for i := len(logBuffer) - 1; i >= 0 && len(output) <= c; i-- {
 		if logBuffer[i].level <= logLevel {
-			output = append(output, fmt.Sprintf("%s %s - %s", logBuffer[i].time, logBuffer[i].level, logBuffer[i].log))
+			output = append(output, fmt.Sprintf("%s %s - %s", logBuffer[i].time, logBuffer[i].level, formatEntry(logBuffer[i].log, logBuffer[i].fields)))
 		}
 	}
 	return output
@@ -13,6 +13,7 @@ import (
 
 	"github.com/mhsanaei/3x-ui/v2/config"
 	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/migration"
 	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/sub"
 	"github.com/mhsanaei/3x-ui/v2/util/crypto"
@@ -394,6 +395,48 @@ func migrateDb() {
 	fmt.Println("Migration done!")
 }
 
+// migrateShopDb copies the shop tables of the panel's SQLite database into the
+// external shop database configured through XUI_SHOP_DB_DRIVER and XUI_SHOP_DB_DSN.
+func migrateShopDb(source string) {
+	if source == "" {
+		source = config.GetDBPath()
+	}
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Start copying shop data from", source, "...")
+	if err := database.MigrateShopData(source); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Shop data copied!")
+}
+
+// shopSchema prints the shop schema migrations or reverts the newest ones before
+// switching to an older release.
+func shopSchema(down int) {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if down > 0 {
+		if err := migration.Down(database.GetShopDB(), down); err != nil {
+			log.Fatal(err)
+		}
+	}
+	list, err := migration.List(database.GetShopDB())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range list {
+		state := "pending"
+		if m.Applied {
+			state = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d %-30s %s\n", m.Version, m.Name, state)
+	}
+}
+
 // main is the entry point of the 3x-ui application.
 // It parses command-line arguments to run the web server, migrate database, or update settings.
 func main() {
@@ -407,6 +450,14 @@ func main() {
 
 	runCmd := flag.NewFlagSet("run", flag.ExitOnError)
 
+	migrateShopCmd := flag.NewFlagSet("migrate-shop", flag.ExitOnError)
+	var shopSource string
+
+	shopSchemaCmd := flag.NewFlagSet("shop-schema", flag.ExitOnError)
+	var shopSchemaDown int
+	shopSchemaCmd.IntVar(&shopSchemaDown, "down", 0, "Revert the given number of most recent shop migrations")
+	migrateShopCmd.StringVar(&shopSource, "from", "", "SQLite database to copy the shop tables from (default: the panel database)")
+
 	settingCmd := flag.NewFlagSet("setting", flag.ExitOnError)
 	var port int
 	var username string
@@ -448,6 +499,8 @@ func main() {
 		fmt.Println("Commands:")
 		fmt.Println("    run            run web panel")
 		fmt.Println("    migrate        migrate form other/old x-ui")
+		fmt.Println("    migrate-shop   copy shop data into the external shop database")
+		fmt.Println("    shop-schema    show or revert shop schema migrations")
 		fmt.Println("    setting        set settings")
 	}
 
@@ -467,6 +520,20 @@ func main() {
 		runWebServer()
 	case "migrate":
 		migrateDb()
+	case "migrate-shop":
+		err := migrateShopCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		migrateShopDb(shopSource)
+	case "shop-schema":
+		err := shopSchemaCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		shopSchema(shopSchemaDown)
 	case "setting":
 		err := settingCmd.Parse(os.Args[2:])
 		if err != nil {
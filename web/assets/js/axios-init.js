@@ -1,6 +1,12 @@
 axios.defaults.headers.post['Content-Type'] = 'application/x-www-form-urlencoded; charset=UTF-8';
 axios.defaults.headers.common['X-Requested-With'] = 'XMLHttpRequest';
 
+// Shop routes refuse state-changing requests without the session's CSRF token.
+const csrfMeta = document.querySelector('meta[name="csrf-token"]');
+if (csrfMeta) {
+    axios.defaults.headers.common['X-CSRF-Token'] = csrfMeta.content;
+}
+
 axios.interceptors.request.use(
     (config) => {
         if (config.data instanceof FormData) {
@@ -3,6 +3,7 @@ class AllSetting {
     constructor(data) {
         this.webListen = "";
         this.webDomain = "";
+        this.trustedProxies = "";
         this.webPort = 2053;
         this.webCertFile = "";
         this.webKeyFile = "";
@@ -18,10 +19,93 @@ class AllSetting {
         this.shopMaxGB = 0;
         this.shopMinDays = 0;
         this.shopMaxDays = 0;
+        this.shopMaintenance = false;
+        this.shopClosedMessage = "";
+        this.shopRenewalGraceDays = 3;
+        this.shopPausesPerCycle = 0;
+        this.shopPauseFreezeExpiry = true;
+        this.shopOcrProvider = "";
+        this.shopOcrEndpoint = "";
+        this.shopOcrApiKey = "";
+        this.shopPaymentRotation = "round_robin";
+        this.shopRateMessagesPerMinute = 20;
+        this.shopRateOrdersPerHour = 5;
+        this.shopRateReceiptsPerHour = 10;
+        this.shopRateCooldownMinutes = 10;
+        this.shopMsgWelcome = "";
+        this.shopMsgPackages = "";
+        this.shopMsgPayment = "";
+        this.shopMsgApproved = "";
+        this.shopMsgRejected = "";
+        this.shopRequiredChannel = "";
+        this.shopRequiredChannelLink = "";
+        this.shopNotifier = "";
+        this.shopNotifierAccount = "";
+        this.shopNotifierApiKey = "";
+        this.shopNotifierSender = "";
+        this.smtpHost = "";
+        this.smtpPort = 587;
+        this.smtpUsername = "";
+        this.smtpPassword = "";
+        this.smtpFrom = "";
+        this.metricsToken = "";
+        this.shopTgBackup = false;
+        this.shopBackupPassword = "";
+        this.shopReceiptRetentionDays = 0;
+        this.shopOrderArchiveDays = 0;
+        this.shopCurrency = "";
+        this.shopStepGB = 0;
+        this.shopStepDays = 0;
+        this.shopPresetsGB = "";
+        this.shopPresetsDays = "";
+        this.shopEmailPattern = "tg-{tgid}-{orderid}@shop";
+        this.shopSubIdPattern = "{random:16}";
+        this.shopShortLinks = false;
+        this.shopShortLinkDays = 0;
+        this.shopCartReminderMinutes = 60;
+        this.shopStorefrontEnabled = false;
+        this.shopStorefrontTitle = "";
+        this.shopPriceListEnabled = false;
+        this.shopApiRatePerMinute = 300;
+        this.shopApiWriteRatePerMinute = 20;
+        this.shopCaptchaProvider = "";
+        this.shopCaptchaSiteKey = "";
+        this.shopCaptchaSecret = "";
+        this.shopDuplicateOrderMinutes = 10;
+        this.shopPartialProvision = false;
+        this.shopAmountCodeMax = 0;
+        this.shopSyncPrimaryUrl = "";
+        this.shopSyncToken = "";
+        this.shopCatalogToken = "";
+        this.shopSyncMinutes = 60;
+        this.shopReceiptDeadlineMinutes = 0;
+        this.shopTgPayments = "";
+        this.shopTgProviderToken = "";
+        this.shopStarsPerUnit = "";
+        this.shopLightningBackend = "";
+        this.shopLightningUrl = "";
+        this.shopLightningApiKey = "";
+        this.shopSatsPerUnit = "";
+        this.shopGateway = "";
+        this.shopGatewayAccount = "";
+        this.shopGatewaySecret = "";
+        this.shopGatewayCurrency = "USD";
+        this.shopGatewayRate = "1";
+        this.shopPublicUrl = "";
+        this.shopWeeklySummary = true;
+        this.shopLowStockThreshold = 0;
+        this.shopInboundAlertPercent = 0;
+        this.shopSecondApprovalPrice = 0;
+        this.shopAdminAllowedIps = "";
+        this.shopAdminAllowedCountries = "";
         this.tgBotEnable = false;
         this.tgBotToken = "";
         this.tgBotProxy = "";
         this.tgBotAPIServer = "";
+        this.tgBotWebhookUrl = "";
+        this.tgBotWebhookSecret = "";
+        this.tgBotCustomerCommands = "start,shop,orders,balance,support,rotate,pause,mydata,forgetme,help,id";
+        this.tgBotAdminCommands = "start,help,status,usage,inbound,restart,broadcast,id";
         this.tgBotChatId = "";
         this.tgRunTime = "@daily";
         this.tgBotBackup = false;
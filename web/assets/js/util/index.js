@@ -625,6 +625,27 @@ class NumberFormatter {
     }
 }
 
+class PriceFormatter {
+    // Shop amounts are integers in the minor unit of the currency reported by
+    // /shop/currency, e.g. cents for USD.
+    static toMajor(amount, currency) {
+        return (amount || 0) / Math.pow(10, currency.exponent || 0);
+    }
+
+    static toMinor(value, currency) {
+        return Math.round((value || 0) * Math.pow(10, currency.exponent || 0));
+    }
+
+    static format(amount, currency) {
+        const exponent = currency.exponent || 0;
+        const text = this.toMajor(amount, currency).toLocaleString('en-US', {
+            minimumFractionDigits: exponent,
+            maximumFractionDigits: exponent,
+        });
+        return currency.code ? `${text} ${currency.code}` : text;
+    }
+}
+
 class Utils {
     static debounce(fn, delay) {
         let timeoutID = null;
@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAccess returns a middleware answering 403 to requests from addresses
+// not on the admin allowlists, which guard the routes approving orders and
+// changing settings more strictly than the panel login does.
+func adminAccess() gin.HandlerFunc {
+	var settings service.SettingService
+	return func(c *gin.Context) {
+		ips, _ := settings.GetShopAdminAllowedIps()
+		countries, _ := settings.GetShopAdminAllowedCountries()
+		allowed, err := service.AdminIPAllowed(c.ClientIP(), ips, countries)
+		if err != nil {
+			logger.Warning("admin allowlist check failed:", err)
+		}
+		if !allowed {
+			logger.Warningf("admin allowlist: %s refused on %s %s", c.ClientIP(), c.Request.Method, c.Request.URL.Path)
+			pureJsonMsg(c, http.StatusForbidden, false, "access from this address is not allowed")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -16,6 +16,8 @@ type APIController struct {
 	serverController  *ServerController
 	shopController    *ShopController
 	Tgbot             service.Tgbot
+
+	routes func() gin.RoutesInfo
 }
 
 // NewAPIController creates a new APIController instance and initializes its routes.
@@ -50,10 +52,25 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 	a.serverController = NewServerController(server)
 
 	// Shop API
-	a.shopController = NewShopController(api)
+	shopService := new(service.ShopService)
+	a.shopController = NewShopController(api, shopService, &a.Tgbot, &a.Tgbot)
 
 	// Extra routes
 	api.GET("/backuptotgbot", a.BackuptoTgbot)
+
+	// Versioned API with the same handlers, documented by an OpenAPI spec.
+	// The unversioned routes above stay for the panel's own pages.
+	v1 := g.Group(apiV1Prefix)
+	v1.Use(a.checkAPIAuth)
+	NewInboundController(v1.Group("/inbounds"))
+	NewShopController(v1, shopService, &a.Tgbot, &a.Tgbot)
+	v1.GET("/openapi.json", a.openAPI)
+}
+
+// SetRoutes gives the controller access to the engine's routes, from which the
+// OpenAPI document is generated.
+func (a *APIController) SetRoutes(routes func() gin.RoutesInfo) {
+	a.routes = routes
 }
 
 // BackuptoTgbot sends a backup of the panel data to Telegram bot admins.
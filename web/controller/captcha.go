@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// captchaTokenFields are the form fields the hCaptcha and Turnstile widgets
+// put their token in.
+var captchaTokenFields = []string{"h-captcha-response", "cf-turnstile-response"}
+
+// captchaToken returns the captcha token of a request, sent by the widget's
+// form field or, from scripts, by the X-Captcha-Token header.
+func captchaToken(c *gin.Context) string {
+	if token := c.GetHeader("X-Captcha-Token"); token != "" {
+		return token
+	}
+	for _, field := range captchaTokenFields {
+		if token := c.PostForm(field); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// shopCaptcha returns a middleware that makes the state-changing requests of
+// public shop routes, such as paying an order, pass the configured captcha
+// first. Reads go through untouched, as does everything while captcha is off.
+func shopCaptcha(shopService *service.ShopService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		err := shopService.VerifyCaptcha(c.Request.Context(), captchaToken(c), c.ClientIP())
+		switch {
+		case err == nil:
+			c.Next()
+		case errors.Is(err, service.ErrCaptchaRequired), errors.Is(err, service.ErrCaptchaFailed):
+			c.AbortWithStatusJSON(http.StatusForbidden, entity.Msg{Success: false, Msg: err.Error()})
+		default:
+			logger.WithFields(logger.Fields{"error": err}).Warning("shop captcha verification failed")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, entity.Msg{Success: false, Msg: "captcha verification unavailable"})
+		}
+	}
+}
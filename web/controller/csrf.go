@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// csrfHeader carries the session's CSRF token on state-changing requests.
+const csrfHeader = "X-CSRF-Token"
+
+// csrfProtect returns a middleware answering 403 to state-changing requests
+// that do not carry their session's CSRF token, so another site cannot make a
+// logged-in admin's browser change the shop. Panel pages hand the token to
+// their requests; API clients get it from GET /shop/csrf.
+func csrfProtect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		token := session.GetCSRFToken(c)
+		got := c.GetHeader(csrfHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			logger.Warningf("CSRF token missing or wrong on %s %s from %s", c.Request.Method, c.Request.URL.Path, c.ClientIP())
+			pureJsonMsg(c, http.StatusForbidden, false, "invalid CSRF token, reload the page")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// getCSRFToken returns the CSRF token of the session, for API clients to send
+// in the X-CSRF-Token header.
+func (s *ShopController) getCSRFToken(c *gin.Context) {
+	jsonObj(c, gin.H{"token": session.GetCSRFToken(c), "header": csrfHeader}, nil)
+}
@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsController exposes Prometheus metrics to scrapers holding the metrics token.
+type MetricsController struct {
+	settingService service.SettingService
+	handler        http.Handler
+}
+
+// NewMetricsController creates a MetricsController and registers its route.
+func NewMetricsController(g *gin.RouterGroup) *MetricsController {
+	a := &MetricsController{
+		handler: promhttp.HandlerFor(service.ShopMetricsRegistry, promhttp.HandlerOpts{}),
+	}
+	g.GET("/metrics", a.metrics)
+	return a
+}
+
+// metrics serves the registry when the request carries the configured bearer
+// token. The endpoint answers 404 while no token is set.
+func (a *MetricsController) metrics(c *gin.Context) {
+	token, err := a.settingService.GetMetricsToken()
+	if err != nil || token == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	a.handler.ServeHTTP(c.Writer, c.Request)
+}
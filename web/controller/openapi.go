@@ -0,0 +1,480 @@
+package controller
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiV1Prefix is where the versioned REST API is mounted below the base path.
+const apiV1Prefix = "/api/v1"
+
+// apiOperation documents one versioned API route. Request and Response are
+// zero values of the types sent and returned in the obj field of the reply;
+// nil means the route takes no body or returns only a message.
+type apiOperation struct {
+	Summary  string
+	Request  any
+	Form     bool // the request is sent as form fields instead of JSON
+	Response any
+	Raw      bool // the response is Response itself rather than a Msg envelope, or a file when Response is nil
+}
+
+type shopOrdersResponse struct {
+	Orders   []model.ShopOrder   `json:"orders"`
+	Packages []model.ShopPackage `json:"packages"`
+}
+
+type provisioningResponse struct {
+	Orders      []model.ShopOrder `json:"orders"`
+	MaxAttempts int               `json:"maxAttempts"`
+}
+
+type archiveResponse struct {
+	Archived int `json:"archived"`
+}
+
+type idsRequest struct {
+	Ids []int `json:"ids"`
+}
+
+type inboundEnabledRequest struct {
+	Enabled bool `json:"enabled"`
+	NodeId  int  `json:"nodeId"`
+}
+
+type inboundBulkRequest struct {
+	Ids     []int `json:"ids"`
+	NodeId  int   `json:"nodeId"`
+	Enabled bool  `json:"enabled"`
+	All     bool  `json:"all"`
+}
+
+type inboundBulkResponse struct {
+	Updated int `json:"updated"`
+}
+
+type inboundTagsRequest struct {
+	Tags   []string `json:"tags"`
+	NodeId int      `json:"nodeId"`
+}
+
+type inboundLimitRequest struct {
+	MaxClients int `json:"maxClients"`
+	NodeId     int `json:"nodeId"`
+}
+
+type bodyRequest struct {
+	Body string `json:"body"`
+}
+
+type bulkOrderRequest struct {
+	TelegramId   int64  `json:"telegramId"`
+	ContactEmail string `json:"contactEmail"`
+	NodeId       int    `json:"nodeId"`
+	InboundId    int    `json:"inboundId"`
+	PackageId    int    `json:"packageId"`
+	CustomDataGB int    `json:"customDataGb"`
+	CustomDays   int    `json:"customDays"`
+	Seats        int    `json:"seats"`
+	Price        int64  `json:"price"`
+}
+
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+type approveRequest struct {
+	Price     *int64 `json:"price"`     // Price to charge instead of the order's, in minor units
+	PriceNote string `json:"priceNote"` // Required reason when the price changes
+}
+
+type paymentRequest struct {
+	Amount int64  `json:"amount"` // Minor units
+	Note   string `json:"note"`
+}
+
+type resellerKeyResponse struct {
+	Key string `json:"key"`
+}
+
+type resellerSaveResponse struct {
+	Reseller model.ShopReseller `json:"reseller"`
+	Key      string             `json:"key"` // Empty when an existing reseller was updated
+}
+
+type holdRequest struct {
+	Reason string `json:"reason"` // Sent to the customer
+}
+
+type chargebackRequest struct {
+	Reason string `json:"reason"` // Why the payment was reversed
+}
+
+type reconcileRequest struct {
+	Reference string `json:"reference"` // Reference of the matched transaction
+}
+
+type scheduleRequest struct {
+	At int64 `json:"at"` // Unix milliseconds
+}
+
+type orderStatusRequest struct {
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+type broadcastRequest struct {
+	Segment string `json:"segment"`
+	Message string `json:"message"`
+}
+
+type graphQLResponse struct {
+	Data   map[string]any   `json:"data"`
+	Errors []map[string]any `json:"errors"`
+}
+
+// apiOperations documents the routes mounted under apiV1Prefix, keyed by
+// method and gin path relative to the prefix.
+var apiOperations = map[string]apiOperation{
+	"GET /inbounds/list":                           {Summary: "List inbounds", Response: []model.Inbound{}},
+	"GET /inbounds/get/:id":                        {Summary: "Get an inbound", Response: model.Inbound{}},
+	"GET /inbounds/getClientTraffics/:email":       {Summary: "Get a client's traffic by email", Response: xray.ClientTraffic{}},
+	"GET /inbounds/getClientTrafficsById/:id":      {Summary: "Get a client's traffic by client ID", Response: []xray.ClientTraffic{}},
+	"POST /inbounds/add":                           {Summary: "Add an inbound", Request: model.Inbound{}, Form: true, Response: model.Inbound{}},
+	"POST /inbounds/del/:id":                       {Summary: "Delete an inbound"},
+	"POST /inbounds/update/:id":                    {Summary: "Update an inbound", Request: model.Inbound{}, Form: true, Response: model.Inbound{}},
+	"POST /inbounds/clientIps/:email":              {Summary: "List the IPs a client connected from"},
+	"POST /inbounds/clearClientIps/:email":         {Summary: "Clear a client's IP log"},
+	"POST /inbounds/addClient":                     {Summary: "Add clients to an inbound", Request: model.Inbound{}, Form: true},
+	"POST /inbounds/:id/delClient/:clientId":       {Summary: "Delete a client by ID"},
+	"POST /inbounds/updateClient/:clientId":        {Summary: "Update a client", Request: model.Inbound{}, Form: true},
+	"POST /inbounds/:id/resetClientTraffic/:email": {Summary: "Reset a client's traffic"},
+	"POST /inbounds/resetAllTraffics":              {Summary: "Reset the traffic of all inbounds"},
+	"POST /inbounds/resetAllClientTraffics/:id":    {Summary: "Reset the traffic of an inbound's clients"},
+	"POST /inbounds/delDepletedClients/:id":        {Summary: "Delete depleted clients"},
+	"POST /inbounds/import":                        {Summary: "Import an inbound from JSON", Request: model.Inbound{}, Form: true},
+	"POST /inbounds/onlines":                       {Summary: "List online client emails", Response: []string{}},
+	"POST /inbounds/lastOnline":                    {Summary: "Last online time per client email", Response: map[string]int64{}},
+	"POST /inbounds/updateClientTraffic/:email":    {Summary: "Set a client's traffic counters"},
+	"POST /inbounds/:id/delClientByEmail/:email":   {Summary: "Delete a client by email"},
+
+	"GET /shop/csrf":                      {Summary: "CSRF token of the session, sent in the X-CSRF-Token header of POST requests"},
+	"GET /shop/currency":                  {Summary: "Currency of shop amounts, which are integers in its minor unit", Response: service.ShopCurrency{}},
+	"GET /shop/settings":                  {Summary: "Get the shop settings, grouped as the shop settings page shows them", Response: service.ShopSettings{}},
+	"POST /shop/settings":                 {Summary: "Validate and save shop settings; only the shop keys posted change", Request: entity.AllSetting{}, Form: true, Response: service.ShopSettings{}},
+	"GET /shop/packages":                  {Summary: "List packages", Response: []model.ShopPackage{}},
+	"POST /shop/packages":                 {Summary: "Create or update a package", Request: model.ShopPackage{}, Form: true, Response: model.ShopPackage{}},
+	"POST /shop/packages/reorder":         {Summary: "Reorder packages", Request: idsRequest{}},
+	"GET /shop/packages/export":           {Summary: "Download the package catalog as JSON, or YAML with ?format=yaml", Raw: true},
+	"POST /shop/packages/import":          {Summary: "Import a package catalog file (field file) in JSON or YAML; conflict is skip, overwrite or duplicate", Response: service.ShopCatalogImportResult{}},
+	"POST /shop/packages/sync":            {Summary: "Pull the package catalog from the configured primary panel now", Response: service.ShopCatalogSyncResult{}},
+	"POST /shop/packages/:id/delete":      {Summary: "Delete or archive a package"},
+	"POST /shop/packages/:id/duplicate":   {Summary: "Duplicate a package", Response: model.ShopPackage{}},
+	"GET /shop/categories":                {Summary: "List categories", Response: []model.ShopCategory{}},
+	"POST /shop/categories":               {Summary: "Create or update a category", Request: model.ShopCategory{}, Form: true, Response: model.ShopCategory{}},
+	"POST /shop/categories/:id/delete":    {Summary: "Delete a category"},
+	"GET /shop/orders":                    {Summary: "List orders with the packages they refer to", Response: shopOrdersResponse{}},
+	"POST /shop/orders/import":            {Summary: "Import past orders from a CSV file", Response: service.ShopImportResult{}},
+	"POST /shop/orders/reconcile":         {Summary: "Match a bank statement CSV to the orders awaiting payment", Response: service.ShopReconcileResult{}},
+	"GET /shop/orders/archive":            {Summary: "List archived orders created between the optional from and to dates", Response: []model.ShopOrderArchive{}},
+	"GET /shop/orders/archive/export":     {Summary: "Download archived orders as a JSON file", Raw: true},
+	"POST /shop/orders/archive":           {Summary: "Move closed orders past the archive age to the archive", Response: archiveResponse{}},
+	"GET /shop/orders/provisioning":       {Summary: "List orders waiting in the provisioning queue", Response: provisioningResponse{}},
+	"POST /shop/orders/:id/approve":       {Summary: "Approve an order and provision its client, queueing it for retry on failure. Orders above the second approval price need two admins", Request: approveRequest{}, Form: true},
+	"POST /shop/orders/:id/retry":         {Summary: "Retry provisioning a queued order now"},
+	"POST /shop/orders/:id/reject":        {Summary: "Reject an order"},
+	"POST /shop/orders/:id/hold":          {Summary: "Put an order on hold and ask the customer the reason", Request: holdRequest{}, Form: true, Response: model.ShopOrder{}},
+	"POST /shop/orders/:id/resume":        {Summary: "Take an order off hold", Response: model.ShopOrder{}},
+	"POST /shop/orders/:id/chargeback":    {Summary: "Record that an order's payment was reversed and disable its clients", Request: chargebackRequest{}, Form: true, Response: model.ShopOrder{}},
+	"POST /shop/orders/:id/reconcile":     {Summary: "Approve an order a bank statement transaction was matched to", Request: reconcileRequest{}, Form: true},
+	"POST /shop/orders/:id/schedule":      {Summary: "Approve an order to be provisioned at a later time, or reschedule it", Request: scheduleRequest{}, Form: true, Response: model.ShopOrder{}},
+	"POST /shop/orders/:id/status":        {Summary: "Move an order to another status allowed by the order workflow", Request: orderStatusRequest{}, Form: true, Response: model.ShopOrder{}},
+	"POST /shop/orders/bulk":              {Summary: "Place a bulk order provisioning one client per seat, ready for approval", Request: bulkOrderRequest{}, Response: model.ShopOrder{}, Form: true},
+	"GET /shop/orders/:id/items":          {Summary: "List a cart order's items", Response: []model.ShopOrderItem{}},
+	"GET /shop/orders/:id/clients":        {Summary: "List an approved order's clients with their subscription URLs", Response: []service.ShopClientLink{}},
+	"GET /shop/orders/:id/clients/export": {Summary: "Download an approved order's clients as CSV", Raw: true},
+	"POST /shop/orders/:id/rotate":        {Summary: "Give an order's client, by email or the first one, a new UUID or password and subId and send the customer the new links", Request: emailRequest{}, Form: true, Response: model.ShopOrderClient{}},
+	"POST /shop/orders/:id/email":         {Summary: "Email an approved order to the customer", Request: emailRequest{}, Form: true},
+	"GET /shop/orders/:id/comments":       {Summary: "List an order's internal comments", Response: []model.ShopOrderComment{}},
+	"POST /shop/orders/:id/comments":      {Summary: "Comment on an order", Request: bodyRequest{}, Form: true, Response: model.ShopOrderComment{}},
+	"GET /shop/orders/:id/payments":       {Summary: "List the installments paid towards an order", Response: []model.ShopOrderPayment{}},
+	"POST /shop/orders/:id/payments":      {Summary: "Record an installment paid towards an order", Request: paymentRequest{}, Form: true, Response: model.ShopOrder{}},
+	"GET /shop/orders/:id/links":          {Summary: "List the short subscription links sent for an order, with their hits", Response: []model.ShopShortLink{}},
+	"GET /shop/orders/:id/pauses":         {Summary: "List the times the customer paused an order, latest first", Response: []model.ShopOrderPause{}},
+	"POST /shop/links/:id/revoke":         {Summary: "Revoke a short link so it no longer redirects", Response: model.ShopShortLink{}},
+	"POST /shop/links/:id/regenerate":     {Summary: "Revoke a short link and return a new one to the same subscription", Response: model.ShopShortLink{}},
+	"GET /shop/orders/:id/logs":           {Summary: "List recent log entries tagged with an order", Response: []logger.LogRecord{}},
+	"GET /shop/receipt/:id":               {Summary: "Download an order's receipt image", Raw: true},
+	"GET /shop/subscriptions":             {Summary: "List subscriptions", Response: []model.ShopSubscription{}},
+	"POST /shop/subscriptions/:id/cancel": {Summary: "Cancel a subscription"},
+	"GET /shop/destinations":              {Summary: "List payment destinations with today's usage", Response: []service.ShopPaymentDestinationUsage{}},
+	"POST /shop/destinations":             {Summary: "Create or update a payment destination", Request: model.ShopPaymentDestination{}, Form: true},
+	"POST /shop/destinations/:id/delete":  {Summary: "Delete a payment destination"},
+	"GET /shop/resellers":                 {Summary: "List resellers with their balances", Response: []model.ShopReseller{}},
+	"POST /shop/resellers":                {Summary: "Create or update a reseller; a new reseller's API key is returned only once", Request: model.ShopReseller{}, Form: true, Response: resellerSaveResponse{}},
+	"POST /shop/resellers/:id/key":        {Summary: "Replace a reseller's API key and return the new one", Response: resellerKeyResponse{}},
+	"POST /shop/resellers/:id/delete":     {Summary: "Delete a reseller that never placed an order"},
+	"POST /shop/resellers/:id/credit":     {Summary: "Add to a reseller's balance, or correct it down with a negative amount", Request: paymentRequest{}, Form: true, Response: model.ShopResellerEntry{}},
+	"GET /shop/resellers/:id/entries":     {Summary: "List the changes of a reseller's balance, latest first", Response: []model.ShopResellerEntry{}},
+	"GET /shop/customers":                 {Summary: "List customer profiles with their order totals", Response: []service.ShopCustomerSummary{}},
+	"GET /shop/customers/:id":             {Summary: "Get a customer profile by Telegram ID", Response: service.ShopCustomerSummary{}},
+	"POST /shop/customers":                {Summary: "Create or update a customer's language and ban", Request: model.ShopCustomer{}, Form: true, Response: model.ShopCustomer{}},
+	"POST /shop/customers/:id/delete":     {Summary: "Delete a customer profile, keeping their orders"},
+	"GET /shop/customers/:id/export":      {Summary: "Download everything stored about a customer as JSON", Raw: true},
+	"POST /shop/customers/:id/erase":      {Summary: "Delete a customer's data, anonymizing their orders and removing their receipts", Response: service.ShopCustomerErasure{}},
+	"GET /shop/deeplinks/stats":           {Summary: "Clicks and conversions of pkg_ and ref_ bot deep links", Response: service.ShopDeepLinkReport{}},
+	"GET /shop/health":                    {Summary: "Check the database, bot, receipt storage, payment gateways and Xray API; 503 when any is down", Response: service.ShopHealthReport{}},
+	"GET /shop/goals":                     {Summary: "List monthly revenue goals", Response: []model.ShopRevenueGoal{}},
+	"POST /shop/goals":                    {Summary: "Set the revenue goal of a month", Request: model.ShopRevenueGoal{}, Form: true, Response: model.ShopRevenueGoal{}},
+	"POST /shop/goals/:id/delete":         {Summary: "Delete a revenue goal"},
+	"GET /shop/stats/goal":                {Summary: "Progress of a month towards its revenue goal; month query like 2026-10, default current", Response: service.ShopRevenueGoalProgress{}},
+	"GET /shop/stats/weekly":              {Summary: "Orders, revenue, top package, churn and goal progress of the last seven days", Response: service.ShopWeeklySummary{}},
+	"GET /shop/stats/retention":           {Summary: "Customers of each monthly cohort who ordered again in later months; months query, default 12, at most 36", Response: []service.ShopRetentionCohort{}},
+	"GET /shop/stats/packages":            {Summary: "Traffic sold with each package against what its clients used", Response: []service.ShopPackageUtilization{}},
+	"GET /shop/statuses":                  {Summary: "List custom order statuses with their transitions", Response: []model.ShopOrderStatus{}},
+	"POST /shop/statuses":                 {Summary: "Create or update a custom order status and its transitions", Request: model.ShopOrderStatus{}, Form: true, Response: model.ShopOrderStatus{}},
+	"POST /shop/statuses/:id/delete":      {Summary: "Delete a custom order status no order is in"},
+	"GET /shop/fields":                    {Summary: "List the checkout fields the bot asks before placing an order", Response: []model.ShopCheckoutField{}},
+	"POST /shop/fields":                   {Summary: "Create or update a checkout field; packageIds limits it to those packages and showIf to orders meeting its conditions", Request: model.ShopCheckoutField{}, Form: true, Response: model.ShopCheckoutField{}},
+	"POST /shop/fields/:id/delete":        {Summary: "Delete a checkout field, keeping the answers stored on orders"},
+	"GET /shop/config-files":              {Summary: "List the config file templates sent with approved orders", Response: []model.ShopConfigTemplate{}},
+	"POST /shop/config-files":             {Summary: "Create or update a config file template for an inbound protocol", Request: model.ShopConfigTemplate{}, Form: true, Response: model.ShopConfigTemplate{}},
+	"POST /shop/config-files/:id/delete":  {Summary: "Delete a config file template"},
+	"GET /shop/segments":                  {Summary: "List saved customer segments", Response: []model.ShopSegment{}},
+	"POST /shop/segments":                 {Summary: "Create or update a customer segment", Request: model.ShopSegment{}, Form: true, Response: model.ShopSegment{}},
+	"POST /shop/segments/:id/delete":      {Summary: "Delete a customer segment"},
+	"GET /shop/segments/:id/customers":    {Summary: "List the customers matching a segment", Response: []service.ShopCustomerSummary{}},
+	"GET /shop/segments/:id/export":       {Summary: "Download the customers matching a segment as CSV", Raw: true},
+	"GET /shop/abuse":                     {Summary: "List rate limit violations", Response: []model.ShopAbuseLog{}},
+	"GET /shop/tickets":                   {Summary: "List support tickets", Response: []model.ShopTicket{}},
+	"GET /shop/tickets/:id/messages":      {Summary: "List a ticket's messages", Response: []model.ShopTicketMessage{}},
+	"POST /shop/tickets/:id/reply":        {Summary: "Reply to a ticket", Request: bodyRequest{}, Form: true, Response: model.ShopTicketMessage{}},
+	"POST /shop/tickets/:id/close":        {Summary: "Close a ticket"},
+	"GET /shop/backup":                    {Summary: "Download an encrypted backup of the shop data", Raw: true},
+	"POST /shop/restore":                  {Summary: "Replace the shop data with an uploaded backup", Response: service.ShopRestoreResult{}},
+	"POST /shop/graphql":                  {Summary: "Query shop data with GraphQL", Request: graphQLRequest{}, Response: graphQLResponse{}, Raw: true},
+	"GET /shop/broadcasts":                {Summary: "List broadcasts", Response: []model.ShopBroadcast{}},
+	"POST /shop/broadcast":                {Summary: "Send an announcement to a customer segment or saved segment:<id>", Request: broadcastRequest{}, Form: true, Response: model.ShopBroadcast{}},
+	"GET /shop/inbounds":                  {Summary: "List inbounds with shop availability", Response: []service.ShopInboundOption{}},
+	"GET /shop/inbounds/tags":             {Summary: "Inbound tags in use, with the number of inbounds carrying each", Response: map[string]int{}},
+	"POST /shop/inbounds/bulk":            {Summary: "Offer or withdraw several inbounds of a node, or every inbound when all is set", Request: inboundBulkRequest{}, Response: inboundBulkResponse{}},
+	"POST /shop/inbounds/:id":             {Summary: "Offer or withdraw an inbound in the shop", Request: inboundEnabledRequest{}},
+	"POST /shop/inbounds/:id/limit":       {Summary: "Set an inbound's client limit", Request: inboundLimitRequest{}},
+	"POST /shop/inbounds/:id/tags":        {Summary: "Replace an inbound's tags", Request: inboundTagsRequest{}},
+	"GET /shop/nodes":                     {Summary: "List remote nodes", Response: []model.ShopNode{}},
+	"POST /shop/nodes":                    {Summary: "Create or update a remote node", Request: model.ShopNode{}, Form: true, Response: model.ShopNode{}},
+	"POST /shop/nodes/:id/delete":         {Summary: "Delete a remote node"},
+	"GET /shop/nodes/:id/status":          {Summary: "Check a remote node", Response: service.ShopNodeStatus{}},
+}
+
+// shopModels are documented as components even when no route returns them directly.
+var shopModels = []any{
+	model.ShopPackage{}, model.ShopCategory{}, model.ShopNode{}, model.ShopInbound{},
+	model.ShopAbuseLog{}, model.ShopConversation{}, model.ShopCustomer{}, model.ShopSegment{}, model.ShopBroadcast{},
+	model.ShopTicket{}, model.ShopTicketMessage{}, model.ShopOrderComment{}, model.ShopOrderPayment{},
+	model.ShopPaymentDestination{}, model.ShopSubscription{}, model.ShopOrder{}, model.ShopReseller{},
+}
+
+var (
+	openAPIMu   sync.Mutex
+	openAPISpec map[string]any
+	ginParamRe  = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// openAPI serves the OpenAPI 3 document of the versioned API. It is generated
+// from the registered routes on first use.
+func (a *APIController) openAPI(c *gin.Context) {
+	openAPIMu.Lock()
+	defer openAPIMu.Unlock()
+	if openAPISpec == nil {
+		if a.routes == nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		openAPISpec = buildOpenAPI(a.routes(), c.GetString("base_path"))
+	}
+	c.JSON(http.StatusOK, openAPISpec)
+}
+
+func buildOpenAPI(routes gin.RoutesInfo, basePath string) map[string]any {
+	gen := &schemaGenerator{components: map[string]any{}}
+	for _, m := range shopModels {
+		gen.schemaOf(reflect.TypeOf(m))
+	}
+	gen.schemaOf(reflect.TypeOf(entity.Msg{}))
+
+	prefix := strings.TrimSuffix(basePath, "/") + apiV1Prefix
+	paths := map[string]any{}
+	for _, route := range routes {
+		rel, ok := strings.CutPrefix(route.Path, prefix)
+		if !ok || rel == "/openapi.json" {
+			continue
+		}
+		doc := apiOperations[route.Method+" "+rel]
+		op := map[string]any{
+			"summary":   doc.Summary,
+			"tags":      []string{strings.Split(strings.TrimPrefix(rel, "/"), "/")[0]},
+			"responses": map[string]any{"200": gen.responseOf(doc)},
+		}
+		var params []any
+		for _, match := range ginParamRe.FindAllStringSubmatch(rel, -1) {
+			params = append(params, map[string]any{
+				"name": match[1], "in": "path", "required": true,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if doc.Request != nil {
+			contentType := "application/json"
+			if doc.Form {
+				contentType = "application/x-www-form-urlencoded"
+			}
+			op["requestBody"] = map[string]any{
+				"content": map[string]any{contentType: map[string]any{"schema": gen.schemaOf(reflect.TypeOf(doc.Request))}},
+			}
+		}
+		path := ginParamRe.ReplaceAllString(rel, "{$1}")
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "3x-ui API",
+			"version": "v1 (" + config.GetVersion() + ")",
+		},
+		"servers": []any{map[string]any{"url": prefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": gen.components,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "cookie", "name": "3x-ui"},
+			},
+		},
+		"security": []any{map[string]any{"session": []string{}}},
+	}
+}
+
+// schemaGenerator turns Go types into OpenAPI schemas, collecting named
+// structs as reusable components.
+type schemaGenerator struct {
+	components map[string]any
+}
+
+func (g *schemaGenerator) responseOf(doc apiOperation) map[string]any {
+	if doc.Raw && doc.Response == nil {
+		return map[string]any{
+			"description": "File download",
+			"content":     map[string]any{"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}},
+		}
+	}
+	if doc.Raw {
+		return map[string]any{
+			"description": "Result",
+			"content":     map[string]any{"application/json": map[string]any{"schema": g.schemaOf(reflect.TypeOf(doc.Response))}},
+		}
+	}
+	schema := map[string]any{"$ref": "#/components/schemas/Msg"}
+	if doc.Response != nil {
+		schema = map[string]any{"allOf": []any{
+			schema,
+			map[string]any{"type": "object", "properties": map[string]any{"obj": g.schemaOf(reflect.TypeOf(doc.Response))}},
+		}}
+	}
+	return map[string]any{
+		"description": "Result envelope; obj carries the data",
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) map[string]any {
+	if t == nil {
+		return map[string]any{}
+	}
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := g.schemaOf(t.Elem())
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := g.components[name]; !ok {
+			g.components[name] = map[string]any{} // placeholder for recursive types
+			g.components[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	g.addFields(t, properties)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]any) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.addFields(field.Type, properties)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schemaOf(field.Type)
+	}
+}
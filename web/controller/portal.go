@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// portalKeepAlive is how often an idle order stream sends a ping so proxies keep it open.
+const portalKeepAlive = 25 * time.Second
+
+// PortalController serves the customer-facing endpoints of the shop. Customers
+// are not panel users, so each request carries an order status token instead.
+type PortalController struct {
+	BaseController
+	shopService    service.ShopService
+	settingService service.SettingService
+	tgbotService   service.Tgbot
+}
+
+// NewPortalController creates a PortalController and registers its routes.
+func NewPortalController(g *gin.RouterGroup) *PortalController {
+	a := &PortalController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *PortalController) initRouter(g *gin.RouterGroup) {
+	portal := g.Group("/portal")
+	portal.Use(shopRateLimit(rateScopeStore, a.settingService.GetShopApiRatePerMinute, clientIPRateKeys))
+	portal.GET("/orders/stream", a.streamOrder)
+	portal.GET("/pay", a.payOrder)
+	portal.POST("/pay", shopCaptcha(&a.shopService), a.payOrder)
+	portal.GET("/pay/done", a.payDone)
+
+	// Payment gateways call back from their servers.
+	gateway := g.Group("/portal/gateway")
+	gateway.Use(shopRateLimit(rateScopeStore, a.settingService.GetShopApiRatePerMinute, clientIPRateKeys))
+	gateway.POST("/:gateway", a.gatewayCallback)
+	gateway.POST("/:gateway/chargeback", a.gatewayChargeback)
+
+	// Short links are opened by subscription clients.
+	short := g.Group("/s")
+	short.Use(shopRateLimit(rateScopeStore, a.settingService.GetShopApiRatePerMinute, clientIPRateKeys))
+	short.GET("/:token", a.shortLink)
+}
+
+// shortLink redirects a short link to the subscription it stands for.
+func (a *PortalController) shortLink(c *gin.Context) {
+	target, err := a.shopService.ResolveShortLink(c.Param("token"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, target)
+}
+
+// streamOrder pushes an order's status as Server-Sent Events until the order is
+// approved or rejected or the customer disconnects.
+func (a *PortalController) streamOrder(c *gin.Context) {
+	orderId, err := strconv.Atoi(c.Query("order"))
+	if err != nil || !a.shopService.CheckOrderStatusToken(orderId, c.Query("token")) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	events, cancel := service.SubscribeOrder(orderId)
+	defer cancel()
+	order, err := a.shopService.GetOrder(orderId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("status", service.ShopOrderEvent{OrderId: order.Id, Status: order.Status, UpdatedAt: order.UpdatedAt})
+	c.Writer.Flush()
+	if isFinalOrderStatus(order.Status) {
+		return
+	}
+
+	ticker := time.NewTicker(portalKeepAlive)
+	defer ticker.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			c.SSEvent("status", event)
+			return !isFinalOrderStatus(event.Status)
+		case <-ticker.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func isFinalOrderStatus(status string) bool {
+	return status == service.OrderStatusApproved || status == service.OrderStatusRejected || status == service.OrderStatusChargeback
+}
+
+// payOrder sends the customer of an order awaiting payment to the configured
+// payment gateway. While captcha is on, the customer solves it first and posts
+// the page back, which shopCaptcha verifies.
+func (a *PortalController) payOrder(c *gin.Context) {
+	orderId, err := strconv.Atoi(c.Query("order"))
+	if err != nil || !a.shopService.CheckOrderStatusToken(orderId, c.Query("token")) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	order, err := a.shopService.GetOrder(orderId)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	checkout, err := a.shopService.GatewayCheckout(order)
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: orderId, "error": err}).Warning("gateway checkout failed")
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	if captcha := a.shopService.CaptchaConfig(); captcha.Provider != "" && c.Request.Method == http.MethodGet {
+		c.HTML(http.StatusOK, "pay.html", gin.H{
+			"title":   "Order " + service.OrderNumber(order),
+			"gateway": service.ShopPaymentGatewayNames[a.shopService.PaymentGateway()],
+			"amount":  checkout.Amount,
+			"captcha": captcha,
+		})
+		return
+	}
+	c.HTML(http.StatusOK, "pay.html", gin.H{
+		"title":    "Order " + service.OrderNumber(order),
+		"gateway":  service.ShopPaymentGatewayNames[a.shopService.PaymentGateway()],
+		"amount":   checkout.Amount,
+		"checkout": checkout,
+	})
+}
+
+// payDone is where a gateway sends the customer back to.
+func (a *PortalController) payDone(c *gin.Context) {
+	c.HTML(http.StatusOK, "pay.html", gin.H{"title": "Thank you"})
+}
+
+// gatewayCallback records a payment a gateway notified the shop of and, when
+// it pays the order in full, approves the order. Payments that cannot be
+// matched are left for the admins.
+func (a *PortalController) gatewayCallback(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	name := c.Param("gateway")
+	payment, order, err := a.shopService.ConfirmGatewayPayment(name, c.Request.PostForm)
+	if payment != nil && payment.Prerequest {
+		if err != nil {
+			c.String(http.StatusOK, "NO")
+			return
+		}
+		c.String(http.StatusOK, "YES")
+		return
+	}
+	ctx := logger.NewContext(c.Request.Context(), logger.Fields{"gateway": name})
+	if order != nil {
+		ctx = logger.NewContext(ctx, logger.Fields{logger.FieldOrderId: order.Id, "reference": payment.Reference})
+	}
+	log := logger.FromContext(ctx)
+	if err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("gateway payment not approved")
+		if order != nil {
+			a.tgbotService.NotifyAdminsOrderPending(order.Id)
+		}
+		if payment == nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		c.String(http.StatusOK, "OK")
+		return
+	}
+	if err := a.tgbotService.ApproveOrder(ctx, order); err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("approve order paid through gateway failed")
+		if !errors.Is(err, service.ErrProvisionQueued) {
+			a.tgbotService.NotifyAdminsOrderPending(order.Id)
+		}
+	} else {
+		a.tgbotService.SendOrderFulfillment(order)
+	}
+	c.String(http.StatusOK, "OK")
+}
+
+// gatewayChargeback records a chargeback a gateway notified the shop of and
+// tells the admins.
+func (a *PortalController) gatewayChargeback(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	name := c.Param("gateway")
+	log := logger.FromContext(c.Request.Context()).WithFields(logger.Fields{"gateway": name})
+	order, reason, err := a.shopService.GatewayChargeback(name, c.Request.PostForm)
+	if err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("gateway chargeback not recorded")
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if order.Status == service.OrderStatusChargeback {
+		c.String(http.StatusOK, "OK")
+		return
+	}
+	order, err = a.tgbotService.ChargebackOrder(order.Id, reason)
+	if err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("gateway chargeback not recorded")
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+	log.WithFields(logger.Fields{logger.FieldOrderId: order.Id}).Info("order charged back by gateway")
+	a.tgbotService.SendMsgToTgbotAdmins(fmt.Sprintf("Order #%d (%s) was charged back: %s\r\nTelegram ID: %d\r\nPrice: %s",
+		order.Id, service.OrderNumber(order), template.HTMLEscapeString(reason), order.TelegramId, a.shopService.FormatPrice(order.Price)))
+	c.String(http.StatusOK, "OK")
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/middleware"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rate limit scopes, the groups of shop routes that are counted separately.
+const (
+	rateScopeAPI      = "api"      // every shop API route
+	rateScopeWrite    = "write"    // routes creating orders or uploading files
+	rateScopeStore    = "store"    // the public storefront, price list and order portal
+	rateScopeReseller = "reseller" // the reseller API
+)
+
+// Shop requests are counted per minute. The limiters are shared by the
+// unversioned and /v1 routes so both count towards the same limit.
+var shopRateLimiters = map[string]*middleware.RateLimiter{
+	rateScopeAPI:      middleware.NewRateLimiter(time.Minute),
+	rateScopeWrite:    middleware.NewRateLimiter(time.Minute),
+	rateScopeStore:    middleware.NewRateLimiter(time.Minute),
+	rateScopeReseller: middleware.NewRateLimiter(time.Minute),
+}
+
+// sessionRateKeys limits a request by its client IP and, once logged in, by
+// its panel user.
+func sessionRateKeys(c *gin.Context) []string {
+	keys := []string{"ip:" + c.ClientIP()}
+	if user := session.GetLoginUser(c); user != nil {
+		keys = append(keys, "user:"+strconv.Itoa(user.Id))
+	}
+	return keys
+}
+
+// clientIPRateKeys limits a public request by its client IP.
+func clientIPRateKeys(c *gin.Context) []string {
+	return []string{"ip:" + c.ClientIP()}
+}
+
+// shopRateLimit returns a middleware limiting the routes of scope to the
+// per-minute limit read by limit, answering 429 and counting the rejection in
+// xui_shop_http_rate_limited_total.
+func shopRateLimit(scope string, limit func() (int, error), keys func(*gin.Context) []string) gin.HandlerFunc {
+	return middleware.RateLimitMiddleware(shopRateLimiters[scope], func() int {
+		n, _ := limit()
+		return n
+	}, keys, func(c *gin.Context, key string) {
+		kind, _, _ := strings.Cut(key, ":")
+		service.CountRateLimited(scope, kind)
+		logger.Warningf("shop %s rate limit: %s over the limit on %s %s", scope, key, c.Request.Method, c.Request.URL.Path)
+	})
+}
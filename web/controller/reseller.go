@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resellerKey is the context key the authenticated reseller is stored under.
+const resellerKey = "reseller"
+
+// ResellerController serves the reseller API, through which resellers order
+// plans for their own end-users and fetch their configs to hand out under their
+// own brand. Resellers are not panel users, so each request carries the
+// reseller's API key instead.
+type ResellerController struct {
+	shopService    service.ShopService
+	settingService service.SettingService
+	tgbotService   service.Tgbot
+}
+
+// NewResellerController creates a ResellerController and registers its routes.
+func NewResellerController(g *gin.RouterGroup) *ResellerController {
+	a := &ResellerController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *ResellerController) initRouter(g *gin.RouterGroup) {
+	reseller := g.Group("/reseller/v1")
+	reseller.Use(shopRateLimit(rateScopeReseller, a.settingService.GetShopApiRatePerMinute, resellerRateKeys))
+	reseller.Use(a.authenticate)
+	reseller.GET("/packages", a.listPackages)
+	reseller.GET("/orders", a.listOrders)
+	reseller.POST("/orders", a.placeOrder)
+	reseller.GET("/orders/:id", a.getOrder)
+	reseller.GET("/orders/:id/configs", a.orderConfigs)
+	reseller.GET("/balance", a.balance)
+	reseller.GET("/entries", a.listEntries)
+}
+
+// resellerAPIKey returns the API key a request carries as a bearer token or
+// in the X-API-Key header.
+func resellerAPIKey(c *gin.Context) string {
+	if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(key)
+	}
+	return strings.TrimSpace(c.GetHeader("X-API-Key"))
+}
+
+// resellerRateKeys limits a reseller request by its client IP and by the
+// visible prefix of its API key, so resellers behind one address do not share
+// a limit.
+func resellerRateKeys(c *gin.Context) []string {
+	keys := []string{"ip:" + c.ClientIP()}
+	if key := resellerAPIKey(c); len(key) >= 10 {
+		keys = append(keys, "key:"+key[:10])
+	}
+	return keys
+}
+
+// authenticate answers 401 to requests without the API key of an enabled
+// reseller.
+func (a *ResellerController) authenticate(c *gin.Context) {
+	reseller, err := a.shopService.AuthenticateReseller(resellerAPIKey(c))
+	if err != nil {
+		if !errors.Is(err, service.ErrResellerKey) {
+			logger.Warning("authenticate reseller failed:", err)
+		}
+		pureJsonMsg(c, http.StatusUnauthorized, false, "invalid API key")
+		c.Abort()
+		return
+	}
+	c.Set(resellerKey, reseller)
+	c.Next()
+}
+
+func currentReseller(c *gin.Context) *model.ShopReseller {
+	return c.MustGet(resellerKey).(*model.ShopReseller)
+}
+
+// resellerOrder returns the order of the id route parameter, answering 404
+// when it is not the reseller's.
+func (a *ResellerController) resellerOrder(c *gin.Context) (*model.ShopOrder, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err == nil {
+		var order *model.ShopOrder
+		if order, err = a.shopService.GetResellerOrder(currentReseller(c).Id, id); err == nil {
+			return order, true
+		}
+	}
+	pureJsonMsg(c, http.StatusNotFound, false, "order not found")
+	return nil, false
+}
+
+func (a *ResellerController) listPackages(c *gin.Context) {
+	packages, err := a.shopService.ResellerPackages(currentReseller(c))
+	jsonObj(c, packages, err)
+}
+
+// placeOrder charges the reseller's balance for an order and provisions it at
+// once. An order that cannot be provisioned yet stays queued and is reported as
+// PROVISIONING; the reseller polls it until it is APPROVED. End-users are never
+// messaged, the reseller hands out the configs itself.
+func (a *ResellerController) placeOrder(c *gin.Context) {
+	req := &service.ShopResellerOrderRequest{}
+	if err := c.ShouldBind(req); err != nil {
+		jsonMsg(c, "invalid order", err)
+		return
+	}
+	reseller := currentReseller(c)
+	order, err := a.shopService.PlaceResellerOrder(reseller, req)
+	if err != nil {
+		jsonShopMsgObj(c, "place order", nil, err)
+		return
+	}
+	ctx := logger.NewContext(c.Request.Context(), logger.Fields{logger.FieldOrderId: order.Id, "reseller": reseller.Id})
+	if err := a.tgbotService.ApproveOrder(ctx, order); err != nil {
+		logger.FromContext(ctx).WithFields(logger.Fields{"error": err}).Warning("approve reseller order failed")
+		if !errors.Is(err, service.ErrProvisionQueued) {
+			a.tgbotService.NotifyAdminsOrderPending(order.Id)
+		}
+	}
+	if updated, err := a.shopService.GetOrder(order.Id); err == nil {
+		order = updated
+	}
+	jsonMsgObj(c, "created", service.ResellerOrderView(order), nil)
+}
+
+// listOrders returns the reseller's orders, only those with the reference
+// query parameter when given.
+func (a *ResellerController) listOrders(c *gin.Context) {
+	orders, err := a.shopService.ListResellerOrders(currentReseller(c).Id, strings.TrimSpace(c.Query("reference")))
+	views := make([]service.ShopResellerOrder, 0, len(orders))
+	for i := range orders {
+		views = append(views, service.ResellerOrderView(&orders[i]))
+	}
+	jsonObj(c, views, err)
+}
+
+func (a *ResellerController) getOrder(c *gin.Context) {
+	order, ok := a.resellerOrder(c)
+	if !ok {
+		return
+	}
+	jsonObj(c, service.ResellerOrderView(order), nil)
+}
+
+// orderConfigs returns the subscription links of an approved order's clients.
+func (a *ResellerController) orderConfigs(c *gin.Context) {
+	order, ok := a.resellerOrder(c)
+	if !ok {
+		return
+	}
+	if order.Status != service.OrderStatusApproved {
+		jsonMsg(c, "get configs", errors.New("order is not approved yet"))
+		return
+	}
+	links, err := a.tgbotService.OrderClientLinks(order)
+	jsonObj(c, links, err)
+}
+
+func (a *ResellerController) balance(c *gin.Context) {
+	summary, err := a.shopService.ResellerSummary(currentReseller(c))
+	jsonObj(c, summary, err)
+}
+
+func (a *ResellerController) listEntries(c *gin.Context) {
+	entries, err := a.shopService.ListResellerEntries(currentReseller(c).Id)
+	jsonObj(c, entries, err)
+}
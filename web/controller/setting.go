@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/mhsanaei/3x-ui/v2/logger"
 	"github.com/mhsanaei/3x-ui/v2/util/crypto"
 	"github.com/mhsanaei/3x-ui/v2/web/entity"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
@@ -25,6 +26,7 @@ type SettingController struct {
 	settingService service.SettingService
 	userService    service.UserService
 	panelService   service.PanelService
+	tgbotService   service.Tgbot
 }
 
 // NewSettingController creates a new SettingController and initializes its routes.
@@ -37,6 +39,7 @@ func NewSettingController(g *gin.RouterGroup) *SettingController {
 // initRouter sets up the routes for settings management.
 func (a *SettingController) initRouter(g *gin.RouterGroup) {
 	g = g.Group("/setting")
+	g.Use(adminAccess())
 
 	g.POST("/all", a.getAllSetting)
 	g.POST("/defaultSettings", a.getDefaultSettings)
@@ -74,7 +77,19 @@ func (a *SettingController) updateSetting(c *gin.Context) {
 		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 		return
 	}
+	if err := service.CheckAdminAccessKept(c.ClientIP(), allSetting); err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
 	err = a.settingService.UpdateAllSetting(allSetting)
+	if err == nil {
+		// Apply a new bot token or admin list without a panel restart.
+		go func() {
+			if err := a.tgbotService.Reload(); err != nil {
+				logger.Warning("reload Telegram bot failed:", err)
+			}
+		}()
+	}
 	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
 }
 
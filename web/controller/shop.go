@@ -1,70 +1,362 @@
 package controller
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database/model"
 	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
 	"github.com/mhsanaei/3x-ui/v2/web/service"
+	"github.com/mhsanaei/3x-ui/v2/web/session"
 
 	"github.com/gin-gonic/gin"
 )
 
+// ShopServicer is the shop data access ShopController needs. It is
+// implemented by service.ShopService.
+type ShopServicer interface {
+	Currency() service.ShopCurrency
+	GetShopSettings() (*service.ShopSettings, error)
+	UpdateShopSettings(settings *entity.AllSetting) error
+
+	ListPackages(filter service.ShopPackageFilter) ([]model.ShopPackage, error)
+	GetPackage(id int) (*model.ShopPackage, error)
+	CreatePackage(pkg *model.ShopPackage) error
+	UpdatePackage(pkg *model.ShopPackage) error
+	ReorderPackages(ids []int) error
+	DeletePackage(id int) error
+	DuplicatePackage(id int) (*model.ShopPackage, error)
+	ExportCatalog(format string) ([]byte, error)
+	ImportCatalog(data []byte, conflict string) (*service.ShopCatalogImportResult, error)
+	SyncCatalog() (*service.ShopCatalogSyncResult, error)
+
+	ListCategories() ([]model.ShopCategory, error)
+	SaveCategory(category *model.ShopCategory) error
+	DeleteCategory(id int) error
+
+	ListOrders() ([]model.ShopOrder, error)
+	ListOrdersByTelegramId(tgId int64) ([]model.ShopOrder, error)
+	GetOrder(id int) (*model.ShopOrder, error)
+	ListProvisioningOrders() ([]model.ShopOrder, error)
+	CreateBulkOrder(order *model.ShopOrder) error
+	ListOrderItems(orderId int) ([]model.ShopOrderItem, error)
+	UpdateOrderStatus(id int, status, note string) error
+	SetOrderContactEmail(id int, address string) error
+	OverrideOrderPrice(id int, price int64, note string) (*model.ShopOrder, error)
+	RecordApproval(id int, admin string) (*model.ShopOrder, error)
+	ListOrderPayments(orderId int) ([]model.ShopOrderPayment, error)
+	ImportOrdersCSV(r io.Reader) (*service.ShopImportResult, error)
+	ReconcileStatementCSV(r io.Reader) (*service.ShopReconcileResult, error)
+	ConfirmStatementPayment(id int, reference string) (*model.ShopOrder, error)
+	ListOrderComments(orderId int) ([]model.ShopOrderComment, error)
+	AddOrderComment(orderId int, author, body string) (*model.ShopOrderComment, error)
+	ArchiveOrders() (int, error)
+	ListArchivedOrders(from, to time.Time) ([]model.ShopOrderArchive, error)
+	ListCustomers() ([]service.ShopCustomerSummary, error)
+	GetCustomer(tgId int64) (*service.ShopCustomerSummary, error)
+	SaveCustomer(customer *model.ShopCustomer) error
+	DeleteCustomer(tgId int64) error
+	ExportCustomerData(tgId int64) (*service.ShopCustomerExport, error)
+	EraseCustomerData(tgId int64) (*service.ShopCustomerErasure, error)
+	DeepLinkStats() ([]service.ShopDeepLinkStats, error)
+	ListSegments() ([]model.ShopSegment, error)
+	GetSegment(id int) (*model.ShopSegment, error)
+	SaveSegment(segment *model.ShopSegment) error
+	DeleteSegment(id int) error
+	SegmentCustomers(segment *model.ShopSegment) ([]service.ShopCustomerSummary, error)
+	ListOrderStatuses() ([]model.ShopOrderStatus, error)
+	SaveOrderStatus(status *model.ShopOrderStatus) error
+	DeleteOrderStatus(id int) error
+	ListCheckoutFields() ([]model.ShopCheckoutField, error)
+	SaveCheckoutField(field *model.ShopCheckoutField) error
+	DeleteCheckoutField(id int) error
+	ListConfigTemplates() ([]model.ShopConfigTemplate, error)
+	SaveConfigTemplate(tmpl *model.ShopConfigTemplate) error
+	DeleteConfigTemplate(id int) error
+	ListOrderShortLinks(orderId int) ([]model.ShopShortLink, error)
+	RevokeShortLink(id int) (*model.ShopShortLink, error)
+	RegenerateShortLink(id int) (*model.ShopShortLink, error)
+	ListOrderPauses(orderId int) ([]model.ShopOrderPause, error)
+	TransitionOrder(id int, to string) (*model.ShopOrder, *model.ShopOrderStatus, error)
+	ScheduleOrder(id int, at time.Time) (*model.ShopOrder, error)
+	HoldOrder(id int, reason string) (*model.ShopOrder, error)
+	ResumeOrder(id int) (*model.ShopOrder, error)
+	RevenueStats(since time.Time) (*service.ShopRevenueStats, error)
+	ListRevenueGoals() ([]model.ShopRevenueGoal, error)
+	SaveRevenueGoal(goal *model.ShopRevenueGoal) error
+	DeleteRevenueGoal(id int) error
+	RevenueGoalProgress(month string) (*service.ShopRevenueGoalProgress, error)
+	WeeklySummary(now time.Time) (*service.ShopWeeklySummary, error)
+	RetentionCohorts(months int, now time.Time) ([]service.ShopRetentionCohort, error)
+	PackageUtilization() ([]service.ShopPackageUtilization, error)
+	HealthCheck(ctx context.Context) *service.ShopHealthReport
+	Location() *time.Location
+	StartOfDay(t time.Time) time.Time
+
+	ListSubscriptions() ([]model.ShopSubscription, error)
+	CancelSubscription(id int) error
+
+	ListPaymentDestinations() ([]service.ShopPaymentDestinationUsage, error)
+	SavePaymentDestination(dest *model.ShopPaymentDestination) error
+	DeletePaymentDestination(id int) error
+
+	ListResellers() ([]model.ShopReseller, error)
+	SaveReseller(reseller *model.ShopReseller) (string, error)
+	RegenerateResellerKey(id int) (string, error)
+	DeleteReseller(id int) error
+	CreditReseller(id int, amount int64, note string) (*model.ShopResellerEntry, error)
+	ListResellerEntries(id int) ([]model.ShopResellerEntry, error)
+
+	ListAbuseLogs(limit int) ([]model.ShopAbuseLog, error)
+	ListTickets(status string) ([]model.ShopTicket, error)
+	ListTicketMessages(ticketId int) ([]model.ShopTicketMessage, error)
+	ListBroadcasts(limit int) ([]model.ShopBroadcast, error)
+
+	ListInbounds() ([]service.ShopInboundOption, error)
+	SetInboundsEnabled(nodeId int, inboundIds []int, enabled bool) error
+	SetAllInboundsEnabled(enabled bool) (int, error)
+	SetInboundTags(nodeId, inboundId int, tags []string) error
+	ListInboundTags() (map[string]int, error)
+	SetInboundEnabled(nodeId, inboundId int, enabled bool) error
+	SetInboundMaxClients(nodeId, inboundId, maxClients int) error
+
+	Backup(password string) ([]byte, error)
+	BackupFileName() string
+	Restore(data []byte, password string) (*service.ShopRestoreResult, error)
+}
+
+// OrderProvisioner creates the clients of approved orders and tells customers
+// about the outcome. It is implemented by service.Tgbot.
+type OrderProvisioner interface {
+	ApproveOrder(ctx context.Context, order *model.ShopOrder) error
+	SendOrderFulfillment(order *model.ShopOrder)
+	SendOrderRejection(orderId int)
+	SendOrderStatusChange(order *model.ShopOrder, status *model.ShopOrderStatus, note string)
+	SendOrderScheduled(order *model.ShopOrder)
+	SendOrderHold(order *model.ShopOrder)
+	RecordOrderPayment(orderId int, amount int64, note, author string) (*model.ShopOrder, error)
+	ChargebackOrder(orderId int, reason string) (*model.ShopOrder, error)
+	EmailOrder(order *model.ShopOrder) error
+	OrderClientLinks(order *model.ShopOrder) ([]service.ShopClientLink, error)
+	RotateOrderClient(order *model.ShopOrder, email string) (*model.ShopOrderClient, error)
+}
+
+// ShopMessenger sends support replies and announcements to customers and names
+// the bot deep links point to. It is implemented by service.Tgbot.
+type ShopMessenger interface {
+	ReplyTicket(ticketId int, author, body string) (*model.ShopTicketMessage, error)
+	CloseSupportTicket(ticketId int) error
+	StartBroadcast(segment, message string) (*model.ShopBroadcast, error)
+	BotUsername() string
+	CheckBot(ctx context.Context) error
+}
+
 // ShopController handles package/order management.
 type ShopController struct {
 	BaseController
-	shopService   service.ShopService
-	tgbotService  service.Tgbot
+	shopService     ShopServicer
+	shopNodeService service.ShopNodeService
+	provisioner     OrderProvisioner
+	messenger       ShopMessenger
 }
 
-// NewShopController creates a ShopController instance.
-func NewShopController(g *gin.RouterGroup) *ShopController {
-	s := &ShopController{}
+// NewShopController creates a ShopController instance serving its routes on g
+// with the given services.
+func NewShopController(g *gin.RouterGroup, shopService ShopServicer, provisioner OrderProvisioner, messenger ShopMessenger) *ShopController {
+	s := &ShopController{
+		shopService: shopService,
+		provisioner: provisioner,
+		messenger:   messenger,
+	}
 	s.initRouter(g)
 	return s
 }
 
 func (s *ShopController) initRouter(g *gin.RouterGroup) {
+	var settings service.SettingService
 	shop := g.Group("/shop")
+	shop.Use(shopRateLimit(rateScopeAPI, settings.GetShopApiRatePerMinute, sessionRateKeys))
+	shop.Use(csrfProtect())
+	writeLimit := shopRateLimit(rateScopeWrite, settings.GetShopApiWriteRatePerMinute, sessionRateKeys)
+	admin := adminAccess()
 
+	shop.GET("/csrf", s.getCSRFToken)
+	shop.GET("/currency", s.getCurrency)
+	shop.GET("/settings", admin, s.getSettings)
+	shop.POST("/settings", admin, s.updateSettings)
 	shop.GET("/packages", s.listPackages)
 	shop.POST("/packages", s.upsertPackage)
+	shop.POST("/packages/reorder", s.reorderPackages)
+	shop.GET("/packages/export", s.exportCatalog)
+	shop.POST("/packages/import", writeLimit, s.importCatalog)
+	shop.POST("/packages/sync", writeLimit, s.syncCatalog)
 	shop.POST("/packages/:id/delete", s.deletePackage)
+	shop.POST("/packages/:id/duplicate", s.duplicatePackage)
+
+	shop.GET("/categories", s.listCategories)
+	shop.POST("/categories", s.saveCategory)
+	shop.POST("/categories/:id/delete", s.deleteCategory)
 
 	shop.GET("/orders", s.listOrders)
-	shop.POST("/orders/:id/approve", s.approveOrder)
-	shop.POST("/orders/:id/reject", s.rejectOrder)
+	shop.POST("/orders/import", writeLimit, admin, s.importOrders)
+	shop.POST("/orders/reconcile", writeLimit, admin, s.reconcileStatement)
+	shop.POST("/orders/bulk", writeLimit, admin, s.createBulkOrder)
+	shop.GET("/orders/archive", s.listArchivedOrders)
+	shop.GET("/orders/archive/export", s.exportArchivedOrders)
+	shop.POST("/orders/archive", s.archiveOrders)
+	shop.GET("/orders/provisioning", s.listProvisioningOrders)
+	shop.POST("/orders/:id/approve", admin, s.approveOrder)
+	shop.POST("/orders/:id/retry", admin, s.retryOrder)
+	shop.POST("/orders/:id/schedule", admin, s.scheduleOrder)
+	shop.POST("/orders/:id/reconcile", admin, s.approveReconciledOrder)
+	shop.POST("/orders/:id/reject", admin, s.rejectOrder)
+	shop.POST("/orders/:id/hold", admin, s.holdOrder)
+	shop.POST("/orders/:id/resume", admin, s.resumeOrder)
+	shop.POST("/orders/:id/chargeback", admin, s.chargebackOrder)
+	shop.POST("/orders/:id/status", admin, s.setOrderStatus)
+	shop.POST("/orders/:id/email", s.emailOrder)
+	shop.GET("/orders/:id/items", s.listOrderItems)
+	shop.GET("/orders/:id/clients", s.listOrderClients)
+	shop.GET("/orders/:id/clients/export", s.exportOrderClients)
+	shop.POST("/orders/:id/rotate", admin, s.rotateOrderClient)
+	shop.GET("/orders/:id/comments", s.listOrderComments)
+	shop.GET("/orders/:id/logs", s.listOrderLogs)
+	shop.POST("/orders/:id/comments", s.addOrderComment)
+	shop.GET("/orders/:id/payments", s.listOrderPayments)
+	shop.POST("/orders/:id/payments", admin, s.recordOrderPayment)
+	shop.GET("/orders/:id/links", s.listOrderShortLinks)
+	shop.GET("/orders/:id/pauses", s.listOrderPauses)
+	shop.POST("/links/:id/revoke", s.revokeShortLink)
+	shop.POST("/links/:id/regenerate", s.regenerateShortLink)
 	shop.GET("/receipt/:id", s.getReceipt)
 
+	shop.GET("/statuses", s.listOrderStatuses)
+	shop.POST("/statuses", s.saveOrderStatus)
+	shop.POST("/statuses/:id/delete", s.deleteOrderStatus)
+
+	shop.GET("/fields", s.listCheckoutFields)
+	shop.POST("/fields", s.saveCheckoutField)
+	shop.POST("/fields/:id/delete", s.deleteCheckoutField)
+
+	shop.GET("/config-files", s.listConfigTemplates)
+	shop.POST("/config-files", s.saveConfigTemplate)
+	shop.POST("/config-files/:id/delete", s.deleteConfigTemplate)
+
+	shop.GET("/subscriptions", s.listSubscriptions)
+	shop.POST("/subscriptions/:id/cancel", s.cancelSubscription)
+
+	shop.GET("/destinations", s.listPaymentDestinations)
+	shop.POST("/destinations", admin, s.savePaymentDestination)
+	shop.POST("/destinations/:id/delete", admin, s.deletePaymentDestination)
+
+	shop.GET("/resellers", admin, s.listResellers)
+	shop.POST("/resellers", admin, s.saveReseller)
+	shop.POST("/resellers/:id/key", admin, s.regenerateResellerKey)
+	shop.POST("/resellers/:id/delete", admin, s.deleteReseller)
+	shop.POST("/resellers/:id/credit", admin, s.creditReseller)
+	shop.GET("/resellers/:id/entries", admin, s.listResellerEntries)
+
+	shop.GET("/customers", s.listCustomers)
+	shop.GET("/customers/:id", s.getCustomer)
+	shop.POST("/customers", s.saveCustomer)
+	shop.POST("/customers/:id/delete", s.deleteCustomer)
+	shop.GET("/customers/:id/export", s.exportCustomerData)
+	shop.POST("/customers/:id/erase", s.eraseCustomerData)
+
+	shop.GET("/deeplinks/stats", s.deepLinkStats)
+
+	shop.GET("/health", s.health)
+
+	shop.GET("/goals", s.listRevenueGoals)
+	shop.POST("/goals", s.saveRevenueGoal)
+	shop.POST("/goals/:id/delete", s.deleteRevenueGoal)
+	shop.GET("/stats/goal", s.revenueGoalProgress)
+	shop.GET("/stats/weekly", s.weeklySummary)
+	shop.GET("/stats/retention", s.retentionCohorts)
+	shop.GET("/stats/packages", s.packageUtilization)
+
+	shop.GET("/segments", s.listSegments)
+	shop.POST("/segments", s.saveSegment)
+	shop.POST("/segments/:id/delete", s.deleteSegment)
+	shop.GET("/segments/:id/customers", s.segmentCustomers)
+	shop.GET("/segments/:id/export", s.exportSegment)
+
+	shop.GET("/abuse", s.listAbuseLogs)
+
+	shop.GET("/tickets", s.listTickets)
+	shop.GET("/tickets/:id/messages", s.listTicketMessages)
+	shop.POST("/tickets/:id/reply", s.replyTicket)
+	shop.POST("/tickets/:id/close", s.closeTicket)
+
+	shop.POST("/graphql", s.graphql)
+
+	shop.GET("/backup", s.backup)
+	shop.POST("/restore", writeLimit, admin, s.restore)
+
+	shop.GET("/broadcasts", s.listBroadcasts)
+	shop.POST("/broadcast", s.broadcast)
+
 	shop.GET("/inbounds", s.listInbounds)
+	shop.GET("/inbounds/tags", s.listInboundTags)
+	shop.POST("/inbounds/bulk", s.setInboundsEnabled)
 	shop.POST("/inbounds/:id", s.setInboundEnabled)
+	shop.POST("/inbounds/:id/limit", s.setInboundLimit)
+	shop.POST("/inbounds/:id/tags", s.setInboundTags)
+
+	shop.GET("/nodes", admin, s.listNodes)
+	shop.POST("/nodes", admin, s.saveNode)
+	shop.POST("/nodes/:id/delete", admin, s.deleteNode)
+	shop.GET("/nodes/:id/status", admin, s.nodeStatus)
 }
 
 func (s *ShopController) listPackages(c *gin.Context) {
-	packages, err := s.shopService.ListPackages(false)
+	archived, _ := strconv.ParseBool(c.Query("archived"))
+	filter := service.ShopPackageFilter{Archived: archived}
+	if categoryId, err := strconv.Atoi(c.Query("categoryId")); err == nil {
+		filter.CategoryId = &categoryId
+	}
+	packages, err := s.shopService.ListPackages(filter)
 	jsonObj(c, packages, err)
 }
 
 func (s *ShopController) upsertPackage(c *gin.Context) {
 	pkg := &model.ShopPackage{}
-	if err := c.ShouldBindJSON(pkg); err != nil {
+	if err := c.ShouldBind(pkg); err != nil {
 		jsonMsg(c, "invalid package", err)
 		return
 	}
-	if pkg.Name == "" {
-		jsonMsg(c, "name is required", nil)
-		return
-	}
 	if pkg.Id > 0 {
 		err := s.shopService.UpdatePackage(pkg)
-		jsonMsg(c, "updated", err)
+		jsonShopMsgObj(c, "updated", pkg, err)
 		return
 	}
 	err := s.shopService.CreatePackage(pkg)
-	jsonMsg(c, "created", err)
+	jsonShopMsgObj(c, "created", pkg, err)
+}
+
+// jsonShopMsgObj is jsonMsgObj for saving shop models: on a validation error
+// the object is replaced by the invalid fields' messages, keyed by field, in
+// the admin's language.
+func jsonShopMsgObj(c *gin.Context, msg string, obj any, err error) {
+	if verr, ok := service.AsValidationError(err); ok {
+		lang := ""
+		if cookie, cookieErr := c.Request.Cookie("lang"); cookieErr == nil {
+			lang = service.MatchShopLanguage(cookie.Value)
+		}
+		jsonMsgObj(c, msg, gin.H{"fields": verr.Localize(lang)}, err)
+		return
+	}
+	jsonMsgObj(c, msg, obj, err)
 }
 
 func (s *ShopController) deletePackage(c *gin.Context) {
@@ -74,6 +366,147 @@ func (s *ShopController) deletePackage(c *gin.Context) {
 		return
 	}
 	err = s.shopService.DeletePackage(id)
+	jsonMsg(c, "archived", err)
+}
+
+func (s *ShopController) reorderPackages(c *gin.Context) {
+	var body struct {
+		Ids []int `json:"ids" form:"ids"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		jsonMsg(c, "invalid request", err)
+		return
+	}
+	err := s.shopService.ReorderPackages(body.Ids)
+	jsonMsg(c, "reordered", err)
+}
+
+func (s *ShopController) duplicatePackage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	pkg, err := s.shopService.DuplicatePackage(id)
+	jsonMsgObj(c, "duplicated", pkg, err)
+}
+
+// exportCatalog downloads the package catalog as JSON, or as YAML with
+// ?format=yaml, for importing on another panel.
+func (s *ShopController) exportCatalog(c *gin.Context) {
+	format := c.DefaultQuery("format", service.CatalogFormatJSON)
+	data, err := s.shopService.ExportCatalog(format)
+	if err != nil {
+		jsonMsg(c, "export catalog", err)
+		return
+	}
+	contentType := "application/json"
+	if format == service.CatalogFormatYAML {
+		contentType = "application/yaml"
+	}
+	name := fmt.Sprintf("x-ui-packages-%s.%s", time.Now().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", "attachment; filename="+name)
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// maxShopCatalogSize bounds uploaded package catalogs.
+const maxShopCatalogSize = 4 << 20
+
+// importCatalog adds the packages of an uploaded catalog, resolving name
+// conflicts as the conflict field says: skip, overwrite or duplicate.
+func (s *ShopController) importCatalog(c *gin.Context) {
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		jsonMsg(c, "invalid file", err)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxShopCatalogSize+1))
+	if err != nil {
+		jsonMsg(c, "import catalog", err)
+		return
+	}
+	if len(data) > maxShopCatalogSize {
+		jsonMsg(c, "import catalog", errors.New("catalog file is too large"))
+		return
+	}
+	result, err := s.shopService.ImportCatalog(data, c.PostForm("conflict"))
+	if err != nil {
+		jsonMsg(c, "import catalog", err)
+		return
+	}
+	jsonMsgObj(c, fmt.Sprintf("created %d, updated %d, skipped %d", result.Created, result.Updated, result.Skipped), result, nil)
+}
+
+// syncCatalog pulls the package catalog from the primary panel right away
+// instead of waiting for the sync job.
+func (s *ShopController) syncCatalog(c *gin.Context) {
+	result, err := s.shopService.SyncCatalog()
+	if err != nil {
+		jsonMsg(c, "sync catalog", err)
+		return
+	}
+	jsonMsgObj(c, fmt.Sprintf("created %d, updated %d, archived %d", result.Created, result.Updated, result.Archived), result, nil)
+}
+
+// getCurrency reports the currency shop amounts are kept in. Amounts are
+// integers in its minor unit.
+func (s *ShopController) getCurrency(c *gin.Context) {
+	jsonObj(c, s.shopService.Currency(), nil)
+}
+
+func (s *ShopController) getSettings(c *gin.Context) {
+	settings, err := s.shopService.GetShopSettings()
+	jsonObj(c, settings, err)
+}
+
+// updateSettings saves the shop settings posted; settings left out keep their
+// current value and other panel settings are not touched.
+func (s *ShopController) updateSettings(c *gin.Context) {
+	var settingService service.SettingService
+	allSetting, err := settingService.GetAllSetting()
+	if err != nil {
+		jsonMsg(c, "get settings", err)
+		return
+	}
+	if err := c.ShouldBind(allSetting); err != nil {
+		jsonMsg(c, "invalid settings", err)
+		return
+	}
+	if err := service.CheckAdminAccessKept(c.ClientIP(), allSetting); err != nil {
+		jsonMsg(c, "invalid settings", err)
+		return
+	}
+	if err := s.shopService.UpdateShopSettings(allSetting); err != nil {
+		jsonShopMsgObj(c, "updated", nil, err)
+		return
+	}
+	settings, err := s.shopService.GetShopSettings()
+	jsonMsgObj(c, "updated", settings, err)
+}
+
+func (s *ShopController) listCategories(c *gin.Context) {
+	categories, err := s.shopService.ListCategories()
+	jsonObj(c, categories, err)
+}
+
+func (s *ShopController) saveCategory(c *gin.Context) {
+	category := &model.ShopCategory{}
+	if err := c.ShouldBind(category); err != nil {
+		jsonMsg(c, "invalid category", err)
+		return
+	}
+	err := s.shopService.SaveCategory(category)
+	jsonShopMsgObj(c, "saved", category, err)
+}
+
+func (s *ShopController) deleteCategory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteCategory(id)
 	jsonMsg(c, "deleted", err)
 }
 
@@ -83,7 +516,7 @@ func (s *ShopController) listOrders(c *gin.Context) {
 		jsonMsg(c, "failed to get orders", err)
 		return
 	}
-	packages, _ := s.shopService.ListPackages(false)
+	packages, _ := s.shopService.ListPackages(service.ShopPackageFilter{IncludeArchived: true})
 	resp := gin.H{
 		"orders":   orders,
 		"packages": packages,
@@ -91,7 +524,135 @@ func (s *ShopController) listOrders(c *gin.Context) {
 	jsonObj(c, resp, nil)
 }
 
-func (s *ShopController) approveOrder(c *gin.Context) {
+// archiveRange reads the optional from and to dates (YYYY-MM-DD, both
+// inclusive) bounding the creation time of archived orders, as days of the
+// panel's time zone.
+func archiveRange(c *gin.Context, loc *time.Location) (from, to time.Time, err error) {
+	if v := c.Query("from"); v != "" {
+		if from, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = time.ParseInLocation("2006-01-02", v, loc); err != nil {
+			return
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	return
+}
+
+func (s *ShopController) listArchivedOrders(c *gin.Context) {
+	from, to, err := archiveRange(c, s.shopService.Location())
+	if err != nil {
+		jsonMsg(c, "invalid date", err)
+		return
+	}
+	orders, err := s.shopService.ListArchivedOrders(from, to)
+	jsonObj(c, orders, err)
+}
+
+// exportArchivedOrders downloads the archived orders as a JSON file.
+func (s *ShopController) exportArchivedOrders(c *gin.Context) {
+	from, to, err := archiveRange(c, s.shopService.Location())
+	if err != nil {
+		jsonMsg(c, "invalid date", err)
+		return
+	}
+	orders, err := s.shopService.ListArchivedOrders(from, to)
+	if err != nil {
+		jsonMsg(c, "export archive", err)
+		return
+	}
+	data, err := json.MarshalIndent(orders, "", "  ")
+	if err != nil {
+		jsonMsg(c, "export archive", err)
+		return
+	}
+	name := fmt.Sprintf("x-ui-orders-archive-%s.json", time.Now().Format("20060102-150405"))
+	c.Header("Content-Disposition", "attachment; filename="+name)
+	c.Data(http.StatusOK, "application/json", data)
+}
+
+// archiveOrders runs the archival job immediately.
+func (s *ShopController) archiveOrders(c *gin.Context) {
+	archived, err := s.shopService.ArchiveOrders()
+	jsonMsgObj(c, "archive orders", gin.H{"archived": archived}, err)
+}
+
+func (s *ShopController) importOrders(c *gin.Context) {
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		jsonMsg(c, "invalid file", err)
+		return
+	}
+	defer file.Close()
+	result, err := s.shopService.ImportOrdersCSV(file)
+	if err != nil {
+		jsonMsg(c, "import failed", err)
+		return
+	}
+	jsonMsgObj(c, fmt.Sprintf("imported %d, skipped %d", result.Imported, result.Skipped), result, nil)
+}
+
+// reconcileStatement matches the transactions of an uploaded bank statement CSV
+// to the orders awaiting payment and returns the suggested matches. Orders
+// matched by their unique amount code are approved right away.
+func (s *ShopController) reconcileStatement(c *gin.Context) {
+	file, _, err := c.Request.FormFile("file")
+	if err != nil {
+		jsonMsg(c, "invalid file", err)
+		return
+	}
+	defer file.Close()
+	result, err := s.shopService.ReconcileStatementCSV(file)
+	if err != nil {
+		jsonMsg(c, "reconcile failed", err)
+		return
+	}
+	fields := logger.Fields{}
+	admin := ""
+	if user := session.GetLoginUser(c); user != nil {
+		admin = user.Username
+		fields["admin"] = admin
+	}
+	ctx := logger.NewContext(c.Request.Context(), fields)
+	for i := range result.Matches {
+		if result.Matches[i].Match == service.StatementMatchCode {
+			result.Matches[i].Approved = s.approveStatementMatch(ctx, &result.Matches[i], admin)
+		}
+	}
+	jsonMsgObj(c, fmt.Sprintf("matched %d, unmatched %d", len(result.Matches), result.Unmatched), result, nil)
+}
+
+// approveStatementMatch approves the order of a statement transaction on
+// behalf of admin, who uploaded the statement, and tells whether it was
+// provisioned. Failures, and orders needing a second admin, are left for the
+// admins to approve.
+func (s *ShopController) approveStatementMatch(ctx context.Context, match *service.ShopStatementMatch, admin string) bool {
+	ctx = logger.NewContext(ctx, logger.Fields{logger.FieldOrderId: match.OrderId, "reconciled": match.Match})
+	log := logger.FromContext(ctx)
+	order, err := s.shopService.ConfirmStatementPayment(match.OrderId, match.Reference)
+	if err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("confirm reconciled order failed")
+		return false
+	}
+	if order, err = s.shopService.RecordApproval(order.Id, admin); err != nil {
+		log.WithFields(logger.Fields{"error": err}).Info("reconciled order left for approval")
+		return false
+	}
+	if err := s.provisioner.ApproveOrder(ctx, order); err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("approve reconciled order failed")
+		return false
+	}
+	s.provisioner.SendOrderFulfillment(order)
+	return true
+}
+
+// approveReconciledOrder approves an order a bank statement transaction, with
+// the reference parameter, was matched to. The transaction stands in for the
+// receipt and pays what is left of an order paid in installments.
+func (s *ShopController) approveReconciledOrder(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		jsonMsg(c, "invalid id", err)
@@ -102,74 +663,1163 @@ func (s *ShopController) approveOrder(c *gin.Context) {
 		jsonMsg(c, "order not found", err)
 		return
 	}
+	reference := c.PostForm("reference")
+	if balance := service.OrderBalance(order); balance > 0 {
+		author := ""
+		if user := session.GetLoginUser(c); user != nil {
+			author = user.Username
+		}
+		if _, err := s.provisioner.RecordOrderPayment(id, balance, reference, author); err != nil {
+			jsonShopMsgObj(c, "approve failed", nil, err)
+			return
+		}
+	}
+	if _, err := s.shopService.ConfirmStatementPayment(id, reference); err != nil {
+		jsonMsg(c, "approve failed", err)
+		return
+	}
+	s.provisionOrder(c, "order is not pending review", service.OrderStatusPendingReview)
+}
+
+func (s *ShopController) approveOrder(c *gin.Context) {
+	s.provisionOrder(c, "order is not pending review", service.OrderStatusPendingReview, service.OrderStatusScheduled)
+}
+
+// retryOrder provisions an order from the provisioning queue right away.
+func (s *ShopController) retryOrder(c *gin.Context) {
+	s.provisionOrder(c, "order is not queued for provisioning", service.OrderStatusProvisioning)
+}
 
-	if order.Status != service.OrderStatusPendingReview {
-		jsonMsg(c, "order not ready", nil)
+// scheduleOrder approves an order to be provisioned at the time given by the
+// at parameter, in Unix milliseconds, and tells the customer when.
+func (s *ShopController) scheduleOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	at, err := strconv.ParseInt(c.PostForm("at"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "invalid date", err)
+		return
+	}
+	admin := ""
+	if user := session.GetLoginUser(c); user != nil {
+		admin = user.Username
+	}
+	if order, err := s.shopService.GetOrder(id); err == nil && order.Status == service.OrderStatusPendingReview {
+		if _, err := s.shopService.RecordApproval(id, admin); err != nil {
+			jsonMsg(c, "approval recorded", err)
+			return
+		}
+	}
+	order, err := s.shopService.ScheduleOrder(id, time.UnixMilli(at))
+	if err != nil {
+		jsonMsg(c, "schedule order", err)
 		return
 	}
+	fields := logger.Fields{logger.FieldOrderId: id, "at": order.ScheduledAt}
+	if admin != "" {
+		fields["admin"] = admin
+	}
+	logger.FromContext(c.Request.Context()).WithFields(fields).Info("order scheduled")
+	s.provisioner.SendOrderScheduled(order)
+	jsonMsgObj(c, "scheduled", order, nil)
+}
 
-	email, clientId, subId, err := s.tgbotService.ProvisionOrder(order)
+// provisionOrder approves an order in one of the given statuses, first charging
+// the price in the optional price parameter, in minor units, for the reason
+// given by priceNote. An order whose provisioning fails stays in the
+// provisioning queue.
+func (s *ShopController) provisionOrder(c *gin.Context, notReady string, statuses ...string) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	order, err := s.shopService.GetOrder(id)
 	if err != nil {
-		jsonMsg(c, "provision failed", err)
+		jsonMsg(c, "order not found", err)
 		return
 	}
 
-	if err := s.shopService.SetOrderProvisioned(order.Id, email, clientId, subId); err != nil {
-		logger.Warning("order provision saved partially:", err)
+	if !slices.Contains(statuses, order.Status) {
+		jsonMsg(c, "order not ready", errors.New(notReady))
+		return
+	}
+
+	fields := logger.Fields{logger.FieldOrderId: id}
+	admin := ""
+	if user := session.GetLoginUser(c); user != nil {
+		admin = user.Username
+		fields["admin"] = admin
+	}
+	if order.Status == service.OrderStatusPendingReview {
+		// Orders above the second approval price, as placed, wait for another
+		// admin before their price may be changed.
+		if order, err = s.shopService.RecordApproval(id, admin); err != nil {
+			jsonMsg(c, "approval recorded", err)
+			return
+		}
+	}
+	if value := c.PostForm("price"); value != "" {
+		price, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			jsonMsg(c, "invalid price", err)
+			return
+		}
+		if price != order.Price {
+			if order, err = s.shopService.OverrideOrderPrice(id, price, c.PostForm("priceNote")); err != nil {
+				jsonShopMsgObj(c, "approve failed", nil, err)
+				return
+			}
+			fields["price"] = price
+			fields["originalPrice"] = order.OriginalPrice
+		}
+	}
+	ctx := logger.NewContext(c.Request.Context(), fields)
+	if err := s.provisioner.ApproveOrder(ctx, order); err != nil {
+		jsonMsg(c, "approve failed", err)
+		return
 	}
 
 	// notify user if bot is running
-	s.tgbotService.SendOrderFulfillment(order.TelegramId, email)
+	s.provisioner.SendOrderFulfillment(order)
 	jsonMsg(c, "approved", nil)
 }
 
-func (s *ShopController) rejectOrder(c *gin.Context) {
+// listProvisioningOrders returns the orders waiting in the provisioning queue.
+func (s *ShopController) listProvisioningOrders(c *gin.Context) {
+	orders, err := s.shopService.ListProvisioningOrders()
+	jsonObj(c, gin.H{"orders": orders, "maxAttempts": service.ShopProvisionMaxAttempts}, err)
+}
+
+// createBulkOrder places a bulk order provisioning several clients at once,
+// ready for approval.
+func (s *ShopController) createBulkOrder(c *gin.Context) {
+	var body struct {
+		TelegramId   int64  `json:"telegramId" form:"telegramId"`
+		ContactEmail string `json:"contactEmail" form:"contactEmail"`
+		NodeId       int    `json:"nodeId" form:"nodeId"`
+		InboundId    int    `json:"inboundId" form:"inboundId"`
+		PackageId    int    `json:"packageId" form:"packageId"`
+		CustomDataGB int    `json:"customDataGb" form:"customDataGb"`
+		CustomDays   int    `json:"customDays" form:"customDays"`
+		Seats        int    `json:"seats" form:"seats"`
+		Price        int64  `json:"price" form:"price"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		jsonMsg(c, "invalid request", err)
+		return
+	}
+	order := &model.ShopOrder{
+		TelegramId:   body.TelegramId,
+		ContactEmail: strings.TrimSpace(body.ContactEmail),
+		NodeId:       body.NodeId,
+		InboundId:    body.InboundId,
+		CustomDataGB: body.CustomDataGB,
+		CustomDays:   body.CustomDays,
+		Seats:        body.Seats,
+		Price:        body.Price,
+	}
+	if body.PackageId > 0 {
+		order.PackageId = &body.PackageId
+	}
+	err := s.shopService.CreateBulkOrder(order)
+	jsonShopMsgObj(c, "created", order, err)
+}
+
+// listOrderItems returns the packages of a cart order with the client each
+// one was provisioned as.
+func (s *ShopController) listOrderItems(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		jsonMsg(c, "invalid id", err)
 		return
 	}
-	err = s.shopService.UpdateOrderStatus(id, service.OrderStatusRejected, "")
-	jsonMsg(c, "rejected", err)
+	items, err := s.shopService.ListOrderItems(id)
+	jsonObj(c, items, err)
 }
 
-func (s *ShopController) listInbounds(c *gin.Context) {
-	inbounds, err := s.shopService.ListInbounds()
-	jsonObj(c, inbounds, err)
+// orderForClients loads the approved order whose clients are requested.
+func (s *ShopController) orderForClients(c *gin.Context) (*model.ShopOrder, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	order, err := s.shopService.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != service.OrderStatusApproved {
+		return nil, errors.New("order is not approved")
+	}
+	return order, nil
 }
 
-func (s *ShopController) setInboundEnabled(c *gin.Context) {
+// listOrderClients returns the clients of an approved order with their
+// subscription URLs.
+func (s *ShopController) listOrderClients(c *gin.Context) {
+	order, err := s.orderForClients(c)
+	if err != nil {
+		jsonMsg(c, "order clients", err)
+		return
+	}
+	links, err := s.provisioner.OrderClientLinks(order)
+	jsonObj(c, links, err)
+}
+
+// exportOrderClients downloads the clients of an approved order as CSV.
+func (s *ShopController) exportOrderClients(c *gin.Context) {
+	order, err := s.orderForClients(c)
+	if err != nil {
+		jsonMsg(c, "order clients", err)
+		return
+	}
+	links, err := s.provisioner.OrderClientLinks(order)
+	if err != nil {
+		jsonMsg(c, "order clients", err)
+		return
+	}
+	data, err := service.ShopClientLinksCSV(links)
+	if err != nil {
+		jsonMsg(c, "order clients", err)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+service.ShopClientLinksFileName(order.Id))
+	c.Data(http.StatusOK, "text/csv", data)
+}
+
+func (s *ShopController) listOrderComments(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		jsonMsg(c, "invalid id", err)
 		return
 	}
-	var body struct {
-		Enabled bool `json:"enabled"`
+	comments, err := s.shopService.ListOrderComments(id)
+	jsonObj(c, comments, err)
+}
+
+func (s *ShopController) addOrderComment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
 	}
-	if err := c.ShouldBindJSON(&body); err != nil {
-		jsonMsg(c, "invalid request", err)
+	body := strings.TrimSpace(c.PostForm("body"))
+	if body == "" {
+		jsonMsg(c, "invalid comment", errors.New("comment is empty"))
 		return
 	}
-	err = s.shopService.SetInboundEnabled(id, body.Enabled)
-	jsonMsg(c, "updated", err)
+	author := ""
+	if user := session.GetLoginUser(c); user != nil {
+		author = user.Username
+	}
+	comment, err := s.shopService.AddOrderComment(id, author, body)
+	jsonMsgObj(c, "saved", comment, err)
 }
 
-func (s *ShopController) getReceipt(c *gin.Context) {
+// listOrderShortLinks returns the short links sent for an order with their hits.
+func (s *ShopController) listOrderShortLinks(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		c.AbortWithStatus(http.StatusBadRequest)
+		jsonMsg(c, "invalid id", err)
 		return
 	}
-	order, err := s.shopService.GetOrder(id)
-	if err != nil || order.ReceiptPath == "" {
-		c.AbortWithStatus(http.StatusNotFound)
+	links, err := s.shopService.ListOrderShortLinks(id)
+	jsonObj(c, links, err)
+}
+
+// listOrderPauses returns the times the customer paused an order, latest first.
+func (s *ShopController) listOrderPauses(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
 		return
 	}
-	path := filepath.Clean(order.ReceiptPath)
-	if _, err := os.Stat(path); err != nil {
-		c.AbortWithStatus(http.StatusNotFound)
+	pauses, err := s.shopService.ListOrderPauses(id)
+	jsonObj(c, pauses, err)
+}
+
+func (s *ShopController) revokeShortLink(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	link, err := s.shopService.RevokeShortLink(id)
+	jsonMsgObj(c, "revoked", link, err)
+}
+
+// regenerateShortLink replaces a short link, such as one shared too widely,
+// with a new one to the same subscription.
+func (s *ShopController) regenerateShortLink(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	link, err := s.shopService.RegenerateShortLink(id)
+	jsonMsgObj(c, "regenerated", link, err)
+}
+
+// listOrderPayments returns the installments paid towards an order.
+func (s *ShopController) listOrderPayments(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	payments, err := s.shopService.ListOrderPayments(id)
+	jsonObj(c, payments, err)
+}
+
+// recordOrderPayment records an installment of amount, in minor units, paid
+// towards an order.
+func (s *ShopController) recordOrderPayment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	amount, err := strconv.ParseInt(c.PostForm("amount"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "invalid amount", err)
+		return
+	}
+	author := ""
+	if user := session.GetLoginUser(c); user != nil {
+		author = user.Username
+	}
+	order, err := s.provisioner.RecordOrderPayment(id, amount, c.PostForm("note"), author)
+	if err == nil {
+		logger.FromContext(c.Request.Context()).WithFields(logger.Fields{
+			logger.FieldOrderId: id, "amount": amount, "paid": order.PaidAmount, "admin": author,
+		}).Info("order payment recorded")
+	}
+	jsonShopMsgObj(c, "saved", order, err)
+}
+
+// holdOrder puts an order on hold and sends the customer the reason, the
+// question they are to answer.
+func (s *ShopController) holdOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	order, err := s.shopService.HoldOrder(id, c.PostForm("reason"))
+	if err != nil {
+		jsonShopMsgObj(c, "hold order", nil, err)
+		return
+	}
+	author := ""
+	if user := session.GetLoginUser(c); user != nil {
+		author = user.Username
+	}
+	if _, err := s.shopService.AddOrderComment(id, author, "On hold: "+order.HoldReason); err != nil {
+		logger.Warning("save order hold reason failed:", err)
+	}
+	logger.FromContext(c.Request.Context()).WithFields(logger.Fields{logger.FieldOrderId: id, "admin": author}).Info("order put on hold")
+	s.provisioner.SendOrderHold(order)
+	jsonMsgObj(c, "updated", order, nil)
+}
+
+// resumeOrder takes an order off hold without waiting for the customer.
+func (s *ShopController) resumeOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	order, err := s.shopService.ResumeOrder(id)
+	jsonMsgObj(c, "updated", order, err)
+}
+
+// chargebackOrder records that an order's payment was reversed, disabling its
+// clients.
+func (s *ShopController) chargebackOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	order, err := s.provisioner.ChargebackOrder(id, c.PostForm("reason"))
+	if err != nil {
+		jsonShopMsgObj(c, "chargeback order", nil, err)
+		return
+	}
+	author := ""
+	if user := session.GetLoginUser(c); user != nil {
+		author = user.Username
+	}
+	if _, err := s.shopService.AddOrderComment(id, author, "Chargeback: "+order.ChargebackReason); err != nil {
+		logger.Warning("save order chargeback reason failed:", err)
+	}
+	logger.FromContext(c.Request.Context()).WithFields(logger.Fields{logger.FieldOrderId: id, "admin": author}).Info("order charged back")
+	jsonMsgObj(c, "updated", order, nil)
+}
+
+func (s *ShopController) rejectOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.UpdateOrderStatus(id, service.OrderStatusRejected, "")
+	if err == nil {
+		logger.FromContext(c.Request.Context()).WithFields(logger.Fields{logger.FieldOrderId: id}).Info("order rejected")
+		s.provisioner.SendOrderRejection(id)
+	}
+	jsonMsg(c, "rejected", err)
+}
+
+// setOrderStatus moves an order to another status along the order workflow,
+// keeps the admin's note as an order comment and messages the customer when
+// the new status asks for it.
+func (s *ShopController) setOrderStatus(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	order, status, err := s.shopService.TransitionOrder(id, c.PostForm("status"))
+	if err != nil {
+		jsonMsg(c, "update status", err)
+		return
+	}
+	author := ""
+	if user := session.GetLoginUser(c); user != nil {
+		author = user.Username
+	}
+	note := strings.TrimSpace(c.PostForm("note"))
+	if note != "" {
+		if _, err := s.shopService.AddOrderComment(id, author, note); err != nil {
+			logger.Warning("save order status note failed:", err)
+		}
+	}
+	logger.FromContext(c.Request.Context()).WithFields(logger.Fields{logger.FieldOrderId: id, "status": order.Status, "admin": author}).Info("order status changed")
+	if status != nil && status.NotifyCustomer {
+		s.provisioner.SendOrderStatusChange(order, status, note)
+	}
+	jsonMsgObj(c, "updated", order, nil)
+}
+
+// listOrderLogs returns the buffered log entries tagged with an order, newest
+// first, to help find out why its provisioning failed.
+func (s *ShopController) listOrderLogs(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	count, _ := strconv.Atoi(c.DefaultQuery("count", "100"))
+	if count <= 0 {
+		count = 100
+	}
+	jsonObj(c, logger.QueryLogs(logger.FieldOrderId, id, count), nil)
+}
+
+// emailOrder saves the customer's email address on an approved order and sends
+// the subscription links and invoice to it.
+func (s *ShopController) emailOrder(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	order, err := s.shopService.GetOrder(id)
+	if err != nil {
+		jsonMsg(c, "order not found", err)
+		return
+	}
+	if order.Status != service.OrderStatusApproved {
+		jsonMsg(c, "email order", errors.New("order is not approved"))
+		return
+	}
+	if err := s.shopService.SetOrderContactEmail(id, c.PostForm("email")); err != nil {
+		jsonMsg(c, "email order", err)
+		return
+	}
+	// Read the order again for the address as stored.
+	if order, err = s.shopService.GetOrder(id); err != nil {
+		jsonMsg(c, "order not found", err)
+		return
+	}
+	jsonMsg(c, "email sent", s.provisioner.EmailOrder(order))
+}
+
+// rotateOrderClient gives the order's client named by the email parameter, or
+// its first client, a new UUID or password and subId, and sends the customer
+// the new links.
+func (s *ShopController) rotateOrderClient(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	order, err := s.shopService.GetOrder(id)
+	if err != nil {
+		jsonMsg(c, "order not found", err)
+		return
+	}
+	email := c.PostForm("email")
+	if email == "" {
+		email = order.ClientEmail
+	}
+	client, err := s.provisioner.RotateOrderClient(order, email)
+	if err == nil {
+		fields := logger.Fields{logger.FieldOrderId: id, "client": email}
+		if user := session.GetLoginUser(c); user != nil {
+			fields["admin"] = user.Username
+		}
+		logger.FromContext(c.Request.Context()).WithFields(fields).Info("client credentials rotated")
+	}
+	jsonMsgObj(c, "rotated", client, err)
+}
+
+func (s *ShopController) listSubscriptions(c *gin.Context) {
+	subs, err := s.shopService.ListSubscriptions()
+	jsonObj(c, subs, err)
+}
+
+func (s *ShopController) cancelSubscription(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.CancelSubscription(id)
+	jsonMsg(c, "cancelled", err)
+}
+
+func (s *ShopController) listPaymentDestinations(c *gin.Context) {
+	dests, err := s.shopService.ListPaymentDestinations()
+	jsonObj(c, dests, err)
+}
+
+func (s *ShopController) savePaymentDestination(c *gin.Context) {
+	dest := &model.ShopPaymentDestination{}
+	if err := c.ShouldBind(dest); err != nil {
+		jsonMsg(c, "invalid destination", err)
+		return
+	}
+	err := s.shopService.SavePaymentDestination(dest)
+	jsonShopMsgObj(c, "saved", dest, err)
+}
+
+func (s *ShopController) deletePaymentDestination(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeletePaymentDestination(id)
+	jsonMsg(c, "deleted", err)
+}
+
+func (s *ShopController) listResellers(c *gin.Context) {
+	resellers, err := s.shopService.ListResellers()
+	jsonObj(c, resellers, err)
+}
+
+// saveReseller creates or updates a reseller. A new reseller's API key is in
+// the response and cannot be read again later.
+func (s *ShopController) saveReseller(c *gin.Context) {
+	reseller := &model.ShopReseller{}
+	if err := c.ShouldBind(reseller); err != nil {
+		jsonMsg(c, "invalid reseller", err)
+		return
+	}
+	key, err := s.shopService.SaveReseller(reseller)
+	jsonShopMsgObj(c, "saved", gin.H{"reseller": reseller, "key": key}, err)
+}
+
+// regenerateResellerKey replaces a reseller's API key, such as one that leaked.
+func (s *ShopController) regenerateResellerKey(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	key, err := s.shopService.RegenerateResellerKey(id)
+	jsonMsgObj(c, "regenerated", gin.H{"key": key}, err)
+}
+
+func (s *ShopController) deleteReseller(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteReseller(id)
+	jsonMsg(c, "deleted", err)
+}
+
+// creditReseller adds amount, in minor units, to a reseller's balance. A
+// negative amount corrects the balance down.
+func (s *ShopController) creditReseller(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	amount, err := strconv.ParseInt(c.PostForm("amount"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "invalid amount", err)
+		return
+	}
+	entry, err := s.shopService.CreditReseller(id, amount, c.PostForm("note"))
+	if err == nil {
+		author := ""
+		if user := session.GetLoginUser(c); user != nil {
+			author = user.Username
+		}
+		logger.FromContext(c.Request.Context()).WithFields(logger.Fields{
+			"reseller": id, "amount": amount, "balance": entry.Balance, "admin": author,
+		}).Info("reseller balance credited")
+	}
+	jsonShopMsgObj(c, "saved", entry, err)
+}
+
+func (s *ShopController) listResellerEntries(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	entries, err := s.shopService.ListResellerEntries(id)
+	jsonObj(c, entries, err)
+}
+
+func (s *ShopController) listTickets(c *gin.Context) {
+	tickets, err := s.shopService.ListTickets(c.Query("status"))
+	jsonObj(c, tickets, err)
+}
+
+func (s *ShopController) listTicketMessages(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	messages, err := s.shopService.ListTicketMessages(id)
+	jsonObj(c, messages, err)
+}
+
+func (s *ShopController) replyTicket(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	author := ""
+	if user := session.GetLoginUser(c); user != nil {
+		author = user.Username
+	}
+	message, err := s.messenger.ReplyTicket(id, author, c.PostForm("body"))
+	jsonMsgObj(c, "sent", message, err)
+}
+
+func (s *ShopController) closeTicket(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.messenger.CloseSupportTicket(id)
+	jsonMsg(c, "closed", err)
+}
+
+func (s *ShopController) listBroadcasts(c *gin.Context) {
+	broadcasts, err := s.shopService.ListBroadcasts(50)
+	jsonObj(c, broadcasts, err)
+}
+
+func (s *ShopController) broadcast(c *gin.Context) {
+	broadcast, err := s.messenger.StartBroadcast(c.PostForm("segment"), c.PostForm("message"))
+	jsonMsgObj(c, "broadcast started", broadcast, err)
+}
+
+func (s *ShopController) listCustomers(c *gin.Context) {
+	customers, err := s.shopService.ListCustomers()
+	jsonObj(c, customers, err)
+}
+
+func (s *ShopController) getCustomer(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	customer, err := s.shopService.GetCustomer(id)
+	jsonObj(c, customer, err)
+}
+
+func (s *ShopController) saveCustomer(c *gin.Context) {
+	customer := &model.ShopCustomer{}
+	if err := c.ShouldBind(customer); err != nil {
+		jsonMsg(c, "invalid customer", err)
+		return
+	}
+	err := s.shopService.SaveCustomer(customer)
+	jsonShopMsgObj(c, "saved", customer, err)
+}
+
+func (s *ShopController) deleteCustomer(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteCustomer(id)
+	jsonMsg(c, "deleted", err)
+}
+
+// exportCustomerData downloads everything the shop stores about a customer,
+// for answering their request for a copy of their data.
+func (s *ShopController) exportCustomerData(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	export, err := s.shopService.ExportCustomerData(id)
+	if err != nil {
+		jsonMsg(c, "export customer data", err)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+service.ShopCustomerExportFileName(id))
+	c.IndentedJSON(http.StatusOK, export)
+}
+
+// eraseCustomerData deletes a customer's data, anonymizing their orders, for
+// answering their request to be forgotten.
+func (s *ShopController) eraseCustomerData(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	erasure, err := s.shopService.EraseCustomerData(id)
+	if err == nil {
+		if user := session.GetLoginUser(c); user != nil {
+			logger.Infof("shop customer %d erased by %s", id, user.Username)
+		}
+	}
+	jsonMsgObj(c, "erased", erasure, err)
+}
+
+// deepLinkStats reports the clicks and conversions of the bot's deep links.
+func (s *ShopController) deepLinkStats(c *gin.Context) {
+	links, err := s.shopService.DeepLinkStats()
+	jsonObj(c, service.ShopDeepLinkReport{BotUsername: s.messenger.BotUsername(), Links: links}, err)
+}
+
+// health checks the components the shop depends on for uptime monitors. It
+// answers 503 while any of them is down.
+func (s *ShopController) health(c *gin.Context) {
+	ctx := c.Request.Context()
+	report := s.shopService.HealthCheck(ctx)
+	report.Check("bot", func() error { return s.messenger.CheckBot(ctx) })
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, entity.Msg{Success: report.Healthy, Obj: report})
+}
+
+func (s *ShopController) listRevenueGoals(c *gin.Context) {
+	goals, err := s.shopService.ListRevenueGoals()
+	jsonObj(c, goals, err)
+}
+
+func (s *ShopController) saveRevenueGoal(c *gin.Context) {
+	goal := &model.ShopRevenueGoal{}
+	if err := c.ShouldBind(goal); err != nil {
+		jsonMsg(c, "invalid goal", err)
+		return
+	}
+	err := s.shopService.SaveRevenueGoal(goal)
+	jsonShopMsgObj(c, "saved", goal, err)
+}
+
+func (s *ShopController) deleteRevenueGoal(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteRevenueGoal(id)
+	jsonMsg(c, "deleted", err)
+}
+
+// revenueGoalProgress reports how far a month, the current one unless the
+// month query names another, is towards its revenue goal.
+func (s *ShopController) revenueGoalProgress(c *gin.Context) {
+	progress, err := s.shopService.RevenueGoalProgress(c.Query("month"))
+	jsonObj(c, progress, err)
+}
+
+// weeklySummary returns the summary of the last seven days the bot sends the
+// admins every week.
+func (s *ShopController) weeklySummary(c *gin.Context) {
+	summary, err := s.shopService.WeeklySummary(time.Now())
+	jsonObj(c, summary, err)
+}
+
+// retentionCohorts reports how many customers of each monthly cohort, the
+// last 12 unless the months query asks for more, ordered again later.
+func (s *ShopController) retentionCohorts(c *gin.Context) {
+	months, _ := strconv.Atoi(c.Query("months"))
+	cohorts, err := s.shopService.RetentionCohorts(months, time.Now())
+	jsonObj(c, cohorts, err)
+}
+
+// packageUtilization compares the traffic sold with each package to what its
+// clients used.
+func (s *ShopController) packageUtilization(c *gin.Context) {
+	usage, err := s.shopService.PackageUtilization()
+	jsonObj(c, usage, err)
+}
+
+func (s *ShopController) listOrderStatuses(c *gin.Context) {
+	statuses, err := s.shopService.ListOrderStatuses()
+	jsonObj(c, statuses, err)
+}
+
+func (s *ShopController) saveOrderStatus(c *gin.Context) {
+	status := &model.ShopOrderStatus{}
+	if err := c.ShouldBind(status); err != nil {
+		jsonMsg(c, "invalid status", err)
+		return
+	}
+	err := s.shopService.SaveOrderStatus(status)
+	jsonShopMsgObj(c, "saved", status, err)
+}
+
+func (s *ShopController) deleteOrderStatus(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteOrderStatus(id)
+	jsonMsg(c, "deleted", err)
+}
+
+func (s *ShopController) listCheckoutFields(c *gin.Context) {
+	fields, err := s.shopService.ListCheckoutFields()
+	jsonObj(c, fields, err)
+}
+
+func (s *ShopController) saveCheckoutField(c *gin.Context) {
+	field := &model.ShopCheckoutField{}
+	if err := c.ShouldBind(field); err != nil {
+		jsonMsg(c, "invalid field", err)
+		return
+	}
+	err := s.shopService.SaveCheckoutField(field)
+	jsonShopMsgObj(c, "saved", field, err)
+}
+
+func (s *ShopController) deleteCheckoutField(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteCheckoutField(id)
+	jsonMsg(c, "deleted", err)
+}
+
+func (s *ShopController) listConfigTemplates(c *gin.Context) {
+	templates, err := s.shopService.ListConfigTemplates()
+	jsonObj(c, templates, err)
+}
+
+func (s *ShopController) saveConfigTemplate(c *gin.Context) {
+	tmpl := &model.ShopConfigTemplate{}
+	if err := c.ShouldBind(tmpl); err != nil {
+		jsonMsg(c, "invalid template", err)
+		return
+	}
+	err := s.shopService.SaveConfigTemplate(tmpl)
+	jsonShopMsgObj(c, "saved", tmpl, err)
+}
+
+func (s *ShopController) deleteConfigTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteConfigTemplate(id)
+	jsonMsg(c, "deleted", err)
+}
+
+func (s *ShopController) listSegments(c *gin.Context) {
+	segments, err := s.shopService.ListSegments()
+	jsonObj(c, segments, err)
+}
+
+func (s *ShopController) saveSegment(c *gin.Context) {
+	segment := &model.ShopSegment{}
+	if err := c.ShouldBind(segment); err != nil {
+		jsonMsg(c, "invalid segment", err)
+		return
+	}
+	err := s.shopService.SaveSegment(segment)
+	jsonShopMsgObj(c, "saved", segment, err)
+}
+
+func (s *ShopController) deleteSegment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopService.DeleteSegment(id)
+	jsonMsg(c, "deleted", err)
+}
+
+// segmentForRequest loads the segment named by the request's id parameter.
+func (s *ShopController) segmentForRequest(c *gin.Context) (*model.ShopSegment, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+	return s.shopService.GetSegment(id)
+}
+
+func (s *ShopController) segmentCustomers(c *gin.Context) {
+	segment, err := s.segmentForRequest(c)
+	if err != nil {
+		jsonMsg(c, "segment customers", err)
+		return
+	}
+	customers, err := s.shopService.SegmentCustomers(segment)
+	jsonObj(c, customers, err)
+}
+
+// exportSegment downloads the customers of a segment as CSV.
+func (s *ShopController) exportSegment(c *gin.Context) {
+	segment, err := s.segmentForRequest(c)
+	if err != nil {
+		jsonMsg(c, "segment customers", err)
+		return
+	}
+	customers, err := s.shopService.SegmentCustomers(segment)
+	if err != nil {
+		jsonMsg(c, "segment customers", err)
+		return
+	}
+	data, err := service.ShopCustomersCSV(customers, s.shopService.Currency().Code)
+	if err != nil {
+		jsonMsg(c, "segment customers", err)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+service.ShopSegmentFileName(segment))
+	c.Data(http.StatusOK, "text/csv", data)
+}
+
+func (s *ShopController) listAbuseLogs(c *gin.Context) {
+	logs, err := s.shopService.ListAbuseLogs(200)
+	jsonObj(c, logs, err)
+}
+
+func (s *ShopController) listInbounds(c *gin.Context) {
+	inbounds, err := s.shopService.ListInbounds()
+	jsonObj(c, inbounds, err)
+}
+
+func (s *ShopController) setInboundEnabled(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	var body struct {
+		Enabled bool `json:"enabled" form:"enabled"`
+		NodeId  int  `json:"nodeId" form:"nodeId"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		jsonMsg(c, "invalid request", err)
+		return
+	}
+	err = s.shopService.SetInboundEnabled(body.NodeId, id, body.Enabled)
+	jsonMsg(c, "updated", err)
+}
+
+// setInboundsEnabled offers or withdraws the listed inbounds of one node, or
+// every inbound when all is set.
+func (s *ShopController) setInboundsEnabled(c *gin.Context) {
+	var body struct {
+		Ids     []int `json:"ids" form:"ids"`
+		NodeId  int   `json:"nodeId" form:"nodeId"`
+		Enabled bool  `json:"enabled" form:"enabled"`
+		All     bool  `json:"all" form:"all"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		jsonMsg(c, "invalid request", err)
+		return
+	}
+	if body.All {
+		updated, err := s.shopService.SetAllInboundsEnabled(body.Enabled)
+		jsonMsgObj(c, "updated", gin.H{"updated": updated}, err)
+		return
+	}
+	if len(body.Ids) == 0 {
+		jsonMsg(c, "invalid request", errors.New("no inbounds given"))
+		return
+	}
+	err := s.shopService.SetInboundsEnabled(body.NodeId, body.Ids, body.Enabled)
+	jsonMsgObj(c, "updated", gin.H{"updated": len(body.Ids)}, err)
+}
+
+func (s *ShopController) listInboundTags(c *gin.Context) {
+	tags, err := s.shopService.ListInboundTags()
+	jsonObj(c, tags, err)
+}
+
+func (s *ShopController) setInboundTags(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	var body struct {
+		Tags   []string `json:"tags" form:"tags"`
+		NodeId int      `json:"nodeId" form:"nodeId"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		jsonMsg(c, "invalid request", err)
+		return
+	}
+	err = s.shopService.SetInboundTags(body.NodeId, id, body.Tags)
+	jsonShopMsgObj(c, "updated", nil, err)
+}
+
+func (s *ShopController) setInboundLimit(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	var body struct {
+		MaxClients int `json:"maxClients" form:"maxClients"`
+		NodeId     int `json:"nodeId" form:"nodeId"`
+	}
+	if err := c.ShouldBind(&body); err != nil {
+		jsonMsg(c, "invalid request", err)
+		return
+	}
+	err = s.shopService.SetInboundMaxClients(body.NodeId, id, body.MaxClients)
+	jsonMsg(c, "updated", err)
+}
+
+func (s *ShopController) listNodes(c *gin.Context) {
+	nodes, err := s.shopNodeService.ListNodes()
+	for i := range nodes {
+		nodes[i].Password = ""
+	}
+	jsonObj(c, nodes, err)
+}
+
+func (s *ShopController) saveNode(c *gin.Context) {
+	node := &model.ShopNode{}
+	if err := c.ShouldBind(node); err != nil {
+		jsonMsg(c, "invalid node", err)
+		return
+	}
+	if node.Name == "" {
+		jsonMsg(c, "invalid node", errors.New("name is required"))
+		return
+	}
+	err := s.shopNodeService.SaveNode(node)
+	jsonMsg(c, "saved", err)
+}
+
+func (s *ShopController) deleteNode(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	err = s.shopNodeService.DeleteNode(id)
+	jsonMsg(c, "deleted", err)
+}
+
+func (s *ShopController) nodeStatus(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, "invalid id", err)
+		return
+	}
+	node, err := s.shopNodeService.GetNode(id)
+	if err != nil {
+		jsonMsg(c, "node not found", err)
+		return
+	}
+	jsonObj(c, s.shopNodeService.NodeStatus(node), nil)
+}
+
+func (s *ShopController) getReceipt(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	order, err := s.shopService.GetOrder(id)
+	if err != nil || order.ReceiptPath == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	image, err := service.ReadReceipt(filepath.Clean(order.ReceiptPath))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Data(http.StatusOK, http.DetectContentType(image), image)
+}
+
+// backup downloads an encrypted archive of the shop data. The optional password
+// query parameter overrides the configured backup passphrase.
+func (s *ShopController) backup(c *gin.Context) {
+	data, err := s.shopService.Backup(c.Query("password"))
+	if err != nil {
+		jsonMsg(c, "backup", err)
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename="+s.shopService.BackupFileName())
+	c.Data(http.StatusOK, "application/octet-stream", data)
+}
+
+// maxShopBackupSize bounds uploaded backups, receipts included.
+const maxShopBackupSize = 512 << 20
+
+// restore replaces the shop data with an uploaded backup.
+func (s *ShopController) restore(c *gin.Context) {
+	file, err := c.FormFile("backup")
+	if err != nil {
+		jsonMsg(c, "restore", err)
+		return
+	}
+	if file.Size > maxShopBackupSize {
+		jsonMsg(c, "restore", errors.New("backup file is too large"))
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		jsonMsg(c, "restore", err)
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxShopBackupSize))
+	if err != nil {
+		jsonMsg(c, "restore", err)
 		return
 	}
-	c.File(path)
+	result, err := s.shopService.Restore(data, c.PostForm("password"))
+	jsonMsgObj(c, "restore", result, err)
 }
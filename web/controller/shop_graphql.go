@@ -0,0 +1,287 @@
+package controller
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+)
+
+// graphQLRequest is the standard GraphQL-over-HTTP request body.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+var (
+	shopSchemaOnce sync.Once
+	shopSchema     graphql.Schema
+	shopSchemaErr  error
+)
+
+// graphql runs a query against the read-only shop schema. Telegram IDs are
+// strings and amounts are floats because GraphQL integers are only 32 bits.
+func (s *ShopController) graphql(c *gin.Context) {
+	shopSchemaOnce.Do(func() {
+		shopSchema, shopSchemaErr = newShopSchema(s.shopService)
+		if shopSchemaErr != nil {
+			logger.Error("build shop GraphQL schema failed:", shopSchemaErr)
+		}
+	})
+	if shopSchemaErr != nil {
+		jsonMsg(c, "graphql", shopSchemaErr)
+		return
+	}
+	var req graphQLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		jsonMsg(c, "graphql", err)
+		return
+	}
+	result := graphql.Do(graphql.Params{
+		Schema:         shopSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        c.Request.Context(),
+	})
+	c.JSON(200, result)
+}
+
+func newShopSchema(shopService ShopServicer) (graphql.Schema, error) {
+	packageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Package",
+		Fields: graphql.Fields{
+			"id":           &graphql.Field{Type: graphql.Int},
+			"name":         &graphql.Field{Type: graphql.String},
+			"type":         &graphql.Field{Type: graphql.String},
+			"dataGb":       &graphql.Field{Type: graphql.Int},
+			"durationDays": &graphql.Field{Type: graphql.Int},
+			"devices":      &graphql.Field{Type: graphql.Int},
+			"price":        &graphql.Field{Type: graphql.Float},
+			"billingCycle": &graphql.Field{Type: graphql.String},
+			"isActive":     &graphql.Field{Type: graphql.Boolean},
+			"isArchived":   &graphql.Field{Type: graphql.Boolean},
+			"sortOrder":    &graphql.Field{Type: graphql.Int},
+			"categoryId":   &graphql.Field{Type: graphql.Int},
+			"description":  &graphql.Field{Type: graphql.String},
+			"imageUrl":     &graphql.Field{Type: graphql.String},
+			"inboundTag":   &graphql.Field{Type: graphql.String},
+			"createdAt":    &graphql.Field{Type: graphql.DateTime},
+			"updatedAt":    &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+
+	orderType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Order",
+		Fields: graphql.Fields{
+			"id":               &graphql.Field{Type: graphql.Int},
+			"telegramId":       &graphql.Field{Type: graphql.String},
+			"telegramUsername": &graphql.Field{Type: graphql.String},
+			"phone":            &graphql.Field{Type: graphql.String},
+			"contactEmail":     &graphql.Field{Type: graphql.String},
+			"nodeId":           &graphql.Field{Type: graphql.Int},
+			"inboundId":        &graphql.Field{Type: graphql.Int},
+			"packageId":        &graphql.Field{Type: graphql.Int},
+			"customDataGb":     &graphql.Field{Type: graphql.Int},
+			"customDays":       &graphql.Field{Type: graphql.Int},
+			"price":            &graphql.Field{Type: graphql.Float},
+			"status":           &graphql.Field{Type: graphql.String},
+			"clientEmail":      &graphql.Field{Type: graphql.String},
+			"subscriptionId":   &graphql.Field{Type: graphql.Int},
+			"createdAt":        &graphql.Field{Type: graphql.DateTime},
+			"updatedAt":        &graphql.Field{Type: graphql.DateTime},
+			"package": &graphql.Field{
+				Type: packageType,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					order := p.Source.(model.ShopOrder)
+					if order.PackageId == nil {
+						return nil, nil
+					}
+					return shopService.GetPackage(*order.PackageId)
+				},
+			},
+		},
+	})
+
+	customerType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Customer",
+		Fields: graphql.Fields{
+			"telegramId":          &graphql.Field{Type: graphql.String},
+			"username":            &graphql.Field{Type: graphql.String},
+			"firstName":           &graphql.Field{Type: graphql.String},
+			"language":            &graphql.Field{Type: graphql.String},
+			"orderCount":          &graphql.Field{Type: graphql.Int},
+			"approvedOrders":      &graphql.Field{Type: graphql.Int},
+			"spent":               &graphql.Field{Type: graphql.Float},
+			"chargebacks":         &graphql.Field{Type: graphql.Int},
+			"activeSubscriptions": &graphql.Field{Type: graphql.Int},
+			"banned":              &graphql.Field{Type: graphql.Boolean},
+			"firstSeenAt":         &graphql.Field{Type: graphql.DateTime},
+			"lastSeenAt":          &graphql.Field{Type: graphql.DateTime},
+			"lastOrderAt":         &graphql.Field{Type: graphql.DateTime},
+			"orders": &graphql.Field{
+				Type: graphql.NewList(orderType),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return shopService.ListOrdersByTelegramId(p.Source.(service.ShopCustomerSummary).TelegramId)
+				},
+			},
+		},
+	})
+
+	revenueDayType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RevenueDay",
+		Fields: graphql.Fields{
+			"date":    &graphql.Field{Type: graphql.String},
+			"orders":  &graphql.Field{Type: graphql.Int},
+			"revenue": &graphql.Field{Type: graphql.Float},
+		},
+	})
+
+	revenueType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Revenue",
+		Fields: graphql.Fields{
+			"since":           &graphql.Field{Type: graphql.DateTime},
+			"orders":          &graphql.Field{Type: graphql.Int},
+			"revenue":         &graphql.Field{Type: graphql.Float},
+			"chargebacks":     &graphql.Field{Type: graphql.Int},
+			"chargebackTotal": &graphql.Field{Type: graphql.Float},
+			"days":            &graphql.Field{Type: graphql.NewList(revenueDayType)},
+		},
+	})
+
+	inboundType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Inbound",
+		Fields: graphql.Fields{
+			"id":               &graphql.Field{Type: graphql.Int},
+			"nodeId":           &graphql.Field{Type: graphql.Int},
+			"nodeName":         &graphql.Field{Type: graphql.String},
+			"remark":           &graphql.Field{Type: graphql.String},
+			"protocol":         &graphql.Field{Type: graphql.String},
+			"port":             &graphql.Field{Type: graphql.Int},
+			"enabled":          &graphql.Field{Type: graphql.Boolean},
+			"maxClients":       &graphql.Field{Type: graphql.Int},
+			"clients":          &graphql.Field{Type: graphql.Int},
+			"full":             &graphql.Field{Type: graphql.Boolean},
+			"traffic":          &graphql.Field{Type: graphql.Float},
+			"trafficLimit":     &graphql.Field{Type: graphql.Float},
+			"available":        &graphql.Field{Type: graphql.Int},
+			"availableTraffic": &graphql.Field{Type: graphql.Float},
+			"usage":            &graphql.Field{Type: graphql.Float},
+			"tags":             &graphql.Field{Type: graphql.NewList(graphql.String)},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"packages": &graphql.Field{
+				Type: graphql.NewList(packageType),
+				Args: graphql.FieldConfigArgument{
+					"activeOnly":      &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+					"includeArchived": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+					"categoryId":      &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					filter := service.ShopPackageFilter{
+						ActiveOnly:      p.Args["activeOnly"].(bool),
+						IncludeArchived: p.Args["includeArchived"].(bool),
+					}
+					if categoryId, ok := p.Args["categoryId"].(int); ok {
+						filter.CategoryId = &categoryId
+					}
+					return shopService.ListPackages(filter)
+				},
+			},
+			"package": &graphql.Field{
+				Type: packageType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return shopService.GetPackage(p.Args["id"].(int))
+				},
+			},
+			"orders": &graphql.Field{
+				Type: graphql.NewList(orderType),
+				Args: graphql.FieldConfigArgument{
+					"status":     &graphql.ArgumentConfig{Type: graphql.String},
+					"telegramId": &graphql.ArgumentConfig{Type: graphql.String},
+					"limit":      &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					var orders []model.ShopOrder
+					var err error
+					if raw, ok := p.Args["telegramId"].(string); ok {
+						tgId, parseErr := strconv.ParseInt(raw, 10, 64)
+						if parseErr != nil {
+							return nil, parseErr
+						}
+						orders, err = shopService.ListOrdersByTelegramId(tgId)
+					} else {
+						orders, err = shopService.ListOrders()
+					}
+					if err != nil {
+						return nil, err
+					}
+					if status, ok := p.Args["status"].(string); ok {
+						filtered := orders[:0]
+						for _, order := range orders {
+							if order.Status == status {
+								filtered = append(filtered, order)
+							}
+						}
+						orders = filtered
+					}
+					if limit, ok := p.Args["limit"].(int); ok && limit >= 0 && limit < len(orders) {
+						orders = orders[:limit]
+					}
+					return orders, nil
+				},
+			},
+			"order": &graphql.Field{
+				Type: orderType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					order, err := shopService.GetOrder(p.Args["id"].(int))
+					if err != nil {
+						return nil, err
+					}
+					return *order, nil
+				},
+			},
+			"customers": &graphql.Field{
+				Type: graphql.NewList(customerType),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return shopService.ListCustomers()
+				},
+			},
+			"revenue": &graphql.Field{
+				Type: revenueType,
+				Args: graphql.FieldConfigArgument{
+					"days": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 30},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					days := p.Args["days"].(int)
+					return shopService.RevenueStats(shopService.StartOfDay(time.Now()).AddDate(0, 0, -days))
+				},
+			},
+			"inbounds": &graphql.Field{
+				Type: graphql.NewList(inboundType),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return shopService.ListInbounds()
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
@@ -0,0 +1,729 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+	"github.com/mhsanaei/3x-ui/v2/web/middleware"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+	"github.com/op/go-logging"
+)
+
+func TestMain(m *testing.M) {
+	logDir, err := os.MkdirTemp("", "x-ui-test-log")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XUI_LOG_FOLDER", logDir)
+	os.Setenv("XUI_SHOP_KEY_FILE", filepath.Join(logDir, "shop.key"))
+	logger.InitLogger(logging.ERROR)
+	code := m.Run()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
+// testCSRFToken is the CSRF token of the sessions newShopRouter serves.
+const testCSRFToken = "test-csrf-token"
+
+// newShopRouter serves the shop routes, without login, on the given services.
+// Every request's session has testCSRFToken as its CSRF token.
+func newShopRouter(shopService ShopServicer, provisioner OrderProvisioner, messenger ShopMessenger) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions("3x-ui", cookie.NewStore([]byte("test"))))
+	r.Use(func(c *gin.Context) {
+		sessions.Default(c).Set("CSRF_TOKEN", testCSRFToken)
+	})
+	NewShopController(r.Group("/panel/api"), shopService, provisioner, messenger)
+	return r
+}
+
+// newShopTestRouter serves the shop routes with the panel's own services on a
+// fresh in-memory database.
+func newShopTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	newShopTestDB(t)
+	tgbot := new(service.Tgbot)
+	return newShopRouter(new(service.ShopService), tgbot, tgbot)
+}
+
+// newShopTestDB opens a fresh in-memory panel database for one test, which
+// the routes' middleware reads its settings from.
+func newShopTestDB(t *testing.T) {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	if err := database.InitDB(fmt.Sprintf("file:%s?mode=memory&cache=shared", name)); err != nil {
+		t.Fatalf("init database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := database.CloseDB(); err != nil {
+			t.Errorf("close database: %v", err)
+		}
+	})
+}
+
+// doShop sends a request to the router and decodes the JSON reply.
+func doShop(t *testing.T, r *gin.Engine, method, path string, form url.Values) entity.Msg {
+	t.Helper()
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set(csrfHeader, testCSRFToken)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d", method, path, w.Code)
+	}
+	var msg entity.Msg
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+		t.Fatalf("%s %s: decode %q: %v", method, path, w.Body.String(), err)
+	}
+	return msg
+}
+
+// decodeObj converts a reply object into v.
+func decodeObj(t *testing.T, obj any, v any) {
+	t.Helper()
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func packageForm(pkg model.ShopPackage) url.Values {
+	return url.Values{
+		"id":           {fmt.Sprint(pkg.Id)},
+		"name":         {pkg.Name},
+		"dataGb":       {fmt.Sprint(pkg.DataGB)},
+		"durationDays": {fmt.Sprint(pkg.DurationDays)},
+		"price":        {fmt.Sprint(pkg.Price)},
+		"isActive":     {fmt.Sprint(pkg.IsActive)},
+		"version":      {fmt.Sprint(pkg.Version)},
+	}
+}
+
+func TestShopPackageRoutes(t *testing.T) {
+	r := newShopTestRouter(t)
+
+	msg := doShop(t, r, http.MethodPost, "/panel/api/shop/packages", packageForm(model.ShopPackage{Name: "monthly", DataGB: 50, DurationDays: 30, Price: 100, IsActive: true}))
+	if !msg.Success {
+		t.Fatalf("create: %s", msg.Msg)
+	}
+	var created model.ShopPackage
+	decodeObj(t, msg.Obj, &created)
+	if created.Id == 0 || created.Version != 1 {
+		t.Fatalf("created = %+v, want an id and version 1", created)
+	}
+
+	free := created
+	free.Price = 0
+	free.IsActive = false
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/packages", packageForm(free))
+	if !msg.Success {
+		t.Fatalf("update: %s", msg.Msg)
+	}
+
+	msg = doShop(t, r, http.MethodGet, "/panel/api/shop/packages", nil)
+	var packages []model.ShopPackage
+	decodeObj(t, msg.Obj, &packages)
+	if len(packages) != 1 || packages[0].Price != 0 || packages[0].IsActive {
+		t.Fatalf("packages = %+v, want one free inactive package", packages)
+	}
+
+	// The original form still carries version 1.
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/packages", packageForm(created))
+	if msg.Success {
+		t.Fatal("stale update succeeded")
+	}
+
+	msg = doShop(t, r, http.MethodPost, fmt.Sprintf("/panel/api/shop/packages/%d/delete", created.Id), url.Values{})
+	if !msg.Success {
+		t.Fatalf("delete: %s", msg.Msg)
+	}
+	msg = doShop(t, r, http.MethodGet, "/panel/api/shop/packages?archived=true", nil)
+	decodeObj(t, msg.Obj, &packages)
+	if len(packages) != 1 || !packages[0].IsArchived {
+		t.Fatalf("archived packages = %+v, want the deleted package", packages)
+	}
+}
+
+func TestShopPackageValidationErrors(t *testing.T) {
+	r := newShopTestRouter(t)
+
+	msg := doShop(t, r, http.MethodPost, "/panel/api/shop/packages", url.Values{"price": {"-1"}})
+	if msg.Success {
+		t.Fatal("invalid package was saved")
+	}
+	var obj struct {
+		Fields map[string]string `json:"fields"`
+	}
+	decodeObj(t, msg.Obj, &obj)
+	for _, field := range []string{"name", "price"} {
+		if obj.Fields[field] == "" {
+			t.Errorf("no message for %s in %v", field, obj.Fields)
+		}
+	}
+}
+
+func TestShopOrderRoutes(t *testing.T) {
+	r := newShopTestRouter(t)
+
+	order := &model.ShopOrder{TelegramId: 1, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 50, Status: "PENDING_REVIEW"}
+	if err := database.GetShopDB().Create(order).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	msg := doShop(t, r, http.MethodGet, "/panel/api/shop/orders", nil)
+	var listed struct {
+		Orders []model.ShopOrder `json:"orders"`
+	}
+	decodeObj(t, msg.Obj, &listed)
+	if !msg.Success || len(listed.Orders) != 1 || listed.Orders[0].Id != order.Id {
+		t.Fatalf("orders = %+v, want the created order", listed.Orders)
+	}
+
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/orders/999/approve", url.Values{})
+	if msg.Success {
+		t.Fatal("approving a missing order succeeded")
+	}
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/orders/abc/reject", url.Values{})
+	if msg.Success {
+		t.Fatal("rejecting an invalid id succeeded")
+	}
+	msg = doShop(t, r, http.MethodPost, fmt.Sprintf("/panel/api/shop/orders/%d/email", order.Id), url.Values{"email": {"buyer@example.com"}})
+	stored, err := new(service.ShopService).GetOrder(order.Id)
+	if msg.Success || err != nil || stored.ContactEmail != "" {
+		t.Fatalf("emailing a pending order: success %v, contact email %q, %v", msg.Success, stored.ContactEmail, err)
+	}
+}
+
+// stubShop serves a single order; other ShopServicer methods are not expected.
+type stubShop struct {
+	ShopServicer
+	order          *model.ShopOrder
+	secondApproval bool
+}
+
+func (s *stubShop) GetOrder(id int) (*model.ShopOrder, error) {
+	if s.order == nil || s.order.Id != id {
+		return nil, errors.New("record not found")
+	}
+	order := *s.order
+	return &order, nil
+}
+
+// RecordApproval asks for a second admin while secondApproval is set.
+func (s *stubShop) RecordApproval(id int, admin string) (*model.ShopOrder, error) {
+	order, err := s.GetOrder(id)
+	if err == nil && s.secondApproval {
+		err = service.ErrSecondApprovalRequired
+	}
+	return order, err
+}
+
+func (s *stubShop) AddOrderComment(orderId int, author, body string) (*model.ShopOrderComment, error) {
+	return &model.ShopOrderComment{OrderId: orderId, Author: author, Body: body}, nil
+}
+
+func (s *stubShop) HealthCheck(ctx context.Context) *service.ShopHealthReport {
+	report := &service.ShopHealthReport{Healthy: true}
+	report.Check("database", func() error { return nil })
+	report.Check("gateway", func() error { return service.ErrHealthCheckOff })
+	return report
+}
+
+// stubMessenger is a bot whose token check fails with err.
+type stubMessenger struct {
+	ShopMessenger
+	err error
+}
+
+func (m *stubMessenger) CheckBot(ctx context.Context) error {
+	return m.err
+}
+
+// recordingProvisioner records the orders it is asked to approve.
+type recordingProvisioner struct {
+	err         error
+	approved    []int
+	fulfilled   []int
+	chargedBack []int
+}
+
+func (p *recordingProvisioner) ApproveOrder(ctx context.Context, order *model.ShopOrder) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.approved = append(p.approved, order.Id)
+	return nil
+}
+
+func (p *recordingProvisioner) SendOrderFulfillment(order *model.ShopOrder) {
+	p.fulfilled = append(p.fulfilled, order.Id)
+}
+
+func (p *recordingProvisioner) SendOrderRejection(orderId int) {}
+
+func (p *recordingProvisioner) SendOrderScheduled(order *model.ShopOrder) {}
+
+func (p *recordingProvisioner) SendOrderHold(order *model.ShopOrder) {}
+
+func (p *recordingProvisioner) SendOrderStatusChange(order *model.ShopOrder, status *model.ShopOrderStatus, note string) {
+}
+
+func (p *recordingProvisioner) RecordOrderPayment(orderId int, amount int64, note, author string) (*model.ShopOrder, error) {
+	return nil, nil
+}
+
+func (p *recordingProvisioner) ChargebackOrder(orderId int, reason string) (*model.ShopOrder, error) {
+	p.chargedBack = append(p.chargedBack, orderId)
+	return &model.ShopOrder{Id: orderId, Status: service.OrderStatusChargeback, ChargebackReason: reason}, nil
+}
+
+func (p *recordingProvisioner) EmailOrder(order *model.ShopOrder) error { return nil }
+
+func (p *recordingProvisioner) OrderClientLinks(order *model.ShopOrder) ([]service.ShopClientLink, error) {
+	return nil, nil
+}
+
+func (p *recordingProvisioner) RotateOrderClient(order *model.ShopOrder, email string) (*model.ShopOrderClient, error) {
+	return &model.ShopOrderClient{OrderId: order.Id, Email: email}, nil
+}
+
+func TestShopApproveUsesProvisioner(t *testing.T) {
+	newShopTestDB(t)
+	shop := &stubShop{order: &model.ShopOrder{Id: 7, Status: service.OrderStatusPendingReview}}
+	provisioner := &recordingProvisioner{}
+	r := newShopRouter(shop, provisioner, nil)
+
+	msg := doShop(t, r, http.MethodPost, "/panel/api/shop/orders/7/approve", url.Values{})
+	if !msg.Success {
+		t.Fatalf("approve: %s", msg.Msg)
+	}
+	if len(provisioner.approved) != 1 || len(provisioner.fulfilled) != 1 {
+		t.Fatalf("approved %v, fulfilled %v, want order 7 once each", provisioner.approved, provisioner.fulfilled)
+	}
+
+	shop.secondApproval = true
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/orders/7/approve", url.Values{})
+	if msg.Success || len(provisioner.approved) != 1 {
+		t.Fatalf("approval awaiting a second admin: success %v, approved %v", msg.Success, provisioner.approved)
+	}
+	shop.secondApproval = false
+
+	provisioner.err = errors.New("node unreachable")
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/orders/7/approve", url.Values{})
+	if msg.Success || len(provisioner.fulfilled) != 1 {
+		t.Fatalf("failed provisioning: success %v, fulfilled %v", msg.Success, provisioner.fulfilled)
+	}
+
+	shop.order.Status = service.OrderStatusProvisioning
+	provisioner.err = nil
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/orders/7/approve", url.Values{})
+	if msg.Success {
+		t.Fatal("approving a queued order succeeded, want retry")
+	}
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/orders/7/retry", url.Values{})
+	if !msg.Success || len(provisioner.approved) != 2 {
+		t.Fatalf("retry: success %v, approved %v", msg.Success, provisioner.approved)
+	}
+
+	shop.order.Status = service.OrderStatusApproved
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/orders/7/approve", url.Values{})
+	if msg.Success || len(provisioner.approved) != 2 {
+		t.Fatalf("approving an approved order: success %v, approved %v", msg.Success, provisioner.approved)
+	}
+}
+
+func TestShopInboundBulkRoute(t *testing.T) {
+	r := newShopTestRouter(t)
+	for port := 1001; port <= 1003; port++ {
+		inbound := &model.Inbound{Port: port, Protocol: model.VLESS, Tag: fmt.Sprint("inbound-", port), Settings: `{"clients":[]}`}
+		if err := database.GetDB().Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	enabled := func() map[int]bool {
+		var rows []model.ShopInbound
+		if err := database.GetShopDB().Find(&rows).Error; err != nil {
+			t.Fatal(err)
+		}
+		states := map[int]bool{}
+		for _, row := range rows {
+			states[row.InboundId] = row.Enabled
+		}
+		return states
+	}
+
+	msg := doShop(t, r, http.MethodPost, "/panel/api/shop/inbounds/bulk", url.Values{"ids": {"1", "3"}, "enabled": {"true"}})
+	if !msg.Success {
+		t.Fatalf("bulk enable: %s", msg.Msg)
+	}
+	if states := enabled(); len(states) != 2 || !states[1] || !states[3] {
+		t.Fatalf("after bulk enable: %v, want 1 and 3 enabled", states)
+	}
+
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/inbounds/bulk", url.Values{"all": {"true"}, "enabled": {"false"}})
+	var obj struct {
+		Updated int `json:"updated"`
+	}
+	decodeObj(t, msg.Obj, &obj)
+	if !msg.Success || obj.Updated != 3 {
+		t.Fatalf("disable all: success %v, updated %d; want 3", msg.Success, obj.Updated)
+	}
+	for id, on := range enabled() {
+		if on {
+			t.Errorf("inbound %d still enabled", id)
+		}
+	}
+
+	msg = doShop(t, r, http.MethodPost, "/panel/api/shop/inbounds/bulk", url.Values{"enabled": {"true"}})
+	if msg.Success {
+		t.Fatal("bulk update without inbounds succeeded")
+	}
+}
+
+func TestStorefront(t *testing.T) {
+	newShopTestRouter(t)
+	r := gin.New()
+	r.LoadHTMLFiles("../html/store.html")
+	NewStoreController(r.Group("/"))
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/store", nil))
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Fatalf("disabled storefront = %d, want 404", w.Code)
+	}
+	if err := database.GetDB().Create(&model.Setting{Key: "shopStorefrontEnabled", Value: "true"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	shop := new(service.ShopService)
+	for _, pkg := range []*model.ShopPackage{
+		{Name: "Starter <b>", DataGB: 10, DurationDays: 30, Price: 100, IsActive: true},
+		{Name: "Hidden", DataGB: 10, DurationDays: 30, Price: 100},
+	} {
+		if err := shop.CreatePackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := get()
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "Starter &lt;b&gt;") || strings.Contains(body, "Hidden") {
+		t.Fatalf("storefront = %d %s", w.Code, body)
+	}
+}
+
+func TestPriceList(t *testing.T) {
+	newShopTestRouter(t)
+	r := gin.New()
+	NewStoreController(r.Group("/"))
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header = header
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/store/packages.json", http.Header{}); w.Code != http.StatusNotFound {
+		t.Fatalf("disabled price list = %d, want 404", w.Code)
+	}
+	for key, value := range map[string]string{"shopPriceListEnabled": "true", "shopCurrency": "IRT"} {
+		if err := database.GetDB().Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkg := &model.ShopPackage{Name: "Starter", DataGB: 10, DurationDays: 30, Price: 1250000, IsActive: true}
+	if err := new(service.ShopService).CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+
+	w := get("/store/packages.json", http.Header{"Accept-Language": {"fa-IR,fa;q=0.9,en;q=0.8"}})
+	var list service.ShopPriceList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("price list = %d %s", w.Code, w.Body.String())
+	}
+	if list.Language != "fa" || len(list.Packages) != 1 || list.Packages[0].Amount != 1250000 || list.Packages[0].Price != "۱٬۲۵۰٬۰۰۰ IRT" {
+		t.Fatalf("price list = %+v", list)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatal("price list cannot be embedded on other sites")
+	}
+
+	w = get("/store/packages.json?lang=en", http.Header{})
+	etag := w.Header().Get("ETag")
+	if !strings.Contains(w.Body.String(), `"price":"1,250,000 IRT"`) || etag == "" {
+		t.Fatalf("english price list = %s, etag %q", w.Body.String(), etag)
+	}
+	if w := get("/store/packages.json?lang=en", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Fatalf("unchanged price list = %d, want 304", w.Code)
+	}
+}
+
+func TestCatalogToken(t *testing.T) {
+	newShopTestRouter(t)
+	r := gin.New()
+	NewStoreController(r.Group("/"))
+	get := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store/catalog.json", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusNotFound {
+		t.Fatalf("catalog without a token set = %d, want 404", w.Code)
+	}
+	if err := database.GetDB().Create(&model.Setting{Key: "shopCatalogToken", Value: "secret"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	pkg := &model.ShopPackage{Name: "Starter", DataGB: 10, DurationDays: 30, Price: 100, IsActive: true}
+	if err := new(service.ShopService).CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("catalog with a wrong token = %d, want 401", w.Code)
+	}
+	if w := get("secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Starter"`) {
+		t.Fatalf("catalog = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPortalPayCaptcha(t *testing.T) {
+	newShopTestRouter(t)
+	r := gin.New()
+	r.LoadHTMLFiles("../html/pay.html")
+	NewPortalController(r.Group("/"))
+	for key, value := range map[string]string{
+		"shopGateway": "perfectmoney", "shopGatewayAccount": "U1234567", "shopGatewaySecret": "alternate",
+		"shopGatewayRate": "1", "shopPublicUrl": "https://panel.example.com/",
+	} {
+		if err := database.GetDB().Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	shop := new(service.ShopService)
+	order := &model.ShopOrder{TelegramId: 4201, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 300, Status: service.OrderStatusPendingReceipt}
+	if err := shop.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	payURL, err := shop.GatewayPaymentURL(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(payURL)
+	pay := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, u.RequestURI(), nil))
+		return w
+	}
+
+	if w := pay(http.MethodGet); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "PAYEE_ACCOUNT") {
+		t.Fatalf("checkout without captcha = %d %s", w.Code, w.Body.String())
+	}
+	for key, value := range map[string]string{"shopCaptchaProvider": "turnstile", "shopCaptchaSiteKey": "site", "shopCaptchaSecret": "secret"} {
+		if err := database.GetDB().Create(&model.Setting{Key: key, Value: value}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := pay(http.MethodGet)
+	if body := w.Body.String(); w.Code != http.StatusOK || !strings.Contains(body, `data-sitekey="site"`) || strings.Contains(body, "PAYEE_ACCOUNT") {
+		t.Fatalf("checkout with captcha = %d %s", w.Code, body)
+	}
+	if w := pay(http.MethodPost); w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), "PAYEE_ACCOUNT") {
+		t.Fatalf("checkout without a captcha token = %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestShopRateLimit(t *testing.T) {
+	shopRateLimiters[rateScopeWrite] = middleware.NewRateLimiter(time.Minute)
+	r := newShopTestRouter(t)
+	if err := database.GetDB().Create(&model.Setting{Key: "shopApiWriteRatePerMinute", Value: "2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	post := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/panel/api/shop/orders/bulk", nil)
+		req.Header.Set(csrfHeader, testCSRFToken)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := post(); w.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i+1, w.Code)
+		}
+	}
+	w := post()
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("request over the limit = %d, Retry-After %q; want 429", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := doShop(t, r, http.MethodGet, "/panel/api/shop/packages", nil); !w.Success {
+		t.Fatalf("read route limited with the write routes: %s", w.Msg)
+	}
+}
+
+func TestShopChargebackUsesProvisioner(t *testing.T) {
+	newShopTestDB(t)
+	shop := &stubShop{order: &model.ShopOrder{Id: 7, Status: service.OrderStatusApproved}}
+	provisioner := &recordingProvisioner{}
+	r := newShopRouter(shop, provisioner, nil)
+
+	msg := doShop(t, r, http.MethodPost, "/panel/api/shop/orders/7/chargeback", url.Values{"reason": {"disputed"}})
+	if !msg.Success {
+		t.Fatalf("chargeback: %s", msg.Msg)
+	}
+	if len(provisioner.chargedBack) != 1 || provisioner.chargedBack[0] != 7 {
+		t.Fatalf("charged back %v, want order 7", provisioner.chargedBack)
+	}
+}
+
+func TestShopHealth(t *testing.T) {
+	newShopTestDB(t)
+	messenger := &stubMessenger{}
+	r := newShopRouter(&stubShop{}, &recordingProvisioner{}, messenger)
+	check := func(wantCode int) service.ShopHealthReport {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panel/api/shop/health", nil))
+		var msg entity.Msg
+		if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || w.Code != wantCode {
+			t.Fatalf("health: status %d, %q, want %d", w.Code, w.Body.String(), wantCode)
+		}
+		var report service.ShopHealthReport
+		decodeObj(t, msg.Obj, &report)
+		return report
+	}
+
+	report := check(http.StatusOK)
+	if !report.Healthy || len(report.Components) != 3 || report.Components[1].Status != service.HealthStatusOff {
+		t.Fatalf("report = %+v", report)
+	}
+	messenger.err = errors.New("Unauthorized")
+	report = check(http.StatusServiceUnavailable)
+	if bot := report.Components[2]; report.Healthy || bot.Name != "bot" || bot.Status != service.HealthStatusDown || bot.Error != "Unauthorized" {
+		t.Fatalf("report = %+v, want the bot down", report)
+	}
+}
+
+func TestShopAdminAllowlist(t *testing.T) {
+	newShopTestDB(t)
+	shop := &stubShop{order: &model.ShopOrder{Id: 7, Status: service.OrderStatusPendingReview}}
+	provisioner := &recordingProvisioner{}
+	r := newShopRouter(shop, provisioner, nil)
+	if err := database.GetDB().Create(&model.Setting{Key: "shopAdminAllowedIps", Value: "203.0.113.0/24"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetTrustedProxies(nil); err != nil {
+		t.Fatal(err)
+	}
+	post := func(path, remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(csrfHeader, testCSRFToken)
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	approve := func(remoteAddr string) int {
+		return post("/panel/api/shop/orders/7/approve", remoteAddr)
+	}
+
+	if code := approve("198.51.100.7:40000"); code != http.StatusForbidden || len(provisioner.approved) != 0 {
+		t.Fatalf("approve from outside the allowlist: status %d, approved %v", code, provisioner.approved)
+	}
+	for _, path := range []string{
+		"/panel/api/shop/restore", "/panel/api/shop/destinations", "/panel/api/shop/orders/7/payments",
+		"/panel/api/shop/orders/7/reject", "/panel/api/shop/orders/7/chargeback", "/panel/api/shop/orders/7/status",
+		"/panel/api/shop/orders/bulk", "/panel/api/shop/orders/import", "/panel/api/shop/nodes",
+	} {
+		if code := post(path, "198.51.100.7:40000"); code != http.StatusForbidden {
+			t.Fatalf("%s from outside the allowlist: status %d, want 403", path, code)
+		}
+	}
+	if code := approve("203.0.113.5:40000"); code != http.StatusOK || len(provisioner.approved) != 1 {
+		t.Fatalf("approve from the allowlist: status %d, approved %v", code, provisioner.approved)
+	}
+}
+
+func TestShopCSRF(t *testing.T) {
+	newShopTestDB(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(sessions.Sessions("3x-ui", cookie.NewStore([]byte("test"))))
+	NewShopController(r.Group("/panel/api"), new(service.ShopService), nil, nil)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panel/api/shop/csrf", nil))
+	var msg entity.Msg
+	if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil || !msg.Success {
+		t.Fatalf("get token: %q, %v", w.Body.String(), err)
+	}
+	var reply struct{ Token string }
+	decodeObj(t, msg.Obj, &reply)
+	cookies := w.Result().Cookies()
+	if reply.Token == "" || len(cookies) == 0 {
+		t.Fatalf("token %q, cookies %v", reply.Token, cookies)
+	}
+
+	post := func(token string, withCookie bool) int {
+		req := httptest.NewRequest(http.MethodPost, "/panel/api/shop/categories", strings.NewReader("name=VPN"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			req.Header.Set(csrfHeader, token)
+		}
+		if withCookie {
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := post("", true); code != http.StatusForbidden {
+		t.Fatalf("post without token = %d, want 403", code)
+	}
+	if code := post("forged", true); code != http.StatusForbidden {
+		t.Fatalf("post with a wrong token = %d, want 403", code)
+	}
+	if code := post(reply.Token, false); code != http.StatusForbidden {
+		t.Fatalf("post with the token of another session = %d, want 403", code)
+	}
+	if code := post(reply.Token, true); code != http.StatusOK {
+		t.Fatalf("post with the session's token = %d, want 200", code)
+	}
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StoreController serves the public storefront, a page admins can share in
+// channels that lists the packages for sale, and its JSON price list for other
+// sites to embed. Neither needs a login and each is off until enabled in the
+// settings.
+type StoreController struct {
+	BaseController
+	shopService    service.ShopService
+	settingService service.SettingService
+	tgbotService   service.Tgbot
+}
+
+// NewStoreController creates a StoreController and registers its routes.
+func NewStoreController(g *gin.RouterGroup) *StoreController {
+	a := &StoreController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *StoreController) initRouter(g *gin.RouterGroup) {
+	store := g.Group("/store")
+	store.Use(shopRateLimit(rateScopeStore, a.settingService.GetShopApiRatePerMinute, clientIPRateKeys))
+	store.GET("", a.store)
+	store.GET("/packages.json", a.priceList)
+	store.GET("/catalog.json", a.catalog)
+}
+
+// store renders the storefront page, or 404 while the storefront is disabled.
+func (a *StoreController) store(c *gin.Context) {
+	if enabled, err := a.settingService.GetShopStorefrontEnabled(); err != nil || !enabled {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	packages, err := a.shopService.StorefrontPackages(a.tgbotService.BotUsername())
+	if err != nil {
+		logger.Warning("load storefront packages failed:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	title, _ := a.settingService.GetShopStorefrontTitle()
+	if title == "" {
+		title, _, err = net.SplitHostPort(c.Request.Host)
+		if err != nil {
+			title = c.Request.Host
+		}
+	}
+	c.Header("Cache-Control", "public, max-age=60")
+	c.HTML(http.StatusOK, "store.html", gin.H{
+		"title":    title,
+		"packages": packages,
+		"closed":   a.shopService.CheckOpen() != nil,
+	})
+}
+
+// priceList serves the packages for sale as JSON, with prices formatted in the
+// language of the lang query parameter or the Accept-Language header. Any site
+// may fetch it, and an unchanged list is answered with 304 Not Modified.
+func (a *StoreController) priceList(c *gin.Context) {
+	if enabled, err := a.settingService.GetShopPriceListEnabled(); err != nil || !enabled {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	lang := service.MatchShopLanguage(c.Query("lang"))
+	if lang == "" {
+		lang = service.MatchShopAcceptLanguage(c.GetHeader("Accept-Language"))
+	}
+	list, err := a.shopService.PriceList(a.tgbotService.BotUsername(), lang)
+	if err != nil {
+		logger.Warning("load price list failed:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Header("Vary", "Accept-Language")
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
+
+// catalog serves the package catalog as JSON to panels syncing from this one,
+// when the request carries the configured catalog token. The token grants
+// nothing else. The endpoint answers 404 while no token is set.
+func (a *StoreController) catalog(c *gin.Context) {
+	token, err := a.settingService.GetShopCatalogToken()
+	if err != nil || token == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	data, err := a.shopService.ExportCatalog(service.CatalogFormatJSON)
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("export catalog failed")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
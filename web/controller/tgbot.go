@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mymmrac/telego"
+)
+
+// tgbotWebhookMaxBytes bounds the size of an update Telegram posts.
+const tgbotWebhookMaxBytes = 1 << 20
+
+// BotWebhook hands the updates Telegram posts to the panel to the bot. It is
+// implemented by service.Tgbot.
+type BotWebhook interface {
+	ServeWebhook(ctx context.Context, secret string, data []byte) error
+}
+
+// TgbotController receives the Telegram bot's updates while it runs in
+// webhook mode.
+type TgbotController struct {
+	webhook BotWebhook
+}
+
+// NewTgbotController creates a TgbotController and registers its route.
+func NewTgbotController(g *gin.RouterGroup, webhook BotWebhook) *TgbotController {
+	a := &TgbotController{webhook: webhook}
+	g.POST("/tgbot/webhook", a.update)
+	return a
+}
+
+// update passes a posted update to the bot. The endpoint answers 404 while the
+// bot polls for its updates, and 401 to requests without the webhook secret.
+func (a *TgbotController) update(c *gin.Context) {
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, tgbotWebhookMaxBytes))
+	if err != nil {
+		c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		return
+	}
+	err = a.webhook.ServeWebhook(c.Request.Context(), c.GetHeader(telego.WebhookSecretTokenHeader), data)
+	switch {
+	case errors.Is(err, service.ErrBotWebhookOff):
+		c.AbortWithStatus(http.StatusNotFound)
+	case errors.Is(err, service.ErrBotWebhookSecret):
+		c.AbortWithStatus(http.StatusUnauthorized)
+	case err != nil:
+		c.AbortWithStatus(http.StatusBadRequest)
+	default:
+		c.Status(http.StatusOK)
+	}
+}
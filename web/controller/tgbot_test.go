@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mymmrac/telego"
+)
+
+// stubWebhook is a bot in webhook mode with the given secret, recording the
+// updates handed to it. An empty secret stands for polling mode.
+type stubWebhook struct {
+	secret  string
+	updates []string
+}
+
+func (w *stubWebhook) ServeWebhook(ctx context.Context, secret string, data []byte) error {
+	switch {
+	case w.secret == "":
+		return service.ErrBotWebhookOff
+	case secret != w.secret:
+		return service.ErrBotWebhookSecret
+	}
+	w.updates = append(w.updates, string(data))
+	return nil
+}
+
+func TestTgbotWebhook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	webhook := &stubWebhook{}
+	r := gin.New()
+	NewTgbotController(r.Group("/"), webhook)
+	post := func(secret string, wantCode int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/tgbot/webhook", strings.NewReader(`{"update_id":1}`))
+		req.Header.Set(telego.WebhookSecretTokenHeader, secret)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != wantCode {
+			t.Fatalf("post with secret %q: status %d, want %d", secret, w.Code, wantCode)
+		}
+	}
+
+	post("", http.StatusNotFound)
+	webhook.secret = "s3cret"
+	post("guess", http.StatusUnauthorized)
+	post("s3cret", http.StatusOK)
+	if len(webhook.updates) != 1 || webhook.updates[0] != `{"update_id":1}` {
+		t.Fatalf("updates = %q", webhook.updates)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/tls"
 	"math"
 	"net"
+	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -21,13 +23,14 @@ type Msg struct {
 // AllSetting contains all configuration settings for the 3x-ui panel including web server, Telegram bot, and subscription settings.
 type AllSetting struct {
 	// Web server settings
-	WebListen     string `json:"webListen" form:"webListen"`         // Web server listen IP address
-	WebDomain     string `json:"webDomain" form:"webDomain"`         // Web server domain for domain validation
-	WebPort       int    `json:"webPort" form:"webPort"`             // Web server port number
-	WebCertFile   string `json:"webCertFile" form:"webCertFile"`     // Path to SSL certificate file for web server
-	WebKeyFile    string `json:"webKeyFile" form:"webKeyFile"`       // Path to SSL private key file for web server
-	WebBasePath   string `json:"webBasePath" form:"webBasePath"`     // Base path for web panel URLs
-	SessionMaxAge int    `json:"sessionMaxAge" form:"sessionMaxAge"` // Session maximum age in minutes
+	WebListen      string `json:"webListen" form:"webListen"`           // Web server listen IP address
+	WebDomain      string `json:"webDomain" form:"webDomain"`           // Web server domain for domain validation
+	WebPort        int    `json:"webPort" form:"webPort"`               // Web server port number
+	WebCertFile    string `json:"webCertFile" form:"webCertFile"`       // Path to SSL certificate file for web server
+	WebKeyFile     string `json:"webKeyFile" form:"webKeyFile"`         // Path to SSL private key file for web server
+	WebBasePath    string `json:"webBasePath" form:"webBasePath"`       // Base path for web panel URLs
+	SessionMaxAge  int    `json:"sessionMaxAge" form:"sessionMaxAge"`   // Session maximum age in minutes
+	TrustedProxies string `json:"trustedProxies" form:"trustedProxies"` // Comma-separated IPs or CIDRs of reverse proxies whose X-Forwarded-For is trusted
 
 	// UI settings
 	PageSize    int    `json:"pageSize" form:"pageSize"`       // Number of items per page in lists
@@ -37,23 +40,106 @@ type AllSetting struct {
 	Datepicker  string `json:"datepicker" form:"datepicker"`   // Date picker format
 
 	// Shop settings
-	ShopPricePerGB int `json:"shopPricePerGB" form:"shopPricePerGB"` // Price per GB for custom orders
-	ShopMinGB      int `json:"shopMinGB" form:"shopMinGB"`           // Minimum GB for custom orders (0 = no limit)
-	ShopMaxGB      int `json:"shopMaxGB" form:"shopMaxGB"`           // Maximum GB for custom orders (0 = no limit)
-	ShopMinDays    int `json:"shopMinDays" form:"shopMinDays"`       // Minimum days for custom orders (0 = no limit)
-	ShopMaxDays    int `json:"shopMaxDays" form:"shopMaxDays"`       // Maximum days for custom orders (0 = no limit)
+	ShopPricePerGB             int    `json:"shopPricePerGB" form:"shopPricePerGB"`                         // Price per GB for custom orders, in minor units of the shop currency
+	ShopMinGB                  int    `json:"shopMinGB" form:"shopMinGB"`                                   // Minimum GB for custom orders (0 = no limit)
+	ShopMaxGB                  int    `json:"shopMaxGB" form:"shopMaxGB"`                                   // Maximum GB for custom orders (0 = no limit)
+	ShopMinDays                int    `json:"shopMinDays" form:"shopMinDays"`                               // Minimum days for custom orders (0 = no limit)
+	ShopMaxDays                int    `json:"shopMaxDays" form:"shopMaxDays"`                               // Maximum days for custom orders (0 = no limit)
+	ShopMaintenance            bool   `json:"shopMaintenance" form:"shopMaintenance"`                       // Disable new shop orders (maintenance mode)
+	ShopClosedMessage          string `json:"shopClosedMessage" form:"shopClosedMessage"`                   // Message shown to customers while the shop is closed
+	ShopRenewalGraceDays       int    `json:"shopRenewalGraceDays" form:"shopRenewalGraceDays"`             // Days an unpaid renewal may stay open before the client is suspended
+	ShopPausesPerCycle         int    `json:"shopPausesPerCycle" form:"shopPausesPerCycle"`                 // Times a customer may pause an order or renewal, 0 disables pausing
+	ShopPauseFreezeExpiry      bool   `json:"shopPauseFreezeExpiry" form:"shopPauseFreezeExpiry"`           // Move a paused client's expiry back by the length of the pause on resume
+	ShopOcrProvider            string `json:"shopOcrProvider" form:"shopOcrProvider"`                       // Receipt OCR provider name, empty to disable
+	ShopOcrEndpoint            string `json:"shopOcrEndpoint" form:"shopOcrEndpoint"`                       // URL the http OCR provider posts receipt images to
+	ShopOcrApiKey              string `json:"shopOcrApiKey" form:"shopOcrApiKey"`                           // Bearer token sent to the OCR endpoint
+	ShopPaymentRotation        string `json:"shopPaymentRotation" form:"shopPaymentRotation"`               // How payment destinations are picked: round_robin, least_used or priority
+	ShopRateMessagesPerMinute  int    `json:"shopRateMessagesPerMinute" form:"shopRateMessagesPerMinute"`   // Bot messages a customer may send per minute, 0 for no limit
+	ShopRateOrdersPerHour      int    `json:"shopRateOrdersPerHour" form:"shopRateOrdersPerHour"`           // Shop orders a customer may create per hour, 0 for no limit
+	ShopRateReceiptsPerHour    int    `json:"shopRateReceiptsPerHour" form:"shopRateReceiptsPerHour"`       // Receipt uploads a customer may send per hour, 0 for no limit
+	ShopRateCooldownMinutes    int    `json:"shopRateCooldownMinutes" form:"shopRateCooldownMinutes"`       // Minutes a customer is ignored after going over a limit
+	ShopMsgWelcome             string `json:"shopMsgWelcome" form:"shopMsgWelcome"`                         // bot welcome text for customers
+	ShopMsgPackages            string `json:"shopMsgPackages" form:"shopMsgPackages"`                       // bot package list header
+	ShopMsgPayment             string `json:"shopMsgPayment" form:"shopMsgPayment"`                         // bot payment instructions
+	ShopMsgApproved            string `json:"shopMsgApproved" form:"shopMsgApproved"`                       // bot order approval text
+	ShopMsgRejected            string `json:"shopMsgRejected" form:"shopMsgRejected"`                       // bot order rejection text
+	ShopRequiredChannel        string `json:"shopRequiredChannel" form:"shopRequiredChannel"`               // channel customers must join before ordering
+	ShopRequiredChannelLink    string `json:"shopRequiredChannelLink" form:"shopRequiredChannelLink"`       // invite link of the required channel
+	ShopNotifier               string `json:"shopNotifier" form:"shopNotifier"`                             // Provider reaching customers without Telegram
+	ShopNotifierAccount        string `json:"shopNotifierAccount" form:"shopNotifierAccount"`               // Twilio account SID
+	ShopNotifierApiKey         string `json:"shopNotifierApiKey" form:"shopNotifierApiKey"`                 // Kavenegar API key or Twilio auth token
+	ShopNotifierSender         string `json:"shopNotifierSender" form:"shopNotifierSender"`                 // Sender number or line
+	SmtpHost                   string `json:"smtpHost" form:"smtpHost"`                                     // SMTP server used to email customers
+	SmtpPort                   int    `json:"smtpPort" form:"smtpPort"`                                     // SMTP server port
+	SmtpUsername               string `json:"smtpUsername" form:"smtpUsername"`                             // SMTP login
+	SmtpPassword               string `json:"smtpPassword" form:"smtpPassword"`                             // SMTP password
+	SmtpFrom                   string `json:"smtpFrom" form:"smtpFrom"`                                     // Sender address of customer emails
+	MetricsToken               string `json:"metricsToken" form:"metricsToken"`                             // Bearer token required to scrape /metrics
+	ShopTgBackup               bool   `json:"shopTgBackup" form:"shopTgBackup"`                             // Send encrypted shop backups with the Telegram report
+	ShopBackupPassword         string `json:"shopBackupPassword" form:"shopBackupPassword"`                 // Passphrase encrypting shop backups, the panel secret when empty
+	ShopReceiptRetentionDays   int    `json:"shopReceiptRetentionDays" form:"shopReceiptRetentionDays"`     // Days after which receipts of closed orders are deleted, 0 keeps them
+	ShopOrderArchiveDays       int    `json:"shopOrderArchiveDays" form:"shopOrderArchiveDays"`             // Days after which closed orders move to the archive table, 0 disables archival
+	ShopCurrency               string `json:"shopCurrency" form:"shopCurrency"`                             // Currency code prices are shown in, empty to show bare amounts
+	ShopStepGB                 int    `json:"shopStepGB" form:"shopStepGB"`                                 // GB step for custom orders, 0 for any amount
+	ShopStepDays               int    `json:"shopStepDays" form:"shopStepDays"`                             // Day step for custom orders, 0 for any duration
+	ShopPresetsGB              string `json:"shopPresetsGB" form:"shopPresetsGB"`                           // Comma-separated GB amounts offered as quick picks for custom orders
+	ShopPresetsDays            string `json:"shopPresetsDays" form:"shopPresetsDays"`                       // Comma-separated day counts offered as quick picks for custom orders
+	ShopEmailPattern           string `json:"shopEmailPattern" form:"shopEmailPattern"`                     // Pattern of generated shop client emails
+	ShopSubIdPattern           string `json:"shopSubIdPattern" form:"shopSubIdPattern"`                     // Pattern of generated shop client subIds
+	ShopShortLinks             bool   `json:"shopShortLinks" form:"shopShortLinks"`                         // Send customers short /s/ links to their subscriptions instead of the raw URLs
+	ShopShortLinkDays          int    `json:"shopShortLinkDays" form:"shopShortLinkDays"`                   // Days a short link works for, 0 for no expiry
+	ShopCartReminderMinutes    int    `json:"shopCartReminderMinutes" form:"shopCartReminderMinutes"`       // Minutes after which a customer who did not send a receipt is reminded once, 0 disables
+	ShopStorefrontEnabled      bool   `json:"shopStorefrontEnabled" form:"shopStorefrontEnabled"`           // Serves the public /store page listing active packages
+	ShopStorefrontTitle        string `json:"shopStorefrontTitle" form:"shopStorefrontTitle"`               // Heading of the public /store page, the host name when empty
+	ShopPriceListEnabled       bool   `json:"shopPriceListEnabled" form:"shopPriceListEnabled"`             // Serves the public /store/packages.json price list
+	ShopApiRatePerMinute       int    `json:"shopApiRatePerMinute" form:"shopApiRatePerMinute"`             // Shop API and storefront requests allowed per IP and per logged-in user each minute, 0 for no limit
+	ShopApiWriteRatePerMinute  int    `json:"shopApiWriteRatePerMinute" form:"shopApiWriteRatePerMinute"`   // Shop API order imports, bulk orders and uploads allowed per IP and per logged-in user each minute, 0 for no limit
+	ShopCaptchaProvider        string `json:"shopCaptchaProvider" form:"shopCaptchaProvider"`               // Captcha on public order routes: "", "hcaptcha" or "turnstile"
+	ShopCaptchaSiteKey         string `json:"shopCaptchaSiteKey" form:"shopCaptchaSiteKey"`                 // Public site key of the captcha widget
+	ShopCaptchaSecret          string `json:"shopCaptchaSecret" form:"shopCaptchaSecret"`                   // Secret key used to verify captcha tokens
+	ShopDuplicateOrderMinutes  int    `json:"shopDuplicateOrderMinutes" form:"shopDuplicateOrderMinutes"`   // Minutes an identical pending order is reused instead of creating another, 0 to allow duplicates
+	ShopPartialProvision       bool   `json:"shopPartialProvision" form:"shopPartialProvision"`             // Provision partially paid orders right away with a proportionally reduced quota
+	ShopAmountCodeMax          int    `json:"shopAmountCodeMax" form:"shopAmountCodeMax"`                   // Largest code, in minor units, added to new orders' prices so transfers match by amount; 0 is off
+	ShopSyncPrimaryUrl         string `json:"shopSyncPrimaryUrl" form:"shopSyncPrimaryUrl"`                 // Primary panel, with its web base path, whose package catalog this panel mirrors; empty disables sync
+	ShopSyncToken              string `json:"shopSyncToken" form:"shopSyncToken"`                           // Catalog token of the primary panel
+	ShopCatalogToken           string `json:"shopCatalogToken" form:"shopCatalogToken"`                     // Bearer token letting other panels read the package catalog; empty disables it
+	ShopSyncMinutes            int    `json:"shopSyncMinutes" form:"shopSyncMinutes"`                       // Minutes between catalog syncs from the primary panel
+	ShopReceiptDeadlineMinutes int    `json:"shopReceiptDeadlineMinutes" form:"shopReceiptDeadlineMinutes"` // Minutes a customer has to send the receipt of an unpaid order before it is cancelled, 0 disables
+	ShopTgPayments             string `json:"shopTgPayments" form:"shopTgPayments"`                         // In-bot payment method: empty for none, stars for Telegram Stars or provider for a payment provider token
+	ShopTgProviderToken        string `json:"shopTgProviderToken" form:"shopTgProviderToken"`               // Payment provider token from BotFather, charged in the shop currency
+	ShopStarsPerUnit           string `json:"shopStarsPerUnit" form:"shopStarsPerUnit"`                     // Telegram Stars charged per whole unit of the shop currency, such as 0.05
+	ShopLightningBackend       string `json:"shopLightningBackend" form:"shopLightningBackend"`             // Lightning node issuing order invoices: empty for none, lnbits or lnd
+	ShopLightningUrl           string `json:"shopLightningUrl" form:"shopLightningUrl"`                     // Base URL of the LNbits instance or LND REST API
+	ShopLightningApiKey        string `json:"shopLightningApiKey" form:"shopLightningApiKey"`               // LNbits invoice key or LND invoice macaroon in hex
+	ShopSatsPerUnit            string `json:"shopSatsPerUnit" form:"shopSatsPerUnit"`                       // Satoshis charged per whole unit of the shop currency, such as 1500
+	ShopGateway                string `json:"shopGateway" form:"shopGateway"`                               // Merchant payment gateway: empty for none, perfectmoney or webmoney
+	ShopGatewayAccount         string `json:"shopGatewayAccount" form:"shopGatewayAccount"`                 // Perfect Money payee account or WebMoney purse receiving payments
+	ShopGatewaySecret          string `json:"shopGatewaySecret" form:"shopGatewaySecret"`                   // Perfect Money alternate passphrase or WebMoney merchant secret key
+	ShopGatewayCurrency        string `json:"shopGatewayCurrency" form:"shopGatewayCurrency"`               // Currency the gateway charges in
+	ShopGatewayRate            string `json:"shopGatewayRate" form:"shopGatewayRate"`                       // Gateway currency charged per whole unit of the shop currency
+	ShopPublicUrl              string `json:"shopPublicUrl" form:"shopPublicUrl"`                           // Public address of the panel, used for payment gateway callbacks
+	ShopWeeklySummary          bool   `json:"shopWeeklySummary" form:"shopWeeklySummary"`                   // Send the admins a shop summary every Monday morning
+	ShopLowStockThreshold      int    `json:"shopLowStockThreshold" form:"shopLowStockThreshold"`           // Alert the admins when a package has room for fewer orders, 0 to turn off
+	ShopInboundAlertPercent    int    `json:"shopInboundAlertPercent" form:"shopInboundAlertPercent"`       // Alert the admins when a shop inbound uses this percent of its client or traffic cap, 0 to turn off
+	ShopSecondApprovalPrice    int    `json:"shopSecondApprovalPrice" form:"shopSecondApprovalPrice"`       // Orders priced above this need approval by two different admins, in minor units of the shop currency, 0 to turn off
+	ShopAdminAllowedIps        string `json:"shopAdminAllowedIps" form:"shopAdminAllowedIps"`               // Comma-separated IP addresses and networks allowed to approve orders and change settings, empty for any
+	ShopAdminAllowedCountries  string `json:"shopAdminAllowedCountries" form:"shopAdminAllowedCountries"`   // Comma-separated geoip.dat country codes allowed to approve orders and change settings, empty for any
 
 	// Telegram bot settings
-	TgBotEnable      bool   `json:"tgBotEnable" form:"tgBotEnable"`           // Enable Telegram bot notifications
-	TgBotToken       string `json:"tgBotToken" form:"tgBotToken"`             // Telegram bot token
-	TgBotProxy       string `json:"tgBotProxy" form:"tgBotProxy"`             // Proxy URL for Telegram bot
-	TgBotAPIServer   string `json:"tgBotAPIServer" form:"tgBotAPIServer"`     // Custom API server for Telegram bot
-	TgBotChatId      string `json:"tgBotChatId" form:"tgBotChatId"`           // Telegram chat ID for notifications
-	TgRunTime        string `json:"tgRunTime" form:"tgRunTime"`               // Cron schedule for Telegram notifications
-	TgBotBackup      bool   `json:"tgBotBackup" form:"tgBotBackup"`           // Enable database backup via Telegram
-	TgBotLoginNotify bool   `json:"tgBotLoginNotify" form:"tgBotLoginNotify"` // Send login notifications
-	TgCpu            int    `json:"tgCpu" form:"tgCpu"`                       // CPU usage threshold for alerts
-	TgLang           string `json:"tgLang" form:"tgLang"`                     // Telegram bot language
+	TgBotEnable           bool   `json:"tgBotEnable" form:"tgBotEnable"`                     // Enable Telegram bot notifications
+	TgBotToken            string `json:"tgBotToken" form:"tgBotToken"`                       // Telegram bot token
+	TgBotProxy            string `json:"tgBotProxy" form:"tgBotProxy"`                       // Proxy URL for Telegram bot
+	TgBotAPIServer        string `json:"tgBotAPIServer" form:"tgBotAPIServer"`               // Custom API server for Telegram bot
+	TgBotWebhookUrl       string `json:"tgBotWebhookUrl" form:"tgBotWebhookUrl"`             // Public panel address Telegram posts updates to, empty for long polling
+	TgBotWebhookSecret    string `json:"tgBotWebhookSecret" form:"tgBotWebhookSecret"`       // Secret token Telegram sends with webhook updates
+	TgBotCustomerCommands string `json:"tgBotCustomerCommands" form:"tgBotCustomerCommands"` // Comma-separated commands listed in the bot menu of customers
+	TgBotAdminCommands    string `json:"tgBotAdminCommands" form:"tgBotAdminCommands"`       // Comma-separated commands listed in the bot menu of admins
+	TgBotChatId           string `json:"tgBotChatId" form:"tgBotChatId"`                     // Telegram chat ID for notifications
+	TgRunTime             string `json:"tgRunTime" form:"tgRunTime"`                         // Cron schedule for Telegram notifications
+	TgBotBackup           bool   `json:"tgBotBackup" form:"tgBotBackup"`                     // Enable database backup via Telegram
+	TgBotLoginNotify      bool   `json:"tgBotLoginNotify" form:"tgBotLoginNotify"`           // Send login notifications
+	TgCpu                 int    `json:"tgCpu" form:"tgCpu"`                                 // CPU usage threshold for alerts
+	TgLang                string `json:"tgLang" form:"tgLang"`                               // Telegram bot language
 
 	// Security settings
 	TimeLocation    string `json:"timeLocation" form:"timeLocation"`       // Time zone location
@@ -113,6 +199,9 @@ type AllSetting struct {
 	// JSON subscription routing rules
 }
 
+// tgBotWebhookSecretPattern matches the secret tokens Telegram accepts for a webhook.
+var tgBotWebhookSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
 // CheckValid validates all settings in the AllSetting struct, checking IP addresses, ports, SSL certificates, and other configuration values.
 func (s *AllSetting) CheckValid() error {
 	if s.WebListen != "" {
@@ -155,6 +244,16 @@ func (s *AllSetting) CheckValid() error {
 		}
 	}
 
+	for _, proxy := range strings.Split(s.TrustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return common.NewError("trusted proxy is not a valid ip or network:", proxy)
+		}
+	}
+
 	if !strings.HasPrefix(s.WebBasePath, "/") {
 		s.WebBasePath = "/" + s.WebBasePath
 	}
@@ -175,6 +274,16 @@ func (s *AllSetting) CheckValid() error {
 		s.SubJsonPath += "/"
 	}
 
+	if s.TgBotWebhookUrl != "" {
+		webhookUrl, err := url.Parse(s.TgBotWebhookUrl)
+		if err != nil || webhookUrl.Scheme != "https" || webhookUrl.Host == "" {
+			return common.NewError("Telegram webhook URL is not a valid https URL:", s.TgBotWebhookUrl)
+		}
+		if !tgBotWebhookSecretPattern.MatchString(s.TgBotWebhookSecret) {
+			return common.NewError("Telegram webhook secret must be 1 to 256 letters, digits, _ or -")
+		}
+	}
+
 	_, err := time.LoadLocation(s.TimeLocation)
 	if err != nil {
 		return common.NewError("time location not exist:", s.TimeLocation)
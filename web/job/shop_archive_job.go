@@ -0,0 +1,27 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopArchiveJob moves long closed orders to the order archive.
+type ShopArchiveJob struct {
+	shopService service.ShopService
+}
+
+// NewShopArchiveJob creates a new order archival job instance.
+func NewShopArchiveJob() *ShopArchiveJob {
+	return new(ShopArchiveJob)
+}
+
+// Run archives the orders past the configured age.
+func (j *ShopArchiveJob) Run() {
+	archived, err := j.shopService.ArchiveOrders()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("archive shop orders failed")
+	}
+	if archived > 0 {
+		logger.Infof("archived %d shop orders", archived)
+	}
+}
@@ -0,0 +1,33 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopBillingJob opens renewal orders for recurring shop packages and suspends unpaid subscriptions.
+type ShopBillingJob struct {
+	shopService  service.ShopService
+	tgbotService service.Tgbot
+	xrayService  service.XrayService
+}
+
+// NewShopBillingJob creates a new billing cycle job instance.
+func NewShopBillingJob() *ShopBillingJob {
+	return new(ShopBillingJob)
+}
+
+// Run processes due subscriptions and tells customers about their new renewal orders.
+func (j *ShopBillingJob) Run() {
+	orders, needRestart, err := j.shopService.ProcessBillingCycles()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("process shop billing cycles failed")
+		return
+	}
+	for _, order := range orders {
+		j.tgbotService.NotifyRenewalDue(order)
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
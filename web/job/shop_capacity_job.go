@@ -0,0 +1,40 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopCapacityJob alerts the admins of shop packages low on stock and of shop
+// inbounds near their client or traffic cap.
+type ShopCapacityJob struct {
+	shopService  service.ShopService
+	tgbotService service.Tgbot
+	alerted      map[string]bool
+}
+
+// NewShopCapacityJob creates a new shop capacity alert job instance.
+func NewShopCapacityJob() *ShopCapacityJob {
+	return &ShopCapacityJob{alerted: map[string]bool{}}
+}
+
+// Run sends each alert once while its shortage lasts, so a package or inbound
+// is reported again only after it recovered in between.
+func (j *ShopCapacityJob) Run() {
+	if !j.tgbotService.IsRunning() {
+		return
+	}
+	alerts, err := j.shopService.CapacityAlerts()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("check shop capacity failed")
+		return
+	}
+	current := make(map[string]bool, len(alerts))
+	for i := range alerts {
+		current[alerts[i].Key] = true
+		if !j.alerted[alerts[i].Key] {
+			j.tgbotService.SendCapacityAlert(&alerts[i])
+		}
+	}
+	j.alerted = current
+}
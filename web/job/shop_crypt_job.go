@@ -0,0 +1,28 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopCryptJob encrypts sensitive shop order fields still stored in plain text.
+type ShopCryptJob struct {
+	shopService service.ShopService
+}
+
+// NewShopCryptJob creates a new shop field encryption job instance.
+func NewShopCryptJob() *ShopCryptJob {
+	return new(ShopCryptJob)
+}
+
+// Run seals the plain text values of the encrypted shop columns.
+func (j *ShopCryptJob) Run() {
+	sealed, err := j.shopService.EncryptShopFields()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("encrypt shop fields failed")
+		return
+	}
+	if sealed > 0 {
+		logger.Infof("encrypted %d shop order fields", sealed)
+	}
+}
@@ -0,0 +1,56 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopDeadlineJob enforces the receipt deadline of unpaid orders.
+type ShopDeadlineJob struct {
+	settingService service.SettingService
+	shopService    service.ShopService
+	tgbotService   service.Tgbot
+}
+
+// NewShopDeadlineJob creates a new receipt deadline job instance.
+func NewShopDeadlineJob() *ShopDeadlineJob {
+	return new(ShopDeadlineJob)
+}
+
+// Run warns the customers of unpaid orders halfway to the deadline and
+// cancels the orders past it.
+func (j *ShopDeadlineJob) Run() {
+	minutes, err := j.settingService.GetShopReceiptDeadlineMinutes()
+	if err != nil || minutes <= 0 {
+		return
+	}
+	now := time.Now()
+	deadline := time.Duration(minutes) * time.Minute
+
+	orders, err := j.shopService.DueDeadlineWarnings(now, deadline)
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("load shop receipt deadline warnings failed")
+	}
+	for i := range orders {
+		order := &orders[i]
+		marked, err := j.shopService.MarkDeadlineWarned(order)
+		if err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("mark shop receipt deadline warning failed")
+			continue
+		}
+		if marked {
+			j.tgbotService.SendReceiptDeadlineWarning(order, order.CreatedAt.Add(deadline))
+		}
+	}
+
+	cancelled, err := j.shopService.CancelOverdueOrders(now, deadline)
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("cancel overdue shop orders failed")
+	}
+	for i := range cancelled {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: cancelled[i].Id}).Info("shop order cancelled, no receipt before the deadline")
+		j.tgbotService.SendOrderCancelled(&cancelled[i])
+	}
+}
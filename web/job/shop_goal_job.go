@@ -0,0 +1,33 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopGoalJob tells the admins when the month's revenue goal is reached.
+type ShopGoalJob struct {
+	shopService  service.ShopService
+	tgbotService service.Tgbot
+}
+
+// NewShopGoalJob creates a new revenue goal watcher job instance.
+func NewShopGoalJob() *ShopGoalJob {
+	return new(ShopGoalJob)
+}
+
+// Run alerts the admins once the current month's goal is reached. Nothing is
+// marked while the bot is stopped, so the alert follows when it starts.
+func (j *ShopGoalJob) Run() {
+	if !j.tgbotService.IsRunning() {
+		return
+	}
+	progress, err := j.shopService.ReachedRevenueGoal()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("check shop revenue goal failed")
+		return
+	}
+	if progress != nil {
+		j.tgbotService.SendRevenueGoalReached(progress)
+	}
+}
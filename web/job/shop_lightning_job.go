@@ -0,0 +1,44 @@
+package job
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopLightningJob provisions the orders whose Lightning invoice was paid.
+type ShopLightningJob struct {
+	shopService  service.ShopService
+	tgbotService service.Tgbot
+}
+
+// NewShopLightningJob creates a new Lightning payment watcher job instance.
+func NewShopLightningJob() *ShopLightningJob {
+	return new(ShopLightningJob)
+}
+
+// Run approves the orders with a settled Lightning invoice. Orders that fail
+// to provision are queued for retry or left for the admins to review.
+func (j *ShopLightningJob) Run() {
+	orders, err := j.shopService.SettledLightningOrders()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("check shop Lightning invoices failed")
+	}
+	for _, order := range orders {
+		ctx := logger.NewContext(context.Background(), logger.Fields{
+			logger.FieldOrderId: order.Id,
+			"lightning":         order.LightningHash,
+		})
+		err := j.tgbotService.ApproveOrder(ctx, order)
+		if err != nil {
+			logger.FromContext(ctx).WithFields(logger.Fields{"error": err}).Warning("approve order paid over Lightning failed")
+			if !errors.Is(err, service.ErrProvisionQueued) {
+				j.tgbotService.NotifyAdminsOrderPending(order.Id)
+			}
+			continue
+		}
+		j.tgbotService.SendOrderFulfillment(order)
+	}
+}
@@ -0,0 +1,29 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopPoolJob disables the clients of pooled shop orders whose shared traffic is used up.
+type ShopPoolJob struct {
+	shopService service.ShopService
+	xrayService service.XrayService
+}
+
+// NewShopPoolJob creates a new pooled traffic enforcement job instance.
+func NewShopPoolJob() *ShopPoolJob {
+	return new(ShopPoolJob)
+}
+
+// Run checks the traffic pools and restarts Xray if a client could not be removed through the API.
+func (j *ShopPoolJob) Run() {
+	needRestart, err := j.shopService.EnforcePooledOrders()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("enforce shop traffic pools failed")
+		return
+	}
+	if needRestart {
+		j.xrayService.SetToNeedRestart()
+	}
+}
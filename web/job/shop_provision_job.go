@@ -0,0 +1,55 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopProvisionJob provisions the shop orders scheduled for now and retries the
+// provisioning of approved orders that failed.
+type ShopProvisionJob struct {
+	shopService  service.ShopService
+	tgbotService service.Tgbot
+}
+
+// NewShopProvisionJob creates a new provisioning queue job instance.
+func NewShopProvisionJob() *ShopProvisionJob {
+	return new(ShopProvisionJob)
+}
+
+// Run provisions the scheduled orders that are due and the queued orders whose
+// next attempt is due, and sends the customers their configs.
+func (j *ShopProvisionJob) Run() {
+	scheduled, err := j.shopService.DueScheduledOrders(time.Now())
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("load scheduled shop orders failed")
+	} else {
+		j.provision(scheduled)
+	}
+	orders, err := j.shopService.DueProvisioningOrders(time.Now())
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("load shop provisioning queue failed")
+		return
+	}
+	j.provision(orders)
+}
+
+func (j *ShopProvisionJob) provision(orders []model.ShopOrder) {
+	for i := range orders {
+		order := &orders[i]
+		ctx := logger.NewContext(context.Background(), logger.Fields{logger.FieldOrderId: order.Id})
+		err := j.tgbotService.ApproveOrder(ctx, order)
+		if err == nil {
+			j.tgbotService.SendOrderFulfillment(order)
+			continue
+		}
+		if !errors.Is(err, service.ErrProvisionQueued) && !errors.Is(err, service.ErrProvisionBusy) && !errors.Is(err, service.ErrOrderNotFullyPaid) {
+			logger.FromContext(ctx).WithFields(logger.Fields{"error": err}).Warning("retry shop order provisioning failed")
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package job
+
+import (
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopReceiptJob deletes the receipts of closed orders past the retention period.
+type ShopReceiptJob struct {
+	shopService service.ShopService
+}
+
+// NewShopReceiptJob creates a new receipt retention job instance.
+func NewShopReceiptJob() *ShopReceiptJob {
+	return new(ShopReceiptJob)
+}
+
+// Run removes expired receipts.
+func (j *ShopReceiptJob) Run() {
+	purged, err := j.shopService.PurgeReceipts()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("purge shop receipts failed")
+		return
+	}
+	if purged > 0 {
+		logger.Infof("removed %d expired shop receipts", purged)
+	}
+}
@@ -0,0 +1,44 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopReminderJob reminds customers of orders they never sent a receipt for.
+type ShopReminderJob struct {
+	settingService service.SettingService
+	shopService    service.ShopService
+	tgbotService   service.Tgbot
+}
+
+// NewShopReminderJob creates a new unpaid order reminder job instance.
+func NewShopReminderJob() *ShopReminderJob {
+	return new(ShopReminderJob)
+}
+
+// Run sends one reminder for each unpaid order past the configured delay.
+func (j *ShopReminderJob) Run() {
+	minutes, err := j.settingService.GetShopCartReminderMinutes()
+	if err != nil || minutes <= 0 {
+		return
+	}
+	orders, err := j.shopService.DueCartReminders(time.Now(), time.Duration(minutes)*time.Minute)
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("load shop cart reminders failed")
+		return
+	}
+	for i := range orders {
+		order := &orders[i]
+		marked, err := j.shopService.MarkCartReminded(order)
+		if err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("mark shop cart reminder failed")
+			continue
+		}
+		if marked {
+			j.tgbotService.SendCartReminder(order)
+		}
+	}
+}
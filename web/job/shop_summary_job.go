@@ -0,0 +1,34 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopSummaryJob sends the admins a weekly summary of the shop.
+type ShopSummaryJob struct {
+	settingService service.SettingService
+	shopService    service.ShopService
+	tgbotService   service.Tgbot
+}
+
+// NewShopSummaryJob creates a new weekly shop summary job instance.
+func NewShopSummaryJob() *ShopSummaryJob {
+	return new(ShopSummaryJob)
+}
+
+// Run sends the summary of the last seven days when it is enabled.
+func (j *ShopSummaryJob) Run() {
+	enabled, err := j.settingService.GetShopWeeklySummary()
+	if err != nil || !enabled || !j.tgbotService.IsRunning() {
+		return
+	}
+	summary, err := j.shopService.WeeklySummary(time.Now())
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("build shop weekly summary failed")
+		return
+	}
+	j.tgbotService.SendWeeklySummary(summary)
+}
@@ -0,0 +1,40 @@
+package job
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/service"
+)
+
+// ShopSyncJob pulls the package catalog from the primary panel at the
+// configured interval.
+type ShopSyncJob struct {
+	shopService service.ShopService
+	lastRun     time.Time
+}
+
+// NewShopSyncJob creates a new catalog sync job instance.
+func NewShopSyncJob() *ShopSyncJob {
+	return new(ShopSyncJob)
+}
+
+// Run syncs the catalog once the interval since the last sync has passed.
+func (j *ShopSyncJob) Run() {
+	enabled, minutes := j.shopService.CatalogSyncEnabled()
+	if !enabled || time.Since(j.lastRun) < time.Duration(minutes)*time.Minute {
+		return
+	}
+	j.lastRun = time.Now()
+	result, err := j.shopService.SyncCatalog()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("sync shop catalog from the primary panel failed")
+		return
+	}
+	for _, msg := range result.Errors {
+		logger.WithFields(logger.Fields{"error": msg}).Warning("sync shop catalog item failed")
+	}
+	if result.Created+result.Updated+result.Archived > 0 {
+		logger.Infof("synced shop catalog: %d created, %d updated, %d archived", result.Created, result.Updated, result.Archived)
+	}
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimiter counts requests per key over a sliding window. Keys are
+// arbitrary strings such as "ip:203.0.113.7" or "user:1".
+type RateLimiter struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a RateLimiter counting requests over window.
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	return &RateLimiter{window: window, hits: map[string][]time.Time{}}
+}
+
+// Allow records a request for key and reports whether it stays within limit.
+// When it does not, it also returns how long until the oldest counted request
+// leaves the window. A limit of 0 or less allows everything.
+func (l *RateLimiter) Allow(key string, limit int) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	recent := l.hits[key][:0]
+	for _, at := range l.hits[key] {
+		if now.Sub(at) < l.window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= limit {
+		l.hits[key] = recent
+		return false, l.window - now.Sub(recent[0])
+	}
+	l.hits[key] = append(recent, now)
+	return true, 0
+}
+
+// sweep drops the keys without a request in the last window, at most once per
+// window, so clients that went away do not keep memory.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, hits := range l.hits {
+		if len(hits) == 0 || now.Sub(hits[len(hits)-1]) >= l.window {
+			delete(l.hits, key)
+		}
+	}
+}
+
+// RateLimitMiddleware returns a Gin middleware that answers 429 Too Many
+// Requests with a Retry-After header once any of a request's keys goes over
+// limit requests per window. limit is read on every request so setting changes
+// apply at once. onLimited, when set, is called with the key that was over.
+func RateLimitMiddleware(l *RateLimiter, limit func() int, keys func(*gin.Context) []string, onLimited func(c *gin.Context, key string)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		n := limit()
+		for _, key := range keys(c) {
+			ok, retryAfter := l.Allow(key, n)
+			if ok {
+				continue
+			}
+			if onLimited != nil {
+				onLimited(c, key)
+			}
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, entity.Msg{Success: false, Msg: "too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
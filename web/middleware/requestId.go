@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"regexp"
+
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIdHeader carries the correlation ID of a request.
+const RequestIdHeader = "X-Request-Id"
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIdMiddleware returns a Gin middleware that tags every request with a
+// correlation ID. A well-formed X-Request-Id sent by a proxy is kept, otherwise
+// a new one is generated. The ID is echoed in the response and stored in the
+// request context, where logger.FromContext picks it up.
+func RequestIdMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIdHeader)
+		if !validRequestId.MatchString(id) {
+			id = random.Seq(16)
+		}
+		c.Header(RequestIdHeader, id)
+		ctx := logger.NewContext(c.Request.Context(), logger.Fields{logger.FieldRequestId: id})
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
@@ -27,6 +27,7 @@ var defaultValueMap = map[string]string{
 	"xrayTemplateConfig":          xrayTemplateConfig,
 	"webListen":                   "",
 	"webDomain":                   "",
+	"trustedProxies":              "",
 	"webPort":                     "2053",
 	"webCertFile":                 "",
 	"webKeyFile":                  "",
@@ -43,10 +44,93 @@ var defaultValueMap = map[string]string{
 	"shopMaxGB":                   "0",
 	"shopMinDays":                 "0",
 	"shopMaxDays":                 "0",
+	"shopMaintenance":             "false",
+	"shopClosedMessage":           "",
+	"shopRenewalGraceDays":        "3",
+	"shopPausesPerCycle":          "0",
+	"shopPauseFreezeExpiry":       "true",
+	"shopOcrProvider":             "",
+	"shopOcrEndpoint":             "",
+	"shopOcrApiKey":               "",
+	"shopPaymentRotation":         "round_robin",
+	"shopRateMessagesPerMinute":   "20",
+	"shopRateOrdersPerHour":       "5",
+	"shopRateReceiptsPerHour":     "10",
+	"shopRateCooldownMinutes":     "10",
+	"shopMsgWelcome":              "",
+	"shopMsgPackages":             "",
+	"shopMsgPayment":              "",
+	"shopMsgApproved":             "",
+	"shopMsgRejected":             "",
+	"shopRequiredChannel":         "",
+	"shopRequiredChannelLink":     "",
+	"shopNotifier":                "",
+	"shopNotifierAccount":         "",
+	"shopNotifierApiKey":          "",
+	"shopNotifierSender":          "",
+	"smtpHost":                    "",
+	"smtpPort":                    "587",
+	"smtpUsername":                "",
+	"smtpPassword":                "",
+	"smtpFrom":                    "",
+	"metricsToken":                "",
+	"shopTgBackup":                "false",
+	"shopBackupPassword":          "",
+	"shopReceiptRetentionDays":    "0",
+	"shopOrderArchiveDays":        "0",
+	"shopCurrency":                "",
+	"shopStepGB":                  "0",
+	"shopStepDays":                "0",
+	"shopPresetsGB":               "",
+	"shopPresetsDays":             "",
+	"shopEmailPattern":            "tg-{tgid}-{orderid}@shop",
+	"shopSubIdPattern":            "{random:16}",
+	"shopShortLinks":              "false",
+	"shopShortLinkDays":           "0",
+	"shopCartReminderMinutes":     "60",
+	"shopStorefrontEnabled":       "false",
+	"shopStorefrontTitle":         "",
+	"shopPriceListEnabled":        "false",
+	"shopApiRatePerMinute":        "300",
+	"shopApiWriteRatePerMinute":   "20",
+	"shopCaptchaProvider":         "",
+	"shopCaptchaSiteKey":          "",
+	"shopCaptchaSecret":           "",
+	"shopDuplicateOrderMinutes":   "10",
+	"shopPartialProvision":        "false",
+	"shopAmountCodeMax":           "0",
+	"shopSyncPrimaryUrl":          "",
+	"shopSyncToken":               "",
+	"shopCatalogToken":            "",
+	"shopSyncMinutes":             "60",
+	"shopReceiptDeadlineMinutes":  "0",
+	"shopTgPayments":              "",
+	"shopTgProviderToken":         "",
+	"shopStarsPerUnit":            "",
+	"shopLightningBackend":        "",
+	"shopLightningUrl":            "",
+	"shopLightningApiKey":         "",
+	"shopSatsPerUnit":             "",
+	"shopGateway":                 "",
+	"shopGatewayAccount":          "",
+	"shopGatewaySecret":           "",
+	"shopGatewayCurrency":         "USD",
+	"shopGatewayRate":             "1",
+	"shopPublicUrl":               "",
+	"shopWeeklySummary":           "true",
+	"shopLowStockThreshold":       "0",
+	"shopInboundAlertPercent":     "0",
+	"shopSecondApprovalPrice":     "0",
+	"shopAdminAllowedIps":         "",
+	"shopAdminAllowedCountries":   "",
 	"tgBotEnable":                 "false",
 	"tgBotToken":                  "",
 	"tgBotProxy":                  "",
 	"tgBotAPIServer":              "",
+	"tgBotWebhookUrl":             "",
+	"tgBotWebhookSecret":          "",
+	"tgBotCustomerCommands":       "start,shop,orders,balance,support,rotate,pause,mydata,forgetme,help,id",
+	"tgBotAdminCommands":          "start,help,status,usage,inbound,restart,broadcast,id",
 	"tgBotChatId":                 "",
 	"tgRunTime":                   "@daily",
 	"tgBotBackup":                 "false",
@@ -268,6 +352,14 @@ func (s *SettingService) getInt(key string) (int, error) {
 	return strconv.Atoi(str)
 }
 
+func (s *SettingService) getInt64(key string) (int64, error) {
+	str, err := s.getString(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(str, 10, 64)
+}
+
 func (s *SettingService) setInt(key string, value int) error {
 	return s.setString(key, strconv.Itoa(value))
 }
@@ -288,6 +380,23 @@ func (s *SettingService) GetWebDomain() (string, error) {
 	return s.getString("webDomain")
 }
 
+// GetTrustedProxies returns the reverse proxies whose forwarded client address
+// headers are trusted. Requests from anywhere else are attributed to the
+// address they came from.
+func (s *SettingService) GetTrustedProxies() ([]string, error) {
+	value, err := s.getString("trustedProxies")
+	if err != nil {
+		return nil, err
+	}
+	var proxies []string
+	for _, proxy := range strings.Split(value, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies, nil
+}
+
 func (s *SettingService) GetTgBotToken() (string, error) {
 	return s.getString("tgBotToken")
 }
@@ -312,6 +421,22 @@ func (s *SettingService) SetTgBotAPIServer(token string) error {
 	return s.setString("tgBotAPIServer", token)
 }
 
+func (s *SettingService) GetTgBotWebhookUrl() (string, error) {
+	return s.getString("tgBotWebhookUrl")
+}
+
+func (s *SettingService) GetTgBotWebhookSecret() (string, error) {
+	return s.getString("tgBotWebhookSecret")
+}
+
+func (s *SettingService) GetTgBotCustomerCommands() (string, error) {
+	return s.getString("tgBotCustomerCommands")
+}
+
+func (s *SettingService) GetTgBotAdminCommands() (string, error) {
+	return s.getString("tgBotAdminCommands")
+}
+
 func (s *SettingService) GetTgBotChatId() (string, error) {
 	return s.getString("tgBotChatId")
 }
@@ -541,8 +666,10 @@ func (s *SettingService) GetPageSize() (int, error) {
 	return s.getInt("pageSize")
 }
 
-func (s *SettingService) GetShopPricePerGB() (int, error) {
-	return s.getInt("shopPricePerGB")
+// GetShopPricePerGB returns the custom order price of one GB in minor units of
+// the shop currency.
+func (s *SettingService) GetShopPricePerGB() (int64, error) {
+	return s.getInt64("shopPricePerGB")
 }
 
 func (s *SettingService) GetShopMinGB() (int, error) {
@@ -561,6 +688,322 @@ func (s *SettingService) GetShopMaxDays() (int, error) {
 	return s.getInt("shopMaxDays")
 }
 
+func (s *SettingService) GetShopMaintenance() (bool, error) {
+	return s.getBool("shopMaintenance")
+}
+
+func (s *SettingService) GetShopClosedMessage() (string, error) {
+	return s.getString("shopClosedMessage")
+}
+
+func (s *SettingService) GetShopRenewalGraceDays() (int, error) {
+	return s.getInt("shopRenewalGraceDays")
+}
+
+func (s *SettingService) GetShopPausesPerCycle() (int, error) {
+	return s.getInt("shopPausesPerCycle")
+}
+
+func (s *SettingService) GetShopPauseFreezeExpiry() (bool, error) {
+	return s.getBool("shopPauseFreezeExpiry")
+}
+
+func (s *SettingService) GetShopOcrProvider() (string, error) {
+	return s.getString("shopOcrProvider")
+}
+
+func (s *SettingService) GetShopOcrEndpoint() (string, error) {
+	return s.getString("shopOcrEndpoint")
+}
+
+func (s *SettingService) GetShopOcrApiKey() (string, error) {
+	return s.getString("shopOcrApiKey")
+}
+
+func (s *SettingService) GetShopPaymentRotation() (string, error) {
+	return s.getString("shopPaymentRotation")
+}
+
+func (s *SettingService) GetShopRateMessagesPerMinute() (int, error) {
+	return s.getInt("shopRateMessagesPerMinute")
+}
+
+func (s *SettingService) GetShopRateOrdersPerHour() (int, error) {
+	return s.getInt("shopRateOrdersPerHour")
+}
+
+func (s *SettingService) GetShopRateReceiptsPerHour() (int, error) {
+	return s.getInt("shopRateReceiptsPerHour")
+}
+
+func (s *SettingService) GetShopRateCooldownMinutes() (int, error) {
+	return s.getInt("shopRateCooldownMinutes")
+}
+
+func (s *SettingService) GetShopMsgWelcome() (string, error) {
+	return s.getString("shopMsgWelcome")
+}
+
+func (s *SettingService) GetShopMsgPackages() (string, error) {
+	return s.getString("shopMsgPackages")
+}
+
+func (s *SettingService) GetShopMsgPayment() (string, error) {
+	return s.getString("shopMsgPayment")
+}
+
+func (s *SettingService) GetShopMsgApproved() (string, error) {
+	return s.getString("shopMsgApproved")
+}
+
+func (s *SettingService) GetShopMsgRejected() (string, error) {
+	return s.getString("shopMsgRejected")
+}
+
+func (s *SettingService) GetShopRequiredChannel() (string, error) {
+	return s.getString("shopRequiredChannel")
+}
+
+func (s *SettingService) GetShopRequiredChannelLink() (string, error) {
+	return s.getString("shopRequiredChannelLink")
+}
+
+func (s *SettingService) GetShopNotifier() (string, error) {
+	return s.getString("shopNotifier")
+}
+
+func (s *SettingService) GetShopNotifierAccount() (string, error) {
+	return s.getString("shopNotifierAccount")
+}
+
+func (s *SettingService) GetShopNotifierApiKey() (string, error) {
+	return s.getString("shopNotifierApiKey")
+}
+
+func (s *SettingService) GetShopNotifierSender() (string, error) {
+	return s.getString("shopNotifierSender")
+}
+
+func (s *SettingService) GetSmtpHost() (string, error) {
+	return s.getString("smtpHost")
+}
+
+func (s *SettingService) GetSmtpPort() (int, error) {
+	return s.getInt("smtpPort")
+}
+
+func (s *SettingService) GetSmtpUsername() (string, error) {
+	return s.getString("smtpUsername")
+}
+
+func (s *SettingService) GetSmtpPassword() (string, error) {
+	return s.getString("smtpPassword")
+}
+
+func (s *SettingService) GetSmtpFrom() (string, error) {
+	return s.getString("smtpFrom")
+}
+
+func (s *SettingService) GetMetricsToken() (string, error) {
+	return s.getString("metricsToken")
+}
+
+func (s *SettingService) GetShopTgBackup() (bool, error) {
+	return s.getBool("shopTgBackup")
+}
+
+func (s *SettingService) GetShopBackupPassword() (string, error) {
+	return s.getString("shopBackupPassword")
+}
+
+func (s *SettingService) GetShopReceiptRetentionDays() (int, error) {
+	return s.getInt("shopReceiptRetentionDays")
+}
+
+func (s *SettingService) GetShopOrderArchiveDays() (int, error) {
+	return s.getInt("shopOrderArchiveDays")
+}
+
+func (s *SettingService) GetShopCurrency() (string, error) {
+	return s.getString("shopCurrency")
+}
+
+func (s *SettingService) GetShopStepGB() (int, error) {
+	return s.getInt("shopStepGB")
+}
+
+func (s *SettingService) GetShopStepDays() (int, error) {
+	return s.getInt("shopStepDays")
+}
+
+func (s *SettingService) GetShopPresetsGB() (string, error) {
+	return s.getString("shopPresetsGB")
+}
+
+func (s *SettingService) GetShopPresetsDays() (string, error) {
+	return s.getString("shopPresetsDays")
+}
+
+func (s *SettingService) GetShopEmailPattern() (string, error) {
+	return s.getString("shopEmailPattern")
+}
+
+func (s *SettingService) GetShopSubIdPattern() (string, error) {
+	return s.getString("shopSubIdPattern")
+}
+
+func (s *SettingService) GetShopCartReminderMinutes() (int, error) {
+	return s.getInt("shopCartReminderMinutes")
+}
+
+func (s *SettingService) GetShopStorefrontEnabled() (bool, error) {
+	return s.getBool("shopStorefrontEnabled")
+}
+
+func (s *SettingService) GetShopStorefrontTitle() (string, error) {
+	return s.getString("shopStorefrontTitle")
+}
+
+func (s *SettingService) GetShopPriceListEnabled() (bool, error) {
+	return s.getBool("shopPriceListEnabled")
+}
+
+func (s *SettingService) GetShopApiRatePerMinute() (int, error) {
+	return s.getInt("shopApiRatePerMinute")
+}
+
+func (s *SettingService) GetShopApiWriteRatePerMinute() (int, error) {
+	return s.getInt("shopApiWriteRatePerMinute")
+}
+
+func (s *SettingService) GetShopCaptchaProvider() (string, error) {
+	return s.getString("shopCaptchaProvider")
+}
+
+func (s *SettingService) GetShopCaptchaSiteKey() (string, error) {
+	return s.getString("shopCaptchaSiteKey")
+}
+
+func (s *SettingService) GetShopCaptchaSecret() (string, error) {
+	return s.getString("shopCaptchaSecret")
+}
+
+func (s *SettingService) GetShopDuplicateOrderMinutes() (int, error) {
+	return s.getInt("shopDuplicateOrderMinutes")
+}
+
+func (s *SettingService) GetShopPartialProvision() (bool, error) {
+	return s.getBool("shopPartialProvision")
+}
+
+func (s *SettingService) GetShopAmountCodeMax() (int, error) {
+	return s.getInt("shopAmountCodeMax")
+}
+
+func (s *SettingService) GetShopSyncPrimaryUrl() (string, error) {
+	return s.getString("shopSyncPrimaryUrl")
+}
+
+func (s *SettingService) GetShopSyncToken() (string, error) {
+	return s.getString("shopSyncToken")
+}
+
+func (s *SettingService) GetShopCatalogToken() (string, error) {
+	return s.getString("shopCatalogToken")
+}
+
+func (s *SettingService) GetShopSyncMinutes() (int, error) {
+	return s.getInt("shopSyncMinutes")
+}
+
+func (s *SettingService) GetShopReceiptDeadlineMinutes() (int, error) {
+	return s.getInt("shopReceiptDeadlineMinutes")
+}
+
+func (s *SettingService) GetShopTgPayments() (string, error) {
+	return s.getString("shopTgPayments")
+}
+
+func (s *SettingService) GetShopTgProviderToken() (string, error) {
+	return s.getString("shopTgProviderToken")
+}
+
+func (s *SettingService) GetShopStarsPerUnit() (string, error) {
+	return s.getString("shopStarsPerUnit")
+}
+
+func (s *SettingService) GetShopLightningBackend() (string, error) {
+	return s.getString("shopLightningBackend")
+}
+
+func (s *SettingService) GetShopLightningUrl() (string, error) {
+	return s.getString("shopLightningUrl")
+}
+
+func (s *SettingService) GetShopLightningApiKey() (string, error) {
+	return s.getString("shopLightningApiKey")
+}
+
+func (s *SettingService) GetShopSatsPerUnit() (string, error) {
+	return s.getString("shopSatsPerUnit")
+}
+
+func (s *SettingService) GetShopGateway() (string, error) {
+	return s.getString("shopGateway")
+}
+
+func (s *SettingService) GetShopGatewayAccount() (string, error) {
+	return s.getString("shopGatewayAccount")
+}
+
+func (s *SettingService) GetShopGatewaySecret() (string, error) {
+	return s.getString("shopGatewaySecret")
+}
+
+func (s *SettingService) GetShopGatewayCurrency() (string, error) {
+	return s.getString("shopGatewayCurrency")
+}
+
+func (s *SettingService) GetShopGatewayRate() (string, error) {
+	return s.getString("shopGatewayRate")
+}
+
+func (s *SettingService) GetShopPublicUrl() (string, error) {
+	return s.getString("shopPublicUrl")
+}
+
+func (s *SettingService) GetShopWeeklySummary() (bool, error) {
+	return s.getBool("shopWeeklySummary")
+}
+
+func (s *SettingService) GetShopLowStockThreshold() (int, error) {
+	return s.getInt("shopLowStockThreshold")
+}
+
+func (s *SettingService) GetShopInboundAlertPercent() (int, error) {
+	return s.getInt("shopInboundAlertPercent")
+}
+
+func (s *SettingService) GetShopSecondApprovalPrice() (int64, error) {
+	return s.getInt64("shopSecondApprovalPrice")
+}
+
+func (s *SettingService) GetShopAdminAllowedIps() (string, error) {
+	return s.getString("shopAdminAllowedIps")
+}
+
+func (s *SettingService) GetShopAdminAllowedCountries() (string, error) {
+	return s.getString("shopAdminAllowedCountries")
+}
+
+func (s *SettingService) GetShopShortLinks() (bool, error) {
+	return s.getBool("shopShortLinks")
+}
+
+func (s *SettingService) GetShopShortLinkDays() (int, error) {
+	return s.getInt("shopShortLinkDays")
+}
+
 func (s *SettingService) GetSubURI() (string, error) {
 	return s.getString("subURI")
 }
@@ -706,6 +1149,14 @@ func (s *SettingService) UpdateAllSetting(allSetting *entity.AllSetting) error {
 	if err := allSetting.CheckValid(); err != nil {
 		return err
 	}
+	if err := validateShopSettings(allSetting); err != nil {
+		return err
+	}
+	for _, commands := range []string{allSetting.TgBotCustomerCommands, allSetting.TgBotAdminCommands} {
+		if _, err := parseBotCommands(commands); err != nil {
+			return err
+		}
+	}
 
 	v := reflect.ValueOf(allSetting).Elem()
 	t := reflect.TypeOf(allSetting).Elem()
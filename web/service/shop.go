@@ -2,63 +2,238 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/mhsanaei/3x-ui/v2/database"
 	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"gorm.io/gorm"
 )
 
 const (
 	OrderStatusPendingReceipt = "PENDING_RECEIPT"
 	OrderStatusPendingReview  = "PENDING_REVIEW"
+	OrderStatusOnHold         = "ON_HOLD"   // Paused until the customer answers the admin's question
+	OrderStatusScheduled      = "SCHEDULED" // Approved, waiting for its scheduled provisioning time
+	OrderStatusProvisioning   = "PROVISIONING"
 	OrderStatusApproved       = "APPROVED"
 	OrderStatusRejected       = "REJECTED"
+	OrderStatusChargeback     = "CHARGEBACK" // Paid, then the payment was reversed; the clients are disabled
+)
+
+const (
+	PackageTypeStandard = "standard"
+	PackageTypePooled   = "pooled"
+	PackageTypeTopUp    = "topup"
 )
 
+// ShopReceiptDir holds the receipt images uploaded by customers.
+const ShopReceiptDir = "/etc/x-ui/receipts"
+
+// ErrPackageConflict is returned when a package was changed since the version being saved was read.
+var ErrPackageConflict = errors.New("package was changed by someone else, reload it and try again")
+
+// ErrShopClosed is returned when order creation is attempted during maintenance mode.
+var ErrShopClosed = errors.New("shop is closed for maintenance")
+
 // ShopInboundOption holds inbound info with shop availability.
 type ShopInboundOption struct {
-	Id       int    `json:"id"`
-	Remark   string `json:"remark"`
-	Protocol string `json:"protocol"`
-	Port     int    `json:"port"`
-	Enabled  bool   `json:"enabled"`
+	Id         int      `json:"id"`
+	NodeId     int      `json:"nodeId"`
+	NodeName   string   `json:"nodeName"`
+	Remark     string   `json:"remark"`
+	Protocol   string   `json:"protocol"`
+	Port       int      `json:"port"`
+	Enabled    bool     `json:"enabled"`
+	MaxClients int      `json:"maxClients"`
+	Clients    int      `json:"clients"`
+	Full       bool     `json:"full"` // No client slots or traffic left
+	Tags       []string `json:"tags"`
+
+	Traffic          int64   `json:"traffic"`          // Bytes sent and received through the inbound
+	TrafficLimit     int64   `json:"trafficLimit"`     // Inbound traffic cap in bytes, 0 for none
+	Available        int     `json:"available"`        // Free client slots, -1 when unlimited
+	AvailableTraffic int64   `json:"availableTraffic"` // Bytes left under the traffic cap, -1 when uncapped
+	Usage            float64 `json:"usage"`            // Highest of the client and traffic usage ratios, 0 when neither is capped
+}
+
+// setCapacity fills in the capacity figures of an option from its client count
+// and the inbound's traffic counters.
+func (o *ShopInboundOption) setCapacity(inbound *model.Inbound) {
+	o.Traffic = inbound.Up + inbound.Down
+	o.TrafficLimit = inbound.Total
+	o.Available, o.AvailableTraffic = -1, -1
+	if o.MaxClients > 0 {
+		o.Available = max(0, o.MaxClients-o.Clients)
+		o.Usage = float64(o.Clients) / float64(o.MaxClients)
+	}
+	if o.TrafficLimit > 0 {
+		o.AvailableTraffic = max(0, o.TrafficLimit-o.Traffic)
+		o.Usage = max(o.Usage, float64(o.Traffic)/float64(o.TrafficLimit))
+	}
+	o.Full = o.Available == 0 || o.AvailableTraffic == 0
+}
+
+// ShopPackageFilter narrows down the packages returned by ListPackages.
+type ShopPackageFilter struct {
+	ActiveOnly      bool     // only packages offered for sale
+	Archived        bool     // only archived packages
+	IncludeArchived bool     // live and archived packages together
+	CategoryId      *int     // only packages of this category, 0 for uncategorized
+	Types           []string // only packages of these types
 }
 
 // ShopService provides operations for packages and orders.
 type ShopService struct {
-	inboundService InboundService
-	settingService SettingService
+	inboundService  InboundService
+	settingService  SettingService
+	shopNodeService ShopNodeService
+	xrayService     XrayService
+}
+
+// ListPackages returns the packages matching filter in display order. The
+// package table is served from memory; see shopPackageCache.
+func (s *ShopService) ListPackages(filter ShopPackageFilter) ([]model.ShopPackage, error) {
+	all, err := shopPackageCache.get(func() ([]model.ShopPackage, error) {
+		var packages []model.ShopPackage
+		err := database.GetShopDB().Order("sort_order asc, id asc").Find(&packages).Error
+		return packages, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(all, func(pkg model.ShopPackage) bool {
+		return !filter.matches(&pkg)
+	}), nil
 }
 
-func (s *ShopService) ListPackages(activeOnly bool) ([]model.ShopPackage, error) {
-	db := database.GetDB()
-	var packages []model.ShopPackage
-	query := db.Model(&model.ShopPackage{})
-	if activeOnly {
-		query = query.Where("is_active = ?", true)
+func (f ShopPackageFilter) matches(pkg *model.ShopPackage) bool {
+	if f.ActiveOnly && !pkg.IsActive {
+		return false
+	}
+	if !f.IncludeArchived && pkg.IsArchived != f.Archived {
+		return false
 	}
-	err := query.Order("id desc").Find(&packages).Error
-	return packages, err
+	if f.CategoryId != nil && pkg.CategoryId != *f.CategoryId {
+		return false
+	}
+	return len(f.Types) == 0 || slices.Contains(f.Types, pkg.Type)
 }
 
 func (s *ShopService) CreatePackage(pkg *model.ShopPackage) error {
+	if err := validatePackage(pkg); err != nil {
+		return err
+	}
+	db := database.GetShopDB()
+	if pkg.SortOrder == 0 {
+		var maxOrder int
+		if err := db.Model(&model.ShopPackage{}).Select("COALESCE(MAX(sort_order), 0)").Scan(&maxOrder).Error; err != nil {
+			return err
+		}
+		pkg.SortOrder = maxOrder + 1
+	}
 	pkg.CreatedAt = time.Now()
 	pkg.UpdatedAt = time.Now()
-	return database.GetDB().Create(pkg).Error
+	active := pkg.IsActive
+	if err := db.Create(pkg).Error; err != nil {
+		return err
+	}
+	// is_active has a database default of true, so the zero value is skipped on insert.
+	if !active {
+		pkg.IsActive = false
+		return db.Model(&model.ShopPackage{}).Where("id = ?", pkg.Id).Update("is_active", false).Error
+	}
+	return nil
+}
+
+// ReorderPackages stores the given package IDs' positions in list order.
+func (s *ShopService) ReorderPackages(ids []int) error {
+	return database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		for i, id := range ids {
+			err := tx.Model(&model.ShopPackage{}).Where("id = ?", id).Updates(map[string]any{
+				"sort_order": i + 1,
+				"version":    gorm.Expr("version + 1"),
+				"updated_at": time.Now(),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
+// UpdatePackage saves an edited package. pkg.Version must be the version the
+// edit started from; ErrPackageConflict is returned when the package has been
+// changed since.
 func (s *ShopService) UpdatePackage(pkg *model.ShopPackage) error {
+	if pkg.Version <= 0 {
+		v := &shopValidator{}
+		v.add("version", "shop.invalid.required")
+		return v.err()
+	}
+	if err := validatePackage(pkg); err != nil {
+		return err
+	}
+	db := database.GetShopDB()
+	expected := pkg.Version
+	pkg.Version = expected + 1
 	pkg.UpdatedAt = time.Now()
-	return database.GetDB().Model(&model.ShopPackage{}).Where("id = ?", pkg.Id).Updates(pkg).Error
+	// Every edited column is written, so zero prices and inactive packages are saved too.
+	result := db.Model(&model.ShopPackage{}).Where("id = ? AND version = ?", pkg.Id, expected).
+		Select("*").Omit("id", "sort_order", "is_archived", "created_at").Updates(pkg)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		pkg.Version = expected
+		if _, err := s.GetPackage(pkg.Id); err != nil {
+			return err
+		}
+		return ErrPackageConflict
+	}
+	return nil
 }
 
+// DuplicatePackage clones a package as an inactive copy so admins can derive
+// variants without re-entering every field.
+func (s *ShopService) DuplicatePackage(id int) (*model.ShopPackage, error) {
+	src, err := s.GetPackage(id)
+	if err != nil {
+		return nil, err
+	}
+	pkg := *src
+	pkg.Id = 0
+	pkg.Name = src.Name + " copy"
+	pkg.SortOrder = 0
+	pkg.IsArchived = false
+	pkg.IsActive = false
+	pkg.Version = 0
+	if err := s.CreatePackage(&pkg); err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+// DeletePackage archives a package instead of removing the row, since
+// historical orders keep referencing it.
 func (s *ShopService) DeletePackage(id int) error {
-	return database.GetDB().Delete(&model.ShopPackage{}, id).Error
+	return database.GetShopDB().Model(&model.ShopPackage{}).Where("id = ?", id).Updates(map[string]any{
+		"is_archived": true,
+		"is_active":   false,
+		"version":     gorm.Expr("version + 1"),
+		"updated_at":  time.Now(),
+	}).Error
 }
 
 func (s *ShopService) GetPackage(id int) (*model.ShopPackage, error) {
-	db := database.GetDB()
+	db := database.GetShopDB()
 	pkg := &model.ShopPackage{}
 	if err := db.First(pkg, id).Error; err != nil {
 		return nil, err
@@ -66,22 +241,63 @@ func (s *ShopService) GetPackage(id int) (*model.ShopPackage, error) {
 	return pkg, nil
 }
 
+func (s *ShopService) ListCategories() ([]model.ShopCategory, error) {
+	var categories []model.ShopCategory
+	err := database.GetShopDB().Order("sort_order asc, id asc").Find(&categories).Error
+	return categories, err
+}
+
+func (s *ShopService) GetCategory(id int) (*model.ShopCategory, error) {
+	category := &model.ShopCategory{}
+	if err := database.GetShopDB().First(category, id).Error; err != nil {
+		return nil, err
+	}
+	return category, nil
+}
+
+func (s *ShopService) SaveCategory(category *model.ShopCategory) error {
+	if err := validateCategory(category); err != nil {
+		return err
+	}
+	db := database.GetShopDB()
+	category.UpdatedAt = time.Now()
+	if category.Id > 0 {
+		return db.Model(&model.ShopCategory{}).Where("id = ?", category.Id).Updates(map[string]any{
+			"name":       category.Name,
+			"sort_order": category.SortOrder,
+			"updated_at": category.UpdatedAt,
+		}).Error
+	}
+	category.CreatedAt = time.Now()
+	return db.Create(category).Error
+}
+
+// DeleteCategory removes a category and moves its packages to uncategorized.
+func (s *ShopService) DeleteCategory(id int) error {
+	return database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.ShopPackage{}).Where("category_id = ?", id).Update("category_id", 0).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.ShopCategory{}, id).Error
+	})
+}
+
 func (s *ShopService) ListOrders() ([]model.ShopOrder, error) {
-	db := database.GetDB()
+	db := database.GetShopDB()
 	var orders []model.ShopOrder
 	err := db.Order("id desc").Find(&orders).Error
 	return orders, err
 }
 
 func (s *ShopService) ListOrdersByTelegramId(tgId int64) ([]model.ShopOrder, error) {
-	db := database.GetDB()
+	db := database.GetShopDB()
 	var orders []model.ShopOrder
 	err := db.Where("telegram_id = ?", tgId).Order("id desc").Find(&orders).Error
 	return orders, err
 }
 
 func (s *ShopService) GetOrder(id int) (*model.ShopOrder, error) {
-	db := database.GetDB()
+	db := database.GetShopDB()
 	order := &model.ShopOrder{}
 	if err := db.First(order, id).Error; err != nil {
 		return nil, err
@@ -89,86 +305,398 @@ func (s *ShopService) GetOrder(id int) (*model.ShopOrder, error) {
 	return order, nil
 }
 
+// CheckOpen reports ErrShopClosed while maintenance mode is enabled.
+func (s *ShopService) CheckOpen() error {
+	if closed, _ := s.settingService.GetShopMaintenance(); closed {
+		return ErrShopClosed
+	}
+	return nil
+}
+
+func (s *ShopService) ListConversations() ([]model.ShopConversation, error) {
+	var conversations []model.ShopConversation
+	err := database.GetShopDB().Find(&conversations).Error
+	return conversations, err
+}
+
+// SaveConversation stores a customer's bot flow, or removes it once state and draft are both empty.
+func (s *ShopService) SaveConversation(tgId int64, state, draft string) error {
+	db := database.GetShopDB()
+	if state == "" && draft == "" {
+		return db.Delete(&model.ShopConversation{}, tgId).Error
+	}
+	return db.Save(&model.ShopConversation{
+		TelegramId: tgId,
+		State:      state,
+		Draft:      draft,
+		UpdatedAt:  time.Now(),
+	}).Error
+}
+
+func (s *ShopService) ListOrderComments(orderId int) ([]model.ShopOrderComment, error) {
+	var comments []model.ShopOrderComment
+	err := database.GetShopDB().Where("order_id = ?", orderId).Order("id asc").Find(&comments).Error
+	return comments, err
+}
+
+func (s *ShopService) AddOrderComment(orderId int, author, body string) (*model.ShopOrderComment, error) {
+	if _, err := s.GetOrder(orderId); err != nil {
+		return nil, err
+	}
+	comment := &model.ShopOrderComment{
+		OrderId:   orderId,
+		Author:    author,
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+	return comment, database.GetShopDB().Create(comment).Error
+}
+
 func (s *ShopService) CreateOrder(order *model.ShopOrder) error {
+	if err := s.CheckOpen(); err != nil {
+		return err
+	}
+	if err := validateOrder(order); err != nil {
+		return err
+	}
+	if s.IsCustomerBanned(order.TelegramId) {
+		return ErrCustomerBanned
+	}
+	if existing := s.findDuplicateOrder(order); existing != nil {
+		*order = *existing
+		return nil
+	}
+	if err := s.CheckRate(order.TelegramId, RateKindOrder); err != nil {
+		return err
+	}
+	s.attributeDeepLink(order)
 	order.CreatedAt = time.Now()
 	order.UpdatedAt = time.Now()
-	return database.GetDB().Create(order).Error
+	err := database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		if err := s.assignAmountCode(tx, order); err != nil {
+			return err
+		}
+		if err := s.assignOrderNumber(tx, order); err != nil {
+			return err
+		}
+		if err := tx.Create(order).Error; err != nil {
+			return err
+		}
+		for i := range order.Items {
+			order.Items[i].OrderId = order.Id
+			order.Items[i].CreatedAt = time.Now()
+		}
+		if len(order.Items) > 0 {
+			return tx.Create(&order.Items).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	countOrderEvent(OrderEventCreated)
+	s.broadcastOrderFeed(OrderFeedNew, order)
+	return nil
+}
+
+// findDuplicateOrder returns the customer's identical order still awaiting a
+// receipt when it was placed within the duplicate order window, so tapping buy
+// twice leaves one order to pay. Cart orders are never matched.
+func (s *ShopService) findDuplicateOrder(order *model.ShopOrder) *model.ShopOrder {
+	minutes, err := s.settingService.GetShopDuplicateOrderMinutes()
+	if err != nil || minutes <= 0 || order.TelegramId == 0 || order.Status != OrderStatusPendingReceipt || len(order.Items) > 0 {
+		return nil
+	}
+	query := database.GetShopDB().
+		Where("telegram_id = ? AND status = ? AND item_count = 0 AND paid_amount = 0", order.TelegramId, OrderStatusPendingReceipt).
+		Where("node_id = ? AND inbound_id = ? AND custom_data_gb = ? AND custom_days = ? AND price - amount_code = ?",
+			order.NodeId, order.InboundId, order.CustomDataGB, order.CustomDays, order.Price).
+		Where("seats = ? AND subscription_id = ? AND upgrade_from_order_id = ? AND client_email = ?",
+			order.Seats, order.SubscriptionId, order.UpgradeFromOrderId, order.ClientEmail).
+		Where("created_at >= ?", time.Now().Add(-time.Duration(minutes)*time.Minute))
+	if order.PackageId != nil {
+		query = query.Where("package_id = ?", *order.PackageId)
+	} else {
+		query = query.Where("package_id IS NULL")
+	}
+	existing := &model.ShopOrder{}
+	if err := query.Order("id desc").Limit(1).Find(existing).Error; err != nil || existing.Id == 0 {
+		return nil
+	}
+	return existing
 }
 
 func (s *ShopService) UpdateOrder(order *model.ShopOrder) error {
 	order.UpdatedAt = time.Now()
-	return database.GetDB().Model(&model.ShopOrder{}).Where("id = ?", order.Id).Updates(order).Error
+	return database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", order.Id).Updates(order).Error
 }
 
 func (s *ShopService) UpdateOrderReceipt(id int, receiptPath, receiptFileId string) error {
-	return database.GetDB().Model(&model.ShopOrder{}).Where("id = ?", id).Updates(map[string]any{
+	err := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", id).Updates(map[string]any{
 		"receipt_path":    receiptPath,
 		"receipt_file_id": receiptFileId,
 		"status":          OrderStatusPendingReview,
 		"updated_at":      time.Now(),
 	}).Error
+	if err != nil {
+		return err
+	}
+	publishOrderStatus(id, OrderStatusPendingReview)
+	if order, err := s.GetOrder(id); err == nil {
+		s.broadcastOrderFeed(OrderFeedReceipt, order)
+	}
+	return nil
 }
 
 func (s *ShopService) UpdateOrderStatus(id int, status, note string) error {
-	return database.GetDB().Model(&model.ShopOrder{}).Where("id = ?", id).Updates(map[string]any{
+	err := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", id).Updates(map[string]any{
 		"status":     status,
 		"updated_at": time.Now(),
 	}).Error
+	if err != nil {
+		return err
+	}
+	if status == OrderStatusRejected {
+		countOrderEvent(OrderEventRejected)
+		if err := s.refundResellerOrder(id); err != nil {
+			return err
+		}
+	}
+	publishOrderStatus(id, status)
+	return nil
 }
 
-func (s *ShopService) SetOrderProvisioned(id int, email, clientId, subId string) error {
-	return database.GetDB().Model(&model.ShopOrder{}).Where("id = ?", id).Updates(map[string]any{
-		"client_email":  email,
-		"client_id":     clientId,
-		"client_sub_id": subId,
-		"status":        OrderStatusApproved,
+// OverrideOrderPrice changes the price charged for an order awaiting
+// provisioning, as when the customer paid slightly more or less than asked. A
+// note is required, and the order keeps the price it was placed at in
+// OriginalPrice, so revenue reports count what was actually paid.
+func (s *ShopService) OverrideOrderPrice(id int, price int64, note string) (*model.ShopOrder, error) {
+	note = strings.TrimSpace(note)
+	v := &shopValidator{}
+	v.nonNegative("price", price)
+	v.text("priceNote", note, true, shopValueMaxLength)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(shopProvisionableStatuses, order.Status) {
+		return nil, errors.New("order is no longer awaiting provisioning")
+	}
+	original := order.OriginalPrice
+	if order.PriceNote == "" {
+		original = order.Price
+	}
+	result := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ? AND status = ?", id, order.Status).
+		Updates(map[string]any{
+			"price":          price,
+			"original_price": original,
+			"price_note":     note,
+			"updated_at":     time.Now(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("order is no longer awaiting provisioning")
+	}
+	order.Price, order.OriginalPrice, order.PriceNote = price, original, note
+	return order, nil
+}
+
+// SetOrderContactEmail stores the address an order's config and invoice are emailed to.
+func (s *ShopService) SetOrderContactEmail(id int, address string) error {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return errors.New("invalid email address")
+	}
+	return database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", id).Updates(map[string]any{
+		"contact_email": parsed.Address,
 		"updated_at":    time.Now(),
 	}).Error
 }
 
+// SetOrderProvisioned records the clients of a provisioned order and marks it
+// approved. The order update and the subscription of a recurring package are
+// written in one transaction, so a failure leaves the order to be provisioned again.
+func (s *ShopService) SetOrderProvisioned(order *model.ShopOrder) error {
+	sub, err := s.newSubscription(order)
+	if err != nil {
+		return err
+	}
+	err = database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.ShopOrder{}).
+			Where("id = ? AND status IN ?", order.Id, shopProvisionableStatuses).
+			Updates(map[string]any{
+				"client_email":     order.ClientEmail,
+				"client_id":        order.ClientId,
+				"client_sub_id":    order.ClientSubId,
+				"client_emails":    order.ClientEmails,
+				"pool_bytes":       order.PoolBytes,
+				"withheld_data_gb": order.WithheldDataGB,
+				"node_id":          order.NodeId,
+				"inbound_id":       order.InboundId,
+				"provision_error":  "",
+				"status":           OrderStatusApproved,
+				"updated_at":       time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("order is no longer awaiting provisioning")
+		}
+		for i := range order.Clients {
+			order.Clients[i].OrderId = order.Id
+			order.Clients[i].CreatedAt = time.Now()
+		}
+		if len(order.Clients) > 0 {
+			if err := tx.Create(&order.Clients).Error; err != nil {
+				return err
+			}
+		}
+		if sub != nil {
+			return tx.Create(sub).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	order.Status = OrderStatusApproved
+	countOrderEvent(OrderEventApproved)
+	publishOrderStatus(order.Id, OrderStatusApproved)
+	s.refreshCustomerStats(order.TelegramId)
+	return nil
+}
+
+// ListInbounds returns the local and remote inbounds with their shop
+// availability. Results are cached briefly; see shopInboundCache.
 func (s *ShopService) ListInbounds() ([]ShopInboundOption, error) {
+	return shopInboundCache.get(s.loadInbounds)
+}
+
+func (s *ShopService) loadInbounds() ([]ShopInboundOption, error) {
 	inbounds, err := s.inboundService.GetAllInbounds()
 	if err != nil {
 		return nil, err
 	}
 
-	db := database.GetDB()
+	db := database.GetShopDB()
 	var shopInbounds []model.ShopInbound
 	_ = db.Find(&shopInbounds).Error
-	enabledMap := map[int]bool{}
+	enabledMap := map[[2]int]bool{}
+	maxMap := map[[2]int]int{}
+	tagMap := map[[2]int]string{}
+	// If no local inbound is configured, default to all local inbounds enabled.
+	useDefaultAll := true
 	for _, item := range shopInbounds {
-		enabledMap[item.InboundId] = item.Enabled
+		key := [2]int{item.NodeId, item.InboundId}
+		enabledMap[key] = item.Enabled
+		maxMap[key] = item.MaxClients
+		tagMap[key] = item.Tags
+		if item.NodeId == 0 {
+			useDefaultAll = false
+		}
+	}
+	newOption := func(nodeId int, inbound *model.Inbound) ShopInboundOption {
+		key := [2]int{nodeId, inbound.Id}
+		option := ShopInboundOption{
+			Id:         inbound.Id,
+			NodeId:     nodeId,
+			Remark:     inbound.Remark,
+			Protocol:   string(inbound.Protocol),
+			Port:       inbound.Port,
+			Enabled:    enabledMap[key],
+			MaxClients: maxMap[key],
+			Clients:    s.inboundClientCount(inbound),
+			Tags:       splitShopTags(tagMap[key]),
+		}
+		option.setCapacity(inbound)
+		return option
 	}
-
-	// If none configured, default to all enabled.
-	useDefaultAll := len(shopInbounds) == 0
 
 	options := make([]ShopInboundOption, 0, len(inbounds))
 	for _, inbound := range inbounds {
-		enabled := enabledMap[inbound.Id]
+		option := newOption(0, inbound)
 		if useDefaultAll {
-			enabled = true
-		}
-		options = append(options, ShopInboundOption{
-			Id:       inbound.Id,
-			Remark:   inbound.Remark,
-			Protocol: string(inbound.Protocol),
-			Port:     inbound.Port,
-			Enabled:  enabled,
-		})
+			option.Enabled = true
+		}
+		options = append(options, option)
+	}
+
+	nodes, err := s.shopNodeService.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		if !node.Enabled {
+			continue
+		}
+		remote, err := s.shopNodeService.RemoteInbounds(&node)
+		if err != nil {
+			logger.Warning("shop node", node.Name, "unreachable:", err)
+			continue
+		}
+		for _, inbound := range remote {
+			option := newOption(node.Id, inbound)
+			option.NodeName = node.Name
+			options = append(options, option)
+		}
 	}
 
-	sort.Slice(options, func(i, j int) bool {
+	sort.SliceStable(options, func(i, j int) bool {
+		if options[i].NodeId != options[j].NodeId {
+			return options[i].NodeId < options[j].NodeId
+		}
 		return options[i].Id < options[j].Id
 	})
 
 	return options, nil
 }
 
-func (s *ShopService) SetInboundEnabled(inboundId int, enabled bool) error {
-	db := database.GetDB()
+func (s *ShopService) SetInboundEnabled(nodeId, inboundId int, enabled bool) error {
+	return setInboundEnabled(database.GetShopDB(), nodeId, inboundId, enabled)
+}
+
+// SetInboundsEnabled offers or withdraws several inbounds of one node at once.
+func (s *ShopService) SetInboundsEnabled(nodeId int, inboundIds []int, enabled bool) error {
+	return database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		for _, inboundId := range inboundIds {
+			if err := setInboundEnabled(tx, nodeId, inboundId, enabled); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetAllInboundsEnabled offers or withdraws every inbound of the panel and its
+// reachable nodes. It returns the number of inbounds updated.
+func (s *ShopService) SetAllInboundsEnabled(enabled bool) (int, error) {
+	options, err := s.ListInbounds()
+	if err != nil {
+		return 0, err
+	}
+	err = database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		for _, option := range options {
+			if err := setInboundEnabled(tx, option.NodeId, option.Id, enabled); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(options), nil
+}
+
+func setInboundEnabled(db *gorm.DB, nodeId, inboundId int, enabled bool) error {
 	var existing model.ShopInbound
-	err := db.Where("inbound_id = ?", inboundId).First(&existing).Error
+	err := db.Where("node_id = ? AND inbound_id = ?", nodeId, inboundId).First(&existing).Error
 	if err == nil {
 		return db.Model(&model.ShopInbound{}).Where("id = ?", existing.Id).Updates(map[string]any{
 			"enabled":    enabled,
@@ -176,49 +704,76 @@ func (s *ShopService) SetInboundEnabled(inboundId int, enabled bool) error {
 		}).Error
 	}
 
+	// A map keeps a false Enabled from being replaced by the column default.
+	return db.Model(&model.ShopInbound{}).Create(map[string]any{
+		"node_id":    nodeId,
+		"inbound_id": inboundId,
+		"enabled":    enabled,
+		"created_at": time.Now(),
+		"updated_at": time.Now(),
+	}).Error
+}
+
+func (s *ShopService) SetInboundMaxClients(nodeId, inboundId, maxClients int) error {
+	if maxClients < 0 {
+		return errors.New("max clients cannot be negative")
+	}
+	db := database.GetShopDB()
+	var existing model.ShopInbound
+	err := db.Where("node_id = ? AND inbound_id = ?", nodeId, inboundId).First(&existing).Error
+	if err == nil {
+		return db.Model(&model.ShopInbound{}).Where("id = ?", existing.Id).Updates(map[string]any{
+			"max_clients": maxClients,
+			"updated_at":  time.Now(),
+		}).Error
+	}
+
 	return db.Create(&model.ShopInbound{
-		InboundId: inboundId,
-		Enabled:   enabled,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		NodeId:     nodeId,
+		InboundId:  inboundId,
+		Enabled:    true,
+		MaxClients: maxClients,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
 	}).Error
 }
 
-func (s *ShopService) EnabledInboundIds() ([]int, error) {
+// IsInboundAvailable reports whether an inbound is enabled and below its client limit.
+func (s *ShopService) IsInboundAvailable(nodeId, inboundId int) bool {
 	inbounds, err := s.ListInbounds()
 	if err != nil {
-		return nil, err
+		return false
 	}
-	var ids []int
 	for _, ib := range inbounds {
-		if ib.Enabled {
-			ids = append(ids, ib.Id)
+		if ib.NodeId == nodeId && ib.Id == inboundId {
+			return ib.Enabled && !ib.Full
 		}
 	}
-	return ids, nil
+	return false
 }
 
-func (s *ShopService) ValidateCustomOrder(dataGB, days int) error {
-	minGb, _ := s.settingService.GetShopMinGB()
-	maxGb, _ := s.settingService.GetShopMaxGB()
-	minDays, _ := s.settingService.GetShopMinDays()
-	maxDays, _ := s.settingService.GetShopMaxDays()
-
-	if minGb > 0 && dataGB < minGb {
-		return errors.New("data less than minimum allowed")
-	}
-	if maxGb > 0 && dataGB > maxGb {
-		return errors.New("data greater than maximum allowed")
-	}
-	if minDays > 0 && days < minDays {
-		return errors.New("days less than minimum allowed")
+// CheckInboundCapacity returns an error when the inbound has no room for clients
+// more within its shop client limit.
+func (s *ShopService) CheckInboundCapacity(nodeId int, inbound *model.Inbound, clients int) error {
+	var item model.ShopInbound
+	err := database.GetShopDB().Where("node_id = ? AND inbound_id = ?", nodeId, inbound.Id).First(&item).Error
+	if err != nil || item.MaxClients == 0 {
+		return nil
 	}
-	if maxDays > 0 && days > maxDays {
-		return errors.New("days greater than maximum allowed")
+	if s.inboundClientCount(inbound)+clients > item.MaxClients {
+		return fmt.Errorf("inbound %s has reached its limit of %d clients", inbound.Remark, item.MaxClients)
 	}
 	return nil
 }
 
+func (s *ShopService) inboundClientCount(inbound *model.Inbound) int {
+	clients, _ := s.inboundService.GetClients(inbound)
+	return len(clients)
+}
+
+// CalculateCustomPrice returns the price of a custom order for dataGB, in minor
+// units of the shop currency. It returns ErrPriceOverflow when the total does
+// not fit in an int64.
 func (s *ShopService) CalculateCustomPrice(dataGB int) (int64, error) {
 	pricePerGb, err := s.settingService.GetShopPricePerGB()
 	if err != nil {
@@ -227,5 +782,5 @@ func (s *ShopService) CalculateCustomPrice(dataGB int) (int64, error) {
 	if pricePerGb < 0 {
 		pricePerGb = 0
 	}
-	return int64(dataGB * pricePerGb), nil
+	return mulPrice(pricePerGb, int64(dataGB))
 }
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"github.com/xtls/xray-core/app/router"
+	"go4.org/netipx"
+	"google.golang.org/protobuf/proto"
+)
+
+// shopCountryCodePattern matches the country codes and other tags of the
+// entries in Xray's geoip.dat, such as DE or PRIVATE.
+var shopCountryCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{2,32}$`)
+
+// shopGeoIP caches the networks of the countries last looked up in Xray's
+// geoip.dat, read again when the file or the countries change.
+var shopGeoIP struct {
+	sync.Mutex
+	path      string
+	modTime   time.Time
+	countries string
+	networks  *netipx.IPSet
+}
+
+// parseAdminAllowedIps parses a comma-separated list of IP addresses and
+// networks in CIDR notation.
+func parseAdminAllowedIps(value string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(item); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseAdminAllowedCountries parses a comma-separated list of geoip.dat
+// country codes, upper-cased as geoip.dat has them.
+func parseAdminAllowedCountries(value string) ([]string, error) {
+	codes := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToUpper(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if !shopCountryCodePattern.MatchString(item) {
+			return nil, fmt.Errorf("invalid country code %q", item)
+		}
+		if !slices.Contains(codes, item) {
+			codes = append(codes, item)
+		}
+	}
+	slices.Sort(codes)
+	return codes, nil
+}
+
+// AdminIPAllowed tells whether a request from ip may use the routes that
+// approve orders or change settings. With no allowlist set every address may;
+// otherwise the address must be in allowedIps or belong to one of the
+// allowedCountries, as listed in Xray's geoip.dat.
+func AdminIPAllowed(ip, allowedIps, allowedCountries string) (bool, error) {
+	prefixes, err := parseAdminAllowedIps(allowedIps)
+	if err != nil {
+		return false, err
+	}
+	countries, err := parseAdminAllowedCountries(allowedCountries)
+	if err != nil {
+		return false, err
+	}
+	if len(prefixes) == 0 && len(countries) == 0 {
+		return true, nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false, nil
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true, nil
+		}
+	}
+	if len(countries) == 0 {
+		return false, nil
+	}
+	networks, err := countryNetworks(xray.GetGeoipPath(), countries)
+	if err != nil {
+		return false, err
+	}
+	return networks.Contains(addr), nil
+}
+
+// countryNetworks returns the networks geoip.dat at path lists for the given
+// countries.
+func countryNetworks(path string, countries []string) (*netipx.IPSet, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.Join(countries, ",")
+	shopGeoIP.Lock()
+	defer shopGeoIP.Unlock()
+	if shopGeoIP.networks != nil && shopGeoIP.path == path && shopGeoIP.modTime.Equal(info.ModTime()) && shopGeoIP.countries == key {
+		return shopGeoIP.networks, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := &router.GeoIPList{}
+	if err := proto.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	var builder netipx.IPSetBuilder
+	for _, entry := range list.Entry {
+		if !slices.Contains(countries, strings.ToUpper(entry.CountryCode)) {
+			continue
+		}
+		for _, cidr := range entry.Cidr {
+			addr, ok := netip.AddrFromSlice(cidr.Ip)
+			if !ok {
+				continue
+			}
+			if prefix, err := addr.Unmap().Prefix(int(cidr.Prefix)); err == nil {
+				builder.AddPrefix(prefix)
+			}
+		}
+	}
+	networks, err := builder.IPSet()
+	if err != nil {
+		return nil, err
+	}
+	shopGeoIP.path, shopGeoIP.modTime, shopGeoIP.countries, shopGeoIP.networks = path, info.ModTime(), key, networks
+	return networks, nil
+}
+
+// CheckAdminAccessKept refuses admin allowlists that would lock out the
+// request from ip saving them. Malformed lists are left to the settings
+// validation.
+func CheckAdminAccessKept(ip string, settings *entity.AllSetting) error {
+	if _, err := parseAdminAllowedIps(settings.ShopAdminAllowedIps); err != nil {
+		return nil
+	}
+	if _, err := parseAdminAllowedCountries(settings.ShopAdminAllowedCountries); err != nil {
+		return nil
+	}
+	allowed, err := AdminIPAllowed(ip, settings.ShopAdminAllowedIps, settings.ShopAdminAllowedCountries)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("the admin allowlists would lock out your address %s", ip)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ShopCapacityAlert warns of a package or a shop inbound running out of room
+// for new customers.
+type ShopCapacityAlert struct {
+	Key       string  `json:"key"` // What the alert is about, the same while the shortage lasts
+	PackageId int     `json:"packageId"`
+	Package   string  `json:"package"`
+	Stock     int     `json:"stock"` // Orders of the package its inbounds still have client slots for
+	NodeId    int     `json:"nodeId"`
+	InboundId int     `json:"inboundId"`
+	Inbound   string  `json:"inbound"`
+	Usage     float64 `json:"usage"` // Percent used of the inbound's client or traffic cap
+}
+
+// CapacityAlerts returns the packages on sale whose stock, the orders their
+// inbounds still have client slots for, fell below the low stock threshold,
+// and the enabled inbounds whose client or traffic usage reached the inbound
+// alert threshold. A zero threshold turns its alerts off. Packages that may be
+// provisioned on an inbound without a client limit are never low on stock.
+func (s *ShopService) CapacityAlerts() ([]ShopCapacityAlert, error) {
+	lowStock, err := s.settingService.GetShopLowStockThreshold()
+	if err != nil {
+		return nil, err
+	}
+	inboundPercent, err := s.settingService.GetShopInboundAlertPercent()
+	if err != nil {
+		return nil, err
+	}
+	if lowStock <= 0 && inboundPercent <= 0 {
+		return nil, nil
+	}
+	options, err := s.ListInbounds()
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := []ShopCapacityAlert{}
+	if lowStock > 0 {
+		packages, err := s.ListPackages(ShopPackageFilter{ActiveOnly: true, Types: []string{PackageTypeStandard, PackageTypePooled}})
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range packages {
+			slots, limited := 0, true
+			for _, option := range options {
+				if !option.Enabled || pkg.InboundTag != "" && !slices.Contains(option.Tags, pkg.InboundTag) {
+					continue
+				}
+				switch {
+				case option.AvailableTraffic == 0:
+				case option.Available < 0:
+					limited = false
+				default:
+					slots += option.Available
+				}
+			}
+			if !limited {
+				continue
+			}
+			stock := slots
+			if pkg.Type == PackageTypePooled {
+				stock = slots / max(pkg.Devices, 1)
+			}
+			if stock < lowStock {
+				alerts = append(alerts, ShopCapacityAlert{
+					Key:       fmt.Sprintf("package:%d", pkg.Id),
+					PackageId: pkg.Id,
+					Package:   pkg.Name,
+					Stock:     stock,
+				})
+			}
+		}
+	}
+	if inboundPercent > 0 {
+		for _, option := range options {
+			usage := option.Usage * 100
+			if !option.Enabled || usage < float64(inboundPercent) {
+				continue
+			}
+			name := option.Remark
+			if option.NodeName != "" {
+				name = option.NodeName + " / " + name
+			}
+			alerts = append(alerts, ShopCapacityAlert{
+				Key:       fmt.Sprintf("inbound:%d:%d", option.NodeId, option.Id),
+				NodeId:    option.NodeId,
+				InboundId: option.Id,
+				Inbound:   name,
+				Usage:     usage,
+			})
+		}
+	}
+	return alerts, nil
+}
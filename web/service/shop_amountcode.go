@@ -0,0 +1,35 @@
+package service
+
+import (
+	"slices"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// assignAmountCode adds to the price of a new order awaiting payment the
+// smallest amount code, up to the configured maximum, that no other open
+// order's price has taken, so a bank transfer of that amount can only be for
+// this order. Orders are left as they are when codes are off or all taken.
+func (s *ShopService) assignAmountCode(tx *gorm.DB, order *model.ShopOrder) error {
+	maxCode, err := s.settingService.GetShopAmountCodeMax()
+	if err != nil || maxCode <= 0 || order.Status != OrderStatusPendingReceipt || order.Price <= 0 {
+		return nil
+	}
+	var taken []int64
+	err = tx.Model(&model.ShopOrder{}).
+		Where("status IN ? AND price BETWEEN ? AND ?", []string{OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusOnHold}, order.Price+1, order.Price+int64(maxCode)).
+		Pluck("price", &taken).Error
+	if err != nil {
+		return err
+	}
+	for code := int64(1); code <= int64(maxCode); code++ {
+		if !slices.Contains(taken, order.Price+code) {
+			order.AmountCode = code
+			order.Price += code
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ErrSecondApprovalRequired is returned for an order priced above the second
+// approval price until two different admins approved it.
+var ErrSecondApprovalRequired = errors.New("order needs the approval of a second admin")
+
+// NeedsSecondApproval tells whether an order is priced above the second
+// approval price, so two different admins must approve it. The price the order
+// was placed at counts too, so lowering it on approval does not skip the check.
+func (s *ShopService) NeedsSecondApproval(order *model.ShopOrder) bool {
+	threshold, err := s.settingService.GetShopSecondApprovalPrice()
+	if err != nil || threshold <= 0 {
+		return false
+	}
+	price := order.Price
+	if order.PriceNote != "" {
+		price = max(price, order.OriginalPrice)
+	}
+	return price > threshold
+}
+
+// CheckOrderApproved returns ErrSecondApprovalRequired for an order needing a
+// second approval that two different admins have not given yet. Every path
+// provisioning an order goes through it, whatever approved the order.
+func (s *ShopService) CheckOrderApproved(order *model.ShopOrder) error {
+	if !s.NeedsSecondApproval(order) {
+		return nil
+	}
+	if order.FirstApprover == "" || order.SecondApprover == "" || order.FirstApprover == order.SecondApprover {
+		return ErrSecondApprovalRequired
+	}
+	return nil
+}
+
+// RecordApproval records the approval of an order by admin, a panel username.
+// An order needing a second approval may be provisioned once two different
+// admins approved it: until then ErrSecondApprovalRequired is returned, with the
+// order showing who approved it first. Other orders are returned as they are.
+func (s *ShopService) RecordApproval(id int, admin string) (*model.ShopOrder, error) {
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if !s.NeedsSecondApproval(order) || order.SecondApprover != "" {
+		return order, nil
+	}
+	if admin == "" {
+		return nil, errors.New("approving admin is unknown")
+	}
+	if order.FirstApprover == admin {
+		return order, fmt.Errorf("%w, %s approved it already", ErrSecondApprovalRequired, admin)
+	}
+
+	now := time.Now()
+	db := database.GetShopDB().Model(&model.ShopOrder{})
+	if order.FirstApprover == "" {
+		result := db.Where("id = ? AND first_approver = ''", id).
+			Updates(map[string]any{"first_approver": admin, "first_approved_at": now, "updated_at": now})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			// Another admin approved it meanwhile.
+			return s.RecordApproval(id, admin)
+		}
+		order.FirstApprover, order.FirstApprovedAt = admin, now
+		return order, ErrSecondApprovalRequired
+	}
+	result := db.Where("id = ? AND second_approver = '' AND first_approver <> ?", id, admin).
+		Updates(map[string]any{"second_approver": admin, "second_approved_at": now, "updated_at": now})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Another admin gave the second approval meanwhile.
+		return s.RecordApproval(id, admin)
+	}
+	order.SecondApprover, order.SecondApprovedAt = admin, now
+	return order, nil
+}
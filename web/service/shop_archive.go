@@ -0,0 +1,144 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"gorm.io/gorm"
+)
+
+const shopArchiveBatchSize = 200
+
+// ArchiveOrders moves orders that have been closed for longer than the
+// configured number of days from shop_orders to shop_orders_archive. Rejected
+// and abandoned orders qualify on age alone; approved orders stay while their
+// subscription is open or one of their clients still exists and has not been
+// expired for that long. Orders hosted on remote nodes are only archived when
+// rejected or abandoned, since their clients cannot be checked here. It returns
+// the number of orders archived.
+func (s *ShopService) ArchiveOrders() (int, error) {
+	days, err := s.settingService.GetShopOrderArchiveDays()
+	if err != nil || days <= 0 {
+		return 0, err
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	db := database.GetShopDB()
+
+	var candidates []model.ShopOrder
+	err = db.Where("status IN ? AND updated_at < ?",
+		[]string{OrderStatusApproved, OrderStatusRejected, OrderStatusPendingReceipt}, cutoff).
+		Order("id asc").Find(&candidates).Error
+	if err != nil {
+		return 0, err
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	var openOrders []int
+	err = db.Model(&model.ShopSubscription{}).Where("status <> ?", SubscriptionStatusCancelled).Pluck("order_id", &openOrders).Error
+	if err != nil {
+		return 0, err
+	}
+	var upgrading []int
+	err = db.Model(&model.ShopOrder{}).Where("upgrade_from_order_id <> 0 AND status IN ?",
+		[]string{OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusOnHold, OrderStatusScheduled, OrderStatusProvisioning}).Pluck("upgrade_from_order_id", &upgrading).Error
+	if err != nil {
+		return 0, err
+	}
+	keep := make(map[int]bool, len(openOrders)+len(upgrading))
+	for _, id := range append(openOrders, upgrading...) {
+		keep[id] = true
+	}
+
+	var ids []int
+	for _, order := range candidates {
+		if keep[order.Id] {
+			continue
+		}
+		if order.Status == OrderStatusApproved {
+			if order.NodeId != 0 {
+				continue
+			}
+			live, err := hasLiveClient(orderClientEmails(order), cutoff)
+			if err != nil {
+				return 0, err
+			}
+			if live {
+				continue
+			}
+		}
+		ids = append(ids, order.Id)
+	}
+
+	archived := 0
+	for start := 0; start < len(ids); start += shopArchiveBatchSize {
+		batch := ids[start:min(start+shopArchiveBatchSize, len(ids))]
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var orders []model.ShopOrder
+			if err := tx.Where("id IN ?", batch).Find(&orders).Error; err != nil {
+				return err
+			}
+			now := time.Now()
+			rows := make([]model.ShopOrderArchive, len(orders))
+			for i, order := range orders {
+				rows[i] = model.ShopOrderArchive{ShopOrder: order, ArchivedAt: now}
+			}
+			if err := tx.Create(&rows).Error; err != nil {
+				return err
+			}
+			return tx.Where("id IN ?", batch).Delete(&model.ShopOrder{}).Error
+		})
+		if err != nil {
+			return archived, err
+		}
+		archived += len(batch)
+	}
+	return archived, nil
+}
+
+// ListArchivedOrders returns the archived orders created in [from, to), newest
+// first. A zero bound leaves that side open.
+func (s *ShopService) ListArchivedOrders(from, to time.Time) ([]model.ShopOrderArchive, error) {
+	db := database.GetShopDB()
+	if !from.IsZero() {
+		db = db.Where("created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		db = db.Where("created_at < ?", to)
+	}
+	orders := []model.ShopOrderArchive{}
+	err := db.Order("id desc").Find(&orders).Error
+	return orders, err
+}
+
+// orderClientEmails returns the emails of every client an order created.
+func orderClientEmails(order model.ShopOrder) []string {
+	var emails []string
+	if order.ClientEmail != "" {
+		emails = append(emails, order.ClientEmail)
+	}
+	for _, email := range strings.Split(order.ClientEmails, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// hasLiveClient reports whether any of the clients still exists on this panel
+// without having expired before cutoff.
+func hasLiveClient(emails []string, cutoff time.Time) (bool, error) {
+	if len(emails) == 0 {
+		return false, nil
+	}
+	var count int64
+	err := database.GetDB().Model(&xray.ClientTraffic{}).
+		Where("email IN ? AND (expiry_time <= 0 OR expiry_time >= ?)", emails, cutoff.UnixMilli()).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,357 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/database"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Shop backups are a zip archive of the shop tables and receipt images,
+// encrypted with AES-256-GCM under a key derived from the backup passphrase:
+//
+//	magic | scrypt salt (16) | GCM nonce (12) | ciphertext
+const shopBackupMagic = "XUISHOP1"
+
+const (
+	shopBackupSaltSize = 16
+	shopBackupTables   = "tables/"
+	shopBackupReceipts = "receipts/"
+
+	// Bounds on the uncompressed content of a restored backup, so a small
+	// archive cannot expand without limit.
+	shopBackupMaxTableSize   = 256 << 20
+	shopBackupMaxReceiptSize = 20 << 20 // Largest file a Telegram bot can download
+	shopBackupMaxSize        = 2 << 30
+)
+
+// shopReceiptTables are the backed up tables whose rows reference a receipt.
+var shopReceiptTables = []string{"shop_orders", "shop_orders_archive"}
+
+// ErrShopBackupPassword is returned when a backup cannot be decrypted.
+var ErrShopBackupPassword = errors.New("wrong backup password or corrupted backup")
+
+// shopBackupManifest describes the content of a shop backup.
+type shopBackupManifest struct {
+	Version   string         `json:"version"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Rows      map[string]int `json:"rows"`
+}
+
+// ShopRestoreResult summarizes a restored backup.
+type ShopRestoreResult struct {
+	CreatedAt time.Time      `json:"createdAt"`
+	Rows      map[string]int `json:"rows"`
+	Receipts  int            `json:"receipts"`
+}
+
+// BackupFileName returns the download name of a backup taken now.
+func (s *ShopService) BackupFileName() string {
+	return fmt.Sprintf("x-ui-shop-%s.xuishop", time.Now().Format("20060102-150405"))
+}
+
+// Backup archives every shop table together with the order receipts and
+// encrypts the archive. An empty password falls back to the shopBackupPassword
+// setting, then to the panel secret.
+func (s *ShopService) Backup(password string) ([]byte, error) {
+	key, err := s.backupPassphrase(password)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := database.DumpShopTables()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	manifest := shopBackupManifest{Version: config.GetVersion(), CreatedAt: time.Now(), Rows: map[string]int{}}
+	for table, data := range tables {
+		var rows []json.RawMessage
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, err
+		}
+		manifest.Rows[table] = len(rows)
+		if err := writeZipFile(zw, shopBackupTables+table+".json", data); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, table := range shopReceiptTables {
+		paths, err := backupReceiptPaths(tables[table])
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			data, err := ReadReceipt(path)
+			if err != nil {
+				// Receipts removed from disk are simply left out.
+				continue
+			}
+			if err := writeZipFile(zw, shopBackupReceipts+filepath.Base(path), data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeZipFile(zw, "manifest.json", manifestData); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return encryptShopBackup(buf.Bytes(), key)
+}
+
+// Restore replaces the shop tables with the content of a backup and writes its
+// receipts back to disk.
+func (s *ShopService) Restore(data []byte, password string) (*ShopRestoreResult, error) {
+	key, err := s.backupPassphrase(password)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptShopBackup(data, key)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest shopBackupManifest
+	tables := map[string]json.RawMessage{}
+	receipts := map[string][]byte{}
+	var size int64
+	for _, f := range zr.File {
+		limit := int64(shopBackupMaxTableSize)
+		if strings.HasPrefix(f.Name, shopBackupReceipts) {
+			limit = shopBackupMaxReceiptSize
+		}
+		content, err := readZipFile(f, limit)
+		if err != nil {
+			return nil, err
+		}
+		if size += int64(len(content)); size > shopBackupMaxSize {
+			return nil, errors.New("backup content is too large")
+		}
+		switch {
+		case f.Name == "manifest.json":
+			if err := json.Unmarshal(content, &manifest); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(f.Name, shopBackupTables):
+			tables[strings.TrimSuffix(strings.TrimPrefix(f.Name, shopBackupTables), ".json")] = content
+		case strings.HasPrefix(f.Name, shopBackupReceipts):
+			name := filepath.Base(f.Name)
+			if name != "." && name != ".." && name != "/" {
+				receipts[name] = content
+			}
+		}
+	}
+	if manifest.Rows == nil {
+		return nil, errors.New("not a shop backup")
+	}
+
+	// Receipts are stored by file name; point the orders at this panel's folder.
+	for _, table := range shopReceiptTables {
+		if data, ok := tables[table]; ok {
+			if tables[table], err = relocateReceipts(data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Receipts are staged beside the receipt folder and moved into it only
+	// once the tables are restored, so a failed restore leaves them untouched.
+	staging := ""
+	if len(receipts) > 0 {
+		if err := os.MkdirAll(ShopReceiptDir, 0o755); err != nil {
+			return nil, err
+		}
+		if staging, err = os.MkdirTemp(ShopReceiptDir, ".restore-*"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(staging)
+	}
+	for name, content := range receipts {
+		if err := WriteReceipt(filepath.Join(staging, name), content); err != nil {
+			return nil, err
+		}
+	}
+	if err := database.RestoreShopTables(tables); err != nil {
+		return nil, err
+	}
+	for name := range receipts {
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(ShopReceiptDir, name)); err != nil {
+			return nil, err
+		}
+	}
+	return &ShopRestoreResult{CreatedAt: manifest.CreatedAt, Rows: manifest.Rows, Receipts: len(receipts)}, nil
+}
+
+// shopReceiptColumns are the keys of a backed up order's receipt path: the
+// column name, and the JSON name older backups used.
+var shopReceiptColumns = []string{"receipt_path", "receiptPath"}
+
+// backupReceiptPaths returns the receipt paths of a backed up order table.
+func backupReceiptPaths(data json.RawMessage) ([]string, error) {
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, row := range rows {
+		for _, column := range shopReceiptColumns {
+			var path string
+			if raw, ok := row[column]; ok && json.Unmarshal(raw, &path) == nil && path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// relocateReceipts points the receipt paths of the backed up rows at this panel's receipt folder.
+func relocateReceipts(data json.RawMessage) (json.RawMessage, error) {
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for _, column := range shopReceiptColumns {
+			var path string
+			if raw, ok := row[column]; !ok || json.Unmarshal(raw, &path) != nil || path == "" {
+				continue
+			}
+			relocated, err := json.Marshal(filepath.Join(ShopReceiptDir, filepath.Base(path)))
+			if err != nil {
+				return nil, err
+			}
+			row[column] = relocated
+		}
+	}
+	return json.Marshal(rows)
+}
+
+func (s *ShopService) backupPassphrase(password string) ([]byte, error) {
+	if password != "" {
+		return []byte(password), nil
+	}
+	if saved, err := s.settingService.GetShopBackupPassword(); err == nil && saved != "" {
+		return []byte(saved), nil
+	}
+	return s.settingService.GetSecret()
+}
+
+func shopBackupKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+}
+
+func encryptShopBackup(plain, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, shopBackupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := shopBackupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(shopBackupMagic)+len(salt)+len(nonce)+len(plain)+gcm.Overhead())
+	out = append(out, shopBackupMagic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain, []byte(shopBackupMagic)), nil
+}
+
+func decryptShopBackup(data, passphrase []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(shopBackupMagic)) {
+		return nil, errors.New("not a shop backup")
+	}
+	data = data[len(shopBackupMagic):]
+	if len(data) < shopBackupSaltSize {
+		return nil, ErrShopBackupPassword
+	}
+	salt, data := data[:shopBackupSaltSize], data[shopBackupSaltSize:]
+	key, err := shopBackupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrShopBackupPassword
+	}
+	nonce, data := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, data, []byte(shopBackupMagic))
+	if err != nil {
+		return nil, ErrShopBackupPassword
+	}
+	return plain, nil
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readZipFile reads an archive entry, refusing entries larger than limit once
+// uncompressed.
+func readZipFile(f *zip.File, limit int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(limit) {
+		return nil, fmt.Errorf("backup entry %s is too large", f.Name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("backup entry %s is too large", f.Name)
+	}
+	return data, nil
+}
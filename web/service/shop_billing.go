@@ -0,0 +1,258 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+const (
+	BillingCycleWeekly    = "weekly"
+	BillingCycleMonthly   = "monthly"
+	BillingCycleQuarterly = "quarterly"
+)
+
+const (
+	SubscriptionStatusActive    = "ACTIVE"
+	SubscriptionStatusSuspended = "SUSPENDED"
+	SubscriptionStatusCancelled = "CANCELLED"
+)
+
+// nextBillingDate returns the due date one billing cycle after from, counting
+// months in the time zone of from.
+func nextBillingDate(from time.Time, cycle string) time.Time {
+	switch cycle {
+	case BillingCycleWeekly:
+		return from.AddDate(0, 0, 7)
+	case BillingCycleQuarterly:
+		return from.AddDate(0, 3, 0)
+	default:
+		return from.AddDate(0, 1, 0)
+	}
+}
+
+func (s *ShopService) ListSubscriptions() ([]model.ShopSubscription, error) {
+	var subs []model.ShopSubscription
+	err := database.GetShopDB().Order("next_due_at asc").Find(&subs).Error
+	return subs, err
+}
+
+func (s *ShopService) ListSubscriptionsByTelegramId(tgId int64) ([]model.ShopSubscription, error) {
+	var subs []model.ShopSubscription
+	err := database.GetShopDB().Where("telegram_id = ? AND status <> ?", tgId, SubscriptionStatusCancelled).Order("next_due_at asc").Find(&subs).Error
+	return subs, err
+}
+
+func (s *ShopService) GetSubscription(id int) (*model.ShopSubscription, error) {
+	sub := &model.ShopSubscription{}
+	if err := database.GetShopDB().First(sub, id).Error; err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *ShopService) CancelSubscription(id int) error {
+	sub, err := s.GetSubscription(id)
+	if err != nil {
+		return err
+	}
+	err = database.GetShopDB().Model(&model.ShopSubscription{}).Where("id = ?", id).Updates(map[string]any{
+		"status":     SubscriptionStatusCancelled,
+		"updated_at": time.Now(),
+	}).Error
+	if err != nil {
+		return err
+	}
+	s.refreshCustomerStats(sub.TelegramId)
+	return nil
+}
+
+// newSubscription returns the billing cycle to open for a newly provisioned order
+// of a recurring package, or nil when the order is not billed periodically.
+// Only local clients can be suspended, so orders on remote nodes are not tracked.
+func (s *ShopService) newSubscription(order *model.ShopOrder) (*model.ShopSubscription, error) {
+	if order.SubscriptionId > 0 || order.PackageId == nil || order.NodeId > 0 {
+		return nil, nil
+	}
+	pkg, err := s.GetPackage(*order.PackageId)
+	if err != nil || pkg.BillingCycle == "" {
+		return nil, err
+	}
+	now := time.Now()
+	return &model.ShopSubscription{
+		TelegramId: order.TelegramId,
+		PackageId:  pkg.Id,
+		OrderId:    order.Id,
+		Status:     SubscriptionStatusActive,
+		NextDueAt:  nextBillingDate(now.In(s.Location()), pkg.BillingCycle),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// RenewSubscription applies a paid renewal order: the subscription's clients get
+// their traffic reset and are re-enabled, and the due date moves one cycle ahead.
+// A renewal for a scheduled downgrade moves the subscription to its package and
+// sets the clients' traffic limit from it.
+func (s *ShopService) RenewSubscription(order *model.ShopOrder) (bool, error) {
+	sub, err := s.GetSubscription(order.SubscriptionId)
+	if err != nil {
+		return false, err
+	}
+	if sub.Status == SubscriptionStatusCancelled {
+		return false, errors.New("subscription is cancelled")
+	}
+	origin, err := s.GetOrder(sub.OrderId)
+	if err != nil {
+		return false, err
+	}
+	pkgId := sub.PackageId
+	if order.PackageId != nil {
+		pkgId = *order.PackageId
+	}
+	pkg, err := s.GetPackage(pkgId)
+	if err != nil {
+		return false, err
+	}
+
+	needRestart := false
+	for _, email := range s.OrderClientEmails(origin) {
+		if err := s.inboundService.ResetClientTrafficByEmail(email); err != nil {
+			return needRestart, err
+		}
+		if pkg.Id != sub.PackageId {
+			restart, err := s.inboundService.ResetClientTrafficLimitByEmail(email, pkg.DataGB)
+			needRestart = needRestart || restart
+			if err != nil {
+				return needRestart, err
+			}
+		}
+		_, restart, err := s.inboundService.SetClientEnableByEmail(email, true)
+		if err != nil {
+			return needRestart, err
+		}
+		needRestart = needRestart || restart
+	}
+
+	nextDue := nextBillingDate(sub.NextDueAt.In(s.Location()), pkg.BillingCycle)
+	for !nextDue.After(time.Now()) {
+		nextDue = nextBillingDate(nextDue, pkg.BillingCycle)
+	}
+	updates := map[string]any{
+		"status":           SubscriptionStatusActive,
+		"package_id":       pkg.Id,
+		"next_due_at":      nextDue,
+		"renewal_order_id": 0,
+		"updated_at":       time.Now(),
+	}
+	if sub.NextPackageId == pkg.Id {
+		updates["next_package_id"] = 0
+	}
+	err = database.GetShopDB().Model(&model.ShopSubscription{}).Where("id = ?", sub.Id).Updates(updates).Error
+
+	order.InboundId = origin.InboundId
+	order.ClientEmail = origin.ClientEmail
+	order.ClientId = origin.ClientId
+	order.ClientSubId = origin.ClientSubId
+	return needRestart, err
+}
+
+// ProcessBillingCycles opens renewal orders for subscriptions that are due and
+// suspends the clients of subscriptions whose renewal is unpaid past the grace period.
+// It returns the renewal orders it created so customers can be notified.
+func (s *ShopService) ProcessBillingCycles() ([]*model.ShopOrder, bool, error) {
+	db := database.GetShopDB()
+	var subs []model.ShopSubscription
+	err := db.Where("status IN ? AND next_due_at <= ?",
+		[]string{SubscriptionStatusActive, SubscriptionStatusSuspended}, time.Now()).Find(&subs).Error
+	if err != nil {
+		return nil, false, err
+	}
+	graceDays, _ := s.settingService.GetShopRenewalGraceDays()
+
+	var created []*model.ShopOrder
+	needRestart := false
+	for i := range subs {
+		sub := &subs[i]
+		if sub.RenewalOrderId > 0 {
+			if renewal, err := s.GetOrder(sub.RenewalOrderId); err != nil || renewal.Status == OrderStatusRejected {
+				sub.RenewalOrderId = 0
+			}
+		}
+		if sub.RenewalOrderId == 0 {
+			order, err := s.createRenewalOrder(sub)
+			if err != nil {
+				logger.WithFields(logger.Fields{logger.FieldOrderId: sub.OrderId, "subscription_id": sub.Id, "error": err}).Warning("shop renewal order failed")
+				continue
+			}
+			created = append(created, order)
+		}
+
+		if sub.Status != SubscriptionStatusActive || time.Now().Before(sub.NextDueAt.AddDate(0, 0, graceDays)) {
+			continue
+		}
+		origin, err := s.GetOrder(sub.OrderId)
+		if err != nil {
+			continue
+		}
+		for _, email := range s.OrderClientEmails(origin) {
+			_, restart, err := s.inboundService.SetClientEnableByEmail(email, false)
+			if err != nil {
+				logger.WithFields(logger.Fields{logger.FieldOrderId: sub.OrderId, "client": email, "error": err}).Warning("shop failed to suspend client")
+				continue
+			}
+			needRestart = needRestart || restart
+		}
+		err = db.Model(&model.ShopSubscription{}).Where("id = ?", sub.Id).Updates(map[string]any{
+			"status":     SubscriptionStatusSuspended,
+			"updated_at": time.Now(),
+		}).Error
+		if err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: sub.OrderId, "subscription_id": sub.Id, "error": err}).Warning("shop failed to suspend subscription")
+			continue
+		}
+		s.refreshCustomerStats(sub.TelegramId)
+	}
+	return created, needRestart, nil
+}
+
+// createRenewalOrder opens the order a customer pays to extend a subscription,
+// for the package of a scheduled downgrade if there is one. Renewals bypass
+// maintenance mode since they only extend existing clients.
+func (s *ShopService) createRenewalOrder(sub *model.ShopSubscription) (*model.ShopOrder, error) {
+	pkg, err := s.renewalPackage(sub)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := s.GetOrder(sub.OrderId)
+	if err != nil {
+		return nil, err
+	}
+	order := &model.ShopOrder{
+		TelegramId:     sub.TelegramId,
+		Phone:          origin.Phone,
+		InboundId:      origin.InboundId,
+		PackageId:      &pkg.Id,
+		Price:          pkg.Price,
+		Status:         OrderStatusPendingReceipt,
+		ClientEmail:    origin.ClientEmail,
+		SubscriptionId: sub.Id,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+	db := database.GetShopDB()
+	if err := s.assignOrderNumber(db, order); err != nil {
+		return nil, err
+	}
+	if err := db.Create(order).Error; err != nil {
+		return nil, err
+	}
+	sub.RenewalOrderId = order.Id
+	return order, db.Model(&model.ShopSubscription{}).Where("id = ?", sub.Id).Updates(map[string]any{
+		"renewal_order_id": order.Id,
+		"updated_at":       time.Now(),
+	}).Error
+}
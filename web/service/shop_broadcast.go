@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// Broadcast segments select which customers receive an announcement.
+const (
+	BroadcastSegmentAll     = "all"
+	BroadcastSegmentActive  = "active"
+	BroadcastSegmentExpired = "expired"
+	BroadcastSegmentPending = "pending"
+)
+
+// Broadcast statuses.
+const (
+	BroadcastStatusRunning = "running"
+	BroadcastStatusDone    = "done"
+)
+
+// BroadcastRecipients returns the Telegram IDs of the customers in a segment.
+// Active customers have an approved order whose client is enabled and not
+// expired, or an active subscription; expired customers bought before but have
+// neither. A "segment:<id>" segment targets the customers of a saved segment.
+func (s *ShopService) BroadcastRecipients(segment string) ([]int64, error) {
+	db := database.GetShopDB()
+	var ids []int64
+	switch segment {
+	case BroadcastSegmentAll, "":
+		var customers []int64
+		if err := db.Model(&model.ShopOrder{}).Where("telegram_id <> 0").Distinct().Pluck("telegram_id", &ids).Error; err != nil {
+			return nil, err
+		}
+		if err := db.Model(&model.ShopCustomer{}).Pluck("telegram_id", &customers).Error; err != nil {
+			return nil, err
+		}
+		ids = append(ids, customers...)
+	case BroadcastSegmentActive:
+		return s.activeCustomers()
+	case BroadcastSegmentExpired:
+		active, err := s.activeCustomers()
+		if err != nil {
+			return nil, err
+		}
+		var buyers []int64
+		if err := db.Model(&model.ShopOrder{}).Where("status = ? AND telegram_id <> 0", OrderStatusApproved).Distinct().Pluck("telegram_id", &buyers).Error; err != nil {
+			return nil, err
+		}
+		for _, id := range buyers {
+			if !slices.Contains(active, id) {
+				ids = append(ids, id)
+			}
+		}
+	case BroadcastSegmentPending:
+		if err := db.Model(&model.ShopOrder{}).
+			Where("status IN ? AND telegram_id <> 0", []string{OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusOnHold}).
+			Distinct().Pluck("telegram_id", &ids).Error; err != nil {
+			return nil, err
+		}
+	default:
+		id, err := strconv.Atoi(strings.TrimPrefix(segment, shopSegmentPrefix))
+		if !strings.HasPrefix(segment, shopSegmentPrefix) || err != nil {
+			return nil, errors.New("unknown broadcast segment")
+		}
+		if ids, err = s.segmentRecipients(id); err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// activeCustomers returns the customers with an enabled, unexpired client or an
+// active subscription. Orders and client traffics may live in different
+// databases, so they are matched here rather than joined.
+func (s *ShopService) activeCustomers() ([]int64, error) {
+	db := database.GetShopDB()
+	var orders []model.ShopOrder
+	err := db.Select("telegram_id", "client_email").
+		Where("status = ? AND telegram_id <> 0 AND client_email <> ''", OrderStatusApproved).
+		Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]int64, len(orders))
+	emails := make([]string, 0, len(orders))
+	for _, order := range orders {
+		owners[order.ClientEmail] = order.TelegramId
+		emails = append(emails, order.ClientEmail)
+	}
+	var active []string
+	for chunk := range slices.Chunk(emails, 500) {
+		var found []string
+		err := database.GetDB().Model(&xray.ClientTraffic{}).
+			Where("email IN ?", chunk).
+			Where("enable = ? AND (expiry_time <= 0 OR expiry_time > ?)", true, time.Now().UnixMilli()).
+			Pluck("email", &found).Error
+		if err != nil {
+			return nil, err
+		}
+		active = append(active, found...)
+	}
+	var ids, subscribers []int64
+	for _, email := range active {
+		ids = append(ids, owners[email])
+	}
+	if err := db.Model(&model.ShopSubscription{}).Where("status = ?", SubscriptionStatusActive).Distinct().Pluck("telegram_id", &subscribers).Error; err != nil {
+		return nil, err
+	}
+	ids = append(ids, subscribers...)
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+func (s *ShopService) CreateBroadcast(segment, message string, recipients int) (*model.ShopBroadcast, error) {
+	broadcast := &model.ShopBroadcast{
+		Segment:    segment,
+		Message:    message,
+		Recipients: recipients,
+		Status:     BroadcastStatusRunning,
+		CreatedAt:  time.Now(),
+	}
+	if err := database.GetShopDB().Create(broadcast).Error; err != nil {
+		return nil, err
+	}
+	return broadcast, nil
+}
+
+// FinishBroadcast stores the delivery counts of a completed broadcast.
+func (s *ShopService) FinishBroadcast(broadcast *model.ShopBroadcast) error {
+	broadcast.Status = BroadcastStatusDone
+	broadcast.FinishedAt = time.Now()
+	return database.GetShopDB().Model(&model.ShopBroadcast{}).Where("id = ?", broadcast.Id).Updates(map[string]any{
+		"sent":        broadcast.Sent,
+		"failed":      broadcast.Failed,
+		"status":      broadcast.Status,
+		"finished_at": broadcast.FinishedAt,
+	}).Error
+}
+
+func (s *ShopService) ListBroadcasts(limit int) ([]model.ShopBroadcast, error) {
+	var broadcasts []model.ShopBroadcast
+	err := database.GetShopDB().Order("id desc").Limit(limit).Find(&broadcasts).Error
+	return broadcasts, err
+}
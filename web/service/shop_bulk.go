@@ -0,0 +1,120 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// shopBulkMaxSeats caps the clients of one bulk order.
+const shopBulkMaxSeats = 500
+
+// CreateBulkOrder creates an order provisioning order.Seats clients at once, such
+// as a company buying seats for its staff. Bulk orders are placed by admins, who
+// take the payment themselves, so they skip the receipt and go straight to review.
+// A zero price is the package or custom price times the seats.
+func (s *ShopService) CreateBulkOrder(order *model.ShopOrder) error {
+	v := &shopValidator{}
+	v.between("seats", order.Seats, 2, shopBulkMaxSeats)
+	v.positive("inboundId", int64(order.InboundId))
+	v.nonNegative("price", order.Price)
+	unitPrice := int64(0)
+	if order.PackageId != nil {
+		order.CustomDataGB, order.CustomDays = 0, 0
+		pkg, err := s.GetPackage(*order.PackageId)
+		switch {
+		case err != nil || !pkg.IsActive || pkg.IsArchived:
+			v.add("packageId", "shop.invalid.choice")
+		case pkg.Type != PackageTypeStandard || pkg.BillingCycle != "":
+			v.add("packageId", "shop.invalid.bulkPackage")
+		default:
+			unitPrice = pkg.Price
+		}
+	} else {
+		v.positive("customDataGb", int64(order.CustomDataGB))
+		v.positive("customDays", int64(order.CustomDays))
+		if order.CustomDataGB > 0 {
+			var err error
+			if unitPrice, err = s.CalculateCustomPrice(order.CustomDataGB); errors.Is(err, ErrPriceOverflow) {
+				v.add("customDataGb", "shop.invalid.priceRange")
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	if order.Price == 0 {
+		price, err := mulPrice(unitPrice, int64(order.Seats))
+		if err != nil {
+			v.add("seats", "shop.invalid.priceRange")
+			return v.err()
+		}
+		order.Price = price
+	}
+
+	order.Status = OrderStatusPendingReview
+	order.CreatedAt = time.Now()
+	order.UpdatedAt = time.Now()
+	db := database.GetShopDB()
+	if err := s.assignOrderNumber(db, order); err != nil {
+		return err
+	}
+	if err := db.Create(order).Error; err != nil {
+		return err
+	}
+	countOrderEvent(OrderEventCreated)
+	return nil
+}
+
+// ListOrderClients returns the clients provisioned for an order. Orders from
+// before clients were recorded list the client kept on the order itself.
+func (s *ShopService) ListOrderClients(order *model.ShopOrder) ([]model.ShopOrderClient, error) {
+	clients := []model.ShopOrderClient{}
+	if err := database.GetShopDB().Where("order_id = ?", order.Id).Order("id asc").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	if len(clients) > 0 {
+		return clients, nil
+	}
+	for i, email := range s.OrderClientEmails(order) {
+		client := model.ShopOrderClient{OrderId: order.Id, Email: email}
+		if i == 0 {
+			client.ClientId = order.ClientId
+			client.SubId = order.ClientSubId
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// ShopClientLink is a client of an order with its subscription URL.
+type ShopClientLink struct {
+	Email string `json:"email"`
+	SubId string `json:"subId"`
+	Url   string `json:"url"`
+}
+
+// ShopClientLinksCSV renders the clients of an order as a CSV file for the
+// customer to hand out.
+func ShopClientLinksCSV(links []ShopClientLink) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"email", "sub_id", "subscription_url"})
+	for _, link := range links {
+		w.Write([]string{link.Email, link.SubId, link.Url})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// ShopClientLinksFileName returns the download name of an order's client list.
+func ShopClientLinksFileName(orderId int) string {
+	return fmt.Sprintf("order-%d-clients.csv", orderId)
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// shopCache keeps the result of an expensive listing in memory until it is
+// invalidated or its TTL runs out. The TTL bounds staleness from writes the
+// change hook cannot see: raw SQL, other panels sharing an external shop
+// database and remote nodes.
+type shopCache[T any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	value   []T
+	expires time.Time
+	gen     uint64
+}
+
+// get returns a copy of the cached value, loading it first when missing or expired.
+func (c *shopCache[T]) get(load func() ([]T, error)) ([]T, error) {
+	c.mu.Lock()
+	if c.value != nil && time.Now().Before(c.expires) {
+		value := slices.Clone(c.value)
+		c.mu.Unlock()
+		return value, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	// Loading runs unlocked so invalidation from a write in progress never waits on it.
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []T{}
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.value = value
+		c.expires = time.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	return slices.Clone(value), nil
+}
+
+func (c *shopCache[T]) invalidate() {
+	c.mu.Lock()
+	c.value = nil
+	c.gen++
+	c.mu.Unlock()
+}
+
+var (
+	shopPackageCache = &shopCache[model.ShopPackage]{ttl: time.Minute}
+	shopInboundCache = &shopCache[ShopInboundOption]{ttl: 30 * time.Second}
+)
+
+func init() {
+	database.OnTableChange(func(table string) {
+		switch table {
+		case "shop_packages":
+			shopPackageCache.invalidate()
+		case "inbounds", "shop_inbounds", "shop_nodes":
+			shopInboundCache.invalidate()
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Captcha providers selectable in the shop settings.
+const (
+	CaptchaProviderHCaptcha  = "hcaptcha"
+	CaptchaProviderTurnstile = "turnstile"
+)
+
+// shopCaptchaVerifyURLs are the siteverify endpoints of the captcha providers.
+// Both take the same form fields and answer with the same JSON.
+var shopCaptchaVerifyURLs = map[string]string{
+	CaptchaProviderHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	CaptchaProviderTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+var (
+	// ErrCaptchaRequired is returned when captcha is on and a request has no token.
+	ErrCaptchaRequired = errors.New("captcha required")
+	// ErrCaptchaFailed is returned when the provider rejects a captcha token.
+	ErrCaptchaFailed = errors.New("captcha verification failed")
+)
+
+// ShopCaptchaConfig is what a public page needs to render the captcha widget.
+// Provider is empty while captcha is off.
+type ShopCaptchaConfig struct {
+	Provider string `json:"provider"`
+	SiteKey  string `json:"siteKey"`
+}
+
+// CaptchaConfig returns the configured captcha provider and site key. Captcha
+// counts as off until a known provider and its secret key are both set.
+func (s *ShopService) CaptchaConfig() ShopCaptchaConfig {
+	provider, _ := s.settingService.GetShopCaptchaProvider()
+	secret, _ := s.settingService.GetShopCaptchaSecret()
+	if _, ok := shopCaptchaVerifyURLs[provider]; !ok || secret == "" {
+		return ShopCaptchaConfig{}
+	}
+	siteKey, _ := s.settingService.GetShopCaptchaSiteKey()
+	return ShopCaptchaConfig{Provider: provider, SiteKey: siteKey}
+}
+
+// VerifyCaptcha checks a captcha token solved by the client at remoteIP with
+// the configured provider. It accepts everything while captcha is off.
+func (s *ShopService) VerifyCaptcha(ctx context.Context, token, remoteIP string) error {
+	config := s.CaptchaConfig()
+	if config.Provider == "" {
+		return nil
+	}
+	if token == "" {
+		return ErrCaptchaRequired
+	}
+	secret, _ := s.settingService.GetShopCaptchaSecret()
+	form := url.Values{"secret": {secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	if config.SiteKey != "" {
+		form.Set("sitekey", config.SiteKey)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, shopCaptchaVerifyURLs[config.Provider], strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha provider returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", ErrCaptchaFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ShopCartMaxItems caps the packages of one cart checkout.
+const ShopCartMaxItems = 10
+
+// CartPackage returns a package that can go in a cart. Only active standard
+// one-time packages can: pooled, top-up and recurring packages stay single
+// package orders.
+func (s *ShopService) CartPackage(id int) (*model.ShopPackage, error) {
+	v := &shopValidator{}
+	pkg, err := s.GetPackage(id)
+	switch {
+	case err != nil || !pkg.IsActive || pkg.IsArchived:
+		v.add("packageId", "shop.invalid.choice")
+	case pkg.Type != PackageTypeStandard || pkg.BillingCycle != "":
+		v.add("packageId", "shop.invalid.cartPackage")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// CreateCartOrder creates one order buying every package in packageIds, paid
+// with a single receipt. The order's price is the sum of the package prices.
+func (s *ShopService) CreateCartOrder(order *model.ShopOrder, packageIds []int) error {
+	v := &shopValidator{}
+	v.between("items", len(packageIds), 1, ShopCartMaxItems)
+	if err := v.err(); err != nil {
+		return err
+	}
+	order.PackageId = nil
+	order.CustomDataGB, order.CustomDays = 0, 0
+	order.Items = nil
+	order.Price = 0
+	for _, id := range packageIds {
+		pkg, err := s.CartPackage(id)
+		if err != nil {
+			return err
+		}
+		if order.Price, err = addPrice(order.Price, pkg.Price); err != nil {
+			v.add("items", "shop.invalid.priceRange")
+			return v.err()
+		}
+		order.Items = append(order.Items, model.ShopOrderItem{PackageId: pkg.Id, Price: pkg.Price})
+	}
+	order.ItemCount = len(order.Items)
+	return s.CreateOrder(order)
+}
+
+// ListOrderItems returns the items of a cart order in the order they were added.
+func (s *ShopService) ListOrderItems(orderId int) ([]model.ShopOrderItem, error) {
+	items := []model.ShopOrderItem{}
+	err := database.GetShopDB().Where("order_id = ?", orderId).Order("id asc").Find(&items).Error
+	return items, err
+}
+
+// SetOrderItemProvisioned records the client created for a cart item.
+func (s *ShopService) SetOrderItemProvisioned(item *model.ShopOrderItem) error {
+	item.ProvisionedAt = time.Now()
+	return database.GetShopDB().Model(&model.ShopOrderItem{}).Where("id = ?", item.Id).Updates(map[string]any{
+		"node_id":        item.NodeId,
+		"inbound_id":     item.InboundId,
+		"client_email":   item.ClientEmail,
+		"client_id":      item.ClientId,
+		"client_sub_id":  item.ClientSubId,
+		"provisioned_at": item.ProvisionedAt,
+	}).Error
+}
+
+// OrderItemNames returns the package names of a cart order's items, numbered
+// when a package was bought more than once.
+func (s *ShopService) OrderItemNames(orderId int) ([]string, error) {
+	items, err := s.ListOrderItems(orderId)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(items))
+	seen := map[int]int{}
+	for i, item := range items {
+		names[i] = "#" + strconv.Itoa(item.PackageId)
+		if pkg, err := s.GetPackage(item.PackageId); err == nil {
+			names[i] = pkg.Name
+		}
+		if seen[item.PackageId]++; seen[item.PackageId] > 1 {
+			names[i] += " " + strconv.Itoa(seen[item.PackageId])
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Formats a package catalog is exported in.
+const (
+	CatalogFormatJSON = "json"
+	CatalogFormatYAML = "yaml"
+)
+
+// How a catalog import treats a package named like an existing one.
+const (
+	CatalogConflictSkip      = "skip"      // Keep the existing package
+	CatalogConflictOverwrite = "overwrite" // Replace the existing package's details
+	CatalogConflictDuplicate = "duplicate" // Add the imported package next to it
+)
+
+// ShopCatalog is the package catalog as exported to keep several panels in
+// sync. Packages refer to their category by name, as IDs differ between panels.
+type ShopCatalog struct {
+	Currency   string               `json:"currency"` // Prices are in minor units of this currency
+	Categories []string             `json:"categories"`
+	Packages   []ShopCatalogPackage `json:"packages"`
+}
+
+// ShopCatalogPackage is a package of an exported catalog.
+type ShopCatalogPackage struct {
+	Name           string `json:"name"`
+	Category       string `json:"category,omitempty"`
+	DataGB         int    `json:"dataGb"`
+	DurationDays   int    `json:"durationDays"`
+	Price          int64  `json:"price"`
+	Type           string `json:"type,omitempty"`
+	Devices        int    `json:"devices,omitempty"`
+	BillingCycle   string `json:"billingCycle,omitempty"`
+	IsActive       bool   `json:"isActive"`
+	Description    string `json:"description,omitempty"`
+	ImageUrl       string `json:"imageUrl,omitempty"`
+	InboundTag     string `json:"inboundTag,omitempty"`
+	PaymentMethods string `json:"paymentMethods,omitempty"`
+}
+
+// ShopCatalogImportResult summarizes a package catalog import.
+type ShopCatalogImportResult struct {
+	Created    int      `json:"created"`
+	Updated    int      `json:"updated"`
+	Skipped    int      `json:"skipped"`
+	Categories int      `json:"categories"` // Categories created for the imported packages
+	Errors     []string `json:"errors"`
+}
+
+// ExportCatalog returns the packages that are not archived, in display order,
+// with their categories, encoded in format.
+func (s *ShopService) ExportCatalog(format string) ([]byte, error) {
+	if format != CatalogFormatJSON && format != CatalogFormatYAML {
+		return nil, fmt.Errorf("unknown catalog format %q", format)
+	}
+	categories, err := s.ListCategories()
+	if err != nil {
+		return nil, err
+	}
+	packages, err := s.ListPackages(ShopPackageFilter{})
+	if err != nil {
+		return nil, err
+	}
+	names := map[int]string{}
+	catalog := &ShopCatalog{Currency: s.Currency().Code, Categories: []string{}, Packages: []ShopCatalogPackage{}}
+	for _, category := range categories {
+		names[category.Id] = category.Name
+		catalog.Categories = append(catalog.Categories, category.Name)
+	}
+	for _, pkg := range packages {
+		catalog.Packages = append(catalog.Packages, ShopCatalogPackage{
+			Name:           pkg.Name,
+			Category:       names[pkg.CategoryId],
+			DataGB:         pkg.DataGB,
+			DurationDays:   pkg.DurationDays,
+			Price:          pkg.Price,
+			Type:           pkg.Type,
+			Devices:        pkg.Devices,
+			BillingCycle:   pkg.BillingCycle,
+			IsActive:       pkg.IsActive,
+			Description:    pkg.Description,
+			ImageUrl:       pkg.ImageUrl,
+			InboundTag:     pkg.InboundTag,
+			PaymentMethods: pkg.PaymentMethods,
+		})
+	}
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil || format == CatalogFormatJSON {
+		return data, err
+	}
+	return yaml.JSONToYAML(data)
+}
+
+// ImportCatalog adds the packages of an exported catalog, in JSON or YAML, and
+// creates the categories they name that are missing. A package named like an
+// existing one is skipped, overwrites it unless nothing changed, or is added
+// next to it as conflict says; duplicates get " copy" appended to their name,
+// as when duplicating a package. Packages that fail validation are reported
+// and the rest imported.
+func (s *ShopService) ImportCatalog(data []byte, conflict string) (*ShopCatalogImportResult, error) {
+	switch conflict {
+	case "":
+		conflict = CatalogConflictSkip
+	case CatalogConflictSkip, CatalogConflictOverwrite, CatalogConflictDuplicate:
+	default:
+		return nil, fmt.Errorf("unknown conflict resolution %q", conflict)
+	}
+	catalog, err := s.parseCatalog(data)
+	if err != nil {
+		return nil, err
+	}
+	return s.importCatalog(catalog, conflict)
+}
+
+// parseCatalog decodes a JSON or YAML catalog whose prices are in the shop
+// currency.
+func (s *ShopService) parseCatalog(data []byte) (*ShopCatalog, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] != '{' {
+		converted, err := yaml.YAMLToJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid catalog: %w", err)
+		}
+		data = converted
+	}
+	catalog := &ShopCatalog{}
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, fmt.Errorf("invalid catalog: %w", err)
+	}
+	if catalog.Currency != "" && catalog.Currency != s.Currency().Code {
+		return nil, fmt.Errorf("catalog prices are in %s, the shop uses %s", catalog.Currency, s.Currency().Code)
+	}
+	return catalog, nil
+}
+
+func (s *ShopService) importCatalog(catalog *ShopCatalog, conflict string) (*ShopCatalogImportResult, error) {
+	categories, err := s.ListCategories()
+	if err != nil {
+		return nil, err
+	}
+	categoryIds := map[string]int{}
+	for _, category := range categories {
+		categoryIds[strings.ToLower(category.Name)] = category.Id
+	}
+	packages, err := s.ListPackages(ShopPackageFilter{})
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]*model.ShopPackage{}
+	for i := range packages {
+		if _, ok := existing[strings.ToLower(packages[i].Name)]; !ok {
+			existing[strings.ToLower(packages[i].Name)] = &packages[i]
+		}
+	}
+
+	result := &ShopCatalogImportResult{Errors: []string{}}
+	categoryId := func(name string) (int, error) {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return 0, nil
+		}
+		if id, ok := categoryIds[strings.ToLower(name)]; ok {
+			return id, nil
+		}
+		category := &model.ShopCategory{Name: name}
+		if err := s.SaveCategory(category); err != nil {
+			return 0, err
+		}
+		categoryIds[strings.ToLower(name)] = category.Id
+		result.Categories++
+		return category.Id, nil
+	}
+	for _, name := range catalog.Categories {
+		if _, err := categoryId(name); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("category %q: %v", name, err))
+		}
+	}
+
+	for i, item := range catalog.Packages {
+		label := fmt.Sprintf("package %d %q", i+1, item.Name)
+		current := existing[strings.ToLower(strings.TrimSpace(item.Name))]
+		if current != nil && conflict == CatalogConflictSkip {
+			result.Skipped++
+			continue
+		}
+		catId, err := categoryId(item.Category)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: category %q: %v", label, item.Category, err))
+			continue
+		}
+		pkg := &model.ShopPackage{
+			Name:           strings.TrimSpace(item.Name),
+			CategoryId:     catId,
+			DataGB:         item.DataGB,
+			DurationDays:   item.DurationDays,
+			Price:          item.Price,
+			Type:           item.Type,
+			Devices:        item.Devices,
+			BillingCycle:   item.BillingCycle,
+			IsActive:       item.IsActive,
+			Description:    item.Description,
+			ImageUrl:       item.ImageUrl,
+			InboundTag:     item.InboundTag,
+			PaymentMethods: item.PaymentMethods,
+		}
+		overwrite := current != nil && conflict == CatalogConflictOverwrite
+		if overwrite && sameCatalogPackage(current, pkg) {
+			result.Skipped++
+			continue
+		}
+		if overwrite {
+			pkg.Id, pkg.Version = current.Id, current.Version
+			err = s.UpdatePackage(pkg)
+		} else {
+			if current != nil {
+				pkg.Name += " copy"
+			}
+			err = s.CreatePackage(pkg)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", label, err))
+			continue
+		}
+		if overwrite {
+			result.Updated++
+			continue
+		}
+		result.Created++
+		if current == nil {
+			existing[strings.ToLower(pkg.Name)] = pkg
+		}
+	}
+	return result, nil
+}
+
+// sameCatalogPackage tells whether overwriting pkg with imported would change
+// nothing.
+func sameCatalogPackage(pkg, imported *model.ShopPackage) bool {
+	importedType := imported.Type
+	if importedType == "" {
+		importedType = PackageTypeStandard
+	}
+	return pkg.Name == imported.Name && pkg.CategoryId == imported.CategoryId &&
+		pkg.DataGB == imported.DataGB && pkg.DurationDays == imported.DurationDays && pkg.Price == imported.Price &&
+		pkg.Type == importedType && (pkg.Type != PackageTypePooled || pkg.Devices == imported.Devices) &&
+		pkg.BillingCycle == imported.BillingCycle && pkg.IsActive == imported.IsActive &&
+		pkg.Description == imported.Description && pkg.ImageUrl == imported.ImageUrl && pkg.InboundTag == imported.InboundTag &&
+		pkg.PaymentMethods == imported.PaymentMethods
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// shopChargebackStatuses are the statuses of orders that were paid, and whose
+// payment can therefore be reversed.
+var shopChargebackStatuses = []string{OrderStatusPendingReview, OrderStatusOnHold, OrderStatusScheduled, OrderStatusProvisioning, OrderStatusApproved}
+
+// ShopChargebackGateway is a payment gateway that notifies the shop when a
+// payment is reversed. Gateways registered with RegisterShopPaymentGateway may
+// implement it to have their chargebacks recorded on their own.
+type ShopChargebackGateway interface {
+	// VerifyChargeback checks the signature of a chargeback notification and
+	// returns the reversed payment, of which Reference is required.
+	VerifyChargeback(form url.Values) (*ShopGatewayPayment, string, error)
+}
+
+// ChargebackOrder marks a paid order as charged back: the order leaves the
+// revenue, its clients are disabled and its subscription is cancelled. A
+// reason is required. Clients on nodes are disabled first, and a node that
+// cannot be reached fails the chargeback, so it can be retried before anything
+// is recorded. It also reports whether Xray needs a restart.
+func (s *ShopService) ChargebackOrder(id int, reason string) (*model.ShopOrder, bool, error) {
+	reason = strings.TrimSpace(reason)
+	v := &shopValidator{}
+	v.text("reason", reason, true, shopValueMaxLength)
+	if err := v.err(); err != nil {
+		return nil, false, err
+	}
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if !slices.Contains(shopChargebackStatuses, order.Status) {
+		return nil, false, errors.New("order was not paid")
+	}
+	log := logger.WithFields(logger.Fields{logger.FieldOrderId: id})
+	db := database.GetShopDB()
+	// Cart items know where each of their clients lives; the other clients
+	// are on the order's own inbound.
+	var clients []model.ShopOrderItem
+	if err := db.Where("order_id = ? AND client_email <> ''", id).Find(&clients).Error; err != nil {
+		return nil, false, err
+	}
+	for _, email := range orderClientEmails(*order) {
+		if !slices.ContainsFunc(clients, func(item model.ShopOrderItem) bool { return item.ClientEmail == email }) {
+			clients = append(clients, model.ShopOrderItem{NodeId: order.NodeId, InboundId: order.InboundId, ClientEmail: email})
+		}
+	}
+	if err := s.disableNodeClients(clients); err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	result := db.Model(&model.ShopOrder{}).Where("id = ? AND status IN ?", id, shopChargebackStatuses).
+		Updates(map[string]any{
+			"status":            OrderStatusChargeback,
+			"chargeback_at":     now,
+			"chargeback_reason": reason,
+			"updated_at":        now,
+		})
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, false, errors.New("order was not paid")
+	}
+	order.Status, order.ChargebackAt, order.ChargebackReason = OrderStatusChargeback, now, reason
+	countOrderEvent(OrderEventChargeback)
+	publishOrderStatus(id, OrderStatusChargeback)
+
+	needRestart := false
+	for _, client := range clients {
+		if client.NodeId != 0 {
+			continue
+		}
+		_, restart, err := s.inboundService.SetClientEnableByEmail(client.ClientEmail, false)
+		if err != nil {
+			log.WithFields(logger.Fields{"client": client.ClientEmail, "error": err}).Warning("shop chargeback failed to disable client")
+			continue
+		}
+		needRestart = needRestart || restart
+	}
+	err = db.Model(&model.ShopSubscription{}).
+		Where("(order_id = ? OR id = ?) AND status <> ?", id, order.SubscriptionId, SubscriptionStatusCancelled).
+		Updates(map[string]any{"status": SubscriptionStatusCancelled, "updated_at": now}).Error
+	if err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("shop chargeback failed to cancel subscription")
+	}
+	s.refreshCustomerStats(order.TelegramId)
+	return order, needRestart, nil
+}
+
+// disableNodeClients disables the clients hosted on nodes through the nodes'
+// panels, returning the first node that could not do it.
+func (s *ShopService) disableNodeClients(clients []model.ShopOrderItem) error {
+	nodes := map[int]*model.ShopNode{}
+	for _, client := range clients {
+		if client.NodeId == 0 {
+			continue
+		}
+		node, ok := nodes[client.NodeId]
+		if !ok {
+			var err error
+			if node, err = s.shopNodeService.GetNode(client.NodeId); err != nil {
+				return fmt.Errorf("node %d of client %s: %w", client.NodeId, client.ClientEmail, err)
+			}
+			nodes[client.NodeId] = node
+		}
+		if err := s.shopNodeService.SetRemoteClientEnable(node, client.InboundId, client.ClientEmail, false); err != nil {
+			return fmt.Errorf("disable client %s on node %s: %w", client.ClientEmail, node.Name, err)
+		}
+	}
+	return nil
+}
+
+// GatewayChargeback verifies a chargeback notification of the named gateway
+// and returns the order whose payment it reversed, with the reason given. The
+// order is found by the payment reference the gateway confirmed it with.
+func (s *ShopService) GatewayChargeback(name string, form url.Values) (*model.ShopOrder, string, error) {
+	if name != s.PaymentGateway() {
+		return nil, "", fmt.Errorf("gateway %q is not enabled", name)
+	}
+	gateway, ok := getShopPaymentGateway(name).(ShopChargebackGateway)
+	if !ok {
+		return nil, "", fmt.Errorf("gateway %q does not report chargebacks", name)
+	}
+	payment, reason, err := gateway.VerifyChargeback(form)
+	if err != nil {
+		return nil, "", err
+	}
+	if payment.Reference == "" {
+		return nil, "", errors.New("chargeback without a payment reference")
+	}
+	references, err := shopFieldValues(name + ":" + payment.Reference)
+	if err != nil {
+		return nil, "", err
+	}
+	order := &model.ShopOrder{}
+	if err := database.GetShopDB().Where("ocr_reference IN ?", references).First(order).Error; err != nil {
+		return nil, "", err
+	}
+	if reason = strings.TrimSpace(reason); reason == "" {
+		label := ShopPaymentGatewayNames[name]
+		if label == "" {
+			label = name
+		}
+		reason = "Reported by " + label
+	}
+	return order, reason, nil
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// shopConfigBodyMaxLength bounds a config file template, which is sent as a
+// Telegram document.
+const shopConfigBodyMaxLength = 16 * 1024
+
+// shopConfigProtocols are the inbound protocols config files can be sent for.
+var shopConfigProtocols = []string{
+	string(model.VMESS), string(model.VLESS), string(model.Trojan),
+	string(model.Shadowsocks), string(model.WireGuard), string(model.HTTP), string(model.Mixed),
+}
+
+// ShopConfigFile is a config file rendered for one client of an order.
+type ShopConfigFile struct {
+	Name string
+	Data []byte
+}
+
+// ListConfigTemplates returns the config file templates by protocol.
+func (s *ShopService) ListConfigTemplates() ([]model.ShopConfigTemplate, error) {
+	templates := []model.ShopConfigTemplate{}
+	err := database.GetShopDB().Order("protocol asc, id asc").Find(&templates).Error
+	return templates, err
+}
+
+// SaveConfigTemplate creates or updates a config file template.
+func (s *ShopService) SaveConfigTemplate(tmpl *model.ShopConfigTemplate) error {
+	tmpl.Protocol = strings.ToLower(strings.TrimSpace(tmpl.Protocol))
+	tmpl.FileName = strings.TrimSpace(tmpl.FileName)
+	v := &shopValidator{}
+	if !slices.Contains(shopConfigProtocols, tmpl.Protocol) {
+		v.add("protocol", "shop.invalid.choice")
+	}
+	v.text("fileName", tmpl.FileName, true, shopNameMaxLength)
+	if strings.ContainsAny(tmpl.FileName, `/\`) {
+		v.add("fileName", "shop.invalid.fileName")
+	}
+	v.text("body", tmpl.Body, true, shopConfigBodyMaxLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	db := database.GetShopDB()
+	now := time.Now()
+	tmpl.UpdatedAt = now
+	if tmpl.Id == 0 {
+		tmpl.CreatedAt = now
+		return db.Create(tmpl).Error
+	}
+	return db.Model(&model.ShopConfigTemplate{}).Where("id = ?", tmpl.Id).
+		Select("protocol", "file_name", "body", "enabled", "updated_at").Updates(tmpl).Error
+}
+
+// DeleteConfigTemplate deletes a config file template.
+func (s *ShopService) DeleteConfigTemplate(id int) error {
+	return database.GetShopDB().Delete(&model.ShopConfigTemplate{}, id).Error
+}
+
+// ConfigTemplatesFor returns the enabled config file templates of a protocol.
+func (s *ShopService) ConfigTemplatesFor(protocol model.Protocol) ([]model.ShopConfigTemplate, error) {
+	templates := []model.ShopConfigTemplate{}
+	err := database.GetShopDB().Where("protocol = ? AND enabled = ?", string(protocol), true).Order("id asc").Find(&templates).Error
+	return templates, err
+}
+
+// ConfigFileVars returns the placeholders of a config file template for a
+// client of an inbound: email, subId, subUrl, host, remark, protocol, listen
+// and port, plus client.*, settings.* and stream.* for the scalar values of the
+// client, the inbound settings and the stream settings, nested keys joined by
+// dots as in stream.realitySettings.shortIds.
+func ConfigFileVars(inbound *model.Inbound, email, subURL string) map[string]string {
+	vars := map[string]string{
+		"email":    email,
+		"subUrl":   subURL,
+		"remark":   inbound.Remark,
+		"protocol": string(inbound.Protocol),
+		"listen":   inbound.Listen,
+		"port":     strconv.Itoa(inbound.Port),
+	}
+	if u, err := url.Parse(subURL); err == nil {
+		vars["host"] = u.Hostname()
+	}
+
+	var settings map[string]any
+	if json.Unmarshal([]byte(inbound.Settings), &settings) == nil {
+		clients, _ := settings["clients"].([]any)
+		for _, c := range clients {
+			if client, ok := c.(map[string]any); ok && client["email"] == email {
+				flattenConfigVars(vars, "client", client)
+				if subId, ok := client["subId"].(string); ok {
+					vars["subId"] = subId
+				}
+				break
+			}
+		}
+		delete(settings, "clients")
+		flattenConfigVars(vars, "settings", settings)
+	}
+	var stream map[string]any
+	if json.Unmarshal([]byte(inbound.StreamSettings), &stream) == nil {
+		flattenConfigVars(vars, "stream", stream)
+	}
+	return vars
+}
+
+// flattenConfigVars adds the scalars of a JSON object under prefix. Lists of
+// scalars are joined with commas; lists of objects are left out.
+func flattenConfigVars(vars map[string]string, prefix string, object map[string]any) {
+	for key, value := range object {
+		name := prefix + "." + key
+		switch value := value.(type) {
+		case map[string]any:
+			flattenConfigVars(vars, name, value)
+		case []any:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				text, ok := configVarText(item)
+				if !ok {
+					items = nil
+					break
+				}
+				items = append(items, text)
+			}
+			if items != nil {
+				vars[name] = strings.Join(items, ",")
+			}
+		default:
+			if text, ok := configVarText(value); ok {
+				vars[name] = text
+			}
+		}
+	}
+}
+
+func configVarText(value any) (string, bool) {
+	switch value := value.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+// RenderConfigFile fills a config file template. Unlike bot messages, values
+// are not escaped, and unknown placeholders are left as they are.
+func RenderConfigFile(tmpl *model.ShopConfigTemplate, vars map[string]string) ShopConfigFile {
+	pairs := make([]string, 0, len(vars)*2)
+	for name, value := range vars {
+		pairs = append(pairs, "{{"+name+"}}", value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, replacer.Replace(tmpl.FileName))
+	return ShopConfigFile{Name: name, Data: []byte(replacer.Replace(tmpl.Body))}
+}
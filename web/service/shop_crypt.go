@@ -0,0 +1,323 @@
+package service
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mhsanaei/3x-ui/v2/config"
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+const (
+	// shopFieldPrefix marks sealed values, so values written before the
+	// columns were encrypted are still read as they are.
+	shopFieldPrefix = "enc1:"
+	// shopFieldBatchSize bounds the rows EncryptShopFields seals at once.
+	shopFieldBatchSize = 500
+)
+
+// shopFields seals the database.SecretColumns, such as receipt file IDs and
+// payment references, so a leaked database file does not expose them.
+var shopFields = &shopFieldCipher{}
+
+func init() {
+	database.SetFieldCipher(shopFields)
+}
+
+// shopFieldCipher encrypts values with AES-256-GCM under the key file at
+// config.GetShopKeyPath(), which it creates on first use. The nonce is derived
+// from the value, so equal values seal alike and can still be looked up.
+type shopFieldCipher struct {
+	mu    sync.Mutex
+	path  string
+	aead  cipher.AEAD
+	nonce []byte // Key deriving the nonce of a value
+}
+
+// keys returns the cipher and nonce key of the current key file.
+func (c *shopFieldCipher) keys() (cipher.AEAD, []byte, error) {
+	path := config.GetShopKeyPath()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.aead != nil && c.path == path {
+		return c.aead, c.nonce, nil
+	}
+	master, err := loadShopKey(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, master)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("shop field encryption"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.path, c.aead, c.nonce = path, aead, derive("shop field nonce")
+	return c.aead, c.nonce, nil
+}
+
+// loadShopKey reads the hex-encoded 32-byte key at path, creating it when the
+// file does not exist. A missing key is not replaced while values or receipts
+// sealed with it are stored, as a new key could never open them.
+func loadShopKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if sealed, where := sealedShopData(); sealed {
+			err := fmt.Errorf("shop key file %s is missing while %s is encrypted with it; restore the key file", path, where)
+			logger.Error(err)
+			return nil, err
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			return loadShopKey(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := f.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("shop key file %s is not a hex-encoded 32-byte key", path)
+	}
+	return key, nil
+}
+
+// sealedShopData tells whether any value of the database.SecretColumns or any
+// receipt image is stored encrypted, and where.
+func sealedShopData() (bool, string) {
+	if db := database.GetShopDB(); db != nil {
+		for table, columns := range database.SecretColumns {
+			if !db.Migrator().HasTable(table) {
+				continue
+			}
+			for _, column := range columns {
+				var count int64
+				if err := db.Table(table).Where(column+" LIKE ?", shopFieldPrefix+"%").Count(&count).Error; err == nil && count > 0 {
+					return true, table + "." + column
+				}
+			}
+		}
+	}
+	entries, _ := os.ReadDir(ShopReceiptDir)
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isSealedReceipt(filepath.Join(ShopReceiptDir, entry.Name())) {
+			return true, "receipt " + entry.Name()
+		}
+	}
+	return false, ""
+}
+
+// Seal encrypts plain. Empty values are returned as they are; anything else is
+// sealed, even when it already looks sealed.
+func (c *shopFieldCipher) Seal(plain string) (string, error) {
+	if plain == "" {
+		return plain, nil
+	}
+	aead, nonceKey, err := c.keys()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write([]byte(plain))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	sealed := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return shopFieldPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed by Seal. Values never sealed are returned as
+// they are.
+func (c *shopFieldCipher) Open(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, shopFieldPrefix)
+	if !ok {
+		return value, nil
+	}
+	aead, _, err := c.keys()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%w: malformed shop field", database.ErrFieldNotOpened)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: shop field not sealed with the key at %s", database.ErrFieldNotOpened, config.GetShopKeyPath())
+	}
+	return string(plain), nil
+}
+
+// shopReceiptMagic starts the receipt images sealed by WriteReceipt, so
+// images saved before receipts were encrypted are still read as they are.
+var shopReceiptMagic = []byte("XUIRCPT1")
+
+// WriteReceipt stores a receipt image at path, encrypted under a random nonce.
+// The file is replaced at once, so a receipt sealed in place is never lost.
+func WriteReceipt(path string, plain []byte) error {
+	aead, _, err := shopFields.keys()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := append(append([]byte{}, shopReceiptMagic...), nonce...)
+	sealed = aead.Seal(sealed, nonce, plain, shopReceiptMagic)
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".receipt-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(sealed); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReadReceipt returns the receipt image at path, decrypted. Images never
+// sealed are returned as they are.
+func ReadReceipt(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sealed, ok := bytes.CutPrefix(data, shopReceiptMagic)
+	if !ok {
+		return data, nil
+	}
+	aead, _, err := shopFields.keys()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted receipt")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], shopReceiptMagic)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt receipt: not sealed with the key at %s", config.GetShopKeyPath())
+	}
+	return plain, nil
+}
+
+// isSealedReceipt tells whether the file at path was written by WriteReceipt.
+func isSealedReceipt(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(shopReceiptMagic))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return bytes.Equal(head, shopReceiptMagic)
+}
+
+// shopFieldValues returns the values a secret column holding plain may have,
+// for looking rows up by it: plain as written before the column was encrypted,
+// and sealed.
+func shopFieldValues(plain string) ([]string, error) {
+	sealed, err := shopFields.Seal(plain)
+	if err != nil {
+		return nil, err
+	}
+	return []string{plain, sealed}, nil
+}
+
+// EncryptShopFields seals the values of the database.SecretColumns and the
+// receipt images still stored in plain text, such as those written before they
+// were encrypted or by raw SQL. It returns the number of values sealed.
+func (s *ShopService) EncryptShopFields() (int, error) {
+	// Loading the key up front reports a missing key file at startup.
+	if _, _, err := shopFields.keys(); err != nil {
+		return 0, err
+	}
+	db := database.GetShopDB()
+	sealed := 0
+	for table, columns := range database.SecretColumns {
+		for _, column := range columns {
+			for {
+				var rows []struct {
+					Id    int
+					Value string
+				}
+				err := db.Table(table).Select("id, "+column+" AS value").
+					Where(column+" <> '' AND "+column+" NOT LIKE ?", shopFieldPrefix+"%").
+					Order("id").Limit(shopFieldBatchSize).Scan(&rows).Error
+				if err != nil {
+					return sealed, err
+				}
+				for _, row := range rows {
+					// The update seals the value on its way to the database.
+					if err := db.Table(table).Where("id = ?", row.Id).UpdateColumn(column, row.Value).Error; err != nil {
+						return sealed, err
+					}
+					sealed++
+				}
+				if len(rows) < shopFieldBatchSize {
+					break
+				}
+			}
+		}
+	}
+	entries, err := os.ReadDir(ShopReceiptDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return sealed, err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(ShopReceiptDir, entry.Name())
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") || isSealedReceipt(path) {
+			continue
+		}
+		plain, err := os.ReadFile(path)
+		if err != nil {
+			return sealed, err
+		}
+		if err := WriteReceipt(path, plain); err != nil {
+			return sealed, err
+		}
+		sealed++
+	}
+	return sealed, nil
+}
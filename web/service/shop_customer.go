@@ -0,0 +1,175 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// ErrCustomerBanned is returned when a banned customer tries to order.
+var ErrCustomerBanned = errors.New("customer is banned")
+
+// shopCustomerSeenInterval is how often a customer's last-seen time and
+// Telegram names are written back while they keep using the bot.
+const shopCustomerSeenInterval = 5 * time.Minute
+
+// shopCustomerPresence is the cached state of a customer seen by the bot.
+type shopCustomerPresence struct {
+	seenAt    time.Time
+	username  string
+	firstName string
+	banned    bool
+}
+
+// shopCustomerSeen caches the presence of customers, guarded by shopCustomerMu.
+var shopCustomerSeen = map[int64]shopCustomerPresence{}
+
+// forgetCustomer drops the cached language and presence of a customer after
+// their profile changed.
+func forgetCustomer(tgId int64) {
+	shopCustomerMu.Lock()
+	delete(shopCustomerLng, tgId)
+	delete(shopCustomerSeen, tgId)
+	shopCustomerMu.Unlock()
+}
+
+// TrackCustomer records a bot interaction of a customer, creating their profile
+// on first contact, and reports whether they are banned. The profile is only
+// written when the names changed or shopCustomerSeenInterval passed.
+func (s *ShopService) TrackCustomer(tgId int64, username, firstName string) (bool, error) {
+	shopCustomerMu.RLock()
+	presence, ok := shopCustomerSeen[tgId]
+	shopCustomerMu.RUnlock()
+	if ok && presence.username == username && presence.firstName == firstName &&
+		time.Since(presence.seenAt) < shopCustomerSeenInterval {
+		return presence.banned, nil
+	}
+
+	db := database.GetShopDB()
+	customer := &model.ShopCustomer{}
+	if err := db.Where("telegram_id = ?", tgId).Limit(1).Find(customer).Error; err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if customer.TelegramId == 0 {
+		customer.TelegramId = tgId
+		customer.CreatedAt = now
+	}
+	customer.Username = username
+	customer.FirstName = firstName
+	customer.LastSeenAt = now
+	customer.UpdatedAt = now
+	if err := db.Save(customer).Error; err != nil {
+		return false, err
+	}
+	shopCustomerMu.Lock()
+	shopCustomerSeen[tgId] = shopCustomerPresence{seenAt: now, username: username, firstName: firstName, banned: customer.Banned}
+	shopCustomerMu.Unlock()
+	return customer.Banned, nil
+}
+
+// IsCustomerBanned reports whether a customer is banned from the shop.
+func (s *ShopService) IsCustomerBanned(tgId int64) bool {
+	if tgId == 0 {
+		return false
+	}
+	var count int64
+	database.GetShopDB().Model(&model.ShopCustomer{}).Where("telegram_id = ? AND banned = ?", tgId, true).Count(&count)
+	return count > 0
+}
+
+// GetCustomer returns the profile and order totals of one customer.
+func (s *ShopService) GetCustomer(tgId int64) (*ShopCustomerSummary, error) {
+	customers, err := s.ListCustomers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range customers {
+		if customers[i].TelegramId == tgId {
+			return &customers[i], nil
+		}
+	}
+	return nil, errors.New("customer not found")
+}
+
+// SaveCustomer creates a customer profile or updates the fields admins manage:
+// the bot language and the ban. Other fields are kept up to date by the bot.
+func (s *ShopService) SaveCustomer(customer *model.ShopCustomer) error {
+	v := &shopValidator{}
+	v.positive("telegramId", customer.TelegramId)
+	if customer.Language != "" && MatchShopLanguage(customer.Language) != customer.Language {
+		v.add("language", "shop.invalid.choice")
+	}
+	v.text("banReason", customer.BanReason, false, shopValueMaxLength)
+	if err := v.err(); err != nil {
+		return err
+	}
+	if !customer.Banned {
+		customer.BanReason = ""
+	}
+
+	db := database.GetShopDB()
+	existing := &model.ShopCustomer{}
+	if err := db.Where("telegram_id = ?", customer.TelegramId).Limit(1).Find(existing).Error; err != nil {
+		return err
+	}
+	now := time.Now()
+	if existing.TelegramId == 0 {
+		existing.TelegramId = customer.TelegramId
+		existing.CreatedAt = now
+	}
+	existing.Language = customer.Language
+	existing.Banned = customer.Banned
+	existing.BanReason = customer.BanReason
+	existing.UpdatedAt = now
+	// Save writes every column, so a cleared ban is stored too.
+	if err := db.Save(existing).Error; err != nil {
+		return err
+	}
+	forgetCustomer(customer.TelegramId)
+	*customer = *existing
+	return nil
+}
+
+// DeleteCustomer removes a customer's profile. Their orders are kept, and the
+// profile is created again when they next use the bot.
+func (s *ShopService) DeleteCustomer(tgId int64) error {
+	if err := database.GetShopDB().Where("telegram_id = ?", tgId).Delete(&model.ShopCustomer{}).Error; err != nil {
+		return err
+	}
+	forgetCustomer(tgId)
+	return nil
+}
+
+// refreshCustomerStats recomputes the total spend and active subscriptions of a
+// customer who has a profile.
+func (s *ShopService) refreshCustomerStats(tgId int64) {
+	if tgId == 0 {
+		return
+	}
+	db := database.GetShopDB()
+	var spent, archived int64
+	var subs int64
+	err := db.Model(&model.ShopOrder{}).Select("COALESCE(SUM(price), 0)").
+		Where("telegram_id = ? AND status = ?", tgId, OrderStatusApproved).Scan(&spent).Error
+	if err == nil {
+		err = db.Model(&model.ShopOrderArchive{}).Select("COALESCE(SUM(price), 0)").
+			Where("telegram_id = ? AND status = ?", tgId, OrderStatusApproved).Scan(&archived).Error
+	}
+	if err == nil {
+		err = db.Model(&model.ShopSubscription{}).
+			Where("telegram_id = ? AND status = ?", tgId, SubscriptionStatusActive).Count(&subs).Error
+	}
+	if err == nil {
+		err = db.Model(&model.ShopCustomer{}).Where("telegram_id = ?", tgId).Updates(map[string]any{
+			"total_spent":          spent + archived,
+			"active_subscriptions": subs,
+		}).Error
+	}
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("refresh shop customer stats failed")
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// unpaidOrders selects the orders awaiting a receipt that the receipt deadline
+// applies to. Renewal orders are left out, as the billing job suspends their
+// subscription instead, and so are orders with a payment recorded.
+func unpaidOrders() *gorm.DB {
+	return database.GetShopDB().Model(&model.ShopOrder{}).
+		Where("status = ? AND subscription_id = 0 AND paid_amount = 0", OrderStatusPendingReceipt)
+}
+
+// ReceiptDeadline returns when an unpaid order is cancelled if no receipt is
+// sent, or the zero time when it is not.
+func (s *ShopService) ReceiptDeadline(order *model.ShopOrder) time.Time {
+	minutes, err := s.settingService.GetShopReceiptDeadlineMinutes()
+	if err != nil || minutes <= 0 || order.Status != OrderStatusPendingReceipt || order.SubscriptionId != 0 || order.PaidAmount != 0 {
+		return time.Time{}
+	}
+	return order.CreatedAt.Add(time.Duration(minutes) * time.Minute)
+}
+
+// DueDeadlineWarnings returns the unpaid orders past half of their receipt
+// deadline whose customer has not been warned yet.
+func (s *ShopService) DueDeadlineWarnings(now time.Time, deadline time.Duration) ([]model.ShopOrder, error) {
+	orders := []model.ShopOrder{}
+	err := unpaidOrders().
+		Where("deadline_warned_at IS NULL OR deadline_warned_at = ?", time.Time{}).
+		Where("created_at <= ? AND created_at > ?", now.Add(-deadline/2), now.Add(-deadline)).
+		Order("id asc").Find(&orders).Error
+	return orders, err
+}
+
+// MarkDeadlineWarned records that an order's customer was warned about the
+// receipt deadline. It reports false when the order was already warned or is
+// no longer unpaid.
+func (s *ShopService) MarkDeadlineWarned(order *model.ShopOrder) (bool, error) {
+	now := time.Now()
+	result := database.GetShopDB().Model(&model.ShopOrder{}).
+		Where("id = ? AND status = ?", order.Id, OrderStatusPendingReceipt).
+		Where("deadline_warned_at IS NULL OR deadline_warned_at = ?", time.Time{}).
+		Update("deadline_warned_at", now)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	order.DeadlineWarnedAt = now
+	return true, nil
+}
+
+// CancelOverdueOrders rejects the unpaid orders placed more than deadline ago
+// and returns them. An order whose receipt arrives meanwhile is kept.
+func (s *ShopService) CancelOverdueOrders(now time.Time, deadline time.Duration) ([]model.ShopOrder, error) {
+	var overdue []model.ShopOrder
+	if err := unpaidOrders().Where("created_at <= ?", now.Add(-deadline)).Order("id asc").Find(&overdue).Error; err != nil {
+		return nil, err
+	}
+	cancelled := []model.ShopOrder{}
+	for _, order := range overdue {
+		result := database.GetShopDB().Model(&model.ShopOrder{}).
+			Where("id = ? AND status = ?", order.Id, OrderStatusPendingReceipt).
+			Updates(map[string]any{"status": OrderStatusRejected, "updated_at": now})
+		if result.Error != nil {
+			return cancelled, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		countOrderEvent(OrderEventRejected)
+		publishOrderStatus(order.Id, OrderStatusRejected)
+		order.Status = OrderStatusRejected
+		cancelled = append(cancelled, order)
+	}
+	return cancelled, nil
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// Deep-link payload prefixes: t.me/<bot>?start=pkg_5 opens a package's
+// checkout and start=ref_ABC attaches a referral code.
+const (
+	DeepLinkPackagePrefix  = "pkg_"
+	DeepLinkReferralPrefix = "ref_"
+)
+
+// shopDeepLinkWindow is how long after opening a deep link a customer's orders
+// are credited to it.
+const shopDeepLinkWindow = 7 * 24 * time.Hour
+
+// shopReferralCodePattern matches the referral codes Telegram can carry in a
+// start payload.
+var shopReferralCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ErrInvalidDeepLink is returned for start payloads that are not shop deep links.
+var ErrInvalidDeepLink = errors.New("invalid deep link")
+
+// ShopDeepLinkTarget is what a deep link asks for: a package to buy or a
+// referral code to attach.
+type ShopDeepLinkTarget struct {
+	Payload      string
+	PackageId    int
+	ReferralCode string
+}
+
+// ShopDeepLinkStats is the click and conversion count of one deep link.
+type ShopDeepLinkStats struct {
+	Payload      string    `json:"payload"`
+	PackageId    int       `json:"packageId"`
+	ReferralCode string    `json:"referralCode"`
+	Clicks       int64     `json:"clicks"`
+	Orders       int64     `json:"orders"`      // Orders placed within the attribution window of a click
+	Conversions  int64     `json:"conversions"` // Those of the orders that were approved
+	Revenue      int64     `json:"revenue"`     // Price of the approved orders, in minor units
+	Customers    int64     `json:"customers"`   // Customers referred by a ref_ link
+	LastClickAt  time.Time `json:"lastClickAt"`
+}
+
+// ShopDeepLinkReport is the deep-link stats with the bot username the links
+// point to, empty while the bot is stopped.
+type ShopDeepLinkReport struct {
+	BotUsername string              `json:"botUsername"`
+	Links       []ShopDeepLinkStats `json:"links"`
+}
+
+// DeepLinkURL returns the t.me link that starts botUsername with payload, or ""
+// without a bot username.
+func DeepLinkURL(botUsername, payload string) string {
+	if botUsername == "" {
+		return ""
+	}
+	return "https://t.me/" + botUsername + "?start=" + payload
+}
+
+// ParseDeepLink reads a bot start payload. Package links must name an active
+// package sold through the bot.
+func (s *ShopService) ParseDeepLink(payload string) (*ShopDeepLinkTarget, error) {
+	target := &ShopDeepLinkTarget{Payload: payload}
+	if ref, ok := strings.CutPrefix(payload, DeepLinkPackagePrefix); ok {
+		id, err := strconv.Atoi(ref)
+		if err != nil || strconv.Itoa(id) != ref {
+			return nil, ErrInvalidDeepLink
+		}
+		pkg, err := s.GetPackage(id)
+		if err != nil || !pkg.IsActive || pkg.IsArchived || pkg.Type == PackageTypeTopUp {
+			return nil, ErrInvalidDeepLink
+		}
+		target.PackageId = id
+		return target, nil
+	}
+	if code, ok := strings.CutPrefix(payload, DeepLinkReferralPrefix); ok && shopReferralCodePattern.MatchString(code) {
+		target.ReferralCode = code
+		return target, nil
+	}
+	return nil, ErrInvalidDeepLink
+}
+
+// RecordDeepLinkClick counts a customer opening the bot through a deep link and
+// remembers it on their profile so their next orders are credited to it. The
+// first referral code a customer opens stays theirs.
+func (s *ShopService) RecordDeepLinkClick(tgId int64, payload string) (*ShopDeepLinkTarget, error) {
+	target, err := s.ParseDeepLink(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.ShopDeepLink{}).Where("payload = ?", payload).Updates(map[string]any{
+			"clicks":        gorm.Expr("clicks + 1"),
+			"last_click_at": now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			link := &model.ShopDeepLink{Payload: payload, Clicks: 1, LastClickAt: now, CreatedAt: now}
+			if err := tx.Create(link).Error; err != nil {
+				return err
+			}
+		}
+		customer := &model.ShopCustomer{}
+		if err := tx.Where("telegram_id = ?", tgId).Limit(1).Find(customer).Error; err != nil {
+			return err
+		}
+		if customer.TelegramId == 0 {
+			customer.TelegramId = tgId
+			customer.CreatedAt = now
+		}
+		if customer.ReferralCode == "" {
+			customer.ReferralCode = target.ReferralCode
+		}
+		customer.DeepLink = payload
+		customer.DeepLinkAt = now
+		customer.UpdatedAt = now
+		return tx.Save(customer).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// attributeDeepLink credits a customer's new order to the deep link they opened
+// within shopDeepLinkWindow. Renewals of a subscription are not credited.
+func (s *ShopService) attributeDeepLink(order *model.ShopOrder) {
+	if order.TelegramId == 0 || order.SubscriptionId != 0 || order.DeepLink != "" {
+		return
+	}
+	customer := &model.ShopCustomer{}
+	err := database.GetShopDB().Select("deep_link", "deep_link_at").
+		Where("telegram_id = ?", order.TelegramId).Limit(1).Find(customer).Error
+	if err == nil && customer.DeepLink != "" && time.Since(customer.DeepLinkAt) < shopDeepLinkWindow {
+		order.DeepLink = customer.DeepLink
+	}
+}
+
+// DeepLinkStats returns the clicks and conversions of every deep link that was
+// opened, most clicked first. Archived orders count.
+func (s *ShopService) DeepLinkStats() ([]ShopDeepLinkStats, error) {
+	db := database.GetShopDB()
+	links := []model.ShopDeepLink{}
+	if err := db.Order("clicks desc, payload asc").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	type orderCount struct {
+		DeepLink    string
+		Orders      int64
+		Conversions int64
+		Revenue     int64
+	}
+	counts := map[string]*orderCount{}
+	for _, table := range []any{&model.ShopOrder{}, &model.ShopOrderArchive{}} {
+		var rows []orderCount
+		err := db.Model(table).
+			Select("deep_link, COUNT(*) AS orders, "+
+				"SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS conversions, "+
+				"COALESCE(SUM(CASE WHEN status = ? THEN price ELSE 0 END), 0) AS revenue", OrderStatusApproved, OrderStatusApproved).
+			Where("deep_link <> ''").Group("deep_link").Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			if counts[row.DeepLink] == nil {
+				counts[row.DeepLink] = &orderCount{}
+			}
+			counts[row.DeepLink].Orders += row.Orders
+			counts[row.DeepLink].Conversions += row.Conversions
+			counts[row.DeepLink].Revenue += row.Revenue
+		}
+	}
+	var referred []struct {
+		ReferralCode string
+		Customers    int64
+	}
+	err := db.Model(&model.ShopCustomer{}).Select("referral_code, COUNT(*) AS customers").
+		Where("referral_code <> ''").Group("referral_code").Scan(&referred).Error
+	if err != nil {
+		return nil, err
+	}
+	customers := map[string]int64{}
+	for _, row := range referred {
+		customers[row.ReferralCode] = row.Customers
+	}
+
+	stats := make([]ShopDeepLinkStats, 0, len(links))
+	for _, link := range links {
+		stat := ShopDeepLinkStats{Payload: link.Payload, Clicks: link.Clicks, LastClickAt: link.LastClickAt}
+		if ref, ok := strings.CutPrefix(link.Payload, DeepLinkPackagePrefix); ok {
+			stat.PackageId, _ = strconv.Atoi(ref)
+		} else if code, ok := strings.CutPrefix(link.Payload, DeepLinkReferralPrefix); ok {
+			stat.ReferralCode = code
+			stat.Customers = customers[code]
+		}
+		if count := counts[link.Payload]; count != nil {
+			stat.Orders, stat.Conversions, stat.Revenue = count.Orders, count.Conversions, count.Revenue
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ErrNotDowngrade is returned when scheduling a package that is not a
+// downgrade of the subscription's package.
+var ErrNotDowngrade = errors.New("package is not a downgrade")
+
+// isDowngrade reports whether a subscription on current can move to pkg at its
+// next renewal: a cheaper standard package on the same billing cycle, with no
+// more traffic.
+func isDowngrade(current, pkg *model.ShopPackage) bool {
+	if pkg.Id == current.Id || pkg.Type != PackageTypeStandard || !pkg.IsActive || pkg.IsArchived {
+		return false
+	}
+	if pkg.BillingCycle == "" || pkg.BillingCycle != current.BillingCycle || pkg.Price >= current.Price {
+		return false
+	}
+	return current.DataGB == 0 || (pkg.DataGB > 0 && pkg.DataGB <= current.DataGB)
+}
+
+// ListDowngradeOptions returns the packages a subscription can downgrade to.
+func (s *ShopService) ListDowngradeOptions(sub *model.ShopSubscription) ([]model.ShopPackage, error) {
+	current, err := s.GetPackage(sub.PackageId)
+	if err != nil {
+		return nil, err
+	}
+	packages, err := s.ListPackages(ShopPackageFilter{ActiveOnly: true, Types: []string{PackageTypeStandard}})
+	if err != nil {
+		return nil, err
+	}
+	options := make([]model.ShopPackage, 0, len(packages))
+	for _, pkg := range packages {
+		if isDowngrade(current, &pkg) {
+			options = append(options, pkg)
+		}
+	}
+	return options, nil
+}
+
+// ScheduleDowngrade records the package a subscription switches to when it is
+// next renewed, and returns that package. The current cycle keeps its package.
+func (s *ShopService) ScheduleDowngrade(sub *model.ShopSubscription, pkgId int) (*model.ShopPackage, error) {
+	if sub.Status == SubscriptionStatusCancelled {
+		return nil, errors.New("subscription is cancelled")
+	}
+	current, err := s.GetPackage(sub.PackageId)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := s.GetPackage(pkgId)
+	if err != nil {
+		return nil, err
+	}
+	if !isDowngrade(current, pkg) {
+		return nil, ErrNotDowngrade
+	}
+	sub.NextPackageId = pkg.Id
+	return pkg, database.GetShopDB().Model(&model.ShopSubscription{}).Where("id = ?", sub.Id).Updates(map[string]any{
+		"next_package_id": pkg.Id,
+		"updated_at":      time.Now(),
+	}).Error
+}
+
+// CancelDowngrade keeps a subscription on its package at the next renewal.
+func (s *ShopService) CancelDowngrade(sub *model.ShopSubscription) error {
+	sub.NextPackageId = 0
+	return database.GetShopDB().Model(&model.ShopSubscription{}).Where("id = ?", sub.Id).Updates(map[string]any{
+		"next_package_id": 0,
+		"updated_at":      time.Now(),
+	}).Error
+}
+
+// renewalPackage returns the package a subscription's next renewal order is
+// for: the scheduled downgrade while it is still on offer, the subscription's
+// package otherwise.
+func (s *ShopService) renewalPackage(sub *model.ShopSubscription) (*model.ShopPackage, error) {
+	current, err := s.GetPackage(sub.PackageId)
+	if err != nil {
+		return nil, err
+	}
+	if sub.NextPackageId == 0 {
+		return current, nil
+	}
+	if next, err := s.GetPackage(sub.NextPackageId); err == nil && isDowngrade(current, next) {
+		return next, nil
+	}
+	return current, nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/web/websocket"
+)
+
+// ShopOrderEvent is an order status change pushed to live listeners.
+type ShopOrderEvent struct {
+	OrderId   int       `json:"orderId"`
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Kinds of admin order feed events.
+const (
+	OrderFeedNew     = "new"
+	OrderFeedReceipt = "receipt"
+)
+
+// ShopOrderFeedEvent is pushed to the panel when an order needs an admin's attention.
+type ShopOrderFeedEvent struct {
+	Kind       string `json:"kind"`
+	OrderId    int    `json:"orderId"`
+	TelegramId int64  `json:"telegramId"`
+	Price      int64  `json:"price"`
+	PriceText  string `json:"priceText"`
+	Status     string `json:"status"`
+}
+
+var (
+	orderListenersMu sync.Mutex
+	orderListeners   = map[int]map[chan ShopOrderEvent]struct{}{}
+)
+
+// SubscribeOrder returns a channel receiving the status changes of one order.
+// The returned function must be called to stop listening.
+func SubscribeOrder(orderId int) (<-chan ShopOrderEvent, func()) {
+	ch := make(chan ShopOrderEvent, 4)
+	orderListenersMu.Lock()
+	if orderListeners[orderId] == nil {
+		orderListeners[orderId] = map[chan ShopOrderEvent]struct{}{}
+	}
+	orderListeners[orderId][ch] = struct{}{}
+	orderListenersMu.Unlock()
+	return ch, func() {
+		orderListenersMu.Lock()
+		delete(orderListeners[orderId], ch)
+		if len(orderListeners[orderId]) == 0 {
+			delete(orderListeners, orderId)
+		}
+		orderListenersMu.Unlock()
+	}
+}
+
+// publishOrderStatus notifies the listeners of an order. Slow listeners miss
+// events rather than blocking the caller.
+func publishOrderStatus(orderId int, status string) {
+	event := ShopOrderEvent{OrderId: orderId, Status: status, UpdatedAt: time.Now()}
+	orderListenersMu.Lock()
+	defer orderListenersMu.Unlock()
+	for ch := range orderListeners[orderId] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// broadcastOrderFeed pushes an order event to the admins viewing the panel.
+func (s *ShopService) broadcastOrderFeed(kind string, order *model.ShopOrder) {
+	websocket.BroadcastShopOrder(ShopOrderFeedEvent{
+		Kind:       kind,
+		OrderId:    order.Id,
+		TelegramId: order.TelegramId,
+		Price:      order.Price,
+		PriceText:  s.FormatPrice(order.Price),
+		Status:     order.Status,
+	})
+}
+
+// OrderStatusToken returns the token a customer presents to follow an order's
+// status without logging in. It is derived from the panel secret.
+func (s *ShopService) OrderStatusToken(orderId int) (string, error) {
+	secret, err := s.settingService.GetSecret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("order-status:" + strconv.Itoa(orderId)))
+	return hex.EncodeToString(mac.Sum(nil))[:32], nil
+}
+
+// CheckOrderStatusToken reports whether a token was issued for the order.
+func (s *ShopService) CheckOrderStatusToken(orderId int, token string) bool {
+	expected, err := s.OrderStatusToken(orderId)
+	return err == nil && hmac.Equal([]byte(expected), []byte(token))
+}
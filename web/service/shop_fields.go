@@ -0,0 +1,218 @@
+package service
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// Kinds of checkout fields.
+const (
+	CheckoutFieldText   = "text"
+	CheckoutFieldNumber = "number"
+	CheckoutFieldChoice = "choice"
+)
+
+// CheckoutFieldKinds are the supported checkout field kinds.
+var CheckoutFieldKinds = []string{CheckoutFieldText, CheckoutFieldNumber, CheckoutFieldChoice}
+
+// shopCheckoutFieldMaxOptions bounds the answers of a choice field, which the
+// bot shows as buttons.
+const shopCheckoutFieldMaxOptions = 20
+
+// ListCheckoutFields returns the checkout fields in the order they are asked.
+func (s *ShopService) ListCheckoutFields() ([]model.ShopCheckoutField, error) {
+	fields := []model.ShopCheckoutField{}
+	err := database.GetShopDB().Order("sort_order asc, id asc").Find(&fields).Error
+	return fields, err
+}
+
+// GetCheckoutField returns a checkout field by ID.
+func (s *ShopService) GetCheckoutField(id int) (*model.ShopCheckoutField, error) {
+	field := &model.ShopCheckoutField{}
+	if err := database.GetShopDB().First(field, id).Error; err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// SaveCheckoutField creates or updates a checkout field, normalizing its
+// choices and packages.
+func (s *ShopService) SaveCheckoutField(field *model.ShopCheckoutField) error {
+	field.Label = strings.TrimSpace(field.Label)
+	v := &shopValidator{}
+	v.text("label", field.Label, true, shopNameMaxLength)
+	if !slices.Contains(CheckoutFieldKinds, field.Kind) {
+		v.add("fieldKind", "shop.invalid.choice")
+	}
+	options := []string{}
+	for _, option := range splitShopTags(field.Options) {
+		if !slices.Contains(options, option) {
+			options = append(options, option)
+		}
+	}
+	if field.Kind == CheckoutFieldChoice {
+		v.between("options", len(options), 1, shopCheckoutFieldMaxOptions)
+		for _, option := range options {
+			v.text("options", option, false, shopNameMaxLength)
+		}
+		field.Options = strings.Join(options, ",")
+	} else {
+		field.Options = ""
+	}
+	if packageIds, err := parseShopIdList(field.PackageIds); err == nil {
+		field.PackageIds = joinShopIdList(packageIds)
+	} else {
+		v.add("packageIds", "shop.invalid.list")
+	}
+	field.ShowIf = strings.TrimSpace(field.ShowIf)
+	v.text("showIf", field.ShowIf, false, shopValueMaxLength)
+	if _, ok := parseCheckoutCondition(field.ShowIf); !ok {
+		v.add("showIf", "shop.invalid.condition")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+
+	db := database.GetShopDB()
+	now := time.Now()
+	field.UpdatedAt = now
+	if field.Id == 0 {
+		field.CreatedAt = now
+		return db.Create(field).Error
+	}
+	return db.Model(&model.ShopCheckoutField{}).Where("id = ?", field.Id).
+		Select("label", "kind", "options", "required", "package_ids", "show_if", "sort_order", "enabled", "updated_at").Updates(field).Error
+}
+
+// DeleteCheckoutField deletes a checkout field. Answers already stored on
+// orders are kept.
+func (s *ShopService) DeleteCheckoutField(id int) error {
+	return database.GetShopDB().Delete(&model.ShopCheckoutField{}, id).Error
+}
+
+// CheckoutFieldsFor returns the enabled checkout fields asked for an order:
+// fields listing none of its packages are left out, as are fields whose
+// conditions do not hold for its packages and the answers given so far.
+// Orders without a package, such as custom ones, are asked the fields listing
+// no packages.
+func (s *ShopService) CheckoutFieldsFor(subject *CheckoutSubject) ([]model.ShopCheckoutField, error) {
+	fields, err := s.ListCheckoutFields()
+	if err != nil {
+		return nil, err
+	}
+	packages := []map[string]string{}
+	if len(subject.PackageIds) > 0 {
+		var bought []model.ShopPackage
+		if err := database.GetShopDB().Where("id IN ?", subject.PackageIds).Find(&bought).Error; err != nil {
+			return nil, err
+		}
+		for i := range bought {
+			packages = append(packages, checkoutPackageValues(&bought[i]))
+		}
+	} else {
+		packages = append(packages, map[string]string{
+			"type":         "custom",
+			"devices":      "1",
+			"dataGb":       strconv.Itoa(subject.CustomGB),
+			"durationDays": strconv.Itoa(subject.CustomDays),
+		})
+	}
+	asked := []model.ShopCheckoutField{}
+	for _, field := range fields {
+		if !field.Enabled {
+			continue
+		}
+		listed, _ := parseShopIdList(field.PackageIds)
+		if len(listed) > 0 && !slices.ContainsFunc(subject.PackageIds, func(id int) bool { return slices.Contains(listed, id) }) {
+			continue
+		}
+		clauses, ok := parseCheckoutCondition(field.ShowIf)
+		if ok && checkoutFieldShown(clauses, packages, subject.Answers) {
+			asked = append(asked, field)
+		}
+	}
+	return asked, nil
+}
+
+// CheckoutFieldOptions returns the answers of a choice field.
+func CheckoutFieldOptions(field *model.ShopCheckoutField) []string {
+	return splitShopTags(field.Options)
+}
+
+// CheckoutAnswer checks a customer's answer to a checkout field and returns it
+// normalized.
+func CheckoutAnswer(field *model.ShopCheckoutField, answer string) (string, error) {
+	answer = strings.TrimSpace(answer)
+	v := &shopValidator{}
+	v.text("answer", answer, field.Required, shopValueMaxLength)
+	if answer != "" {
+		switch field.Kind {
+		case CheckoutFieldNumber:
+			if n, err := strconv.ParseFloat(answer, 64); err != nil {
+				v.add("answer", "shop.invalid.number")
+			} else {
+				answer = strconv.FormatFloat(n, 'f', -1, 64)
+			}
+		case CheckoutFieldChoice:
+			if !slices.Contains(CheckoutFieldOptions(field), answer) {
+				v.add("answer", "shop.invalid.choice")
+			}
+		}
+	}
+	return answer, v.err()
+}
+
+// EncodeCheckoutAnswers returns the answers as stored in an order's custom
+// fields, leaving out the unanswered ones.
+func EncodeCheckoutAnswers(answers map[string]string) string {
+	kept := map[string]string{}
+	for label, answer := range answers {
+		if answer != "" {
+			kept[label] = answer
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(kept)
+	return string(data)
+}
+
+// OrderCheckoutAnswers returns the checkout field answers stored on an order,
+// keyed by field label.
+func OrderCheckoutAnswers(order *model.ShopOrder) map[string]string {
+	answers := map[string]string{}
+	if order.CustomFields != "" {
+		_ = json.Unmarshal([]byte(order.CustomFields), &answers)
+	}
+	return answers
+}
+
+// parseShopIdList parses a comma-separated list of positive IDs.
+func parseShopIdList(value string) ([]int, error) {
+	ids := []int{}
+	for _, item := range splitShopTags(value) {
+		id, err := strconv.Atoi(item)
+		if err != nil || id <= 0 {
+			return nil, strconv.ErrSyntax
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func joinShopIdList(ids []int) string {
+	items := make([]string, len(ids))
+	for i, id := range ids {
+		items[i] = strconv.Itoa(id)
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// checkoutAnswerPrefix starts a condition on an earlier checkout answer, as in
+// answer.OS=Router.
+const checkoutAnswerPrefix = "answer."
+
+// checkoutPackageAttributes are the package attributes a checkout field
+// condition can test.
+var checkoutPackageAttributes = []string{"type", "devices", "dataGb", "durationDays", "billingCycle", "categoryId", "inboundTag"}
+
+// checkoutOperators are the condition operators, two-character ones first so
+// they are matched before their one-character prefixes.
+var checkoutOperators = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+// checkoutClause is one condition of a checkout field: an attribute or earlier
+// answer compared with a value. The = and != operators accept alternatives
+// separated by |.
+type checkoutClause struct {
+	name     string
+	operator string
+	values   []string
+}
+
+// CheckoutSubject is the order a checkout form is filled for: the packages
+// being bought, or the amounts of a custom order, and the answers given so far.
+type CheckoutSubject struct {
+	PackageIds []int
+	CustomGB   int
+	CustomDays int
+	Answers    map[string]string
+}
+
+// parseCheckoutCondition parses conditions separated by semicolons, such as
+// "type=pooled; devices>1; answer.OS=Router|Android".
+func parseCheckoutCondition(condition string) ([]checkoutClause, bool) {
+	clauses := []checkoutClause{}
+	for _, part := range strings.Split(condition, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		clause, ok := parseCheckoutClause(part)
+		if !ok {
+			return nil, false
+		}
+		clauses = append(clauses, clause)
+	}
+	return clauses, true
+}
+
+func parseCheckoutClause(part string) (checkoutClause, bool) {
+	at, operator := -1, ""
+	for _, op := range checkoutOperators {
+		if i := strings.Index(part, op); i > 0 && (at < 0 || i < at) {
+			at, operator = i, op
+		}
+	}
+	if at < 0 {
+		return checkoutClause{}, false
+	}
+	clause := checkoutClause{name: strings.TrimSpace(part[:at]), operator: operator}
+	for _, value := range strings.Split(part[at+len(operator):], "|") {
+		clause.values = append(clause.values, strings.TrimSpace(value))
+	}
+	if label, ok := strings.CutPrefix(clause.name, checkoutAnswerPrefix); ok {
+		if strings.TrimSpace(label) == "" {
+			return checkoutClause{}, false
+		}
+	} else if !slices.Contains(checkoutPackageAttributes, clause.name) {
+		return checkoutClause{}, false
+	}
+	if len(clause.values) > 1 && operator != "=" && operator != "!=" {
+		return checkoutClause{}, false
+	}
+	if operator != "=" && operator != "!=" {
+		if _, err := strconv.ParseFloat(clause.values[0], 64); err != nil {
+			return checkoutClause{}, false
+		}
+	}
+	return clause, true
+}
+
+// holds reports whether the clause holds for value.
+func (c checkoutClause) holds(value string) bool {
+	switch c.operator {
+	case "=":
+		return slices.ContainsFunc(c.values, func(v string) bool { return strings.EqualFold(v, value) })
+	case "!=":
+		return !slices.ContainsFunc(c.values, func(v string) bool { return strings.EqualFold(v, value) })
+	}
+	have, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	want, _ := strconv.ParseFloat(c.values[0], 64)
+	switch c.operator {
+	case ">":
+		return have > want
+	case ">=":
+		return have >= want
+	case "<":
+		return have < want
+	default:
+		return have <= want
+	}
+}
+
+// checkoutPackageValues returns the condition attributes of a package.
+func checkoutPackageValues(pkg *model.ShopPackage) map[string]string {
+	return map[string]string{
+		"type":         pkg.Type,
+		"devices":      strconv.Itoa(max(pkg.Devices, 1)),
+		"dataGb":       strconv.Itoa(pkg.DataGB),
+		"durationDays": strconv.Itoa(pkg.DurationDays),
+		"billingCycle": pkg.BillingCycle,
+		"categoryId":   strconv.Itoa(pkg.CategoryId),
+		"inboundTag":   pkg.InboundTag,
+	}
+}
+
+// checkoutFieldShown reports whether a field's conditions hold for the order.
+// Package conditions must all hold for one of the order's packages; a custom
+// order counts as a single-device package of type custom.
+func checkoutFieldShown(clauses []checkoutClause, packages []map[string]string, answers map[string]string) bool {
+	var packageClauses []checkoutClause
+	for _, clause := range clauses {
+		if label, ok := strings.CutPrefix(clause.name, checkoutAnswerPrefix); !ok {
+			packageClauses = append(packageClauses, clause)
+		} else if !clause.holds(answers[label]) {
+			return false
+		}
+	}
+	if len(packageClauses) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(packages, func(values map[string]string) bool {
+		for _, clause := range packageClauses {
+			if !clause.holds(values[clause.name]) {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,347 @@
+package service
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ShopGatewayCheckout is the form that sends a customer to a payment gateway.
+type ShopGatewayCheckout struct {
+	Action string            // Gateway address the form is posted to
+	Amount string            // Amount the customer pays, in the gateway currency
+	Fields map[string]string // Form fields
+}
+
+// ShopGatewayPayment is a payment a gateway notified the shop of.
+type ShopGatewayPayment struct {
+	OrderId     int    // Order the payment is for, when the gateway refers to it by ID
+	OrderNumber string // Order the payment is for, when the gateway refers to it by number
+	Amount      string // Paid amount in the gateway currency
+	Currency    string // Gateway currency, empty when the account implies it
+	Reference   string // Gateway's ID of the payment
+	Prerequest  bool   // The gateway asks whether to accept the payment; nothing was paid yet
+}
+
+// ShopPaymentGateway is a merchant payment gateway customers are sent to.
+type ShopPaymentGateway interface {
+	// Checkout returns the form paying amount for order. The gateway notifies
+	// callbackURL of the payment and sends the customer to returnURL.
+	Checkout(order *model.ShopOrder, amount, currency, callbackURL, returnURL string) (*ShopGatewayCheckout, error)
+	// VerifyCallback checks the signature of a payment notification.
+	VerifyCallback(form url.Values) (*ShopGatewayPayment, error)
+}
+
+var (
+	shopPaymentGatewaysMu sync.RWMutex
+	shopPaymentGateways   = map[string]ShopPaymentGateway{
+		"perfectmoney": &perfectMoneyGateway{},
+		"webmoney":     &webMoneyGateway{},
+	}
+)
+
+// ShopPaymentGatewayNames are the display names of the built-in gateways.
+var ShopPaymentGatewayNames = map[string]string{
+	"perfectmoney": "Perfect Money",
+	"webmoney":     "WebMoney",
+}
+
+// RegisterShopPaymentGateway makes a payment gateway selectable by name in the
+// shop settings.
+func RegisterShopPaymentGateway(name string, gateway ShopPaymentGateway) {
+	shopPaymentGatewaysMu.Lock()
+	defer shopPaymentGatewaysMu.Unlock()
+	shopPaymentGateways[name] = gateway
+}
+
+func getShopPaymentGateway(name string) ShopPaymentGateway {
+	shopPaymentGatewaysMu.RLock()
+	defer shopPaymentGatewaysMu.RUnlock()
+	return shopPaymentGateways[name]
+}
+
+// ErrGatewayPaymentMismatch is returned when a gateway reports a payment that
+// does not pay what its order costs.
+var ErrGatewayPaymentMismatch = errors.New("payment does not match the order")
+
+// PaymentGateway returns the name of the configured payment gateway, or an
+// empty name when gateway payments are off or not fully configured.
+func (s *ShopService) PaymentGateway() string {
+	name, _ := s.settingService.GetShopGateway()
+	if name == "" || getShopPaymentGateway(name) == nil {
+		return ""
+	}
+	if public, _ := s.settingService.GetShopPublicUrl(); public == "" {
+		return ""
+	}
+	if rate, err := s.gatewayRate(); err != nil || rate <= 0 {
+		return ""
+	}
+	return name
+}
+
+func (s *ShopService) gatewayRate() (float64, error) {
+	value, err := s.settingService.GetShopGatewayRate()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(value), 64)
+}
+
+// GatewayAmount returns what an order costs in the gateway currency, in cents
+// rounded up.
+func (s *ShopService) GatewayAmount(order *model.ShopOrder) (int64, error) {
+	rate, err := s.gatewayRate()
+	if err != nil || rate <= 0 {
+		return 0, errors.New("invalid gateway rate")
+	}
+	units := float64(order.Price) / float64(minorUnitScale(CurrencyExponent(s.Currency().Code)))
+	cents := math.Ceil(units*rate*100 - 1e-6)
+	if cents > math.MaxInt32 {
+		return 0, ErrPriceOverflow
+	}
+	return max(int64(cents), 1), nil
+}
+
+// formatGatewayAmount renders an amount in cents as gateways expect it.
+func formatGatewayAmount(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// parseGatewayAmount reads an amount a gateway reported into cents.
+func parseGatewayAmount(amount string) (int64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	return int64(math.Round(value * 100)), nil
+}
+
+// publicShopURL returns the panel's public address joined with path.
+func (s *ShopService) publicShopURL(path string) string {
+	public, _ := s.settingService.GetShopPublicUrl()
+	return strings.TrimRight(public, "/") + "/" + path
+}
+
+// GatewayPaymentURL returns the page sending the customer of an order awaiting
+// payment to the configured gateway.
+func (s *ShopService) GatewayPaymentURL(order *model.ShopOrder) (string, error) {
+	if s.PaymentGateway() == "" {
+		return "", errors.New("gateway payments are off")
+	}
+	if order.Status != OrderStatusPendingReceipt || order.PaidAmount != 0 {
+		return "", errors.New("order is not awaiting payment")
+	}
+	if !s.PaymentMethodAllowed(order, PaymentMethodGateway) {
+		return "", errors.New("package does not accept gateway payments")
+	}
+	token, err := s.OrderStatusToken(order.Id)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"order": {strconv.Itoa(order.Id)}, "token": {token}}
+	return s.publicShopURL("portal/pay?" + query.Encode()), nil
+}
+
+// GatewayCheckout returns the gateway form paying an order awaiting payment.
+func (s *ShopService) GatewayCheckout(order *model.ShopOrder) (*ShopGatewayCheckout, error) {
+	name := s.PaymentGateway()
+	if name == "" {
+		return nil, errors.New("gateway payments are off")
+	}
+	if order.Status != OrderStatusPendingReceipt || order.PaidAmount != 0 {
+		return nil, errors.New("order is not awaiting payment")
+	}
+	if !s.PaymentMethodAllowed(order, PaymentMethodGateway) {
+		return nil, errors.New("package does not accept gateway payments")
+	}
+	cents, err := s.GatewayAmount(order)
+	if err != nil {
+		return nil, err
+	}
+	currency, _ := s.settingService.GetShopGatewayCurrency()
+	return getShopPaymentGateway(name).Checkout(order, formatGatewayAmount(cents), strings.ToUpper(currency),
+		s.publicShopURL("portal/gateway/"+name), s.publicShopURL("portal/pay/done"))
+}
+
+// ConfirmGatewayPayment verifies a payment notification of the named gateway
+// and readies the order it paid for review, keeping the gateway's reference in
+// place of the one read from a receipt. A payment of the wrong amount is still
+// recorded but reported with ErrGatewayPaymentMismatch, so it is not approved
+// on its own. A prerequest is only checked.
+func (s *ShopService) ConfirmGatewayPayment(name string, form url.Values) (*ShopGatewayPayment, *model.ShopOrder, error) {
+	if name != s.PaymentGateway() {
+		return nil, nil, fmt.Errorf("gateway %q is not enabled", name)
+	}
+	payment, err := getShopPaymentGateway(name).VerifyCallback(form)
+	if err != nil {
+		return nil, nil, err
+	}
+	order := &model.ShopOrder{}
+	db := database.GetShopDB()
+	if payment.OrderId > 0 {
+		err = db.First(order, payment.OrderId).Error
+	} else {
+		err = db.Where("number = ?", payment.OrderNumber).First(order).Error
+	}
+	if err != nil {
+		return payment, nil, err
+	}
+	if order.Status != OrderStatusPendingReceipt {
+		return payment, order, errors.New("order is not awaiting payment")
+	}
+	want, err := s.GatewayAmount(order)
+	if err != nil {
+		return payment, order, err
+	}
+	paid, err := parseGatewayAmount(payment.Amount)
+	if err != nil {
+		return payment, order, err
+	}
+	currency, _ := s.settingService.GetShopGatewayCurrency()
+	mismatch := paid != want || (payment.Currency != "" && !strings.EqualFold(payment.Currency, currency))
+	if payment.Prerequest {
+		if mismatch {
+			return payment, order, ErrGatewayPaymentMismatch
+		}
+		return payment, order, nil
+	}
+	confirmed, err := s.ConfirmStatementPayment(order.Id, name+":"+payment.Reference)
+	if err == nil && mismatch {
+		err = ErrGatewayPaymentMismatch
+	}
+	return payment, confirmed, err
+}
+
+// perfectMoneyGateway takes payments through the Perfect Money SCI.
+type perfectMoneyGateway struct {
+	settingService SettingService
+}
+
+func (g *perfectMoneyGateway) Checkout(order *model.ShopOrder, amount, currency, callbackURL, returnURL string) (*ShopGatewayCheckout, error) {
+	account, _ := g.settingService.GetShopGatewayAccount()
+	if account == "" || order.Number == "" {
+		return nil, errors.New("Perfect Money account not configured")
+	}
+	return &ShopGatewayCheckout{
+		Action: "https://perfectmoney.com/api/step1.asp",
+		Amount: amount,
+		Fields: map[string]string{
+			"PAYEE_ACCOUNT":        account,
+			"PAYEE_NAME":           "Order " + order.Number,
+			"PAYMENT_ID":           order.Number,
+			"PAYMENT_AMOUNT":       amount,
+			"PAYMENT_UNITS":        currency,
+			"STATUS_URL":           callbackURL,
+			"PAYMENT_URL":          returnURL,
+			"PAYMENT_URL_METHOD":   "GET",
+			"NOPAYMENT_URL":        returnURL,
+			"NOPAYMENT_URL_METHOD": "GET",
+			"SUGGESTED_MEMO":       "Order " + order.Number,
+		},
+	}, nil
+}
+
+func (g *perfectMoneyGateway) VerifyCallback(form url.Values) (*ShopGatewayPayment, error) {
+	account, _ := g.settingService.GetShopGatewayAccount()
+	secret, _ := g.settingService.GetShopGatewaySecret()
+	if account == "" || secret == "" {
+		return nil, errors.New("Perfect Money account not configured")
+	}
+	secretHash := md5.Sum([]byte(secret))
+	fields := []string{
+		form.Get("PAYMENT_ID"), form.Get("PAYEE_ACCOUNT"), form.Get("PAYMENT_AMOUNT"), form.Get("PAYMENT_UNITS"),
+		form.Get("PAYMENT_BATCH_NUM"), form.Get("PAYER_ACCOUNT"), strings.ToUpper(hex.EncodeToString(secretHash[:])), form.Get("TIMESTAMPGMT"),
+	}
+	sum := md5.Sum([]byte(strings.Join(fields, ":")))
+	if !equalSignature(hex.EncodeToString(sum[:]), form.Get("V2_HASH")) {
+		return nil, errors.New("invalid Perfect Money signature")
+	}
+	if form.Get("PAYEE_ACCOUNT") != account {
+		return nil, errors.New("payment to another Perfect Money account")
+	}
+	return &ShopGatewayPayment{
+		OrderNumber: form.Get("PAYMENT_ID"),
+		Amount:      form.Get("PAYMENT_AMOUNT"),
+		Currency:    form.Get("PAYMENT_UNITS"),
+		Reference:   form.Get("PAYMENT_BATCH_NUM"),
+	}, nil
+}
+
+// webMoneyGateway takes payments through the WebMoney Merchant interface.
+type webMoneyGateway struct {
+	settingService SettingService
+}
+
+func (g *webMoneyGateway) Checkout(order *model.ShopOrder, amount, currency, callbackURL, returnURL string) (*ShopGatewayCheckout, error) {
+	purse, _ := g.settingService.GetShopGatewayAccount()
+	if purse == "" {
+		return nil, errors.New("WebMoney purse not configured")
+	}
+	return &ShopGatewayCheckout{
+		Action: "https://merchant.webmoney.ru/lmi/payment_utf.asp",
+		Amount: amount,
+		Fields: map[string]string{
+			"LMI_PAYEE_PURSE":         purse,
+			"LMI_PAYMENT_AMOUNT":      amount,
+			"LMI_PAYMENT_NO":          strconv.Itoa(order.Id),
+			"LMI_PAYMENT_DESC_BASE64": base64.StdEncoding.EncodeToString([]byte("Order " + OrderNumber(order))),
+			"LMI_RESULT_URL":          callbackURL,
+			"LMI_SUCCESS_URL":         returnURL,
+			"LMI_SUCCESS_METHOD":      "0",
+			"LMI_FAIL_URL":            returnURL,
+			"LMI_FAIL_METHOD":         "0",
+		},
+	}, nil
+}
+
+func (g *webMoneyGateway) VerifyCallback(form url.Values) (*ShopGatewayPayment, error) {
+	purse, _ := g.settingService.GetShopGatewayAccount()
+	secret, _ := g.settingService.GetShopGatewaySecret()
+	if purse == "" || secret == "" {
+		return nil, errors.New("WebMoney purse not configured")
+	}
+	if form.Get("LMI_PAYEE_PURSE") != purse {
+		return nil, errors.New("payment to another WebMoney purse")
+	}
+	orderId, err := strconv.Atoi(form.Get("LMI_PAYMENT_NO"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid payment number %q", form.Get("LMI_PAYMENT_NO"))
+	}
+	payment := &ShopGatewayPayment{OrderId: orderId, Amount: form.Get("LMI_PAYMENT_AMOUNT")}
+	if form.Get("LMI_PREREQUEST") == "1" {
+		payment.Prerequest = true
+		return payment, nil
+	}
+	if form.Get("LMI_MODE") != "0" {
+		return nil, errors.New("WebMoney test payment")
+	}
+	fields := []string{
+		form.Get("LMI_PAYEE_PURSE"), form.Get("LMI_PAYMENT_AMOUNT"), form.Get("LMI_PAYMENT_NO"), form.Get("LMI_MODE"),
+		form.Get("LMI_SYS_INVS_NO"), form.Get("LMI_SYS_TRANS_NO"), form.Get("LMI_SYS_TRANS_DATE"), secret,
+		form.Get("LMI_PAYER_PURSE"), form.Get("LMI_PAYER_WM"),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "")))
+	if !equalSignature(hex.EncodeToString(sum[:]), form.Get("LMI_HASH")) {
+		return nil, errors.New("invalid WebMoney signature")
+	}
+	payment.Reference = form.Get("LMI_SYS_TRANS_NO")
+	return payment, nil
+}
+
+// equalSignature compares hex signatures regardless of case in constant time.
+func equalSignature(expected, got string) bool {
+	return subtle.ConstantTimeCompare([]byte(strings.ToUpper(expected)), []byte(strings.ToUpper(got))) == 1
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"gorm.io/gorm"
+)
+
+// shopGoalMonthLayout is how the month of a revenue goal is written.
+const shopGoalMonthLayout = "2006-01"
+
+// ShopRevenueGoalProgress is how far the approved sales of a month are towards
+// its revenue goal. Goal is 0 when none is set for the month.
+type ShopRevenueGoalProgress struct {
+	Month     string    `json:"month"`
+	Goal      int64     `json:"goal"`
+	Orders    int       `json:"orders"`
+	Revenue   int64     `json:"revenue"`
+	Percent   float64   `json:"percent"`
+	Reached   bool      `json:"reached"`
+	ReachedAt time.Time `json:"reachedAt"` // When the admins were told, zero until then
+}
+
+// ShopWeeklySummary sums up the shop's last seven days for the admins.
+type ShopWeeklySummary struct {
+	Since            time.Time                `json:"since"`
+	Orders           int                      `json:"orders"`
+	Revenue          int64                    `json:"revenue"`
+	TopPackageId     int                      `json:"topPackageId"` // Package sold most often, 0 when none was
+	TopPackage       string                   `json:"topPackage"`
+	TopPackageOrders int                      `json:"topPackageOrders"`
+	Churned          int                      `json:"churned"`   // Subscriptions suspended or cancelled in the week
+	ChurnRate        float64                  `json:"churnRate"` // Churned share of the subscriptions active during the week, in percent
+	Goal             *ShopRevenueGoalProgress `json:"goal"`      // Progress of the current month, nil without a goal
+}
+
+// ListRevenueGoals returns the monthly revenue goals, latest month first.
+func (s *ShopService) ListRevenueGoals() ([]model.ShopRevenueGoal, error) {
+	goals := []model.ShopRevenueGoal{}
+	err := database.GetShopDB().Order("month desc").Find(&goals).Error
+	return goals, err
+}
+
+// SaveRevenueGoal sets the revenue goal of a month, replacing the goal the
+// month already has. The admins are told again once the new goal is reached.
+func (s *ShopService) SaveRevenueGoal(goal *model.ShopRevenueGoal) error {
+	v := &shopValidator{}
+	if _, err := time.ParseInLocation(shopGoalMonthLayout, goal.Month, s.Location()); err != nil {
+		v.add("month", "shop.invalid.month")
+	}
+	v.positive("amount", goal.Amount)
+	if err := v.err(); err != nil {
+		return err
+	}
+	db := database.GetShopDB()
+	existing := &model.ShopRevenueGoal{}
+	if err := db.Where("month = ?", goal.Month).Limit(1).Find(existing).Error; err != nil {
+		return err
+	}
+	if goal.Id == 0 {
+		goal.Id = existing.Id
+	}
+	if existing.Id != 0 && existing.Id != goal.Id {
+		// Moving a goal onto a month that has one replaces that month's goal.
+		if err := db.Delete(existing).Error; err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	goal.ReachedAt, goal.UpdatedAt = time.Time{}, now
+	if goal.Id == 0 {
+		goal.CreatedAt = now
+		return db.Create(goal).Error
+	}
+	return db.Model(&model.ShopRevenueGoal{}).Where("id = ?", goal.Id).
+		Select("month", "amount", "reached_at", "updated_at").Updates(goal).Error
+}
+
+func (s *ShopService) DeleteRevenueGoal(id int) error {
+	return database.GetShopDB().Delete(&model.ShopRevenueGoal{}, id).Error
+}
+
+// RevenueGoalProgress returns the progress of a month, written like 2026-10,
+// towards its goal. An empty month is the current one.
+func (s *ShopService) RevenueGoalProgress(month string) (*ShopRevenueGoalProgress, error) {
+	loc := s.Location()
+	if month == "" {
+		month = time.Now().In(loc).Format(shopGoalMonthLayout)
+	}
+	start, err := time.ParseInLocation(shopGoalMonthLayout, month, loc)
+	if err != nil {
+		return nil, errors.New("month must look like 2026-10")
+	}
+	goal := &model.ShopRevenueGoal{}
+	if err := database.GetShopDB().Where("month = ?", month).Limit(1).Find(goal).Error; err != nil {
+		return nil, err
+	}
+	orders, err := approvedOrdersSince(start)
+	if err != nil {
+		return nil, err
+	}
+	end := start.AddDate(0, 1, 0)
+	progress := &ShopRevenueGoalProgress{Month: month, Goal: goal.Amount, ReachedAt: goal.ReachedAt}
+	for _, order := range orders {
+		if !order.CreatedAt.Before(end) {
+			break
+		}
+		progress.Orders++
+		progress.Revenue += order.Price
+	}
+	if progress.Goal > 0 {
+		progress.Percent = float64(progress.Revenue) * 100 / float64(progress.Goal)
+		progress.Reached = progress.Revenue >= progress.Goal
+	}
+	return progress, nil
+}
+
+// ReachedRevenueGoal returns the progress of the current month once its goal
+// is reached, and nil before then or after it was already returned, so the
+// admins are told only once.
+func (s *ShopService) ReachedRevenueGoal() (*ShopRevenueGoalProgress, error) {
+	progress, err := s.RevenueGoalProgress("")
+	if err != nil || !progress.Reached || !progress.ReachedAt.IsZero() {
+		return nil, err
+	}
+	now := time.Now()
+	result := database.GetShopDB().Model(&model.ShopRevenueGoal{}).
+		Where("month = ? AND (reached_at IS NULL OR reached_at = ?)", progress.Month, time.Time{}).
+		Update("reached_at", now)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	progress.ReachedAt = now
+	return progress, nil
+}
+
+// WeeklySummary sums up the seven days before now: the approved orders and
+// their revenue, the package sold most often, the subscriptions lost and the
+// progress of the current month towards its goal.
+func (s *ShopService) WeeklySummary(now time.Time) (*ShopWeeklySummary, error) {
+	since := now.AddDate(0, 0, -7)
+	orders, err := approvedOrdersSince(since)
+	if err != nil {
+		return nil, err
+	}
+	summary := &ShopWeeklySummary{Since: since}
+	sold := map[int]int{}
+	for _, order := range orders {
+		summary.Orders++
+		summary.Revenue += order.Price
+		if order.PackageId != nil {
+			sold[*order.PackageId]++
+		}
+	}
+	for id, count := range sold {
+		if count > summary.TopPackageOrders || count == summary.TopPackageOrders && id < summary.TopPackageId {
+			summary.TopPackageId, summary.TopPackageOrders = id, count
+		}
+	}
+	if summary.TopPackageId != 0 {
+		if pkg, err := s.GetPackage(summary.TopPackageId); err == nil {
+			summary.TopPackage = pkg.Name
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	db := database.GetShopDB()
+	var churned, active int64
+	err = db.Model(&model.ShopSubscription{}).
+		Where("status IN ? AND updated_at >= ?", []string{SubscriptionStatusSuspended, SubscriptionStatusCancelled}, since).
+		Count(&churned).Error
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Model(&model.ShopSubscription{}).Where("status = ?", SubscriptionStatusActive).Count(&active).Error; err != nil {
+		return nil, err
+	}
+	summary.Churned = int(churned)
+	if churned+active > 0 {
+		summary.ChurnRate = float64(churned) * 100 / float64(churned+active)
+	}
+
+	progress, err := s.RevenueGoalProgress(now.In(s.Location()).Format(shopGoalMonthLayout))
+	if err != nil {
+		return nil, err
+	}
+	if progress.Goal > 0 {
+		summary.Goal = progress
+	}
+	return summary, nil
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// Statuses of a shop health component.
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusDown = "down"
+	HealthStatusOff  = "off" // Not configured, so not checked
+)
+
+// ErrHealthCheckOff is returned by a health check whose component is turned
+// off or not configured.
+var ErrHealthCheckOff = errors.New("not configured")
+
+// ShopHealthComponent is the result of checking one component the shop
+// depends on.
+type ShopHealthComponent struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+// ShopHealthReport is the state of the components the shop depends on. It is
+// healthy while none of them is down.
+type ShopHealthReport struct {
+	Healthy    bool                  `json:"healthy"`
+	CheckedAt  time.Time             `json:"checkedAt"`
+	Components []ShopHealthComponent `json:"components"`
+}
+
+// Check runs a component's check and records its result.
+func (r *ShopHealthReport) Check(name string, check func() error) {
+	started := time.Now()
+	err := check()
+	component := ShopHealthComponent{Name: name, Status: HealthStatusOK, LatencyMs: time.Since(started).Milliseconds()}
+	switch {
+	case errors.Is(err, ErrHealthCheckOff):
+		component.Status = HealthStatusOff
+	case err != nil:
+		component.Status, component.Error = HealthStatusDown, err.Error()
+		r.Healthy = false
+	}
+	r.Components = append(r.Components, component)
+}
+
+// HealthCheck checks the shop database, the receipt storage, the configured
+// payment gateway and Lightning node, and the Xray API. The Telegram bot is
+// checked by the caller, which owns it.
+func (s *ShopService) HealthCheck(ctx context.Context) *ShopHealthReport {
+	report := &ShopHealthReport{Healthy: true, CheckedAt: time.Now()}
+	report.Check("database", func() error {
+		db, err := database.GetShopDB().DB()
+		if err != nil {
+			return err
+		}
+		return db.PingContext(ctx)
+	})
+	report.Check("receipts", checkReceiptStorage)
+	report.Check("gateway", func() error {
+		name, _ := s.settingService.GetShopGateway()
+		gateway := getShopPaymentGateway(name)
+		if gateway == nil {
+			return ErrHealthCheckOff
+		}
+		currency, _ := s.settingService.GetShopGatewayCurrency()
+		checkout, err := gateway.Checkout(&model.ShopOrder{Number: "HEALTH"}, "1.00", currency, "", "")
+		if err != nil {
+			return err
+		}
+		return checkReachable(ctx, checkout.Action)
+	})
+	report.Check("lightning", func() error {
+		if backend, _ := s.settingService.GetShopLightningBackend(); backend == "" {
+			return ErrHealthCheckOff
+		}
+		endpoint, _ := s.settingService.GetShopLightningUrl()
+		return checkReachable(ctx, endpoint)
+	})
+	report.Check("xray", func() error {
+		return s.xrayService.CheckXrayAPI(ctx)
+	})
+	return report
+}
+
+// checkReceiptStorage tells whether receipt images can be written.
+func checkReceiptStorage() error {
+	if err := os.MkdirAll(ShopReceiptDir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(ShopReceiptDir, ".health-*")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	file.Close()
+	return os.Remove(name)
+}
+
+// checkReachable tells whether a web server answers at endpoint. Any answer
+// but a server error will do, as the address may expect another request.
+func checkReachable(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, http.NoBody)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// shopHoldableStatuses are the statuses an order can be put on hold from.
+var shopHoldableStatuses = []string{OrderStatusPendingReceipt, OrderStatusPendingReview}
+
+// HoldOrder puts an order awaiting its receipt or review on hold until the
+// customer answers the question in reason.
+func (s *ShopService) HoldOrder(id int, reason string) (*model.ShopOrder, error) {
+	reason = strings.TrimSpace(reason)
+	v := &shopValidator{}
+	v.text("reason", reason, true, shopValueMaxLength)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	result := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ? AND status IN ?", id, shopHoldableStatuses).
+		Updates(map[string]any{
+			"status":           OrderStatusOnHold,
+			"hold_reason":      reason,
+			"held_from_status": order.Status,
+			"updated_at":       time.Now(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("order is not awaiting a receipt or review")
+	}
+	order.HeldFromStatus, order.Status, order.HoldReason = order.Status, OrderStatusOnHold, reason
+	publishOrderStatus(id, OrderStatusOnHold)
+	return order, nil
+}
+
+// ResumeOrder takes an order off hold, back to the status it was held from.
+func (s *ShopService) ResumeOrder(id int) (*model.ShopOrder, error) {
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	status := order.HeldFromStatus
+	if status == "" {
+		status = OrderStatusPendingReview
+	}
+	result := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ? AND status = ?", id, OrderStatusOnHold).
+		Updates(map[string]any{
+			"status":           status,
+			"hold_reason":      "",
+			"held_from_status": "",
+			"updated_at":       time.Now(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("order is not on hold")
+	}
+	order.Status, order.HoldReason, order.HeldFromStatus = status, "", ""
+	publishOrderStatus(id, status)
+	return order, nil
+}
+
+// AnswerHeldOrder records a customer's answer to the question an order was
+// put on hold for as a comment, and resumes the order.
+func (s *ShopService) AnswerHeldOrder(id int, author, answer string) (*model.ShopOrder, error) {
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != OrderStatusOnHold {
+		return nil, errors.New("order is not on hold")
+	}
+	if answer = strings.TrimSpace(answer); answer != "" {
+		if _, err := s.AddOrderComment(id, author, answer); err != nil {
+			return nil, err
+		}
+	}
+	return s.ResumeOrder(id)
+}
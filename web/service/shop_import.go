@@ -0,0 +1,211 @@
+package service
+
+import (
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ShopImportResult summarizes a historical order import.
+type ShopImportResult struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Unlinked int      `json:"unlinked"`
+	Errors   []string `json:"errors"`
+}
+
+// importDateLayouts lists the date formats accepted in the date column.
+var importDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02",
+	"02.01.2006",
+}
+
+// ImportOrdersCSV creates approved orders from a CSV of past manual sales.
+// The first row must be a header naming the buyer, package, amount, date and email columns;
+// amounts are decimals in the shop currency, such as 12.50 or 1,250,000;
+// optional phone and contact_email columns let buyers without Telegram get notifications
+// by SMS, WhatsApp or email.
+// Each row is fingerprinted so importing the same file again skips rows already imported.
+// Identical sales, such as two of a package on the same day, are told apart by the
+// optional id column holding the source's own sale ID, or else by their order in the file.
+func (s *ShopService) ImportOrdersCSV(r io.Reader) (*ShopImportResult, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("csv header missing")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"buyer", "package", "amount", "date", "email"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("csv column %q missing", name)
+		}
+	}
+
+	packages, err := s.ListPackages(ShopPackageFilter{IncludeArchived: true})
+	if err != nil {
+		return nil, err
+	}
+
+	_, hasId := columns["id"]
+	occurrences := map[string]int{}
+	result := &ShopImportResult{Errors: []string{}}
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		field := func(name string) string {
+			idx := columns[name]
+			if idx >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+
+		order, err := s.buildImportedOrder(packages, field("buyer"), field("package"), field("amount"), field("date"), field("email"))
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		if id := field("id"); hasId && id != "" {
+			order.ImportRef = importRefVariant(order.ImportRef, "id:"+id)
+		} else {
+			occurrences[order.ImportRef]++
+			if n := occurrences[order.ImportRef]; n > 1 {
+				order.ImportRef = importRefVariant(order.ImportRef, "#"+strconv.Itoa(n))
+			}
+		}
+		if _, ok := columns["phone"]; ok {
+			order.Phone = field("phone")
+		}
+		if _, ok := columns["contact_email"]; ok {
+			order.ContactEmail = field("contact_email")
+		}
+
+		var count int64
+		if err := database.GetShopDB().Model(&model.ShopOrder{}).Where("import_ref = ?", order.ImportRef).Count(&count).Error; err != nil {
+			return result, err
+		}
+		if count > 0 {
+			result.Skipped++
+			continue
+		}
+
+		if order.ClientEmail != "" && !s.linkImportedClient(order) {
+			result.Unlinked++
+		}
+		if err := s.assignOrderNumber(database.GetShopDB(), order); err != nil {
+			return result, err
+		}
+		if err := database.GetShopDB().Create(order).Error; err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		result.Imported++
+	}
+	return result, nil
+}
+
+func (s *ShopService) buildImportedOrder(packages []model.ShopPackage, buyer, pkgRef, amount, date, email string) (*model.ShopOrder, error) {
+	order := &model.ShopOrder{
+		Status:      OrderStatusApproved,
+		ClientEmail: email,
+	}
+
+	if buyer != "" {
+		tgId, err := strconv.ParseInt(buyer, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid buyer telegram id %q", buyer)
+		}
+		order.TelegramId = tgId
+	}
+
+	if pkgRef != "" {
+		var found *model.ShopPackage
+		pkgId, idErr := strconv.Atoi(pkgRef)
+		for i := range packages {
+			if (idErr == nil && packages[i].Id == pkgId) || strings.EqualFold(packages[i].Name, pkgRef) {
+				found = &packages[i]
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("package %q not found", pkgRef)
+		}
+		order.PackageId = &found.Id
+	}
+
+	price, err := ParsePrice(amount, s.Currency().Code)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount %q", amount)
+	}
+	order.Price = price
+
+	var createdAt time.Time
+	loc := s.Location()
+	for _, layout := range importDateLayouts {
+		if createdAt, err = time.ParseInLocation(layout, date, loc); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid date %q", date)
+	}
+	order.CreatedAt = createdAt
+	order.UpdatedAt = createdAt
+
+	sum := sha1.Sum([]byte(strings.Join([]string{buyer, strings.ToLower(pkgRef), amount, createdAt.UTC().Format(time.RFC3339), strings.ToLower(email)}, "|")))
+	order.ImportRef = hex.EncodeToString(sum[:])
+	return order, nil
+}
+
+// importRefVariant returns the fingerprint of a sale with the same details as
+// the one fingerprinted ref, told apart from it by distinct.
+func importRefVariant(ref, distinct string) string {
+	sum := sha1.Sum([]byte(ref + "|" + distinct))
+	return hex.EncodeToString(sum[:])
+}
+
+// linkImportedClient fills the inbound and client identifiers of an imported
+// order from the existing client with the same email, if there is one.
+func (s *ShopService) linkImportedClient(order *model.ShopOrder) bool {
+	traffic, client, err := s.inboundService.GetClientByEmail(order.ClientEmail)
+	if err != nil || traffic == nil || client == nil {
+		return false
+	}
+	order.InboundId = traffic.InboundId
+	order.ClientId = client.ID
+	if order.ClientId == "" {
+		order.ClientId = client.Password
+	}
+	order.ClientSubId = client.SubID
+	if order.TelegramId == 0 {
+		order.TelegramId = client.TgID
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// ErrOrderNotFullyPaid is returned when approving an order paid in part that
+// has to wait for the rest of its price.
+var ErrOrderNotFullyPaid = errors.New("order is not fully paid yet")
+
+// OrderBalance returns what is left to pay for an order. An order without
+// recorded payments counts as paid in one go by its receipt.
+func OrderBalance(order *model.ShopOrder) int64 {
+	if order.PaidAmount == 0 || order.PaidAmount >= order.Price {
+		return 0
+	}
+	return order.Price - order.PaidAmount
+}
+
+// ListOrderPayments returns the payments recorded for an order, oldest first.
+func (s *ShopService) ListOrderPayments(orderId int) ([]model.ShopOrderPayment, error) {
+	payments := []model.ShopOrderPayment{}
+	err := database.GetShopDB().Where("order_id = ?", orderId).Order("id asc").Find(&payments).Error
+	return payments, err
+}
+
+// RecordOrderPayment adds an installment to an order. While a balance remains,
+// an order under review goes back to awaiting a receipt for the next
+// installment, unless partially paid orders may be provisioned. Once an order
+// provisioned in part is fully paid, its withheld traffic is handed out; the
+// returned bool tells whether Xray needs a restart for that.
+func (s *ShopService) RecordOrderPayment(orderId int, amount int64, note, author string) (*model.ShopOrder, bool, error) {
+	order, err := s.GetOrder(orderId)
+	if err != nil {
+		return nil, false, err
+	}
+	if order.Status == OrderStatusRejected {
+		return nil, false, errors.New("order is rejected")
+	}
+	if order.Status == OrderStatusChargeback {
+		return nil, false, errors.New("order was charged back")
+	}
+	paid := order.PaidAmount
+	note = strings.TrimSpace(note)
+	v := &shopValidator{}
+	v.positive("amount", amount)
+	if amount > order.Price-paid {
+		v.add("amount", "shop.invalid.aboveMax", "Max=="+s.FormatPrice(order.Price-paid))
+	}
+	v.text("note", note, false, shopValueMaxLength)
+	if err := v.err(); err != nil {
+		return nil, false, err
+	}
+
+	status := order.Status
+	if order.Status == OrderStatusPendingReview && paid+amount < order.Price {
+		if partial, _ := s.settingService.GetShopPartialProvision(); !partial {
+			status = OrderStatusPendingReceipt
+		}
+	}
+	err = database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&model.ShopOrder{}).Where("id = ? AND status = ? AND paid_amount = ?", orderId, order.Status, paid).
+			Updates(map[string]any{
+				"paid_amount": paid + amount,
+				"status":      status,
+				"updated_at":  time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("order changed meanwhile")
+		}
+		return tx.Create(&model.ShopOrderPayment{
+			OrderId:   orderId,
+			Amount:    amount,
+			Note:      note,
+			Author:    author,
+			CreatedAt: time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	order.PaidAmount = paid + amount
+	if status != order.Status {
+		order.Status = status
+		publishOrderStatus(order.Id, status)
+	}
+	if order.Status != OrderStatusApproved || order.WithheldDataGB == 0 || OrderBalance(order) > 0 {
+		return order, false, nil
+	}
+	needRestart, err := s.releaseWithheldData(order)
+	return order, needRestart, err
+}
+
+// CheckOrderPaid tells whether an order may be provisioned. An order with a
+// balance left has to wait for it unless partially paid orders may be
+// provisioned and the order creates new clients with limited traffic on a
+// local inbound, the only ones whose quota can be held back.
+func (s *ShopService) CheckOrderPaid(order *model.ShopOrder) error {
+	if OrderBalance(order) == 0 {
+		return nil
+	}
+	if partial, _ := s.settingService.GetShopPartialProvision(); !partial {
+		return ErrOrderNotFullyPaid
+	}
+	if order.NodeId > 0 || order.ItemCount > 0 || order.SubscriptionId > 0 || order.UpgradeFromOrderId > 0 {
+		return ErrOrderNotFullyPaid
+	}
+	dataGB := order.CustomDataGB
+	if order.PackageId != nil {
+		pkg, err := s.GetPackage(*order.PackageId)
+		if err != nil {
+			return err
+		}
+		if pkg.Type == PackageTypeTopUp {
+			return ErrOrderNotFullyPaid
+		}
+		dataGB = pkg.DataGB
+	}
+	if dataGB == 0 {
+		return ErrOrderNotFullyPaid
+	}
+	return nil
+}
+
+// WithheldData returns how much of dataGB a partially paid order holds back,
+// leaving the customer traffic in proportion to what was paid and at least 1 GB.
+func WithheldData(order *model.ShopOrder, dataGB int) int {
+	if dataGB == 0 || OrderBalance(order) == 0 {
+		return 0
+	}
+	granted := int(int64(dataGB) * order.PaidAmount / order.Price)
+	return dataGB - max(granted, 1)
+}
+
+// releaseWithheldData adds the traffic held back from an order to its clients
+// and clears it from the order.
+func (s *ShopService) releaseWithheldData(order *model.ShopOrder) (bool, error) {
+	const gb = int64(1024 * 1024 * 1024)
+	needRestart := false
+	for _, email := range s.OrderClientEmails(order) {
+		traffic, _, err := s.inboundService.GetClientByEmail(email)
+		if err != nil {
+			return needRestart, err
+		}
+		if traffic == nil {
+			return needRestart, errors.New("client of the order not found")
+		}
+		totalGB := int(traffic.Total/gb) + order.WithheldDataGB
+		restart, err := s.inboundService.ResetClientTrafficLimitByEmail(email, totalGB)
+		if err != nil {
+			return needRestart, err
+		}
+		needRestart = needRestart || restart
+		if !traffic.Enable && (traffic.ExpiryTime <= 0 || traffic.ExpiryTime > time.Now().UnixMilli()) {
+			_, restart, err := s.inboundService.SetClientEnableByEmail(email, true)
+			if err != nil {
+				return needRestart, err
+			}
+			needRestart = needRestart || restart
+		}
+	}
+	updates := map[string]any{"withheld_data_gb": 0, "updated_at": time.Now()}
+	if order.PoolBytes > 0 {
+		order.PoolBytes += int64(order.WithheldDataGB) * gb
+		updates["pool_bytes"] = order.PoolBytes
+	}
+	order.WithheldDataGB = 0
+	return needRestart, database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", order.Id).Updates(updates).Error
+}
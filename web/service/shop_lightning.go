@@ -0,0 +1,302 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+)
+
+// lightningInvoiceTTL is how long an order's Lightning invoice can be paid. A
+// customer asking to pay later gets a new one.
+const lightningInvoiceTTL = time.Hour
+
+// LightningInvoice is an invoice created on a Lightning node.
+type LightningInvoice struct {
+	Hash           string // Payment hash, hex encoded
+	PaymentRequest string // BOLT11 invoice the customer pays
+}
+
+// ShopLightningBackend creates invoices on a Lightning node and tells whether
+// they were paid.
+type ShopLightningBackend interface {
+	CreateInvoice(ctx context.Context, sats int64, memo string, expiry time.Duration) (*LightningInvoice, error)
+	InvoiceSettled(ctx context.Context, hash string) (bool, error)
+}
+
+var (
+	shopLightningBackendsMu sync.RWMutex
+	shopLightningBackends   = map[string]ShopLightningBackend{
+		"lnbits": &lnbitsBackend{},
+		"lnd":    &lndBackend{},
+	}
+)
+
+// RegisterShopLightningBackend makes a Lightning backend selectable by name in
+// the shop settings.
+func RegisterShopLightningBackend(name string, backend ShopLightningBackend) {
+	shopLightningBackendsMu.Lock()
+	defer shopLightningBackendsMu.Unlock()
+	shopLightningBackends[name] = backend
+}
+
+func getShopLightningBackend(name string) ShopLightningBackend {
+	shopLightningBackendsMu.RLock()
+	defer shopLightningBackendsMu.RUnlock()
+	return shopLightningBackends[name]
+}
+
+// lightningBackend returns the configured Lightning backend, or nil when
+// Lightning payments are off.
+func (s *ShopService) lightningBackend() ShopLightningBackend {
+	name, _ := s.settingService.GetShopLightningBackend()
+	if name == "" {
+		return nil
+	}
+	if rate, err := s.satsPerUnit(); err != nil || rate <= 0 {
+		return nil
+	}
+	return getShopLightningBackend(name)
+}
+
+// LightningEnabled tells whether customers can pay orders over Lightning.
+func (s *ShopService) LightningEnabled() bool {
+	return s.lightningBackend() != nil
+}
+
+// satsPerUnit returns the satoshis charged per whole unit of the shop currency.
+func (s *ShopService) satsPerUnit() (float64, error) {
+	value, err := s.settingService.GetShopSatsPerUnit()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(value), 64)
+}
+
+// OrderLightningInvoice returns a Lightning invoice for an order awaiting its
+// receipt, reusing the order's invoice while it can still be paid. Only orders
+// with nothing paid yet, whose package accepts Lightning, get one.
+func (s *ShopService) OrderLightningInvoice(order *model.ShopOrder) (*model.ShopOrder, error) {
+	backend := s.lightningBackend()
+	if backend == nil {
+		return nil, errors.New("Lightning payments are off")
+	}
+	if order.Status != OrderStatusPendingReceipt || order.PaidAmount != 0 {
+		return nil, errors.New("order is not awaiting payment")
+	}
+	if !s.PaymentMethodAllowed(order, PaymentMethodLightning) {
+		return nil, errors.New("package does not accept Lightning payments")
+	}
+	rate, err := s.satsPerUnit()
+	if err != nil {
+		return nil, err
+	}
+	units := float64(order.Price) / float64(minorUnitScale(CurrencyExponent(s.Currency().Code)))
+	sats := math.Ceil(units*rate - 1e-9)
+	if sats > math.MaxInt64/2 {
+		return nil, ErrPriceOverflow
+	}
+	amount := max(int64(sats), 1)
+	if order.LightningHash != "" && order.LightningSats == amount && time.Since(order.LightningInvoiceAt) < lightningInvoiceTTL-5*time.Minute {
+		return order, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	invoice, err := backend.CreateInvoice(ctx, amount, "Order "+OrderNumber(order), lightningInvoiceTTL)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ? AND status = ?", order.Id, OrderStatusPendingReceipt).
+		Updates(map[string]any{
+			"lightning_hash":       invoice.Hash,
+			"lightning_invoice":    invoice.PaymentRequest,
+			"lightning_sats":       amount,
+			"lightning_invoice_at": now,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("order status changed meanwhile")
+	}
+	order.LightningHash, order.LightningInvoice = invoice.Hash, invoice.PaymentRequest
+	order.LightningSats, order.LightningInvoiceAt = amount, now
+	return order, nil
+}
+
+// SettledLightningOrders checks the open Lightning invoices of the orders
+// awaiting their receipt and readies those paid for approval, keeping the
+// payment hash in place of the reference read from a receipt.
+func (s *ShopService) SettledLightningOrders() ([]*model.ShopOrder, error) {
+	backend := s.lightningBackend()
+	if backend == nil {
+		return nil, nil
+	}
+	var orders []model.ShopOrder
+	err := database.GetShopDB().Where("status = ? AND lightning_hash <> ''", OrderStatusPendingReceipt).
+		Where("lightning_invoice_at > ?", time.Now().Add(-2*lightningInvoiceTTL)).
+		Order("id asc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	settled := []*model.ShopOrder{}
+	errs := []error{}
+	for _, order := range orders {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		paid, err := backend.InvoiceSettled(ctx, order.LightningHash)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("order %d: %w", order.Id, err))
+			continue
+		}
+		if !paid {
+			continue
+		}
+		confirmed, err := s.ConfirmStatementPayment(order.Id, "lightning:"+order.LightningHash)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("order %d: %w", order.Id, err))
+			continue
+		}
+		settled = append(settled, confirmed)
+	}
+	return settled, common.Combine(errs...)
+}
+
+// lightningRequest sends a JSON request to a Lightning node's REST API and
+// decodes the JSON answer into out.
+func lightningRequest(ctx context.Context, method, endpoint string, header http.Header, in, out any) error {
+	var body io.Reader = http.NoBody
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Lightning node returned status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// lnbitsBackend creates invoices through the LNbits wallet API.
+type lnbitsBackend struct {
+	settingService SettingService
+}
+
+func (b *lnbitsBackend) config() (string, http.Header, error) {
+	endpoint, _ := b.settingService.GetShopLightningUrl()
+	apiKey, _ := b.settingService.GetShopLightningApiKey()
+	if endpoint == "" || apiKey == "" {
+		return "", nil, errors.New("LNbits URL or API key not configured")
+	}
+	return strings.TrimRight(endpoint, "/"), http.Header{"X-Api-Key": {apiKey}}, nil
+}
+
+func (b *lnbitsBackend) CreateInvoice(ctx context.Context, sats int64, memo string, expiry time.Duration) (*LightningInvoice, error) {
+	endpoint, header, err := b.config()
+	if err != nil {
+		return nil, err
+	}
+	in := map[string]any{"out": false, "amount": sats, "memo": memo, "expiry": int(expiry.Seconds())}
+	var out struct {
+		PaymentHash    string `json:"payment_hash"`
+		PaymentRequest string `json:"payment_request"`
+		Bolt11         string `json:"bolt11"`
+	}
+	if err := lightningRequest(ctx, http.MethodPost, endpoint+"/api/v1/payments", header, in, &out); err != nil {
+		return nil, err
+	}
+	if out.PaymentRequest == "" {
+		out.PaymentRequest = out.Bolt11
+	}
+	if out.PaymentHash == "" || out.PaymentRequest == "" {
+		return nil, errors.New("LNbits returned no invoice")
+	}
+	return &LightningInvoice{Hash: out.PaymentHash, PaymentRequest: out.PaymentRequest}, nil
+}
+
+func (b *lnbitsBackend) InvoiceSettled(ctx context.Context, hash string) (bool, error) {
+	endpoint, header, err := b.config()
+	if err != nil {
+		return false, err
+	}
+	var out struct {
+		Paid bool `json:"paid"`
+	}
+	err = lightningRequest(ctx, http.MethodGet, endpoint+"/api/v1/payments/"+hash, header, nil, &out)
+	return out.Paid, err
+}
+
+// lndBackend creates invoices through the LND REST API.
+type lndBackend struct {
+	settingService SettingService
+}
+
+func (b *lndBackend) config() (string, http.Header, error) {
+	endpoint, _ := b.settingService.GetShopLightningUrl()
+	macaroon, _ := b.settingService.GetShopLightningApiKey()
+	if endpoint == "" || macaroon == "" {
+		return "", nil, errors.New("LND URL or macaroon not configured")
+	}
+	return strings.TrimRight(endpoint, "/"), http.Header{"Grpc-Metadata-Macaroon": {macaroon}}, nil
+}
+
+func (b *lndBackend) CreateInvoice(ctx context.Context, sats int64, memo string, expiry time.Duration) (*LightningInvoice, error) {
+	endpoint, header, err := b.config()
+	if err != nil {
+		return nil, err
+	}
+	in := map[string]any{"value": strconv.FormatInt(sats, 10), "memo": memo, "expiry": strconv.Itoa(int(expiry.Seconds()))}
+	var out struct {
+		RHash          string `json:"r_hash"`
+		PaymentRequest string `json:"payment_request"`
+	}
+	if err := lightningRequest(ctx, http.MethodPost, endpoint+"/v1/invoices", header, in, &out); err != nil {
+		return nil, err
+	}
+	hash, err := base64.StdEncoding.DecodeString(out.RHash)
+	if err != nil || len(hash) == 0 || out.PaymentRequest == "" {
+		return nil, errors.New("LND returned no invoice")
+	}
+	return &LightningInvoice{Hash: hex.EncodeToString(hash), PaymentRequest: out.PaymentRequest}, nil
+}
+
+func (b *lndBackend) InvoiceSettled(ctx context.Context, hash string) (bool, error) {
+	endpoint, header, err := b.config()
+	if err != nil {
+		return false, err
+	}
+	var out struct {
+		State string `json:"state"`
+	}
+	err = lightningRequest(ctx, http.MethodGet, endpoint+"/v1/invoice/"+hash, header, nil, &out)
+	return out.State == "SETTLED", err
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"embed"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"golang.org/x/text/language"
+)
+
+// The shop bot catalog has one JSON file per language, named by its language
+// code (e.g. fa.json). Adding a file is enough to offer a new language;
+// messages missing from it fall back to English.
+//
+//go:embed shop_locales/*.json
+var shopLocaleFS embed.FS
+
+const shopDefaultLanguage = "en"
+
+// ShopLanguage is a language the shop bot can be used in.
+type ShopLanguage struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+var (
+	shopCatalogOnce sync.Once
+	shopCatalog     *i18n.Bundle
+	shopLocalizers  sync.Map // language code -> *i18n.Localizer
+	shopCustomerMu  sync.RWMutex
+	shopCustomerLng = map[int64]string{}
+)
+
+func shopLocaleBundle() *i18n.Bundle {
+	shopCatalogOnce.Do(func() {
+		shopCatalog = i18n.NewBundle(language.English)
+		files, err := fs.Glob(shopLocaleFS, "shop_locales/*.json")
+		if err != nil {
+			logger.WithFields(logger.Fields{"error": err}).Error("list shop locales failed")
+			return
+		}
+		for _, file := range files {
+			data, err := shopLocaleFS.ReadFile(file)
+			if err != nil {
+				logger.WithFields(logger.Fields{"error": err}).Error("read shop locale failed")
+				continue
+			}
+			if _, err := shopCatalog.ParseMessageFileBytes(data, file); err != nil {
+				logger.WithFields(logger.Fields{"file": file, "error": err}).Error("parse shop locale failed")
+			}
+		}
+	})
+	return shopCatalog
+}
+
+// ShopText returns a shop bot message in the given language. Params use the
+// same Name==value form as the panel's I18n helpers.
+func ShopText(lang, key string, params ...string) string {
+	var localizer *i18n.Localizer
+	if cached, ok := shopLocalizers.Load(lang); ok {
+		localizer = cached.(*i18n.Localizer)
+	} else {
+		localizer = i18n.NewLocalizer(shopLocaleBundle(), lang, shopDefaultLanguage)
+		shopLocalizers.Store(lang, localizer)
+	}
+	data := make(map[string]any, len(params))
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "==")
+		data[name] = value
+	}
+	// A message missing from the language comes back in English along with an error.
+	msg, err := localizer.Localize(&i18n.LocalizeConfig{MessageID: key, TemplateData: data})
+	if msg == "" {
+		logger.WithFields(logger.Fields{"key": key, "error": err}).Warning("shop text missing")
+		return key
+	}
+	return msg
+}
+
+// ShopLanguages lists the languages of the shop bot catalog.
+func ShopLanguages() []ShopLanguage {
+	var languages []ShopLanguage
+	for _, tag := range shopLocaleBundle().LanguageTags() {
+		code := tag.String()
+		languages = append(languages, ShopLanguage{Code: code, Name: ShopText(code, "shop.languageName")})
+	}
+	return languages
+}
+
+// MatchShopLanguage returns the catalog language closest to a Telegram
+// language code, or an empty string when none is close enough.
+func MatchShopLanguage(code string) string {
+	if code == "" {
+		return ""
+	}
+	tags := shopLocaleBundle().LanguageTags()
+	_, index, confidence := language.NewMatcher(tags).Match(language.Make(code))
+	if confidence < language.High {
+		return ""
+	}
+	return tags[index].String()
+}
+
+// MatchShopAcceptLanguage returns the catalog language preferred by an HTTP
+// Accept-Language header, or the default language when none matches.
+func MatchShopAcceptLanguage(header string) string {
+	tags, _, _ := language.ParseAcceptLanguage(header)
+	for _, tag := range tags {
+		if lang := MatchShopLanguage(tag.String()); lang != "" {
+			return lang
+		}
+	}
+	return shopDefaultLanguage
+}
+
+// GetCustomerLanguage returns the bot language chosen by or detected for a customer.
+func (s *ShopService) GetCustomerLanguage(tgId int64) string {
+	shopCustomerMu.RLock()
+	lang, ok := shopCustomerLng[tgId]
+	shopCustomerMu.RUnlock()
+	if ok {
+		return lang
+	}
+	customer := &model.ShopCustomer{}
+	if err := database.GetShopDB().Where("telegram_id = ?", tgId).Limit(1).Find(customer).Error; err != nil {
+		return ""
+	}
+	shopCustomerMu.Lock()
+	shopCustomerLng[tgId] = customer.Language
+	shopCustomerMu.Unlock()
+	return customer.Language
+}
+
+// SetCustomerLanguage stores a customer's bot language.
+func (s *ShopService) SetCustomerLanguage(tgId int64, lang string) error {
+	db := database.GetShopDB()
+	customer := &model.ShopCustomer{}
+	if err := db.Where("telegram_id = ?", tgId).Limit(1).Find(customer).Error; err != nil {
+		return err
+	}
+	if customer.TelegramId == 0 {
+		customer.TelegramId = tgId
+		customer.CreatedAt = time.Now()
+	}
+	customer.Language = lang
+	customer.UpdatedAt = time.Now()
+	if err := db.Save(customer).Error; err != nil {
+		return err
+	}
+	shopCustomerMu.Lock()
+	shopCustomerLng[tgId] = lang
+	shopCustomerMu.Unlock()
+	return nil
+}
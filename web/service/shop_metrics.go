@@ -0,0 +1,163 @@
+package service
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Shop and bot metrics exported on /metrics. Counters and histograms are
+// process-lifetime; queue sizes and revenue are read from the database on
+// every scrape so they survive restarts.
+var (
+	shopOrderEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "xui_shop_order_events_total",
+		Help: "Shop orders created, approved and rejected.",
+	}, []string{"event"})
+
+	shopProvisionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "xui_shop_provision_duration_seconds",
+		Help:    "Time taken to provision the clients of an approved order.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"result"})
+
+	shopReceiptBytes = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "xui_shop_receipt_upload_bytes",
+		Help:    "Size of receipt images uploaded by customers.",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 2, 8),
+	})
+
+	shopRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "xui_shop_http_rate_limited_total",
+		Help: "Shop HTTP requests rejected with 429 by the rate limit, by route group and key kind.",
+	}, []string{"scope", "key"})
+
+	botUpdateDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "xui_tgbot_update_duration_seconds",
+		Help:    "Time taken to process a Telegram update.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	shopPendingOrdersDesc = prometheus.NewDesc("xui_shop_orders_pending",
+		"Orders waiting for a receipt, for review, on hold or in the provisioning queue.", []string{"status"}, nil)
+	shopOldestPendingDesc = prometheus.NewDesc("xui_shop_oldest_pending_review_seconds",
+		"Age of the oldest order waiting for review, 0 when the queue is empty.", nil, nil)
+	shopRevenueDesc = prometheus.NewDesc("xui_shop_revenue_total",
+		"Sum of the prices of all approved orders.", nil, nil)
+	shopApprovedDesc = prometheus.NewDesc("xui_shop_orders_approved",
+		"Number of approved orders in the database.", nil, nil)
+	shopCartRemindersDesc = prometheus.NewDesc("xui_shop_cart_reminders",
+		"Unpaid orders whose customer was reminded, and those recovered by a receipt afterwards.", []string{"outcome"}, nil)
+)
+
+// Order events counted by xui_shop_order_events_total.
+const (
+	OrderEventCreated    = "created"
+	OrderEventApproved   = "approved"
+	OrderEventRejected   = "rejected"
+	OrderEventChargeback = "chargeback"
+)
+
+// ShopMetricsRegistry holds the shop metrics together with the Go runtime and
+// process collectors.
+var ShopMetricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	ShopMetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		shopOrderEvents,
+		shopProvisionDuration,
+		shopReceiptBytes,
+		shopRateLimited,
+		botUpdateDuration,
+		shopQueueCollector{},
+	)
+}
+
+func countOrderEvent(event string) {
+	shopOrderEvents.WithLabelValues(event).Inc()
+}
+
+func observeProvision(start time.Time, err *error) {
+	result := "ok"
+	if *err != nil {
+		result = "error"
+	}
+	shopProvisionDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// CountRateLimited counts a shop HTTP request rejected by the rate limit. scope
+// is the group of routes limited and key the kind of key that was over, such as
+// "ip" or "user".
+func CountRateLimited(scope, key string) {
+	shopRateLimited.WithLabelValues(scope, key).Inc()
+}
+
+func observeBotUpdate(kind string, start time.Time) {
+	botUpdateDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+}
+
+// shopQueueCollector reports the order queues and revenue from the database.
+type shopQueueCollector struct{}
+
+func (shopQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- shopPendingOrdersDesc
+	ch <- shopOldestPendingDesc
+	ch <- shopRevenueDesc
+	ch <- shopApprovedDesc
+	ch <- shopCartRemindersDesc
+}
+
+func (shopQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	db := database.GetShopDB()
+	if db == nil {
+		return
+	}
+	for _, status := range []string{OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusOnHold, OrderStatusScheduled, OrderStatusProvisioning} {
+		var count int64
+		if err := db.Model(&model.ShopOrder{}).Where("status = ?", status).Count(&count).Error; err != nil {
+			logger.WithFields(logger.Fields{"error": err}).Warning("collect shop metrics failed")
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(shopPendingOrdersDesc, prometheus.GaugeValue, float64(count), status)
+	}
+
+	var oldest []model.ShopOrder
+	db.Where("status = ?", OrderStatusPendingReview).Order("updated_at asc").Limit(1).Find(&oldest)
+	age := 0.0
+	if len(oldest) > 0 {
+		age = time.Since(oldest[0].UpdatedAt).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(shopOldestPendingDesc, prometheus.GaugeValue, age)
+
+	var totals struct {
+		Count   int64
+		Revenue int64
+	}
+	var archived struct {
+		Count   int64
+		Revenue int64
+	}
+	db.Model(&model.ShopOrder{}).Select("COUNT(*) AS count, COALESCE(SUM(price), 0) AS revenue").
+		Where("status = ?", OrderStatusApproved).Scan(&totals)
+	db.Model(&model.ShopOrderArchive{}).Select("COUNT(*) AS count, COALESCE(SUM(price), 0) AS revenue").
+		Where("status = ?", OrderStatusApproved).Scan(&archived)
+	totals.Count += archived.Count
+	totals.Revenue += archived.Revenue
+	ch <- prometheus.MustNewConstMetric(shopRevenueDesc, prometheus.CounterValue, float64(totals.Revenue))
+	ch <- prometheus.MustNewConstMetric(shopApprovedDesc, prometheus.GaugeValue, float64(totals.Count))
+
+	sent, recovered, err := new(ShopService).CartReminderStats()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("collect shop metrics failed")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(shopCartRemindersDesc, prometheus.GaugeValue, float64(sent), "sent")
+	ch <- prometheus.MustNewConstMetric(shopCartRemindersDesc, prometheus.GaugeValue, float64(recovered), "recovered")
+}
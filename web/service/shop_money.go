@@ -0,0 +1,205 @@
+package service
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// Shop prices are stored as int64 amounts in the minor unit of the configured
+// currency: cents for USD, whole rials for IRR. An empty currency has no minor
+// unit, so amounts are shown as they are stored.
+
+// ErrPriceOverflow is returned when a price does not fit in an int64 amount.
+var ErrPriceOverflow = errors.New("price is out of range")
+
+// shopCurrencyExponents holds the number of decimal digits in the minor unit
+// of each shop currency. Keep in sync with PriceFormatter in util/index.js.
+var shopCurrencyExponents = map[string]int{
+	"IRR":  0,
+	"IRT":  0,
+	"USD":  2,
+	"EUR":  2,
+	"GBP":  2,
+	"RUB":  2,
+	"TRY":  2,
+	"AED":  2,
+	"USDT": 2,
+}
+
+// ShopCurrencies lists the currency codes the shop can price in.
+var ShopCurrencies = []string{"IRR", "IRT", "USD", "EUR", "GBP", "RUB", "TRY", "AED", "USDT"}
+
+// ShopCurrency describes the currency shop amounts are kept in.
+type ShopCurrency struct {
+	Code     string `json:"code"`
+	Exponent int    `json:"exponent"`
+}
+
+// CurrencyExponent returns the number of decimal digits in the minor unit of
+// currency. Unknown and empty codes have none.
+func CurrencyExponent(currency string) int {
+	return shopCurrencyExponents[currency]
+}
+
+func minorUnitScale(exponent int) int64 {
+	scale := int64(1)
+	for range exponent {
+		scale *= 10
+	}
+	return scale
+}
+
+// FormatPrice renders an amount in minor units with grouped thousands and the
+// currency code, such as "1,250,000 IRT" or "12.50 USD".
+func FormatPrice(amount int64, currency string) string {
+	exponent := CurrencyExponent(currency)
+	scale := minorUnitScale(exponent)
+	var b strings.Builder
+	if amount < 0 {
+		b.WriteByte('-')
+	}
+	// Split before taking the absolute value so math.MinInt64 stays in range.
+	major, minor := amount/scale, amount%scale
+	if major < 0 {
+		major = -major
+	}
+	if minor < 0 {
+		minor = -minor
+	}
+	digits := strconv.FormatUint(uint64(major), 10)
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	if exponent > 0 {
+		fraction := strconv.FormatInt(minor, 10)
+		b.WriteByte('.')
+		b.WriteString(strings.Repeat("0", exponent-len(fraction)))
+		b.WriteString(fraction)
+	}
+	if currency != "" {
+		b.WriteByte(' ')
+		b.WriteString(currency)
+	}
+	return b.String()
+}
+
+// shopPriceStyles rewrite FormatPrice output into the number style of a
+// language. Languages without a style keep the English one.
+var shopPriceStyles = map[string]*strings.Replacer{
+	"fa": strings.NewReplacer(",", "٬", ".", "٫",
+		"0", "۰", "1", "۱", "2", "۲", "3", "۳", "4", "۴", "5", "۵", "6", "۶", "7", "۷", "8", "۸", "9", "۹"),
+	"ru": strings.NewReplacer(",", "\u00a0", ".", ","),
+}
+
+// LocalizePrice renders an amount like FormatPrice in the number style of a
+// shop language, such as "۱٬۲۵۰٬۰۰۰ IRT" in Persian.
+func LocalizePrice(amount int64, currency, lang string) string {
+	price := FormatPrice(amount, currency)
+	if style := shopPriceStyles[lang]; style != nil {
+		return style.Replace(price)
+	}
+	return price
+}
+
+// ParsePrice reads a non-negative decimal amount in major units, such as
+// "12.5" or "1,250,000", into minor units of currency. Digits beyond the
+// currency's minor unit are rejected rather than rounded.
+func ParsePrice(text, currency string) (int64, error) {
+	text = strings.ReplaceAll(strings.TrimSpace(text), ",", "")
+	whole, fraction, _ := strings.Cut(text, ".")
+	exponent := CurrencyExponent(currency)
+	if whole == "" && fraction == "" || len(fraction) > exponent {
+		return 0, errors.New("invalid price")
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+	for _, part := range []string{whole, fraction} {
+		if strings.Trim(part, "0123456789") != "" {
+			return 0, errors.New("invalid price")
+		}
+	}
+	var major, minor int64
+	var err error
+	if whole != "" {
+		if major, err = strconv.ParseInt(whole, 10, 64); err != nil {
+			return 0, ErrPriceOverflow
+		}
+	}
+	if fraction != "" {
+		if minor, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	amount, err := mulPrice(major, minorUnitScale(exponent))
+	if err != nil {
+		return 0, err
+	}
+	return addPrice(amount, minor)
+}
+
+// mulPrice returns price*n, or ErrPriceOverflow when the product does not fit
+// in an int64.
+func mulPrice(price, n int64) (int64, error) {
+	if price == 0 || n == 0 {
+		return 0, nil
+	}
+	product := price * n
+	if product/n != price || (price == -1 && n == math.MinInt64) || (n == -1 && price == math.MinInt64) {
+		return 0, ErrPriceOverflow
+	}
+	return product, nil
+}
+
+// addPrice returns a+b, or ErrPriceOverflow when the sum does not fit in an
+// int64.
+func addPrice(a, b int64) (int64, error) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, ErrPriceOverflow
+	}
+	return sum, nil
+}
+
+// currencyChangeAllowed reports whether the shop currency may be set to code.
+// Amounts are stored in minor units of the current currency, so switching to a
+// currency with another number of decimals would misread every stored amount;
+// that is refused while packages or orders exist.
+func currencyChangeAllowed(code string) (bool, error) {
+	current, err := (&SettingService{}).GetShopCurrency()
+	if err != nil {
+		return false, err
+	}
+	if CurrencyExponent(current) == CurrencyExponent(code) {
+		return true, nil
+	}
+	db := database.GetShopDB()
+	for _, m := range []any{&model.ShopPackage{}, &model.ShopOrder{}, &model.ShopOrderArchive{}} {
+		var count int64
+		if err := db.Model(m).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Currency returns the configured shop currency.
+func (s *ShopService) Currency() ShopCurrency {
+	code, _ := s.settingService.GetShopCurrency()
+	return ShopCurrency{Code: code, Exponent: CurrencyExponent(code)}
+}
+
+// FormatPrice renders an amount in the configured shop currency.
+func (s *ShopService) FormatPrice(amount int64) string {
+	code, _ := s.settingService.GetShopCurrency()
+	return FormatPrice(amount, code)
+}
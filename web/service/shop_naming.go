@@ -0,0 +1,244 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
+)
+
+// Client emails and subIds of shop orders are generated from the patterns in
+// the shopEmailPattern and shopSubIdPattern settings. A pattern is literal
+// text with these placeholders:
+//
+//	{tgid}        customer's Telegram ID
+//	{tgusername}  customer's Telegram username, "tg" and the ID without one
+//	{orderid}     order ID
+//	{device}      client number within a pooled order
+//	{random:N}    N random lowercase letters and digits, 8 without N
+//	{num:N}       N random digits, 6 without N
+//	{words}       two random words, such as "brave-otter"
+const (
+	defaultShopEmailPattern = "tg-{tgid}-{orderid}@shop"
+	defaultShopSubIdPattern = "{random:16}"
+
+	shopPatternMaxLength = 64
+	shopPatternMaxRandom = 32
+	// shopNameAttempts is how many random suffixes are tried when a generated
+	// name is taken.
+	shopNameAttempts = 5
+)
+
+var shopPatternRe = regexp.MustCompile(`\{([a-z]+)(?::(\d+))?\}`)
+
+// shopPatternPlaceholders maps each placeholder to whether it takes a length.
+var shopPatternPlaceholders = map[string]bool{
+	"tgid":       false,
+	"tgusername": false,
+	"orderid":    false,
+	"device":     false,
+	"random":     true,
+	"num":        true,
+	"words":      false,
+}
+
+var shopNameAdjectives = []string{
+	"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp",
+	"swift", "eager", "fair", "gentle", "golden", "happy", "jolly", "keen",
+	"lively", "lucky", "mellow", "misty", "noble", "quiet", "rapid", "silver",
+	"sunny", "tidy", "vivid", "warm", "wild", "wise", "young", "zesty",
+}
+
+var shopNameNouns = []string{
+	"badger", "beacon", "canyon", "cedar", "comet", "coral", "falcon", "fern",
+	"harbor", "heron", "island", "lark", "lotus", "maple", "meadow", "otter",
+	"panda", "pebble", "pine", "planet", "raven", "river", "robin", "sparrow",
+	"summit", "tiger", "tulip", "valley", "willow", "wolf", "yak", "zebra",
+}
+
+// validateNamePattern checks a client naming pattern's length and placeholders.
+// An empty pattern stands for the default one.
+func validateNamePattern(v *shopValidator, field, pattern string) {
+	v.text(field, pattern, false, shopPatternMaxLength)
+	for _, match := range shopPatternRe.FindAllStringSubmatch(pattern, -1) {
+		takesLength, ok := shopPatternPlaceholders[match[1]]
+		if !ok || (match[2] != "" && !takesLength) {
+			v.add(field, "shop.invalid.pattern", "Placeholder=="+match[0])
+			return
+		}
+		if match[2] != "" {
+			if n, _ := strconv.Atoi(match[2]); n < 1 || n > shopPatternMaxRandom {
+				v.add(field, "shop.invalid.pattern", "Placeholder=="+match[0])
+				return
+			}
+		}
+	}
+}
+
+// renderNamePattern fills in a pattern for one client of an order.
+func renderNamePattern(pattern string, order *model.ShopOrder, device int) string {
+	return shopPatternRe.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		match := shopPatternRe.FindStringSubmatch(placeholder)
+		n, _ := strconv.Atoi(match[2])
+		switch match[1] {
+		case "tgid":
+			return strconv.FormatInt(order.TelegramId, 10)
+		case "tgusername":
+			if order.TelegramUsername != "" {
+				return order.TelegramUsername
+			}
+			return "tg" + strconv.FormatInt(order.TelegramId, 10)
+		case "orderid":
+			return strconv.Itoa(order.Id)
+		case "device":
+			return strconv.Itoa(device)
+		case "random":
+			return randomFrom("abcdefghijklmnopqrstuvwxyz0123456789", orDefault(n, 8))
+		case "num":
+			return randomFrom("0123456789", orDefault(n, 6))
+		case "words":
+			return shopNameAdjectives[random.Num(len(shopNameAdjectives))] + "-" + shopNameNouns[random.Num(len(shopNameNouns))]
+		}
+		return placeholder
+	})
+}
+
+// orDefault returns n, or fallback when n is not set.
+func orDefault(n, fallback int) int {
+	if n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+func randomFrom(charset string, length int) string {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = charset[random.Num(len(charset))]
+	}
+	return string(b)
+}
+
+// cleanClientName lower-cases a generated name and replaces the characters
+// that are not allowed with "-".
+func cleanClientName(name, allowed string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(allowed, r) {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+}
+
+// withNameSuffix appends suffix to a name, before the domain of an email.
+func withNameSuffix(name, suffix string) string {
+	if at := strings.LastIndex(name, "@"); at >= 0 {
+		return name[:at] + suffix + name[at:]
+	}
+	return name + suffix
+}
+
+// takenClientNames returns the lower-cased client emails and subIds in use by
+// local inbounds, shop orders and cart items. Clients on remote nodes are only
+// known through the orders that created them.
+func (s *ShopService) takenClientNames() (emails, subIds map[string]bool, err error) {
+	emails, subIds = map[string]bool{}, map[string]bool{}
+	var localEmails, localSubIds []string
+	for column, values := range map[string]*[]string{"email": &localEmails, "subId": &localSubIds} {
+		err = database.GetDB().Raw(`
+			SELECT JSON_EXTRACT(client.value, '$.` + column + `')
+			FROM inbounds,
+				JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+			WHERE JSON_EXTRACT(client.value, '$.` + column + `') IS NOT NULL
+			`).Scan(values).Error
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	var orders []model.ShopOrder
+	err = database.GetShopDB().Select("client_email", "client_emails", "client_sub_id").
+		Where("client_email <> '' OR client_sub_id <> ''").Find(&orders).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, order := range orders {
+		localEmails = append(localEmails, order.ClientEmail)
+		localEmails = append(localEmails, splitShopTags(order.ClientEmails)...)
+		localSubIds = append(localSubIds, order.ClientSubId)
+	}
+	var items []model.ShopOrderItem
+	err = database.GetShopDB().Select("client_email", "client_sub_id").
+		Where("client_email <> '' OR client_sub_id <> ''").Find(&items).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, item := range items {
+		localEmails = append(localEmails, item.ClientEmail)
+		localSubIds = append(localSubIds, item.ClientSubId)
+	}
+	for _, email := range localEmails {
+		emails[strings.ToLower(email)] = true
+	}
+	for _, subId := range localSubIds {
+		subIds[strings.ToLower(subId)] = true
+	}
+	delete(emails, "")
+	delete(subIds, "")
+	return emails, subIds, nil
+}
+
+// uniqueClientName renders a pattern until it gives a name not in taken, adding
+// a random suffix when the pattern alone does not.
+func uniqueClientName(pattern string, order *model.ShopOrder, device int, allowed string, taken map[string]bool) (string, error) {
+	name := cleanClientName(renderNamePattern(pattern, order, device), allowed)
+	for attempt := 0; attempt <= shopNameAttempts; attempt++ {
+		candidate := name
+		if attempt > 0 {
+			candidate = withNameSuffix(name, "-"+randomFrom("abcdefghijklmnopqrstuvwxyz0123456789", 4))
+		}
+		if !taken[candidate] {
+			taken[candidate] = true
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free client name for pattern %q", pattern)
+}
+
+// GenerateClientNames returns the emails and subIds of the clients of an order,
+// one per device, from the configured naming patterns. Names already in use are
+// not handed out again.
+func (s *ShopService) GenerateClientNames(order *model.ShopOrder, devices int) (emails, subIds []string, err error) {
+	emailPattern, _ := s.settingService.GetShopEmailPattern()
+	if emailPattern == "" {
+		emailPattern = defaultShopEmailPattern
+	}
+	subIdPattern, _ := s.settingService.GetShopSubIdPattern()
+	if subIdPattern == "" {
+		subIdPattern = defaultShopSubIdPattern
+	}
+	// Every client of a pooled order needs its own name.
+	if devices > 1 && !strings.Contains(emailPattern, "{device}") {
+		emailPattern = withNameSuffix(emailPattern, "-{device}")
+	}
+	takenEmails, takenSubIds, err := s.takenClientNames()
+	if err != nil {
+		return nil, nil, err
+	}
+	for device := 1; device <= devices; device++ {
+		email, err := uniqueClientName(emailPattern, order, device, "abcdefghijklmnopqrstuvwxyz0123456789._@-", takenEmails)
+		if err != nil {
+			return nil, nil, err
+		}
+		subId, err := uniqueClientName(subIdPattern, order, device, "abcdefghijklmnopqrstuvwxyz0123456789_-", takenSubIds)
+		if err != nil {
+			return nil, nil, err
+		}
+		emails = append(emails, email)
+		subIds = append(subIds, subId)
+	}
+	return emails, subIds, nil
+}
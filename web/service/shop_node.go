@@ -0,0 +1,350 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ShopNodeStatus reports the reachability of a remote panel.
+type ShopNodeStatus struct {
+	NodeId   int    `json:"nodeId"`
+	Online   bool   `json:"online"`
+	Inbounds int    `json:"inbounds"`
+	Error    string `json:"error,omitempty"`
+	Server   any    `json:"server,omitempty"`
+}
+
+// ShopNodeService talks to remote x-ui panels registered as shop nodes.
+type ShopNodeService struct{}
+
+// shopNodeSessionTTL is how long a node session is used before logging in
+// again, well within the session lifetime of a panel.
+const shopNodeSessionTTL = 10 * time.Minute
+
+// errNodeUnauthorized is returned when a remote panel no longer accepts the
+// session's cookie.
+var errNodeUnauthorized = errors.New("node session expired")
+
+// shopNodeSession is a logged-in client of a node, valid while the node keeps
+// the address and credentials it was opened with.
+type shopNodeSession struct {
+	key      string
+	client   *http.Client
+	openedAt time.Time
+}
+
+// shopNodeSessions caches a session per node id, so listing and provisioning
+// do not log in to the node on every call.
+var shopNodeSessions = struct {
+	sync.Mutex
+	byNode map[int]*shopNodeSession
+}{byNode: map[int]*shopNodeSession{}}
+
+func (s *ShopNodeService) ListNodes() ([]model.ShopNode, error) {
+	var nodes []model.ShopNode
+	err := database.GetShopDB().Order("id asc").Find(&nodes).Error
+	return nodes, err
+}
+
+func (s *ShopNodeService) GetNode(id int) (*model.ShopNode, error) {
+	node := &model.ShopNode{}
+	if err := database.GetShopDB().First(node, id).Error; err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (s *ShopNodeService) SaveNode(node *model.ShopNode) error {
+	node.Url = strings.TrimRight(strings.TrimSpace(node.Url), "/")
+	if _, err := url.ParseRequestURI(node.Url); err != nil {
+		return errors.New("invalid node url")
+	}
+	db := database.GetShopDB()
+	node.UpdatedAt = time.Now()
+	if node.Id > 0 {
+		updates := map[string]any{
+			"name":       node.Name,
+			"url":        node.Url,
+			"username":   node.Username,
+			"sub_uri":    node.SubUri,
+			"enabled":    node.Enabled,
+			"updated_at": node.UpdatedAt,
+		}
+		// An empty password keeps the stored one.
+		if node.Password != "" {
+			updates["password"] = node.Password
+		}
+		return db.Model(&model.ShopNode{}).Where("id = ?", node.Id).Updates(updates).Error
+	}
+	node.CreatedAt = time.Now()
+	return db.Create(node).Error
+}
+
+func (s *ShopNodeService) DeleteNode(id int) error {
+	db := database.GetShopDB()
+	if err := db.Where("node_id = ?", id).Delete(&model.ShopInbound{}).Error; err != nil {
+		return err
+	}
+	forgetNodeSession(id)
+	return db.Delete(&model.ShopNode{}, id).Error
+}
+
+// NodeStatus logs in to the remote panel and collects its inbound count and server status.
+func (s *ShopNodeService) NodeStatus(node *model.ShopNode) ShopNodeStatus {
+	status := ShopNodeStatus{NodeId: node.Id}
+	// A status check tests the node's credentials, so it never reuses a session.
+	forgetNodeSession(node.Id)
+	var inbounds []*model.Inbound
+	var server any
+	err := s.withSession(node, func(client *http.Client) error {
+		var err error
+		if inbounds, err = s.remoteInbounds(client, node); err != nil {
+			return err
+		}
+		if err := s.call(client, node, http.MethodGet, "/panel/api/server/status", nil, &server); err != nil {
+			server = nil
+		}
+		return nil
+	})
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Online = true
+	status.Inbounds = len(inbounds)
+	status.Server = server
+	return status
+}
+
+// RemoteInbounds returns the inbounds configured on a remote panel.
+func (s *ShopNodeService) RemoteInbounds(node *model.ShopNode) ([]*model.Inbound, error) {
+	var inbounds []*model.Inbound
+	err := s.withSession(node, func(client *http.Client) error {
+		var err error
+		inbounds, err = s.remoteInbounds(client, node)
+		return err
+	})
+	return inbounds, err
+}
+
+// RemoteInbound returns a single inbound of a remote panel.
+func (s *ShopNodeService) RemoteInbound(node *model.ShopNode, inboundId int) (*model.Inbound, error) {
+	inbound := &model.Inbound{}
+	err := s.withSession(node, func(client *http.Client) error {
+		return s.call(client, node, http.MethodGet, "/panel/api/inbounds/get/"+strconv.Itoa(inboundId), nil, inbound)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inbound, nil
+}
+
+// AddRemoteClient adds the clients in settings to an inbound of a remote panel.
+func (s *ShopNodeService) AddRemoteClient(node *model.ShopNode, inboundId int, settings string) error {
+	form := url.Values{}
+	form.Set("id", strconv.Itoa(inboundId))
+	form.Set("settings", settings)
+	return s.withSession(node, func(client *http.Client) error {
+		return s.call(client, node, http.MethodPost, "/panel/api/inbounds/addClient", form, nil)
+	})
+}
+
+// UpdateRemoteClient replaces the client known by clientKey on an inbound of a
+// remote panel with the client in settings.
+func (s *ShopNodeService) UpdateRemoteClient(node *model.ShopNode, inboundId int, clientKey, settings string) error {
+	form := url.Values{}
+	form.Set("id", strconv.Itoa(inboundId))
+	form.Set("settings", settings)
+	return s.withSession(node, func(client *http.Client) error {
+		return s.call(client, node, http.MethodPost, "/panel/api/inbounds/updateClient/"+url.PathEscape(clientKey), form, nil)
+	})
+}
+
+// SetRemoteClientEnable enables or disables the client with email on an inbound
+// of a remote panel. A client no longer on the inbound is left alone.
+func (s *ShopNodeService) SetRemoteClientEnable(node *model.ShopNode, inboundId int, email string, enable bool) error {
+	inbound, err := s.RemoteInbound(node, inboundId)
+	if err != nil {
+		return err
+	}
+	client, key, err := findInboundClient(inbound, email)
+	if errors.Is(err, errInboundClientMissing) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	client["enable"] = enable
+	data, err := json.Marshal(map[string]any{"clients": []any{client}})
+	if err != nil {
+		return err
+	}
+	return s.UpdateRemoteClient(node, inboundId, key, string(data))
+}
+
+// DelRemoteClientByEmail removes a client from an inbound of a remote panel.
+func (s *ShopNodeService) DelRemoteClientByEmail(node *model.ShopNode, inboundId int, email string) error {
+	path := fmt.Sprintf("/panel/api/inbounds/%d/delClientByEmail/%s", inboundId, url.PathEscape(email))
+	return s.withSession(node, func(client *http.Client) error {
+		return s.call(client, node, http.MethodPost, path, nil, nil)
+	})
+}
+
+// maxRemoteCatalogSize bounds the package catalog downloaded from a remote panel.
+const maxRemoteCatalogSize = 4 << 20
+
+// RemoteCatalog downloads the package catalog of the remote panel at baseUrl as
+// JSON, authenticating with the remote panel's catalog token. The token only
+// grants reading the catalog, so no admin login is needed.
+func (s *ShopNodeService) RemoteCatalog(baseUrl, token string) ([]byte, error) {
+	const path = "/store/catalog.json"
+	req, err := http.NewRequest(http.MethodGet, baseUrl+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := (&http.Client{Timeout: 15 * time.Second}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, errors.New("the primary panel rejected the catalog token")
+	case http.StatusNotFound:
+		return nil, errors.New("the primary panel has no catalog token set")
+	default:
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, path)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxRemoteCatalogSize))
+}
+
+func (s *ShopNodeService) remoteInbounds(client *http.Client, node *model.ShopNode) ([]*model.Inbound, error) {
+	var inbounds []*model.Inbound
+	if err := s.call(client, node, http.MethodGet, "/panel/api/inbounds/list", nil, &inbounds); err != nil {
+		return nil, err
+	}
+	return inbounds, nil
+}
+
+// withSession runs fn with a logged-in client of the node, reusing the node's
+// cached session. When the node turned the session down, fn runs once more on
+// a new one: panels refuse such requests before acting on them.
+func (s *ShopNodeService) withSession(node *model.ShopNode, fn func(client *http.Client) error) error {
+	client, cached, err := s.session(node)
+	if err != nil {
+		return err
+	}
+	err = fn(client)
+	if !cached || !errors.Is(err, errNodeUnauthorized) {
+		return err
+	}
+	forgetNodeSession(node.Id)
+	if client, _, err = s.session(node); err != nil {
+		return err
+	}
+	return fn(client)
+}
+
+// session returns the node's cached session, logging in when there is none
+// for its current address and credentials. It reports whether the session
+// was cached.
+func (s *ShopNodeService) session(node *model.ShopNode) (*http.Client, bool, error) {
+	key := strings.Join([]string{node.Url, node.Username, node.Password}, "\n")
+	shopNodeSessions.Lock()
+	cached := shopNodeSessions.byNode[node.Id]
+	shopNodeSessions.Unlock()
+	if node.Enabled && cached != nil && cached.key == key && time.Since(cached.openedAt) < shopNodeSessionTTL {
+		return cached.client, true, nil
+	}
+	client, err := s.login(node)
+	if err != nil {
+		return nil, false, err
+	}
+	if node.Id > 0 {
+		shopNodeSessions.Lock()
+		shopNodeSessions.byNode[node.Id] = &shopNodeSession{key: key, client: client, openedAt: time.Now()}
+		shopNodeSessions.Unlock()
+	}
+	return client, false, nil
+}
+
+// forgetNodeSession drops the cached session of a node.
+func forgetNodeSession(nodeId int) {
+	shopNodeSessions.Lock()
+	defer shopNodeSessions.Unlock()
+	delete(shopNodeSessions.byNode, nodeId)
+}
+
+// login opens a session on the remote panel and returns a client carrying its cookie.
+func (s *ShopNodeService) login(node *model.ShopNode) (*http.Client, error) {
+	if !node.Enabled {
+		return nil, fmt.Errorf("node %s is disabled", node.Name)
+	}
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, Timeout: 15 * time.Second}
+	form := url.Values{}
+	form.Set("username", node.Username)
+	form.Set("password", node.Password)
+	if err := s.call(client, node, http.MethodPost, "/login", form, nil); err != nil {
+		return nil, fmt.Errorf("node %s login failed: %w", node.Name, err)
+	}
+	return client, nil
+}
+
+// call performs a panel API request and decodes the obj field of its entity.Msg response into out.
+func (s *ShopNodeService) call(client *http.Client, node *model.ShopNode, method, path string, form url.Values, out any) error {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req, err := http.NewRequest(method, node.Url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w: status %d from %s", errNodeUnauthorized, resp.StatusCode, path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, path)
+	}
+	var msg struct {
+		Success bool            `json:"success"`
+		Msg     string          `json:"msg"`
+		Obj     json.RawMessage `json:"obj"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return err
+	}
+	if !msg.Success {
+		return errors.New(msg.Msg)
+	}
+	if out != nil && len(msg.Obj) > 0 {
+		return json.Unmarshal(msg.Obj, out)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ShopNotifier delivers a bot message to a customer. to is the customer's
+// phone number for SMS and WhatsApp providers and their chat ID for Telegram.
+// text is HTML as the bot sends it; providers without formatting send
+// plainShopText(text).
+type ShopNotifier interface {
+	Notify(ctx context.Context, to, text string) error
+}
+
+var (
+	shopNotifiersMu sync.RWMutex
+	shopNotifiers   = map[string]ShopNotifier{
+		"kavenegar":       &kavenegarNotifier{},
+		"twilio_sms":      &twilioNotifier{},
+		"twilio_whatsapp": &twilioNotifier{whatsapp: true},
+	}
+	// shopTelegramNotifier reaches customers who ordered through the bot. It is
+	// not selectable as the phone provider.
+	shopTelegramNotifier ShopNotifier = telegramNotifier{}
+)
+
+// RegisterShopNotifier makes a notification provider selectable by name in the shop settings.
+func RegisterShopNotifier(name string, notifier ShopNotifier) {
+	shopNotifiersMu.Lock()
+	defer shopNotifiersMu.Unlock()
+	shopNotifiers[name] = notifier
+}
+
+func getShopNotifier(name string) ShopNotifier {
+	shopNotifiersMu.RLock()
+	defer shopNotifiersMu.RUnlock()
+	return shopNotifiers[name]
+}
+
+var shopTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// plainShopText turns an HTML bot message into plain text for SMS and WhatsApp.
+func plainShopText(msg string) string {
+	msg = strings.ReplaceAll(msg, "\r\n", "\n")
+	return strings.TrimSpace(html.UnescapeString(shopTagRe.ReplaceAllString(msg, "")))
+}
+
+// NotifyCustomer sends a bot message to the customer of an order: through the
+// bot when they ordered on Telegram, otherwise to their phone through the
+// configured notification provider. It does nothing when the order has no
+// phone or no provider is configured.
+func (s *ShopService) NotifyCustomer(order *model.ShopOrder, msg string) error {
+	notifier, to := shopTelegramNotifier, strconv.FormatInt(order.TelegramId, 10)
+	if order.TelegramId == 0 {
+		name, err := s.settingService.GetShopNotifier()
+		if err != nil || name == "" || order.Phone == "" {
+			return err
+		}
+		if notifier = getShopNotifier(name); notifier == nil {
+			return fmt.Errorf("unknown notification provider %q", name)
+		}
+		to = order.Phone
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return notifier.Notify(ctx, to, msg)
+}
+
+// ListPhoneCustomerOrders returns the approved orders of customers who ordered
+// without Telegram and left a phone number, newest first. Orders hosted on
+// remote nodes are left out, as their clients' traffic is not known here.
+func (s *ShopService) ListPhoneCustomerOrders() ([]model.ShopOrder, error) {
+	var orders []model.ShopOrder
+	err := database.GetShopDB().Where("telegram_id = 0 AND phone <> '' AND node_id = 0 AND status = ?", OrderStatusApproved).
+		Order("id desc").Find(&orders).Error
+	return orders, err
+}
+
+// telegramNotifier sends messages through the Telegram bot, when it runs.
+type telegramNotifier struct{}
+
+func (telegramNotifier) Notify(ctx context.Context, to, text string) error {
+	chatId, err := strconv.ParseInt(to, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid Telegram chat ID %q", to)
+	}
+	new(Tgbot).SendMsgToTgbot(chatId, text)
+	return nil
+}
+
+// kavenegarNotifier sends SMS through the Kavenegar REST API.
+type kavenegarNotifier struct {
+	settingService SettingService
+}
+
+func (n *kavenegarNotifier) Notify(ctx context.Context, to, text string) error {
+	apiKey, err := n.settingService.GetShopNotifierApiKey()
+	if err != nil {
+		return err
+	}
+	if apiKey == "" {
+		return errors.New("Kavenegar API key not configured")
+	}
+	sender, _ := n.settingService.GetShopNotifierSender()
+	form := url.Values{"receptor": {to}, "message": {plainShopText(text)}}
+	if sender != "" {
+		form.Set("sender", sender)
+	}
+	endpoint := "https://api.kavenegar.com/v1/" + url.PathEscape(apiKey) + "/sms/send.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Return struct {
+			Status  int    `json:"status"`
+			Message string `json:"message"`
+		} `json:"return"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("Kavenegar returned status %d", resp.StatusCode)
+	}
+	if result.Return.Status != http.StatusOK {
+		return fmt.Errorf("Kavenegar returned status %d: %s", result.Return.Status, result.Return.Message)
+	}
+	return nil
+}
+
+// twilioNotifier sends SMS or WhatsApp messages through the Twilio Messages API.
+type twilioNotifier struct {
+	settingService SettingService
+	whatsapp       bool
+}
+
+func (n *twilioNotifier) Notify(ctx context.Context, to, text string) error {
+	account, err := n.settingService.GetShopNotifierAccount()
+	if err != nil {
+		return err
+	}
+	token, _ := n.settingService.GetShopNotifierApiKey()
+	sender, _ := n.settingService.GetShopNotifierSender()
+	if account == "" || token == "" || sender == "" {
+		return errors.New("Twilio account, auth token and sender must be configured")
+	}
+	if n.whatsapp {
+		to = "whatsapp:" + to
+		sender = "whatsapp:" + sender
+	}
+	form := url.Values{"To": {to}, "From": {sender}, "Body": {plainShopText(text)}}
+	endpoint := "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(account) + "/Messages.json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(account, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		var result struct {
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return fmt.Errorf("Twilio returned status %d: %s", resp.StatusCode, result.Message)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// OrderNumber returns the number customers know an order by, or its ID for an
+// order restored from a backup taken before orders were numbered.
+func OrderNumber(order *model.ShopOrder) string {
+	if order.Number != "" {
+		return order.Number
+	}
+	return "#" + strconv.Itoa(order.Id)
+}
+
+// assignOrderNumber gives a new order a random number of the year it was
+// placed in that no live or archived order has, such as ORD-2026-482913.
+// Numbers get more digits once six are crowded.
+func (s *ShopService) assignOrderNumber(tx *gorm.DB, order *model.ShopOrder) error {
+	placed := order.CreatedAt
+	if placed.IsZero() {
+		placed = time.Now()
+	}
+	year := placed.In(s.Location()).Year()
+	for attempt := 0; ; attempt++ {
+		digits := 6 + attempt/10
+		n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil))
+		if err != nil {
+			return err
+		}
+		number := fmt.Sprintf("ORD-%d-%0*d", year, digits, n.Int64())
+		var taken int64
+		if err := tx.Model(&model.ShopOrder{}).Where("number = ?", number).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken == 0 {
+			if err := tx.Model(&model.ShopOrderArchive{}).Where("number = ?", number).Count(&taken).Error; err != nil {
+				return err
+			}
+		}
+		if taken == 0 {
+			order.Number = number
+			return nil
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ReceiptOCRResult is what an OCR provider read from a receipt image.
+type ReceiptOCRResult struct {
+	Amount    int64  `json:"amount"` // In minor units of the shop currency
+	Reference string `json:"reference"`
+	Text      string `json:"text"`
+}
+
+// ReceiptOCRProvider extracts payment details from a receipt image, given its
+// file name and decrypted content.
+type ReceiptOCRProvider interface {
+	Extract(ctx context.Context, name string, image []byte) (*ReceiptOCRResult, error)
+}
+
+var (
+	ocrProvidersMu sync.RWMutex
+	ocrProviders   = map[string]ReceiptOCRProvider{
+		"http": &httpReceiptOCR{},
+	}
+)
+
+// RegisterReceiptOCRProvider makes an OCR provider selectable by name in the shop settings.
+func RegisterReceiptOCRProvider(name string, provider ReceiptOCRProvider) {
+	ocrProvidersMu.Lock()
+	defer ocrProvidersMu.Unlock()
+	ocrProviders[name] = provider
+}
+
+func getReceiptOCRProvider(name string) ReceiptOCRProvider {
+	ocrProvidersMu.RLock()
+	defer ocrProvidersMu.RUnlock()
+	return ocrProviders[name]
+}
+
+// ScanReceipt runs the configured OCR provider on an order's receipt and stores the
+// extracted amount and reference. It does nothing when OCR is disabled.
+func (s *ShopService) ScanReceipt(orderId int) error {
+	name, err := s.settingService.GetShopOcrProvider()
+	if err != nil || name == "" {
+		return err
+	}
+	provider := getReceiptOCRProvider(name)
+	if provider == nil {
+		return fmt.Errorf("unknown OCR provider %q", name)
+	}
+	order, err := s.GetOrder(orderId)
+	if err != nil {
+		return err
+	}
+	if order.ReceiptPath == "" {
+		return errors.New("order has no receipt")
+	}
+
+	image, err := ReadReceipt(order.ReceiptPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := provider.Extract(ctx, filepath.Base(order.ReceiptPath), image)
+	if err != nil {
+		return err
+	}
+	if result.Amount == 0 || result.Reference == "" {
+		amount, reference := parseReceiptText(result.Text)
+		if result.Amount == 0 {
+			// Receipts show whole currency units.
+			result.Amount, _ = mulPrice(amount, minorUnitScale(s.Currency().Exponent))
+		}
+		if result.Reference == "" {
+			result.Reference = reference
+		}
+	}
+	return database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", orderId).Updates(map[string]any{
+		"ocr_amount":    result.Amount,
+		"ocr_reference": result.Reference,
+		"ocr_mismatch":  result.Amount > 0 && result.Amount != order.Price,
+		"updated_at":    time.Now(),
+	}).Error
+}
+
+var (
+	receiptNumberRe    = regexp.MustCompile(`\d{1,3}(?:[,٬]\d{3})+|\d+`)
+	receiptAmountRe    = regexp.MustCompile(`(?i)amount|total|sum|paid|مبلغ|واریز`)
+	receiptReferenceRe = regexp.MustCompile(`(?i)ref|tracking|trace|پیگیری|مرجع|ارجاع`)
+	receiptDigits      = strings.NewReplacer(
+		"۰", "0", "۱", "1", "۲", "2", "۳", "3", "۴", "4", "۵", "5", "۶", "6", "۷", "7", "۸", "8", "۹", "9",
+		"٠", "0", "١", "1", "٢", "2", "٣", "3", "٤", "4", "٥", "5", "٦", "6", "٧", "7", "٨", "8", "٩", "9",
+	)
+)
+
+// parseReceiptText picks the paid amount and reference number out of raw OCR text.
+// Lines labelled as amount or reference win; otherwise the largest grouped number is
+// taken as the amount. Persian and Arabic digits are accepted.
+func parseReceiptText(text string) (int64, string) {
+	var amount, fallback int64
+	var reference string
+	for _, line := range strings.Split(receiptDigits.Replace(text), "\n") {
+		numbers := receiptNumberRe.FindAllString(line, -1)
+		if len(numbers) == 0 {
+			continue
+		}
+		if reference == "" && receiptReferenceRe.MatchString(line) {
+			for _, n := range numbers {
+				if len(n) > len(reference) {
+					reference = n
+				}
+			}
+			continue
+		}
+		for _, n := range numbers {
+			grouped := strings.ContainsAny(n, ",٬")
+			value, err := strconv.ParseInt(strings.NewReplacer(",", "", "٬", "").Replace(n), 10, 64)
+			if err != nil {
+				continue
+			}
+			if amount == 0 && receiptAmountRe.MatchString(line) {
+				amount = value
+			}
+			if grouped && value > fallback {
+				fallback = value
+			}
+		}
+	}
+	if amount == 0 {
+		amount = fallback
+	}
+	return amount, reference
+}
+
+// httpReceiptOCR posts the receipt image to the endpoint configured in the shop settings.
+type httpReceiptOCR struct {
+	settingService SettingService
+}
+
+func (p *httpReceiptOCR) Extract(ctx context.Context, name string, image []byte) (*ReceiptOCRResult, error) {
+	endpoint, err := p.settingService.GetShopOcrEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	if endpoint == "" {
+		return nil, errors.New("OCR endpoint not configured")
+	}
+	apiKey, _ := p.settingService.GetShopOcrApiKey()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(image); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCR endpoint returned status %d", resp.StatusCode)
+	}
+	result := &ReceiptOCRResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrPausesDisabled is returned when the shop does not let customers pause.
+	ErrPausesDisabled = errors.New("pausing is disabled")
+	// ErrPauseLimit is returned when an order was paused as often as allowed.
+	ErrPauseLimit = errors.New("no pauses left this cycle")
+	// ErrOrderPaused is returned when pausing an order that is already paused.
+	ErrOrderPaused = errors.New("order is already paused")
+	// ErrOrderNotPaused is returned when resuming an order that is not paused.
+	ErrOrderNotPaused = errors.New("order is not paused")
+	// ErrResumeLapsed is returned when a resumed order ran out of traffic,
+	// expired or is overdue for renewal, so its clients stay disabled.
+	ErrResumeLapsed = errors.New("order's clients stay disabled until it is renewed")
+)
+
+// ListPausablePlans returns the customer's approved plans on local inbounds,
+// keeping only the latest order for each client. Renewals are orders of their
+// own, so each billing cycle gets its own pauses.
+func (s *ShopService) ListPausablePlans(tgId int64) ([]model.ShopOrder, error) {
+	var orders []model.ShopOrder
+	err := database.GetShopDB().Where("telegram_id = ? AND status = ? AND node_id = 0 AND client_email <> ''", tgId, OrderStatusApproved).
+		Order("id desc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	plans := make([]model.ShopOrder, 0, len(orders))
+	for _, order := range orders {
+		if seen[order.ClientEmail] {
+			continue
+		}
+		if order.PackageId != nil {
+			if pkg, err := s.GetPackage(*order.PackageId); err != nil || pkg.Type == PackageTypeTopUp {
+				continue
+			}
+		}
+		seen[order.ClientEmail] = true
+		plans = append(plans, order)
+	}
+	return plans, nil
+}
+
+// ListOrderPauses returns an order's pauses, latest first.
+func (s *ShopService) ListOrderPauses(orderId int) ([]model.ShopOrderPause, error) {
+	pauses := []model.ShopOrderPause{}
+	err := database.GetShopDB().Where("order_id = ?", orderId).Order("id desc").Find(&pauses).Error
+	return pauses, err
+}
+
+// ActiveOrderPause returns the pause an order is in, or nil when it is not paused.
+func (s *ShopService) ActiveOrderPause(orderId int) (*model.ShopOrderPause, error) {
+	pause := &model.ShopOrderPause{}
+	err := database.GetShopDB().Where("order_id = ? AND (resumed_at IS NULL OR resumed_at = ?)", orderId, time.Time{}).
+		Order("id desc").Limit(1).Find(pause).Error
+	if err != nil || pause.Id == 0 {
+		return nil, err
+	}
+	return pause, nil
+}
+
+// PausesLeft returns how many more times an order can be paused.
+func (s *ShopService) PausesLeft(orderId int) (int, error) {
+	limit, _ := s.settingService.GetShopPausesPerCycle()
+	var used int64
+	if err := database.GetShopDB().Model(&model.ShopOrderPause{}).Where("order_id = ?", orderId).Count(&used).Error; err != nil {
+		return 0, err
+	}
+	return max(0, limit-int(used)), nil
+}
+
+// pauseClientEmails returns the clients pausing an order disables. A renewal
+// pauses the clients of the order that created its subscription.
+func (s *ShopService) pauseClientEmails(order *model.ShopOrder) ([]string, error) {
+	if order.SubscriptionId > 0 {
+		sub, err := s.GetSubscription(order.SubscriptionId)
+		if err != nil {
+			return nil, err
+		}
+		origin, err := s.GetOrder(sub.OrderId)
+		if err != nil {
+			return nil, err
+		}
+		return s.OrderClientEmails(origin), nil
+	}
+	return s.OrderClientEmails(order), nil
+}
+
+// PauseOrder disables the clients of an order at its customer's request. It
+// reports whether Xray needs a restart.
+func (s *ShopService) PauseOrder(order *model.ShopOrder) (*model.ShopOrderPause, bool, error) {
+	if limit, _ := s.settingService.GetShopPausesPerCycle(); limit <= 0 {
+		return nil, false, ErrPausesDisabled
+	}
+	if order.Status != OrderStatusApproved || order.NodeId > 0 {
+		return nil, false, errors.New("only approved orders on local inbounds can be paused")
+	}
+	active, err := s.ActiveOrderPause(order.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	if active != nil {
+		return nil, false, ErrOrderPaused
+	}
+	left, err := s.PausesLeft(order.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	if left == 0 {
+		return nil, false, ErrPauseLimit
+	}
+	emails, err := s.pauseClientEmails(order)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(emails) == 0 {
+		return nil, false, errors.New("order has no clients")
+	}
+	// Clients disabled for running out of traffic or an unpaid renewal cannot be
+	// paused, or resuming would enable them again.
+	traffic, err := s.inboundService.GetClientTrafficByEmail(emails[0])
+	if err != nil {
+		return nil, false, err
+	}
+	if traffic == nil || !traffic.Enable {
+		return nil, false, errors.New("order's clients are not active")
+	}
+
+	needRestart := false
+	for _, email := range emails {
+		_, restart, err := s.inboundService.SetClientEnableByEmail(email, false)
+		needRestart = needRestart || restart
+		if err != nil {
+			return nil, needRestart, err
+		}
+	}
+	freeze, _ := s.settingService.GetShopPauseFreezeExpiry()
+	pause := &model.ShopOrderPause{OrderId: order.Id, FreezeExpiry: freeze, PausedAt: time.Now()}
+	return pause, needRestart, database.GetShopDB().Create(pause).Error
+}
+
+// pausedSubscriptions returns the subscriptions in the given statuses an
+// order's pause holds back: the order's renewal subscription, or the one it
+// created.
+func pausedSubscriptions(tx *gorm.DB, order *model.ShopOrder, statuses ...string) ([]model.ShopSubscription, error) {
+	var subs []model.ShopSubscription
+	query := tx.Where("status IN ?", statuses)
+	if order.SubscriptionId > 0 {
+		query = query.Where("id = ?", order.SubscriptionId)
+	} else {
+		query = query.Where("order_id = ?", order.Id)
+	}
+	return subs, query.Find(&subs).Error
+}
+
+// UnpauseOrder ends the pause of an order and enables its clients again. When
+// the pause froze the expiry, the clients' expiry and the subscription's due
+// date move back by the length of the pause. Clients that ran out of traffic,
+// expired or whose renewal is overdue stay disabled, as billing would have
+// disabled them had they not been paused, and ErrResumeLapsed is returned. It
+// reports whether Xray needs a restart.
+func (s *ShopService) UnpauseOrder(order *model.ShopOrder) (*model.ShopOrderPause, bool, error) {
+	pause, err := s.ActiveOrderPause(order.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	if pause == nil {
+		return nil, false, ErrOrderNotPaused
+	}
+	emails, err := s.pauseClientEmails(order)
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	shift := time.Duration(0)
+	if pause.FreezeExpiry {
+		shift = now.Sub(pause.PausedAt)
+	}
+
+	// Billing suspends subscriptions past their grace days, counted from the due
+	// date the pause moves back.
+	subs, err := pausedSubscriptions(database.GetShopDB(), order, SubscriptionStatusActive, SubscriptionStatusSuspended)
+	if err != nil {
+		return nil, false, err
+	}
+	graceDays, _ := s.settingService.GetShopRenewalGraceDays()
+	overdue := func(sub *model.ShopSubscription) bool {
+		return !now.Before(sub.NextDueAt.Add(shift).AddDate(0, 0, graceDays))
+	}
+	lapsed := false
+	for i := range subs {
+		lapsed = lapsed || overdue(&subs[i])
+	}
+
+	needRestart := false
+	for _, email := range emails {
+		traffic, err := s.inboundService.GetClientTrafficByEmail(email)
+		if err != nil || traffic == nil {
+			continue
+		}
+		expiry := traffic.ExpiryTime
+		// Clients whose expiry starts on first use (negative) lose nothing.
+		if shift > 0 && expiry > 0 {
+			expiry += shift.Milliseconds()
+			restart, err := s.inboundService.ResetClientExpiryTimeByEmail(email, expiry)
+			needRestart = needRestart || restart
+			if err != nil {
+				return nil, needRestart, err
+			}
+		}
+		if (traffic.Total > 0 && traffic.Up+traffic.Down >= traffic.Total) || (expiry > 0 && expiry <= now.UnixMilli()) {
+			lapsed = true
+		}
+	}
+	if !lapsed {
+		for _, email := range emails {
+			_, restart, err := s.inboundService.SetClientEnableByEmail(email, true)
+			needRestart = needRestart || restart
+			if err != nil {
+				return nil, needRestart, err
+			}
+		}
+	}
+
+	pause.ResumedAt = now
+	err = database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(pause).Update("resumed_at", now).Error; err != nil {
+			return err
+		}
+		if shift == 0 {
+			return nil
+		}
+		// A subscription suspended while frozen is active again when its moved
+		// due date leaves it within its grace days.
+		for i := range subs {
+			updates := map[string]any{"next_due_at": subs[i].NextDueAt.Add(shift), "updated_at": now}
+			if !overdue(&subs[i]) {
+				updates["status"] = SubscriptionStatusActive
+			}
+			if err := tx.Model(&model.ShopSubscription{}).Where("id = ?", subs[i].Id).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && lapsed {
+		err = ErrResumeLapsed
+	}
+	return pause, needRestart, err
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"slices"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+const (
+	PaymentRotationRoundRobin = "round_robin"
+	PaymentRotationLeastUsed  = "least_used"
+	PaymentRotationPriority   = "priority"
+)
+
+// ShopPaymentDestinationUsage is a payment destination with the order total assigned to it today.
+type ShopPaymentDestinationUsage struct {
+	model.ShopPaymentDestination
+	UsedToday int64 `json:"usedToday"`
+}
+
+func (s *ShopService) ListPaymentDestinations() ([]ShopPaymentDestinationUsage, error) {
+	var dests []model.ShopPaymentDestination
+	if err := database.GetShopDB().Order("sort_order asc, id asc").Find(&dests).Error; err != nil {
+		return nil, err
+	}
+	used, err := s.paymentDestinationUsageToday()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]ShopPaymentDestinationUsage, 0, len(dests))
+	for _, dest := range dests {
+		result = append(result, ShopPaymentDestinationUsage{ShopPaymentDestination: dest, UsedToday: used[dest.Id]})
+	}
+	return result, nil
+}
+
+func (s *ShopService) GetPaymentDestination(id int) (*model.ShopPaymentDestination, error) {
+	dest := &model.ShopPaymentDestination{}
+	if err := database.GetShopDB().First(dest, id).Error; err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+func (s *ShopService) SavePaymentDestination(dest *model.ShopPaymentDestination) error {
+	if err := validatePaymentDestination(dest); err != nil {
+		return err
+	}
+	db := database.GetShopDB()
+	dest.UpdatedAt = time.Now()
+	if dest.Id > 0 {
+		return db.Model(&model.ShopPaymentDestination{}).Where("id = ?", dest.Id).Updates(map[string]any{
+			"name":       dest.Name,
+			"kind":       dest.Kind,
+			"value":      dest.Value,
+			"holder":     dest.Holder,
+			"daily_cap":  dest.DailyCap,
+			"sort_order": dest.SortOrder,
+			"enabled":    dest.Enabled,
+			"updated_at": dest.UpdatedAt,
+		}).Error
+	}
+	dest.CreatedAt = time.Now()
+	return db.Create(dest).Error
+}
+
+func (s *ShopService) DeletePaymentDestination(id int) error {
+	return database.GetShopDB().Delete(&model.ShopPaymentDestination{}, id).Error
+}
+
+// paymentDestinationUsageToday sums the prices of today's non-rejected orders per destination.
+func (s *ShopService) paymentDestinationUsageToday() (map[int]int64, error) {
+	startOfDay := s.StartOfDay(time.Now())
+	var rows []struct {
+		PaymentDestinationId int
+		Total                int64
+	}
+	err := database.GetShopDB().Model(&model.ShopOrder{}).
+		Select("payment_destination_id, SUM(price) AS total").
+		Where("payment_destination_id > 0 AND status <> ? AND created_at >= ?", OrderStatusRejected, startOfDay).
+		Group("payment_destination_id").Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int]int64, len(rows))
+	for _, row := range rows {
+		used[row.PaymentDestinationId] = row.Total
+	}
+	return used, nil
+}
+
+// NextPaymentDestination picks the destination of one of kinds for a payment of
+// amount using the configured rotation rule, skipping destinations whose daily
+// cap would be exceeded. It returns nil when no such destination is configured
+// or all are capped.
+func (s *ShopService) NextPaymentDestination(amount int64, kinds []string) (*model.ShopPaymentDestination, error) {
+	var dests []model.ShopPaymentDestination
+	if err := database.GetShopDB().Where("enabled = ?", true).Order("sort_order asc, id asc").Find(&dests).Error; err != nil {
+		return nil, err
+	}
+	used, err := s.paymentDestinationUsageToday()
+	if err != nil {
+		return nil, err
+	}
+	var available []model.ShopPaymentDestination
+	for _, dest := range dests {
+		if !slices.Contains(kinds, destinationKind(&dest)) {
+			continue
+		}
+		if dest.DailyCap == 0 || used[dest.Id]+amount <= dest.DailyCap {
+			available = append(available, dest)
+		}
+	}
+	if len(available) == 0 {
+		return nil, nil
+	}
+
+	rotation, _ := s.settingService.GetShopPaymentRotation()
+	switch rotation {
+	case PaymentRotationPriority:
+		return &available[0], nil
+	case PaymentRotationLeastUsed:
+		best := 0
+		for i := range available {
+			if used[available[i].Id] < used[available[best].Id] {
+				best = i
+			}
+		}
+		return &available[best], nil
+	default:
+		var last model.ShopOrder
+		err := database.GetShopDB().Where("payment_destination_id > 0").Order("id desc").Limit(1).Find(&last).Error
+		if err != nil {
+			return nil, err
+		}
+		for i := range available {
+			if available[i].Id == last.PaymentDestinationId {
+				return &available[(i+1)%len(available)], nil
+			}
+		}
+		return &available[0], nil
+	}
+}
+
+// AssignPaymentDestination records the destination shown for an order, picking one
+// if the order has none yet or its package no longer accepts that kind, and
+// returns it.
+func (s *ShopService) AssignPaymentDestination(orderId int) (*model.ShopPaymentDestination, error) {
+	order, err := s.GetOrder(orderId)
+	if err != nil {
+		return nil, err
+	}
+	kinds := s.receiptDestinationKinds(order)
+	if order.PaymentDestinationId > 0 {
+		if dest, err := s.GetPaymentDestination(order.PaymentDestinationId); err == nil && slices.Contains(kinds, destinationKind(dest)) {
+			return dest, nil
+		}
+	}
+	dest, err := s.NextPaymentDestination(order.Price, kinds)
+	if err != nil || dest == nil {
+		return nil, err
+	}
+	err = database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", order.Id).Update("payment_destination_id", dest.Id).Error
+	return dest, err
+}
+
+// destinationKind returns the kind of a payment destination, destinations saved
+// without one being cards.
+func destinationKind(dest *model.ShopPaymentDestination) string {
+	if dest.Kind == "" {
+		return PaymentMethodCard
+	}
+	return dest.Kind
+}
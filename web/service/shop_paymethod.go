@@ -0,0 +1,71 @@
+package service
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// Payment methods a package can restrict its orders to.
+const (
+	PaymentMethodCard      = "card"      // Transfer to a bank card destination, proven by a receipt
+	PaymentMethodWallet    = "wallet"    // Transfer to a wallet destination, proven by a receipt
+	PaymentMethodTelegram  = "telegram"  // Telegram invoice in Stars or through a provider
+	PaymentMethodLightning = "lightning" // Lightning invoice
+	PaymentMethodGateway   = "gateway"   // Merchant payment gateway
+)
+
+// ShopPaymentMethods are the payment methods in the order they are offered.
+var ShopPaymentMethods = []string{PaymentMethodCard, PaymentMethodWallet, PaymentMethodTelegram, PaymentMethodLightning, PaymentMethodGateway}
+
+// normalizePaymentMethods trims, lower-cases and orders a comma-separated list
+// of payment methods, dropping repeats. It reports false when the list names
+// an unknown method.
+func normalizePaymentMethods(value string) (string, bool) {
+	methods := []string{}
+	for _, method := range splitShopTags(strings.ToLower(value)) {
+		if !slices.Contains(ShopPaymentMethods, method) {
+			return value, false
+		}
+		methods = append(methods, method)
+	}
+	ordered := []string{}
+	for _, method := range ShopPaymentMethods {
+		if slices.Contains(methods, method) {
+			ordered = append(ordered, method)
+		}
+	}
+	return strings.Join(ordered, ","), true
+}
+
+// OrderPaymentMethods returns the payment methods an order may be paid with.
+// Orders of packages that restrict none, and orders without a package, may be
+// paid with any.
+func (s *ShopService) OrderPaymentMethods(order *model.ShopOrder) []string {
+	if order.PackageId == nil {
+		return ShopPaymentMethods
+	}
+	pkg, err := s.GetPackage(*order.PackageId)
+	if err != nil || pkg.PaymentMethods == "" {
+		return ShopPaymentMethods
+	}
+	return splitShopTags(pkg.PaymentMethods)
+}
+
+// PaymentMethodAllowed tells whether an order may be paid with method.
+func (s *ShopService) PaymentMethodAllowed(order *model.ShopOrder, method string) bool {
+	return slices.Contains(s.OrderPaymentMethods(order), method)
+}
+
+// receiptDestinationKinds returns the kinds of payment destinations an order
+// may be paid to, which are named like their payment methods.
+func (s *ShopService) receiptDestinationKinds(order *model.ShopOrder) []string {
+	kinds := []string{}
+	for _, method := range s.OrderPaymentMethods(order) {
+		if method == PaymentMethodCard || method == PaymentMethodWallet {
+			kinds = append(kinds, method)
+		}
+	}
+	return kinds
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// ShopPoolUsage reports the shared traffic of a pooled order.
+type ShopPoolUsage struct {
+	Used      int64 `json:"used"`
+	Total     int64 `json:"total"`
+	Devices   int   `json:"devices"`
+	Exhausted bool  `json:"exhausted"`
+}
+
+// OrderClientEmails returns the emails of every client provisioned for an order.
+func (s *ShopService) OrderClientEmails(order *model.ShopOrder) []string {
+	if order.ClientEmails == "" {
+		if order.ClientEmail == "" {
+			return nil
+		}
+		return []string{order.ClientEmail}
+	}
+	return strings.Split(order.ClientEmails, ",")
+}
+
+// PoolUsage sums the traffic of all clients of a pooled order.
+func (s *ShopService) PoolUsage(order *model.ShopOrder) (*ShopPoolUsage, error) {
+	emails := s.OrderClientEmails(order)
+	var traffics []xray.ClientTraffic
+	if err := database.GetDB().Model(&xray.ClientTraffic{}).Where("email IN ?", emails).Find(&traffics).Error; err != nil {
+		return nil, err
+	}
+	usage := &ShopPoolUsage{Total: order.PoolBytes, Devices: len(emails)}
+	for _, traffic := range traffics {
+		usage.Used += traffic.Up + traffic.Down
+	}
+	usage.Exhausted = usage.Total > 0 && usage.Used >= usage.Total
+	return usage, nil
+}
+
+// EnforcePooledOrders disables every client of a pooled order once the
+// combined traffic of its clients reaches the pool size.
+func (s *ShopService) EnforcePooledOrders() (bool, error) {
+	var orders []model.ShopOrder
+	err := database.GetShopDB().Where("status = ? AND pool_bytes > 0 AND client_emails <> ''", OrderStatusApproved).Find(&orders).Error
+	if err != nil {
+		return false, err
+	}
+	needRestart := false
+	for i := range orders {
+		usage, err := s.PoolUsage(&orders[i])
+		if err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: orders[i].Id, "error": err}).Warning("shop pool usage failed")
+			continue
+		}
+		if !usage.Exhausted {
+			continue
+		}
+		for _, email := range s.OrderClientEmails(&orders[i]) {
+			changed, restart, err := s.inboundService.SetClientEnableByEmail(email, false)
+			if err != nil {
+				logger.WithFields(logger.Fields{logger.FieldOrderId: orders[i].Id, "client": email, "error": err}).Warning("shop pool failed to disable client")
+				continue
+			}
+			if changed {
+				logger.WithFields(logger.Fields{logger.FieldOrderId: orders[i].Id, "client": email}).Info("shop pool exhausted, client disabled")
+			}
+			needRestart = needRestart || restart
+		}
+	}
+	return needRestart, nil
+}
@@ -0,0 +1,366 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+
+	"gorm.io/gorm"
+)
+
+// ErrCustomerOrdersOpen is returned when erasing a customer who still has
+// orders in progress.
+var ErrCustomerOrdersOpen = errors.New("customer has orders in progress")
+
+// shopOpenOrderStatuses are the statuses of orders still being worked on.
+var shopOpenOrderStatuses = []string{
+	OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusOnHold,
+	OrderStatusScheduled, OrderStatusProvisioning,
+}
+
+// ShopCustomerExport is everything the shop stores about one customer. Receipt
+// images are described by their file name and hash, not included.
+type ShopCustomerExport struct {
+	TelegramId     int64                     `json:"telegramId"`
+	ExportedAt     time.Time                 `json:"exportedAt"`
+	Profile        *model.ShopCustomer       `json:"profile"`
+	Orders         []model.ShopOrder         `json:"orders"`
+	ArchivedOrders []model.ShopOrderArchive  `json:"archivedOrders"`
+	Payments       []model.ShopOrderPayment  `json:"payments"`
+	Subscriptions  []model.ShopSubscription  `json:"subscriptions"`
+	Tickets        []model.ShopTicket        `json:"tickets"`
+	Messages       []model.ShopTicketMessage `json:"messages"`
+	AbuseLogs      []model.ShopAbuseLog      `json:"abuseLogs"`
+	Conversation   *model.ShopConversation   `json:"conversation"`
+}
+
+// ShopCustomerErasure reports what erasing a customer's data changed.
+type ShopCustomerErasure struct {
+	Orders   int `json:"orders"`   // Orders, archived ones included, anonymized
+	Clients  int `json:"clients"`  // Clients of those orders renamed to random emails
+	Receipts int `json:"receipts"` // Receipt images removed from disk
+	Tickets  int `json:"tickets"`  // Support tickets deleted with their messages
+}
+
+// ExportCustomerData returns the data stored about the customer with the
+// given Telegram ID. Internal admin comments on their orders are left out.
+func (s *ShopService) ExportCustomerData(tgId int64) (*ShopCustomerExport, error) {
+	if tgId <= 0 {
+		return nil, errors.New("invalid Telegram ID")
+	}
+	db := database.GetShopDB()
+	export := &ShopCustomerExport{
+		TelegramId:     tgId,
+		ExportedAt:     time.Now(),
+		Orders:         []model.ShopOrder{},
+		ArchivedOrders: []model.ShopOrderArchive{},
+		Payments:       []model.ShopOrderPayment{},
+		Subscriptions:  []model.ShopSubscription{},
+		Tickets:        []model.ShopTicket{},
+		Messages:       []model.ShopTicketMessage{},
+		AbuseLogs:      []model.ShopAbuseLog{},
+	}
+	profile := &model.ShopCustomer{}
+	if err := db.Where("telegram_id = ?", tgId).Limit(1).Find(profile).Error; err != nil {
+		return nil, err
+	}
+	if profile.TelegramId != 0 {
+		export.Profile = profile
+	}
+	conversation := &model.ShopConversation{}
+	if err := db.Where("telegram_id = ?", tgId).Limit(1).Find(conversation).Error; err != nil {
+		return nil, err
+	}
+	if conversation.TelegramId != 0 {
+		export.Conversation = conversation
+	}
+
+	err := db.Where("telegram_id = ?", tgId).Order("id").Find(&export.Orders).Error
+	if err == nil {
+		err = db.Where("telegram_id = ?", tgId).Order("id").Find(&export.ArchivedOrders).Error
+	}
+	if err == nil {
+		err = db.Where("order_id IN (?) OR order_id IN (?)",
+			db.Model(&model.ShopOrder{}).Select("id").Where("telegram_id = ?", tgId),
+			db.Model(&model.ShopOrderArchive{}).Select("id").Where("telegram_id = ?", tgId)).
+			Order("id").Find(&export.Payments).Error
+	}
+	if err == nil {
+		err = db.Where("telegram_id = ?", tgId).Order("id").Find(&export.Subscriptions).Error
+	}
+	if err == nil {
+		err = db.Where("telegram_id = ?", tgId).Order("id").Find(&export.Tickets).Error
+	}
+	if err == nil {
+		err = db.Where("ticket_id IN (?)", db.Model(&model.ShopTicket{}).Select("id").Where("telegram_id = ?", tgId)).
+			Order("id").Find(&export.Messages).Error
+	}
+	if err == nil {
+		err = db.Where("telegram_id = ?", tgId).Order("id").Find(&export.AbuseLogs).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Receipts are described, not located: their paths are the panel's business.
+	for i := range export.Orders {
+		export.Orders[i].ReceiptPath = receiptFileName(export.Orders[i].ReceiptPath)
+	}
+	for i := range export.ArchivedOrders {
+		export.ArchivedOrders[i].ReceiptPath = receiptFileName(export.ArchivedOrders[i].ReceiptPath)
+	}
+	return export, nil
+}
+
+// ShopCustomerExportFileName names the file a customer's data export is
+// downloaded or sent as.
+func ShopCustomerExportFileName(tgId int64) string {
+	return fmt.Sprintf("customer-%d-data-%s.json", tgId, time.Now().Format("20060102"))
+}
+
+func receiptFileName(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Base(path)
+}
+
+// EraseCustomerData deletes the customer with the given Telegram ID: their
+// profile, support tickets, bot conversation and abuse logs are deleted, their
+// receipt images removed, and their orders, archived ones included, detached
+// from them with their contact details cleared. The clients of those orders,
+// named after the Telegram ID by the default naming pattern, get random emails
+// and lose the Telegram ID the inbounds keep on them. Prices, statuses and
+// dates stay, so revenue figures do not change. Active subscriptions are
+// cancelled. Customers with orders in progress are refused with
+// ErrCustomerOrdersOpen.
+func (s *ShopService) EraseCustomerData(tgId int64) (*ShopCustomerErasure, error) {
+	if tgId <= 0 {
+		return nil, errors.New("invalid Telegram ID")
+	}
+	db := database.GetShopDB()
+	var open int64
+	if err := db.Model(&model.ShopOrder{}).Where("telegram_id = ? AND status IN ?", tgId, shopOpenOrderStatuses).Count(&open).Error; err != nil {
+		return nil, err
+	}
+	if open > 0 {
+		return nil, fmt.Errorf("%w: %d", ErrCustomerOrdersOpen, open)
+	}
+
+	clients, err := s.anonymizeCustomerClients(tgId)
+	if err != nil {
+		return nil, err
+	}
+	erasure := &ShopCustomerErasure{Clients: clients}
+	var receipts []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		for _, m := range []any{&model.ShopOrder{}, &model.ShopOrderArchive{}} {
+			var paths []string
+			if err := tx.Model(m).Where("telegram_id = ? AND receipt_path <> ''", tgId).Pluck("receipt_path", &paths).Error; err != nil {
+				return err
+			}
+			receipts = append(receipts, paths...)
+			// updated_at is left alone so the orders keep their closing time.
+			result := tx.Model(m).Where("telegram_id = ?", tgId).UpdateColumns(map[string]any{
+				"telegram_id":       0,
+				"telegram_username": "",
+				"phone":             "",
+				"contact_email":     "",
+				"receipt_path":      "",
+				"receipt_file_id":   "",
+				"ocr_reference":     "",
+				"hold_reason":       "",
+				"deep_link":         "",
+				"custom_fields":     "",
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			erasure.Orders += int(result.RowsAffected)
+		}
+		err := tx.Model(&model.ShopSubscription{}).Where("telegram_id = ?", tgId).UpdateColumns(map[string]any{
+			"telegram_id": 0,
+			"status":      SubscriptionStatusCancelled,
+			"updated_at":  time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		ticketIds := tx.Model(&model.ShopTicket{}).Select("id").Where("telegram_id = ?", tgId)
+		if err := tx.Where("ticket_id IN (?)", ticketIds).Delete(&model.ShopTicketMessage{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("telegram_id = ?", tgId).Delete(&model.ShopTicket{})
+		if result.Error != nil {
+			return result.Error
+		}
+		erasure.Tickets = int(result.RowsAffected)
+		for _, m := range []any{&model.ShopConversation{}, &model.ShopAbuseLog{}, &model.ShopCustomer{}} {
+			if err := tx.Where("telegram_id = ?", tgId).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	forgetCustomer(tgId)
+
+	for _, path := range receipts {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.WithFields(logger.Fields{"error": err}).Warning("remove erased customer's receipt failed")
+			continue
+		}
+		erasure.Receipts++
+	}
+	return erasure, nil
+}
+
+// anonymizeCustomerClients renames the clients of a customer's orders, archived
+// ones included, and returns how many it renamed. A failed erasure can be run
+// again: clients renamed by it are renamed once more.
+func (s *ShopService) anonymizeCustomerClients(tgId int64) (int, error) {
+	db := database.GetShopDB()
+	var orders []model.ShopOrder
+	if err := db.Where("telegram_id = ?", tgId).Order("id").Find(&orders).Error; err != nil {
+		return 0, err
+	}
+	var archived []model.ShopOrderArchive
+	if err := db.Where("telegram_id = ?", tgId).Order("id").Find(&archived).Error; err != nil {
+		return 0, err
+	}
+	for i := range archived {
+		orders = append(orders, archived[i].ShopOrder)
+	}
+
+	renamed := 0
+	needRestart := false
+	defer func() {
+		if needRestart {
+			s.xrayService.SetToNeedRestart()
+		}
+	}()
+	seen := map[string]bool{}
+	for i := range orders {
+		clients, err := s.ListOrderClients(&orders[i])
+		if err != nil {
+			return renamed, err
+		}
+		for _, client := range clients {
+			if client.Email == "" || seen[client.Email] {
+				continue
+			}
+			seen[client.Email] = true
+			nodeId, inboundId, err := s.orderClientInbound(&orders[i], client.Email)
+			if err != nil {
+				return renamed, err
+			}
+			restart, err := s.anonymizeClient(nodeId, inboundId, client.Email)
+			needRestart = needRestart || restart
+			if err != nil {
+				return renamed, err
+			}
+			renamed++
+		}
+	}
+	return renamed, nil
+}
+
+// anonymizeClient gives a client a random email and clears its Telegram ID,
+// on its inbound and on the shop rows referring to it. Clients removed from
+// their inbound, or on a node no longer known, are only renamed in the shop.
+// It reports whether Xray needs a restart.
+func (s *ShopService) anonymizeClient(nodeId, inboundId int, email string) (bool, error) {
+	erased := "erased-" + randomFrom("abcdefghijklmnopqrstuvwxyz0123456789", 12) + "@shop"
+	var node *model.ShopNode
+	var inbound *model.Inbound
+	var err error
+	if nodeId > 0 {
+		if node, err = s.shopNodeService.GetNode(nodeId); err == nil {
+			inbound, err = s.shopNodeService.RemoteInbound(node, inboundId)
+		}
+	} else {
+		_, inbound, err = s.inboundService.GetClientInboundByEmail(email)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		inbound, err = nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	needRestart := false
+	if inbound != nil {
+		client, key, err := findInboundClient(inbound, email)
+		switch {
+		case errors.Is(err, errInboundClientMissing):
+		case err != nil:
+			return false, err
+		default:
+			client["email"] = erased
+			client["tgId"] = 0
+			data, err := json.Marshal(map[string]any{"clients": []any{client}})
+			if err != nil {
+				return false, err
+			}
+			if node != nil {
+				err = s.shopNodeService.UpdateRemoteClient(node, inbound.Id, key, string(data))
+			} else {
+				needRestart, err = s.inboundService.UpdateInboundClient(&model.Inbound{Id: inbound.Id, Settings: string(data)}, key)
+			}
+			if err != nil {
+				return needRestart, err
+			}
+		}
+	}
+	return needRestart, renameShopClient(email, erased)
+}
+
+// renameShopClient replaces a client's email on the orders, archived orders,
+// cart items, order clients and short links that refer to it.
+func renameShopClient(email, renamed string) error {
+	return database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		for _, m := range []any{&model.ShopOrder{}, &model.ShopOrderArchive{}} {
+			if err := tx.Model(m).Where("client_email = ?", email).UpdateColumn("client_email", renamed).Error; err != nil {
+				return err
+			}
+			var rows []struct {
+				Id           int
+				ClientEmails string
+			}
+			err := tx.Model(m).Select("id, client_emails").Where("client_emails LIKE ?", "%"+email+"%").Scan(&rows).Error
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				emails := strings.Split(row.ClientEmails, ",")
+				for i := range emails {
+					if emails[i] == email {
+						emails[i] = renamed
+					}
+				}
+				err := tx.Model(m).Where("id = ?", row.Id).UpdateColumn("client_emails", strings.Join(emails, ",")).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Model(&model.ShopOrderItem{}).Where("client_email = ?", email).Update("client_email", renamed).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.ShopOrderClient{}).Where("email = ?", email).Update("email", renamed).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model.ShopShortLink{}).Where("email = ?", email).Update("email", renamed).Error
+	})
+}
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// Orders whose provisioning fails, say while Xray restarts or a node's API is
+// unreachable, move to PROVISIONING and are retried by the provisioning queue
+// with an exponential backoff. After ShopProvisionMaxAttempts failures an order
+// is left for the admin to retry by hand.
+const (
+	ShopProvisionMaxAttempts = 8
+	shopProvisionBaseDelay   = 30 * time.Second
+	shopProvisionMaxDelay    = time.Hour
+)
+
+// shopProvisionableStatuses are the statuses of orders that are approved but
+// have no clients yet: awaiting approval, scheduled or queued for a retry.
+var shopProvisionableStatuses = []string{OrderStatusPendingReview, OrderStatusScheduled, OrderStatusProvisioning}
+
+// ErrProvisionQueued is returned when an approved order could not be
+// provisioned and was queued for another attempt.
+var ErrProvisionQueued = errors.New("provisioning failed, queued for retry")
+
+// ErrProvisionBusy is returned when an order is already being provisioned.
+var ErrProvisionBusy = errors.New("order is already being provisioned")
+
+// shopProvisionClaimTTL is how long a claim on an order holds. A panel stopped
+// while provisioning leaves its claim behind, which others take over after it.
+const shopProvisionClaimTTL = 10 * time.Minute
+
+// provisioningOrders holds the ids of the orders being provisioned by this
+// panel, sparing the database a claim the panel itself already holds.
+var provisioningOrders sync.Map
+
+// claimProvision marks an order as being provisioned, in this panel and in the
+// shop database, so neither the queue and an admin nor panels sharing an
+// external shop database provision the same order twice at once. It returns
+// ErrProvisionBusy when the order already is; otherwise the returned func must
+// be called once done.
+func claimProvision(orderId int) (release func(), err error) {
+	if _, busy := provisioningOrders.LoadOrStore(orderId, struct{}{}); busy {
+		return nil, ErrProvisionBusy
+	}
+	now := time.Now()
+	db := database.GetShopDB()
+	result := db.Model(&model.ShopOrder{}).
+		Where("id = ? AND (provision_claimed_at IS NULL OR provision_claimed_at < ?)", orderId, now.Add(-shopProvisionClaimTTL)).
+		UpdateColumn("provision_claimed_at", now)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = ErrProvisionBusy
+		if err := db.First(&model.ShopOrder{}, orderId).Error; err != nil {
+			result.Error = err
+		}
+	}
+	if result.Error != nil {
+		provisioningOrders.Delete(orderId)
+		return nil, result.Error
+	}
+	return func() {
+		err := db.Model(&model.ShopOrder{}).Where("id = ?", orderId).UpdateColumn("provision_claimed_at", nil).Error
+		if err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: orderId, "error": err}).Warning("release order provisioning claim failed")
+		}
+		provisioningOrders.Delete(orderId)
+	}, nil
+}
+
+// MarkOrderEffectApplied records that the renewal, upgrade or top-up of an
+// order was applied to its client, with the client it was applied to. Should
+// the order then fail to be saved as provisioned, a retry finds the mark and
+// does not extend or top up the client a second time.
+func (s *ShopService) MarkOrderEffectApplied(order *model.ShopOrder) error {
+	now := time.Now()
+	err := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ?", order.Id).
+		Updates(map[string]any{
+			"effect_applied_at": now,
+			"node_id":           order.NodeId,
+			"inbound_id":        order.InboundId,
+			"client_email":      order.ClientEmail,
+			"client_id":         order.ClientId,
+			"client_sub_id":     order.ClientSubId,
+			"updated_at":        now,
+		}).Error
+	if err != nil {
+		return err
+	}
+	order.EffectAppliedAt = now
+	return nil
+}
+
+// provisionBackoff returns the delay before the next attempt of an order that
+// has failed attempts times.
+func provisionBackoff(attempts int) time.Duration {
+	delay := shopProvisionBaseDelay
+	for i := 1; i < attempts && delay < shopProvisionMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, shopProvisionMaxDelay)
+}
+
+// ProvisionStuck reports whether an order has used up its automatic attempts.
+func ProvisionStuck(order *model.ShopOrder) bool {
+	return order.Status == OrderStatusProvisioning && order.ProvisionAttempts >= ShopProvisionMaxAttempts
+}
+
+// QueueProvisioning records a failed provisioning attempt of an order under
+// review, scheduled or already queued, and schedules the next one.
+func (s *ShopService) QueueProvisioning(order *model.ShopOrder, cause error) error {
+	attempts := order.ProvisionAttempts + 1
+	next := time.Now().Add(provisionBackoff(attempts))
+	result := database.GetShopDB().Model(&model.ShopOrder{}).
+		Where("id = ? AND status IN ?", order.Id, shopProvisionableStatuses).
+		Updates(map[string]any{
+			"status":             OrderStatusProvisioning,
+			"provision_attempts": attempts,
+			"provision_error":    cause.Error(),
+			"next_provision_at":  next,
+			"updated_at":         time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("order is no longer awaiting provisioning")
+	}
+	queued := order.Status != OrderStatusProvisioning
+	order.Status = OrderStatusProvisioning
+	order.ProvisionAttempts = attempts
+	order.ProvisionError = cause.Error()
+	order.NextProvisionAt = next
+	if queued {
+		publishOrderStatus(order.Id, OrderStatusProvisioning)
+	}
+	return nil
+}
+
+// DueProvisioningOrders returns the queued orders whose next attempt is due.
+func (s *ShopService) DueProvisioningOrders(now time.Time) ([]model.ShopOrder, error) {
+	orders := []model.ShopOrder{}
+	err := database.GetShopDB().
+		Where("status = ? AND provision_attempts < ? AND next_provision_at <= ?", OrderStatusProvisioning, ShopProvisionMaxAttempts, now).
+		Order("next_provision_at asc").Find(&orders).Error
+	return orders, err
+}
+
+// ScheduleOrder approves an order under review, or reschedules a scheduled
+// one, to be provisioned at a later time by the provisioning queue.
+func (s *ShopService) ScheduleOrder(id int, at time.Time) (*model.ShopOrder, error) {
+	if !at.After(time.Now()) {
+		return nil, errors.New("scheduled time must be in the future")
+	}
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.CheckOrderPaid(order); err != nil {
+		return nil, err
+	}
+	result := database.GetShopDB().Model(&model.ShopOrder{}).
+		Where("id = ? AND status IN ?", id, []string{OrderStatusPendingReview, OrderStatusScheduled}).
+		Updates(map[string]any{
+			"status":       OrderStatusScheduled,
+			"scheduled_at": at,
+			"updated_at":   time.Now(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("order is not pending review")
+	}
+	publishOrderStatus(id, OrderStatusScheduled)
+	return s.GetOrder(id)
+}
+
+// DueScheduledOrders returns the scheduled orders whose time has come.
+func (s *ShopService) DueScheduledOrders(now time.Time) ([]model.ShopOrder, error) {
+	orders := []model.ShopOrder{}
+	err := database.GetShopDB().Where("status = ? AND scheduled_at <= ?", OrderStatusScheduled, now).
+		Order("scheduled_at asc").Find(&orders).Error
+	return orders, err
+}
+
+// ListProvisioningOrders returns every queued order, those that used up their
+// automatic attempts first.
+func (s *ShopService) ListProvisioningOrders() ([]model.ShopOrder, error) {
+	orders := []model.ShopOrder{}
+	err := database.GetShopDB().Where("status = ?", OrderStatusProvisioning).
+		Order("provision_attempts desc, id asc").Find(&orders).Error
+	return orders, err
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+const (
+	RateKindMessage  = "message"
+	RateKindOrder    = "order"
+	RateKindReceipt  = "receipt"
+	RateKindRotation = "rotation"
+)
+
+// shopRotationsPerDay limits credential rotations, which break every device
+// still using the old config.
+const shopRotationsPerDay = 3
+
+// ErrRateLimited is returned when a customer goes over a bot rate limit.
+// Actions during the following cooldown fail with an error wrapping it.
+var ErrRateLimited = errors.New("too many requests")
+
+var errRateCoolingDown = fmt.Errorf("%w: cooling down", ErrRateLimited)
+
+// shopRateLimiter keeps sliding windows of recent customer actions in memory.
+type shopRateLimiter struct {
+	mu        sync.Mutex
+	events    map[string][]time.Time
+	cooldowns map[int64]time.Time
+}
+
+var shopRates = &shopRateLimiter{
+	events:    map[string][]time.Time{},
+	cooldowns: map[int64]time.Time{},
+}
+
+// CheckRate records a customer action of the given kind and fails when the action
+// goes over its limit or the customer is cooling down. Going over a limit starts a
+// cooldown and writes an abuse log entry.
+func (s *ShopService) CheckRate(tgId int64, kind string) error {
+	var limit int
+	var window time.Duration
+	switch kind {
+	case RateKindMessage:
+		limit, _ = s.settingService.GetShopRateMessagesPerMinute()
+		window = time.Minute
+	case RateKindOrder:
+		limit, _ = s.settingService.GetShopRateOrdersPerHour()
+		window = time.Hour
+	case RateKindReceipt:
+		limit, _ = s.settingService.GetShopRateReceiptsPerHour()
+		window = time.Hour
+	case RateKindRotation:
+		limit, window = shopRotationsPerDay, 24*time.Hour
+	}
+
+	now := time.Now()
+	shopRates.mu.Lock()
+	defer shopRates.mu.Unlock()
+	if until, ok := shopRates.cooldowns[tgId]; ok {
+		if now.Before(until) {
+			return errRateCoolingDown
+		}
+		delete(shopRates.cooldowns, tgId)
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf("%d:%s", tgId, kind)
+	recent := shopRates.events[key][:0]
+	for _, at := range shopRates.events[key] {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= limit {
+		shopRates.events[key] = recent
+		cooldown, _ := s.settingService.GetShopRateCooldownMinutes()
+		shopRates.cooldowns[tgId] = now.Add(time.Duration(cooldown) * time.Minute)
+		s.logAbuse(tgId, kind, fmt.Sprintf("more than %d per %s, cooling down %d minutes", limit, window, cooldown))
+		return ErrRateLimited
+	}
+	shopRates.events[key] = append(recent, now)
+	return nil
+}
+
+func (s *ShopService) logAbuse(tgId int64, kind, detail string) {
+	logger.WithFields(logger.Fields{"telegram_id": tgId, "kind": kind, "detail": detail}).Warning("shop rate limit hit")
+	err := database.GetShopDB().Create(&model.ShopAbuseLog{
+		TelegramId: tgId,
+		Kind:       kind,
+		Detail:     detail,
+		CreatedAt:  time.Now(),
+	}).Error
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("save shop abuse log failed")
+	}
+}
+
+func (s *ShopService) ListAbuseLogs(limit int) ([]model.ShopAbuseLog, error) {
+	var logs []model.ShopAbuseLog
+	err := database.GetShopDB().Order("id desc").Limit(limit).Find(&logs).Error
+	return logs, err
+}
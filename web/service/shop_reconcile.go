@@ -0,0 +1,221 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// How a bank statement transaction was matched to an order.
+const (
+	StatementMatchCode      = "code"      // The transaction pays the unique amount of an order with an amount code
+	StatementMatchReference = "reference" // The transaction names the order and pays its balance
+	StatementMatchAmount    = "amount"    // The transaction pays the balance of the order
+)
+
+// statementColumns are the header names accepted for each statement column,
+// as banks label them differently.
+var statementColumns = map[string][]string{
+	"amount":    {"amount", "credit", "deposit"},
+	"reference": {"reference", "ref", "description", "memo", "details", "narrative"},
+	"date":      {"date", "value date", "booking date"},
+}
+
+// statementOrderRe finds order numbers such as #42 or "order 42" in a
+// transaction's reference.
+var statementOrderRe = regexp.MustCompile(`(?i)(?:#|order\s*#?\s*)(\d+)`)
+
+// ShopStatementMatch is an order suggested as paid by one transaction of a bank
+// statement.
+type ShopStatementMatch struct {
+	Line        int    `json:"line"`
+	Date        string `json:"date"`
+	Amount      int64  `json:"amount"`
+	Reference   string `json:"reference"`
+	OrderId     int    `json:"orderId"`
+	OrderStatus string `json:"orderStatus"`
+	Match       string `json:"match"`      // StatementMatchCode, StatementMatchReference or StatementMatchAmount
+	Candidates  int    `json:"candidates"` // Orders the amount alone matched, more than 1 when ambiguous
+	Approved    bool   `json:"approved"`   // The order was approved automatically
+}
+
+// ShopReconcileResult lists the matches suggested for a bank statement.
+type ShopReconcileResult struct {
+	Matches   []ShopStatementMatch `json:"matches"`
+	Unmatched int                  `json:"unmatched"` // Credits no open order matched
+	Skipped   int                  `json:"skipped"`   // Debits and empty rows
+	Errors    []string             `json:"errors"`
+}
+
+// ReconcileStatementCSV matches the credits of a bank statement CSV to the
+// orders awaiting a receipt or review. The header must name an amount column
+// and may name reference and date columns. A transaction whose reference
+// names an order, by #id, by its number or by the reference read from its
+// receipt, and pays its balance matches that order; otherwise it matches the
+// oldest order with that balance. A transaction of the exact amount of an order with an amount
+// code matches it before anything else. Each order is matched once. Nothing is
+// changed; the matches are suggestions for the admin to approve.
+func (s *ShopService) ReconcileStatementCSV(r io.Reader) (*ShopReconcileResult, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("csv header missing")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for column, names := range statementColumns {
+			if _, ok := columns[column]; !ok && slices.Contains(names, name) {
+				columns[column] = i
+			}
+		}
+	}
+	if _, ok := columns["amount"]; !ok {
+		return nil, errors.New(`csv column "amount" missing`)
+	}
+
+	var orders []model.ShopOrder
+	err = database.GetShopDB().Where("status IN ?", []string{OrderStatusPendingReceipt, OrderStatusPendingReview}).
+		Order("id asc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	matched := map[int]bool{}
+	currency := s.Currency().Code
+
+	result := &ShopReconcileResult{Matches: []ShopStatementMatch{}, Errors: []string{}}
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: %v", line, err))
+			continue
+		}
+		field := func(name string) string {
+			idx, ok := columns[name]
+			if !ok || idx >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[idx])
+		}
+
+		text := field("amount")
+		if text == "" || strings.HasPrefix(text, "-") {
+			result.Skipped++
+			continue
+		}
+		amount, err := ParsePrice(strings.TrimPrefix(text, "+"), currency)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("line %d: invalid amount %q", line, text))
+			continue
+		}
+		if amount == 0 {
+			result.Skipped++
+			continue
+		}
+		match := ShopStatementMatch{Line: line, Date: field("date"), Amount: amount, Reference: field("reference")}
+		if order := matchStatementCode(orders, matched, amount); order != nil {
+			match.OrderId, match.OrderStatus, match.Match, match.Candidates = order.Id, order.Status, StatementMatchCode, 1
+		} else if order := matchStatementReference(orders, matched, match.Reference, amount); order != nil {
+			match.OrderId, match.OrderStatus, match.Match, match.Candidates = order.Id, order.Status, StatementMatchReference, 1
+		} else {
+			for i := range orders {
+				if matched[orders[i].Id] || orders[i].Price-orders[i].PaidAmount != amount {
+					continue
+				}
+				if match.Candidates == 0 {
+					match.OrderId, match.OrderStatus, match.Match = orders[i].Id, orders[i].Status, StatementMatchAmount
+				}
+				match.Candidates++
+			}
+		}
+		if match.OrderId == 0 {
+			result.Unmatched++
+			continue
+		}
+		matched[match.OrderId] = true
+		result.Matches = append(result.Matches, match)
+	}
+	return result, nil
+}
+
+// matchStatementCode returns the open order with an amount code whose price is
+// amount, or nil. Codes keep the prices of open orders unique.
+func matchStatementCode(orders []model.ShopOrder, matched map[int]bool, amount int64) *model.ShopOrder {
+	for i := range orders {
+		order := &orders[i]
+		if !matched[order.Id] && order.AmountCode > 0 && order.PaidAmount == 0 && order.Price == amount {
+			return order
+		}
+	}
+	return nil
+}
+
+// matchStatementReference returns the open order a transaction reference names
+// whose balance the amount pays, or nil.
+func matchStatementReference(orders []model.ShopOrder, matched map[int]bool, reference string, amount int64) *model.ShopOrder {
+	if reference == "" {
+		return nil
+	}
+	ids := map[int]bool{}
+	for _, m := range statementOrderRe.FindAllStringSubmatch(reference, -1) {
+		if id, err := strconv.Atoi(m[1]); err == nil {
+			ids[id] = true
+		}
+	}
+	reference = strings.ToLower(reference)
+	for i := range orders {
+		order := &orders[i]
+		if matched[order.Id] || order.Price-order.PaidAmount != amount {
+			continue
+		}
+		if ids[order.Id] || (order.Number != "" && strings.Contains(reference, strings.ToLower(order.Number))) ||
+			(order.OcrReference != "" && strings.Contains(reference, strings.ToLower(order.OcrReference))) {
+			return order
+		}
+	}
+	return nil
+}
+
+// ConfirmStatementPayment readies an order a bank statement shows as paid for
+// approval. An order still awaiting its receipt moves to review, keeping the
+// statement's reference in place of the one read from a receipt.
+func (s *ShopService) ConfirmStatementPayment(id int, reference string) (*model.ShopOrder, error) {
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != OrderStatusPendingReceipt {
+		return order, nil
+	}
+	result := database.GetShopDB().Model(&model.ShopOrder{}).Where("id = ? AND status = ?", id, OrderStatusPendingReceipt).
+		Updates(map[string]any{
+			"status":        OrderStatusPendingReview,
+			"ocr_reference": strings.TrimSpace(reference),
+			"updated_at":    time.Now(),
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New("order status changed meanwhile")
+	}
+	publishOrderStatus(id, OrderStatusPendingReview)
+	return s.GetOrder(id)
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// shopReminderWindow is how long after its due time an unpaid order is still
+// reminded, so enabling reminders does not message every old unpaid order.
+const shopReminderWindow = 24 * time.Hour
+
+// shopRecoveredStatuses are the statuses of an order whose receipt was sent.
+var shopRecoveredStatuses = []string{OrderStatusPendingReview, OrderStatusScheduled, OrderStatusProvisioning, OrderStatusApproved}
+
+// DueCartReminders returns the unpaid Telegram orders placed at least delay ago
+// whose customer has not been reminded yet. Renewal orders are left out; the
+// billing job asks for those.
+func (s *ShopService) DueCartReminders(now time.Time, delay time.Duration) ([]model.ShopOrder, error) {
+	orders := []model.ShopOrder{}
+	due := now.Add(-delay)
+	err := database.GetShopDB().
+		Where("status = ? AND telegram_id <> 0 AND subscription_id = 0", OrderStatusPendingReceipt).
+		Where("reminder_sent_at IS NULL OR reminder_sent_at = ?", time.Time{}).
+		Where("created_at <= ? AND created_at > ?", due, due.Add(-shopReminderWindow)).
+		Order("id asc").Find(&orders).Error
+	return orders, err
+}
+
+// MarkCartReminded records that an order's customer was reminded. It reports
+// false when the order was already reminded or is no longer unpaid.
+func (s *ShopService) MarkCartReminded(order *model.ShopOrder) (bool, error) {
+	now := time.Now()
+	result := database.GetShopDB().Model(&model.ShopOrder{}).
+		Where("id = ? AND status = ?", order.Id, OrderStatusPendingReceipt).
+		Where("reminder_sent_at IS NULL OR reminder_sent_at = ?", time.Time{}).
+		Update("reminder_sent_at", now)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+	order.ReminderSentAt = now
+	return true, nil
+}
+
+// CartReminderStats counts the reminded orders and those of them whose receipt
+// was sent afterwards. Archived orders are included.
+func (s *ShopService) CartReminderStats() (sent, recovered int64, err error) {
+	db := database.GetShopDB()
+	for _, table := range []any{&model.ShopOrder{}, &model.ShopOrderArchive{}} {
+		var tableSent, tableRecovered int64
+		err = db.Model(table).Where("reminder_sent_at IS NOT NULL AND reminder_sent_at <> ?", time.Time{}).
+			Count(&tableSent).Error
+		if err != nil {
+			return 0, 0, err
+		}
+		err = db.Model(table).Where("reminder_sent_at IS NOT NULL AND reminder_sent_at <> ?", time.Time{}).
+			Where("status IN ?", shopRecoveredStatuses).Count(&tableRecovered).Error
+		if err != nil {
+			return 0, 0, err
+		}
+		sent += tableSent
+		recovered += tableRecovered
+	}
+	return sent, recovered, nil
+}
@@ -0,0 +1,440 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrResellerKey is returned for an API key no enabled reseller holds.
+	ErrResellerKey = errors.New("invalid reseller API key")
+	// ErrResellerBalance is returned when a reseller's balance does not cover an order.
+	ErrResellerBalance = errors.New("reseller balance is too low")
+)
+
+// resellerKeyPrefix starts every reseller API key, so leaked keys are easy to
+// recognize, and resellerKeyShown is how much of a key admins see afterwards.
+const (
+	resellerKeyPrefix = "rsk_"
+	resellerKeyShown  = len(resellerKeyPrefix) + 6
+)
+
+// shopResellerPackageTypes are the packages resellers can order. Recurring
+// packages are left out, as their renewals are paid through the bot.
+var shopResellerPackageTypes = []string{PackageTypeStandard, PackageTypePooled}
+
+// ShopResellerPackage is a package as the reseller API lists it, at the price
+// the reseller pays.
+type ShopResellerPackage struct {
+	Id           int    `json:"id"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	DataGB       int    `json:"dataGb"`
+	DurationDays int    `json:"durationDays"`
+	Devices      int    `json:"devices"`     // Devices sharing a pooled package, 0 for other packages
+	InboundTag   string `json:"inboundTag"`  // Orders are placed on an inbound with this tag, so need no inboundId
+	RetailPrice  int64  `json:"retailPrice"` // Package price in the shop, in minor units
+	Price        int64  `json:"price"`       // Price charged to the reseller's balance
+	Commission   int64  `json:"commission"`  // Part of the retail price the reseller keeps
+}
+
+// ShopResellerOrderRequest is an order a reseller places for one of its end-users.
+type ShopResellerOrderRequest struct {
+	PackageId int    `json:"packageId" form:"packageId"`
+	InboundId int    `json:"inboundId" form:"inboundId"` // Not needed for packages with an inbound tag
+	NodeId    int    `json:"nodeId" form:"nodeId"`
+	Reference string `json:"reference" form:"reference"` // Reseller's own reference, such as its end-user's account
+}
+
+// ShopResellerOrder is an order as the reseller API shows it, without the
+// shop's internal fields.
+type ShopResellerOrder struct {
+	Id          int       `json:"id"`
+	Number      string    `json:"number"`
+	PackageId   int       `json:"packageId"`
+	Price       int64     `json:"price"`  // Charged to the reseller's balance
+	Status      string    `json:"status"` // Clients exist once the order is APPROVED
+	Reference   string    `json:"reference"`
+	ClientEmail string    `json:"clientEmail"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// ResellerOrderView returns an order as the reseller API shows it.
+func ResellerOrderView(order *model.ShopOrder) ShopResellerOrder {
+	view := ShopResellerOrder{
+		Id:          order.Id,
+		Number:      order.Number,
+		Price:       order.Price,
+		Status:      order.Status,
+		Reference:   order.ResellerRef,
+		ClientEmail: order.ClientEmail,
+		CreatedAt:   order.CreatedAt,
+		UpdatedAt:   order.UpdatedAt,
+	}
+	if order.PackageId != nil {
+		view.PackageId = *order.PackageId
+	}
+	return view
+}
+
+// ShopResellerSummary is a reseller's balance and what it has earned.
+type ShopResellerSummary struct {
+	Balance    int64  `json:"balance"`
+	Currency   string `json:"currency"`
+	Orders     int64  `json:"orders"`     // Orders charged and not refunded
+	Spent      int64  `json:"spent"`      // Charged to the balance for those orders
+	Commission int64  `json:"commission"` // Earned on those orders
+}
+
+func hashResellerKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newResellerKey() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return resellerKeyPrefix + hex.EncodeToString(secret), nil
+}
+
+// ListResellers returns the resellers by name.
+func (s *ShopService) ListResellers() ([]model.ShopReseller, error) {
+	resellers := []model.ShopReseller{}
+	err := database.GetShopDB().Order("name asc, id asc").Find(&resellers).Error
+	return resellers, err
+}
+
+// GetReseller returns a reseller by ID.
+func (s *ShopService) GetReseller(id int) (*model.ShopReseller, error) {
+	reseller := &model.ShopReseller{}
+	if err := database.GetShopDB().First(reseller, id).Error; err != nil {
+		return nil, err
+	}
+	return reseller, nil
+}
+
+// SaveReseller creates or updates a reseller. A new reseller is issued an API
+// key, which is returned only this once; updates return an empty key. The
+// balance only changes through CreditReseller and orders.
+func (s *ShopService) SaveReseller(reseller *model.ShopReseller) (string, error) {
+	reseller.Name = strings.TrimSpace(reseller.Name)
+	v := &shopValidator{}
+	v.text("name", reseller.Name, true, shopNameMaxLength)
+	v.nonNegative("commissionPercent", int64(reseller.CommissionPercent))
+	v.between("commissionPercent", reseller.CommissionPercent, 0, 100)
+	if err := v.err(); err != nil {
+		return "", err
+	}
+
+	db := database.GetShopDB()
+	now := time.Now()
+	reseller.UpdatedAt = now
+	if reseller.Id > 0 {
+		return "", db.Model(&model.ShopReseller{}).Where("id = ?", reseller.Id).
+			Select("name", "commission_percent", "enabled", "updated_at").Updates(reseller).Error
+	}
+	key, err := newResellerKey()
+	if err != nil {
+		return "", err
+	}
+	reseller.KeyHash = hashResellerKey(key)
+	reseller.KeyPrefix = key[:resellerKeyShown]
+	reseller.Balance = 0
+	reseller.CreatedAt = now
+	return key, db.Create(reseller).Error
+}
+
+// RegenerateResellerKey issues a reseller a new API key, which stops the old
+// one from working, and returns it.
+func (s *ShopService) RegenerateResellerKey(id int) (string, error) {
+	key, err := newResellerKey()
+	if err != nil {
+		return "", err
+	}
+	result := database.GetShopDB().Model(&model.ShopReseller{}).Where("id = ?", id).Updates(map[string]any{
+		"key_hash":   hashResellerKey(key),
+		"key_prefix": key[:resellerKeyShown],
+		"updated_at": time.Now(),
+	})
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", gorm.ErrRecordNotFound
+	}
+	return key, nil
+}
+
+// DeleteReseller deletes a reseller that never placed an order. Resellers
+// with orders are disabled instead, so their orders keep their owner.
+func (s *ShopService) DeleteReseller(id int) error {
+	db := database.GetShopDB()
+	var orders int64
+	if err := db.Model(&model.ShopOrder{}).Where("reseller_id = ?", id).Count(&orders).Error; err != nil {
+		return err
+	}
+	if orders > 0 {
+		return errors.New("reseller has orders, disable it instead")
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("reseller_id = ?", id).Delete(&model.ShopResellerEntry{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.ShopReseller{}, id).Error
+	})
+}
+
+// AuthenticateReseller returns the enabled reseller holding an API key.
+func (s *ShopService) AuthenticateReseller(key string) (*model.ShopReseller, error) {
+	if !strings.HasPrefix(key, resellerKeyPrefix) {
+		return nil, ErrResellerKey
+	}
+	db := database.GetShopDB()
+	reseller := &model.ShopReseller{}
+	if err := db.Where("key_hash = ?", hashResellerKey(key)).Limit(1).Find(reseller).Error; err != nil {
+		return nil, err
+	}
+	if reseller.Id == 0 || !reseller.Enabled {
+		return nil, ErrResellerKey
+	}
+	reseller.LastUsedAt = time.Now()
+	return reseller, db.Model(&model.ShopReseller{}).Where("id = ?", reseller.Id).Update("last_used_at", reseller.LastUsedAt).Error
+}
+
+// addResellerEntry changes a reseller's balance by entry.Amount and records
+// the entry with the balance it leaves. Charges the balance does not cover
+// fail with ErrResellerBalance.
+func addResellerEntry(tx *gorm.DB, entry *model.ShopResellerEntry) error {
+	result := tx.Model(&model.ShopReseller{}).Where("id = ? AND balance + ? >= 0", entry.ResellerId, entry.Amount).
+		Updates(map[string]any{"balance": gorm.Expr("balance + ?", entry.Amount), "updated_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrResellerBalance
+	}
+	reseller := &model.ShopReseller{}
+	if err := tx.Select("balance").First(reseller, entry.ResellerId).Error; err != nil {
+		return err
+	}
+	entry.Balance = reseller.Balance
+	entry.CreatedAt = time.Now()
+	return tx.Create(entry).Error
+}
+
+// CreditReseller adds an admin's top-up to a reseller's balance, or takes a
+// correction off it when amount is negative.
+func (s *ShopService) CreditReseller(id int, amount int64, note string) (*model.ShopResellerEntry, error) {
+	note = strings.TrimSpace(note)
+	v := &shopValidator{}
+	if amount == 0 {
+		v.add("amount", "shop.invalid.required")
+	}
+	v.text("note", note, false, shopValueMaxLength)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if _, err := s.GetReseller(id); err != nil {
+		return nil, err
+	}
+	entry := &model.ShopResellerEntry{ResellerId: id, Amount: amount, Note: note}
+	err := database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		return addResellerEntry(tx, entry)
+	})
+	return entry, err
+}
+
+// ListResellerEntries returns the changes of a reseller's balance, latest first.
+func (s *ShopService) ListResellerEntries(id int) ([]model.ShopResellerEntry, error) {
+	entries := []model.ShopResellerEntry{}
+	err := database.GetShopDB().Where("reseller_id = ?", id).Order("id desc").Find(&entries).Error
+	return entries, err
+}
+
+// resellerPrice returns what a reseller pays for a package and the commission
+// it keeps of the package price.
+func resellerPrice(reseller *model.ShopReseller, pkg *model.ShopPackage) (price, commission int64) {
+	commission = pkg.Price * int64(reseller.CommissionPercent) / 100
+	return pkg.Price - commission, commission
+}
+
+func resellerCanOrder(pkg *model.ShopPackage) bool {
+	return pkg.IsActive && !pkg.IsArchived && pkg.BillingCycle == "" && slices.Contains(shopResellerPackageTypes, pkg.Type)
+}
+
+// ResellerPackages returns the packages a reseller can order, at its prices.
+func (s *ShopService) ResellerPackages(reseller *model.ShopReseller) ([]ShopResellerPackage, error) {
+	packages, err := s.ListPackages(ShopPackageFilter{ActiveOnly: true, Types: shopResellerPackageTypes})
+	if err != nil {
+		return nil, err
+	}
+	items := make([]ShopResellerPackage, 0, len(packages))
+	for _, pkg := range packages {
+		if !resellerCanOrder(&pkg) {
+			continue
+		}
+		price, commission := resellerPrice(reseller, &pkg)
+		item := ShopResellerPackage{
+			Id:           pkg.Id,
+			Name:         pkg.Name,
+			Type:         pkg.Type,
+			DataGB:       pkg.DataGB,
+			DurationDays: pkg.DurationDays,
+			InboundTag:   pkg.InboundTag,
+			RetailPrice:  pkg.Price,
+			Price:        price,
+			Commission:   commission,
+		}
+		if pkg.Type == PackageTypePooled {
+			item.Devices = pkg.Devices
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// PlaceResellerOrder charges a reseller's balance for an order and creates it
+// ready for provisioning. The order has no Telegram customer; the reseller
+// fetches its configs through the API and hands them out under its own brand.
+func (s *ShopService) PlaceResellerOrder(reseller *model.ShopReseller, req *ShopResellerOrderRequest) (*model.ShopOrder, error) {
+	if err := s.CheckOpen(); err != nil {
+		return nil, err
+	}
+	req.Reference = strings.TrimSpace(req.Reference)
+	v := &shopValidator{}
+	v.text("reference", req.Reference, false, shopValueMaxLength)
+	pkg, err := s.GetPackage(req.PackageId)
+	if err != nil || !resellerCanOrder(pkg) {
+		v.add("packageId", "shop.invalid.choice")
+	} else if pkg.InboundTag == "" && !s.IsInboundAvailable(req.NodeId, req.InboundId) {
+		v.add("inboundId", "shop.invalid.choice")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	price, commission := resellerPrice(reseller, pkg)
+	now := time.Now()
+	order := &model.ShopOrder{
+		NodeId:      req.NodeId,
+		InboundId:   req.InboundId,
+		PackageId:   &pkg.Id,
+		Price:       price,
+		Status:      OrderStatusPendingReview,
+		ResellerId:  reseller.Id,
+		ResellerRef: req.Reference,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if pkg.InboundTag != "" {
+		if err := s.PlaceTaggedOrder(order, pkg.InboundTag); err != nil {
+			return nil, err
+		}
+	}
+	err = database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		if err := s.assignOrderNumber(tx, order); err != nil {
+			return err
+		}
+		if err := tx.Create(order).Error; err != nil {
+			return err
+		}
+		return addResellerEntry(tx, &model.ShopResellerEntry{
+			ResellerId: reseller.Id,
+			OrderId:    order.Id,
+			Amount:     -price,
+			Commission: commission,
+			Note:       pkg.Name,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	countOrderEvent(OrderEventCreated)
+	s.broadcastOrderFeed(OrderFeedNew, order)
+	return order, nil
+}
+
+// refundResellerOrder gives a reseller back what it was charged for an order
+// that was rejected. An order is refunded at most once.
+func (s *ShopService) refundResellerOrder(orderId int) error {
+	return database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		var entries []model.ShopResellerEntry
+		if err := tx.Where("order_id = ?", orderId).Find(&entries).Error; err != nil {
+			return err
+		}
+		var charge *model.ShopResellerEntry
+		for i := range entries {
+			if entries[i].Amount > 0 {
+				return nil
+			}
+			charge = &entries[i]
+		}
+		if charge == nil {
+			return nil
+		}
+		return addResellerEntry(tx, &model.ShopResellerEntry{
+			ResellerId: charge.ResellerId,
+			OrderId:    orderId,
+			Amount:     -charge.Amount,
+			Commission: -charge.Commission,
+			Note:       "refund",
+		})
+	})
+}
+
+// ListResellerOrders returns a reseller's orders, latest first, optionally
+// only those with a reference.
+func (s *ShopService) ListResellerOrders(resellerId int, reference string) ([]model.ShopOrder, error) {
+	orders := []model.ShopOrder{}
+	query := database.GetShopDB().Where("reseller_id = ?", resellerId)
+	if reference != "" {
+		query = query.Where("reseller_ref = ?", reference)
+	}
+	err := query.Order("id desc").Find(&orders).Error
+	return orders, err
+}
+
+// GetResellerOrder returns an order of a reseller.
+func (s *ShopService) GetResellerOrder(resellerId, orderId int) (*model.ShopOrder, error) {
+	order, err := s.GetOrder(orderId)
+	if err != nil {
+		return nil, err
+	}
+	if order.ResellerId != resellerId {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return order, nil
+}
+
+// ResellerSummary returns a reseller's balance with the orders it paid for and
+// the commission it earned on them, net of refunds.
+func (s *ShopService) ResellerSummary(reseller *model.ShopReseller) (*ShopResellerSummary, error) {
+	summary := &ShopResellerSummary{Balance: reseller.Balance, Currency: s.Currency().Code}
+	var entries []model.ShopResellerEntry
+	if err := database.GetShopDB().Where("reseller_id = ? AND order_id > 0", reseller.Id).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		summary.Spent -= entry.Amount
+		summary.Commission += entry.Commission
+		if entry.Amount < 0 {
+			summary.Orders++
+		} else {
+			summary.Orders--
+		}
+	}
+	return summary, nil
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+)
+
+// PurgeReceipts deletes the receipt images of approved and rejected orders
+// closed more than the configured number of days ago, archived orders
+// included. The SHA-256 of each file is kept on the order so a receipt
+// produced later can still be matched. It returns the number of receipts
+// removed.
+func (s *ShopService) PurgeReceipts() (int, error) {
+	days, err := s.settingService.GetShopReceiptRetentionDays()
+	if err != nil || days <= 0 {
+		return 0, err
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	db := database.GetShopDB()
+	var orders []model.ShopOrder
+	err = db.Where("status IN ? AND receipt_path <> '' AND updated_at < ?",
+		[]string{OrderStatusApproved, OrderStatusRejected}, cutoff).
+		Find(&orders).Error
+	if err != nil {
+		return 0, err
+	}
+	purged, err := purgeOrderReceipts(&model.ShopOrder{}, orders)
+	if err != nil {
+		return purged, err
+	}
+
+	// Archived orders are all closed.
+	var archived []model.ShopOrderArchive
+	err = db.Where("receipt_path <> '' AND updated_at < ?", cutoff).Find(&archived).Error
+	if err != nil {
+		return purged, err
+	}
+	orders = make([]model.ShopOrder, len(archived))
+	for i := range archived {
+		orders[i] = archived[i].ShopOrder
+	}
+	n, err := purgeOrderReceipts(&model.ShopOrderArchive{}, orders)
+	return purged + n, err
+}
+
+// purgeOrderReceipts deletes the receipt images of orders, keeping their
+// SHA-256 on their rows in table, a model of shop_orders or
+// shop_orders_archive. It returns the number of receipts removed.
+func purgeOrderReceipts(table any, orders []model.ShopOrder) (int, error) {
+	purged := 0
+	for _, order := range orders {
+		hash, err := fileSHA256(order.ReceiptPath)
+		if err != nil && !os.IsNotExist(err) {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("hash receipt failed")
+			continue
+		}
+		// updated_at is left alone so the order keeps its closing time.
+		err = database.GetShopDB().Model(table).Where("id = ?", order.Id).UpdateColumns(map[string]any{
+			"receipt_path": "",
+			"receipt_hash": hash,
+		}).Error
+		if err != nil {
+			return purged, err
+		}
+		if err := os.Remove(order.ReceiptPath); err != nil && !os.IsNotExist(err) {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("remove receipt failed")
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of a receipt image, decrypted.
+func fileSHA256(path string) (string, error) {
+	data, err := ReadReceipt(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// ErrClientNotInOrder is returned when rotating a client the order did not create.
+var ErrClientNotInOrder = errors.New("client does not belong to the order")
+
+// errInboundClientMissing is returned for a client an inbound no longer has.
+var errInboundClientMissing = errors.New("client not found in inbound")
+
+// RotateClientCredentials gives a client of an order a new UUID or password and
+// a new subId, for when its config leaked. The client keeps its email, so its
+// traffic, limits and expiry stay as they are. Short links to the old
+// subscription are revoked. It reports whether Xray needs a restart.
+func (s *ShopService) RotateClientCredentials(order *model.ShopOrder, email string) (*model.ShopOrderClient, bool, error) {
+	if order.Status != OrderStatusApproved {
+		return nil, false, errors.New("only approved orders have clients")
+	}
+	nodeId, inboundId, err := s.orderClientInbound(order, email)
+	if err != nil {
+		return nil, false, err
+	}
+	// The subId is always random: a naming pattern built from the order alone
+	// would give the leaked one again.
+	rotated := &model.ShopOrderClient{OrderId: order.Id, Email: email, ClientId: uuid.New().String(),
+		SubId: randomFrom("abcdefghijklmnopqrstuvwxyz0123456789", 16)}
+
+	var node *model.ShopNode
+	var inbound *model.Inbound
+	if nodeId > 0 {
+		if node, err = s.shopNodeService.GetNode(nodeId); err != nil {
+			return nil, false, err
+		}
+		inbound, err = s.shopNodeService.RemoteInbound(node, inboundId)
+	} else {
+		_, inbound, err = s.inboundService.GetClientInboundByEmail(email)
+		if err == nil && inbound == nil {
+			err = fmt.Errorf("client %s not found", email)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	rotation, err := rotateClientSettings(inbound, email, rotated)
+	if err != nil {
+		return nil, false, err
+	}
+
+	update := func(key, settings string) (bool, error) {
+		if node != nil {
+			return false, s.shopNodeService.UpdateRemoteClient(node, inbound.Id, key, settings)
+		}
+		return s.inboundService.UpdateInboundClient(&model.Inbound{Id: inbound.Id, Settings: settings}, key)
+	}
+	needRestart, err := update(rotation.key, rotation.settings)
+	if err != nil {
+		return nil, needRestart, err
+	}
+	if err := saveRotatedClient(rotated); err != nil {
+		// Put the old credentials back, so the orders keep pointing at a client
+		// that exists.
+		if _, revertErr := update(rotation.revertKey, rotation.revertSettings); revertErr != nil {
+			return nil, needRestart, errors.Join(err, fmt.Errorf("restore old credentials of %s: %w", email, revertErr))
+		}
+		return nil, needRestart, err
+	}
+	return rotated, needRestart, nil
+}
+
+// ListRotatableClients returns the clients of a customer's approved orders, each
+// with the latest order that refers to it. Clients of bulk orders are left out,
+// as the customer hands those out to others.
+func (s *ShopService) ListRotatableClients(tgId int64) ([]model.ShopOrderClient, error) {
+	var orders []model.ShopOrder
+	err := database.GetShopDB().Where("telegram_id = ? AND status = ? AND client_email <> '' AND seats <= 1", tgId, OrderStatusApproved).
+		Order("id desc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	clients := []model.ShopOrderClient{}
+	for i := range orders {
+		orderClients, err := s.ListOrderClients(&orders[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, client := range orderClients {
+			if !seen[client.Email] {
+				seen[client.Email] = true
+				clients = append(clients, client)
+			}
+		}
+	}
+	return clients, nil
+}
+
+// orderClientInbound returns the node and inbound of an order's client. Each
+// client of a cart order is on the inbound of its own item.
+func (s *ShopService) orderClientInbound(order *model.ShopOrder, email string) (nodeId, inboundId int, err error) {
+	clients, err := s.ListOrderClients(order)
+	if err != nil {
+		return 0, 0, err
+	}
+	found := false
+	for _, client := range clients {
+		found = found || client.Email == email
+	}
+	if !found || email == "" {
+		return 0, 0, ErrClientNotInOrder
+	}
+	item := &model.ShopOrderItem{}
+	err = database.GetShopDB().Where("order_id = ? AND client_email = ?", order.Id, email).Limit(1).Find(item).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	if item.Id > 0 {
+		return item.NodeId, item.InboundId, nil
+	}
+	return order.NodeId, order.InboundId, nil
+}
+
+// findInboundClient returns the client of an inbound with the given email,
+// along with the key the inbound knows it by: the password for Trojan, the
+// email for Shadowsocks and the UUID otherwise.
+func findInboundClient(inbound *model.Inbound, email string) (map[string]any, string, error) {
+	var settings map[string]any
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return nil, "", err
+	}
+	clients, _ := settings["clients"].([]any)
+	var client map[string]any
+	for _, c := range clients {
+		if c, ok := c.(map[string]any); ok && c["email"] == email {
+			client = c
+			break
+		}
+	}
+	if client == nil {
+		return nil, "", fmt.Errorf("%w: %s in inbound %d", errInboundClientMissing, email, inbound.Id)
+	}
+
+	key := ""
+	switch inbound.Protocol {
+	case model.VMESS, model.VLESS:
+		key, _ = client["id"].(string)
+	case model.Trojan:
+		key, _ = client["password"].(string)
+	case model.Shadowsocks:
+		key = email
+	default:
+		return nil, "", fmt.Errorf("clients of %s inbounds cannot be updated", inbound.Protocol)
+	}
+	if key == "" {
+		return nil, "", fmt.Errorf("client %s has no credentials", email)
+	}
+	return client, key, nil
+}
+
+// clientRotation holds the inbound client updates giving a client new
+// credentials and putting its old ones back, each with the key the inbound
+// knows the client by before the update.
+type clientRotation struct {
+	key, settings             string
+	revertKey, revertSettings string
+}
+
+// rotateClientSettings sets the new credentials on a client of an inbound and
+// returns the updates applying and reverting them.
+func rotateClientSettings(inbound *model.Inbound, email string, rotated *model.ShopOrderClient) (*clientRotation, error) {
+	client, key, err := findInboundClient(inbound, email)
+	if err != nil {
+		return nil, err
+	}
+	original, err := json.Marshal(map[string]any{"clients": []any{maps.Clone(client)}})
+	if err != nil {
+		return nil, err
+	}
+	rotation := &clientRotation{key: key, revertKey: key, revertSettings: string(original)}
+	switch inbound.Protocol {
+	case model.VMESS, model.VLESS:
+		client["id"] = rotated.ClientId
+		rotation.revertKey = rotated.ClientId
+	case model.Trojan:
+		password := randomFrom("abcdefghijklmnopqrstuvwxyz0123456789", 10)
+		client["password"] = password
+		rotation.revertKey = password
+	case model.Shadowsocks:
+		password := make([]byte, 32)
+		if _, err := rand.Read(password); err != nil {
+			return nil, err
+		}
+		client["password"] = base64.StdEncoding.EncodeToString(password)
+	}
+	client["subId"] = rotated.SubId
+	data, err := json.Marshal(map[string]any{"clients": []any{client}})
+	if err != nil {
+		return nil, err
+	}
+	rotation.settings = string(data)
+	return rotation, nil
+}
+
+// saveRotatedClient records a client's new credentials on the orders and cart
+// items that refer to it, and revokes its short links.
+func saveRotatedClient(rotated *model.ShopOrderClient) error {
+	return database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.ShopOrder{}).Where("client_email = ?", rotated.Email).
+			Updates(map[string]any{"client_id": rotated.ClientId, "client_sub_id": rotated.SubId}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&model.ShopOrderItem{}).Where("client_email = ?", rotated.Email).
+			Updates(map[string]any{"client_id": rotated.ClientId, "client_sub_id": rotated.SubId}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&model.ShopOrderClient{}).Where("email = ?", rotated.Email).
+			Updates(map[string]any{"client_id": rotated.ClientId, "sub_id": rotated.SubId}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&model.ShopShortLink{}).Where("email = ? AND (revoked_at IS NULL OR revoked_at = ?)", rotated.Email, time.Time{}).
+			Update("revoked_at", time.Now()).Error
+	})
+}
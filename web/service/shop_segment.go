@@ -0,0 +1,258 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// Kinds of saved customer segments.
+const (
+	SegmentKindHighSpenders    = "high_spenders"
+	SegmentKindRecentlyExpired = "recently_expired"
+	SegmentKindNeverPurchased  = "never_purchased"
+	SegmentKindPackageBuyers   = "package_buyers"
+)
+
+// shopSegmentPrefix marks a broadcast segment that refers to a saved segment,
+// such as "segment:3".
+const shopSegmentPrefix = "segment:"
+
+// defaultSegmentDays is the look-back of a recently_expired segment without one.
+const defaultSegmentDays = 30
+
+// SegmentBroadcastName returns the broadcast segment targeting a saved segment.
+func SegmentBroadcastName(id int) string {
+	return shopSegmentPrefix + strconv.Itoa(id)
+}
+
+func (s *ShopService) ListSegments() ([]model.ShopSegment, error) {
+	segments := []model.ShopSegment{}
+	err := database.GetShopDB().Order("name asc").Find(&segments).Error
+	return segments, err
+}
+
+func (s *ShopService) GetSegment(id int) (*model.ShopSegment, error) {
+	segment := &model.ShopSegment{}
+	if err := database.GetShopDB().First(segment, id).Error; err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
+
+// validateSegment checks a segment and clears the parameters its kind does not use.
+func (s *ShopService) validateSegment(segment *model.ShopSegment) error {
+	v := &shopValidator{}
+	v.text("name", segment.Name, true, shopNameMaxLength)
+	switch segment.Kind {
+	case SegmentKindHighSpenders:
+		v.positive("minSpent", segment.MinSpent)
+		segment.Days, segment.PackageId = 0, 0
+	case SegmentKindRecentlyExpired:
+		if segment.Days == 0 {
+			segment.Days = defaultSegmentDays
+		}
+		v.positive("days", int64(segment.Days))
+		segment.MinSpent, segment.PackageId = 0, 0
+	case SegmentKindNeverPurchased:
+		segment.MinSpent, segment.Days, segment.PackageId = 0, 0, 0
+	case SegmentKindPackageBuyers:
+		if _, err := s.GetPackage(segment.PackageId); err != nil {
+			v.add("packageId", "shop.invalid.choice")
+		}
+		segment.MinSpent, segment.Days = 0, 0
+	default:
+		v.add("kind", "shop.invalid.choice")
+	}
+	return v.err()
+}
+
+// SaveSegment creates a segment, or updates it when it has an ID.
+func (s *ShopService) SaveSegment(segment *model.ShopSegment) error {
+	if err := s.validateSegment(segment); err != nil {
+		return err
+	}
+	segment.UpdatedAt = time.Now()
+	db := database.GetShopDB()
+	if segment.Id == 0 {
+		segment.CreatedAt = time.Now()
+		return db.Create(segment).Error
+	}
+	return db.Model(&model.ShopSegment{}).Where("id = ?", segment.Id).
+		Select("name", "kind", "min_spent", "days", "package_id", "updated_at").Updates(segment).Error
+}
+
+func (s *ShopService) DeleteSegment(id int) error {
+	return database.GetShopDB().Delete(&model.ShopSegment{}, id).Error
+}
+
+// SegmentCustomers returns the customers currently matching a segment.
+func (s *ShopService) SegmentCustomers(segment *model.ShopSegment) ([]ShopCustomerSummary, error) {
+	customers, err := s.ListCustomers()
+	if err != nil {
+		return nil, err
+	}
+	var include func(c *ShopCustomerSummary) bool
+	switch segment.Kind {
+	case SegmentKindHighSpenders:
+		include = func(c *ShopCustomerSummary) bool { return c.Spent >= segment.MinSpent }
+	case SegmentKindNeverPurchased:
+		include = func(c *ShopCustomerSummary) bool { return c.ApprovedOrders == 0 }
+	case SegmentKindRecentlyExpired:
+		ids, err := s.recentlyExpiredCustomers(segment.Days)
+		if err != nil {
+			return nil, err
+		}
+		include = func(c *ShopCustomerSummary) bool { return slices.Contains(ids, c.TelegramId) }
+	case SegmentKindPackageBuyers:
+		ids, err := s.packageBuyers(segment.PackageId)
+		if err != nil {
+			return nil, err
+		}
+		include = func(c *ShopCustomerSummary) bool { return slices.Contains(ids, c.TelegramId) }
+	default:
+		return nil, errors.New("unknown segment kind")
+	}
+	matched := []ShopCustomerSummary{}
+	for i := range customers {
+		if include(&customers[i]) {
+			matched = append(matched, customers[i])
+		}
+	}
+	return matched, nil
+}
+
+// segmentRecipients returns the Telegram IDs of a saved segment's customers.
+func (s *ShopService) segmentRecipients(id int) ([]int64, error) {
+	segment, err := s.GetSegment(id)
+	if err != nil {
+		return nil, err
+	}
+	customers, err := s.SegmentCustomers(segment)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(customers))
+	for _, customer := range customers {
+		ids = append(ids, customer.TelegramId)
+	}
+	return ids, nil
+}
+
+// recentlyExpiredCustomers returns the customers with a client that expired in
+// the last days and nothing active now.
+func (s *ShopService) recentlyExpiredCustomers(days int) ([]int64, error) {
+	var orders []model.ShopOrder
+	err := database.GetShopDB().Select("telegram_id", "client_email", "client_emails").
+		Where("status = ? AND telegram_id <> 0 AND client_email <> ''", OrderStatusApproved).
+		Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	owners := map[string]int64{}
+	emails := []string{}
+	for _, order := range orders {
+		for _, email := range s.OrderClientEmails(&order) {
+			owners[email] = order.TelegramId
+			emails = append(emails, email)
+		}
+	}
+	now := time.Now()
+	var expired []string
+	for chunk := range slices.Chunk(emails, 500) {
+		var found []string
+		err := database.GetDB().Model(&xray.ClientTraffic{}).
+			Where("email IN ?", chunk).
+			Where("expiry_time > ? AND expiry_time <= ?", now.AddDate(0, 0, -days).UnixMilli(), now.UnixMilli()).
+			Pluck("email", &found).Error
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, found...)
+	}
+	active, err := s.activeCustomers()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, email := range expired {
+		if id := owners[email]; !slices.Contains(active, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// packageBuyers returns the customers with an approved order of a package,
+// bought on its own or in a cart. Archived orders count.
+func (s *ShopService) packageBuyers(packageId int) ([]int64, error) {
+	db := database.GetShopDB()
+	var cartOrders []int
+	if err := db.Model(&model.ShopOrderItem{}).Where("package_id = ?", packageId).Distinct().Pluck("order_id", &cartOrders).Error; err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, table := range []any{&model.ShopOrder{}, &model.ShopOrderArchive{}} {
+		var found []int64
+		err := db.Model(table).
+			Where("status = ? AND telegram_id <> 0", OrderStatusApproved).
+			Where("package_id = ? OR id IN ?", packageId, append(cartOrders, 0)).
+			Distinct().Pluck("telegram_id", &found).Error
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, found...)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// ShopCustomersCSV renders customers as a CSV file. Amounts are in major units
+// of currency.
+func ShopCustomersCSV(customers []ShopCustomerSummary, currency string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"telegram_id", "username", "first_name", "language", "orders", "approved_orders", "spent", "active_subscriptions", "banned", "last_order_at"})
+	for _, c := range customers {
+		lastOrder := ""
+		if !c.LastOrderAt.IsZero() {
+			lastOrder = c.LastOrderAt.Format(time.RFC3339)
+		}
+		w.Write([]string{
+			strconv.FormatInt(c.TelegramId, 10), c.Username, c.FirstName, c.Language,
+			strconv.Itoa(c.OrderCount), strconv.Itoa(c.ApprovedOrders), plainPrice(c.Spent, currency),
+			strconv.Itoa(c.ActiveSubscriptions), strconv.FormatBool(c.Banned), lastOrder,
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// plainPrice renders an amount in minor units as a bare decimal number, such as
+// "12.50", for spreadsheets.
+func plainPrice(amount int64, currency string) string {
+	exponent := CurrencyExponent(currency)
+	if exponent == 0 {
+		return strconv.FormatInt(amount, 10)
+	}
+	scale := minorUnitScale(exponent)
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, exponent, amount%scale)
+}
+
+// ShopSegmentFileName returns the download name of a segment's customer export.
+func ShopSegmentFileName(segment *model.ShopSegment) string {
+	return fmt.Sprintf("segment-%d-customers-%s.csv", segment.Id, time.Now().Format("20060102"))
+}
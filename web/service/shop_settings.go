@@ -0,0 +1,117 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/mhsanaei/3x-ui/v2/util/common"
+	"github.com/mhsanaei/3x-ui/v2/util/reflect_util"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+)
+
+// ShopSettingGroup names the panel settings shown together on the shop
+// settings page.
+type ShopSettingGroup struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys"`
+}
+
+// ShopSettings is the shop configuration: the value of every shop setting,
+// keyed by its name in entity.AllSetting, and the groups they are shown in.
+type ShopSettings struct {
+	Groups []ShopSettingGroup `json:"groups"`
+	Values map[string]any     `json:"values"`
+}
+
+// shopSettingGroups lists every panel setting configuring the shop, in the
+// order the shop settings page shows them.
+var shopSettingGroups = []ShopSettingGroup{
+	{Name: "pricing", Keys: []string{
+		"shopCurrency", "shopPricePerGB", "shopMinGB", "shopMaxGB", "shopStepGB", "shopPresetsGB",
+		"shopMinDays", "shopMaxDays", "shopStepDays", "shopPresetsDays", "shopRenewalGraceDays",
+		"shopPausesPerCycle", "shopPauseFreezeExpiry",
+	}},
+	{Name: "payment", Keys: []string{
+		"shopPaymentRotation", "shopAmountCodeMax", "shopPartialProvision", "shopDuplicateOrderMinutes", "shopCartReminderMinutes",
+		"shopReceiptDeadlineMinutes", "shopTgPayments", "shopTgProviderToken", "shopStarsPerUnit",
+		"shopLightningBackend", "shopLightningUrl", "shopLightningApiKey", "shopSatsPerUnit",
+		"shopGateway", "shopGatewayAccount", "shopGatewaySecret", "shopGatewayCurrency", "shopGatewayRate", "shopPublicUrl",
+	}},
+	{Name: "approval", Keys: []string{
+		"shopOcrProvider", "shopOcrEndpoint", "shopOcrApiKey", "shopSecondApprovalPrice",
+		"shopAdminAllowedIps", "shopAdminAllowedCountries",
+	}},
+	{Name: "texts", Keys: []string{
+		"shopMaintenance", "shopClosedMessage", "shopMsgWelcome", "shopMsgPackages", "shopMsgPayment",
+		"shopMsgApproved", "shopMsgRejected", "shopRequiredChannel", "shopRequiredChannelLink",
+	}},
+	{Name: "notifications", Keys: []string{
+		"shopNotifier", "shopNotifierAccount", "shopNotifierApiKey", "shopNotifierSender",
+		"smtpHost", "smtpPort", "smtpUsername", "smtpPassword", "smtpFrom",
+		"shopWeeklySummary", "shopLowStockThreshold", "shopInboundAlertPercent",
+	}},
+	{Name: "storefront", Keys: []string{
+		"shopStorefrontEnabled", "shopStorefrontTitle", "shopPriceListEnabled",
+		"shopCaptchaProvider", "shopCaptchaSiteKey", "shopCaptchaSecret",
+	}},
+	{Name: "limits", Keys: []string{
+		"shopRateMessagesPerMinute", "shopRateOrdersPerHour", "shopRateReceiptsPerHour", "shopRateCooldownMinutes",
+		"shopApiRatePerMinute", "shopApiWriteRatePerMinute",
+	}},
+	{Name: "clients", Keys: []string{
+		"shopEmailPattern", "shopSubIdPattern", "shopShortLinks", "shopShortLinkDays",
+	}},
+	{Name: "sync", Keys: []string{
+		"shopSyncPrimaryUrl", "shopSyncToken", "shopSyncMinutes", "shopCatalogToken",
+	}},
+	{Name: "retention", Keys: []string{
+		"shopReceiptRetentionDays", "shopOrderArchiveDays", "shopTgBackup", "shopBackupPassword",
+	}},
+}
+
+// shopSettingFields returns the fields of entity.AllSetting keyed by their
+// setting name.
+func shopSettingFields() map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for _, field := range reflect_util.GetFields(reflect.TypeOf(entity.AllSetting{})) {
+		fields[field.Tag.Get("json")] = field
+	}
+	return fields
+}
+
+// GetShopSettings returns the current shop configuration.
+func (s *ShopService) GetShopSettings() (*ShopSettings, error) {
+	all, err := s.settingService.GetAllSetting()
+	if err != nil {
+		return nil, err
+	}
+	fields := shopSettingFields()
+	v := reflect.ValueOf(all).Elem()
+	settings := &ShopSettings{Groups: shopSettingGroups, Values: map[string]any{}}
+	for _, group := range shopSettingGroups {
+		for _, key := range group.Keys {
+			settings.Values[key] = v.FieldByIndex(fields[key].Index).Interface()
+		}
+	}
+	return settings, nil
+}
+
+// UpdateShopSettings validates the shop part of settings and saves it, leaving
+// the other panel settings alone.
+func (s *ShopService) UpdateShopSettings(settings *entity.AllSetting) error {
+	if err := validateShopSettings(settings); err != nil {
+		return err
+	}
+	fields := shopSettingFields()
+	v := reflect.ValueOf(settings).Elem()
+	errs := make([]error, 0)
+	for _, group := range shopSettingGroups {
+		for _, key := range group.Keys {
+			value := fmt.Sprint(v.FieldByIndex(fields[key].Index).Interface())
+			if err := s.settingService.saveSetting(key, value); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return common.Combine(errs...)
+}
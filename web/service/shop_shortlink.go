@@ -0,0 +1,174 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// ErrShortLinkNotFound is returned for a short link that does not exist, was
+// revoked or has expired.
+var ErrShortLinkNotFound = errors.New("short link not found")
+
+// shortLinkAlphabet and shortLinkLength make tokens of about 47 random bits,
+// too many to enumerate through the rate-limited redirect.
+const (
+	shortLinkAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	shortLinkLength   = 8
+)
+
+// ShortLinksEnabled reports whether customers are sent short links, which
+// needs the panel's public address.
+func (s *ShopService) ShortLinksEnabled() bool {
+	enabled, _ := s.settingService.GetShopShortLinks()
+	if !enabled {
+		return false
+	}
+	public, _ := s.settingService.GetShopPublicUrl()
+	return public != ""
+}
+
+// ShortLinkURL returns the public address of a short link.
+func (s *ShopService) ShortLinkURL(link *model.ShopShortLink) string {
+	return s.publicShopURL("s/" + link.Token)
+}
+
+// ShortenOrderLink returns the short link sent for a client of an order in
+// place of target, reusing the client's live link to the same target. With
+// short links off, or when no link can be made, target is returned as is.
+func (s *ShopService) ShortenOrderLink(order *model.ShopOrder, email, target string) string {
+	if target == "" || !s.ShortLinksEnabled() {
+		return target
+	}
+	db := database.GetShopDB()
+	link := &model.ShopShortLink{}
+	err := db.Where("order_id = ? AND email = ? AND target_url = ? AND (revoked_at IS NULL OR revoked_at = ?)", order.Id, email, target, time.Time{}).
+		Order("id desc").Limit(1).Find(link).Error
+	if err == nil && link.Id > 0 && !shortLinkExpired(link, time.Now()) {
+		return s.ShortLinkURL(link)
+	}
+	link, err = s.createShortLink(db, order.Id, email, target)
+	if err != nil {
+		return target
+	}
+	return s.ShortLinkURL(link)
+}
+
+func (s *ShopService) createShortLink(tx *gorm.DB, orderId int, email, target string) (*model.ShopShortLink, error) {
+	now := time.Now()
+	link := &model.ShopShortLink{OrderId: orderId, Email: email, TargetUrl: target, CreatedAt: now}
+	if days, _ := s.settingService.GetShopShortLinkDays(); days > 0 {
+		link.ExpiresAt = now.AddDate(0, 0, days)
+	}
+	for {
+		token, err := randomShortLinkToken()
+		if err != nil {
+			return nil, err
+		}
+		var taken int64
+		if err := tx.Model(&model.ShopShortLink{}).Where("token = ?", token).Count(&taken).Error; err != nil {
+			return nil, err
+		}
+		if taken == 0 {
+			link.Token = token
+			return link, tx.Create(link).Error
+		}
+	}
+}
+
+func randomShortLinkToken() (string, error) {
+	token := make([]byte, shortLinkLength)
+	limit := big.NewInt(int64(len(shortLinkAlphabet)))
+	for i := range token {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		token[i] = shortLinkAlphabet[n.Int64()]
+	}
+	return string(token), nil
+}
+
+func shortLinkExpired(link *model.ShopShortLink, now time.Time) bool {
+	return !link.ExpiresAt.IsZero() && now.After(link.ExpiresAt)
+}
+
+// ResolveShortLink counts a visit of a short link and returns where it leads.
+func (s *ShopService) ResolveShortLink(token string) (string, error) {
+	if len(token) != shortLinkLength {
+		return "", ErrShortLinkNotFound
+	}
+	db := database.GetShopDB()
+	link := &model.ShopShortLink{}
+	if err := db.Where("token = ?", token).Limit(1).Find(link).Error; err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if link.Id == 0 || !link.RevokedAt.IsZero() || shortLinkExpired(link, now) {
+		return "", ErrShortLinkNotFound
+	}
+	err := db.Model(&model.ShopShortLink{}).Where("id = ?", link.Id).Updates(map[string]any{
+		"hits":        gorm.Expr("hits + 1"),
+		"last_hit_at": now,
+	}).Error
+	return link.TargetUrl, err
+}
+
+// ListOrderShortLinks returns the short links sent for an order, newest first.
+func (s *ShopService) ListOrderShortLinks(orderId int) ([]model.ShopShortLink, error) {
+	links := []model.ShopShortLink{}
+	if err := database.GetShopDB().Where("order_id = ?", orderId).Order("id desc").Find(&links).Error; err != nil {
+		return nil, err
+	}
+	for i := range links {
+		links[i].Url = s.ShortLinkURL(&links[i])
+	}
+	return links, nil
+}
+
+// RevokeShortLink stops a short link from redirecting.
+func (s *ShopService) RevokeShortLink(id int) (*model.ShopShortLink, error) {
+	db := database.GetShopDB()
+	link := &model.ShopShortLink{}
+	if err := db.First(link, id).Error; err != nil {
+		return nil, err
+	}
+	if link.RevokedAt.IsZero() {
+		link.RevokedAt = time.Now()
+		if err := db.Model(link).Update("revoked_at", link.RevokedAt).Error; err != nil {
+			return nil, err
+		}
+	}
+	return link, nil
+}
+
+// RegenerateShortLink revokes a short link and returns a new one to the same
+// subscription, with a fresh lifetime.
+func (s *ShopService) RegenerateShortLink(id int) (*model.ShopShortLink, error) {
+	var link *model.ShopShortLink
+	err := database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		old := &model.ShopShortLink{}
+		if err := tx.First(old, id).Error; err != nil {
+			return err
+		}
+		if old.RevokedAt.IsZero() {
+			if err := tx.Model(old).Update("revoked_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+		var err error
+		link, err = s.createShortLink(tx, old.OrderId, old.Email, old.TargetUrl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	link.Url = s.ShortLinkURL(link)
+	return link, nil
+}
@@ -0,0 +1,410 @@
+package service
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+)
+
+// ShopCustomerSummary is the profile of one Telegram customer with the totals
+// of their orders.
+type ShopCustomerSummary struct {
+	TelegramId          int64     `json:"telegramId"`
+	Username            string    `json:"username"`
+	FirstName           string    `json:"firstName"`
+	Language            string    `json:"language"`
+	OrderCount          int       `json:"orderCount"`
+	ApprovedOrders      int       `json:"approvedOrders"`
+	Spent               int64     `json:"spent"`
+	Chargebacks         int       `json:"chargebacks"` // Orders whose payment the customer reversed
+	ActiveSubscriptions int       `json:"activeSubscriptions"`
+	Banned              bool      `json:"banned"`
+	BanReason           string    `json:"banReason"`
+	FirstSeenAt         time.Time `json:"firstSeenAt"`
+	LastSeenAt          time.Time `json:"lastSeenAt"`
+	LastOrderAt         time.Time `json:"lastOrderAt"`
+}
+
+// ShopRevenueDay is the approved sales of one calendar day.
+type ShopRevenueDay struct {
+	Date    string `json:"date"`
+	Orders  int    `json:"orders"`
+	Revenue int64  `json:"revenue"`
+}
+
+// ShopRevenueStats summarizes approved sales since a point in time. Orders
+// charged back are not part of the sales, and are counted on their own by
+// when the payment was reversed.
+type ShopRevenueStats struct {
+	Since           time.Time        `json:"since"`
+	Orders          int              `json:"orders"`
+	Revenue         int64            `json:"revenue"`
+	Chargebacks     int              `json:"chargebacks"`
+	ChargebackTotal int64            `json:"chargebackTotal"`
+	Days            []ShopRevenueDay `json:"days"`
+}
+
+// ShopRetentionCohort follows the customers whose first approved order was
+// placed in one month: Retained counts those of them who bought again in each
+// following month up to the current one, and Rates is the same in percent.
+type ShopRetentionCohort struct {
+	Month     string    `json:"month"`
+	Customers int       `json:"customers"`
+	Retained  []int     `json:"retained"`
+	Rates     []float64 `json:"rates"`
+}
+
+// ShopPackageUtilization compares the traffic sold with a package to what
+// the clients of its approved orders on this panel have used so far in their
+// current period. Clients without a traffic limit count towards UsedBytes but
+// are left out of Utilization.
+type ShopPackageUtilization struct {
+	PackageId   int     `json:"packageId"`
+	Package     string  `json:"package"`
+	DataGB      int     `json:"dataGb"` // Traffic the package is sold with now
+	Orders      int     `json:"orders"`
+	Clients     int     `json:"clients"`
+	Unlimited   int     `json:"unlimited"` // Clients without a traffic limit
+	SoldBytes   int64   `json:"soldBytes"`
+	UsedBytes   int64   `json:"usedBytes"`
+	AverageUsed int64   `json:"averageUsed"` // Bytes used per client
+	Utilization float64 `json:"utilization"` // Percent of the sold traffic used
+}
+
+// Bounds of the number of monthly cohorts RetentionCohorts reports.
+const (
+	defaultRetentionMonths = 12
+	maxRetentionMonths     = 36
+)
+
+// ListCustomers returns every customer who has a profile or placed an order,
+// most recently active first. Archived orders count towards the totals.
+func (s *ShopService) ListCustomers() ([]ShopCustomerSummary, error) {
+	db := database.GetShopDB()
+	var orders []model.ShopOrder
+	if err := db.Where("telegram_id <> 0").Order("id asc").Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	var archived []model.ShopOrderArchive
+	if err := db.Where("telegram_id <> 0").Find(&archived).Error; err != nil {
+		return nil, err
+	}
+	for _, order := range archived {
+		orders = append(orders, order.ShopOrder)
+	}
+	var customers []model.ShopCustomer
+	if err := db.Find(&customers).Error; err != nil {
+		return nil, err
+	}
+	byId := make(map[int64]*ShopCustomerSummary, len(customers))
+	for _, customer := range customers {
+		byId[customer.TelegramId] = &ShopCustomerSummary{
+			TelegramId:          customer.TelegramId,
+			Username:            customer.Username,
+			FirstName:           customer.FirstName,
+			Language:            customer.Language,
+			ActiveSubscriptions: customer.ActiveSubscriptions,
+			Banned:              customer.Banned,
+			BanReason:           customer.BanReason,
+			FirstSeenAt:         customer.CreatedAt,
+			LastSeenAt:          customer.LastSeenAt,
+		}
+	}
+	for _, order := range orders {
+		summary := byId[order.TelegramId]
+		if summary == nil {
+			summary = &ShopCustomerSummary{TelegramId: order.TelegramId}
+			byId[order.TelegramId] = summary
+		}
+		if summary.Username == "" {
+			summary.Username = order.TelegramUsername
+		}
+		// Profiles are newer than the first orders of long-time customers.
+		if summary.FirstSeenAt.IsZero() || order.CreatedAt.Before(summary.FirstSeenAt) {
+			summary.FirstSeenAt = order.CreatedAt
+		}
+		summary.OrderCount++
+		switch order.Status {
+		case OrderStatusApproved:
+			summary.ApprovedOrders++
+			summary.Spent += order.Price
+		case OrderStatusChargeback:
+			summary.Chargebacks++
+		}
+		if order.CreatedAt.After(summary.LastOrderAt) {
+			summary.LastOrderAt = order.CreatedAt
+		}
+	}
+	result := make([]ShopCustomerSummary, 0, len(byId))
+	for _, summary := range byId {
+		result = append(result, *summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].lastActive().After(result[j].lastActive())
+	})
+	return result, nil
+}
+
+// lastActive returns when the customer last used the bot or ordered.
+func (c *ShopCustomerSummary) lastActive() time.Time {
+	if c.LastSeenAt.After(c.LastOrderAt) {
+		return c.LastSeenAt
+	}
+	return c.LastOrderAt
+}
+
+// RevenueStats totals the approved orders placed since the given time, per day
+// of the panel's time zone and overall, archived orders included. Days without
+// sales are left out. Chargebacks recorded since then are totalled apart.
+func (s *ShopService) RevenueStats(since time.Time) (*ShopRevenueStats, error) {
+	orders, err := approvedOrdersSince(since)
+	if err != nil {
+		return nil, err
+	}
+	db := database.GetShopDB()
+	loc := s.Location()
+	stats := &ShopRevenueStats{Since: since, Days: []ShopRevenueDay{}}
+	for _, order := range orders {
+		date := order.CreatedAt.In(loc).Format("2006-01-02")
+		if n := len(stats.Days); n == 0 || stats.Days[n-1].Date != date {
+			stats.Days = append(stats.Days, ShopRevenueDay{Date: date})
+		}
+		day := &stats.Days[len(stats.Days)-1]
+		day.Orders++
+		day.Revenue += order.Price
+		stats.Orders++
+		stats.Revenue += order.Price
+	}
+	for _, table := range []any{&model.ShopOrder{}, &model.ShopOrderArchive{}} {
+		var row struct {
+			Count int
+			Total int64
+		}
+		err := db.Model(table).Select("COUNT(*) AS count, COALESCE(SUM(price), 0) AS total").
+			Where("status = ? AND chargeback_at >= ?", OrderStatusChargeback, since).Scan(&row).Error
+		if err != nil {
+			return nil, err
+		}
+		stats.Chargebacks += row.Count
+		stats.ChargebackTotal += row.Total
+	}
+	return stats, nil
+}
+
+// approvedOrdersSince returns the approved orders placed since the given time,
+// archived orders included, oldest first.
+func approvedOrdersSince(since time.Time) ([]model.ShopOrder, error) {
+	db := database.GetShopDB()
+	var orders []model.ShopOrder
+	err := db.Where("status = ? AND created_at >= ?", OrderStatusApproved, since).Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	var archived []model.ShopOrderArchive
+	err = db.Where("status = ? AND created_at >= ?", OrderStatusApproved, since).Find(&archived).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range archived {
+		orders = append(orders, order.ShopOrder)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].CreatedAt.Before(orders[j].CreatedAt)
+	})
+	return orders, nil
+}
+
+// RetentionCohorts groups customers by the month of their first approved
+// order, in the panel's time zone, and reports for the cohorts of the last
+// months how many of them ordered again in each month after. Archived orders
+// count, and customers without Telegram are told apart by contact email or
+// phone.
+func (s *ShopService) RetentionCohorts(months int, now time.Time) ([]ShopRetentionCohort, error) {
+	if months <= 0 {
+		months = defaultRetentionMonths
+	}
+	months = min(months, maxRetentionMonths)
+	orders, err := approvedOrdersSince(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	loc := s.Location()
+	monthIndex := func(t time.Time) int {
+		t = t.In(loc)
+		return t.Year()*12 + int(t.Month()) - 1
+	}
+	current := monthIndex(now)
+	first := current - months + 1
+
+	// Orders come oldest first, so a customer's first month is seen first.
+	cohortOf := map[string]int{}
+	active := map[string]map[int]bool{}
+	for _, order := range orders {
+		key := shopCustomerKey(order)
+		if key == "" {
+			continue
+		}
+		month := monthIndex(order.CreatedAt)
+		if _, ok := cohortOf[key]; !ok {
+			cohortOf[key] = month
+			active[key] = map[int]bool{}
+		}
+		active[key][month] = true
+	}
+
+	cohorts := make([]ShopRetentionCohort, months)
+	for i := range cohorts {
+		month := first + i
+		cohorts[i] = ShopRetentionCohort{
+			Month:    time.Date(month/12, time.Month(month%12+1), 1, 0, 0, 0, 0, loc).Format(shopGoalMonthLayout),
+			Retained: make([]int, current-month),
+			Rates:    make([]float64, current-month),
+		}
+	}
+	for key, cohort := range cohortOf {
+		if cohort < first {
+			continue
+		}
+		c := &cohorts[cohort-first]
+		c.Customers++
+		for offset := range c.Retained {
+			if active[key][cohort+offset+1] {
+				c.Retained[offset]++
+			}
+		}
+	}
+	for i := range cohorts {
+		c := &cohorts[i]
+		for offset, retained := range c.Retained {
+			if c.Customers > 0 {
+				c.Rates[offset] = float64(retained) * 100 / float64(c.Customers)
+			}
+		}
+	}
+	return cohorts, nil
+}
+
+// shopCustomerKey tells apart the customer who placed an order: by Telegram
+// ID, or else by contact email or phone. It is empty when there is none.
+func shopCustomerKey(order model.ShopOrder) string {
+	switch {
+	case order.TelegramId != 0:
+		return "tg:" + strconv.FormatInt(order.TelegramId, 10)
+	case order.ContactEmail != "":
+		return "email:" + strings.ToLower(order.ContactEmail)
+	case order.Phone != "":
+		return "phone:" + order.Phone
+	}
+	return ""
+}
+
+// PackageUtilization reports for every package how much of the traffic sold
+// with its approved orders the orders' clients have used, from the traffic
+// limits and counters of the clients on this panel. Pooled orders count with
+// their pool, and cart items with their own package. Orders hosted on nodes
+// are left out, their traffic being counted there.
+func (s *ShopService) PackageUtilization() ([]ShopPackageUtilization, error) {
+	db := database.GetShopDB()
+	var orders []model.ShopOrder
+	if err := db.Where("status = ? AND node_id = 0", OrderStatusApproved).Find(&orders).Error; err != nil {
+		return nil, err
+	}
+	var items []model.ShopOrderItem
+	err := db.Where("node_id = 0 AND client_email <> '' AND order_id IN (?)",
+		db.Model(&model.ShopOrder{}).Select("id").Where("status = ?", OrderStatusApproved)).Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []string
+	for _, order := range orders {
+		emails = append(emails, orderClientEmails(order)...)
+	}
+	for _, item := range items {
+		emails = append(emails, item.ClientEmail)
+	}
+	traffics := map[string]xray.ClientTraffic{}
+	for chunk := range slices.Chunk(emails, 500) {
+		var found []xray.ClientTraffic
+		if err := database.GetDB().Where("email IN ?", chunk).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for _, traffic := range found {
+			traffics[traffic.Email] = traffic
+		}
+	}
+
+	byPackage := map[int]*ShopPackageUtilization{}
+	limitedUsed := map[int]int64{}
+	usage := func(packageId int) *ShopPackageUtilization {
+		if byPackage[packageId] == nil {
+			byPackage[packageId] = &ShopPackageUtilization{PackageId: packageId}
+		}
+		return byPackage[packageId]
+	}
+	addClient := func(u *ShopPackageUtilization, email string) {
+		traffic, ok := traffics[email]
+		if !ok {
+			return
+		}
+		used := traffic.Up + traffic.Down
+		u.Clients++
+		u.UsedBytes += used
+		if traffic.Total > 0 {
+			u.SoldBytes += traffic.Total
+			limitedUsed[u.PackageId] += used
+		} else {
+			u.Unlimited++
+		}
+	}
+	for _, order := range orders {
+		if order.PackageId == nil {
+			continue
+		}
+		u := usage(*order.PackageId)
+		u.Orders++
+		if order.PoolBytes > 0 {
+			u.SoldBytes += order.PoolBytes
+			for _, email := range orderClientEmails(order) {
+				if traffic, ok := traffics[email]; ok {
+					u.Clients++
+					u.UsedBytes += traffic.Up + traffic.Down
+					limitedUsed[u.PackageId] += traffic.Up + traffic.Down
+				}
+			}
+			continue
+		}
+		for _, email := range orderClientEmails(order) {
+			addClient(u, email)
+		}
+	}
+	for _, item := range items {
+		u := usage(item.PackageId)
+		u.Orders++
+		addClient(u, item.ClientEmail)
+	}
+
+	result := make([]ShopPackageUtilization, 0, len(byPackage))
+	for id, u := range byPackage {
+		if pkg, err := s.GetPackage(id); err == nil {
+			u.Package, u.DataGB = pkg.Name, pkg.DataGB
+		}
+		if u.Clients > 0 {
+			u.AverageUsed = u.UsedBytes / int64(u.Clients)
+		}
+		if u.SoldBytes > 0 {
+			u.Utilization = float64(limitedUsed[id]) * 100 / float64(u.SoldBytes)
+		}
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PackageId < result[j].PackageId
+	})
+	return result, nil
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ShopStorefrontPackage is a package as the public storefront and price list
+// show it.
+type ShopStorefrontPackage struct {
+	Id           int    `json:"id"`
+	Name         string `json:"name"`
+	Category     string `json:"category"`
+	Description  string `json:"description"`
+	ImageUrl     string `json:"imageUrl"` // Only http(s) images; Telegram file IDs cannot be shown on the web
+	DataGB       int    `json:"dataGb"`
+	DurationDays int    `json:"durationDays"`
+	Devices      int    `json:"devices"`      // Devices sharing a pooled package, 0 for other packages
+	BillingCycle string `json:"billingCycle"` // Renewal cycle of a recurring package, empty for one-time ones
+	Amount       int64  `json:"amount"`       // Price in minor units of Currency
+	Currency     string `json:"currency"`
+	Price        string `json:"price"`  // Amount formatted for display, such as "12.50 USD"
+	BuyUrl       string `json:"buyUrl"` // Deep link opening the package's checkout in the bot, empty while it is stopped
+}
+
+// ShopPriceList is the public JSON price list of the packages for sale.
+type ShopPriceList struct {
+	Currency string                  `json:"currency"`
+	Exponent int                     `json:"exponent"` // Decimal digits of the currency's minor unit
+	Language string                  `json:"language"` // Number style of the formatted prices
+	Packages []ShopStorefrontPackage `json:"packages"`
+}
+
+// PriceList returns the storefront packages with prices formatted in lang.
+func (s *ShopService) PriceList(botUsername, lang string) (*ShopPriceList, error) {
+	packages, err := s.StorefrontPackages(botUsername)
+	if err != nil {
+		return nil, err
+	}
+	currency := s.Currency()
+	for i := range packages {
+		packages[i].Price = LocalizePrice(packages[i].Amount, currency.Code, lang)
+	}
+	return &ShopPriceList{Currency: currency.Code, Exponent: currency.Exponent, Language: lang, Packages: packages}, nil
+}
+
+// StorefrontPackages returns the packages sold through the bot for the public
+// storefront in their sort order, with deep links into botUsername.
+func (s *ShopService) StorefrontPackages(botUsername string) ([]ShopStorefrontPackage, error) {
+	packages, err := s.ListPackages(ShopPackageFilter{ActiveOnly: true, Types: shopOrderPackageTypes})
+	if err != nil {
+		return nil, err
+	}
+	categories, err := s.ListCategories()
+	if err != nil {
+		return nil, err
+	}
+	currency := s.Currency().Code
+	names := map[int]string{}
+	for _, category := range categories {
+		names[category.Id] = category.Name
+	}
+	items := make([]ShopStorefrontPackage, 0, len(packages))
+	for _, pkg := range packages {
+		item := ShopStorefrontPackage{
+			Id:           pkg.Id,
+			Name:         pkg.Name,
+			Category:     names[pkg.CategoryId],
+			Description:  pkg.Description,
+			DataGB:       pkg.DataGB,
+			DurationDays: pkg.DurationDays,
+			BillingCycle: pkg.BillingCycle,
+			Amount:       pkg.Price,
+			Currency:     currency,
+			Price:        s.FormatPrice(pkg.Price),
+			BuyUrl:       DeepLinkURL(botUsername, DeepLinkPackagePrefix+strconv.Itoa(pkg.Id)),
+		}
+		if pkg.Type == PackageTypePooled {
+			item.Devices = pkg.Devices
+		}
+		if strings.HasPrefix(pkg.ImageUrl, "https://") || strings.HasPrefix(pkg.ImageUrl, "http://") {
+			item.ImageUrl = pkg.ImageUrl
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"errors"
+	"strings"
+)
+
+// ShopCatalogSyncResult summarizes a catalog sync from the primary panel.
+type ShopCatalogSyncResult struct {
+	ShopCatalogImportResult
+	Archived int `json:"archived"` // Local packages the primary no longer sells
+}
+
+// CatalogSyncEnabled tells whether this panel mirrors the catalog of a primary
+// panel, and how often in minutes.
+func (s *ShopService) CatalogSyncEnabled() (bool, int) {
+	primary, err := s.settingService.GetShopSyncPrimaryUrl()
+	if err != nil || primary == "" {
+		return false, 0
+	}
+	minutes, err := s.settingService.GetShopSyncMinutes()
+	if err != nil || minutes <= 0 {
+		return false, 0
+	}
+	return true, minutes
+}
+
+// SyncCatalog makes the package catalog a copy of the primary panel's: its
+// packages are created or overwritten by name and local packages it does not
+// list are archived. An empty catalog is not applied, as a primary that lost
+// its packages is more likely broken than meant to sell nothing.
+func (s *ShopService) SyncCatalog() (*ShopCatalogSyncResult, error) {
+	primary, err := s.settingService.GetShopSyncPrimaryUrl()
+	if err != nil {
+		return nil, err
+	}
+	if primary == "" {
+		return nil, errors.New("no primary panel configured")
+	}
+	token, err := s.settingService.GetShopSyncToken()
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.shopNodeService.RemoteCatalog(strings.TrimRight(primary, "/"), token)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := s.parseCatalog(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(catalog.Packages) == 0 {
+		return nil, errors.New("the primary panel lists no packages")
+	}
+	imported, err := s.importCatalog(catalog, CatalogConflictOverwrite)
+	if err != nil {
+		return nil, err
+	}
+	result := &ShopCatalogSyncResult{ShopCatalogImportResult: *imported}
+
+	listed := map[string]bool{}
+	for _, pkg := range catalog.Packages {
+		listed[strings.ToLower(strings.TrimSpace(pkg.Name))] = true
+	}
+	packages, err := s.ListPackages(ShopPackageFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pkg := range packages {
+		if listed[strings.ToLower(pkg.Name)] {
+			continue
+		}
+		if err := s.DeletePackage(pkg.Id); err != nil {
+			return nil, err
+		}
+		result.Archived++
+	}
+	return result, nil
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// inboundTagRe matches a normalized inbound tag, such as "germany" or "low-ping".
+var inboundTagRe = regexp.MustCompile(`^[\p{L}\p{N}_-]{1,32}$`)
+
+// normalizeShopTag trims and lower-cases a tag. It returns "" for a tag that is
+// empty or not a valid tag.
+func normalizeShopTag(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !inboundTagRe.MatchString(tag) {
+		return ""
+	}
+	return tag
+}
+
+// splitShopTags returns the tags of a stored comma-separated list.
+func splitShopTags(value string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// SetInboundTags replaces the tags of an inbound. Tags are lower-cased and
+// de-duplicated; an empty list removes them all.
+func (s *ShopService) SetInboundTags(nodeId, inboundId int, tags []string) error {
+	v := &shopValidator{}
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		t := normalizeShopTag(tag)
+		if t == "" {
+			v.add("tags", "shop.invalid.tag")
+			continue
+		}
+		normalized = append(normalized, t)
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	sort.Strings(normalized)
+	value := strings.Join(slices.Compact(normalized), ",")
+
+	db := database.GetShopDB()
+	var existing model.ShopInbound
+	err := db.Where("node_id = ? AND inbound_id = ?", nodeId, inboundId).First(&existing).Error
+	if err == nil {
+		return db.Model(&model.ShopInbound{}).Where("id = ?", existing.Id).Updates(map[string]any{
+			"tags":       value,
+			"updated_at": time.Now(),
+		}).Error
+	}
+	// Tagging must not change which inbounds are offered. Without a row an
+	// inbound's state depends on the other rows: every local inbound is offered
+	// while none has a row, so the first local row pins all of them.
+	options, err := s.ListInbounds()
+	if err != nil {
+		return err
+	}
+	var localRows int64
+	if err := db.Model(&model.ShopInbound{}).Where("node_id = 0").Count(&localRows).Error; err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		found := false
+		for _, option := range options {
+			target := option.NodeId == nodeId && option.Id == inboundId
+			if !target && (nodeId != 0 || option.NodeId != 0 || localRows > 0) {
+				continue
+			}
+			row := map[string]any{
+				"node_id":    option.NodeId,
+				"inbound_id": option.Id,
+				"enabled":    option.Enabled,
+				"created_at": time.Now(),
+				"updated_at": time.Now(),
+			}
+			if target {
+				row["tags"] = value
+				found = true
+			}
+			if err := tx.Model(&model.ShopInbound{}).Create(row).Error; err != nil {
+				return err
+			}
+		}
+		if !found {
+			return fmt.Errorf("inbound %d not found", inboundId)
+		}
+		return nil
+	})
+}
+
+// ListInboundTags returns every tag in use with the number of inbounds
+// carrying it.
+func (s *ShopService) ListInboundTags() (map[string]int, error) {
+	var values []string
+	err := database.GetShopDB().Model(&model.ShopInbound{}).Where("tags <> ''").Pluck("tags", &values).Error
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, value := range values {
+		for _, tag := range splitShopTags(value) {
+			counts[tag]++
+		}
+	}
+	return counts, nil
+}
+
+// SelectTaggedInbound returns the enabled inbound with room left that carries
+// tag, preferring the least used one.
+func (s *ShopService) SelectTaggedInbound(tag string) (*ShopInboundOption, error) {
+	options, err := s.ListInbounds()
+	if err != nil {
+		return nil, err
+	}
+	var best *ShopInboundOption
+	for i := range options {
+		option := &options[i]
+		if !option.Enabled || option.Full || !slices.Contains(option.Tags, tag) {
+			continue
+		}
+		if best == nil || option.Usage < best.Usage {
+			best = option
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no inbound tagged %q has room", tag)
+	}
+	return best, nil
+}
+
+// PlaceTaggedOrder moves an order of a package that requires an inbound tag
+// onto an inbound carrying it. The order's own inbound is kept when it carries
+// the tag and has room.
+func (s *ShopService) PlaceTaggedOrder(order *model.ShopOrder, tag string) error {
+	options, err := s.ListInbounds()
+	if err != nil {
+		return err
+	}
+	for _, option := range options {
+		if option.NodeId == order.NodeId && option.Id == order.InboundId {
+			if option.Enabled && !option.Full && slices.Contains(option.Tags, tag) {
+				return nil
+			}
+			break
+		}
+	}
+	option, err := s.SelectTaggedInbound(tag)
+	if err != nil {
+		return err
+	}
+	order.NodeId = option.NodeId
+	order.InboundId = option.Id
+	return nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"html"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// renderShopTemplate replaces the {{name}} placeholders of a bot message template.
+// Values are HTML-escaped because bot messages are sent in HTML parse mode.
+func renderShopTemplate(tmpl string, vars map[string]string) string {
+	pairs := make([]string, 0, len(vars)*2)
+	for name, value := range vars {
+		pairs = append(pairs, "{{"+name+"}}", html.EscapeString(value))
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
+// OrderTemplateVars returns the placeholders available to order message templates.
+func (s *ShopService) OrderTemplateVars(order *model.ShopOrder) map[string]string {
+	vars := map[string]string{
+		"order":   OrderNumber(order),
+		"price":   s.FormatPrice(order.Price),
+		"email":   order.ClientEmail,
+		"package": "Custom",
+	}
+	if order.PackageId != nil {
+		if pkg, err := s.GetPackage(*order.PackageId); err == nil {
+			vars["package"] = pkg.Name
+		}
+	} else if order.ItemCount > 0 {
+		if names, err := s.OrderItemNames(order.Id); err == nil && len(names) > 0 {
+			vars["package"] = strings.Join(names, ", ")
+		}
+	}
+	return vars
+}
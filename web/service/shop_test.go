@@ -0,0 +1,3795 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/logger"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+	"github.com/mhsanaei/3x-ui/v2/xray"
+
+	"github.com/op/go-logging"
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	logDir, err := os.MkdirTemp("", "x-ui-test-log")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XUI_LOG_FOLDER", logDir)
+	os.Setenv("XUI_SHOP_KEY_FILE", filepath.Join(logDir, "shop.key"))
+	logger.InitLogger(logging.ERROR)
+	code := m.Run()
+	os.RemoveAll(logDir)
+	os.Exit(code)
+}
+
+// newShopTestDB opens a fresh in-memory panel database for one test.
+func newShopTestDB(t *testing.T) {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	if err := database.InitDB(fmt.Sprintf("file:%s?mode=memory&cache=shared", name)); err != nil {
+		t.Fatalf("init database: %v", err)
+	}
+	shopPackageCache.invalidate()
+	shopInboundCache.invalidate()
+	t.Cleanup(func() {
+		if err := database.CloseDB(); err != nil {
+			t.Errorf("close database: %v", err)
+		}
+	})
+}
+
+func setShopSetting(t *testing.T, key, value string) {
+	t.Helper()
+	if err := new(SettingService).saveSetting(key, value); err != nil {
+		t.Fatalf("save setting %s: %v", key, err)
+	}
+}
+
+func newTestPackage(name string) *model.ShopPackage {
+	return &model.ShopPackage{Name: name, DataGB: 10, DurationDays: 30, Price: 100, IsActive: true}
+}
+
+func TestPackageCRUD(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	a, b := newTestPackage("a"), newTestPackage("b")
+	for _, pkg := range []*model.ShopPackage{a, b} {
+		if err := s.CreatePackage(pkg); err != nil {
+			t.Fatalf("create %s: %v", pkg.Name, err)
+		}
+	}
+	if a.SortOrder != 1 || b.SortOrder != 2 {
+		t.Fatalf("sort orders = %d, %d, want 1, 2", a.SortOrder, b.SortOrder)
+	}
+
+	if err := s.ReorderPackages([]int{b.Id, a.Id}); err != nil {
+		t.Fatalf("reorder: %v", err)
+	}
+	packages, err := s.ListPackages(ShopPackageFilter{})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(packages) != 2 || packages[0].Id != b.Id {
+		t.Fatalf("list after reorder = %+v, want b first", packages)
+	}
+
+	dup, err := s.DuplicatePackage(a.Id)
+	if err != nil {
+		t.Fatalf("duplicate: %v", err)
+	}
+	if dup.IsActive || dup.Name != "a copy" {
+		t.Fatalf("duplicate = %+v, want inactive copy", dup)
+	}
+	active, _ := s.ListPackages(ShopPackageFilter{ActiveOnly: true})
+	if len(active) != 2 {
+		t.Fatalf("active packages = %d, want 2", len(active))
+	}
+
+	if err := s.DeletePackage(a.Id); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	live, _ := s.ListPackages(ShopPackageFilter{})
+	archived, _ := s.ListPackages(ShopPackageFilter{Archived: true})
+	if len(live) != 2 || len(archived) != 1 || archived[0].Id != a.Id {
+		t.Fatalf("live = %d, archived = %+v, want 2 live and a archived", len(live), archived)
+	}
+	if got, err := s.GetPackage(a.Id); err != nil || got.IsActive {
+		t.Fatalf("archived package = %+v, %v, want inactive", got, err)
+	}
+}
+
+func TestUpdatePackageSavesZeroValues(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	pkg := newTestPackage("free")
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	edit := *pkg
+	edit.Price = 0
+	edit.IsActive = false
+	if err := s.UpdatePackage(&edit); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	got, err := s.GetPackage(pkg.Id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Price != 0 || got.IsActive {
+		t.Fatalf("package = price %d active %v, want free and inactive", got.Price, got.IsActive)
+	}
+	if got.SortOrder != pkg.SortOrder {
+		t.Fatalf("sort order = %d, want %d kept", got.SortOrder, pkg.SortOrder)
+	}
+
+	inactive := newTestPackage("draft")
+	inactive.IsActive = false
+	if err := s.CreatePackage(inactive); err != nil {
+		t.Fatalf("create inactive: %v", err)
+	}
+	if got, _ := s.GetPackage(inactive.Id); got.IsActive {
+		t.Fatal("package created inactive is active")
+	}
+}
+
+func TestUpdatePackageVersionConflict(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	pkg := newTestPackage("a")
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	first, second := *pkg, *pkg
+	first.Price = 200
+	if err := s.UpdatePackage(&first); err != nil {
+		t.Fatalf("first update: %v", err)
+	}
+	second.Price = 300
+	if err := s.UpdatePackage(&second); !errors.Is(err, ErrPackageConflict) {
+		t.Fatalf("stale update error = %v, want ErrPackageConflict", err)
+	}
+	got, _ := s.GetPackage(pkg.Id)
+	if got.Price != 200 || got.Version != first.Version {
+		t.Fatalf("package = price %d version %d, want 200 and %d", got.Price, got.Version, first.Version)
+	}
+
+	// An edit without the version it started from could overwrite another one.
+	unversioned := *got
+	unversioned.Version = 0
+	if err := s.UpdatePackage(&unversioned); err == nil {
+		t.Fatal("update without a version accepted")
+	} else if verr, ok := AsValidationError(err); !ok || verr.Fields[0].Field != "version" {
+		t.Fatalf("update without a version error = %v, want a version validation error", err)
+	}
+}
+
+func TestCreatePackageValidation(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	tests := []struct {
+		name   string
+		pkg    model.ShopPackage
+		fields []string
+	}{
+		{"missing name", model.ShopPackage{Price: 1}, []string{"name"}},
+		{"long name", model.ShopPackage{Name: strings.Repeat("x", shopNameMaxLength+1)}, []string{"name"}},
+		{"negative price", model.ShopPackage{Name: "a", Price: -1}, []string{"price"}},
+		{"top-up without data", model.ShopPackage{Name: "a", Type: PackageTypeTopUp}, []string{"dataGb"}},
+		{"recurring top-up", model.ShopPackage{Name: "a", Type: PackageTypeTopUp, DataGB: 1, BillingCycle: BillingCycleMonthly}, []string{"billingCycle"}},
+		{"pooled with one device", model.ShopPackage{Name: "a", Type: PackageTypePooled, Devices: 1}, []string{"devices"}},
+		{"unknown type", model.ShopPackage{Name: "a", Type: "bundle"}, []string{"type"}},
+		{"unknown payment method", model.ShopPackage{Name: "a", PaymentMethods: "card,cash"}, []string{"paymentMethods"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkg := tt.pkg
+			verr, ok := AsValidationError(s.CreatePackage(&pkg))
+			if !ok {
+				t.Fatal("expected a validation error")
+			}
+			messages := verr.Localize("en")
+			for _, field := range tt.fields {
+				if messages[field] == "" {
+					t.Errorf("no message for %s in %v", field, messages)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCustomOrder(t *testing.T) {
+	newShopTestDB(t)
+	setShopSetting(t, "shopMinGB", "5")
+	setShopSetting(t, "shopMaxGB", "100")
+	setShopSetting(t, "shopMinDays", "7")
+	setShopSetting(t, "shopMaxDays", "90")
+	s := &ShopService{}
+
+	tests := []struct {
+		gb, days int
+		fields   []string
+	}{
+		{5, 7, nil},
+		{100, 90, nil},
+		{4, 30, []string{"customDataGb"}},
+		{101, 30, []string{"customDataGb"}},
+		{10, 6, []string{"customDays"}},
+		{10, 91, []string{"customDays"}},
+		{0, 0, []string{"customDataGb", "customDays"}},
+		{-1, 30, []string{"customDataGb"}},
+	}
+	for _, tt := range tests {
+		err := s.ValidateCustomOrder(tt.gb, tt.days)
+		if len(tt.fields) == 0 {
+			if err != nil {
+				t.Errorf("%dGB/%dd: unexpected error %v", tt.gb, tt.days, err)
+			}
+			continue
+		}
+		verr, ok := AsValidationError(err)
+		if !ok {
+			t.Errorf("%dGB/%dd: error = %v, want a validation error", tt.gb, tt.days, err)
+			continue
+		}
+		if len(verr.Fields) != len(tt.fields) {
+			t.Errorf("%dGB/%dd: fields = %+v, want %v", tt.gb, tt.days, verr.Fields, tt.fields)
+		}
+		for i, field := range tt.fields {
+			if i < len(verr.Fields) && verr.Fields[i].Field != field {
+				t.Errorf("%dGB/%dd: field %d = %s, want %s", tt.gb, tt.days, i, verr.Fields[i].Field, field)
+			}
+		}
+	}
+}
+
+func TestCustomOrderSteps(t *testing.T) {
+	newShopTestDB(t)
+	setShopSetting(t, "shopMaxGB", "100")
+	setShopSetting(t, "shopStepGB", "10")
+	setShopSetting(t, "shopStepDays", "30")
+	setShopSetting(t, "shopPresetsGB", "10, 25,50,200")
+	setShopSetting(t, "shopPresetsDays", "30,60,x")
+	s := &ShopService{}
+
+	if err := s.ValidateCustomOrder(20, 60); err != nil {
+		t.Fatalf("20GB/60d: %v", err)
+	}
+	verr, ok := AsValidationError(s.ValidateCustomOrder(25, 45))
+	if !ok || len(verr.Fields) != 2 || verr.Fields[0].Key != "shop.invalid.step" {
+		t.Fatalf("25GB/45d: %v, want step errors on both fields", verr)
+	}
+
+	gb, days := s.CustomOrderPresets()
+	if fmt.Sprint(gb) != "[10 50]" || fmt.Sprint(days) != "[30 60]" {
+		t.Fatalf("presets = %v / %v, want [10 50] / [30 60]", gb, days)
+	}
+
+	settings := &entity.AllSetting{ShopMaxGB: 100, ShopStepGB: 10, ShopPresetsGB: "10,20", ShopPresetsDays: "30"}
+	if err := validateShopSettings(settings); err != nil {
+		t.Fatalf("valid settings: %v", err)
+	}
+	for _, presets := range []string{"10,25", "10,abc", "10,-10", "110"} {
+		settings.ShopPresetsGB = presets
+		verr, ok := AsValidationError(validateShopSettings(settings))
+		if !ok || verr.Fields[0].Field != "presetsGb" {
+			t.Errorf("presets %q: %v, want a presetsGb error", presets, verr)
+		}
+	}
+}
+
+func TestFormatPrice(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		want     string
+	}{
+		{0, "", "0"},
+		{1250000, "IRT", "1,250,000 IRT"},
+		{1250, "USD", "12.50 USD"},
+		{5, "EUR", "0.05 EUR"},
+		{-123456, "USD", "-1,234.56 USD"},
+		{math.MinInt64, "USD", "-92,233,720,368,547,758.08 USD"},
+	}
+	for _, tt := range tests {
+		if got := FormatPrice(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatPrice(%d, %q) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		text, currency string
+		want           int64
+		ok             bool
+	}{
+		{"12.5", "USD", 1250, true},
+		{"1,250,000", "IRT", 1250000, true},
+		{".99", "USD", 99, true},
+		{"12.345", "USD", 0, false},
+		{"12.5", "IRR", 0, false},
+		{"-1", "USD", 0, false},
+		{"", "USD", 0, false},
+		{"92233720368547758.08", "USD", 0, false},
+		{"92233720368547758.07", "USD", math.MaxInt64, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePrice(tt.text, tt.currency)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParsePrice(%q, %q) = %d, %v; want %d, ok %v", tt.text, tt.currency, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCalculateCustomPriceOverflow(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	setShopSetting(t, "shopPricePerGB", "250")
+	price, err := s.CalculateCustomPrice(40)
+	if err != nil || price != 10000 {
+		t.Fatalf("price = %d, %v; want 10000", price, err)
+	}
+
+	setShopSetting(t, "shopPricePerGB", fmt.Sprint(int64(math.MaxInt64/1000)))
+	if _, err := s.CalculateCustomPrice(1001); !errors.Is(err, ErrPriceOverflow) {
+		t.Fatalf("err = %v, want ErrPriceOverflow", err)
+	}
+}
+
+func TestGenerateClientNames(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	order := &model.ShopOrder{Id: 5, TelegramId: 1001, TelegramUsername: "Alice"}
+
+	emails, subIds, err := s.GenerateClientNames(order, 1)
+	if err != nil || len(emails) != 1 || emails[0] != "tg-1001-5@shop" || len(subIds[0]) != 16 {
+		t.Fatalf("default names = %v %v, %v", emails, subIds, err)
+	}
+
+	setShopSetting(t, "shopEmailPattern", "{tgusername}-{orderid}")
+	setShopSetting(t, "shopSubIdPattern", "{tgusername} {num:4}")
+	emails, subIds, err = s.GenerateClientNames(order, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails[0] != "alice-5-1" || emails[1] != "alice-5-2" {
+		t.Fatalf("pooled emails = %v, want one per device", emails)
+	}
+	if !strings.HasPrefix(subIds[0], "alice-") || len(subIds[0]) != len("alice-0000") {
+		t.Fatalf("subId = %q, want the username and 4 digits", subIds[0])
+	}
+
+	// A name already used by an inbound client gets a random suffix.
+	inbound := &model.Inbound{Port: 1001, Protocol: model.VLESS, Tag: "inbound-1001", Settings: `{"clients":[{"email":"Alice-5","subId":"x"}]}`}
+	if err := database.GetDB().Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	emails, _, err = s.GenerateClientNames(order, 1)
+	if err != nil || emails[0] == "alice-5" || !strings.HasPrefix(emails[0], "alice-5-") {
+		t.Fatalf("colliding email = %v, %v; want a suffixed name", emails, err)
+	}
+
+	for pattern, valid := range map[string]bool{
+		"{tgid}-{random:4}@shop": true,
+		"{words}":                true,
+		"":                       true,
+		"{nickname}":             false,
+		"{random:99}":            false,
+		"{orderid:3}":            false,
+	} {
+		v := &shopValidator{}
+		validateNamePattern(v, "emailPattern", pattern)
+		if got := len(v.fields) == 0; got != valid {
+			t.Errorf("pattern %q valid = %v, want %v", pattern, got, valid)
+		}
+	}
+}
+
+func TestInboundOptionCapacity(t *testing.T) {
+	tests := []struct {
+		name             string
+		maxClients       int
+		clients          int
+		up, down, total  int64
+		available        int
+		availableTraffic int64
+		usage            float64
+		full             bool
+	}{
+		{"unlimited", 0, 5, 10, 20, 0, -1, -1, 0, false},
+		{"client cap", 10, 4, 0, 0, 0, 6, -1, 0.4, false},
+		{"clients full", 2, 3, 0, 0, 0, 0, -1, 1.5, true},
+		{"traffic cap", 0, 1, 300, 500, 1000, -1, 200, 0.8, false},
+		{"traffic exhausted", 10, 1, 600, 500, 1000, 9, 0, 1.1, true},
+	}
+	for _, tt := range tests {
+		option := ShopInboundOption{MaxClients: tt.maxClients, Clients: tt.clients}
+		option.setCapacity(&model.Inbound{Up: tt.up, Down: tt.down, Total: tt.total})
+		if option.Traffic != tt.up+tt.down || option.Available != tt.available || option.AvailableTraffic != tt.availableTraffic ||
+			math.Abs(option.Usage-tt.usage) > 1e-9 || option.Full != tt.full {
+			t.Errorf("%s: got %+v", tt.name, option)
+		}
+	}
+}
+
+func TestInboundTags(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	for i, clients := range []string{`[{"email":"a"},{"email":"b"}]`, `[]`, `[]`} {
+		inbound := &model.Inbound{Port: 2001 + i, Protocol: model.VLESS, Tag: fmt.Sprint("inbound-", i), Settings: `{"clients":` + clients + `}`}
+		if err := database.GetDB().Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// No inbound has a row yet, so all are offered; tagging one must keep it so.
+	if err := s.SetInboundTags(0, 3, []string{"gaming"}); err != nil {
+		t.Fatal(err)
+	}
+	options, err := s.ListInbounds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range options {
+		if !option.Enabled {
+			t.Errorf("inbound %d was withdrawn by tagging", option.Id)
+		}
+	}
+	if err := s.SetInboundMaxClients(0, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetInboundMaxClients(0, 2, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := AsValidationError(s.SetInboundTags(0, 1, []string{"germany", "bad tag"})); !ok {
+		t.Fatal("invalid tag accepted")
+	}
+	if err := s.SetInboundTags(0, 1, []string{"Germany", "premium", "germany"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetInboundTags(0, 2, []string{"germany"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetInboundTags(0, 9, []string{"gaming"}); err == nil {
+		t.Fatal("tagging a missing inbound succeeded")
+	}
+
+	options, err = s.ListInbounds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(options[0].Tags); got != "[germany premium]" {
+		t.Errorf("inbound 1 tags = %s, want [germany premium]", got)
+	}
+	tags, err := s.ListInboundTags()
+	if err != nil || tags["germany"] != 2 || tags["gaming"] != 1 {
+		t.Fatalf("tags = %v, %v", tags, err)
+	}
+
+	// Inbound 2 carries the tag and has no clients, so it is preferred.
+	order := &model.ShopOrder{InboundId: 3}
+	if err := s.PlaceTaggedOrder(order, "germany"); err != nil || order.InboundId != 2 {
+		t.Fatalf("placed on %d, %v; want inbound 2", order.InboundId, err)
+	}
+	order.InboundId = 1
+	if err := s.PlaceTaggedOrder(order, "germany"); err != nil || order.InboundId != 1 {
+		t.Fatalf("placed on %d, %v; want the order's own inbound 1", order.InboundId, err)
+	}
+	if err := s.PlaceTaggedOrder(order, "mars"); err == nil {
+		t.Fatal("placed an order on a tag no inbound carries")
+	}
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	order := &model.ShopOrder{TelegramId: 1001, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 50, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.UpdateOrderReceipt(order.Id, "/tmp/receipt.jpg", "file"); err != nil {
+		t.Fatalf("receipt: %v", err)
+	}
+	got, _ := s.GetOrder(order.Id)
+	if got.Status != OrderStatusPendingReview {
+		t.Fatalf("status after receipt = %s, want %s", got.Status, OrderStatusPendingReview)
+	}
+
+	got.ClientEmail = "shop-1001"
+	if err := s.SetOrderProvisioned(got); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	if got.Status != OrderStatusApproved {
+		t.Fatalf("status after provisioning = %s, want %s", got.Status, OrderStatusApproved)
+	}
+	stored, _ := s.GetOrder(order.Id)
+	if stored.Status != OrderStatusApproved || stored.ClientEmail != "shop-1001" {
+		t.Fatalf("stored order = %s %q, want approved with client", stored.Status, stored.ClientEmail)
+	}
+
+	rejected := &model.ShopOrder{TelegramId: 1002, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 50, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(rejected); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := s.UpdateOrderStatus(rejected.Id, OrderStatusRejected, ""); err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+	if got, _ := s.GetOrder(rejected.Id); got.Status != OrderStatusRejected {
+		t.Fatalf("status = %s, want %s", got.Status, OrderStatusRejected)
+	}
+	// A rejected order cannot be approved afterwards.
+	if err := s.SetOrderProvisioned(rejected); err == nil {
+		t.Fatal("provisioning a rejected order succeeded")
+	}
+}
+
+func TestSetOrderProvisionedIsIdempotent(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	pkg := newTestPackage("monthly")
+	pkg.BillingCycle = BillingCycleMonthly
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatalf("create package: %v", err)
+	}
+	order := &model.ShopOrder{TelegramId: 2001, InboundId: 1, PackageId: &pkg.Id, Price: pkg.Price, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	if err := s.UpdateOrderReceipt(order.Id, "", "file"); err != nil {
+		t.Fatalf("receipt: %v", err)
+	}
+
+	first, _ := s.GetOrder(order.Id)
+	first.ClientEmail = "first"
+	if err := s.SetOrderProvisioned(first); err != nil {
+		t.Fatalf("first provision: %v", err)
+	}
+	second, _ := s.GetOrder(order.Id)
+	second.Status = OrderStatusPendingReview
+	second.ClientEmail = "second"
+	if err := s.SetOrderProvisioned(second); err == nil {
+		t.Fatal("second provision succeeded")
+	}
+
+	stored, _ := s.GetOrder(order.Id)
+	if stored.ClientEmail != "first" {
+		t.Fatalf("client email = %q, want the first provisioning kept", stored.ClientEmail)
+	}
+	var subs int64
+	database.GetShopDB().Model(&model.ShopSubscription{}).Where("order_id = ?", order.Id).Count(&subs)
+	if subs != 1 {
+		t.Fatalf("subscriptions = %d, want 1", subs)
+	}
+}
+
+func TestProvisionQueue(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	for attempts, want := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 5: 8 * time.Minute, 8: time.Hour} {
+		if got := provisionBackoff(attempts); got != want {
+			t.Errorf("backoff after %d attempts = %v, want %v", attempts, got, want)
+		}
+	}
+
+	// The inbound does not exist, so provisioning fails.
+	order := &model.ShopOrder{TelegramId: 3001, InboundId: 99, CustomDataGB: 10, CustomDays: 30, Price: 50, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatalf("create order: %v", err)
+	}
+	if err := s.UpdateOrderReceipt(order.Id, "", "file"); err != nil {
+		t.Fatalf("receipt: %v", err)
+	}
+	err := new(Tgbot).ApproveOrder(context.Background(), order)
+	if !errors.Is(err, ErrProvisionQueued) {
+		t.Fatalf("approve error = %v, want ErrProvisionQueued", err)
+	}
+	stored, _ := s.GetOrder(order.Id)
+	if stored.Status != OrderStatusProvisioning || stored.ProvisionAttempts != 1 || stored.ProvisionError == "" {
+		t.Fatalf("queued order = %s, %d attempts, error %q", stored.Status, stored.ProvisionAttempts, stored.ProvisionError)
+	}
+	if due, _ := s.DueProvisioningOrders(time.Now()); len(due) != 0 {
+		t.Fatalf("due right away = %d orders, want none before the backoff", len(due))
+	}
+	if due, _ := s.DueProvisioningOrders(time.Now().Add(time.Minute)); len(due) != 1 {
+		t.Fatalf("due after the backoff = %d orders, want 1", len(due))
+	}
+
+	for stored.ProvisionAttempts < ShopProvisionMaxAttempts {
+		if err := s.QueueProvisioning(stored, errors.New("node unreachable")); err != nil {
+			t.Fatalf("queue: %v", err)
+		}
+	}
+	if !ProvisionStuck(stored) {
+		t.Fatal("order with no attempts left is not stuck")
+	}
+	if due, _ := s.DueProvisioningOrders(time.Now().Add(24 * time.Hour)); len(due) != 0 {
+		t.Fatalf("stuck order is still retried: %d due", len(due))
+	}
+	if queued, _ := s.ListProvisioningOrders(); len(queued) != 1 || queued[0].Id != order.Id {
+		t.Fatalf("provisioning queue = %+v, want the stuck order", queued)
+	}
+
+	stored.ClientEmail = "shop-3001"
+	if err := s.SetOrderProvisioned(stored); err != nil {
+		t.Fatalf("provision queued order: %v", err)
+	}
+	if got, _ := s.GetOrder(order.Id); got.Status != OrderStatusApproved || got.ProvisionError != "" {
+		t.Fatalf("after manual retry = %s, error %q", got.Status, got.ProvisionError)
+	}
+	if err := s.QueueProvisioning(stored, errors.New("late failure")); err == nil {
+		t.Fatal("queued an approved order")
+	}
+}
+
+func TestProvisionClaim(t *testing.T) {
+	newShopTestDB(t)
+	db := database.GetShopDB()
+	order := &model.ShopOrder{TelegramId: 4310, InboundId: 1, Price: 100, Status: OrderStatusPendingReview}
+	if err := db.Create(order).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	release, err := claimProvision(order.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claimProvision(order.Id); !errors.Is(err, ErrProvisionBusy) {
+		t.Fatalf("second claim in this panel: %v, want ErrProvisionBusy", err)
+	}
+	// Another panel on the same shop database only sees the claim stored there.
+	provisioningOrders.Delete(order.Id)
+	if _, err := claimProvision(order.Id); !errors.Is(err, ErrProvisionBusy) {
+		t.Fatalf("claim of another panel: %v, want ErrProvisionBusy", err)
+	}
+	release()
+	release, err = claimProvision(order.Id)
+	if err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+	release()
+
+	// A claim left behind by a panel that stopped expires.
+	if err := db.Model(order).UpdateColumn("provision_claimed_at", time.Now().Add(-2*shopProvisionClaimTTL)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if release, err := claimProvision(order.Id); err != nil {
+		t.Fatalf("claim after an expired claim: %v", err)
+	} else {
+		release()
+	}
+	if _, err := claimProvision(order.Id + 100); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("claim of a missing order: %v", err)
+	}
+}
+
+func TestImportOrdersCSV(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	pkg := newTestPackage("monthly")
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	file := fmt.Sprintf("buyer,package,amount,date,email\n"+
+		"4301,%[1]d,100,2026-01-02,\n"+
+		"4301,%[1]d,100,2026-01-02,\n"+
+		"4302,%[1]d,100,2026-01-02,\n", pkg.Id)
+
+	result, err := s.ImportOrdersCSV(strings.NewReader(file))
+	if err != nil || result.Imported != 3 || result.Skipped != 0 || len(result.Errors) != 0 {
+		t.Fatalf("import = %+v, %v; want the identical sales kept apart", result, err)
+	}
+	result, err = s.ImportOrdersCSV(strings.NewReader(file))
+	if err != nil || result.Imported != 0 || result.Skipped != 3 {
+		t.Fatalf("second import = %+v, %v; want every row skipped", result, err)
+	}
+
+	withIds := fmt.Sprintf("id,buyer,package,amount,date,email\n"+
+		"a1,4303,%[1]d,100,2026-01-02,\n"+
+		"a2,4303,%[1]d,100,2026-01-02,\n", pkg.Id)
+	if result, err := s.ImportOrdersCSV(strings.NewReader(withIds)); err != nil || result.Imported != 2 {
+		t.Fatalf("import with ids = %+v, %v", result, err)
+	}
+	if result, err := s.ImportOrdersCSV(strings.NewReader(withIds)); err != nil || result.Skipped != 2 {
+		t.Fatalf("second import with ids = %+v, %v", result, err)
+	}
+}
+
+func TestBulkOrders(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	pkg := newTestPackage("seat")
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	pooled := newTestPackage("family")
+	pooled.Type = PackageTypePooled
+	pooled.Devices = 3
+	if err := s.CreatePackage(pooled); err != nil {
+		t.Fatal(err)
+	}
+
+	order := &model.ShopOrder{InboundId: 1, PackageId: &pkg.Id, Seats: 3, ContactEmail: "it@example.com"}
+	if err := s.CreateBulkOrder(order); err != nil {
+		t.Fatalf("create bulk order: %v", err)
+	}
+	if order.Status != OrderStatusPendingReview || order.Price != 3*pkg.Price {
+		t.Fatalf("bulk order = %s at %d, want pending review at %d", order.Status, order.Price, 3*pkg.Price)
+	}
+	for name, bad := range map[string]*model.ShopOrder{
+		"one seat":        {InboundId: 1, PackageId: &pkg.Id, Seats: 1},
+		"pooled package":  {InboundId: 1, PackageId: &pooled.Id, Seats: 3},
+		"no inbound":      {PackageId: &pkg.Id, Seats: 3},
+		"no custom value": {InboundId: 1, Seats: 3},
+	} {
+		if _, ok := AsValidationError(s.CreateBulkOrder(bad)); !ok {
+			t.Errorf("%s: want a validation error", name)
+		}
+	}
+
+	order.ClientEmail = "a"
+	order.ClientEmails = "a,b,c"
+	for _, email := range []string{"a", "b", "c"} {
+		order.Clients = append(order.Clients, model.ShopOrderClient{Email: email, SubId: "sub-" + email})
+	}
+	if err := s.SetOrderProvisioned(order); err != nil {
+		t.Fatalf("provision: %v", err)
+	}
+	clients, err := s.ListOrderClients(order)
+	if err != nil || len(clients) != 3 || clients[2].SubId != "sub-c" {
+		t.Fatalf("clients = %+v, %v; want the 3 provisioned clients", clients, err)
+	}
+
+	// Orders provisioned before clients were recorded fall back to the order.
+	legacy := &model.ShopOrder{Id: 999, ClientEmail: "old", ClientSubId: "old-sub"}
+	if clients, _ := s.ListOrderClients(legacy); len(clients) != 1 || clients[0].SubId != "old-sub" {
+		t.Fatalf("legacy clients = %+v", clients)
+	}
+
+	data, err := ShopClientLinksCSV([]ShopClientLink{{Email: "a", SubId: "s", Url: "https://sub/s"}})
+	if err != nil || string(data) != "email,sub_id,subscription_url\na,s,https://sub/s\n" {
+		t.Fatalf("csv = %q, %v", data, err)
+	}
+}
+
+func TestCartOrders(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	basic := newTestPackage("basic")
+	if err := s.CreatePackage(basic); err != nil {
+		t.Fatal(err)
+	}
+	pro := newTestPackage("pro")
+	pro.Price = 25000
+	if err := s.CreatePackage(pro); err != nil {
+		t.Fatal(err)
+	}
+	monthly := newTestPackage("monthly")
+	monthly.BillingCycle = BillingCycleMonthly
+	if err := s.CreatePackage(monthly); err != nil {
+		t.Fatal(err)
+	}
+
+	order := &model.ShopOrder{TelegramId: 4100, InboundId: 1, Status: OrderStatusPendingReceipt}
+	if err := s.CreateCartOrder(order, []int{basic.Id, pro.Id, basic.Id}); err != nil {
+		t.Fatalf("create cart order: %v", err)
+	}
+	if order.ItemCount != 3 || order.Price != 2*basic.Price+pro.Price || order.PackageId != nil {
+		t.Fatalf("cart order = %d items at %d, want 3 items at %d", order.ItemCount, order.Price, 2*basic.Price+pro.Price)
+	}
+	items, err := s.ListOrderItems(order.Id)
+	if err != nil || len(items) != 3 || items[1].PackageId != pro.Id || items[1].Price != pro.Price {
+		t.Fatalf("items = %+v, %v", items, err)
+	}
+	if names, _ := s.OrderItemNames(order.Id); strings.Join(names, ",") != "basic,pro,basic 2" {
+		t.Fatalf("item names = %v", names)
+	}
+
+	for name, ids := range map[string][]int{
+		"empty cart":        nil,
+		"recurring package": {basic.Id, monthly.Id},
+		"unknown package":   {999},
+		"too many items":    make([]int, ShopCartMaxItems+1),
+	} {
+		bad := &model.ShopOrder{TelegramId: 4101, InboundId: 1, Status: OrderStatusPendingReceipt}
+		if _, ok := AsValidationError(s.CreateCartOrder(bad, ids)); !ok {
+			t.Errorf("%s: want a validation error", name)
+		}
+	}
+
+	items[0].ClientEmail = "cart-1"
+	if err := s.SetOrderItemProvisioned(&items[0]); err != nil {
+		t.Fatal(err)
+	}
+	items, _ = s.ListOrderItems(order.Id)
+	if items[0].ProvisionedAt.IsZero() || items[0].ClientEmail != "cart-1" || !items[1].ProvisionedAt.IsZero() {
+		t.Fatalf("provisioned items = %+v", items)
+	}
+	if emails, _, err := s.takenClientNames(); err != nil || !emails["cart-1"] {
+		t.Fatalf("cart item email not taken: %v", err)
+	}
+}
+
+func TestCartReminders(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	now := time.Now()
+	newOrder := func(tgId int64, age time.Duration) *model.ShopOrder {
+		order := &model.ShopOrder{TelegramId: tgId, InboundId: 1, CustomDataGB: 1, CustomDays: 1, Status: OrderStatusPendingReceipt}
+		if err := s.CreateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		database.GetShopDB().Model(order).Update("created_at", now.Add(-age))
+		return order
+	}
+	due := newOrder(4200, 2*time.Hour)
+	newOrder(4201, 10*time.Minute)
+	newOrder(4202, 3*24*time.Hour)
+	renewal := newOrder(4203, 2*time.Hour)
+	database.GetShopDB().Model(renewal).Update("subscription_id", 7)
+
+	orders, err := s.DueCartReminders(now, time.Hour)
+	if err != nil || len(orders) != 1 || orders[0].Id != due.Id {
+		t.Fatalf("due reminders = %+v, %v; want order %d", orders, err, due.Id)
+	}
+	if marked, err := s.MarkCartReminded(&orders[0]); !marked || err != nil {
+		t.Fatalf("mark reminded = %v, %v", marked, err)
+	}
+	if marked, _ := s.MarkCartReminded(&orders[0]); marked {
+		t.Fatal("order reminded twice")
+	}
+	if orders, _ := s.DueCartReminders(now, time.Hour); len(orders) != 0 {
+		t.Fatalf("reminded order is due again: %+v", orders)
+	}
+
+	if sent, recovered, err := s.CartReminderStats(); err != nil || sent != 1 || recovered != 0 {
+		t.Fatalf("stats = %d/%d, %v; want 1 sent, 0 recovered", sent, recovered, err)
+	}
+	if err := s.UpdateOrderReceipt(due.Id, "receipt.jpg", ""); err != nil {
+		t.Fatal(err)
+	}
+	if sent, recovered, _ := s.CartReminderStats(); sent != 1 || recovered != 1 {
+		t.Fatalf("stats = %d/%d; want the reminded order recovered", sent, recovered)
+	}
+}
+
+func TestCustomerProfiles(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	if banned, err := s.TrackCustomer(4300, "alice", "Alice"); banned || err != nil {
+		t.Fatalf("track = %v, %v", banned, err)
+	}
+	order := &model.ShopOrder{TelegramId: 4300, InboundId: 1, CustomDataGB: 1, CustomDays: 1, Price: 500, Status: OrderStatusPendingReview}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	order.ClientEmail = "alice-1"
+	if err := s.SetOrderProvisioned(order); err != nil {
+		t.Fatal(err)
+	}
+	customer, err := s.GetCustomer(4300)
+	if err != nil || customer.Username != "alice" || customer.Spent != 500 || customer.FirstSeenAt.IsZero() {
+		t.Fatalf("customer = %+v, %v", customer, err)
+	}
+	var profile model.ShopCustomer
+	database.GetShopDB().First(&profile, "telegram_id = ?", 4300)
+	if profile.TotalSpent != 500 {
+		t.Fatalf("stored total spent = %d, want 500", profile.TotalSpent)
+	}
+
+	if _, ok := AsValidationError(s.SaveCustomer(&model.ShopCustomer{TelegramId: 4300, Language: "xx"})); !ok {
+		t.Fatal("unknown language accepted")
+	}
+	if err := s.SaveCustomer(&model.ShopCustomer{TelegramId: 4300, Banned: true, BanReason: "chargeback"}); err != nil {
+		t.Fatal(err)
+	}
+	if banned, _ := s.TrackCustomer(4300, "alice", "Alice"); !banned {
+		t.Fatal("ban not seen by the bot")
+	}
+	next := &model.ShopOrder{TelegramId: 4300, InboundId: 1, CustomDataGB: 1, CustomDays: 1, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(next); !errors.Is(err, ErrCustomerBanned) {
+		t.Fatalf("banned customer order = %v, want ErrCustomerBanned", err)
+	}
+	if err := s.SaveCustomer(&model.ShopCustomer{TelegramId: 4300}); err != nil || s.IsCustomerBanned(4300) {
+		t.Fatalf("unban = %v", err)
+	}
+
+	// Customers who never ordered are listed from their profile.
+	if err := s.SaveCustomer(&model.ShopCustomer{TelegramId: 4301, Language: "fa"}); err != nil {
+		t.Fatal(err)
+	}
+	if customer, err := s.GetCustomer(4301); err != nil || customer.Language != "fa" || customer.OrderCount != 0 {
+		t.Fatalf("profile-only customer = %+v, %v", customer, err)
+	}
+	if err := s.DeleteCustomer(4301); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetCustomer(4301); err == nil {
+		t.Fatal("deleted customer still listed")
+	}
+}
+
+func TestCustomerSegments(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	basic := newTestPackage("basic")
+	if err := s.CreatePackage(basic); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	buy := func(tgId int64, pkg *model.ShopPackage, price int64, email string, expiry time.Time) {
+		t.Helper()
+		order := &model.ShopOrder{TelegramId: tgId, InboundId: 1, Price: price, Status: OrderStatusPendingReview}
+		if pkg != nil {
+			order.PackageId = &pkg.Id
+		} else {
+			order.CustomDataGB, order.CustomDays = 1, 1
+		}
+		if err := s.CreateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		order.ClientEmail = email
+		if err := s.SetOrderProvisioned(order); err != nil {
+			t.Fatal(err)
+		}
+		traffic := &xray.ClientTraffic{InboundId: 1, Email: email, Enable: true, ExpiryTime: expiry.UnixMilli()}
+		if err := database.GetDB().Create(traffic).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	buy(5100, basic, 100, "seg-basic", now.AddDate(0, 0, -5))
+	buy(5101, nil, 90000, "seg-big", now.AddDate(0, 0, 20))
+	buy(5102, nil, 500, "seg-old", now.AddDate(0, 0, -60))
+	if err := s.SaveCustomer(&model.ShopCustomer{TelegramId: 5103}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := AsValidationError(s.SaveSegment(&model.ShopSegment{Name: "rich", Kind: SegmentKindHighSpenders})); !ok {
+		t.Fatal("high spenders segment without a minimum accepted")
+	}
+	if _, ok := AsValidationError(s.SaveSegment(&model.ShopSegment{Name: "odd", Kind: "vip"})); !ok {
+		t.Fatal("unknown segment kind accepted")
+	}
+	cases := []struct {
+		segment model.ShopSegment
+		want    []int64
+	}{
+		{model.ShopSegment{Name: "rich", Kind: SegmentKindHighSpenders, MinSpent: 50000}, []int64{5101}},
+		{model.ShopSegment{Name: "lapsed", Kind: SegmentKindRecentlyExpired}, []int64{5100}},
+		{model.ShopSegment{Name: "lurkers", Kind: SegmentKindNeverPurchased}, []int64{5103}},
+		{model.ShopSegment{Name: "basic buyers", Kind: SegmentKindPackageBuyers, PackageId: basic.Id}, []int64{5100}},
+	}
+	for _, tc := range cases {
+		segment := tc.segment
+		if err := s.SaveSegment(&segment); err != nil {
+			t.Fatalf("%s: %v", segment.Name, err)
+		}
+		got, err := s.BroadcastRecipients(SegmentBroadcastName(segment.Id))
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Fatalf("%s recipients = %v, %v; want %v", segment.Name, got, err, tc.want)
+		}
+	}
+	if segment, _ := s.GetSegment(2); segment.Days != defaultSegmentDays {
+		t.Fatalf("recently expired days = %d, want %d", segment.Days, defaultSegmentDays)
+	}
+
+	customers, err := s.SegmentCustomers(&cases[0].segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ShopCustomersCSV(customers, "USD")
+	if err != nil || !strings.Contains(string(data), "\n5101,,,,1,1,900.00,") {
+		t.Fatalf("csv = %q, %v", data, err)
+	}
+}
+
+func TestDeepLinks(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	pkg := newTestPackage("basic")
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"", "hello", "pkg_abc", "pkg_05", "pkg_999", "ref_", "ref_a b"} {
+		if _, err := s.RecordDeepLinkClick(5200, payload); !errors.Is(err, ErrInvalidDeepLink) {
+			t.Fatalf("payload %q = %v, want ErrInvalidDeepLink", payload, err)
+		}
+	}
+
+	pkgLink := "pkg_" + strconv.Itoa(pkg.Id)
+	target, err := s.RecordDeepLinkClick(5200, pkgLink)
+	if err != nil || target.PackageId != pkg.Id {
+		t.Fatalf("package link = %+v, %v", target, err)
+	}
+	if _, err := s.RecordDeepLinkClick(5201, "ref_summer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RecordDeepLinkClick(5201, "ref_winter"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RecordDeepLinkClick(5202, pkgLink); err != nil {
+		t.Fatal(err)
+	}
+	var profile model.ShopCustomer
+	database.GetShopDB().First(&profile, "telegram_id = ?", 5201)
+	if profile.ReferralCode != "summer" || profile.DeepLink != "ref_winter" {
+		t.Fatalf("referral = %q, last link = %q", profile.ReferralCode, profile.DeepLink)
+	}
+
+	order := &model.ShopOrder{TelegramId: 5200, InboundId: 1, PackageId: &pkg.Id, Price: pkg.Price, Status: OrderStatusPendingReview}
+	if err := s.CreateOrder(order); err != nil || order.DeepLink != pkgLink {
+		t.Fatalf("order deep link = %q, %v", order.DeepLink, err)
+	}
+	order.ClientEmail = "deep-1"
+	if err := s.SetOrderProvisioned(order); err != nil {
+		t.Fatal(err)
+	}
+	// Clicks older than the attribution window no longer credit orders.
+	database.GetShopDB().Model(&model.ShopCustomer{}).Where("telegram_id = ?", 5202).
+		Update("deep_link_at", time.Now().Add(-shopDeepLinkWindow-time.Hour))
+	late := &model.ShopOrder{TelegramId: 5202, InboundId: 1, PackageId: &pkg.Id, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(late); err != nil || late.DeepLink != "" {
+		t.Fatalf("late order deep link = %q, %v", late.DeepLink, err)
+	}
+
+	stats, err := s.DeepLinkStats()
+	if err != nil || len(stats) != 3 {
+		t.Fatalf("stats = %+v, %v", stats, err)
+	}
+	if got := stats[0]; got.Payload != pkgLink || got.Clicks != 2 || got.Orders != 1 || got.Conversions != 1 || got.Revenue != pkg.Price {
+		t.Fatalf("package link stats = %+v", got)
+	}
+	for _, stat := range stats[1:] {
+		if stat.ReferralCode == "summer" && stat.Customers != 1 || stat.ReferralCode == "winter" && stat.Customers != 0 {
+			t.Fatalf("referral stats = %+v", stat)
+		}
+	}
+}
+
+func TestCreateOrderRejectsInvalidAmounts(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	tests := []struct {
+		name  string
+		order model.ShopOrder
+		field string
+	}{
+		{"negative price", model.ShopOrder{CustomDataGB: 1, CustomDays: 1, Price: -5}, "price"},
+		{"custom without data", model.ShopOrder{CustomDays: 1}, "customDataGb"},
+		{"custom without days", model.ShopOrder{CustomDataGB: 1}, "customDays"},
+	}
+	for i, tt := range tests {
+		order := tt.order
+		order.TelegramId = int64(3000 + i)
+		order.Status = OrderStatusPendingReceipt
+		verr, ok := AsValidationError(s.CreateOrder(&order))
+		if !ok {
+			t.Errorf("%s: expected a validation error", tt.name)
+			continue
+		}
+		if _, ok := verr.Localize("en")[tt.field]; !ok {
+			t.Errorf("%s: fields = %v, want %s", tt.name, verr.Localize("en"), tt.field)
+		}
+	}
+	orders, _ := s.ListOrders()
+	if len(orders) != 0 {
+		t.Fatalf("orders = %d, want none saved", len(orders))
+	}
+}
+
+func TestVerifyCaptcha(t *testing.T) {
+	newShopTestDB(t)
+	var gotIP string
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIP = r.PostFormValue("remoteip")
+		if r.PostFormValue("secret") == "secret" && r.PostFormValue("response") == "solved" {
+			w.Write([]byte(`{"success":true}`))
+			return
+		}
+		w.Write([]byte(`{"success":false,"error-codes":["invalid-input-response"]}`))
+	}))
+	defer provider.Close()
+	defer func(url string) { shopCaptchaVerifyURLs[CaptchaProviderTurnstile] = url }(shopCaptchaVerifyURLs[CaptchaProviderTurnstile])
+	shopCaptchaVerifyURLs[CaptchaProviderTurnstile] = provider.URL
+
+	s := &ShopService{}
+	ctx := context.Background()
+	if err := s.VerifyCaptcha(ctx, "", "203.0.113.7"); err != nil {
+		t.Fatalf("captcha off: %v", err)
+	}
+	setShopSetting(t, "shopCaptchaProvider", CaptchaProviderTurnstile)
+	if config := s.CaptchaConfig(); config.Provider != "" {
+		t.Fatalf("captcha on without a secret key: %+v", config)
+	}
+	setShopSetting(t, "shopCaptchaSecret", "secret")
+	setShopSetting(t, "shopCaptchaSiteKey", "site")
+	if config := s.CaptchaConfig(); config.Provider != CaptchaProviderTurnstile || config.SiteKey != "site" {
+		t.Fatalf("captcha config = %+v", config)
+	}
+
+	if err := s.VerifyCaptcha(ctx, "", "203.0.113.7"); !errors.Is(err, ErrCaptchaRequired) {
+		t.Fatalf("missing token: %v, want ErrCaptchaRequired", err)
+	}
+	if err := s.VerifyCaptcha(ctx, "forged", "203.0.113.7"); !errors.Is(err, ErrCaptchaFailed) {
+		t.Fatalf("rejected token: %v, want ErrCaptchaFailed", err)
+	}
+	if err := s.VerifyCaptcha(ctx, "solved", "203.0.113.7"); err != nil || gotIP != "203.0.113.7" {
+		t.Fatalf("solved token: %v, remote ip %q", err, gotIP)
+	}
+}
+
+func TestDuplicateOrderReused(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	pkg := newTestPackage("Starter")
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	newOrder := func(tgId int64) *model.ShopOrder {
+		return &model.ShopOrder{TelegramId: tgId, InboundId: 1, PackageId: &pkg.Id, Price: pkg.Price, Status: OrderStatusPendingReceipt}
+	}
+
+	first := newOrder(1001)
+	if err := s.CreateOrder(first); err != nil {
+		t.Fatal(err)
+	}
+	again := newOrder(1001)
+	if err := s.CreateOrder(again); err != nil || again.Id != first.Id {
+		t.Fatalf("repeated order = #%d, %v; want existing #%d", again.Id, err, first.Id)
+	}
+	if other := newOrder(1002); s.CreateOrder(other) != nil || other.Id == first.Id {
+		t.Fatal("another customer's order was merged")
+	}
+
+	if err := s.UpdateOrderReceipt(first.Id, "/tmp/receipt.jpg", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if next := newOrder(1001); s.CreateOrder(next) != nil || next.Id == first.Id {
+		t.Fatal("order with a receipt was reused")
+	}
+
+	setShopSetting(t, "shopDuplicateOrderMinutes", "0")
+	a, b := newOrder(1003), newOrder(1003)
+	if s.CreateOrder(a) != nil || s.CreateOrder(b) != nil || a.Id == b.Id {
+		t.Fatal("duplicate window of 0 still reused the order")
+	}
+}
+
+func isValidationError(err error) bool {
+	_, ok := AsValidationError(err)
+	return ok
+}
+
+func TestOrderWorkflow(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	if err := s.SaveOrderStatus(&model.ShopOrderStatus{Code: OrderStatusApproved, Label: "Approved"}); !isValidationError(err) {
+		t.Fatalf("built-in code: %v, want validation error", err)
+	}
+	if err := s.SaveOrderStatus(&model.ShopOrderStatus{Code: "NEEDS_INFO", Label: "Needs info", To: []string{OrderStatusApproved}}); !isValidationError(err) {
+		t.Fatalf("transition to approval: %v, want validation error", err)
+	}
+	info := &model.ShopOrderStatus{
+		Code: "NEEDS_INFO", Label: "Needs info", Color: "orange", NotifyCustomer: true,
+		From: []string{OrderStatusPendingReview}, To: []string{OrderStatusPendingReview},
+	}
+	if err := s.SaveOrderStatus(info); err != nil {
+		t.Fatal(err)
+	}
+	stock := &model.ShopOrderStatus{Code: "AWAITING_STOCK", Label: "Awaiting stock", From: []string{"NEEDS_INFO"}}
+	if err := s.SaveOrderStatus(stock); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := s.ListOrderStatuses()
+	if err != nil || len(statuses) != 2 || statuses[1].Code != "NEEDS_INFO" || !slices.Equal(statuses[1].To, []string{"AWAITING_STOCK", OrderStatusPendingReview}) {
+		t.Fatalf("statuses = %+v, %v", statuses, err)
+	}
+
+	order := &model.ShopOrder{TelegramId: 1001, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 50, Status: OrderStatusPendingReview}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.TransitionOrder(order.Id, "AWAITING_STOCK"); !errors.Is(err, ErrTransitionNotAllowed) {
+		t.Fatalf("skipping ON_HOLD: %v, want ErrTransitionNotAllowed", err)
+	}
+	moved, status, err := s.TransitionOrder(order.Id, "NEEDS_INFO")
+	if err != nil || moved.Status != "NEEDS_INFO" || status == nil || !status.NotifyCustomer {
+		t.Fatalf("move order: %+v, %+v, %v", moved, status, err)
+	}
+	if err := s.DeleteOrderStatus(info.Id); !errors.Is(err, ErrOrderStatusInUse) {
+		t.Fatalf("delete status in use: %v, want ErrOrderStatusInUse", err)
+	}
+	if _, status, err := s.TransitionOrder(order.Id, OrderStatusPendingReview); err != nil || status != nil {
+		t.Fatalf("back to review: %+v, %v", status, err)
+	}
+
+	if err := s.DeleteOrderStatus(info.Id); err != nil {
+		t.Fatal(err)
+	}
+	if statuses, _ := s.ListOrderStatuses(); len(statuses) != 1 || len(statuses[0].From) != 0 {
+		t.Fatalf("transitions of a deleted status kept: %+v", statuses)
+	}
+}
+
+func TestScheduleOrder(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	order := &model.ShopOrder{TelegramId: 3101, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 50, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(48 * time.Hour)
+	if _, err := s.ScheduleOrder(order.Id, at); err == nil {
+		t.Fatal("scheduled an order without a receipt")
+	}
+	if err := s.UpdateOrderReceipt(order.Id, "", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ScheduleOrder(order.Id, time.Now().Add(-time.Minute)); err == nil {
+		t.Fatal("scheduled an order in the past")
+	}
+	scheduled, err := s.ScheduleOrder(order.Id, at)
+	if err != nil || scheduled.Status != OrderStatusScheduled || !scheduled.ScheduledAt.Equal(at) {
+		t.Fatalf("scheduled order = %+v, %v", scheduled, err)
+	}
+	if due, _ := s.DueScheduledOrders(time.Now()); len(due) != 0 {
+		t.Fatalf("due before its time = %d orders, want none", len(due))
+	}
+	if due, _ := s.DueScheduledOrders(at.Add(time.Second)); len(due) != 1 || due[0].Id != order.Id {
+		t.Fatalf("due at its time = %+v, want the scheduled order", due)
+	}
+
+	scheduled.ClientEmail = "shop-3101"
+	if err := s.SetOrderProvisioned(scheduled); err != nil {
+		t.Fatalf("provision scheduled order: %v", err)
+	}
+	if got, _ := s.GetOrder(order.Id); got.Status != OrderStatusApproved {
+		t.Fatalf("status after provisioning = %s, want %s", got.Status, OrderStatusApproved)
+	}
+}
+
+func TestOrderPriceOverride(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	order := &model.ShopOrder{TelegramId: 3201, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 500, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.OverrideOrderPrice(order.Id, 450, "paid less"); err == nil {
+		t.Fatal("overrode the price of an order without a receipt")
+	}
+	if err := s.UpdateOrderReceipt(order.Id, "", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.OverrideOrderPrice(order.Id, 450, " "); !isValidationError(err) {
+		t.Fatalf("override without a note: err = %v, want a validation error", err)
+	}
+	if _, err := s.OverrideOrderPrice(order.Id, 450, "paid 50 less"); err != nil {
+		t.Fatal(err)
+	}
+	overridden, err := s.OverrideOrderPrice(order.Id, 480, "paid 20 less")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := s.GetOrder(order.Id)
+	if got.Price != 480 || got.OriginalPrice != 500 || got.PriceNote != "paid 20 less" || overridden.OriginalPrice != 500 {
+		t.Fatalf("overridden order = price %d, original %d, note %q", got.Price, got.OriginalPrice, got.PriceNote)
+	}
+
+	got.ClientEmail = "shop-3201"
+	if err := s.SetOrderProvisioned(got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.OverrideOrderPrice(order.Id, 400, "refund"); err == nil {
+		t.Fatal("overrode the price of an approved order")
+	}
+}
+
+func TestOrderInstallments(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	order := &model.ShopOrder{TelegramId: 3301, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 1000, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateOrderReceipt(order.Id, "", "file"); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range []int64{0, 1001} {
+		if _, _, err := s.RecordOrderPayment(order.Id, amount, "", "admin"); !isValidationError(err) {
+			t.Fatalf("payment of %d: err = %v, want a validation error", amount, err)
+		}
+	}
+
+	paid, _, err := s.RecordOrderPayment(order.Id, 400, "first half", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paid.PaidAmount != 400 || OrderBalance(paid) != 600 || paid.Status != OrderStatusPendingReceipt {
+		t.Fatalf("after first installment: paid %d, balance %d, status %s", paid.PaidAmount, OrderBalance(paid), paid.Status)
+	}
+	if err := s.CheckOrderPaid(paid); !errors.Is(err, ErrOrderNotFullyPaid) {
+		t.Fatalf("check partially paid order: err = %v, want %v", err, ErrOrderNotFullyPaid)
+	}
+
+	setShopSetting(t, "shopPartialProvision", "true")
+	if err := s.CheckOrderPaid(paid); err != nil {
+		t.Fatalf("check partially paid order with partial provisioning: %v", err)
+	}
+	if withheld := WithheldData(paid, 10); withheld != 6 {
+		t.Fatalf("withheld data = %d GB, want 6", withheld)
+	}
+
+	paid, _, err = s.RecordOrderPayment(order.Id, 600, "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if OrderBalance(paid) != 0 || WithheldData(paid, 10) != 0 {
+		t.Fatalf("fully paid order: balance %d, withheld %d", OrderBalance(paid), WithheldData(paid, 10))
+	}
+	if payments, _ := s.ListOrderPayments(order.Id); len(payments) != 2 || payments[0].Note != "first half" {
+		t.Fatalf("payments = %+v", payments)
+	}
+}
+
+func TestReconcileStatement(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	price := func(text string) int64 {
+		amount, err := ParsePrice(text, s.Currency().Code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return amount
+	}
+
+	newOrder := func(tgId int64, amount int64) *model.ShopOrder {
+		order := &model.ShopOrder{TelegramId: tgId, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: amount, Status: OrderStatusPendingReceipt}
+		if err := s.CreateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		return order
+	}
+	byAmount := newOrder(3401, price("500"))
+	byOcr := newOrder(3402, price("500"))
+	byId := newOrder(3403, price("700"))
+	if err := s.UpdateOrderReceipt(byOcr.Id, "", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateOrder(&model.ShopOrder{Id: byOcr.Id, OcrReference: "TRX123"}); err != nil {
+		t.Fatal(err)
+	}
+
+	statement := "Date,Description,Amount\n" +
+		"2026-10-01,Transfer TRX123,500\n" +
+		"2026-10-01,Transfer,500\n" +
+		"2026-10-02,Bank fee,-2\n" +
+		fmt.Sprintf("2026-10-02,Payment for order #%d,700\n", byId.Id) +
+		"2026-10-03,Unknown,999\n" +
+		"2026-10-03,Broken,abc\n"
+	result, err := s.ReconcileStatementCSV(strings.NewReader(statement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		orderId int
+		match   string
+	}{{byOcr.Id, StatementMatchReference}, {byAmount.Id, StatementMatchAmount}, {byId.Id, StatementMatchReference}}
+	if len(result.Matches) != len(want) {
+		t.Fatalf("matches = %+v, want %d", result.Matches, len(want))
+	}
+	for i, w := range want {
+		if got := result.Matches[i]; got.OrderId != w.orderId || got.Match != w.match {
+			t.Fatalf("match %d = order %d by %s, want order %d by %s", i, got.OrderId, got.Match, w.orderId, w.match)
+		}
+	}
+	if result.Unmatched != 1 || result.Skipped != 1 || len(result.Errors) != 1 {
+		t.Fatalf("unmatched %d, skipped %d, errors %v", result.Unmatched, result.Skipped, result.Errors)
+	}
+
+	confirmed, err := s.ConfirmStatementPayment(byAmount.Id, "bank-1")
+	if err != nil || confirmed.Status != OrderStatusPendingReview || confirmed.OcrReference != "bank-1" {
+		t.Fatalf("confirmed order = %+v, %v", confirmed, err)
+	}
+}
+
+func TestAmountCodes(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	setShopSetting(t, "shopAmountCodeMax", "2")
+
+	var orders []*model.ShopOrder
+	for i := range 3 {
+		order := &model.ShopOrder{TelegramId: int64(3501 + i), InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 1000, Status: OrderStatusPendingReceipt}
+		if err := s.CreateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		orders = append(orders, order)
+	}
+	for i, want := range []int64{1, 2, 0} {
+		if orders[i].AmountCode != want || orders[i].Price != 1000+want {
+			t.Fatalf("order %d: code %d, price %d, want code %d", i, orders[i].AmountCode, orders[i].Price, want)
+		}
+	}
+
+	again := &model.ShopOrder{TelegramId: 3501, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 1000, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(again); err != nil {
+		t.Fatal(err)
+	}
+	if again.Id != orders[0].Id {
+		t.Fatalf("repeated order got id %d, want the duplicate %d", again.Id, orders[0].Id)
+	}
+
+	exponent := CurrencyExponent(s.Currency().Code)
+	amount := strconv.FormatFloat(float64(orders[1].Price)/float64(minorUnitScale(exponent)), 'f', exponent, 64)
+	statement := "amount,reference\n" + amount + ",transfer\n"
+	result, err := s.ReconcileStatementCSV(strings.NewReader(statement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Matches) != 1 || result.Matches[0].OrderId != orders[1].Id || result.Matches[0].Match != StatementMatchCode {
+		t.Fatalf("matches = %+v, want order %d by code", result.Matches, orders[1].Id)
+	}
+}
+
+func TestHoldOrder(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	order := &model.ShopOrder{TelegramId: 3601, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 100, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateOrderReceipt(order.Id, "", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.HoldOrder(order.Id, " "); !isValidationError(err) {
+		t.Fatalf("hold without a reason: err = %v, want a validation error", err)
+	}
+	held, err := s.HoldOrder(order.Id, "receipt is blurry")
+	if err != nil || held.Status != OrderStatusOnHold || held.HeldFromStatus != OrderStatusPendingReview {
+		t.Fatalf("held order = %+v, %v", held, err)
+	}
+	if _, err := s.HoldOrder(order.Id, "again"); err == nil {
+		t.Fatal("held an order already on hold")
+	}
+
+	resumed, err := s.AnswerHeldOrder(order.Id, "buyer", "here is a clearer one")
+	if err != nil || resumed.Status != OrderStatusPendingReview || resumed.HoldReason != "" {
+		t.Fatalf("resumed order = %+v, %v", resumed, err)
+	}
+	if comments, _ := s.ListOrderComments(order.Id); len(comments) != 1 || comments[0].Author != "buyer" {
+		t.Fatalf("comments = %+v, want the customer's answer", comments)
+	}
+	if _, err := s.ResumeOrder(order.Id); err == nil {
+		t.Fatal("resumed an order not on hold")
+	}
+}
+
+func TestOrderNumbers(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	pattern := regexp.MustCompile(fmt.Sprintf(`^ORD-%d-\d{6}$`, time.Now().Year()))
+	seen := map[string]bool{}
+	for i := range 5 {
+		order := &model.ShopOrder{TelegramId: int64(3701 + i), InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 100, Status: OrderStatusPendingReceipt}
+		if err := s.CreateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		if !pattern.MatchString(order.Number) || seen[order.Number] {
+			t.Fatalf("order %d got number %q", order.Id, order.Number)
+		}
+		seen[order.Number] = true
+		if OrderNumber(order) != order.Number {
+			t.Fatalf("OrderNumber = %q, want %q", OrderNumber(order), order.Number)
+		}
+	}
+	if got := OrderNumber(&model.ShopOrder{Id: 42}); got != "#42" {
+		t.Fatalf("OrderNumber without a number = %q, want #42", got)
+	}
+
+	order := &model.ShopOrder{TelegramId: 3710, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 1000, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	exponent := CurrencyExponent(s.Currency().Code)
+	amount := strconv.FormatFloat(float64(order.Price)/float64(minorUnitScale(exponent)), 'f', exponent, 64)
+	statement := "amount,reference\n" + amount + ",payment " + strings.ToLower(order.Number) + "\n"
+	result, err := s.ReconcileStatementCSV(strings.NewReader(statement))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Matches) != 1 || result.Matches[0].OrderId != order.Id || result.Matches[0].Match != StatementMatchReference {
+		t.Fatalf("matches = %+v, want order %d by reference", result.Matches, order.Id)
+	}
+}
+
+func TestReceiptDeadline(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	now := time.Now()
+	deadline := 2 * time.Hour
+
+	place := func(age time.Duration, subscriptionId int) *model.ShopOrder {
+		order := &model.ShopOrder{TelegramId: 3901, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 100,
+			Status: OrderStatusPendingReceipt, SubscriptionId: subscriptionId, CreatedAt: now.Add(-age)}
+		if err := database.GetShopDB().Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+		return order
+	}
+	fresh := place(30*time.Minute, 0)
+	halfway := place(70*time.Minute, 0)
+	overdue := place(130*time.Minute, 0)
+	renewal := place(130*time.Minute, 1)
+
+	if !s.ReceiptDeadline(fresh).IsZero() {
+		t.Fatal("deadline set while the setting is off")
+	}
+	setShopSetting(t, "shopReceiptDeadlineMinutes", "120")
+	if got := s.ReceiptDeadline(fresh); !got.Equal(fresh.CreatedAt.Add(deadline)) {
+		t.Fatalf("ReceiptDeadline = %v, want %v", got, fresh.CreatedAt.Add(deadline))
+	}
+	if !s.ReceiptDeadline(renewal).IsZero() {
+		t.Fatal("renewal order got a receipt deadline")
+	}
+
+	due, err := s.DueDeadlineWarnings(now, deadline)
+	if err != nil || len(due) != 1 || due[0].Id != halfway.Id {
+		t.Fatalf("due warnings = %+v, %v, want order %d", due, err, halfway.Id)
+	}
+	if marked, err := s.MarkDeadlineWarned(&due[0]); !marked || err != nil {
+		t.Fatalf("MarkDeadlineWarned = %v, %v", marked, err)
+	}
+	if due, _ := s.DueDeadlineWarnings(now, deadline); len(due) != 0 {
+		t.Fatalf("warned order is due again: %+v", due)
+	}
+
+	cancelled, err := s.CancelOverdueOrders(now, deadline)
+	if err != nil || len(cancelled) != 1 || cancelled[0].Id != overdue.Id {
+		t.Fatalf("cancelled = %+v, %v, want order %d", cancelled, err, overdue.Id)
+	}
+	for _, want := range []struct {
+		order  *model.ShopOrder
+		status string
+	}{{fresh, OrderStatusPendingReceipt}, {halfway, OrderStatusPendingReceipt}, {overdue, OrderStatusRejected}, {renewal, OrderStatusPendingReceipt}} {
+		if order, _ := s.GetOrder(want.order.Id); order.Status != want.status {
+			t.Fatalf("order %d status = %s, want %s", order.Id, order.Status, want.status)
+		}
+	}
+}
+
+func TestTgInvoice(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	scale := minorUnitScale(CurrencyExponent(s.Currency().Code))
+
+	order := &model.ShopOrder{TelegramId: 4001, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 12 * scale, Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TgInvoice(order); err == nil {
+		t.Fatal("got an invoice while in-bot payments are off")
+	}
+
+	setShopSetting(t, "shopTgPayments", TgPaymentStars)
+	setShopSetting(t, "shopStarsPerUnit", "2.01")
+	invoice, err := s.TgInvoice(order)
+	if err != nil || invoice.Currency != "XTR" || invoice.Amount != 25 || invoice.ProviderToken != "" {
+		t.Fatalf("stars invoice = %+v, %v, want 25 XTR", invoice, err)
+	}
+
+	if _, err := s.TgPaymentOrder(invoice.Payload, 4002); err == nil {
+		t.Fatal("another customer paid the order")
+	}
+	paid, err := s.TgPaymentOrder(invoice.Payload, 4001)
+	if err != nil || paid.Id != order.Id {
+		t.Fatalf("TgPaymentOrder = %+v, %v", paid, err)
+	}
+	if err := s.CheckTgPayment(paid, "XTR", 24); !errors.Is(err, ErrTgInvoiceMismatch) {
+		t.Fatalf("short payment: err = %v, want a mismatch", err)
+	}
+	if err := s.CheckTgPayment(paid, "XTR", 25); err != nil {
+		t.Fatal(err)
+	}
+
+	setShopSetting(t, "shopTgPayments", TgPaymentProvider)
+	setShopSetting(t, "shopTgProviderToken", "provider-token")
+	invoice, err = s.TgInvoice(order)
+	if err != nil || invoice.Currency != s.Currency().Code || int64(invoice.Amount) != order.Price || invoice.ProviderToken != "provider-token" {
+		t.Fatalf("provider invoice = %+v, %v", invoice, err)
+	}
+
+	confirmed, err := s.ConfirmTgPayment(paid, "charge-1")
+	if err != nil || confirmed.Status != OrderStatusPendingReview || confirmed.OcrReference != "telegram:charge-1" {
+		t.Fatalf("confirmed order = %+v, %v", confirmed, err)
+	}
+	if _, err := s.TgInvoice(confirmed); err == nil {
+		t.Fatal("got an invoice for a paid order")
+	}
+
+	settings := &entity.AllSetting{ShopTgPayments: TgPaymentStars, ShopStarsPerUnit: "free"}
+	if err := validateShopSettings(settings); !isValidationError(err) {
+		t.Fatalf("invalid Stars rate: err = %v, want a validation error", err)
+	}
+}
+
+func TestLightningPayments(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	created, paid := 0, false
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "invoice-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v1/payments":
+			created++
+			fmt.Fprintf(w, `{"payment_hash":"hash%d","payment_request":"lnbc%d"}`, created, created)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/payments/hash1":
+			fmt.Fprintf(w, `{"paid":%t}`, paid)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer node.Close()
+
+	order := &model.ShopOrder{TelegramId: 4101, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 3 * minorUnitScale(CurrencyExponent(s.Currency().Code)), Status: OrderStatusPendingReceipt}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.OrderLightningInvoice(order); err == nil {
+		t.Fatal("got a Lightning invoice while Lightning payments are off")
+	}
+	setShopSetting(t, "shopLightningBackend", "lnbits")
+	setShopSetting(t, "shopLightningUrl", node.URL)
+	setShopSetting(t, "shopLightningApiKey", "invoice-key")
+	setShopSetting(t, "shopSatsPerUnit", "1500")
+
+	invoiced, err := s.OrderLightningInvoice(order)
+	if err != nil || invoiced.LightningHash != "hash1" || invoiced.LightningInvoice != "lnbc1" || invoiced.LightningSats != 4500 {
+		t.Fatalf("invoiced order = %+v, %v", invoiced, err)
+	}
+	stored, _ := s.GetOrder(order.Id)
+	if _, err := s.OrderLightningInvoice(stored); err != nil || created != 1 {
+		t.Fatalf("asking again created %d invoices, err %v, want the open one reused", created, err)
+	}
+
+	if settled, err := s.SettledLightningOrders(); err != nil || len(settled) != 0 {
+		t.Fatalf("settled before payment = %+v, %v", settled, err)
+	}
+	paid = true
+	settled, err := s.SettledLightningOrders()
+	if err != nil || len(settled) != 1 || settled[0].Id != order.Id {
+		t.Fatalf("settled = %+v, %v, want order %d", settled, err, order.Id)
+	}
+	if settled[0].Status != OrderStatusPendingReview || settled[0].OcrReference != "lightning:hash1" {
+		t.Fatalf("settled order = %+v, want it under review with the payment hash", settled[0])
+	}
+}
+
+func TestPackagePaymentMethods(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	for _, dest := range []*model.ShopPaymentDestination{
+		{Name: "Bank", Kind: "card", Value: "6037990000000000", Enabled: true},
+		{Name: "USDT", Kind: "wallet", Value: "TXyz", Enabled: true},
+	} {
+		if err := s.SavePaymentDestination(dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setShopSetting(t, "shopTgPayments", TgPaymentStars)
+	setShopSetting(t, "shopStarsPerUnit", "1")
+
+	pkg := &model.ShopPackage{Name: "Crypto only", DataGB: 10, DurationDays: 30, Price: 100, IsActive: true, PaymentMethods: " Wallet, lightning,wallet"}
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	if pkg.PaymentMethods != "wallet,lightning" {
+		t.Fatalf("payment methods = %q, want them normalized", pkg.PaymentMethods)
+	}
+	pkgId := pkg.Id
+	restricted := &model.ShopOrder{TelegramId: 4301, InboundId: 1, PackageId: &pkgId, Price: 100, Status: OrderStatusPendingReceipt}
+	custom := &model.ShopOrder{TelegramId: 4301, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 100, Status: OrderStatusPendingReceipt}
+	for _, order := range []*model.ShopOrder{restricted, custom} {
+		if err := s.CreateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if dest, err := s.AssignPaymentDestination(restricted.Id); err != nil || dest == nil || dest.Kind != "wallet" {
+		t.Fatalf("restricted order destination = %+v, %v, want the wallet", dest, err)
+	}
+	if _, err := s.TgInvoice(restricted); err == nil {
+		t.Fatal("got a Telegram invoice for a package that does not accept one")
+	}
+	if dest, err := s.AssignPaymentDestination(custom.Id); err != nil || dest == nil || dest.Kind != "card" {
+		t.Fatalf("custom order destination = %+v, %v, want the card", dest, err)
+	}
+	if _, err := s.TgInvoice(custom); err != nil {
+		t.Fatalf("custom order invoice: %v", err)
+	}
+
+	pkg.PaymentMethods = "telegram"
+	if err := s.UpdatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	if dest, err := s.AssignPaymentDestination(restricted.Id); err != nil || dest != nil {
+		t.Fatalf("destination = %+v, %v, want none once the package only accepts Telegram", dest, err)
+	}
+}
+
+func TestChargebackOrder(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+
+	order := &model.ShopOrder{TelegramId: 4401, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 700, Status: OrderStatusApproved}
+	unpaid := &model.ShopOrder{TelegramId: 4401, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 300, Status: OrderStatusPendingReceipt}
+	for _, o := range []*model.ShopOrder{order, unpaid} {
+		if err := db.Create(o).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := &model.ShopSubscription{TelegramId: 4401, OrderId: order.Id, Status: SubscriptionStatusActive}
+	if err := db.Create(sub).Error; err != nil {
+		t.Fatal(err)
+	}
+	since := time.Now().Add(-time.Hour)
+
+	if _, _, err := s.ChargebackOrder(order.Id, " "); err == nil {
+		t.Fatal("recorded a chargeback without a reason")
+	}
+	if _, _, err := s.ChargebackOrder(unpaid.Id, "disputed"); err == nil {
+		t.Fatal("charged back an order that was never paid")
+	}
+	charged, _, err := s.ChargebackOrder(order.Id, "disputed")
+	if err != nil || charged.Status != OrderStatusChargeback || charged.ChargebackReason != "disputed" || charged.ChargebackAt.IsZero() {
+		t.Fatalf("charged back = %+v, %v", charged, err)
+	}
+	if _, _, err := s.ChargebackOrder(order.Id, "disputed"); err == nil {
+		t.Fatal("charged back the same order twice")
+	}
+	stored := &model.ShopSubscription{}
+	if err := db.First(stored, sub.Id).Error; err != nil || stored.Status != SubscriptionStatusCancelled {
+		t.Fatalf("subscription = %+v, %v, want it cancelled", stored, err)
+	}
+
+	stats, err := s.RevenueStats(since)
+	if err != nil || stats.Orders != 0 || stats.Chargebacks != 1 || stats.ChargebackTotal != 700 {
+		t.Fatalf("revenue = %+v, %v, want the chargeback apart from sales", stats, err)
+	}
+	customers, err := s.ListCustomers()
+	if err != nil || len(customers) != 1 || customers[0].Chargebacks != 1 || customers[0].Spent != 0 {
+		t.Fatalf("customers = %+v, %v, want the customer flagged", customers, err)
+	}
+
+	// Clients on a node are disabled through its panel, and an unreachable
+	// node leaves the order as it was.
+	var updated string
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/login":
+			fmt.Fprint(w, `{"success":true}`)
+		case r.URL.Path == "/panel/api/inbounds/get/3":
+			settings, _ := json.Marshal(`{"clients":[{"id":"c1","email":"node-1@shop","enable":true}]}`)
+			fmt.Fprintf(w, `{"success":true,"obj":{"id":3,"protocol":"vless","settings":%s}}`, settings)
+		case r.URL.Path == "/panel/api/inbounds/updateClient/c1":
+			updated = r.PostFormValue("settings")
+			fmt.Fprint(w, `{"success":true}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer panel.Close()
+	node := &model.ShopNode{Name: "edge", Url: "http://127.0.0.1:1", Username: "admin", Password: "secret", Enabled: true}
+	if err := s.shopNodeService.SaveNode(node); err != nil {
+		t.Fatal(err)
+	}
+	hosted := &model.ShopOrder{TelegramId: 4402, NodeId: node.Id, InboundId: 3, ClientEmail: "node-1@shop", Price: 500, Status: OrderStatusApproved}
+	if err := db.Create(hosted).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ChargebackOrder(hosted.Id, "disputed"); err == nil {
+		t.Fatal("charged back an order whose node is unreachable")
+	}
+	if got, err := s.GetOrder(hosted.Id); err != nil || got.Status != OrderStatusApproved {
+		t.Fatalf("order after a failed chargeback = %+v, %v", got, err)
+	}
+	node.Url = panel.URL
+	if err := s.shopNodeService.SaveNode(node); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.ChargebackOrder(hosted.Id, "disputed"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(updated, `"enable":false`) || !strings.Contains(updated, "node-1@shop") {
+		t.Fatalf("node client updated with %q, want it disabled", updated)
+	}
+}
+
+func TestPaymentGateways(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	scale := minorUnitScale(CurrencyExponent(s.Currency().Code))
+
+	newOrder := func() *model.ShopOrder {
+		order := &model.ShopOrder{TelegramId: 4201, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 3 * scale, Status: OrderStatusPendingReceipt}
+		if err := s.CreateOrder(order); err != nil {
+			t.Fatal(err)
+		}
+		return order
+	}
+	order := newOrder()
+	if _, err := s.GatewayPaymentURL(order); err == nil {
+		t.Fatal("got a payment URL while gateway payments are off")
+	}
+	setShopSetting(t, "shopGateway", "perfectmoney")
+	setShopSetting(t, "shopGatewayAccount", "U1234567")
+	setShopSetting(t, "shopGatewaySecret", "alternate")
+	setShopSetting(t, "shopGatewayRate", "1.505")
+	setShopSetting(t, "shopPublicUrl", "https://panel.example.com/base/")
+
+	payURL, err := s.GatewayPaymentURL(order)
+	if err != nil || !strings.HasPrefix(payURL, "https://panel.example.com/base/portal/pay?") {
+		t.Fatalf("payment URL = %q, %v", payURL, err)
+	}
+	checkout, err := s.GatewayCheckout(order)
+	if err != nil || checkout.Amount != "4.52" || checkout.Fields["PAYMENT_AMOUNT"] != "4.52" || checkout.Fields["PAYMENT_ID"] != order.Number ||
+		checkout.Fields["STATUS_URL"] != "https://panel.example.com/base/portal/gateway/perfectmoney" {
+		t.Fatalf("checkout = %+v, %v", checkout, err)
+	}
+
+	perfectMoney := func(order *model.ShopOrder, amount string) url.Values {
+		form := url.Values{
+			"PAYMENT_ID": {order.Number}, "PAYEE_ACCOUNT": {"U1234567"}, "PAYMENT_AMOUNT": {amount}, "PAYMENT_UNITS": {"USD"},
+			"PAYMENT_BATCH_NUM": {"789"}, "PAYER_ACCOUNT": {"U7654321"}, "TIMESTAMPGMT": {"1760000000"},
+		}
+		secret := md5.Sum([]byte("alternate"))
+		sum := md5.Sum([]byte(strings.Join([]string{
+			order.Number, "U1234567", amount, "USD", "789", "U7654321", strings.ToUpper(hex.EncodeToString(secret[:])), "1760000000",
+		}, ":")))
+		form.Set("V2_HASH", strings.ToUpper(hex.EncodeToString(sum[:])))
+		return form
+	}
+	forged := perfectMoney(order, "4.52")
+	forged.Set("PAYMENT_AMOUNT", "0.01")
+	if _, _, err := s.ConfirmGatewayPayment("perfectmoney", forged); err == nil {
+		t.Fatal("accepted a payment with an invalid signature")
+	}
+	if _, _, err := s.ConfirmGatewayPayment("webmoney", perfectMoney(order, "4.52")); err == nil {
+		t.Fatal("accepted a payment through a gateway that is not enabled")
+	}
+	payment, confirmed, err := s.ConfirmGatewayPayment("perfectmoney", perfectMoney(order, "4.52"))
+	if err != nil || payment.Reference != "789" || confirmed.Status != OrderStatusPendingReview || confirmed.OcrReference != "perfectmoney:789" {
+		t.Fatalf("confirmed = %+v, %v, want the order under review with the batch number", confirmed, err)
+	}
+	if _, _, err := s.ConfirmGatewayPayment("perfectmoney", perfectMoney(order, "4.52")); err == nil {
+		t.Fatal("confirmed the same order twice")
+	}
+
+	underpaid := newOrder()
+	if _, confirmed, err := s.ConfirmGatewayPayment("perfectmoney", perfectMoney(underpaid, "1.00")); !errors.Is(err, ErrGatewayPaymentMismatch) || confirmed == nil {
+		t.Fatalf("underpaid = %+v, %v, want it recorded as a mismatch", confirmed, err)
+	}
+
+	setShopSetting(t, "shopGateway", "webmoney")
+	setShopSetting(t, "shopGatewayAccount", "Z123456789012")
+	webMoney := newOrder()
+	form := url.Values{
+		"LMI_PAYEE_PURSE": {"Z123456789012"}, "LMI_PAYMENT_AMOUNT": {"4.52"}, "LMI_PAYMENT_NO": {strconv.Itoa(webMoney.Id)},
+		"LMI_MODE": {"0"}, "LMI_SYS_INVS_NO": {"11"}, "LMI_SYS_TRANS_NO": {"22"}, "LMI_SYS_TRANS_DATE": {"20261016 12:00:00"},
+		"LMI_PAYER_PURSE": {"Z210987654321"}, "LMI_PAYER_WM": {"123456789012"},
+	}
+	prerequest := url.Values{"LMI_PREREQUEST": {"1"}, "LMI_PAYEE_PURSE": {"Z123456789012"}, "LMI_PAYMENT_AMOUNT": {"4.52"}, "LMI_PAYMENT_NO": {strconv.Itoa(webMoney.Id)}}
+	if payment, _, err := s.ConfirmGatewayPayment("webmoney", prerequest); err != nil || !payment.Prerequest {
+		t.Fatalf("prerequest = %+v, %v", payment, err)
+	}
+	if stored, _ := s.GetOrder(webMoney.Id); stored.Status != OrderStatusPendingReceipt {
+		t.Fatalf("prerequest moved the order to %s", stored.Status)
+	}
+	sum := sha256.Sum256([]byte("Z1234567890124.52" + strconv.Itoa(webMoney.Id) + "0112220261016 12:00:00alternateZ210987654321123456789012"))
+	form.Set("LMI_HASH", strings.ToUpper(hex.EncodeToString(sum[:])))
+	if _, confirmed, err := s.ConfirmGatewayPayment("webmoney", form); err != nil || confirmed.OcrReference != "webmoney:22" {
+		t.Fatalf("confirmed = %+v, %v", confirmed, err)
+	}
+}
+
+func TestShopTimeZone(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	setShopSetting(t, "timeLocation", "Asia/Tehran")
+	tehran, err := time.LoadLocation("Asia/Tehran")
+	if err != nil {
+		t.Skip("time zone database unavailable:", err)
+	}
+
+	// 21:30 UTC is already the next day in Tehran.
+	late := time.Date(2026, 3, 10, 21, 30, 0, 0, time.UTC)
+	if got, want := s.StartOfDay(late), time.Date(2026, 3, 11, 0, 0, 0, 0, tehran); !got.Equal(want) {
+		t.Fatalf("StartOfDay = %v, want %v", got, want)
+	}
+	for _, createdAt := range []time.Time{late, late.Add(-3 * time.Hour)} {
+		order := &model.ShopOrder{TelegramId: 3801, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 100, Status: OrderStatusApproved, CreatedAt: createdAt}
+		if err := database.GetShopDB().Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := s.RevenueStats(late.AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Days) != 2 || stats.Days[0].Date != "2026-03-10" || stats.Days[1].Date != "2026-03-11" {
+		t.Fatalf("days = %+v, want one sale on each of 2026-03-10 and 2026-03-11", stats.Days)
+	}
+
+	order := &model.ShopOrder{CreatedAt: time.Date(2025, 12, 31, 21, 0, 0, 0, time.UTC)}
+	if err := s.assignOrderNumber(database.GetShopDB(), order); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(order.Number, "ORD-2026-") {
+		t.Fatalf("number = %q, want one of 2026 in Tehran", order.Number)
+	}
+}
+
+func TestShopSettings(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	grouped := map[string]int{}
+	for _, group := range shopSettingGroups {
+		for _, key := range group.Keys {
+			grouped[key]++
+		}
+	}
+	for key := range shopSettingFields() {
+		if (strings.HasPrefix(key, "shop") || strings.HasPrefix(key, "smtp")) && grouped[key] != 1 {
+			t.Errorf("setting %s is in %d shop setting groups, want 1", key, grouped[key])
+		}
+	}
+
+	setShopSetting(t, "shopMaxGB", "100")
+	settings, err := s.GetShopSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.Values["shopMaxGB"] != 100 || settings.Values["shopMaintenance"] != false {
+		t.Fatalf("values = %v, want shopMaxGB 100 and shopMaintenance false", settings.Values)
+	}
+	if _, ok := settings.Values["pageSize"]; ok {
+		t.Fatal("non-shop setting pageSize returned with the shop settings")
+	}
+
+	all, err := s.settingService.GetAllSetting()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize := all.PageSize
+	all.ShopMinGB, all.ShopMaxGB, all.PageSize = 200, 100, pageSize+5
+	verr, ok := AsValidationError(s.UpdateShopSettings(all))
+	if !ok || verr.Fields[0].Field != "customDataGb" {
+		t.Fatalf("min above max: %v, want a customDataGb error", verr)
+	}
+	all.ShopMinGB, all.ShopMaintenance = 10, true
+	if err := s.UpdateShopSettings(all); err != nil {
+		t.Fatal(err)
+	}
+	if all, err = s.settingService.GetAllSetting(); err != nil {
+		t.Fatal(err)
+	}
+	if all.ShopMinGB != 10 || !all.ShopMaintenance {
+		t.Fatalf("saved min GB %d, maintenance %v, want 10 and true", all.ShopMinGB, all.ShopMaintenance)
+	}
+	if all.PageSize != pageSize {
+		t.Fatalf("page size = %d, want %d left alone", all.PageSize, pageSize)
+	}
+}
+
+func TestCurrencyChangeRefused(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	setShopSetting(t, "shopCurrency", "USD")
+	if err := validateShopSettings(&entity.AllSetting{ShopCurrency: "IRR"}); err != nil {
+		t.Fatalf("currency change without packages or orders: %v", err)
+	}
+
+	if err := s.CreatePackage(newTestPackage("Starter")); err != nil {
+		t.Fatal(err)
+	}
+	verr, ok := AsValidationError(validateShopSettings(&entity.AllSetting{ShopCurrency: "IRR"}))
+	if !ok || verr.Fields[0].Key != "shop.invalid.currencyInUse" {
+		t.Fatalf("USD to IRR with a package: %v, want a currencyInUse error", verr)
+	}
+	if err := validateShopSettings(&entity.AllSetting{ShopCurrency: "EUR"}); err != nil {
+		t.Fatalf("USD to EUR, both in cents: %v", err)
+	}
+}
+
+func TestPackageCatalog(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	category := &model.ShopCategory{Name: "Monthly"}
+	if err := s.SaveCategory(category); err != nil {
+		t.Fatal(err)
+	}
+	basic := newTestPackage("Basic")
+	basic.CategoryId = category.Id
+	if err := s.CreatePackage(basic); err != nil {
+		t.Fatal(err)
+	}
+	archived := newTestPackage("Old")
+	if err := s.CreatePackage(archived); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeletePackage(archived.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.ExportCatalog(CatalogFormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "category: Monthly") || strings.Contains(string(data), "Old") {
+		t.Fatalf("yaml export = %s, want Basic in Monthly and no archived package", data)
+	}
+
+	// The same catalog from another panel, with a changed price and a new package.
+	catalog := `{"currency":"","categories":["Monthly","Yearly"],"packages":[
+		{"name":"Basic","category":"Monthly","dataGb":10,"durationDays":30,"price":250,"isActive":true},
+		{"name":"Pro","category":"Yearly","dataGb":100,"durationDays":365,"price":900,"isActive":true},
+		{"name":"","dataGb":1,"durationDays":1,"price":1}]}`
+	result, err := s.ImportCatalog([]byte(catalog), CatalogConflictSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created != 1 || result.Skipped != 1 || result.Categories != 1 || len(result.Errors) != 1 {
+		t.Fatalf("skip import = %+v, want Pro created, Basic skipped, Yearly added and 1 error", result)
+	}
+	if pkg, _ := s.GetPackage(basic.Id); pkg.Price != 100 {
+		t.Fatalf("skipped package price = %d, want 100 kept", pkg.Price)
+	}
+
+	if result, err = s.ImportCatalog([]byte(catalog), CatalogConflictOverwrite); err != nil {
+		t.Fatal(err)
+	}
+	if result.Updated != 1 || result.Skipped != 1 || result.Created != 0 {
+		t.Fatalf("overwrite import = %+v, want Basic updated and the unchanged Pro skipped", result)
+	}
+	if pkg, _ := s.GetPackage(basic.Id); pkg.Price != 250 || pkg.CategoryId != category.Id {
+		t.Fatalf("overwritten package = %+v, want price 250 in Monthly", pkg)
+	}
+
+	if result, err = s.ImportCatalog(data, CatalogConflictDuplicate); err != nil {
+		t.Fatal(err)
+	}
+	packages, _ := s.ListPackages(ShopPackageFilter{})
+	if result.Created != 1 || len(packages) != 3 || packages[2].Name != "Basic copy" {
+		t.Fatalf("duplicate import = %+v with packages %v, want a Basic copy", result, packages)
+	}
+
+	if _, err := s.ImportCatalog([]byte(`{"currency":"EUR","packages":[]}`), CatalogConflictSkip); err == nil {
+		t.Fatal("catalog in another currency imported")
+	}
+}
+
+func TestShopNodeSessions(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopNodeService{}
+
+	logins, session := 0, "s1"
+	panel := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			if r.PostFormValue("password") != "secret" {
+				fmt.Fprint(w, `{"success":false,"msg":"wrong password"}`)
+				return
+			}
+			logins++
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: session})
+			fmt.Fprint(w, `{"success":true}`)
+			return
+		}
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != session {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"success":false,"msg":"login again"}`)
+			return
+		}
+		fmt.Fprint(w, `{"success":true,"obj":[{"id":1}]}`)
+	}))
+	defer panel.Close()
+
+	node := &model.ShopNode{Name: "edge", Url: panel.URL, Username: "admin", Password: "secret", Enabled: true}
+	if err := s.SaveNode(node); err != nil {
+		t.Fatal(err)
+	}
+	var password string
+	if err := database.GetShopDB().Raw("SELECT password FROM shop_nodes WHERE id = ?", node.Id).Row().Scan(&password); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(password, shopFieldPrefix) {
+		t.Fatalf("node password stored as %q, want it sealed", password)
+	}
+	node, err := s.GetNode(node.Id)
+	if err != nil || node.Password != "secret" {
+		t.Fatalf("node read back as %+v, %v", node, err)
+	}
+
+	for range 2 {
+		if inbounds, err := s.RemoteInbounds(node); err != nil || len(inbounds) != 1 {
+			t.Fatalf("inbounds = %+v, %v", inbounds, err)
+		}
+	}
+	if logins != 1 {
+		t.Fatalf("logged in %d times, want the session reused", logins)
+	}
+	// The node dropped the session: the next call logs in again.
+	session = "s2"
+	if _, err := s.RemoteInbounds(node); err != nil || logins != 2 {
+		t.Fatalf("call after the session expired: %v, %d logins", err, logins)
+	}
+	node.Password = "wrong"
+	if _, err := s.RemoteInbounds(node); err == nil {
+		t.Fatal("changed credentials reused the old session")
+	}
+}
+
+func TestSyncCatalog(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	catalog := `{"currency":"","categories":[],"packages":[{"name":"Basic","dataGb":10,"durationDays":30,"price":300,"isActive":true}]}`
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base/store/catalog.json" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, catalog)
+	}))
+	defer primary.Close()
+
+	if enabled, _ := s.CatalogSyncEnabled(); enabled {
+		t.Fatal("sync enabled without a primary panel")
+	}
+	verr, ok := AsValidationError(validateShopSettings(&entity.AllSetting{ShopSyncPrimaryUrl: "primary.example.com", ShopSyncMinutes: 60}))
+	if !ok || verr.Fields[0].Field != "syncPrimaryUrl" {
+		t.Fatalf("primary URL without scheme: %v, want a syncPrimaryUrl error", verr)
+	}
+	basic, local := newTestPackage("Basic"), newTestPackage("Local only")
+	for _, pkg := range []*model.ShopPackage{basic, local} {
+		if err := s.CreatePackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setShopSetting(t, "shopSyncPrimaryUrl", primary.URL+"/base/")
+	setShopSetting(t, "shopSyncToken", "wrong")
+	if _, err := s.SyncCatalog(); err == nil || !strings.Contains(err.Error(), "rejected the catalog token") {
+		t.Fatalf("sync with a wrong token: %v", err)
+	}
+
+	setShopSetting(t, "shopSyncToken", "secret")
+	if enabled, minutes := s.CatalogSyncEnabled(); !enabled || minutes != 60 {
+		t.Fatalf("sync enabled = %v every %d minutes, want every 60", enabled, minutes)
+	}
+	result, err := s.SyncCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Updated != 1 || result.Archived != 1 {
+		t.Fatalf("sync = %+v, want Basic updated and the local package archived", result)
+	}
+	if pkg, _ := s.GetPackage(basic.Id); pkg.Price != 300 {
+		t.Fatalf("synced price = %d, want 300", pkg.Price)
+	}
+	if pkg, _ := s.GetPackage(local.Id); !pkg.IsArchived {
+		t.Fatal("package missing on the primary not archived")
+	}
+
+	catalog = `{"packages":[]}`
+	if _, err := s.SyncCatalog(); err == nil {
+		t.Fatal("empty catalog applied")
+	}
+	if pkg, _ := s.GetPackage(basic.Id); pkg.IsArchived {
+		t.Fatal("empty catalog archived the synced package")
+	}
+}
+
+func TestRevenueGoals(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	month := time.Now().In(s.Location()).Format("2006-01")
+
+	for _, goal := range []*model.ShopRevenueGoal{{Month: "2026-13", Amount: 100}, {Month: month, Amount: 0}} {
+		if err := s.SaveRevenueGoal(goal); err == nil {
+			t.Fatalf("saved invalid goal %+v", goal)
+		}
+	}
+	goal := &model.ShopRevenueGoal{Month: month, Amount: 1000}
+	if err := s.SaveRevenueGoal(goal); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveRevenueGoal(&model.ShopRevenueGoal{Month: month, Amount: 900}); err != nil {
+		t.Fatal(err)
+	}
+	if goals, err := s.ListRevenueGoals(); err != nil || len(goals) != 1 || goals[0].Id != goal.Id || goals[0].Amount != 900 {
+		t.Fatalf("goals = %+v, %v, want the month's goal replaced", goals, err)
+	}
+
+	pkg := &model.ShopPackage{Name: "Monthly", Price: 500, IsActive: true}
+	if err := db.Create(pkg).Error; err != nil {
+		t.Fatal(err)
+	}
+	if progress, err := s.ReachedRevenueGoal(); progress != nil || err != nil {
+		t.Fatalf("reached = %+v, %v, before any sale", progress, err)
+	}
+	for _, price := range []int64{500, 400} {
+		order := &model.ShopOrder{TelegramId: 4501, InboundId: 1, PackageId: &pkg.Id, Price: price, Status: OrderStatusApproved}
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	progress, err := s.ReachedRevenueGoal()
+	if err != nil || progress == nil || progress.Revenue != 900 || progress.Orders != 2 || progress.Percent != 100 {
+		t.Fatalf("reached = %+v, %v", progress, err)
+	}
+	if again, err := s.ReachedRevenueGoal(); again != nil || err != nil {
+		t.Fatalf("reached again = %+v, %v, want a single alert", again, err)
+	}
+
+	subs := []*model.ShopSubscription{
+		{TelegramId: 4501, PackageId: pkg.Id, Status: SubscriptionStatusActive},
+		{TelegramId: 4502, PackageId: pkg.Id, Status: SubscriptionStatusActive},
+		{TelegramId: 4503, PackageId: pkg.Id, Status: SubscriptionStatusActive},
+		{TelegramId: 4504, PackageId: pkg.Id, Status: SubscriptionStatusCancelled},
+	}
+	for _, sub := range subs {
+		if err := db.Create(sub).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	summary, err := s.WeeklySummary(time.Now())
+	if err != nil || summary.Orders != 2 || summary.Revenue != 900 || summary.TopPackage != "Monthly" || summary.TopPackageOrders != 2 ||
+		summary.Churned != 1 || summary.ChurnRate != 25 || summary.Goal == nil || !summary.Goal.Reached {
+		t.Fatalf("summary = %+v, %v", summary, err)
+	}
+}
+
+func TestRetentionCohorts(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	loc := s.Location()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, loc)
+	at := func(month time.Month) time.Time { return time.Date(2026, month, 10, 12, 0, 0, 0, loc) }
+
+	orders := []*model.ShopOrder{
+		{TelegramId: 4601, CreatedAt: at(8)},
+		{TelegramId: 4601, CreatedAt: at(9)},
+		{TelegramId: 4601, CreatedAt: at(10)},
+		{TelegramId: 4602, CreatedAt: at(8)},
+		{TelegramId: 4602, CreatedAt: at(10)},
+		{ContactEmail: "Web@Example.com", CreatedAt: at(9)},
+		{ContactEmail: "web@example.com", CreatedAt: at(10)},
+		{TelegramId: 4603, CreatedAt: at(7)},
+	}
+	for _, order := range orders {
+		order.InboundId, order.Price, order.Status = 1, 100, OrderStatusApproved
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	unpaid := &model.ShopOrder{TelegramId: 4603, InboundId: 1, Price: 100, Status: OrderStatusRejected, CreatedAt: at(9)}
+	if err := db.Create(unpaid).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cohorts, err := s.RetentionCohorts(3, now)
+	if err != nil || len(cohorts) != 3 {
+		t.Fatalf("cohorts = %+v, %v", cohorts, err)
+	}
+	august, september, october := cohorts[0], cohorts[1], cohorts[2]
+	if august.Month != "2026-08" || august.Customers != 2 || !slices.Equal(august.Retained, []int{1, 2}) || august.Rates[0] != 50 {
+		t.Fatalf("august = %+v", august)
+	}
+	if september.Customers != 1 || !slices.Equal(september.Retained, []int{1}) {
+		t.Fatalf("september = %+v, want the web customer retained", september)
+	}
+	if october.Month != "2026-10" || october.Customers != 0 || len(october.Retained) != 0 {
+		t.Fatalf("october = %+v", october)
+	}
+}
+
+func TestPackageUtilization(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	const gb = int64(1 << 30)
+
+	standard, pooled := newTestPackage("Standard"), newTestPackage("Family")
+	for _, pkg := range []*model.ShopPackage{standard, pooled} {
+		if err := db.Create(pkg).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	orders := []*model.ShopOrder{
+		{PackageId: &standard.Id, ClientEmail: "u1", Status: OrderStatusApproved},
+		{PackageId: &standard.Id, ClientEmail: "u2", Status: OrderStatusApproved},
+		{PackageId: &standard.Id, ClientEmail: "u3", Status: OrderStatusApproved},
+		{PackageId: &standard.Id, ClientEmail: "u4", Status: OrderStatusRejected},
+		{PackageId: &pooled.Id, ClientEmails: "p1,p2", PoolBytes: 20 * gb, Status: OrderStatusApproved},
+	}
+	for _, order := range orders {
+		order.TelegramId, order.InboundId = 4701, 1
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	traffics := []*xray.ClientTraffic{
+		{Email: "u1", Total: 10 * gb, Down: 5 * gb},
+		{Email: "u2", Total: 10 * gb, Up: 2 * gb, Down: 8 * gb},
+		{Email: "u3", Down: 3 * gb},
+		{Email: "u4", Total: 10 * gb, Down: 9 * gb},
+		{Email: "p1", Down: 2 * gb},
+		{Email: "p2", Down: 3 * gb},
+	}
+	for _, traffic := range traffics {
+		traffic.InboundId = 1
+		if err := database.GetDB().Create(traffic).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := s.PackageUtilization()
+	if err != nil || len(usage) != 2 {
+		t.Fatalf("usage = %+v, %v", usage, err)
+	}
+	got := usage[0]
+	if got.PackageId != standard.Id || got.Package != "Standard" || got.Orders != 3 || got.Clients != 3 || got.Unlimited != 1 ||
+		got.SoldBytes != 20*gb || got.UsedBytes != 18*gb || got.AverageUsed != 6*gb || got.Utilization != 75 {
+		t.Fatalf("standard = %+v", got)
+	}
+	got = usage[1]
+	if got.Orders != 1 || got.Clients != 2 || got.SoldBytes != 20*gb || got.UsedBytes != 5*gb || got.Utilization != 25 {
+		t.Fatalf("pooled = %+v", got)
+	}
+}
+
+func TestCapacityAlerts(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	for i, clients := range []string{`[{"email":"a"},{"email":"b"},{"email":"c"}]`, `[{"email":"d"}]`} {
+		inbound := &model.Inbound{Port: 2101 + i, Protocol: model.VLESS, Tag: fmt.Sprint("inbound-", i), Remark: fmt.Sprint("Remark ", i+1), Settings: `{"clients":` + clients + `}`}
+		if err := database.GetDB().Create(inbound).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetInboundMaxClients(0, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetInboundTags(0, 1, []string{"premium"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetInboundEnabled(0, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	premium, family, anywhere := newTestPackage("Premium"), newTestPackage("Family"), newTestPackage("Anywhere")
+	premium.InboundTag = "premium"
+	family.InboundTag, family.Type, family.Devices = "premium", PackageTypePooled, 2
+	for _, pkg := range []*model.ShopPackage{premium, family, anywhere} {
+		if err := s.CreatePackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if alerts, err := s.CapacityAlerts(); err != nil || len(alerts) != 0 {
+		t.Fatalf("alerts = %+v, %v, with the thresholds off", alerts, err)
+	}
+	setShopSetting(t, "shopLowStockThreshold", "2")
+	setShopSetting(t, "shopInboundAlertPercent", "75")
+	alerts, err := s.CapacityAlerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, alert := range alerts {
+		keys = append(keys, alert.Key)
+	}
+	// Premium has one slot left, a pooled Family order needs two and
+	// Anywhere may use the unlimited inbound 2.
+	want := []string{fmt.Sprint("package:", premium.Id), fmt.Sprint("package:", family.Id), "inbound:0:1"}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("alerts = %v, want %v", keys, want)
+	}
+	if alerts[0].Stock != 1 || alerts[1].Stock != 0 || alerts[2].Usage != 75 || alerts[2].Inbound != "Remark 1" {
+		t.Fatalf("alerts = %+v", alerts)
+	}
+}
+
+func TestBotReload(t *testing.T) {
+	newShopTestDB(t)
+	bot := &Tgbot{}
+	setShopSetting(t, "tgBotEnable", "false")
+	if err := bot.Reload(); err != nil || bot.IsRunning() {
+		t.Fatalf("reload of a disabled bot: running %v, %v", bot.IsRunning(), err)
+	}
+	if ids, err := parseAdminIds("12,34"); err != nil || !slices.Equal(ids, []int64{12, 34}) {
+		t.Fatalf("admin ids = %v, %v", ids, err)
+	}
+	if _, err := parseAdminIds("12,abc"); err == nil {
+		t.Fatal("parsed an invalid admin id")
+	}
+}
+
+func TestBotWebhook(t *testing.T) {
+	bot := &Tgbot{}
+	if err := bot.ServeWebhook(context.Background(), "", []byte("{}")); !errors.Is(err, ErrBotWebhookOff) {
+		t.Fatalf("update while polling: %v", err)
+	}
+	var got []byte
+	botWebhook, botWebhookSecret = func(_ context.Context, data []byte) error {
+		got = data
+		return nil
+	}, "s3cret"
+	t.Cleanup(StopBot)
+	if err := bot.ServeWebhook(context.Background(), "guess", []byte("{}")); !errors.Is(err, ErrBotWebhookSecret) || got != nil {
+		t.Fatalf("update with a wrong secret: %v, handed %q", err, got)
+	}
+	if err := bot.ServeWebhook(context.Background(), "s3cret", []byte(`{"update_id":1}`)); err != nil || string(got) != `{"update_id":1}` {
+		t.Fatalf("update = %q, %v", got, err)
+	}
+	StopBot()
+	if err := bot.ServeWebhook(context.Background(), "s3cret", []byte("{}")); !errors.Is(err, ErrBotWebhookOff) {
+		t.Fatalf("update after stop: %v", err)
+	}
+}
+
+func TestShopClientSettings(t *testing.T) {
+	bot := &Tgbot{}
+	client, err := bot.shopClientSettings(model.VLESS, "", "uuid-1", map[string]any{"email": "a"})
+	if err != nil || client["id"] != "uuid-1" || client["flow"] != "" || client["email"] != "a" {
+		t.Fatalf("vless client = %v, %v", client, err)
+	}
+	client, err = bot.shopClientSettings(model.Shadowsocks, "aes-256-gcm", "uuid-2", map[string]any{})
+	if err != nil || client["method"] != "aes-256-gcm" || client["password"] == "" || client["id"] != nil {
+		t.Fatalf("shadowsocks client = %v, %v", client, err)
+	}
+	if _, err := bot.shopClientSettings(model.Protocol("wireguard"), "", "", map[string]any{}); err == nil {
+		t.Fatal("built a client for an unsupported protocol")
+	}
+}
+
+func TestParseBotCommands(t *testing.T) {
+	names, err := parseBotCommands(" help,/shop, ,start,shop")
+	if err != nil || !slices.Equal(names, []string{"start", "shop", "help"}) {
+		t.Fatalf("commands = %v, %v", names, err)
+	}
+	if names, err := parseBotCommands(""); err != nil || len(names) != 0 {
+		t.Fatalf("no commands = %v, %v", names, err)
+	}
+	if _, err := parseBotCommands("start,wallet"); err == nil {
+		t.Fatal("parsed an unknown command")
+	}
+}
+
+func TestSecondApproval(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	small := &model.ShopOrder{TelegramId: 4601, InboundId: 1, Price: 1000, Status: OrderStatusPendingReview}
+	large := &model.ShopOrder{TelegramId: 4601, InboundId: 1, Price: 5001, Status: OrderStatusPendingReview}
+	for _, order := range []*model.ShopOrder{small, large} {
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if order, err := s.RecordApproval(large.Id, "alice"); err != nil || order.FirstApprover != "" {
+		t.Fatalf("approval with the control off: %+v, %v", order, err)
+	}
+
+	setShopSetting(t, "shopSecondApprovalPrice", "5000")
+	if _, err := s.RecordApproval(small.Id, "alice"); err != nil {
+		t.Fatalf("approval below the price: %v", err)
+	}
+	if order, err := s.RecordApproval(large.Id, "alice"); !errors.Is(err, ErrSecondApprovalRequired) || order.FirstApprover != "alice" {
+		t.Fatalf("first approval: %+v, %v", order, err)
+	}
+	if _, err := s.RecordApproval(large.Id, "alice"); !errors.Is(err, ErrSecondApprovalRequired) {
+		t.Fatalf("same admin approving twice: %v", err)
+	}
+	if _, err := s.RecordApproval(large.Id, ""); err == nil {
+		t.Fatal("unknown admin approved")
+	}
+	order, err := s.RecordApproval(large.Id, "bob")
+	if err != nil || order.FirstApprover != "alice" || order.SecondApprover != "bob" {
+		t.Fatalf("second approval: %+v, %v", order, err)
+	}
+	if stored, err := s.GetOrder(large.Id); err != nil || stored.SecondApprover != "bob" || stored.SecondApprovedAt.IsZero() {
+		t.Fatalf("stored order = %+v, %v", stored, err)
+	}
+	if err := s.CheckOrderApproved(order); err != nil {
+		t.Fatalf("check approved order: %v", err)
+	}
+
+	// Lowering the price below the threshold does not skip the second admin.
+	lowered := &model.ShopOrder{TelegramId: 4601, InboundId: 1, Price: 9000, Status: OrderStatusPendingReview}
+	if err := db.Create(lowered).Error; err != nil {
+		t.Fatal(err)
+	}
+	if lowered, err = s.OverrideOrderPrice(lowered.Id, 100, "discount"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckOrderApproved(lowered); !errors.Is(err, ErrSecondApprovalRequired) {
+		t.Fatalf("check lowered order: %v, want ErrSecondApprovalRequired", err)
+	}
+	if _, err := s.RecordApproval(lowered.Id, "alice"); !errors.Is(err, ErrSecondApprovalRequired) {
+		t.Fatalf("first approval of lowered order: %v", err)
+	}
+	if err := new(Tgbot).ApproveOrder(context.Background(), lowered); !errors.Is(err, ErrSecondApprovalRequired) {
+		t.Fatalf("approve with one approval: %v, want ErrSecondApprovalRequired", err)
+	}
+}
+
+func TestAdminIPAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		ip, ips string
+		want    bool
+	}{
+		{"198.51.100.7", "", true},
+		{"198.51.100.7", "203.0.113.0/24, 198.51.100.7", true},
+		{"203.0.113.200", "203.0.113.0/24", true},
+		{"::ffff:203.0.113.9", "203.0.113.0/24", true},
+		{"198.51.100.8", "203.0.113.0/24, 198.51.100.7", false},
+		{"not an ip", "203.0.113.0/24", false},
+	} {
+		if got, err := AdminIPAllowed(tc.ip, tc.ips, ""); err != nil || got != tc.want {
+			t.Errorf("AdminIPAllowed(%q, %q) = %v, %v, want %v", tc.ip, tc.ips, got, err, tc.want)
+		}
+	}
+	if _, err := AdminIPAllowed("198.51.100.7", "203.0.113.0/33", ""); err == nil {
+		t.Error("accepted an invalid network")
+	}
+
+	list := &router.GeoIPList{Entry: []*router.GeoIP{
+		{CountryCode: "DE", Cidr: []*router.CIDR{{Ip: []byte{198, 51, 100, 0}, Prefix: 24}}},
+		{CountryCode: "FR", Cidr: []*router.CIDR{{Ip: []byte{192, 0, 2, 0}, Prefix: 24}}},
+	}}
+	data, err := proto.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	networks, err := countryNetworks(path, []string{"DE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !networks.Contains(netip.MustParseAddr("198.51.100.7")) || networks.Contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatal("networks of DE do not match geoip.dat")
+	}
+
+	settings := &entity.AllSetting{ShopAdminAllowedIps: "203.0.113.0/24"}
+	if err := CheckAdminAccessKept("198.51.100.7", settings); err == nil {
+		t.Fatal("saved an allowlist locking out the admin saving it")
+	}
+	if err := CheckAdminAccessKept("203.0.113.1", settings); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShopFieldEncryption(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	order := &model.ShopOrder{TelegramId: 4701, InboundId: 1, Price: 1000, Status: OrderStatusPendingReview, ReceiptFileId: "file-1", OcrReference: "bank-9"}
+	if err := db.Create(order).Error; err != nil {
+		t.Fatal(err)
+	}
+	if order.ReceiptFileId != "file-1" {
+		t.Fatalf("created order holds %q, want the plain value", order.ReceiptFileId)
+	}
+	stored := func() (receiptFileId, ocrReference string) {
+		t.Helper()
+		row := db.Raw("SELECT receipt_file_id, ocr_reference FROM shop_orders WHERE id = ?", order.Id).Row()
+		if err := row.Scan(&receiptFileId, &ocrReference); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if fileId, reference := stored(); !strings.HasPrefix(fileId, shopFieldPrefix) || !strings.HasPrefix(reference, shopFieldPrefix) {
+		t.Fatalf("stored %q, %q; want them sealed", fileId, reference)
+	}
+	if got, err := s.GetOrder(order.Id); err != nil || got.ReceiptFileId != "file-1" || got.OcrReference != "bank-9" {
+		t.Fatalf("read back %+v, %v", got, err)
+	}
+
+	if err := s.UpdateOrderReceipt(order.Id, "", "file-2"); err != nil {
+		t.Fatal(err)
+	}
+	if fileId, _ := stored(); !strings.HasPrefix(fileId, shopFieldPrefix) {
+		t.Fatalf("updated receipt stored as %q", fileId)
+	}
+	if got, err := s.GetOrder(order.Id); err != nil || got.ReceiptFileId != "file-2" {
+		t.Fatalf("updated receipt read back as %+v, %v", got, err)
+	}
+
+	comment, err := s.AddOrderComment(order.Id, "alice", "paid from card 6037")
+	if err != nil || comment.Body != "paid from card 6037" {
+		t.Fatalf("comment %+v, %v", comment, err)
+	}
+	var body string
+	if err := db.Raw("SELECT body FROM shop_order_comments WHERE id = ?", comment.Id).Row().Scan(&body); err != nil || strings.Contains(body, "6037") {
+		t.Fatalf("comment stored as %q, %v", body, err)
+	}
+
+	// Values written before the columns were encrypted read as they are until
+	// EncryptShopFields seals them.
+	if err := db.Exec("UPDATE shop_orders SET ocr_reference = 'legacy-1' WHERE id = ?", order.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetOrder(order.Id); err != nil || got.OcrReference != "legacy-1" {
+		t.Fatalf("plain value read back as %+v, %v", got, err)
+	}
+	if sealed, err := s.EncryptShopFields(); err != nil || sealed != 1 {
+		t.Fatalf("EncryptShopFields = %d, %v; want 1", sealed, err)
+	}
+	if _, reference := stored(); !strings.HasPrefix(reference, shopFieldPrefix) {
+		t.Fatalf("reference left as %q", reference)
+	}
+	references, err := shopFieldValues("legacy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := &model.ShopOrder{}
+	if err := db.Where("ocr_reference IN ?", references).First(found).Error; err != nil || found.Id != order.Id {
+		t.Fatalf("lookup by reference: %+v, %v", found, err)
+	}
+
+	// Values that only look sealed are sealed all the same, and a stored value
+	// that does not open is read as stored instead of failing the query.
+	if err := db.Model(order).Update("ocr_reference", shopFieldPrefix+"typed").Error; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetOrder(order.Id); err != nil || got.OcrReference != shopFieldPrefix+"typed" {
+		t.Fatalf("look-alike value read back as %+v, %v", got, err)
+	}
+	if err := db.Exec("UPDATE shop_orders SET ocr_reference = ? WHERE id = ?", shopFieldPrefix+"typed", order.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetOrder(order.Id); err != nil || got.OcrReference != shopFieldPrefix+"typed" {
+		t.Fatalf("unopenable value read back as %+v, %v", got, err)
+	}
+}
+
+func TestShopKeyAndReceiptEncryption(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	dir := t.TempDir()
+	t.Setenv("XUI_SHOP_KEY_FILE", filepath.Join(dir, "shop.key"))
+
+	order := &model.ShopOrder{TelegramId: 4702, InboundId: 1, Price: 1000, Status: OrderStatusPendingReview,
+		Phone: "+989120000000", ContactEmail: "buyer@example.com", CustomFields: `{"name":"Sara"}`}
+	if err := database.GetShopDB().Create(order).Error; err != nil {
+		t.Fatal(err)
+	}
+	var phone, customFields string
+	row := database.GetShopDB().Raw("SELECT phone, custom_fields FROM shop_orders WHERE id = ?", order.Id).Row()
+	if err := row.Scan(&phone, &customFields); err != nil || strings.Contains(phone, "912") || strings.Contains(customFields, "Sara") {
+		t.Fatalf("stored %q, %q, %v; want them sealed", phone, customFields, err)
+	}
+
+	receipt := filepath.Join(dir, "order-1.jpg")
+	image := []byte("\xff\xd8\xff receipt of order 1")
+	if err := WriteReceipt(receipt, image); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(receipt); err != nil || bytes.Contains(data, []byte("receipt of order 1")) {
+		t.Fatalf("receipt stored as %q, %v", data, err)
+	}
+	if data, err := ReadReceipt(receipt); err != nil || !bytes.Equal(data, image) {
+		t.Fatalf("receipt read back as %q, %v", data, err)
+	}
+	legacy := filepath.Join(dir, "order-2.jpg")
+	if err := os.WriteFile(legacy, image, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ReadReceipt(legacy); err != nil || !bytes.Equal(data, image) {
+		t.Fatalf("plain receipt read back as %q, %v", data, err)
+	}
+
+	// A missing key file is not replaced while values sealed with it are stored.
+	missing := filepath.Join(dir, "moved.key")
+	t.Setenv("XUI_SHOP_KEY_FILE", missing)
+	if _, err := s.GetOrder(order.Id); err == nil {
+		t.Fatal("order read without its key")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("a new key file was created: %v", err)
+	}
+}
+
+func TestCustomerDataExportAndErasure(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	const tgId = 4801
+	receipt := filepath.Join(t.TempDir(), "receipt-1.jpg")
+	if err := os.WriteFile(receipt, []byte("jpeg"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	approved := &model.ShopOrder{TelegramId: tgId, TelegramUsername: "alice", Phone: "+100", InboundId: 1, Price: 1000,
+		Status: OrderStatusApproved, ReceiptPath: receipt, ReceiptFileId: "file-1", ClientEmail: "tg-4801-1@shop"}
+	pending := &model.ShopOrder{TelegramId: tgId, InboundId: 1, Price: 500, Status: OrderStatusPendingReview}
+	other := &model.ShopOrder{TelegramId: 4802, InboundId: 1, Price: 700, Status: OrderStatusApproved, ClientEmail: "tg-4802-3@shop"}
+	archived := &model.ShopOrderArchive{ShopOrder: model.ShopOrder{Id: 90, TelegramId: tgId, InboundId: 1, Price: 300,
+		Status: OrderStatusApproved, ClientEmail: "tg-4801-90-1@shop", ClientEmails: "tg-4801-90-1@shop,tg-4801-90-2@shop"}}
+	for _, row := range []any{approved, pending, other, archived,
+		&model.ShopShortLink{Token: "erase001", OrderId: 1, Email: "tg-4801-1@shop", TargetUrl: "https://sub/x"},
+		&model.ShopCustomer{TelegramId: tgId, Username: "alice"},
+		&model.ShopSubscription{TelegramId: tgId, OrderId: 1, Status: SubscriptionStatusActive}} {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	ticket, err := s.OpenTicket(tgId, approved.Id, "where is my config?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := s.ExportCustomerData(tgId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Profile == nil || len(export.Orders) != 2 || len(export.Tickets) != 1 || len(export.Messages) != 1 || len(export.Subscriptions) != 1 {
+		t.Fatalf("export = %+v", export)
+	}
+	for _, order := range export.Orders {
+		if order.Id == approved.Id && (order.ReceiptPath != "receipt-1.jpg" || order.ReceiptFileId != "file-1") {
+			t.Fatalf("exported receipt %q, %q", order.ReceiptPath, order.ReceiptFileId)
+		}
+	}
+
+	if _, err := s.EraseCustomerData(tgId); !errors.Is(err, ErrCustomerOrdersOpen) {
+		t.Fatalf("erasure with an order in progress: %v", err)
+	}
+	if err := db.Model(pending).Update("status", OrderStatusRejected).Error; err != nil {
+		t.Fatal(err)
+	}
+	sumRevenue := func() int64 {
+		t.Helper()
+		var sum int64
+		if err := db.Model(&model.ShopOrder{}).Select("COALESCE(SUM(price), 0)").Where("status = ?", OrderStatusApproved).Scan(&sum).Error; err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	revenue := sumRevenue()
+	erasure, err := s.EraseCustomerData(tgId)
+	if err != nil || erasure.Orders != 3 || erasure.Clients != 3 || erasure.Receipts != 1 || erasure.Tickets != 1 {
+		t.Fatalf("erasure = %+v, %v", erasure, err)
+	}
+	var orderEmails, archivedEmails, linkEmails []string
+	db.Model(&model.ShopOrder{}).Pluck("client_email", &orderEmails)
+	db.Model(&model.ShopOrderArchive{}).Pluck("client_emails", &archivedEmails)
+	db.Model(&model.ShopShortLink{}).Pluck("email", &linkEmails)
+	for _, email := range slices.Concat(orderEmails, archivedEmails, linkEmails) {
+		if strings.Contains(email, "4801") {
+			t.Fatalf("client email %q still carries the Telegram ID", email)
+		}
+	}
+	if _, err := os.Stat(receipt); !os.IsNotExist(err) {
+		t.Fatalf("receipt left on disk: %v", err)
+	}
+	if got := sumRevenue(); got != revenue {
+		t.Fatalf("revenue after erasure = %d, want %d", got, revenue)
+	}
+	order, err := s.GetOrder(approved.Id)
+	if err != nil || order.TelegramId != 0 || order.TelegramUsername != "" || order.Phone != "" || order.ReceiptFileId != "" || order.Price != 1000 {
+		t.Fatalf("anonymized order = %+v, %v", order, err)
+	}
+	if _, err := s.GetTicket(ticket.Id); err == nil {
+		t.Fatal("ticket kept after erasure")
+	}
+	export, err = s.ExportCustomerData(tgId)
+	if err != nil || export.Profile != nil || len(export.Orders) != 0 || len(export.Subscriptions) != 0 {
+		t.Fatalf("export after erasure = %+v, %v", export, err)
+	}
+	if kept, err := s.GetOrder(other.Id); err != nil || kept.TelegramId != 4802 {
+		t.Fatalf("other customer's order = %+v, %v", kept, err)
+	}
+}
+
+func TestCheckoutFields(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	if err := s.SaveCheckoutField(&model.ShopCheckoutField{Label: "OS", Kind: CheckoutFieldChoice}); !isValidationError(err) {
+		t.Fatalf("choice without options: %v, want validation error", err)
+	}
+	if err := s.SaveCheckoutField(&model.ShopCheckoutField{Label: "OS", Kind: CheckoutFieldText, PackageIds: "1,x"}); !isValidationError(err) {
+		t.Fatalf("bad package list: %v, want validation error", err)
+	}
+	country := &model.ShopCheckoutField{Label: " Country ", Kind: CheckoutFieldChoice, Options: "DE, NL,,DE", Required: true, Enabled: true, SortOrder: 2}
+	if err := s.SaveCheckoutField(country); err != nil {
+		t.Fatal(err)
+	}
+	if country.Label != "Country" || country.Options != "DE,NL" {
+		t.Fatalf("normalized field = %+v", country)
+	}
+	devices := &model.ShopCheckoutField{Label: "Devices", Kind: CheckoutFieldNumber, Options: "ignored", PackageIds: "7, 7", Enabled: true, SortOrder: 1}
+	if err := s.SaveCheckoutField(devices); err != nil {
+		t.Fatal(err)
+	}
+	if devices.Options != "" || devices.PackageIds != "7" {
+		t.Fatalf("normalized field = %+v", devices)
+	}
+	if err := s.SaveCheckoutField(&model.ShopCheckoutField{Label: "Notes", Kind: CheckoutFieldText}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fields, err := s.CheckoutFieldsFor(&CheckoutSubject{}); err != nil || len(fields) != 1 || fields[0].Id != country.Id {
+		t.Fatalf("fields for a custom order = %+v, %v", fields, err)
+	}
+	if fields, err := s.CheckoutFieldsFor(&CheckoutSubject{PackageIds: []int{3, 7}}); err != nil || len(fields) != 2 || fields[0].Id != devices.Id {
+		t.Fatalf("fields for packages 3 and 7 = %+v, %v", fields, err)
+	}
+
+	if _, err := CheckoutAnswer(country, "FR"); !isValidationError(err) {
+		t.Fatalf("unknown choice: %v, want validation error", err)
+	}
+	if _, err := CheckoutAnswer(country, ""); !isValidationError(err) {
+		t.Fatalf("skipped required field: %v, want validation error", err)
+	}
+	if _, err := CheckoutAnswer(devices, "two"); !isValidationError(err) {
+		t.Fatalf("non-numeric answer: %v, want validation error", err)
+	}
+	if answer, err := CheckoutAnswer(devices, " 3.0 "); err != nil || answer != "3" {
+		t.Fatalf("number answer = %q, %v", answer, err)
+	}
+
+	order := &model.ShopOrder{
+		TelegramId: 1001, InboundId: 1, CustomDataGB: 10, CustomDays: 30, Price: 50, Status: OrderStatusPendingReceipt,
+		CustomFields: EncodeCheckoutAnswers(map[string]string{"Country": "NL", "Devices": ""}),
+	}
+	if err := s.CreateOrder(order); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetOrder(order.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answers := OrderCheckoutAnswers(stored); len(answers) != 1 || answers["Country"] != "NL" {
+		t.Fatalf("stored answers = %v", answers)
+	}
+
+	if err := s.DeleteCheckoutField(country.Id); err != nil {
+		t.Fatal(err)
+	}
+	if fields, _ := s.ListCheckoutFields(); len(fields) != 2 {
+		t.Fatalf("fields after delete = %+v", fields)
+	}
+}
+
+func TestConditionalCheckoutFields(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	for _, condition := range []string{"color=red", "devices", "devices>many", "type>1|2", "answer.=x"} {
+		err := s.SaveCheckoutField(&model.ShopCheckoutField{Label: "Q", Kind: CheckoutFieldText, ShowIf: condition})
+		if !isValidationError(err) {
+			t.Fatalf("condition %q: %v, want validation error", condition, err)
+		}
+	}
+
+	single := newTestPackage("Single")
+	pooled := newTestPackage("Family")
+	pooled.Type, pooled.Devices = "pooled", 4
+	for _, pkg := range []*model.ShopPackage{single, pooled} {
+		if err := s.CreatePackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fields := []*model.ShopCheckoutField{
+		{Label: "OS", Kind: CheckoutFieldChoice, Options: "Android,Router", Enabled: true, SortOrder: 1},
+		{Label: "Devices", Kind: CheckoutFieldNumber, ShowIf: "type=pooled; devices>1", Enabled: true, SortOrder: 2},
+		{Label: "Router model", Kind: CheckoutFieldText, ShowIf: "answer.OS=router", Enabled: true, SortOrder: 3},
+		{Label: "Long trip", Kind: CheckoutFieldText, ShowIf: "type=custom; durationDays>=60", Enabled: true, SortOrder: 4},
+	}
+	for _, field := range fields {
+		if err := s.SaveCheckoutField(field); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	labels := func(subject *CheckoutSubject) string {
+		t.Helper()
+		asked, err := s.CheckoutFieldsFor(subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(asked))
+		for i, field := range asked {
+			names[i] = field.Label
+		}
+		return strings.Join(names, ",")
+	}
+	if got := labels(&CheckoutSubject{PackageIds: []int{single.Id}}); got != "OS" {
+		t.Fatalf("single-device package asks %q", got)
+	}
+	if got := labels(&CheckoutSubject{PackageIds: []int{single.Id, pooled.Id}}); got != "OS,Devices" {
+		t.Fatalf("cart with a pooled package asks %q", got)
+	}
+	if got := labels(&CheckoutSubject{PackageIds: []int{single.Id}, Answers: map[string]string{"OS": "Router"}}); got != "OS,Router model" {
+		t.Fatalf("after answering Router asks %q", got)
+	}
+	if got := labels(&CheckoutSubject{CustomGB: 50, CustomDays: 90}); got != "OS,Long trip" {
+		t.Fatalf("long custom order asks %q", got)
+	}
+}
+
+func TestConfigFileTemplates(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	if err := s.SaveConfigTemplate(&model.ShopConfigTemplate{Protocol: "socks", FileName: "a.conf", Body: "x"}); !isValidationError(err) {
+		t.Fatalf("unknown protocol: %v, want validation error", err)
+	}
+	if err := s.SaveConfigTemplate(&model.ShopConfigTemplate{Protocol: "vless", FileName: "../a.conf", Body: "x"}); !isValidationError(err) {
+		t.Fatalf("file name with a path: %v, want validation error", err)
+	}
+	tmpl := &model.ShopConfigTemplate{
+		Protocol: " VLESS ", FileName: "{{email}}-{{order}}.json", Enabled: true,
+		Body: `{"id":"{{client.id}}","flow":"{{client.flow}}","host":"{{host}}","port":{{port}},"sni":"{{stream.realitySettings.serverNames}}","dec":"{{settings.decryption}}","x":"{{unknown}}"}`,
+	}
+	if err := s.SaveConfigTemplate(tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveConfigTemplate(&model.ShopConfigTemplate{Protocol: "vless", FileName: "off.txt", Body: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := s.ConfigTemplatesFor(model.VLESS)
+	if err != nil || len(templates) != 1 || templates[0].Id != tmpl.Id || templates[0].Protocol != "vless" {
+		t.Fatalf("enabled vless templates = %+v, %v", templates, err)
+	}
+
+	inbound := &model.Inbound{
+		Protocol: model.VLESS, Port: 443, Remark: "de",
+		Settings:       `{"clients":[{"id":"other","email":"b@x"},{"id":"uuid-1","email":"a@x","flow":"xtls-rprx-vision","subId":"sub1"}],"decryption":"none"}`,
+		StreamSettings: `{"network":"tcp","realitySettings":{"serverNames":["a.com","b.com"],"shortIds":[""]}}`,
+	}
+	vars := ConfigFileVars(inbound, "a@x", "https://sub.example.com:2096/sub/sub1")
+	vars["order"] = "A-1"
+	if vars["subId"] != "sub1" || vars["host"] != "sub.example.com" || vars["stream.network"] != "tcp" {
+		t.Fatalf("vars = %v", vars)
+	}
+	file := RenderConfigFile(&templates[0], vars)
+	want := `{"id":"uuid-1","flow":"xtls-rprx-vision","host":"sub.example.com","port":443,"sni":"a.com,b.com","dec":"none","x":"{{unknown}}"}`
+	if file.Name != "a@x-A-1.json" || string(file.Data) != want {
+		t.Fatalf("rendered %q: %s", file.Name, file.Data)
+	}
+}
+
+func TestShortLinks(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	order := &model.ShopOrder{Id: 7}
+	target := "https://sub.example.com/sub/abc"
+
+	if got := s.ShortenOrderLink(order, "a@x", target); got != target {
+		t.Fatalf("short links off: %q, want target", got)
+	}
+	setShopSetting(t, "shopShortLinks", "true")
+	setShopSetting(t, "shopPublicUrl", "https://shop.example.com/")
+	short := s.ShortenOrderLink(order, "a@x", target)
+	if !strings.HasPrefix(short, "https://shop.example.com/s/") || len(short) != len("https://shop.example.com/s/")+shortLinkLength {
+		t.Fatalf("short link = %q", short)
+	}
+	if again := s.ShortenOrderLink(order, "a@x", target); again != short {
+		t.Fatalf("second link %q, want reused %q", again, short)
+	}
+	token := strings.TrimPrefix(short, "https://shop.example.com/s/")
+	for range 2 {
+		if got, err := s.ResolveShortLink(token); err != nil || got != target {
+			t.Fatalf("resolve = %q, %v", got, err)
+		}
+	}
+	links, err := s.ListOrderShortLinks(order.Id)
+	if err != nil || len(links) != 1 || links[0].Hits != 2 || links[0].Url != short {
+		t.Fatalf("links = %+v, %v", links, err)
+	}
+
+	fresh, err := s.RegenerateShortLink(links[0].Id)
+	if err != nil || fresh.Token == token || fresh.TargetUrl != target {
+		t.Fatalf("regenerated = %+v, %v", fresh, err)
+	}
+	if _, err := s.ResolveShortLink(token); !errors.Is(err, ErrShortLinkNotFound) {
+		t.Fatalf("replaced link: %v, want ErrShortLinkNotFound", err)
+	}
+	if got := s.ShortenOrderLink(order, "a@x", target); got != fresh.Url {
+		t.Fatalf("link after regenerate = %q, want %q", got, fresh.Url)
+	}
+	if _, err := s.RevokeShortLink(fresh.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ResolveShortLink(fresh.Token); !errors.Is(err, ErrShortLinkNotFound) {
+		t.Fatalf("revoked link: %v, want ErrShortLinkNotFound", err)
+	}
+
+	expired := &model.ShopShortLink{Token: "expired1", OrderId: order.Id, Email: "b@x", TargetUrl: target, ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := database.GetShopDB().Create(expired).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ResolveShortLink("expired1"); !errors.Is(err, ErrShortLinkNotFound) {
+		t.Fatalf("expired link: %v, want ErrShortLinkNotFound", err)
+	}
+}
+
+func TestRotateClientCredentials(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	rotated := &model.ShopOrderClient{Email: "a@x", ClientId: "uuid-new", SubId: "sub-new"}
+	tests := []struct {
+		protocol model.Protocol
+		client   string
+		key      string
+		field    string
+	}{
+		{model.VLESS, `{"id":"uuid-old","email":"a@x","subId":"sub-old","totalGB":10,"expiryTime":123}`, "uuid-old", "id"},
+		{model.Trojan, `{"password":"pw-old","email":"a@x","subId":"sub-old","totalGB":10,"expiryTime":123}`, "pw-old", "password"},
+		{model.Shadowsocks, `{"password":"pw-old","email":"a@x","subId":"sub-old","totalGB":10,"expiryTime":123}`, "a@x", "password"},
+	}
+	for _, tt := range tests {
+		inbound := &model.Inbound{Protocol: tt.protocol, Settings: `{"clients":[{"id":"other","password":"other","email":"b@x"},` + tt.client + `]}`}
+		rotation, err := rotateClientSettings(inbound, "a@x", rotated)
+		if err != nil || rotation.key != tt.key {
+			t.Fatalf("%s: rotation %+v, %v", tt.protocol, rotation, err)
+		}
+		var got, reverted struct {
+			Clients []map[string]any `json:"clients"`
+		}
+		if err := json.Unmarshal([]byte(rotation.settings), &got); err != nil || len(got.Clients) != 1 {
+			t.Fatalf("%s: settings %s, %v", tt.protocol, rotation.settings, err)
+		}
+		client := got.Clients[0]
+		if client["email"] != "a@x" || client["subId"] != "sub-new" || client["totalGB"] != 10.0 || client["expiryTime"] != 123.0 {
+			t.Fatalf("%s: rotated client %v", tt.protocol, client)
+		}
+		value, _ := client[tt.field].(string)
+		if value == "" || value == "uuid-old" || value == "pw-old" {
+			t.Fatalf("%s: %s = %q, want a new one", tt.protocol, tt.field, value)
+		}
+		// Reverting finds the client by its new key and gives it the old credentials.
+		if err := json.Unmarshal([]byte(rotation.revertSettings), &reverted); err != nil || len(reverted.Clients) != 1 {
+			t.Fatalf("%s: revert settings %s, %v", tt.protocol, rotation.revertSettings, err)
+		}
+		if reverted.Clients[0][tt.field] == value || reverted.Clients[0]["subId"] != "sub-old" {
+			t.Fatalf("%s: reverted client %v", tt.protocol, reverted.Clients[0])
+		}
+		if tt.protocol != model.Shadowsocks && rotation.revertKey != value {
+			t.Fatalf("%s: revert key %q, want %q", tt.protocol, rotation.revertKey, value)
+		}
+	}
+	if _, err := rotateClientSettings(&model.Inbound{Protocol: model.VLESS, Settings: `{"clients":[]}`}, "a@x", rotated); err == nil {
+		t.Fatal("missing client rotated")
+	}
+
+	db := database.GetShopDB()
+	orders := []*model.ShopOrder{
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "a@x", ClientId: "uuid-old", ClientSubId: "sub-old"},
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "a@x", ClientId: "uuid-old", ClientSubId: "sub-old"}, // renewal
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "c@x", ClientEmails: "c@x,d@x"},
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "e@x", Seats: 3},
+		{TelegramId: 5, Status: OrderStatusRejected},
+	}
+	for _, order := range orders {
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	clients, err := s.ListRotatableClients(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emails []string
+	for _, client := range clients {
+		emails = append(emails, fmt.Sprintf("%s#%d", client.Email, client.OrderId))
+	}
+	if want := []string{fmt.Sprintf("c@x#%d", orders[2].Id), fmt.Sprintf("d@x#%d", orders[2].Id), fmt.Sprintf("a@x#%d", orders[1].Id)}; !slices.Equal(emails, want) {
+		t.Fatalf("rotatable clients = %v, want %v", emails, want)
+	}
+	if _, _, err := s.orderClientInbound(orders[0], "c@x"); !errors.Is(err, ErrClientNotInOrder) {
+		t.Fatalf("client of another order: %v, want ErrClientNotInOrder", err)
+	}
+
+	link := &model.ShopShortLink{Token: "rotate01", OrderId: orders[0].Id, Email: "a@x", TargetUrl: "https://sub/sub-old"}
+	if err := db.Create(link).Error; err != nil {
+		t.Fatal(err)
+	}
+	rotated.OrderId = orders[1].Id
+	if err := saveRotatedClient(rotated); err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range orders[:2] {
+		got, _ := s.GetOrder(order.Id)
+		if got.ClientId != "uuid-new" || got.ClientSubId != "sub-new" {
+			t.Fatalf("order %d credentials = %s %s", order.Id, got.ClientId, got.ClientSubId)
+		}
+	}
+	if _, err := s.ResolveShortLink("rotate01"); !errors.Is(err, ErrShortLinkNotFound) {
+		t.Fatalf("short link of rotated client: %v, want ErrShortLinkNotFound", err)
+	}
+}
+
+func TestOrderPauses(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+
+	topUp := newTestPackage("top-up")
+	topUp.Type = PackageTypeTopUp
+	if err := db.Create(topUp).Error; err != nil {
+		t.Fatal(err)
+	}
+	orders := []*model.ShopOrder{
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "a@x"},
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "a@x"}, // renewal
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "b@x", NodeId: 2},
+		{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "c@x", PackageId: &topUp.Id},
+		{TelegramId: 5, Status: OrderStatusRejected, ClientEmail: "d@x"},
+	}
+	for _, order := range orders {
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	plans, err := s.ListPausablePlans(5)
+	if err != nil || len(plans) != 1 || plans[0].Id != orders[1].Id {
+		t.Fatalf("plans = %+v, %v", plans, err)
+	}
+
+	if _, _, err := s.PauseOrder(orders[1]); !errors.Is(err, ErrPausesDisabled) {
+		t.Fatalf("pause with pauses off: %v, want ErrPausesDisabled", err)
+	}
+	setShopSetting(t, "shopPausesPerCycle", "2")
+	if left, err := s.PausesLeft(orders[1].Id); err != nil || left != 2 {
+		t.Fatalf("pauses left = %d, %v", left, err)
+	}
+	if _, _, err := s.UnpauseOrder(orders[1]); !errors.Is(err, ErrOrderNotPaused) {
+		t.Fatalf("resume of an active order: %v, want ErrOrderNotPaused", err)
+	}
+
+	pausedAt := time.Now().Add(-time.Hour)
+	pauses := []*model.ShopOrderPause{
+		{OrderId: orders[1].Id, PausedAt: pausedAt.Add(-time.Hour), ResumedAt: pausedAt},
+		{OrderId: orders[1].Id, FreezeExpiry: true, PausedAt: pausedAt},
+	}
+	for _, pause := range pauses {
+		if err := db.Create(pause).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	active, err := s.ActiveOrderPause(orders[1].Id)
+	if err != nil || active == nil || active.Id != pauses[1].Id {
+		t.Fatalf("active pause = %+v, %v", active, err)
+	}
+	if _, _, err := s.PauseOrder(orders[1]); !errors.Is(err, ErrOrderPaused) {
+		t.Fatalf("pause of a paused order: %v, want ErrOrderPaused", err)
+	}
+	if left, err := s.PausesLeft(orders[1].Id); err != nil || left != 0 {
+		t.Fatalf("pauses left = %d, %v", left, err)
+	}
+	list, err := s.ListOrderPauses(orders[1].Id)
+	if err != nil || len(list) != 2 || list[0].Id != pauses[1].Id {
+		t.Fatalf("pauses = %+v, %v", list, err)
+	}
+
+	if err := db.Model(pauses[1]).Update("resumed_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+	if active, err := s.ActiveOrderPause(orders[1].Id); err != nil || active != nil {
+		t.Fatalf("active pause after resume = %+v, %v", active, err)
+	}
+	if _, _, err := s.PauseOrder(orders[1]); !errors.Is(err, ErrPauseLimit) {
+		t.Fatalf("pause past the limit: %v, want ErrPauseLimit", err)
+	}
+}
+
+func TestQuoteUpgrade(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	const gb = int64(1 << 30)
+
+	small, big := newTestPackage("small"), newTestPackage("big")
+	small.DataGB, small.Price = 10, 1000
+	big.DataGB, big.Price = 50, 3000
+	for _, pkg := range []*model.ShopPackage{small, big} {
+		if err := s.CreatePackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inbound := &model.Inbound{Port: 3001, Protocol: model.VLESS, Tag: "inbound-3001", Settings: `{"clients":[{"email":"up@x","enable":true}]}`}
+	if err := database.GetDB().Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Half of the plan's traffic is left.
+	traffic := &xray.ClientTraffic{InboundId: inbound.Id, Email: "up@x", Enable: true, Total: 10 * gb, Down: 5 * gb}
+	if err := database.GetDB().Create(traffic).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		from model.ShopOrder
+		want int64
+	}{
+		{"paid in one go", model.ShopOrder{Price: 1000}, 500},
+		{"partly paid", model.ShopOrder{Price: 1000, PaidAmount: 400}, 200},
+		{"charged back", model.ShopOrder{Price: 1000, ChargebackAt: time.Now()}, 0},
+		{"upgraded before", model.ShopOrder{Price: 600, UpgradeCredit: 400}, 500},
+	}
+	for _, tc := range cases {
+		from := tc.from
+		from.TelegramId, from.InboundId, from.PackageId, from.ClientEmail, from.Status = 5, inbound.Id, &small.Id, "up@x", OrderStatusApproved
+		if err := db.Create(&from).Error; err != nil {
+			t.Fatal(err)
+		}
+		quote, err := s.QuoteUpgrade(&from, big)
+		if err != nil || quote.Credit != tc.want || quote.Price != big.Price-tc.want {
+			t.Fatalf("%s: quote = %+v, %v; want a credit of %d", tc.name, quote, err, tc.want)
+		}
+	}
+
+	from := &model.ShopOrder{TelegramId: 5, InboundId: inbound.Id, PackageId: &small.Id, ClientEmail: "up@x", Price: 1000, Status: OrderStatusApproved}
+	if err := db.Create(from).Error; err != nil {
+		t.Fatal(err)
+	}
+	upgrade := &model.ShopOrder{TelegramId: 5, PackageId: &big.Id, ClientEmail: "up@x", Price: 2500, UpgradeFromOrderId: from.Id, UpgradeCredit: 500, Status: OrderStatusPendingReceipt}
+	if err := db.Create(upgrade).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.QuoteUpgrade(from, big); !errors.Is(err, ErrUpgradePending) {
+		t.Fatalf("second upgrade of a plan: %v, want ErrUpgradePending", err)
+	}
+	if err := db.Model(upgrade).Update("status", OrderStatusRejected).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.QuoteUpgrade(from, big); err != nil {
+		t.Fatalf("upgrade after the open one was rejected: %v", err)
+	}
+}
+
+func TestUnpauseLapsedOrder(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+
+	order := &model.ShopOrder{TelegramId: 5, Status: OrderStatusApproved, ClientEmail: "a@x"}
+	if err := db.Create(order).Error; err != nil {
+		t.Fatal(err)
+	}
+	// Billing suspended the subscription while the plan was paused.
+	sub := &model.ShopSubscription{TelegramId: 5, OrderId: order.Id, Status: SubscriptionStatusSuspended, NextDueAt: time.Now().AddDate(0, 0, -10)}
+	if err := db.Create(sub).Error; err != nil {
+		t.Fatal(err)
+	}
+	pause := &model.ShopOrderPause{OrderId: order.Id, FreezeExpiry: true, PausedAt: time.Now().Add(-time.Hour)}
+	if err := db.Create(pause).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.UnpauseOrder(order); !errors.Is(err, ErrResumeLapsed) {
+		t.Fatalf("resume of an overdue plan: %v, want ErrResumeLapsed", err)
+	}
+	if active, err := s.ActiveOrderPause(order.Id); err != nil || active != nil {
+		t.Fatalf("pause of a lapsed plan not ended: %+v, %v", active, err)
+	}
+	if stored, err := s.GetSubscription(sub.Id); err != nil || stored.Status != SubscriptionStatusSuspended {
+		t.Fatalf("overdue subscription = %+v, %v, want it kept suspended", stored, err)
+	}
+}
+
+func TestSubscriptionDowngrade(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+
+	monthly := func(name string, dataGB int, price int64) *model.ShopPackage {
+		pkg := newTestPackage(name)
+		pkg.DataGB, pkg.Price, pkg.BillingCycle = dataGB, price, BillingCycleMonthly
+		return pkg
+	}
+	current := monthly("current", 50, 1000)
+	cheaper := monthly("cheaper", 20, 500)
+	unlimited := monthly("unlimited", 0, 500)
+	pricier := monthly("pricier", 100, 2000)
+	weekly := monthly("weekly", 20, 300)
+	weekly.BillingCycle = BillingCycleWeekly
+	for _, pkg := range []*model.ShopPackage{current, cheaper, unlimited, pricier, weekly} {
+		if err := db.Create(pkg).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	origin := &model.ShopOrder{TelegramId: 5, Status: OrderStatusApproved, PackageId: &current.Id, ClientEmail: "a@x"}
+	if err := db.Create(origin).Error; err != nil {
+		t.Fatal(err)
+	}
+	sub := &model.ShopSubscription{TelegramId: 5, PackageId: current.Id, OrderId: origin.Id, Status: SubscriptionStatusActive, NextDueAt: time.Now()}
+	if err := db.Create(sub).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := s.ListDowngradeOptions(sub)
+	if err != nil || len(options) != 1 || options[0].Id != cheaper.Id {
+		t.Fatalf("options = %+v, %v", options, err)
+	}
+	for _, pkg := range []*model.ShopPackage{current, unlimited, pricier, weekly} {
+		if _, err := s.ScheduleDowngrade(sub, pkg.Id); !errors.Is(err, ErrNotDowngrade) {
+			t.Fatalf("downgrade to %s: %v, want ErrNotDowngrade", pkg.Name, err)
+		}
+	}
+	if _, err := s.ScheduleDowngrade(sub, cheaper.Id); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetSubscription(sub.Id)
+	if err != nil || stored.NextPackageId != cheaper.Id || stored.PackageId != current.Id {
+		t.Fatalf("scheduled subscription = %+v, %v", stored, err)
+	}
+
+	renewal, err := s.createRenewalOrder(stored)
+	if err != nil || renewal.PackageId == nil || *renewal.PackageId != cheaper.Id || renewal.Price != cheaper.Price {
+		t.Fatalf("renewal order = %+v, %v", renewal, err)
+	}
+
+	// A downgrade taken off sale renews on the current package.
+	if err := db.Model(cheaper).Update("is_active", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	shopPackageCache.invalidate()
+	if pkg, err := s.renewalPackage(stored); err != nil || pkg.Id != current.Id {
+		t.Fatalf("renewal package = %+v, %v", pkg, err)
+	}
+
+	if err := s.CancelDowngrade(stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = s.GetSubscription(sub.Id); err != nil || stored.NextPackageId != 0 {
+		t.Fatalf("cancelled downgrade = %+v, %v", stored, err)
+	}
+}
+
+func TestRenewalAppliedOnce(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+	ctx := context.Background()
+
+	pkg := newTestPackage("monthly")
+	pkg.BillingCycle = BillingCycleMonthly
+	if err := db.Create(pkg).Error; err != nil {
+		t.Fatal(err)
+	}
+	origin := &model.ShopOrder{TelegramId: 6, Status: OrderStatusApproved, PackageId: &pkg.Id}
+	if err := db.Create(origin).Error; err != nil {
+		t.Fatal(err)
+	}
+	sub := &model.ShopSubscription{TelegramId: 6, PackageId: pkg.Id, OrderId: origin.Id, Status: SubscriptionStatusActive, NextDueAt: time.Now().Add(24 * time.Hour)}
+	if err := db.Create(sub).Error; err != nil {
+		t.Fatal(err)
+	}
+	// A rejected order cannot be saved as provisioned, as if the save failed.
+	renewal := &model.ShopOrder{TelegramId: 6, PackageId: &pkg.Id, SubscriptionId: sub.Id, Price: pkg.Price, Status: OrderStatusRejected}
+	if err := db.Create(renewal).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	bot := &Tgbot{}
+	if err := bot.provisionApprovedOrder(ctx, renewal); err == nil {
+		t.Fatal("saved a rejected order as provisioned")
+	}
+	renewed, err := s.GetSubscription(sub.Id)
+	if err != nil || !renewed.NextDueAt.After(sub.NextDueAt) {
+		t.Fatalf("renewed subscription = %+v, %v", renewed, err)
+	}
+
+	if err := db.Model(renewal).Update("status", OrderStatusProvisioning).Error; err != nil {
+		t.Fatal(err)
+	}
+	retried, err := s.GetOrder(renewal.Id)
+	if err != nil || retried.EffectAppliedAt.IsZero() {
+		t.Fatalf("renewal order = %+v, %v, want the renewal marked applied", retried, err)
+	}
+	if err := bot.provisionApprovedOrder(ctx, retried); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetSubscription(sub.Id)
+	if err != nil || !stored.NextDueAt.Equal(renewed.NextDueAt) {
+		t.Fatalf("due date after the retry = %v, want %v kept", stored.NextDueAt, renewed.NextDueAt)
+	}
+	if retried, err = s.GetOrder(renewal.Id); err != nil || retried.Status != OrderStatusApproved {
+		t.Fatalf("retried order = %+v, %v", retried, err)
+	}
+}
+
+func TestResellers(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	db := database.GetShopDB()
+
+	if _, err := s.SaveReseller(&model.ShopReseller{Name: " ", CommissionPercent: 120}); err == nil {
+		t.Fatal("saved a reseller without a name and with a commission over 100%")
+	}
+	reseller := &model.ShopReseller{Name: "Acme VPN", CommissionPercent: 20, Enabled: true}
+	key, err := s.SaveReseller(reseller)
+	if err != nil || !strings.HasPrefix(key, resellerKeyPrefix) || !strings.HasPrefix(key, reseller.KeyPrefix) {
+		t.Fatalf("key = %q, prefix %q, %v", key, reseller.KeyPrefix, err)
+	}
+	if got, err := s.AuthenticateReseller(key); err != nil || got.Id != reseller.Id {
+		t.Fatalf("authenticate = %+v, %v", got, err)
+	}
+	if _, err := s.AuthenticateReseller(key + "x"); !errors.Is(err, ErrResellerKey) {
+		t.Fatalf("authenticate with a wrong key: %v, want ErrResellerKey", err)
+	}
+	newKey, err := s.RegenerateResellerKey(reseller.Id)
+	if err != nil || newKey == key {
+		t.Fatalf("regenerated key = %q, %v", newKey, err)
+	}
+	if _, err := s.AuthenticateReseller(key); !errors.Is(err, ErrResellerKey) {
+		t.Fatalf("authenticate with the old key: %v, want ErrResellerKey", err)
+	}
+
+	inbound := &model.Inbound{Port: 2201, Protocol: model.VLESS, Tag: "inbound-2201", Settings: `{"clients":[]}`}
+	if err := database.GetDB().Create(inbound).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetInboundEnabled(0, inbound.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	plan, monthly := newTestPackage("Plan"), newTestPackage("Monthly")
+	plan.Price = 1000
+	monthly.BillingCycle = BillingCycleMonthly
+	for _, pkg := range []*model.ShopPackage{plan, monthly} {
+		if err := s.CreatePackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	packages, err := s.ResellerPackages(reseller)
+	if err != nil || len(packages) != 1 || packages[0].Price != 800 || packages[0].Commission != 200 {
+		t.Fatalf("packages = %+v, %v", packages, err)
+	}
+
+	req := &ShopResellerOrderRequest{PackageId: plan.Id, InboundId: inbound.Id, Reference: "user-42"}
+	if _, err := s.PlaceResellerOrder(reseller, req); !errors.Is(err, ErrResellerBalance) {
+		t.Fatalf("order on an empty balance: %v, want ErrResellerBalance", err)
+	}
+	if _, err := s.CreditReseller(reseller.Id, 0, ""); err == nil {
+		t.Fatal("credited nothing")
+	}
+	if _, err := s.CreditReseller(reseller.Id, -1, ""); !errors.Is(err, ErrResellerBalance) {
+		t.Fatalf("credit below zero: %v, want ErrResellerBalance", err)
+	}
+	if entry, err := s.CreditReseller(reseller.Id, 1500, "wire"); err != nil || entry.Balance != 1500 {
+		t.Fatalf("credit = %+v, %v", entry, err)
+	}
+	if _, err := s.PlaceResellerOrder(reseller, &ShopResellerOrderRequest{PackageId: monthly.Id, InboundId: inbound.Id}); err == nil {
+		t.Fatal("placed a reseller order for a recurring package")
+	}
+	order, err := s.PlaceResellerOrder(reseller, req)
+	if err != nil || order.Status != OrderStatusPendingReview || order.Price != 800 || order.ResellerRef != "user-42" || order.TelegramId != 0 {
+		t.Fatalf("order = %+v, %v", order, err)
+	}
+	if _, err := s.PlaceResellerOrder(reseller, req); !errors.Is(err, ErrResellerBalance) {
+		t.Fatalf("second order over the balance: %v, want ErrResellerBalance", err)
+	}
+	if err := s.DeleteReseller(reseller.Id); err == nil {
+		t.Fatal("deleted a reseller with orders")
+	}
+
+	other := &model.ShopReseller{Name: "Other", Enabled: true}
+	if _, err := s.SaveReseller(other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetResellerOrder(other.Id, order.Id); err == nil {
+		t.Fatal("another reseller read the order")
+	}
+	if orders, err := s.ListResellerOrders(reseller.Id, "user-42"); err != nil || len(orders) != 1 || orders[0].Id != order.Id {
+		t.Fatalf("orders = %+v, %v", orders, err)
+	}
+
+	stored, _ := s.GetReseller(reseller.Id)
+	summary, err := s.ResellerSummary(stored)
+	if err != nil || summary.Balance != 700 || summary.Orders != 1 || summary.Spent != 800 || summary.Commission != 200 {
+		t.Fatalf("summary = %+v, %v", summary, err)
+	}
+	for range 2 {
+		if err := s.UpdateOrderStatus(order.Id, OrderStatusRejected, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored, _ = s.GetReseller(reseller.Id)
+	summary, err = s.ResellerSummary(stored)
+	if err != nil || summary.Balance != 1500 || summary.Orders != 0 || summary.Spent != 0 || summary.Commission != 0 {
+		t.Fatalf("summary after the refund = %+v, %v", summary, err)
+	}
+	var entries int64
+	db.Model(&model.ShopResellerEntry{}).Where("reseller_id = ?", reseller.Id).Count(&entries)
+	if entries != 3 {
+		t.Fatalf("entries = %d, want the credit, the charge and one refund", entries)
+	}
+	if err := s.DeleteReseller(other.Id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestoreKeepsResellerKeys(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	keys := map[int]string{}
+	for _, name := range []string{"Acme VPN", "Other"} {
+		reseller := &model.ShopReseller{Name: name, Enabled: true}
+		key, err := s.SaveReseller(reseller)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[reseller.Id] = key
+	}
+	pkg := newTestPackage("Plan")
+	if err := s.CreatePackage(pkg); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := s.Backup("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SaveReseller(&model.ShopReseller{Name: "After the backup", Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Restore(backup, "secret")
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if result.Rows["shop_resellers"] != 2 {
+		t.Fatalf("restored rows = %+v", result.Rows)
+	}
+	for id, key := range keys {
+		if got, err := s.AuthenticateReseller(key); err != nil || got.Id != id {
+			t.Fatalf("authenticate reseller %d after restore = %+v, %v", id, got, err)
+		}
+	}
+	resellers, _ := s.ListResellers()
+	if len(resellers) != 2 {
+		t.Fatalf("resellers after restore = %+v", resellers)
+	}
+	shopPackageCache.invalidate()
+	if got, err := s.GetPackage(pkg.Id); err != nil || got.Name != "Plan" || got.Price != pkg.Price {
+		t.Fatalf("package after restore = %+v, %v", got, err)
+	}
+}
+
+func TestRestoreRefusesOversizedEntries(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if err := writeZipFile(zw, "manifest.json", []byte(`{"rows":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Zeros compress to almost nothing, so the archive itself is small.
+	if err := writeZipFile(zw, shopBackupReceipts+"order-1.jpg", make([]byte, shopBackupMaxReceiptSize+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := encryptShopBackup(buf.Bytes(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Restore(backup, "secret"); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("restore of an oversized receipt = %v, want it refused", err)
+	}
+}
+
+func TestPurgeReceiptsOfArchivedOrders(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	setShopSetting(t, "shopReceiptRetentionDays", "30")
+	dir := t.TempDir()
+	db := database.GetShopDB()
+
+	old := time.Now().AddDate(0, 0, -60)
+	receipts := make([]string, 3)
+	for i := range receipts {
+		receipts[i] = filepath.Join(dir, fmt.Sprintf("order-%d.jpg", i))
+		if err := WriteReceipt(receipts[i], []byte("receipt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	live := &model.ShopOrder{TelegramId: 6001, Status: OrderStatusApproved, ReceiptPath: receipts[0]}
+	if err := db.Create(live).Error; err != nil {
+		t.Fatal(err)
+	}
+	archived := &model.ShopOrderArchive{ShopOrder: model.ShopOrder{Id: 9001, TelegramId: 6001, Status: OrderStatusApproved, ReceiptPath: receipts[1]}, ArchivedAt: old}
+	recent := &model.ShopOrderArchive{ShopOrder: model.ShopOrder{Id: 9002, TelegramId: 6001, Status: OrderStatusApproved, ReceiptPath: receipts[2]}, ArchivedAt: old}
+	for _, order := range []*model.ShopOrderArchive{archived, recent} {
+		if err := db.Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Model(&model.ShopOrder{}).Where("id = ?", live.Id).UpdateColumn("updated_at", old)
+	db.Model(&model.ShopOrderArchive{}).Where("id = ?", archived.Id).UpdateColumn("updated_at", old)
+
+	if purged, err := s.PurgeReceipts(); err != nil || purged != 2 {
+		t.Fatalf("PurgeReceipts = %d, %v; want 2", purged, err)
+	}
+	got := &model.ShopOrderArchive{}
+	if err := db.First(got, archived.Id).Error; err != nil || got.ReceiptPath != "" || got.ReceiptHash == "" {
+		t.Fatalf("archived order %+v, %v; want its receipt purged and hashed", got, err)
+	}
+	if _, err := os.Stat(receipts[1]); !os.IsNotExist(err) {
+		t.Fatalf("archived receipt left on disk: %v", err)
+	}
+	if _, err := os.Stat(receipts[2]); err != nil {
+		t.Fatalf("recent archived receipt removed: %v", err)
+	}
+}
+
+func TestTableChangeReportedOnCommit(t *testing.T) {
+	newShopTestDB(t)
+	var mu sync.Mutex
+	changes := 0
+	database.OnTableChange(func(table string) {
+		if table == "shop_packages" {
+			mu.Lock()
+			changes++
+			mu.Unlock()
+		}
+	})
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return changes
+	}
+
+	err := database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(newTestPackage("a")).Error; err != nil {
+			return err
+		}
+		if n := count(); n != 0 {
+			t.Fatalf("%d changes reported before commit", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("%d changes reported after commit, want 1", n)
+	}
+
+	rollback := errors.New("rollback")
+	err = database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(newTestPackage("b")).Error; err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) || count() != 1 {
+		t.Fatalf("rolled back write: %v, %d changes reported", err, count())
+	}
+	if err := database.GetShopDB().Create(newTestPackage("c")).Error; err != nil || count() != 2 {
+		t.Fatalf("single write: %v, %d changes reported, want 2", err, count())
+	}
+}
+
+type recordingNotifier struct {
+	to, text []string
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, to, text string) error {
+	n.to = append(n.to, to)
+	n.text = append(n.text, text)
+	return nil
+}
+
+func TestNotifyCustomer(t *testing.T) {
+	newShopTestDB(t)
+	s := &ShopService{}
+	phone := &recordingNotifier{}
+	RegisterShopNotifier("test_phone", phone)
+	telegram := &recordingNotifier{}
+	defer func(n ShopNotifier) { shopTelegramNotifier = n }(shopTelegramNotifier)
+	shopTelegramNotifier = telegram
+
+	byPhone := &model.ShopOrder{Id: 1, Phone: "+15550100"}
+	if err := s.NotifyCustomer(byPhone, "<b>Expires soon</b>"); err != nil || len(phone.to) != 0 {
+		t.Fatalf("notified %v, %v without a provider configured", phone.to, err)
+	}
+	setShopSetting(t, "shopNotifier", "test_phone")
+	if err := s.NotifyCustomer(byPhone, "<b>Expires soon</b>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.NotifyCustomer(&model.ShopOrder{Id: 2, TelegramId: 42, Phone: "+15550101"}, "<b>Approved</b>"); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(phone.to, []string{"+15550100"}) || !slices.Equal(telegram.to, []string{"42"}) {
+		t.Fatalf("sent to phones %v and chats %v", phone.to, telegram.to)
+	}
+	if telegram.text[0] != "<b>Approved</b>" {
+		t.Fatalf("Telegram message %q, want the HTML kept", telegram.text[0])
+	}
+
+	orders := []*model.ShopOrder{
+		{TelegramId: 0, Phone: "+15550100", Status: OrderStatusApproved, ClientEmail: "p@x"},
+		{TelegramId: 0, Phone: "+15550100", Status: OrderStatusPendingReview},
+		{TelegramId: 7, Phone: "+15550102", Status: OrderStatusApproved, ClientEmail: "t@x"},
+	}
+	for _, order := range orders {
+		if err := database.GetShopDB().Create(order).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	listed, err := s.ListPhoneCustomerOrders()
+	if err != nil || len(listed) != 1 || listed[0].Id != orders[0].Id || listed[0].Phone != "+15550100" {
+		t.Fatalf("phone customer orders = %+v, %v", listed, err)
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// In-bot payment methods selectable in the shop settings.
+const (
+	TgPaymentStars    = "stars"    // Telegram Stars
+	TgPaymentProvider = "provider" // A payment provider connected in BotFather
+)
+
+// starsCurrency is the currency code Telegram invoices in Stars use.
+const starsCurrency = "XTR"
+
+// tgInvoicePayloadPrefix starts the payload of the invoice of an order.
+const tgInvoicePayloadPrefix = "order:"
+
+// ErrTgInvoiceMismatch is returned when a Telegram payment does not match the
+// invoice its order would get now, as when the price or the rate changed.
+var ErrTgInvoiceMismatch = errors.New("payment does not match the order's invoice")
+
+// ShopTgInvoice is what a customer is asked to pay for an order inside
+// Telegram. Amount is in the smallest unit of Currency, whole Stars for XTR.
+type ShopTgInvoice struct {
+	Payload       string
+	ProviderToken string
+	Currency      string
+	Amount        int
+}
+
+// TgPaymentsEnabled tells whether customers can pay inside the bot.
+func (s *ShopService) TgPaymentsEnabled() bool {
+	mode, _ := s.settingService.GetShopTgPayments()
+	switch mode {
+	case TgPaymentStars:
+		rate, err := s.starsPerUnit()
+		return err == nil && rate > 0
+	case TgPaymentProvider:
+		token, _ := s.settingService.GetShopTgProviderToken()
+		return token != ""
+	}
+	return false
+}
+
+// starsPerUnit returns the Stars charged per whole unit of the shop currency.
+func (s *ShopService) starsPerUnit() (float64, error) {
+	value, err := s.settingService.GetShopStarsPerUnit()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(value), 64)
+}
+
+// TgInvoice returns the invoice an order awaiting its receipt is paid with in
+// Telegram. Only orders with nothing paid yet, whose package accepts in-bot
+// payments, get one.
+func (s *ShopService) TgInvoice(order *model.ShopOrder) (*ShopTgInvoice, error) {
+	if !s.TgPaymentsEnabled() {
+		return nil, errors.New("in-bot payments are off")
+	}
+	if order.Status != OrderStatusPendingReceipt || order.PaidAmount != 0 {
+		return nil, errors.New("order is not awaiting payment")
+	}
+	if !s.PaymentMethodAllowed(order, PaymentMethodTelegram) {
+		return nil, errors.New("package does not accept in-bot payments")
+	}
+	invoice := &ShopTgInvoice{Payload: tgInvoicePayloadPrefix + strconv.Itoa(order.Id)}
+	mode, _ := s.settingService.GetShopTgPayments()
+	if mode == TgPaymentProvider {
+		invoice.ProviderToken, _ = s.settingService.GetShopTgProviderToken()
+		invoice.Currency = s.Currency().Code
+		if order.Price > math.MaxInt32 {
+			return nil, ErrPriceOverflow
+		}
+		invoice.Amount = int(order.Price)
+		return invoice, nil
+	}
+	rate, err := s.starsPerUnit()
+	if err != nil {
+		return nil, err
+	}
+	units := float64(order.Price) / float64(minorUnitScale(CurrencyExponent(s.Currency().Code)))
+	stars := math.Ceil(units*rate - 1e-9)
+	if stars > math.MaxInt32 {
+		return nil, ErrPriceOverflow
+	}
+	invoice.Currency = starsCurrency
+	invoice.Amount = max(int(stars), 1)
+	return invoice, nil
+}
+
+// TgPaymentOrder returns the order the invoice with payload is for, which
+// telegramId must have placed.
+func (s *ShopService) TgPaymentOrder(payload string, telegramId int64) (*model.ShopOrder, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(payload, tgInvoicePayloadPrefix))
+	if err != nil || !strings.HasPrefix(payload, tgInvoicePayloadPrefix) {
+		return nil, fmt.Errorf("unknown invoice payload %q", payload)
+	}
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, err
+	}
+	if order.TelegramId != telegramId {
+		return nil, errors.New("order belongs to another customer")
+	}
+	return order, nil
+}
+
+// CheckTgPayment fails unless a Telegram payment of amount in currency still
+// matches the invoice of order, as when the price or the Stars rate changed
+// after the invoice was sent.
+func (s *ShopService) CheckTgPayment(order *model.ShopOrder, currency string, amount int) error {
+	invoice, err := s.TgInvoice(order)
+	if err != nil {
+		return err
+	}
+	if invoice.Currency != currency || invoice.Amount != amount {
+		return ErrTgInvoiceMismatch
+	}
+	return nil
+}
+
+// ConfirmTgPayment readies an order paid in Telegram for approval, keeping the
+// Telegram charge ID in place of the reference read from a receipt.
+func (s *ShopService) ConfirmTgPayment(order *model.ShopOrder, chargeId string) (*model.ShopOrder, error) {
+	return s.ConfirmStatementPayment(order.Id, "telegram:"+chargeId)
+}
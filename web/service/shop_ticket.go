@@ -0,0 +1,122 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// Ticket statuses.
+const (
+	TicketStatusOpen     = "open"
+	TicketStatusAnswered = "answered"
+	TicketStatusClosed   = "closed"
+)
+
+// OpenTicket starts a support ticket with the customer's first message. An
+// order it refers to must belong to the customer.
+func (s *ShopService) OpenTicket(tgId int64, orderId int, body string) (*model.ShopTicket, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, errors.New("message is empty")
+	}
+	if orderId > 0 {
+		order, err := s.GetOrder(orderId)
+		if err != nil || order.TelegramId != tgId {
+			return nil, errors.New("order not found")
+		}
+	}
+	ticket := &model.ShopTicket{
+		TelegramId: tgId,
+		OrderId:    orderId,
+		Status:     TicketStatusOpen,
+		CreatedAt:  time.Now(),
+		UpdatedAt:  time.Now(),
+	}
+	if err := database.GetShopDB().Create(ticket).Error; err != nil {
+		return nil, err
+	}
+	if _, err := s.AddTicketMessage(ticket.Id, false, "", body); err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// AddTicketMessage appends a message to a ticket. Customer messages reopen it
+// and admin messages mark it answered.
+func (s *ShopService) AddTicketMessage(ticketId int, fromAdmin bool, author, body string) (*model.ShopTicketMessage, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, errors.New("message is empty")
+	}
+	ticket, err := s.GetTicket(ticketId)
+	if err != nil {
+		return nil, err
+	}
+	message := &model.ShopTicketMessage{
+		TicketId:  ticket.Id,
+		FromAdmin: fromAdmin,
+		Author:    author,
+		Body:      body,
+		CreatedAt: time.Now(),
+	}
+	db := database.GetShopDB()
+	if err := db.Create(message).Error; err != nil {
+		return nil, err
+	}
+	status := TicketStatusOpen
+	if fromAdmin {
+		status = TicketStatusAnswered
+	}
+	err = db.Model(&model.ShopTicket{}).Where("id = ?", ticket.Id).Updates(map[string]any{
+		"status":     status,
+		"updated_at": time.Now(),
+	}).Error
+	return message, err
+}
+
+func (s *ShopService) CloseTicket(ticketId int) error {
+	return database.GetShopDB().Model(&model.ShopTicket{}).Where("id = ?", ticketId).Updates(map[string]any{
+		"status":     TicketStatusClosed,
+		"updated_at": time.Now(),
+	}).Error
+}
+
+func (s *ShopService) GetTicket(id int) (*model.ShopTicket, error) {
+	ticket := &model.ShopTicket{}
+	if err := database.GetShopDB().First(ticket, id).Error; err != nil {
+		return nil, err
+	}
+	return ticket, nil
+}
+
+// OpenTicketOf returns the customer's latest ticket that is not closed, or nil.
+func (s *ShopService) OpenTicketOf(tgId int64) (*model.ShopTicket, error) {
+	var tickets []model.ShopTicket
+	err := database.GetShopDB().Where("telegram_id = ? AND status <> ?", tgId, TicketStatusClosed).
+		Order("id desc").Limit(1).Find(&tickets).Error
+	if err != nil || len(tickets) == 0 {
+		return nil, err
+	}
+	return &tickets[0], nil
+}
+
+// ListTickets returns tickets with the given status, or all tickets when status is empty.
+func (s *ShopService) ListTickets(status string) ([]model.ShopTicket, error) {
+	db := database.GetShopDB().Order("updated_at desc")
+	if status != "" {
+		db = db.Where("status = ?", status)
+	}
+	var tickets []model.ShopTicket
+	err := db.Find(&tickets).Error
+	return tickets, err
+}
+
+func (s *ShopService) ListTicketMessages(ticketId int) ([]model.ShopTicketMessage, error) {
+	var messages []model.ShopTicketMessage
+	err := database.GetShopDB().Where("ticket_id = ?", ticketId).Order("id asc").Find(&messages).Error
+	return messages, err
+}
@@ -0,0 +1,20 @@
+package service
+
+import "time"
+
+// Location returns the panel's configured time zone, in which the shop counts
+// days, months and years, or the server's when the setting is invalid.
+func (s *ShopService) Location() *time.Location {
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil || loc == nil {
+		return time.Local
+	}
+	return loc
+}
+
+// StartOfDay returns the midnight starting the day of t in the panel's time
+// zone.
+func (s *ShopService) StartOfDay(t time.Time) time.Time {
+	t = t.In(s.Location())
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
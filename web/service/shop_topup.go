@@ -0,0 +1,48 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ApplyTopUp adds a top-up package's traffic to the order's existing client
+// and re-enables the client if it was only disabled for running out of data.
+func (s *ShopService) ApplyTopUp(order *model.ShopOrder, pkg *model.ShopPackage) (bool, error) {
+	if order.ClientEmail == "" {
+		return false, errors.New("top-up order has no target client")
+	}
+	traffic, client, err := s.inboundService.GetClientByEmail(order.ClientEmail)
+	if err != nil {
+		return false, err
+	}
+	if traffic == nil || client == nil {
+		return false, errors.New("top-up target client not found")
+	}
+	if traffic.Total == 0 {
+		return false, errors.New("client already has unlimited traffic")
+	}
+
+	const gb = int64(1024 * 1024 * 1024)
+	totalGB := int((traffic.Total + int64(pkg.DataGB)*gb) / gb)
+	needRestart, err := s.inboundService.ResetClientTrafficLimitByEmail(order.ClientEmail, totalGB)
+	if err != nil {
+		return needRestart, err
+	}
+	if !traffic.Enable && (traffic.ExpiryTime <= 0 || traffic.ExpiryTime > time.Now().UnixMilli()) {
+		_, restart, err := s.inboundService.SetClientEnableByEmail(order.ClientEmail, true)
+		if err != nil {
+			return needRestart, err
+		}
+		needRestart = needRestart || restart
+	}
+
+	order.InboundId = traffic.InboundId
+	order.ClientId = client.ID
+	if order.ClientId == "" {
+		order.ClientId = client.Password
+	}
+	order.ClientSubId = client.SubID
+	return needRestart, nil
+}
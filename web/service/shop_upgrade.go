@@ -0,0 +1,166 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+)
+
+// ErrUpgradePending is returned when quoting an upgrade for a plan that has an
+// upgrade order still open.
+var ErrUpgradePending = errors.New("plan has an upgrade in progress")
+
+// ShopUpgradeQuote is the price of moving an order's client to a bigger package.
+type ShopUpgradeQuote struct {
+	FromOrderId int   `json:"fromOrderId"`
+	PackageId   int   `json:"packageId"`
+	Credit      int64 `json:"credit"`
+	Price       int64 `json:"price"`
+}
+
+// ListUpgradeablePlans returns the customer's approved single-client plans on local
+// inbounds, keeping only the latest plan order for each client.
+func (s *ShopService) ListUpgradeablePlans(tgId int64) ([]model.ShopOrder, error) {
+	var orders []model.ShopOrder
+	err := database.GetShopDB().Where("telegram_id = ? AND status = ? AND node_id = 0 AND client_email <> '' AND client_emails = '' AND subscription_id = 0",
+		tgId, OrderStatusApproved).Order("id desc").Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	plans := make([]model.ShopOrder, 0, len(orders))
+	for _, order := range orders {
+		if seen[order.ClientEmail] {
+			continue
+		}
+		if order.PackageId != nil {
+			if pkg, err := s.GetPackage(*order.PackageId); err != nil || pkg.Type == PackageTypeTopUp {
+				continue
+			}
+		}
+		seen[order.ClientEmail] = true
+		plans = append(plans, order)
+	}
+	return plans, nil
+}
+
+// upgradePaid returns what the customer paid for an order's plan: its recorded
+// payments, or its price when it was paid in one go, plus the credit an upgrade
+// order was given. A reversed payment counts for nothing.
+func upgradePaid(order *model.ShopOrder) int64 {
+	if order.Status != OrderStatusApproved || !order.ChargebackAt.IsZero() {
+		return 0
+	}
+	paid := order.Price
+	if order.PaidAmount > 0 {
+		paid = min(order.PaidAmount, order.Price)
+	}
+	return paid + order.UpgradeCredit
+}
+
+// QuoteUpgrade prices an upgrade from an order's current plan to pkg. The credit is
+// what was paid for the plan scaled by whichever of the remaining traffic or days
+// runs out first. A plan with an open upgrade order gets ErrUpgradePending, so
+// its credit is not spent twice.
+func (s *ShopService) QuoteUpgrade(from *model.ShopOrder, pkg *model.ShopPackage) (*ShopUpgradeQuote, error) {
+	if pkg.Type != PackageTypeStandard || pkg.BillingCycle != "" || !pkg.IsActive || pkg.IsArchived {
+		return nil, errors.New("package cannot be used for upgrades")
+	}
+	var pending int64
+	err := database.GetShopDB().Model(&model.ShopOrder{}).
+		Where("upgrade_from_order_id = ? AND status IN ?", from.Id, []string{
+			OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusOnHold, OrderStatusScheduled, OrderStatusProvisioning,
+		}).Count(&pending).Error
+	if err != nil {
+		return nil, err
+	}
+	if pending > 0 {
+		return nil, ErrUpgradePending
+	}
+	dataGB, days := from.CustomDataGB, from.CustomDays
+	if from.PackageId != nil {
+		current, err := s.GetPackage(*from.PackageId)
+		if err != nil {
+			return nil, err
+		}
+		dataGB, days = current.DataGB, current.DurationDays
+	}
+	moreData := dataGB > 0 && (pkg.DataGB == 0 || pkg.DataGB > dataGB)
+	longer := pkg.DataGB == dataGB && days > 0 && (pkg.DurationDays == 0 || pkg.DurationDays > days)
+	if !moreData && !longer {
+		return nil, errors.New("package is not an upgrade")
+	}
+
+	traffic, err := s.inboundService.GetClientTrafficByEmail(from.ClientEmail)
+	if err != nil {
+		return nil, err
+	}
+	if traffic == nil {
+		return nil, errors.New("client not found")
+	}
+
+	remaining := 1.0
+	if traffic.Total > 0 {
+		remaining = float64(traffic.Total-traffic.Up-traffic.Down) / float64(traffic.Total)
+	}
+	if traffic.ExpiryTime > 0 && days > 0 {
+		left := float64(traffic.ExpiryTime-time.Now().UnixMilli()) / float64(int64(days)*86400000)
+		remaining = min(remaining, left)
+	}
+	remaining = max(0, min(1, remaining))
+
+	quote := &ShopUpgradeQuote{
+		FromOrderId: from.Id,
+		PackageId:   pkg.Id,
+		Credit:      int64(float64(upgradePaid(from)) * remaining),
+	}
+	quote.Price = max(0, pkg.Price-quote.Credit)
+	return quote, nil
+}
+
+// ApplyUpgrade starts the upgraded package on the existing client: usage is reset
+// and the traffic limit and expiry are set from the new package.
+func (s *ShopService) ApplyUpgrade(order *model.ShopOrder) (bool, error) {
+	from, err := s.GetOrder(order.UpgradeFromOrderId)
+	if err != nil {
+		return false, err
+	}
+	if order.PackageId == nil {
+		return false, errors.New("upgrade order has no package")
+	}
+	pkg, err := s.GetPackage(*order.PackageId)
+	if err != nil {
+		return false, err
+	}
+	email := from.ClientEmail
+
+	if err := s.inboundService.ResetClientTrafficByEmail(email); err != nil {
+		return false, err
+	}
+	needRestart, err := s.inboundService.ResetClientTrafficLimitByEmail(email, pkg.DataGB)
+	if err != nil {
+		return needRestart, err
+	}
+	expiry := int64(0)
+	if pkg.DurationDays > 0 {
+		expiry = time.Now().UnixMilli() + int64(pkg.DurationDays)*86400000
+	}
+	restart, err := s.inboundService.ResetClientExpiryTimeByEmail(email, expiry)
+	needRestart = needRestart || restart
+	if err != nil {
+		return needRestart, err
+	}
+	_, restart, err = s.inboundService.SetClientEnableByEmail(email, true)
+	needRestart = needRestart || restart
+	if err != nil {
+		return needRestart, err
+	}
+
+	order.InboundId = from.InboundId
+	order.ClientEmail = from.ClientEmail
+	order.ClientId = from.ClientId
+	order.ClientSubId = from.ClientSubId
+	return needRestart, nil
+}
@@ -0,0 +1,390 @@
+package service
+
+import (
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/web/entity"
+)
+
+// Length limits of shop text fields. Descriptions are sent as Telegram photo
+// captions, which are capped at 1024 characters.
+const (
+	shopNameMaxLength        = 64
+	shopDescriptionMaxLength = 1024
+	shopUrlMaxLength         = 512
+	shopValueMaxLength       = 256
+)
+
+// FieldError describes one invalid field of a shop model with a shop catalog
+// message, so it can be shown in the admin's or customer's language.
+type FieldError struct {
+	Field  string
+	Key    string
+	Params []string
+}
+
+// Message renders the error in the given catalog language.
+func (e FieldError) Message(lang string) string {
+	params := append([]string{"Field==" + ShopText(lang, "shop.field."+e.Field)}, e.Params...)
+	return ShopText(lang, e.Key, params...)
+}
+
+// ValidationError lists the invalid fields of a shop model.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Message(shopDefaultLanguage)
+	}
+	return strings.Join(messages, " ")
+}
+
+// Localize returns the first message of each invalid field, keyed by the
+// field's JSON name.
+func (e *ValidationError) Localize(lang string) map[string]string {
+	messages := make(map[string]string, len(e.Fields))
+	for _, field := range e.Fields {
+		if _, ok := messages[field.Field]; !ok {
+			messages[field.Field] = field.Message(lang)
+		}
+	}
+	return messages
+}
+
+// Messages returns every message in order, for showing in the bot.
+func (e *ValidationError) Messages(lang string) []string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Message(lang)
+	}
+	return messages
+}
+
+// AsValidationError returns the ValidationError wrapped in err, if any.
+func AsValidationError(err error) (*ValidationError, bool) {
+	var verr *ValidationError
+	ok := errors.As(err, &verr)
+	return verr, ok
+}
+
+// shopValidator collects field errors while a model is checked.
+type shopValidator struct {
+	fields []FieldError
+}
+
+func (v *shopValidator) add(field, key string, params ...string) {
+	v.fields = append(v.fields, FieldError{Field: field, Key: key, Params: params})
+}
+
+func (v *shopValidator) text(field, value string, required bool, maxLength int) {
+	switch {
+	case required && strings.TrimSpace(value) == "":
+		v.add(field, "shop.invalid.required")
+	case utf8.RuneCountInString(value) > maxLength:
+		v.add(field, "shop.invalid.tooLong", "Max=="+strconv.Itoa(maxLength))
+	}
+}
+
+func (v *shopValidator) nonNegative(field string, value int64) {
+	if value < 0 {
+		v.add(field, "shop.invalid.negative")
+	}
+}
+
+func (v *shopValidator) positive(field string, value int64) {
+	if value <= 0 {
+		v.add(field, "shop.invalid.notPositive")
+	}
+}
+
+// between checks value against min and max, a zero bound being unset.
+func (v *shopValidator) between(field string, value, min, max int) {
+	if min > 0 && value < min {
+		v.add(field, "shop.invalid.belowMin", "Min=="+strconv.Itoa(min))
+	} else if max > 0 && value > max {
+		v.add(field, "shop.invalid.aboveMax", "Max=="+strconv.Itoa(max))
+	}
+}
+
+// multipleOf checks that value is a multiple of step, a zero step being unset.
+func (v *shopValidator) multipleOf(field string, value, step int) {
+	if step > 0 && value%step != 0 {
+		v.add(field, "shop.invalid.step", "Step=="+strconv.Itoa(step))
+	}
+}
+
+func (v *shopValidator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.fields}
+}
+
+// validatePackage checks a package and normalizes its type, device count,
+// billing cycle and payment methods. Zero data or days mean unlimited, except for top-ups.
+func validatePackage(pkg *model.ShopPackage) error {
+	v := &shopValidator{}
+	v.text("name", pkg.Name, true, shopNameMaxLength)
+	v.nonNegative("price", pkg.Price)
+	v.nonNegative("dataGb", int64(pkg.DataGB))
+	v.nonNegative("durationDays", int64(pkg.DurationDays))
+	v.text("description", pkg.Description, false, shopDescriptionMaxLength)
+	v.text("imageUrl", pkg.ImageUrl, false, shopUrlMaxLength)
+	if pkg.InboundTag != "" {
+		if pkg.InboundTag = normalizeShopTag(pkg.InboundTag); pkg.InboundTag == "" {
+			v.add("inboundTag", "shop.invalid.tag")
+		}
+	}
+	if methods, ok := normalizePaymentMethods(pkg.PaymentMethods); ok {
+		pkg.PaymentMethods = methods
+	} else {
+		v.add("paymentMethods", "shop.invalid.choice")
+	}
+	switch pkg.Type {
+	case "", PackageTypeStandard:
+		pkg.Type = PackageTypeStandard
+		pkg.Devices = 1
+	case PackageTypePooled:
+		v.between("devices", pkg.Devices, 2, 0)
+	case PackageTypeTopUp:
+		if pkg.DataGB == 0 {
+			v.add("dataGb", "shop.invalid.notPositive")
+		}
+		pkg.Devices = 1
+	default:
+		v.add("type", "shop.invalid.choice")
+	}
+	switch pkg.BillingCycle {
+	case "", BillingCycleWeekly, BillingCycleMonthly, BillingCycleQuarterly:
+		if pkg.BillingCycle != "" && pkg.Type == PackageTypeTopUp {
+			v.add("billingCycle", "shop.invalid.topUpRecurring")
+		}
+	default:
+		v.add("billingCycle", "shop.invalid.choice")
+	}
+	return v.err()
+}
+
+func validateCategory(category *model.ShopCategory) error {
+	v := &shopValidator{}
+	v.text("name", category.Name, true, shopNameMaxLength)
+	return v.err()
+}
+
+func validatePaymentDestination(dest *model.ShopPaymentDestination) error {
+	v := &shopValidator{}
+	v.text("name", dest.Name, false, shopNameMaxLength)
+	v.text("value", dest.Value, true, shopValueMaxLength)
+	v.text("holder", dest.Holder, false, shopNameMaxLength)
+	v.nonNegative("dailyCap", dest.DailyCap)
+	return v.err()
+}
+
+// validateOrder checks the amounts of a new order.
+func validateOrder(order *model.ShopOrder) error {
+	v := &shopValidator{}
+	v.nonNegative("price", order.Price)
+	if order.PackageId == nil && order.SubscriptionId == 0 && order.ItemCount == 0 {
+		v.positive("customDataGb", int64(order.CustomDataGB))
+		v.positive("customDays", int64(order.CustomDays))
+	}
+	return v.err()
+}
+
+// customOrderLimits are the bounds and step of one custom order amount. Zero
+// values are unset.
+type customOrderLimits struct {
+	min, max, step int
+}
+
+func (s *ShopService) customOrderLimits() (gb, days customOrderLimits) {
+	gb.min, _ = s.settingService.GetShopMinGB()
+	gb.max, _ = s.settingService.GetShopMaxGB()
+	gb.step, _ = s.settingService.GetShopStepGB()
+	days.min, _ = s.settingService.GetShopMinDays()
+	days.max, _ = s.settingService.GetShopMaxDays()
+	days.step, _ = s.settingService.GetShopStepDays()
+	return gb, days
+}
+
+// check validates a custom order amount against the limits.
+func (l customOrderLimits) check(v *shopValidator, field string, value int) {
+	if value <= 0 {
+		v.add(field, "shop.invalid.notPositive")
+		return
+	}
+	v.between(field, value, l.min, l.max)
+	v.multipleOf(field, value, l.step)
+}
+
+// ValidateCustomOrder checks a custom order's data amount and duration against
+// the configured limits and steps.
+func (s *ShopService) ValidateCustomOrder(dataGB, days int) error {
+	gbLimits, dayLimits := s.customOrderLimits()
+	v := &shopValidator{}
+	gbLimits.check(v, "customDataGb", dataGB)
+	dayLimits.check(v, "customDays", days)
+	return v.err()
+}
+
+// CustomOrderPresets returns the data amounts and durations the bot offers as
+// quick picks for custom orders. Presets outside the current limits are left out.
+func (s *ShopService) CustomOrderPresets() (gb, days []int) {
+	gbLimits, dayLimits := s.customOrderLimits()
+	gbPresets, _ := s.settingService.GetShopPresetsGB()
+	dayPresets, _ := s.settingService.GetShopPresetsDays()
+	return gbLimits.filter(parseShopPresets(gbPresets)), dayLimits.filter(parseShopPresets(dayPresets))
+}
+
+func (l customOrderLimits) filter(values []int) []int {
+	var valid []int
+	for _, value := range values {
+		v := &shopValidator{}
+		l.check(v, "", value)
+		if len(v.fields) == 0 {
+			valid = append(valid, value)
+		}
+	}
+	return valid
+}
+
+// parseShopPresets reads a comma-separated list of presets. Entries that are
+// not whole numbers are returned as -1 so they fail validation.
+func parseShopPresets(value string) []int {
+	var presets []int
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			n = -1
+		}
+		presets = append(presets, n)
+	}
+	return presets
+}
+
+// validateShopSettings checks the shop part of the panel settings.
+func validateShopSettings(settings *entity.AllSetting) error {
+	v := &shopValidator{}
+	if settings.ShopCurrency != "" && !slices.Contains(ShopCurrencies, settings.ShopCurrency) {
+		v.add("currency", "shop.invalid.choice")
+	} else if allowed, err := currencyChangeAllowed(settings.ShopCurrency); err != nil {
+		return err
+	} else if !allowed {
+		v.add("currency", "shop.invalid.currencyInUse")
+	}
+	v.nonNegative("pricePerGb", int64(settings.ShopPricePerGB))
+	v.nonNegative("secondApprovalPrice", int64(settings.ShopSecondApprovalPrice))
+	if _, err := parseAdminAllowedIps(settings.ShopAdminAllowedIps); err != nil {
+		v.add("adminAllowedIps", "shop.invalid.ipList")
+	}
+	if _, err := parseAdminAllowedCountries(settings.ShopAdminAllowedCountries); err != nil {
+		v.add("adminAllowedCountries", "shop.invalid.countryList")
+	}
+	if settings.ShopMinGB > 0 && settings.ShopMaxGB > 0 && settings.ShopMinGB > settings.ShopMaxGB {
+		v.add("customDataGb", "shop.invalid.aboveMax", "Max=="+strconv.Itoa(settings.ShopMaxGB))
+	}
+	if settings.ShopMinDays > 0 && settings.ShopMaxDays > 0 && settings.ShopMinDays > settings.ShopMaxDays {
+		v.add("customDays", "shop.invalid.aboveMax", "Max=="+strconv.Itoa(settings.ShopMaxDays))
+	}
+	v.nonNegative("stepGb", int64(settings.ShopStepGB))
+	v.nonNegative("stepDays", int64(settings.ShopStepDays))
+	gb := customOrderLimits{settings.ShopMinGB, settings.ShopMaxGB, max(settings.ShopStepGB, 0)}
+	days := customOrderLimits{settings.ShopMinDays, settings.ShopMaxDays, max(settings.ShopStepDays, 0)}
+	validatePresets(v, "presetsGb", settings.ShopPresetsGB, gb)
+	validatePresets(v, "presetsDays", settings.ShopPresetsDays, days)
+	validateNamePattern(v, "emailPattern", settings.ShopEmailPattern)
+	validateNamePattern(v, "subIdPattern", settings.ShopSubIdPattern)
+	v.nonNegative("shortLinkDays", int64(settings.ShopShortLinkDays))
+	v.nonNegative("pausesPerCycle", int64(settings.ShopPausesPerCycle))
+	// A gateway checks the public URL already, as its callbacks need it too.
+	if settings.ShopShortLinks && settings.ShopGateway == "" {
+		if u, err := url.Parse(settings.ShopPublicUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("publicUrl", "shop.invalid.url")
+		}
+	}
+	if settings.ShopSyncPrimaryUrl != "" {
+		if u, err := url.Parse(settings.ShopSyncPrimaryUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("syncPrimaryUrl", "shop.invalid.url")
+		}
+		v.text("syncToken", settings.ShopSyncToken, true, shopValueMaxLength)
+		v.positive("syncMinutes", int64(settings.ShopSyncMinutes))
+	}
+	v.text("catalogToken", settings.ShopCatalogToken, false, shopValueMaxLength)
+	if settings.ShopCaptchaProvider != "" {
+		if _, ok := shopCaptchaVerifyURLs[settings.ShopCaptchaProvider]; !ok {
+			v.add("captchaProvider", "shop.invalid.choice")
+		}
+		v.text("captchaSiteKey", settings.ShopCaptchaSiteKey, true, shopValueMaxLength)
+		v.text("captchaSecret", settings.ShopCaptchaSecret, true, shopValueMaxLength)
+	}
+	switch settings.ShopTgPayments {
+	case "":
+	case TgPaymentStars:
+		if rate, err := strconv.ParseFloat(strings.TrimSpace(settings.ShopStarsPerUnit), 64); err != nil || rate <= 0 {
+			v.add("starsPerUnit", "shop.invalid.notPositive")
+		}
+	case TgPaymentProvider:
+		v.text("tgProviderToken", settings.ShopTgProviderToken, true, shopValueMaxLength)
+	default:
+		v.add("tgPayments", "shop.invalid.choice")
+	}
+	if settings.ShopLightningBackend != "" {
+		if getShopLightningBackend(settings.ShopLightningBackend) == nil {
+			v.add("lightningBackend", "shop.invalid.choice")
+		}
+		if u, err := url.Parse(settings.ShopLightningUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("lightningUrl", "shop.invalid.url")
+		}
+		v.text("lightningApiKey", settings.ShopLightningApiKey, true, shopValueMaxLength)
+		if rate, err := strconv.ParseFloat(strings.TrimSpace(settings.ShopSatsPerUnit), 64); err != nil || rate <= 0 {
+			v.add("satsPerUnit", "shop.invalid.notPositive")
+		}
+	}
+	if settings.ShopGateway != "" {
+		if getShopPaymentGateway(settings.ShopGateway) == nil {
+			v.add("gateway", "shop.invalid.choice")
+		}
+		v.text("gatewayAccount", settings.ShopGatewayAccount, true, shopValueMaxLength)
+		v.text("gatewaySecret", settings.ShopGatewaySecret, true, shopValueMaxLength)
+		v.text("gatewayCurrency", settings.ShopGatewayCurrency, true, shopValueMaxLength)
+		if rate, err := strconv.ParseFloat(strings.TrimSpace(settings.ShopGatewayRate), 64); err != nil || rate <= 0 {
+			v.add("gatewayRate", "shop.invalid.notPositive")
+		}
+		if u, err := url.Parse(settings.ShopPublicUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("publicUrl", "shop.invalid.url")
+		}
+	}
+	v.nonNegative("lowStockThreshold", int64(settings.ShopLowStockThreshold))
+	v.nonNegative("inboundAlertPercent", int64(settings.ShopInboundAlertPercent))
+	v.between("inboundAlertPercent", settings.ShopInboundAlertPercent, 0, 100)
+	return v.err()
+}
+
+// validatePresets checks that every preset in the list is a valid custom order
+// amount, reporting the first one that is not.
+func validatePresets(v *shopValidator, field, value string, limits customOrderLimits) {
+	for _, preset := range parseShopPresets(value) {
+		if preset <= 0 {
+			v.add(field, "shop.invalid.list")
+			return
+		}
+		check := &shopValidator{}
+		limits.check(check, field, preset)
+		if len(check.fields) > 0 {
+			v.fields = append(v.fields, check.fields[0])
+			return
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package service
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/mhsanaei/3x-ui/v2/database"
+	"github.com/mhsanaei/3x-ui/v2/database/model"
+
+	"gorm.io/gorm"
+)
+
+// shopOrderStatusCodePattern matches the codes of admin-defined order statuses.
+var shopOrderStatusCodePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]{1,31}$`)
+
+// builtinOrderStatuses are the statuses the shop itself moves orders through.
+var builtinOrderStatuses = []string{
+	OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusOnHold, OrderStatusScheduled, OrderStatusProvisioning, OrderStatusApproved, OrderStatusRejected,
+	OrderStatusChargeback,
+}
+
+// Built-in statuses a workflow transition may start from or lead to. Orders
+// are still approved and provisioned only from PENDING_REVIEW, so a custom
+// status leads back there before approval; rejecting works from any status.
+var (
+	shopWorkflowSources = []string{OrderStatusPendingReceipt, OrderStatusPendingReview, OrderStatusRejected}
+	shopWorkflowTargets = []string{OrderStatusPendingReceipt, OrderStatusPendingReview}
+)
+
+var (
+	// ErrOrderStatusInUse is returned when deleting a status orders are still in.
+	ErrOrderStatusInUse = errors.New("orders are still in this status")
+	// ErrTransitionNotAllowed is returned when the workflow has no move between
+	// an order's status and the requested one.
+	ErrTransitionNotAllowed = errors.New("the workflow does not allow this status change")
+)
+
+// ListOrderStatuses returns the admin-defined order statuses with the
+// transitions into and out of each.
+func (s *ShopService) ListOrderStatuses() ([]model.ShopOrderStatus, error) {
+	db := database.GetShopDB()
+	statuses := []model.ShopOrderStatus{}
+	if err := db.Order("code asc").Find(&statuses).Error; err != nil {
+		return nil, err
+	}
+	var transitions []model.ShopOrderTransition
+	if err := db.Find(&transitions).Error; err != nil {
+		return nil, err
+	}
+	for i := range statuses {
+		statuses[i].From, statuses[i].To = []string{}, []string{}
+		for _, t := range transitions {
+			if t.ToStatus == statuses[i].Code {
+				statuses[i].From = append(statuses[i].From, t.FromStatus)
+			}
+			if t.FromStatus == statuses[i].Code {
+				statuses[i].To = append(statuses[i].To, t.ToStatus)
+			}
+		}
+		slices.Sort(statuses[i].From)
+		slices.Sort(statuses[i].To)
+	}
+	return statuses, nil
+}
+
+// GetOrderStatus returns the admin-defined status with code, or nil for a
+// built-in or unknown one.
+func (s *ShopService) GetOrderStatus(code string) *model.ShopOrderStatus {
+	status := &model.ShopOrderStatus{}
+	if err := database.GetShopDB().Where("code = ?", code).Limit(1).Find(status).Error; err != nil || status.Id == 0 {
+		return nil
+	}
+	return status
+}
+
+// validateOrderStatus checks an admin-defined status and its transitions. A
+// transition may connect it with other custom statuses and the built-in
+// statuses of shopWorkflowSources and shopWorkflowTargets.
+func (s *ShopService) validateOrderStatus(status *model.ShopOrderStatus) error {
+	v := &shopValidator{}
+	if !shopOrderStatusCodePattern.MatchString(status.Code) || slices.Contains(builtinOrderStatuses, status.Code) {
+		v.add("code", "shop.invalid.statusCode")
+	}
+	v.text("label", status.Label, true, shopNameMaxLength)
+	v.text("color", status.Color, false, 32)
+
+	var custom []string
+	if err := database.GetShopDB().Model(&model.ShopOrderStatus{}).Where("code <> ?", status.Code).Pluck("code", &custom).Error; err != nil {
+		return err
+	}
+	for _, from := range status.From {
+		if !slices.Contains(custom, from) && !slices.Contains(shopWorkflowSources, from) {
+			v.add("from", "shop.invalid.choice")
+			break
+		}
+	}
+	for _, to := range status.To {
+		if !slices.Contains(custom, to) && !slices.Contains(shopWorkflowTargets, to) {
+			v.add("to", "shop.invalid.choice")
+			break
+		}
+	}
+	return v.err()
+}
+
+// SaveOrderStatus creates a status, or updates it when it has an ID, and
+// replaces its transitions. The code of an existing status cannot change, as
+// orders may be in it.
+func (s *ShopService) SaveOrderStatus(status *model.ShopOrderStatus) error {
+	if status.Id != 0 {
+		existing := &model.ShopOrderStatus{}
+		if err := database.GetShopDB().First(existing, status.Id).Error; err != nil {
+			return err
+		}
+		status.Code = existing.Code
+	}
+	if err := s.validateOrderStatus(status); err != nil {
+		return err
+	}
+	slices.Sort(status.From)
+	status.From = slices.Compact(status.From)
+	slices.Sort(status.To)
+	status.To = slices.Compact(status.To)
+	status.UpdatedAt = time.Now()
+	return database.GetShopDB().Transaction(func(tx *gorm.DB) error {
+		if status.Id == 0 {
+			status.CreatedAt = time.Now()
+			if err := tx.Create(status).Error; err != nil {
+				return err
+			}
+		} else {
+			err := tx.Model(&model.ShopOrderStatus{}).Where("id = ?", status.Id).
+				Select("label", "color", "notify_customer", "updated_at").Updates(status).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("from_status = ? OR to_status = ?", status.Code, status.Code).Delete(&model.ShopOrderTransition{}).Error; err != nil {
+			return err
+		}
+		transitions := []model.ShopOrderTransition{}
+		for _, from := range status.From {
+			transitions = append(transitions, model.ShopOrderTransition{FromStatus: from, ToStatus: status.Code})
+		}
+		for _, to := range status.To {
+			transitions = append(transitions, model.ShopOrderTransition{FromStatus: status.Code, ToStatus: to})
+		}
+		if len(transitions) == 0 {
+			return nil
+		}
+		return tx.Create(&transitions).Error
+	})
+}
+
+// DeleteOrderStatus removes a status and its transitions once no order is in it.
+func (s *ShopService) DeleteOrderStatus(id int) error {
+	status := &model.ShopOrderStatus{}
+	db := database.GetShopDB()
+	if err := db.First(status, id).Error; err != nil {
+		return err
+	}
+	var inUse int64
+	if err := db.Model(&model.ShopOrder{}).Where("status = ?", status.Code).Count(&inUse).Error; err != nil {
+		return err
+	}
+	if inUse > 0 {
+		return ErrOrderStatusInUse
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("from_status = ? OR to_status = ?", status.Code, status.Code).Delete(&model.ShopOrderTransition{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(status).Error
+	})
+}
+
+// TransitionOrder moves an order to another status along the workflow. It
+// returns the updated order and, when the new status is admin-defined, that
+// status so the caller can notify the customer.
+func (s *ShopService) TransitionOrder(id int, to string) (*model.ShopOrder, *model.ShopOrderStatus, error) {
+	order, err := s.GetOrder(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	db := database.GetShopDB()
+	var allowed int64
+	err = db.Model(&model.ShopOrderTransition{}).Where("from_status = ? AND to_status = ?", order.Status, to).Count(&allowed).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	if allowed == 0 {
+		return nil, nil, ErrTransitionNotAllowed
+	}
+	result := db.Model(&model.ShopOrder{}).Where("id = ? AND status = ?", id, order.Status).
+		Updates(map[string]any{"status": to, "updated_at": time.Now()})
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil, errors.New("order status changed meanwhile")
+	}
+	order.Status = to
+	publishOrderStatus(id, to)
+	return order, s.GetOrderStatus(to), nil
+}
@@ -3,12 +3,15 @@ package service
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"maps"
 	"math/big"
 	"net"
 	"net/http"
@@ -16,6 +19,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +36,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/mymmrac/telego"
+	ta "github.com/mymmrac/telego/telegoapi"
 	th "github.com/mymmrac/telego/telegohandler"
 	tu "github.com/mymmrac/telego/telegoutil"
 	"github.com/skip2/go-qrcode"
@@ -40,7 +45,19 @@ import (
 )
 
 var (
-	bot *telego.Bot
+	// ErrBotWebhookOff is returned for updates posted while the bot does not
+	// run in webhook mode.
+	ErrBotWebhookOff = errors.New("bot is not in webhook mode")
+	// ErrBotWebhookSecret is returned for updates posted without the webhook
+	// secret.
+	ErrBotWebhookSecret = errors.New("invalid webhook secret")
+)
+
+var (
+	// bot is the running bot instance. A reload replaces it while handlers may
+	// still be sending, so it is read through currentBot.
+	bot   *telego.Bot
+	botMu sync.RWMutex
 
 	// botCancel stores the function to cancel the context, stopping Long Polling gracefully.
 	botCancel context.CancelFunc
@@ -55,9 +72,34 @@ var (
 	hostname    string
 	hashStorage *global.HashStorage
 
+	// botI18nFS holds the translations the bot was started with, to start it
+	// again when its settings change.
+	botI18nFS embed.FS
+	// botConnection is the token, proxy, API server and webhook the running bot uses.
+	botConnection string
+	// botReloadMu serializes bot reloads.
+	botReloadMu sync.Mutex
+
+	// botWebhook receives the updates Telegram posts to the panel while the
+	// bot runs in webhook mode, which must carry botWebhookSecret. The bot
+	// stops only once no update is being handed to it.
+	botWebhook       telego.WebhookHandler
+	botWebhookSecret string
+	botWebhookMu     sync.RWMutex
+
 	// Performance improvements
-	messageWorkerPool   chan struct{} // Semaphore for limiting concurrent message processing
-	optimizedHTTPClient *http.Client  // HTTP client with connection pooling and timeouts
+	messageWorkerPool chan struct{} // Semaphore for limiting concurrent message processing
+	// HTTP client with connection pooling and timeouts, shared by every bot
+	// instance so reloads never replace it under running handlers.
+	optimizedHTTPClient = &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     30 * time.Second,
+			DisableKeepAlives:   false,
+		},
+	}
 
 	// Simple cache for frequently accessed data
 	statusCache struct {
@@ -94,15 +136,31 @@ var (
 var userStates = make(map[int64]string)
 
 type shopDraft struct {
-	InboundId int
-	PackageId int
-	CustomGB  int
-	CustomDays int
-	Price     int64
+	NodeId      int
+	InboundId   int
+	PackageId   int
+	CustomGB    int
+	CustomDays  int
+	Price       int64
+	TopUpEmails []string          // Clients offered as top-up targets, indexed by shop_topup callbacks
+	Cart        []int             // Packages added with shop_cart_add, bought together at checkout
+	LinkedPkgId int               // Package a pkg_ deep link opened, offered once an inbound is chosen
+	Checkout    string            // Order being checked out, one of the shopCheckout kinds
+	Answers     map[string]string // Checkout field answers by field label, empty when skipped
 }
 
+// Kinds of orders the checkout fields are asked for before they are placed.
+const (
+	shopCheckoutPackage = "pkg"
+	shopCheckoutCustom  = "custom"
+	shopCheckoutCart    = "cart"
+)
+
 var shopDrafts = make(map[int64]*shopDraft)
 
+// shopOrderPackageTypes are the package types sold through the new order flow.
+var shopOrderPackageTypes = []string{PackageTypeStandard, PackageTypePooled}
+
 // LoginStatus represents the result of a login attempt.
 type LoginStatus byte
 
@@ -116,12 +174,14 @@ const (
 // Tgbot provides business logic for Telegram bot integration.
 // It handles bot commands, user interactions, and status reporting via Telegram.
 type Tgbot struct {
-	inboundService InboundService
-	settingService SettingService
-	serverService  ServerService
-	xrayService    XrayService
-	shopService    ShopService
-	lastStatus     *Status
+	inboundService  InboundService
+	settingService  SettingService
+	serverService   ServerService
+	xrayService     XrayService
+	shopService     ShopService
+	shopNodeService ShopNodeService
+	emailService    EmailService
+	lastStatus      *Status
 }
 
 // NewTgbot creates a new Tgbot instance.
@@ -186,26 +246,22 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 	if err != nil {
 		return err
 	}
+	t.SetI18nFS(i18nFS)
 
 	// If Start is called again (e.g. during reload), ensure any previous long-polling
 	// loop is stopped before creating a new bot / receiver.
 	StopBot()
 
-	// Initialize hash storage to store callback queries
-	hashStorage = global.NewHashStorage(20 * time.Minute)
-
-	// Initialize worker pool for concurrent message processing (max 10 concurrent handlers)
-	messageWorkerPool = make(chan struct{}, 10)
+	// Initialize hash storage to store callback queries. A reload keeps it, so
+	// buttons sent before still work.
+	if hashStorage == nil {
+		hashStorage = global.NewHashStorage(20 * time.Minute)
+	}
 
-	// Initialize optimized HTTP client with connection pooling
-	optimizedHTTPClient = &http.Client{
-		Timeout: 15 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     30 * time.Second,
-			DisableKeepAlives:   false,
-		},
+	// Initialize worker pool for concurrent message processing (max 10 concurrent handlers).
+	// Handlers still running from before a reload release their worker to it.
+	if messageWorkerPool == nil {
+		messageWorkerPool = make(chan struct{}, 10)
 	}
 
 	t.SetHostname()
@@ -224,17 +280,10 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 		return err
 	}
 
-	parsedAdminIds := make([]int64, 0)
-	// Parse admin IDs from comma-separated string
-	if tgBotID != "" {
-		for _, adminID := range strings.Split(tgBotID, ",") {
-			id, err := strconv.ParseInt(adminID, 10, 64)
-			if err != nil {
-				logger.Warning("Failed to parse admin ID from Telegram bot chat ID:", err)
-				return err
-			}
-			parsedAdminIds = append(parsedAdminIds, int64(id))
-		}
+	parsedAdminIds, err := parseAdminIds(tgBotID)
+	if err != nil {
+		logger.Warning("Failed to parse admin ID from Telegram bot chat ID:", err)
+		return err
 	}
 	tgBotMutex.Lock()
 	adminIds = parsedAdminIds
@@ -253,24 +302,20 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 	}
 
 	// Create new Telegram bot instance
-	bot, err = t.NewBot(tgBotToken, tgBotProxy, tgBotAPIServer)
+	newBot, err := t.NewBot(tgBotToken, tgBotProxy, tgBotAPIServer)
 	if err != nil {
 		logger.Error("Failed to initialize Telegram bot API:", err)
 		return err
 	}
+	botMu.Lock()
+	bot = newBot
+	botMu.Unlock()
+	tgBotMutex.Lock()
+	botConnection = t.botConnectionKey(tgBotToken, tgBotProxy, tgBotAPIServer)
+	tgBotMutex.Unlock()
 
 	// After bot initialization, set up bot commands with localized descriptions
-	err = bot.SetMyCommands(context.Background(), &telego.SetMyCommandsParams{
-		Commands: []telego.BotCommand{
-			{Command: "start", Description: t.I18nBot("tgbot.commands.startDesc")},
-			{Command: "help", Description: t.I18nBot("tgbot.commands.helpDesc")},
-			{Command: "status", Description: t.I18nBot("tgbot.commands.statusDesc")},
-			{Command: "id", Description: t.I18nBot("tgbot.commands.idDesc")},
-		},
-	})
-	if err != nil {
-		logger.Warning("Failed to set bot commands:", err)
-	}
+	t.registerCommands(nil)
 
 	// Start receiving Telegram bot messages
 	tgBotMutex.Lock()
@@ -278,12 +323,166 @@ func (t *Tgbot) Start(i18nFS embed.FS) error {
 	tgBotMutex.Unlock()
 	if !alreadyRunning {
 		logger.Info("Telegram bot receiver started")
+		t.restoreShopConversations()
 		go t.OnReceive()
 	}
 
 	return nil
 }
 
+// parseAdminIds parses the comma-separated chat IDs of the bot admins.
+func parseAdminIds(value string) ([]int64, error) {
+	ids := make([]int64, 0)
+	if value == "" {
+		return ids, nil
+	}
+	for _, adminID := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(adminID, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// SetI18nFS keeps the translations the bot starts with, so Reload can start
+// it when it was off at launch.
+func (t *Tgbot) SetI18nFS(i18nFS embed.FS) {
+	tgBotMutex.Lock()
+	defer tgBotMutex.Unlock()
+	botI18nFS = i18nFS
+}
+
+// botConnectionKey returns what tells whether the bot must be restarted to
+// use the given token, proxy and API server and the configured webhook.
+func (t *Tgbot) botConnectionKey(token, proxy, apiServer string) string {
+	webhookUrl, _ := t.settingService.GetTgBotWebhookUrl()
+	webhookSecret, _ := t.settingService.GetTgBotWebhookSecret()
+	return strings.Join([]string{token, proxy, apiServer, webhookUrl, webhookSecret}, "\n")
+}
+
+// Reload applies changed bot settings without a panel restart. A new token,
+// proxy, API server or webhook restarts the receiver; new admin IDs are taken
+// over in place.
+// Shop conversations in progress are kept, as they live beyond the receiver.
+func (t *Tgbot) Reload() error {
+	botReloadMu.Lock()
+	defer botReloadMu.Unlock()
+
+	enabled, err := t.settingService.GetTgbotEnabled()
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		if t.IsRunning() {
+			t.Stop()
+		}
+		return nil
+	}
+	token, err := t.settingService.GetTgBotToken()
+	if err != nil {
+		return err
+	}
+	proxy, _ := t.settingService.GetTgBotProxy()
+	apiServer, _ := t.settingService.GetTgBotAPIServer()
+	tgBotMutex.Lock()
+	connection, i18nFS := botConnection, botI18nFS
+	tgBotMutex.Unlock()
+	if !t.IsRunning() || connection != t.botConnectionKey(token, proxy, apiServer) {
+		logger.Info("Telegram bot settings changed, restarting the bot")
+		return t.Start(i18nFS)
+	}
+
+	chatIds, err := t.settingService.GetTgBotChatId()
+	if err != nil {
+		return err
+	}
+	ids, err := parseAdminIds(chatIds)
+	if err != nil {
+		return err
+	}
+	tgBotMutex.Lock()
+	previous := adminIds
+	adminIds = ids
+	tgBotMutex.Unlock()
+	t.registerCommands(previous)
+	return nil
+}
+
+// BotCommandNames are the commands the bot menus may list, in menu order.
+var BotCommandNames = []string{"start", "shop", "orders", "balance", "support", "rotate", "pause", "mydata", "forgetme", "help", "status", "usage", "inbound", "restart", "broadcast", "id"}
+
+// parseBotCommands parses a comma-separated list of bot commands, keeping
+// the order of BotCommandNames.
+func parseBotCommands(value string) ([]string, error) {
+	listed := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "/")
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(BotCommandNames, name) {
+			return nil, common.NewError("unknown Telegram bot command:", name)
+		}
+		listed[name] = true
+	}
+	names := make([]string, 0, len(listed))
+	for _, name := range BotCommandNames {
+		if listed[name] {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// registerCommands sets the command menus Telegram shows: the customer
+// commands in private chats, and the admin commands in the chats of the
+// admins. Chats of former admins get the customer menu back.
+func (t *Tgbot) registerCommands(formerAdminIds []int64) {
+	customer, _ := t.settingService.GetTgBotCustomerCommands()
+	admin, _ := t.settingService.GetTgBotAdminCommands()
+	tgBotMutex.Lock()
+	ids := slices.Clone(adminIds)
+	tgBotMutex.Unlock()
+
+	t.setCommands(customer, tu.ScopeAllPrivateChats())
+	for _, id := range ids {
+		t.setCommands(admin, tu.ScopeChat(tu.ID(id)))
+	}
+	for _, id := range formerAdminIds {
+		if slices.Contains(ids, id) {
+			continue
+		}
+		err := currentBot().DeleteMyCommands(context.Background(), &telego.DeleteMyCommandsParams{Scope: tu.ScopeChat(tu.ID(id))})
+		if err != nil {
+			logger.Warning("Failed to delete bot commands:", err)
+		}
+	}
+}
+
+// setCommands lists the comma-separated commands in the menu of a scope, with
+// descriptions in the bot language.
+func (t *Tgbot) setCommands(value string, scope telego.BotCommandScope) {
+	names, err := parseBotCommands(value)
+	if err != nil {
+		logger.Warning("Failed to set bot commands:", err)
+		return
+	}
+	if len(names) == 0 {
+		err = currentBot().DeleteMyCommands(context.Background(), &telego.DeleteMyCommandsParams{Scope: scope})
+	} else {
+		commands := make([]telego.BotCommand, 0, len(names))
+		for _, name := range names {
+			commands = append(commands, telego.BotCommand{Command: name, Description: t.I18nBot("tgbot.commands." + name + "Desc")})
+		}
+		err = currentBot().SetMyCommands(context.Background(), &telego.SetMyCommandsParams{Commands: commands, Scope: scope})
+	}
+	if err != nil {
+		logger.Warning("Failed to set bot commands:", err)
+	}
+}
+
 // NewBot creates a new Telegram bot instance with optional proxy and API server settings.
 func (t *Tgbot) NewBot(token string, proxyUrl string, apiServerUrl string) (*telego.Bot, error) {
 	if proxyUrl == "" && apiServerUrl == "" {
@@ -321,6 +520,14 @@ func (t *Tgbot) NewBot(token string, proxyUrl string, apiServerUrl string) (*tel
 	return telego.NewBot(token, telego.WithAPIServer(apiServerUrl))
 }
 
+// currentBot returns the bot instance the last start created, nil before the
+// bot first started.
+func currentBot() *telego.Bot {
+	botMu.RLock()
+	defer botMu.RUnlock()
+	return bot
+}
+
 // IsRunning checks if the Telegram bot is currently running.
 func (t *Tgbot) IsRunning() bool {
 	tgBotMutex.Lock()
@@ -361,13 +568,18 @@ func StopBot() {
 	isRunning = false
 	tgBotMutex.Unlock()
 
+	// Refuse new webhook updates before the handler stops reading them.
+	botWebhookMu.Lock()
+	botWebhook, botWebhookSecret = nil, ""
+	botWebhookMu.Unlock()
+
 	if handler != nil {
 		handler.Stop()
 	}
 
 	if cancel != nil {
 		logger.Info("Sending cancellation signal to Telegram bot...")
-		// Cancels the context passed to UpdatesViaLongPolling; this closes updates channel
+		// Cancels the context passed to UpdatesViaLongPolling or UpdatesViaWebhook; this closes updates channel
 		// and lets botHandler.Start() exit cleanly.
 		cancel()
 		botWG.Wait()
@@ -401,9 +613,6 @@ func (t *Tgbot) decodeQuery(query string) (string, error) {
 
 // OnReceive starts the message receiving loop for the Telegram bot.
 func (t *Tgbot) OnReceive() {
-	params := telego.GetUpdatesParams{
-		Timeout: 30, // Increased timeout to reduce API calls
-	}
 	// Strict singleton: never start a second long-polling loop.
 	tgBotMutex.Lock()
 	if botCancel != nil || isRunning {
@@ -421,10 +630,20 @@ func (t *Tgbot) OnReceive() {
 	tgBotMutex.Unlock()
 
 	// Get updates channel using the context.
-	updates, _ := bot.UpdatesViaLongPolling(ctx, &params)
+	updates, err := t.receiveUpdates(ctx)
+	if err != nil {
+		logger.Error("Failed to receive Telegram bot updates:", err)
+		tgBotMutex.Lock()
+		botCancel = nil
+		isRunning = false
+		tgBotMutex.Unlock()
+		cancel()
+		botWG.Done()
+		return
+	}
 	go func() {
 		defer botWG.Done()
-		h, _ := th.NewBotHandler(bot, updates)
+		h, _ := th.NewBotHandler(currentBot(), updates)
 		tgBotMutex.Lock()
 		botHandler = h
 		tgBotMutex.Unlock()
@@ -440,6 +659,12 @@ func (t *Tgbot) OnReceive() {
 			go func() {
 				messageWorkerPool <- struct{}{}        // Acquire worker
 				defer func() { <-messageWorkerPool }() // Release worker
+				defer observeBotUpdate("command", time.Now())
+
+				defer t.persistShopConversation(message.Chat.ID)
+				if t.rateLimited(message.Chat.ID, message.From.ID) || t.shopCustomerBanned(message.Chat.ID, message.From) {
+					return
+				}
 
 				delete(userStates, message.Chat.ID)
 				t.answerCommand(&message, message.Chat.ID, checkAdmin(message.From.ID))
@@ -452,6 +677,12 @@ func (t *Tgbot) OnReceive() {
 			go func() {
 				messageWorkerPool <- struct{}{}        // Acquire worker
 				defer func() { <-messageWorkerPool }() // Release worker
+				defer observeBotUpdate("callback", time.Now())
+
+				defer t.persistShopConversation(query.Message.GetChat().ID)
+				if t.rateLimited(query.Message.GetChat().ID, query.From.ID) || t.shopCustomerBanned(query.Message.GetChat().ID, &query.From) {
+					return
+				}
 
 				delete(userStates, query.Message.GetChat().ID)
 				t.answerCallback(&query, checkAdmin(query.From.ID))
@@ -459,87 +690,122 @@ func (t *Tgbot) OnReceive() {
 			return nil
 		}, th.AnyCallbackQueryWithMessage())
 
+		h.HandlePreCheckoutQuery(func(ctx *th.Context, query telego.PreCheckoutQuery) error {
+			t.answerShopPreCheckout(&query)
+			return nil
+		}, th.AnyPreCheckoutQuery())
+
+		h.HandleMessage(func(ctx *th.Context, message telego.Message) error {
+			go t.handleShopPayment(&message)
+			return nil
+		}, th.SuccessPayment())
+
 		h.HandleMessage(func(ctx *th.Context, message telego.Message) error {
+			defer observeBotUpdate("message", time.Now())
+			defer t.persistShopConversation(message.Chat.ID)
+			if t.rateLimited(message.Chat.ID, message.From.ID) || t.shopCustomerBanned(message.Chat.ID, message.From) {
+				return nil
+			}
 			if userState, exists := userStates[message.Chat.ID]; exists {
 				// Handle receipt uploads
 				if strings.HasPrefix(userState, "shop_receipt_") {
 					if len(message.Photo) == 0 {
-						t.SendMsgToTgbot(message.Chat.ID, "Please send a receipt photo.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.receiptPhotoRequired"))
 						return nil
 					}
 					orderIdStr := strings.TrimPrefix(userState, "shop_receipt_")
 					orderId, err := strconv.Atoi(orderIdStr)
 					if err != nil {
 						delete(userStates, message.Chat.ID)
-						t.SendMsgToTgbot(message.Chat.ID, "Invalid order reference.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.invalidOrderReference"))
+						return nil
+					}
+					if err := t.shopService.CheckRate(message.Chat.ID, RateKindReceipt); err != nil {
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.tooManyReceipts"))
+						return nil
+					}
+					if order, err := t.shopService.GetOrder(orderId); err == nil && order.Status == OrderStatusRejected {
+						delete(userStates, message.Chat.ID)
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.orderCancelled", "Order=="+OrderNumber(order)))
 						return nil
 					}
 					photo := message.Photo[len(message.Photo)-1]
 					path, err := t.saveReceiptPhoto(orderId, photo.FileID)
 					if err != nil {
-						t.SendMsgToTgbot(message.Chat.ID, "Failed to save receipt. Try again.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.receiptSaveFailed"))
 						return nil
 					}
 					if err := t.shopService.UpdateOrderReceipt(orderId, path, photo.FileID); err != nil {
-						t.SendMsgToTgbot(message.Chat.ID, "Failed to update receipt.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.receiptUpdateFailed"))
 						return nil
 					}
 					delete(userStates, message.Chat.ID)
-					t.SendMsgToTgbot(message.Chat.ID, "Receipt received. Waiting for admin approval.")
-					t.notifyAdminsOrderPending(orderId)
+					t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.receiptReceived"))
+					t.scanReceiptAndNotify(orderId)
+					return nil
+				}
+				if strings.HasPrefix(userState, "shop_ticket_") {
+					t.handleShopTicketMessage(&message, userState)
+					return nil
+				}
+				if after, ok := strings.CutPrefix(userState, "shop_hold_"); ok {
+					t.handleShopHoldAnswer(&message, after)
+					return nil
+				}
+				if after, ok := strings.CutPrefix(userState, "shop_field_"); ok {
+					fieldId, _ := strconv.Atoi(after)
+					t.answerShopCheckoutField(message.Chat.ID, message.From.Username, fieldId, message.Text)
 					return nil
 				}
 				switch userState {
 				case "shop_custom_gb":
 					gb, err := strconv.Atoi(strings.TrimSpace(message.Text))
 					if err != nil || gb <= 0 {
-						t.SendMsgToTgbot(message.Chat.ID, "Enter a valid number for GB.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.enterValidGB"))
 						return nil
 					}
 					draft := shopDrafts[message.Chat.ID]
 					if draft == nil || draft.InboundId == 0 {
 						delete(userStates, message.Chat.ID)
-						t.SendMsgToTgbot(message.Chat.ID, "Order session expired. Please start again.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.sessionExpired"))
 						return nil
 					}
 					draft.CustomGB = gb
 					userStates[message.Chat.ID] = "shop_custom_days"
-					t.SendMsgToTgbot(message.Chat.ID, "Enter duration in days:")
+					_, dayPresets := t.shopService.CustomOrderPresets()
+					t.askShopCustomAmount(message.Chat.ID, "shop.enterDays", dayPresets)
 					return nil
 				case "shop_custom_days":
 					days, err := strconv.Atoi(strings.TrimSpace(message.Text))
 					if err != nil || days <= 0 {
-						t.SendMsgToTgbot(message.Chat.ID, "Enter a valid number for days.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.enterValidDays"))
 						return nil
 					}
 					draft := shopDrafts[message.Chat.ID]
 					if draft == nil || draft.InboundId == 0 || draft.CustomGB == 0 {
 						delete(userStates, message.Chat.ID)
-						t.SendMsgToTgbot(message.Chat.ID, "Order session expired. Please start again.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.sessionExpired"))
 						return nil
 					}
 					draft.CustomDays = days
 					if err := t.shopService.ValidateCustomOrder(draft.CustomGB, draft.CustomDays); err != nil {
-						t.SendMsgToTgbot(message.Chat.ID, "Custom order is outside limits.")
+						t.sendShopOrderFailed(message.Chat.ID, err)
 						delete(userStates, message.Chat.ID)
 						return nil
 					}
 					price, err := t.shopService.CalculateCustomPrice(draft.CustomGB)
-					if err != nil {
-						t.SendMsgToTgbot(message.Chat.ID, "Pricing not configured.")
+					if errors.Is(err, ErrPriceOverflow) {
+						t.sendShopOrderFailed(message.Chat.ID, &ValidationError{Fields: []FieldError{{Field: "customDataGb", Key: "shop.invalid.priceRange"}}})
 						delete(userStates, message.Chat.ID)
 						return nil
 					}
-					draft.Price = price
-					orderId, err := t.createShopOrder(message.Chat.ID, draft, true)
 					if err != nil {
-						t.SendMsgToTgbot(message.Chat.ID, "Failed to create order.")
+						t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.pricingNotConfigured"))
 						delete(userStates, message.Chat.ID)
 						return nil
 					}
-					delete(userStates, message.Chat.ID)
-					userStates[message.Chat.ID] = "shop_receipt_" + strconv.Itoa(orderId)
-					t.SendMsgToTgbot(message.Chat.ID, fmt.Sprintf("Order #%d created. Price: %d. Please send receipt photo.", orderId, draft.Price))
+					draft.Price = price
+					t.startShopCheckout(message.Chat.ID, message.From.Username, shopCheckoutCustom)
 					return nil
 				case "awaiting_id":
 					if client_Id == strings.TrimSpace(message.Text) {
@@ -688,9 +954,61 @@ func (t *Tgbot) OnReceive() {
 	}()
 }
 
+// receiveUpdates starts getting the bot's updates until ctx is cancelled:
+// from Telegram posting them to the panel's tgbot/webhook route when a webhook
+// URL is set, and by long polling otherwise.
+func (t *Tgbot) receiveUpdates(ctx context.Context) (<-chan telego.Update, error) {
+	webhookUrl, err := t.settingService.GetTgBotWebhookUrl()
+	if err != nil {
+		return nil, err
+	}
+	b := currentBot()
+	if webhookUrl == "" {
+		// Telegram refuses to be polled while a webhook is set, as it is
+		// after leaving webhook mode.
+		if err := b.DeleteWebhook(ctx, &telego.DeleteWebhookParams{}); err != nil {
+			logger.Warning("Failed to delete Telegram bot webhook:", err)
+		}
+		return b.UpdatesViaLongPolling(ctx, &telego.GetUpdatesParams{
+			Timeout: 30, // Increased timeout to reduce API calls
+		})
+	}
+
+	secret, err := t.settingService.GetTgBotWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+	return b.UpdatesViaWebhook(ctx, func(handler telego.WebhookHandler) error {
+		botWebhookMu.Lock()
+		defer botWebhookMu.Unlock()
+		botWebhook, botWebhookSecret = handler, secret
+		return nil
+	}, telego.WithWebhookSet(ctx, &telego.SetWebhookParams{
+		URL:         strings.TrimRight(webhookUrl, "/") + "/tgbot/webhook",
+		SecretToken: secret,
+	}))
+}
+
+// ServeWebhook hands an update Telegram posted to the panel to the bot. It
+// fails with ErrBotWebhookOff unless the bot runs in webhook mode, and with
+// ErrBotWebhookSecret when secret is not the configured one.
+func (t *Tgbot) ServeWebhook(ctx context.Context, secret string, data []byte) error {
+	botWebhookMu.RLock()
+	defer botWebhookMu.RUnlock()
+	if botWebhook == nil {
+		return ErrBotWebhookOff
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(botWebhookSecret)) != 1 {
+		return ErrBotWebhookSecret
+	}
+	// The update is handled after the request ends.
+	return botWebhook(context.WithoutCancel(ctx), data)
+}
+
 // answerCommand processes incoming command messages from Telegram users.
 func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin bool) {
 	msg, onlyMessage := "", false
+	deepLink := ""
 
 	command, _, commandArgs := tu.ParseCommand(message.Text)
 
@@ -708,6 +1026,12 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		msg += t.I18nBot("tgbot.commands.start", "Firstname=="+message.From.FirstName)
 		if isAdmin {
 			msg += t.I18nBot("tgbot.commands.welcome", "Hostname=="+hostname)
+		} else {
+			t.detectShopLanguage(message.From)
+			msg += "\n\n" + t.shopMessage(chatId, t.settingService.GetShopMsgWelcome, "shop.welcome", map[string]string{"name": message.From.FirstName})
+			if len(commandArgs) > 0 {
+				deepLink = commandArgs[0]
+			}
 		}
 		msg += "\n\n" + t.I18nBot("tgbot.commands.pleaseChoose")
 	case "status":
@@ -727,6 +1051,22 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		} else {
 			msg += t.I18nBot("tgbot.commands.usage")
 		}
+	case "shop":
+		t.startShopOrder(chatId)
+	case "orders":
+		t.sendShopOrders(chatId, message.From.ID)
+	case "balance":
+		t.sendShopBalance(chatId, message.From.ID)
+	case "support":
+		t.startShopSupport(chatId, message.From.ID)
+	case "rotate":
+		t.sendShopRotateClients(chatId, message.From.ID)
+	case "pause":
+		t.sendShopPausePlans(chatId, message.From.ID)
+	case "mydata":
+		t.sendShopDataExport(chatId, message.From.ID)
+	case "forgetme":
+		t.askShopErasure(chatId)
 	case "inbound":
 		onlyMessage = true
 		if isAdmin && len(commandArgs) > 0 {
@@ -734,6 +1074,23 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 		} else {
 			handleUnknownCommand()
 		}
+	case "broadcast":
+		onlyMessage = true
+		if !isAdmin {
+			handleUnknownCommand()
+			break
+		}
+		segment, text := parseBroadcastCommand(message.Text)
+		if text == "" {
+			msg += "Usage: /broadcast [all|active|expired|pending|segment:<id>] message"
+			break
+		}
+		broadcast, err := t.StartBroadcast(segment, text)
+		if err != nil {
+			msg += "Broadcast failed: " + err.Error()
+			break
+		}
+		msg += fmt.Sprintf("Broadcast #%d started for %d customers.", broadcast.Id, broadcast.Recipients)
 	case "restart":
 		onlyMessage = true
 		if isAdmin {
@@ -762,6 +1119,53 @@ func (t *Tgbot) answerCommand(message *telego.Message, chatId int64, isAdmin boo
 	if msg != "" {
 		t.sendResponse(chatId, msg, onlyMessage, isAdmin)
 	}
+	if deepLink != "" {
+		t.openShopDeepLink(chatId, deepLink)
+	}
+}
+
+// BotUsername returns the bot's Telegram username, or "" when the bot is not
+// running. Deep links are built as t.me/<username>?start=<payload>.
+func (t *Tgbot) BotUsername() string {
+	b := currentBot()
+	if !t.IsRunning() || b == nil {
+		return ""
+	}
+	return b.Username()
+}
+
+// CheckBot tells whether the bot is running and Telegram accepts its token.
+// It returns ErrHealthCheckOff while the bot is turned off in the settings.
+func (t *Tgbot) CheckBot(ctx context.Context) error {
+	if enabled, err := t.settingService.GetTgbotEnabled(); err != nil || !enabled {
+		return ErrHealthCheckOff
+	}
+	b := currentBot()
+	if !t.IsRunning() || b == nil {
+		return errors.New("bot is not running")
+	}
+	_, err := b.GetMe(ctx)
+	return err
+}
+
+// openShopDeepLink handles the payload of a t.me/<bot>?start=<payload> link: it
+// counts the click, and a package link starts an order for that package.
+// Unknown payloads are ignored so old or mistyped links still just start the bot.
+func (t *Tgbot) openShopDeepLink(chatId int64, payload string) {
+	target, err := t.shopService.RecordDeepLinkClick(chatId, payload)
+	if err != nil {
+		if !errors.Is(err, ErrInvalidDeepLink) {
+			logger.WithFields(logger.Fields{"error": err}).Warning("record deep link failed")
+		}
+		return
+	}
+	if target.PackageId == 0 {
+		return
+	}
+	t.startShopOrder(chatId)
+	if draft := shopDrafts[chatId]; draft != nil {
+		draft.LinkedPkgId = target.PackageId
+	}
 }
 
 // sendResponse sends the response message based on the onlyMessage flag.
@@ -796,225 +1200,2421 @@ func (t *Tgbot) randomShadowSocksPassword() string {
 
 func (t *Tgbot) startShopOrder(chatId int64) {
 	delete(userStates, chatId)
+	if err := t.shopService.CheckOpen(); err != nil {
+		t.sendShopClosed(chatId)
+		return
+	}
+	if !t.checkShopChannel(chatId, "shop_new") {
+		return
+	}
 	shopDrafts[chatId] = &shopDraft{}
 	inbounds, err := t.shopService.ListInbounds()
 	if err != nil {
-		t.SendMsgToTgbot(chatId, "Failed to load inbounds.")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadInboundsFailed"))
 		return
 	}
 	var buttons []telego.InlineKeyboardButton
 	for _, ib := range inbounds {
-		if !ib.Enabled {
+		if !ib.Enabled || ib.Full {
 			continue
 		}
 		title := fmt.Sprintf("%s (%s@%d)", ib.Remark, ib.Protocol, ib.Port)
-		buttons = append(buttons, tu.InlineKeyboardButton(title).WithCallbackData(t.encodeQuery("shop_inbound "+strconv.Itoa(ib.Id))))
+		if ib.NodeName != "" {
+			title = ib.NodeName + " • " + title
+		}
+		buttons = append(buttons, tu.InlineKeyboardButton(title).WithCallbackData(t.encodeQuery(fmt.Sprintf("shop_inbound %d@%d", ib.Id, ib.NodeId))))
 	}
 	if len(buttons) == 0 {
-		t.SendMsgToTgbot(chatId, "No inbounds available for orders.")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noInbounds"))
 		return
 	}
 	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
-	t.SendMsgToTgbot(chatId, "Select an inbound:", keyboard)
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.selectInbound"), keyboard)
 }
 
-func (t *Tgbot) sendShopPackages(chatId int64) {
-	packages, err := t.shopService.ListPackages(true)
+// sendShopCategories shows the category menu, falling back to the plain
+// package list when no category has packages for sale.
+func (t *Tgbot) sendShopCategories(chatId int64) {
+	categories, err := t.shopService.ListCategories()
+	if err != nil || len(categories) == 0 {
+		t.sendShopPackages(chatId, nil)
+		return
+	}
+	packages, err := t.shopService.ListPackages(ShopPackageFilter{ActiveOnly: true, Types: shopOrderPackageTypes})
 	if err != nil {
-		t.SendMsgToTgbot(chatId, "Failed to load packages.")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPackagesFailed"))
 		return
 	}
-	var buttons []telego.InlineKeyboardButton
+	counts := map[int]int{}
 	for _, pkg := range packages {
-		label := fmt.Sprintf("%s (%dGB/%dd)", pkg.Name, pkg.DataGB, pkg.DurationDays)
-		buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData(t.encodeQuery("shop_pkg "+strconv.Itoa(pkg.Id))))
+		counts[pkg.CategoryId]++
+	}
+	var buttons []telego.InlineKeyboardButton
+	for _, category := range categories {
+		if counts[category.Id] == 0 {
+			continue
+		}
+		buttons = append(buttons, tu.InlineKeyboardButton(category.Name).WithCallbackData(t.encodeQuery("shop_cat "+strconv.Itoa(category.Id))))
+	}
+	if len(buttons) == 0 {
+		t.sendShopPackages(chatId, nil)
+		return
 	}
-	buttons = append(buttons, tu.InlineKeyboardButton("Custom").WithCallbackData("shop_custom"))
+	if counts[0] > 0 {
+		buttons = append(buttons, tu.InlineKeyboardButton(t.shopT(chatId, "shop.categoryOther")).WithCallbackData(t.encodeQuery("shop_cat 0")))
+	}
+	buttons = append(buttons, tu.InlineKeyboardButton(t.shopT(chatId, "shop.custom")).WithCallbackData("shop_custom"))
 	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
-	t.SendMsgToTgbot(chatId, "Choose a package or custom:", keyboard)
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.chooseCategory"), keyboard)
 }
 
-func (t *Tgbot) createShopOrder(chatId int64, draft *shopDraft, isCustom bool) (int, error) {
-	order := &model.ShopOrder{
-		TelegramId: chatId,
-		InboundId:  draft.InboundId,
-		Status:     OrderStatusPendingReceipt,
+// checkShopChannel reports whether the customer may order, asking them to join
+// the required channel first when they are not a member. retry is the callback
+// the "joined" button repeats. Errors from Telegram let the customer through so
+// a misconfigured channel does not stop sales.
+func (t *Tgbot) checkShopChannel(chatId int64, retry string) bool {
+	channel, err := t.settingService.GetShopRequiredChannel()
+	channel = strings.TrimSpace(channel)
+	if err != nil || channel == "" {
+		return true
+	}
+	chatID := tu.Username(channel)
+	if id, err := strconv.ParseInt(channel, 10, 64); err == nil {
+		chatID = tu.ID(id)
+	}
+	member, err := currentBot().GetChatMember(context.Background(), &telego.GetChatMemberParams{ChatID: chatID, UserID: chatId})
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("check channel membership failed")
+		return true
 	}
-
-	if isCustom {
-		order.CustomDataGB = draft.CustomGB
-		order.CustomDays = draft.CustomDays
-		order.Price = draft.Price
-	} else {
-		pkg, err := t.shopService.GetPackage(draft.PackageId)
-		if err != nil {
-			return 0, err
-		}
-		order.PackageId = &pkg.Id
-		order.Price = pkg.Price
-		order.CustomDataGB = 0
-		order.CustomDays = 0
+	if member.MemberIsMember() {
+		return true
 	}
 
-	if err := t.shopService.CreateOrder(order); err != nil {
-		return 0, err
+	link, _ := t.settingService.GetShopRequiredChannelLink()
+	if link == "" && strings.HasPrefix(channel, "@") {
+		link = "https://t.me/" + strings.TrimPrefix(channel, "@")
 	}
-	delete(shopDrafts, chatId)
-	return order.Id, nil
+	var rows [][]telego.InlineKeyboardButton
+	if link != "" {
+		rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton(t.shopT(chatId, "shop.joinChannelButton")).WithURL(link)))
+	}
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton(t.shopT(chatId, "shop.joinedButton")).WithCallbackData(t.encodeQuery(retry))))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.joinChannel"), tu.InlineKeyboard(rows...))
+	return false
 }
 
-func (t *Tgbot) sendShopOrders(chatId int64, tgId int64) {
-	orders, err := t.shopService.ListOrdersByTelegramId(tgId)
-	if err != nil || len(orders) == 0 {
-		t.SendMsgToTgbot(chatId, "No orders found.")
-		return
-	}
-	msg := "Your orders:\r\n"
-	for _, order := range orders {
-		msg += fmt.Sprintf("#%d • %s • %d\r\n", order.Id, order.Status, order.Price)
-	}
-	t.SendMsgToTgbot(chatId, msg)
+// sendShopClosed tells the customer that ordering is paused for maintenance.
+func (t *Tgbot) sendShopClosed(chatId int64) {
+	t.SendMsgToTgbot(chatId, t.shopMessage(chatId, t.settingService.GetShopClosedMessage, "shop.closed", nil))
 }
 
-func (t *Tgbot) notifyAdminsOrderPending(orderId int) {
-	order, err := t.shopService.GetOrder(orderId)
+func (t *Tgbot) sendShopPackages(chatId int64, categoryId *int) {
+	packages, err := t.shopService.ListPackages(ShopPackageFilter{ActiveOnly: true, CategoryId: categoryId, Types: shopOrderPackageTypes})
 	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPackagesFailed"))
 		return
 	}
-	msg := fmt.Sprintf("New receipt for order #%d\r\nTelegram ID: %d\r\nInbound: %d\r\nPrice: %d",
-		order.Id, order.TelegramId, order.InboundId, order.Price)
-	keyboard := tu.InlineKeyboard(
-		tu.InlineKeyboardRow(
-			tu.InlineKeyboardButton("Approve").WithCallbackData(t.encodeQuery("shop_approve "+strconv.Itoa(order.Id))),
-			tu.InlineKeyboardButton("Reject").WithCallbackData(t.encodeQuery("shop_reject "+strconv.Itoa(order.Id))),
-		),
-	)
-	for _, adminId := range adminIds {
-		t.SendMsgToTgbot(adminId, msg, keyboard)
+	var rows [][]telego.InlineKeyboardButton
+	for _, pkg := range packages {
+		if pkg.Description != "" || pkg.ImageUrl != "" {
+			t.sendShopPackageCard(chatId, &pkg)
+		}
+		label := t.shopT(chatId, "shop.packageLabel", "Name=="+pkg.Name, "GB=="+strconv.Itoa(pkg.DataGB), "Days=="+strconv.Itoa(pkg.DurationDays))
+		row := tu.InlineKeyboardRow(tu.InlineKeyboardButton(label).WithCallbackData(t.encodeQuery("shop_pkg " + strconv.Itoa(pkg.Id))))
+		if pkg.Type == PackageTypeStandard && pkg.BillingCycle == "" {
+			row = append(row, tu.InlineKeyboardButton(t.shopT(chatId, "shop.addToCart")).WithCallbackData(t.encodeQuery("shop_cart_add "+strconv.Itoa(pkg.Id))))
+		}
+		rows = append(rows, row)
+	}
+	if draft := shopDrafts[chatId]; draft != nil && len(draft.Cart) > 0 {
+		rows = append(rows, t.shopCartButtons(chatId, draft)...)
 	}
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton(t.shopT(chatId, "shop.custom")).WithCallbackData("shop_custom")))
+	t.SendMsgToTgbot(chatId, t.shopMessage(chatId, t.settingService.GetShopMsgPackages, "shop.choosePackage", nil), tu.InlineKeyboard(rows...))
 }
 
-func (t *Tgbot) saveReceiptPhoto(orderId int, fileId string) (string, error) {
-	token, err := t.settingService.GetTgBotToken()
-	if err != nil || token == "" {
-		return "", errors.New("bot token not configured")
+// shopCartTotal returns the price of the packages in a cart. Packages no longer
+// for sale are left out; checkout rejects them.
+func (t *Tgbot) shopCartTotal(draft *shopDraft) int64 {
+	total := int64(0)
+	for _, id := range draft.Cart {
+		if pkg, err := t.shopService.GetPackage(id); err == nil {
+			if sum, err := addPrice(total, pkg.Price); err == nil {
+				total = sum
+			}
+		}
 	}
-	type tgFileResp struct {
-		Ok     bool `json:"ok"`
-		Result struct {
-			FilePath string `json:"file_path"`
-		} `json:"result"`
+	return total
+}
+
+// shopCartButtons returns the checkout and clear buttons of a non-empty cart.
+func (t *Tgbot) shopCartButtons(chatId int64, draft *shopDraft) [][]telego.InlineKeyboardButton {
+	checkout := t.shopT(chatId, "shop.cartCheckout", "Count=="+strconv.Itoa(len(draft.Cart)), "Price=="+t.shopService.FormatPrice(t.shopCartTotal(draft)))
+	return [][]telego.InlineKeyboardButton{
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton(checkout).WithCallbackData("shop_cart_checkout")),
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton(t.shopT(chatId, "shop.cartClear")).WithCallbackData("shop_cart_clear")),
 	}
-	infoUrl := fmt.Sprintf("https://api.telegram.org/bot%s/getFile?file_id=%s", token, url.QueryEscape(fileId))
+}
+
+// addShopCartPackage adds a package to the customer's cart and shows the cart.
+func (t *Tgbot) addShopCartPackage(chatId int64, pkgId int) {
+	draft := shopDrafts[chatId]
+	if draft == nil || draft.InboundId == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.selectInboundFirst"))
+		return
+	}
+	if len(draft.Cart) >= ShopCartMaxItems {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.cartFull", "Max=="+strconv.Itoa(ShopCartMaxItems)))
+		return
+	}
+	pkg, err := t.shopService.CartPackage(pkgId)
+	if err != nil {
+		t.sendShopOrderFailed(chatId, err)
+		return
+	}
+	draft.Cart = append(draft.Cart, pkg.Id)
+	msg := t.shopT(chatId, "shop.cartAdded", "Name=="+html.EscapeString(pkg.Name), "Count=="+strconv.Itoa(len(draft.Cart)), "Price=="+t.shopService.FormatPrice(t.shopCartTotal(draft)))
+	t.SendMsgToTgbot(chatId, msg, tu.InlineKeyboard(t.shopCartButtons(chatId, draft)...))
+}
+
+// createShopCartOrder places one order for every package in the customer's cart.
+func (t *Tgbot) createShopCartOrder(chatId int64, username string, draft *shopDraft) (*model.ShopOrder, error) {
+	order := &model.ShopOrder{
+		TelegramId:       chatId,
+		TelegramUsername: username,
+		NodeId:           draft.NodeId,
+		InboundId:        draft.InboundId,
+		Status:           OrderStatusPendingReceipt,
+		CustomFields:     EncodeCheckoutAnswers(draft.Answers),
+	}
+	if err := t.shopService.CreateCartOrder(order, draft.Cart); err != nil {
+		return nil, err
+	}
+	delete(shopDrafts, chatId)
+	return order, nil
+}
+
+// sendShopPackageCard sends a package's banner and Markdown description with a buy button.
+func (t *Tgbot) sendShopPackageCard(chatId int64, pkg *model.ShopPackage) {
+	if !isRunning {
+		return
+	}
+	caption := t.shopT(chatId, "shop.packageCaption", "Name=="+pkg.Name, "GB=="+strconv.Itoa(pkg.DataGB), "Days=="+strconv.Itoa(pkg.DurationDays), "Price=="+t.shopService.FormatPrice(pkg.Price))
+	if pkg.Type == PackageTypePooled {
+		caption += "\n" + t.shopT(chatId, "shop.sharedDevices", "Devices=="+strconv.Itoa(pkg.Devices))
+	}
+	if pkg.Description != "" {
+		caption += "\n\n" + pkg.Description
+	}
+	if len([]rune(caption)) > 1024 {
+		caption = string([]rune(caption)[:1021]) + "..."
+	}
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(t.shopT(chatId, "shop.buy", "Name=="+pkg.Name)).WithCallbackData(t.encodeQuery(shopPackageCallback(pkg))),
+	))
+
+	if pkg.ImageUrl == "" {
+		params := tu.Message(tu.ID(chatId), caption).WithParseMode(telego.ModeMarkdown).WithReplyMarkup(keyboard)
+		if _, err := currentBot().SendMessage(context.Background(), params); err != nil {
+			// Fall back to plain text when the description is not valid Markdown.
+			_, err = currentBot().SendMessage(context.Background(), params.WithParseMode(""))
+			if err != nil {
+				logger.WithFields(logger.Fields{"error": err}).Warning("Error sending package card")
+			}
+		}
+		return
+	}
+
+	photo := tu.FileFromID(pkg.ImageUrl)
+	if strings.HasPrefix(pkg.ImageUrl, "http://") || strings.HasPrefix(pkg.ImageUrl, "https://") {
+		photo = tu.FileFromURL(pkg.ImageUrl)
+	}
+	params := tu.Photo(tu.ID(chatId), photo).WithCaption(caption).WithParseMode(telego.ModeMarkdown).WithReplyMarkup(keyboard)
+	if _, err := currentBot().SendPhoto(context.Background(), params); err != nil {
+		_, err = currentBot().SendPhoto(context.Background(), params.WithParseMode(""))
+		if err != nil {
+			logger.WithFields(logger.Fields{"error": err}).Warning("Error sending package card")
+		}
+	}
+}
+
+// shopPackageCallback returns the callback that starts buying a package.
+func shopPackageCallback(pkg *model.ShopPackage) string {
+	if pkg.Type == PackageTypeTopUp {
+		return "shop_topup_pkg " + strconv.Itoa(pkg.Id)
+	}
+	return "shop_pkg " + strconv.Itoa(pkg.Id)
+}
+
+// sendShopTopUps lists the top-up packages a customer can buy for an existing client.
+func (t *Tgbot) sendShopTopUps(chatId int64) {
+	delete(userStates, chatId)
+	if err := t.shopService.CheckOpen(); err != nil {
+		t.sendShopClosed(chatId)
+		return
+	}
+	if !t.checkShopChannel(chatId, "shop_topups") {
+		return
+	}
+	packages, err := t.shopService.ListPackages(ShopPackageFilter{ActiveOnly: true, Types: []string{PackageTypeTopUp}})
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPackagesFailed"))
+		return
+	}
+	if len(packages) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noTopUps"))
+		return
+	}
+	var buttons []telego.InlineKeyboardButton
+	for _, pkg := range packages {
+		if pkg.Description != "" || pkg.ImageUrl != "" {
+			t.sendShopPackageCard(chatId, &pkg)
+		}
+		label := t.shopT(chatId, "shop.topUpLabel", "Name=="+pkg.Name, "GB=="+strconv.Itoa(pkg.DataGB), "Price=="+t.shopService.FormatPrice(pkg.Price))
+		buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData(t.encodeQuery(shopPackageCallback(&pkg))))
+	}
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.chooseTopUp"), keyboard)
+}
+
+// sendShopTopUpTargets asks the customer which of their clients a top-up is for.
+func (t *Tgbot) sendShopTopUpTargets(chatId int64, tgId int64, pkgId int) {
+	pkg, err := t.shopService.GetPackage(pkgId)
+	if err != nil || pkg.Type != PackageTypeTopUp || !pkg.IsActive || pkg.IsArchived {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidPackage"))
+		return
+	}
+	traffics, err := t.inboundService.GetClientTrafficTgBot(tgId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadClientsFailed"))
+		return
+	}
+	draft := &shopDraft{PackageId: pkg.Id}
+	var buttons []telego.InlineKeyboardButton
+	for _, tr := range traffics {
+		if tr.Total == 0 {
+			continue
+		}
+		buttons = append(buttons, tu.InlineKeyboardButton(tr.Email).WithCallbackData(t.encodeQuery("shop_topup "+strconv.Itoa(len(draft.TopUpEmails)))))
+		draft.TopUpEmails = append(draft.TopUpEmails, tr.Email)
+	}
+	if len(buttons) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noTopUpTargets"))
+		return
+	}
+	shopDrafts[chatId] = draft
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.chooseTopUpTarget"), keyboard)
+}
+
+// sendShopUpgradePlans lists the customer's plans that can be upgraded.
+func (t *Tgbot) sendShopUpgradePlans(chatId int64, tgId int64) {
+	delete(userStates, chatId)
+	if err := t.shopService.CheckOpen(); err != nil {
+		t.sendShopClosed(chatId)
+		return
+	}
+	if !t.checkShopChannel(chatId, "shop_upgrades") {
+		return
+	}
+	plans, err := t.shopService.ListUpgradeablePlans(tgId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPlansFailed"))
+		return
+	}
+	if len(plans) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noUpgradeablePlans"))
+		return
+	}
+	var buttons []telego.InlineKeyboardButton
+	for _, plan := range plans {
+		label := fmt.Sprintf("#%d • %s", plan.Id, plan.ClientEmail)
+		buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData(t.encodeQuery("shop_upg_from "+strconv.Itoa(plan.Id))))
+	}
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.chooseUpgradePlan"), keyboard)
+}
+
+// sendShopUpgradeOptions lists the packages a plan can be upgraded to with their prorated prices.
+func (t *Tgbot) sendShopUpgradeOptions(chatId int64, from *model.ShopOrder) {
+	packages, err := t.shopService.ListPackages(ShopPackageFilter{ActiveOnly: true, Types: []string{PackageTypeStandard}})
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPackagesFailed"))
+		return
+	}
+	var buttons []telego.InlineKeyboardButton
+	for _, pkg := range packages {
+		quote, err := t.shopService.QuoteUpgrade(from, &pkg)
+		if errors.Is(err, ErrUpgradePending) {
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.upgradePending"))
+			return
+		}
+		if err != nil {
+			continue
+		}
+		label := t.shopT(chatId, "shop.upgradeLabel", "Name=="+pkg.Name, "GB=="+strconv.Itoa(pkg.DataGB), "Days=="+strconv.Itoa(pkg.DurationDays), "Price=="+t.shopService.FormatPrice(quote.Price))
+		buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData(t.encodeQuery(fmt.Sprintf("shop_upg %d %d", from.Id, pkg.Id))))
+	}
+	if len(buttons) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noUpgradeOptions"))
+		return
+	}
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.chooseUpgradeOption"), keyboard)
+}
+
+// createShopUpgradeOrder creates an order for the prorated difference of an upgrade.
+// Upgrades fully covered by the credit skip the receipt and go straight to review.
+func (t *Tgbot) createShopUpgradeOrder(chatId int64, from *model.ShopOrder, pkgId int) (*model.ShopOrder, error) {
+	pkg, err := t.shopService.GetPackage(pkgId)
+	if err != nil {
+		return nil, err
+	}
+	quote, err := t.shopService.QuoteUpgrade(from, pkg)
+	if err != nil {
+		return nil, err
+	}
+	order := &model.ShopOrder{
+		TelegramId:         chatId,
+		InboundId:          from.InboundId,
+		PackageId:          &pkg.Id,
+		Price:              quote.Price,
+		ClientEmail:        from.ClientEmail,
+		UpgradeFromOrderId: from.Id,
+		UpgradeCredit:      min(quote.Credit, pkg.Price),
+		Status:             OrderStatusPendingReceipt,
+	}
+	if quote.Price == 0 {
+		order.Status = OrderStatusPendingReview
+	}
+	if err := t.shopService.CreateOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// createShopTopUpOrder creates an order adding a top-up package to one of the customer's clients.
+func (t *Tgbot) createShopTopUpOrder(chatId int64, draft *shopDraft, email string) (int, error) {
+	pkg, err := t.shopService.GetPackage(draft.PackageId)
+	if err != nil {
+		return 0, err
+	}
+	if pkg.Type != PackageTypeTopUp || !pkg.IsActive || pkg.IsArchived {
+		return 0, errors.New("package is not available")
+	}
+	order := &model.ShopOrder{
+		TelegramId:  chatId,
+		PackageId:   &pkg.Id,
+		Price:       pkg.Price,
+		ClientEmail: email,
+		Status:      OrderStatusPendingReceipt,
+	}
+	if traffic, err := t.inboundService.GetClientTrafficByEmail(email); err == nil && traffic != nil {
+		order.InboundId = traffic.InboundId
+	}
+	if err := t.shopService.CreateOrder(order); err != nil {
+		return 0, err
+	}
+	delete(shopDrafts, chatId)
+	return order.Id, nil
+}
+
+func (t *Tgbot) createShopOrder(chatId int64, username string, draft *shopDraft, isCustom bool) (int, error) {
+	order := &model.ShopOrder{
+		TelegramId:       chatId,
+		TelegramUsername: username,
+		NodeId:           draft.NodeId,
+		InboundId:        draft.InboundId,
+		Status:           OrderStatusPendingReceipt,
+		CustomFields:     EncodeCheckoutAnswers(draft.Answers),
+	}
+
+	if isCustom {
+		order.CustomDataGB = draft.CustomGB
+		order.CustomDays = draft.CustomDays
+		order.Price = draft.Price
+	} else {
+		pkg, err := t.shopService.GetPackage(draft.PackageId)
+		if err != nil {
+			return 0, err
+		}
+		if !pkg.IsActive || pkg.IsArchived {
+			return 0, errors.New("package is not available")
+		}
+		if pkg.Type == PackageTypePooled && draft.NodeId > 0 {
+			return 0, errors.New("pooled packages are only available on local inbounds")
+		}
+		if pkg.Type == PackageTypeTopUp {
+			return 0, errors.New("top-up packages need a target client")
+		}
+		order.PackageId = &pkg.Id
+		order.Price = pkg.Price
+		order.CustomDataGB = 0
+		order.CustomDays = 0
+	}
+
+	if err := t.shopService.CreateOrder(order); err != nil {
+		return 0, err
+	}
+	delete(shopDrafts, chatId)
+	return order.Id, nil
+}
+
+// startShopCheckout asks the checkout fields of the order in the customer's
+// draft, then places it.
+func (t *Tgbot) startShopCheckout(chatId int64, username string, checkout string) {
+	draft := shopDrafts[chatId]
+	draft.Checkout = checkout
+	draft.Answers = map[string]string{}
+	t.continueShopCheckout(chatId, username)
+}
+
+// continueShopCheckout asks the first checkout field the customer has not
+// answered yet, or places the order once all are. The fields are looked up
+// again after every answer, so follow-up questions appear once the answer
+// they depend on is given.
+func (t *Tgbot) continueShopCheckout(chatId int64, username string) {
+	draft := shopDrafts[chatId]
+	if draft == nil || draft.Checkout == "" {
+		delete(userStates, chatId)
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.sessionExpired"))
+		return
+	}
+	subject := &CheckoutSubject{CustomGB: draft.CustomGB, CustomDays: draft.CustomDays, Answers: draft.Answers}
+	switch draft.Checkout {
+	case shopCheckoutPackage:
+		subject.PackageIds = []int{draft.PackageId}
+	case shopCheckoutCart:
+		subject.PackageIds = draft.Cart
+	}
+	fields, err := t.shopService.CheckoutFieldsFor(subject)
+	if err != nil {
+		delete(userStates, chatId)
+		t.sendShopOrderFailed(chatId, err)
+		return
+	}
+	for i := range fields {
+		if _, ok := draft.Answers[fields[i].Label]; !ok {
+			t.askShopCheckoutField(chatId, &fields[i])
+			return
+		}
+	}
+	delete(userStates, chatId)
+	t.placeShopCheckout(chatId, username, draft)
+}
+
+// askShopCheckoutField asks a checkout field, offering a choice field's answers
+// as buttons and a skip button for optional fields.
+func (t *Tgbot) askShopCheckoutField(chatId int64, field *model.ShopCheckoutField) {
+	id := strconv.Itoa(field.Id)
+	userStates[chatId] = "shop_field_" + id
+	msg := t.shopT(chatId, "shop.checkoutField", "Label=="+html.EscapeString(field.Label))
+	rows := [][]telego.InlineKeyboardButton{}
+	switch field.Kind {
+	case CheckoutFieldChoice:
+		for i, option := range CheckoutFieldOptions(field) {
+			rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton(option).WithCallbackData(t.encodeQuery("shop_field "+id+" "+strconv.Itoa(i)))))
+		}
+	case CheckoutFieldNumber:
+		msg += "\n" + t.shopT(chatId, "shop.checkoutFieldNumber")
+	}
+	if !field.Required {
+		rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton(t.shopT(chatId, "shop.checkoutFieldSkip")).WithCallbackData(t.encodeQuery("shop_field_skip "+id))))
+	}
+	if len(rows) == 0 {
+		t.SendMsgToTgbot(chatId, msg)
+		return
+	}
+	t.SendMsgToTgbot(chatId, msg, tu.InlineKeyboard(rows...))
+}
+
+// answerShopCheckoutField records the customer's answer to a checkout field, an
+// empty one skipping it, and moves on to the next field.
+func (t *Tgbot) answerShopCheckoutField(chatId int64, username string, fieldId int, answer string) {
+	draft := shopDrafts[chatId]
+	if draft == nil || draft.Checkout == "" {
+		delete(userStates, chatId)
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.sessionExpired"))
+		return
+	}
+	field, err := t.shopService.GetCheckoutField(fieldId)
+	if err != nil || !field.Enabled {
+		// The field was removed meanwhile; ask whatever is left.
+		t.continueShopCheckout(chatId, username)
+		return
+	}
+	value, err := CheckoutAnswer(field, answer)
+	if err != nil {
+		t.sendShopOrderFailed(chatId, err)
+		t.askShopCheckoutField(chatId, field)
+		return
+	}
+	if draft.Answers == nil {
+		draft.Answers = map[string]string{}
+	}
+	draft.Answers[field.Label] = value
+	t.continueShopCheckout(chatId, username)
+}
+
+// placeShopCheckout places the order in the customer's draft and asks for its
+// receipt.
+func (t *Tgbot) placeShopCheckout(chatId int64, username string, draft *shopDraft) {
+	var (
+		orderId int
+		intro   string
+		err     error
+	)
+	switch draft.Checkout {
+	case shopCheckoutCart:
+		var order *model.ShopOrder
+		if order, err = t.createShopCartOrder(chatId, username, draft); err == nil {
+			orderId = order.Id
+			intro = t.shopT(chatId, "shop.orderCreatedPrice", "Order=="+OrderNumber(order), "Price=="+t.shopService.FormatPrice(order.Price))
+		}
+	case shopCheckoutCustom:
+		if orderId, err = t.createShopOrder(chatId, username, draft, true); err == nil {
+			intro = t.shopT(chatId, "shop.orderCreatedPrice", "Order=="+t.shopOrderNumber(orderId), "Price=="+t.shopService.FormatPrice(draft.Price))
+		}
+	default:
+		if orderId, err = t.createShopOrder(chatId, username, draft, false); err == nil {
+			intro = t.shopT(chatId, "shop.orderCreated", "Order=="+t.shopOrderNumber(orderId))
+		}
+	}
+	switch {
+	case errors.Is(err, ErrShopClosed):
+		t.sendShopClosed(chatId)
+	case errors.Is(err, ErrRateLimited):
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.tooManyOrders"))
+	case err != nil:
+		t.sendShopOrderFailed(chatId, err)
+	default:
+		t.askShopReceipt(chatId, orderId, intro)
+	}
+}
+
+func (t *Tgbot) sendShopOrders(chatId int64, tgId int64) {
+	orders, err := t.shopService.ListOrdersByTelegramId(tgId)
+	if err != nil || len(orders) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noOrders"))
+		return
+	}
+	msg := t.shopT(chatId, "shop.yourOrders") + "\r\n"
+	for _, order := range orders {
+		msg += fmt.Sprintf("%s • %s • %s\r\n", OrderNumber(&order), order.Status, t.shopService.FormatPrice(order.Price))
+		if balance := OrderBalance(&order); balance > 0 {
+			msg += "    " + t.shopT(chatId, "shop.balanceDue", "Paid=="+t.shopService.FormatPrice(order.PaidAmount),
+				"Balance=="+t.shopService.FormatPrice(balance)) + "\r\n"
+		}
+		if order.PoolBytes > 0 && order.Status == OrderStatusApproved {
+			if usage, err := t.shopService.PoolUsage(&order); err == nil {
+				msg += "    " + t.shopT(chatId, "shop.poolUsage", "Devices=="+strconv.Itoa(usage.Devices),
+					"Used=="+common.FormatTraffic(usage.Used), "Total=="+common.FormatTraffic(usage.Total)) + "\r\n"
+			}
+		}
+	}
+	var buttons []telego.InlineKeyboardButton
+	if subs, err := t.shopService.ListSubscriptionsByTelegramId(tgId); err == nil && len(subs) > 0 {
+		msg += "\r\n" + t.shopT(chatId, "shop.subscriptions") + "\r\n"
+		for _, sub := range subs {
+			date := sub.NextDueAt.In(t.shopService.Location()).Format("2006-01-02")
+			msg += t.shopT(chatId, "shop.subscriptionLine", "Id=="+strconv.Itoa(sub.Id), "Status=="+sub.Status, "Date=="+date) + "\r\n"
+			if sub.NextPackageId > 0 {
+				if pkg, err := t.shopService.GetPackage(sub.NextPackageId); err == nil {
+					msg += "    " + t.shopT(chatId, "shop.downgradePending", "Package=="+html.EscapeString(pkg.Name), "Date=="+date) + "\r\n"
+				}
+			}
+			if options, err := t.shopService.ListDowngradeOptions(&sub); err == nil && (len(options) > 0 || sub.NextPackageId > 0) {
+				label := t.shopT(chatId, "shop.downgradeButton", "Id=="+strconv.Itoa(sub.Id))
+				buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData("shop_dg "+strconv.Itoa(sub.Id)))
+			}
+		}
+	}
+	if len(buttons) > 0 {
+		t.SendMsgToTgbot(chatId, msg, tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...)))
+		return
+	}
+	t.SendMsgToTgbot(chatId, msg)
+}
+
+// sendShopDowngradeOptions lists the cheaper packages a subscription can move
+// to at its next renewal, with a button to keep the current package when a
+// downgrade is already scheduled.
+func (t *Tgbot) sendShopDowngradeOptions(chatId int64, sub *model.ShopSubscription) {
+	current, err := t.shopService.GetPackage(sub.PackageId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPackagesFailed"))
+		return
+	}
+	options, err := t.shopService.ListDowngradeOptions(sub)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPackagesFailed"))
+		return
+	}
+	id := strconv.Itoa(sub.Id)
+	var buttons []telego.InlineKeyboardButton
+	for _, pkg := range options {
+		if pkg.Id == sub.NextPackageId {
+			continue
+		}
+		label := t.shopT(chatId, "shop.downgradeLabel", "Name=="+pkg.Name, "GB=="+strconv.Itoa(pkg.DataGB), "Price=="+t.shopService.FormatPrice(pkg.Price))
+		buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData(fmt.Sprintf("shop_dg_set %d %d", sub.Id, pkg.Id)))
+	}
+	if sub.NextPackageId > 0 {
+		label := t.shopT(chatId, "shop.downgradeKeep", "Package=="+current.Name)
+		buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData("shop_dg_keep "+id))
+	}
+	if len(buttons) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noDowngradeOptions"))
+		return
+	}
+	date := sub.NextDueAt.In(t.shopService.Location()).Format("2006-01-02")
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.downgradeChoose", "Package=="+html.EscapeString(current.Name), "Date=="+date), keyboard)
+}
+
+// shopDowngradeSubscription returns the subscription a downgrade callback is
+// about if it is one of the customer's and not cancelled.
+func (t *Tgbot) shopDowngradeSubscription(ref string, tgId int64) (*model.ShopSubscription, bool) {
+	subId, err := strconv.Atoi(ref)
+	if err != nil {
+		return nil, false
+	}
+	sub, err := t.shopService.GetSubscription(subId)
+	if err != nil || sub.TelegramId != tgId || sub.Status == SubscriptionStatusCancelled {
+		return nil, false
+	}
+	return sub, true
+}
+
+// sendShopBalance lists what the customer has left to pay on orders paid in
+// installments.
+func (t *Tgbot) sendShopBalance(chatId int64, tgId int64) {
+	orders, err := t.shopService.ListOrdersByTelegramId(tgId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noOrders"))
+		return
+	}
+	msg, total := "", int64(0)
+	for _, order := range orders {
+		balance := OrderBalance(&order)
+		if balance == 0 || order.Status == OrderStatusRejected || order.Status == OrderStatusChargeback {
+			continue
+		}
+		total += balance
+		msg += OrderNumber(&order) + " • " + t.shopT(chatId, "shop.balanceDue", "Paid=="+t.shopService.FormatPrice(order.PaidAmount),
+			"Balance=="+t.shopService.FormatPrice(balance)) + "\r\n"
+	}
+	if total == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.noBalanceDue"))
+		return
+	}
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.balanceTotal", "Balance=="+t.shopService.FormatPrice(total))+"\r\n"+msg)
+}
+
+// shopOrderNumber returns the number the customer knows an order by.
+func (t *Tgbot) shopOrderNumber(orderId int) string {
+	order, err := t.shopService.GetOrder(orderId)
+	if err != nil {
+		return "#" + strconv.Itoa(orderId)
+	}
+	return OrderNumber(order)
+}
+
+// NotifyAdminsOrderPending asks the admins to review an order awaiting approval.
+func (t *Tgbot) NotifyAdminsOrderPending(orderId int) {
+	order, err := t.shopService.GetOrder(orderId)
+	if err != nil {
+		return
+	}
+	msg := fmt.Sprintf("New receipt for order #%d (%s)\r\nTelegram ID: %d\r\nInbound: %d\r\nPrice: %s",
+		order.Id, OrderNumber(order), order.TelegramId, order.InboundId, t.shopService.FormatPrice(order.Price))
+	if order.PaymentDestinationId > 0 {
+		if dest, err := t.shopService.GetPaymentDestination(order.PaymentDestinationId); err == nil {
+			msg += fmt.Sprintf("\r\nPaid to: %s (%s)", html.EscapeString(dest.Name), html.EscapeString(dest.Value))
+		}
+	}
+	answers := OrderCheckoutAnswers(order)
+	for _, label := range slices.Sorted(maps.Keys(answers)) {
+		msg += fmt.Sprintf("\r\n%s: %s", html.EscapeString(label), html.EscapeString(answers[label]))
+	}
+	if order.OcrAmount > 0 || order.OcrReference != "" {
+		msg += fmt.Sprintf("\r\nReceipt amount: %s\r\nReference: %s", t.shopService.FormatPrice(order.OcrAmount), order.OcrReference)
+		if order.OcrMismatch {
+			msg += "\r\n⚠️ Amount does not match the price"
+		}
+	}
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Approve").WithCallbackData(t.encodeQuery("shop_approve "+strconv.Itoa(order.Id))),
+			tu.InlineKeyboardButton("Reject").WithCallbackData(t.encodeQuery("shop_reject "+strconv.Itoa(order.Id))),
+		),
+	)
+	for _, adminId := range adminIds {
+		t.SendMsgToTgbot(adminId, msg, keyboard)
+	}
+}
+
+// notifyAdminsProvisionStuck tells the admins an order used up its automatic
+// provisioning attempts, with a button to try again.
+func (t *Tgbot) notifyAdminsProvisionStuck(order *model.ShopOrder) {
+	msg := fmt.Sprintf("Order #%d could not be provisioned after %d attempts\r\nTelegram ID: %d\r\nInbound: %d\r\nLast error: %s",
+		order.Id, order.ProvisionAttempts, order.TelegramId, order.InboundId, html.EscapeString(order.ProvisionError))
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Retry").WithCallbackData(t.encodeQuery("shop_retry "+strconv.Itoa(order.Id))),
+			tu.InlineKeyboardButton("Reject").WithCallbackData(t.encodeQuery("shop_reject "+strconv.Itoa(order.Id))),
+		),
+	)
+	for _, adminId := range adminIds {
+		t.SendMsgToTgbot(adminId, msg, keyboard)
+	}
+}
+
+func (t *Tgbot) saveReceiptPhoto(orderId int, fileId string) (string, error) {
+	token, err := t.settingService.GetTgBotToken()
+	if err != nil || token == "" {
+		return "", errors.New("bot token not configured")
+	}
+	type tgFileResp struct {
+		Ok     bool `json:"ok"`
+		Result struct {
+			FilePath string `json:"file_path"`
+		} `json:"result"`
+	}
+	infoUrl := fmt.Sprintf("https://api.telegram.org/bot%s/getFile?file_id=%s", token, url.QueryEscape(fileId))
 	resp, err := optimizedHTTPClient.Get(infoUrl)
 	if err != nil {
-		return "", err
+		return "", err
+	}
+	defer resp.Body.Close()
+	var fileResp tgFileResp
+	if err := json.NewDecoder(resp.Body).Decode(&fileResp); err != nil {
+		return "", err
+	}
+	if !fileResp.Ok || fileResp.Result.FilePath == "" {
+		return "", errors.New("file not found")
+	}
+	downloadUrl := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", token, fileResp.Result.FilePath)
+	ext := filepath.Ext(fileResp.Result.FilePath)
+	if ext == "" {
+		ext = ".jpg"
+	}
+	if err := os.MkdirAll(ShopReceiptDir, 0o755); err != nil {
+		return "", err
+	}
+	filename := fmt.Sprintf("order-%d-%d%s", orderId, time.Now().Unix(), ext)
+	fullPath := filepath.Join(ShopReceiptDir, filename)
+
+	fileRespHttp, err := optimizedHTTPClient.Get(downloadUrl)
+	if err != nil {
+		return "", err
+	}
+	defer fileRespHttp.Body.Close()
+	image, err := io.ReadAll(fileRespHttp.Body)
+	if err != nil {
+		return "", err
+	}
+	if err := WriteReceipt(fullPath, image); err != nil {
+		return "", err
+	}
+	shopReceiptBytes.Observe(float64(len(image)))
+	return fullPath, nil
+}
+
+// ProvisionOrder creates the client(s) for an order on its local or remote inbound
+// and records the generated identifiers on the order.
+func (t *Tgbot) ProvisionOrder(ctx context.Context, order *model.ShopOrder) (err error) {
+	log := logger.FromContext(ctx).WithFields(logger.Fields{logger.FieldOrderId: order.Id})
+	start := time.Now()
+	defer func() {
+		observeProvision(start, &err)
+		if err != nil {
+			log.WithFields(logger.Fields{"error": err}).Warning("order provision failed")
+		} else {
+			log.WithFields(logger.Fields{"client": order.ClientEmail}).Info("order provisioned")
+		}
+	}()
+	if effect := t.orderEffect(order); effect != nil {
+		if !order.EffectAppliedAt.IsZero() {
+			// Applied by an attempt that failed to save the order afterwards.
+			return nil
+		}
+		needRestart, err := effect()
+		if needRestart {
+			t.xrayService.SetToNeedRestart()
+		}
+		if err != nil {
+			return err
+		}
+		return t.shopService.MarkOrderEffectApplied(order)
+	}
+
+	if order.ItemCount > 0 {
+		return t.provisionOrderItems(ctx, order)
+	}
+	return t.provisionClients(ctx, order)
+}
+
+// orderEffect returns the func applying an order that changes an existing
+// client rather than creating one: a renewal, an upgrade or a top-up. It
+// returns nil for other orders.
+func (t *Tgbot) orderEffect(order *model.ShopOrder) func() (bool, error) {
+	switch {
+	case order.SubscriptionId > 0:
+		return func() (bool, error) { return t.shopService.RenewSubscription(order) }
+	case order.UpgradeFromOrderId > 0:
+		return func() (bool, error) { return t.shopService.ApplyUpgrade(order) }
+	case order.PackageId != nil:
+		if pkg, err := t.shopService.GetPackage(*order.PackageId); err == nil && pkg.Type == PackageTypeTopUp {
+			return func() (bool, error) { return t.shopService.ApplyTopUp(order, pkg) }
+		}
+	}
+	return nil
+}
+
+// provisionOrderItems provisions each item of a cart order as a client of its
+// own. Items are marked provisioned as soon as their client exists, so a retry
+// from the provisioning queue only creates the clients still missing.
+func (t *Tgbot) provisionOrderItems(ctx context.Context, order *model.ShopOrder) error {
+	items, err := t.shopService.ListOrderItems(order.Id)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return errors.New("cart order has no items")
+	}
+	var emails []string
+	order.Clients = nil
+	for i := range items {
+		item := &items[i]
+		if item.ProvisionedAt.IsZero() {
+			itemOrder := *order
+			itemOrder.PackageId = &item.PackageId
+			itemOrder.ItemCount = 0
+			itemOrder.Seats = 0
+			itemOrder.CustomDataGB, itemOrder.CustomDays = 0, 0
+			if err := t.provisionClients(ctx, &itemOrder); err != nil {
+				return err
+			}
+			item.NodeId = itemOrder.NodeId
+			item.InboundId = itemOrder.InboundId
+			item.ClientEmail = itemOrder.ClientEmail
+			item.ClientId = itemOrder.ClientId
+			item.ClientSubId = itemOrder.ClientSubId
+			if err := t.shopService.SetOrderItemProvisioned(item); err != nil {
+				return err
+			}
+		}
+		emails = append(emails, item.ClientEmail)
+		order.Clients = append(order.Clients, model.ShopOrderClient{Email: item.ClientEmail, ClientId: item.ClientId, SubId: item.ClientSubId})
+	}
+	order.ClientEmail = items[0].ClientEmail
+	order.ClientId = items[0].ClientId
+	order.ClientSubId = items[0].ClientSubId
+	if len(emails) > 1 {
+		order.ClientEmails = strings.Join(emails, ",")
+	}
+	return nil
+}
+
+// provisionClients creates the client(s) of a single-package or custom order.
+func (t *Tgbot) provisionClients(ctx context.Context, order *model.ShopOrder) (err error) {
+	log := logger.FromContext(ctx).WithFields(logger.Fields{logger.FieldOrderId: order.Id})
+	if order.PackageId != nil {
+		if pkg, err := t.shopService.GetPackage(*order.PackageId); err == nil && pkg.InboundTag != "" {
+			if err := t.shopService.PlaceTaggedOrder(order, pkg.InboundTag); err != nil {
+				return err
+			}
+		}
+	}
+
+	var node *model.ShopNode
+	var inbound *model.Inbound
+	if order.NodeId > 0 {
+		if node, err = t.shopNodeService.GetNode(order.NodeId); err != nil {
+			return err
+		}
+		inbound, err = t.shopNodeService.RemoteInbound(node, order.InboundId)
+	} else {
+		inbound, err = t.inboundService.GetInbound(order.InboundId)
+	}
+	if err != nil {
+		return err
+	}
+
+	dataGB := order.CustomDataGB
+	days := order.CustomDays
+	devices := 1
+	pooled := false
+	if order.PackageId != nil {
+		if pkg, err := t.shopService.GetPackage(*order.PackageId); err == nil {
+			dataGB = pkg.DataGB
+			days = pkg.DurationDays
+			if pkg.Type == PackageTypePooled {
+				devices = pkg.Devices
+				pooled = true
+			}
+			// Recurring packages are kept alive by renewals instead of an expiry date.
+			if pkg.BillingCycle != "" {
+				days = 0
+			}
+		}
+	}
+	// Partially paid orders get traffic in proportion to what was paid.
+	order.WithheldDataGB = WithheldData(order, dataGB)
+	dataGB -= order.WithheldDataGB
+	// Bulk orders get one client per seat, each with the full amount.
+	if order.Seats > 1 {
+		devices = order.Seats
+	}
+	if pooled && node != nil {
+		return errors.New("pooled packages can only be provisioned on local inbounds")
+	}
+	if err := t.shopService.CheckInboundCapacity(order.NodeId, inbound, devices); err != nil {
+		return err
+	}
+
+	method := ""
+	if inbound.Protocol == model.Shadowsocks {
+		var settings map[string]any
+		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err == nil {
+			method, _ = settings["method"].(string)
+		}
+		if method == "" {
+			return errors.New("shadowsocks method missing")
+		}
+	}
+
+	// Pooled orders get one client per device; every client may use the
+	// whole pool and the shop pool job disables them all once it is used up.
+	var clients []any
+	var emails []string
+	expiryTime := int64(0)
+	if days > 0 {
+		expiryTime = time.Now().UnixMilli() + int64(days)*86400000
+	}
+	clientEmails, subIds, err := t.shopService.GenerateClientNames(order, devices)
+	if err != nil {
+		return err
+	}
+	order.Clients = nil
+	for i := 1; i <= devices; i++ {
+		clientId := uuid.New().String()
+		email := clientEmails[i-1]
+		subId := subIds[i-1]
+		client, err := t.shopClientSettings(inbound.Protocol, method, clientId, map[string]any{
+			"email":      email,
+			"limitIp":    0,
+			"totalGB":    int64(dataGB) * 1024 * 1024 * 1024,
+			"expiryTime": expiryTime,
+			"enable":     true,
+			"tgId":       strconv.FormatInt(order.TelegramId, 10),
+			"subId":      subId,
+			"comment":    fmt.Sprintf("order:%d", order.Id),
+			"reset":      0,
+		})
+		if err != nil {
+			return err
+		}
+		clients = append(clients, client)
+		emails = append(emails, email)
+		order.Clients = append(order.Clients, model.ShopOrderClient{Email: email, ClientId: clientId, SubId: subId})
+		if i == 1 {
+			order.ClientEmail = email
+			order.ClientId = clientId
+			order.ClientSubId = subId
+		}
+	}
+	settings, err := json.Marshal(map[string]any{"clients": clients})
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(logger.Fields{"node_id": order.NodeId, "inbound_id": inbound.Id, "clients": len(clients)}).Debug("adding order clients")
+	if node != nil {
+		if err := t.shopNodeService.AddRemoteClient(node, inbound.Id, string(settings)); err != nil {
+			return err
+		}
+	} else {
+		needRestart, err := t.inboundService.AddInboundClient(&model.Inbound{
+			Id:       inbound.Id,
+			Settings: string(settings),
+		})
+		if err != nil {
+			return err
+		}
+		if needRestart {
+			t.xrayService.SetToNeedRestart()
+		}
+	}
+	if devices > 1 {
+		order.ClientEmails = strings.Join(emails, ",")
+	}
+	if pooled {
+		order.PoolBytes = int64(dataGB) * 1024 * 1024 * 1024
+	}
+	return nil
+}
+
+// shopClientSettings completes client, the settings shared by every protocol,
+// with the credentials of protocol. Unlike BuildJSONForProtocol it keeps off the
+// client_* variables of the admin add-client flow, as orders are provisioned
+// concurrently by the jobs, the panel and the bot.
+func (t *Tgbot) shopClientSettings(protocol model.Protocol, method, clientId string, client map[string]any) (map[string]any, error) {
+	switch protocol {
+	case model.VMESS:
+		client["id"] = clientId
+		client["security"] = "auto"
+	case model.VLESS:
+		client["id"] = clientId
+		client["flow"] = ""
+	case model.Trojan:
+		client["password"] = t.randomLowerAndNum(10)
+	case model.Shadowsocks:
+		client["method"] = method
+		client["password"] = t.randomShadowSocksPassword()
+	default:
+		return nil, errors.New("unknown protocol")
+	}
+	return client, nil
+}
+
+// ApproveOrder provisions an order under review or in the provisioning queue and
+// marks it approved. When provisioning fails the order is queued for another
+// attempt and the error wraps ErrProvisionQueued; order is updated either way.
+func (t *Tgbot) ApproveOrder(ctx context.Context, order *model.ShopOrder) error {
+	release, err := claimProvision(order.Id)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// Reload the order, another attempt may have finished since it was read.
+	current, err := t.shopService.GetOrder(order.Id)
+	if err != nil {
+		return err
+	}
+	*order = *current
+	if !slices.Contains(shopProvisionableStatuses, order.Status) {
+		return errors.New("order is no longer awaiting provisioning")
+	}
+	if err := t.shopService.CheckOrderPaid(order); err != nil {
+		return err
+	}
+	if err := t.shopService.CheckOrderApproved(order); err != nil {
+		return err
+	}
+
+	err = t.provisionApprovedOrder(ctx, order)
+	if err == nil {
+		return nil
+	}
+	log := logger.FromContext(ctx).WithFields(logger.Fields{logger.FieldOrderId: order.Id})
+	if qerr := t.shopService.QueueProvisioning(order, err); qerr != nil {
+		log.WithFields(logger.Fields{"error": qerr}).Warning("queue order provisioning failed")
+		return err
+	}
+	if ProvisionStuck(order) {
+		log.WithFields(logger.Fields{"attempts": order.ProvisionAttempts}).Error("order provisioning gave up")
+		t.notifyAdminsProvisionStuck(order)
+	} else {
+		log.WithFields(logger.Fields{"attempts": order.ProvisionAttempts, "next": order.NextProvisionAt}).Info("order provisioning queued")
+	}
+	return fmt.Errorf("%w: %w", ErrProvisionQueued, err)
+}
+
+// provisionApprovedOrder provisions an order and marks it approved. When the
+// order cannot be saved, the clients just created for it are removed again so the
+// inbound and the order stay consistent and the approval can be retried.
+func (t *Tgbot) provisionApprovedOrder(ctx context.Context, order *model.ShopOrder) error {
+	// Clients of cart items are kept by their items, so a retry does not create them again.
+	createsClients := order.ClientEmail == "" && order.SubscriptionId == 0 && order.UpgradeFromOrderId == 0 && order.ItemCount == 0
+	if err := t.ProvisionOrder(ctx, order); err != nil {
+		return err
+	}
+	err := t.shopService.SetOrderProvisioned(order)
+	if err == nil {
+		return nil
+	}
+	log := logger.FromContext(ctx).WithFields(logger.Fields{logger.FieldOrderId: order.Id})
+	log.WithFields(logger.Fields{"error": err}).Warning("save provisioned order failed")
+	if createsClients {
+		t.revertProvision(ctx, order)
+	}
+	return err
+}
+
+// revertProvision removes the clients ProvisionOrder created for an order.
+func (t *Tgbot) revertProvision(ctx context.Context, order *model.ShopOrder) {
+	log := logger.FromContext(ctx).WithFields(logger.Fields{logger.FieldOrderId: order.Id})
+	var node *model.ShopNode
+	if order.NodeId > 0 {
+		var err error
+		if node, err = t.shopNodeService.GetNode(order.NodeId); err != nil {
+			log.WithFields(logger.Fields{"error": err}).Error("revert provision: node not found")
+			return
+		}
+	}
+	for _, email := range t.shopService.OrderClientEmails(order) {
+		var err error
+		if node != nil {
+			err = t.shopNodeService.DelRemoteClientByEmail(node, order.InboundId, email)
+		} else {
+			var needRestart bool
+			needRestart, err = t.inboundService.DelInboundClientByEmail(order.InboundId, email)
+			if needRestart {
+				t.xrayService.SetToNeedRestart()
+			}
+		}
+		if err != nil {
+			log.WithFields(logger.Fields{"client": email, "error": err}).Error("revert provision: remove client failed")
+			continue
+		}
+		log.WithFields(logger.Fields{"client": email}).Info("revert provision: client removed")
+	}
+	order.ClientEmail = ""
+	order.ClientId = ""
+	order.ClientSubId = ""
+	order.ClientEmails = ""
+	order.PoolBytes = 0
+}
+
+// rateLimited reports whether a customer's update should be dropped for going over
+// the bot message limit. The customer is told once, when the cooldown starts.
+func (t *Tgbot) rateLimited(chatId int64, fromId int64) bool {
+	if checkAdmin(fromId) {
+		return false
+	}
+	err := t.shopService.CheckRate(fromId, RateKindMessage)
+	if err == ErrRateLimited {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.tooManyRequests"))
+	}
+	return err != nil
+}
+
+// shopCustomerBanned records a customer's interaction on their profile and
+// tells banned customers they cannot use the shop. Admins are not tracked.
+func (t *Tgbot) shopCustomerBanned(chatId int64, from *telego.User) bool {
+	if from == nil || checkAdmin(from.ID) {
+		return false
+	}
+	banned, err := t.shopService.TrackCustomer(from.ID, from.Username, from.FirstName)
+	if err != nil {
+		logger.WithFields(logger.Fields{"telegram_id": from.ID, "error": err}).Warning("track shop customer failed")
+		return false
+	}
+	if banned {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.banned"))
+	}
+	return banned
+}
+
+// persistShopConversation saves the chat's shop flow state and draft, so a panel
+// restart does not strand a customer mid-purchase.
+func (t *Tgbot) persistShopConversation(chatId int64) {
+	state := userStates[chatId]
+	if !strings.HasPrefix(state, "shop_") {
+		state = ""
+	}
+	draft := ""
+	if d := shopDrafts[chatId]; d != nil {
+		if data, err := json.Marshal(d); err == nil {
+			draft = string(data)
+		}
+	}
+	if err := t.shopService.SaveConversation(chatId, state, draft); err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("save shop conversation failed")
+	}
+}
+
+// restoreShopConversations reloads the shop flows saved before the last restart.
+func (t *Tgbot) restoreShopConversations() {
+	conversations, err := t.shopService.ListConversations()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("load shop conversations failed")
+		return
+	}
+	for _, conversation := range conversations {
+		if conversation.State != "" {
+			userStates[conversation.TelegramId] = conversation.State
+		}
+		if conversation.Draft != "" {
+			draft := &shopDraft{}
+			if err := json.Unmarshal([]byte(conversation.Draft), draft); err == nil {
+				shopDrafts[conversation.TelegramId] = draft
+			}
+		}
+	}
+}
+
+// askShopReceipt shows where to pay for an order and waits for the receipt photo.
+func (t *Tgbot) askShopReceipt(chatId int64, orderId int, intro string) {
+	userStates[chatId] = "shop_receipt_" + strconv.Itoa(orderId)
+	msg := intro
+	dest, err := t.shopService.AssignPaymentDestination(orderId)
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: orderId, "error": err}).Warning("assign payment destination failed")
+	}
+	if dest != nil {
+		msg += "\r\n\r\n" + t.shopT(chatId, "shop.payTo", "Name=="+html.EscapeString(dest.Name))
+		msg += "\r\n<code>" + html.EscapeString(dest.Value) + "</code>"
+		if dest.Holder != "" {
+			msg += "\r\n" + html.EscapeString(dest.Holder)
+		}
+	}
+	vars := map[string]string{}
+	receipts := true
+	var replyMarkup []telego.ReplyMarkup
+	if order, err := t.shopService.GetOrder(orderId); err == nil {
+		vars = t.shopService.OrderTemplateVars(order)
+		receipts = t.shopService.PaymentMethodAllowed(order, PaymentMethodCard) || t.shopService.PaymentMethodAllowed(order, PaymentMethodWallet)
+		var rows [][]telego.InlineKeyboardButton
+		if _, err := t.shopService.TgInvoice(order); err == nil {
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.shopT(chatId, "shop.payInTelegram")).WithCallbackData(t.encodeQuery("shop_invoice "+strconv.Itoa(order.Id))),
+			))
+		}
+		if t.shopService.LightningEnabled() && t.shopService.PaymentMethodAllowed(order, PaymentMethodLightning) &&
+			order.Status == OrderStatusPendingReceipt && order.PaidAmount == 0 {
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.shopT(chatId, "shop.payWithLightning")).WithCallbackData(t.encodeQuery("shop_ln "+strconv.Itoa(order.Id))),
+			))
+		}
+		if payURL, err := t.shopService.GatewayPaymentURL(order); err == nil {
+			name := ShopPaymentGatewayNames[t.shopService.PaymentGateway()]
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.shopT(chatId, "shop.payWithGateway", "Name=="+name)).WithURL(payURL),
+			))
+		}
+		if len(rows) > 0 {
+			replyMarkup = append(replyMarkup, tu.InlineKeyboard(rows...))
+		}
+		if order.AmountCode > 0 && order.PaidAmount == 0 {
+			msg += "\r\n\r\n" + t.shopT(chatId, "shop.exactAmount", "Price=="+t.shopService.FormatPrice(order.Price))
+		}
+		if deadline := t.shopService.ReceiptDeadline(order); !deadline.IsZero() {
+			msg += "\r\n\r\n" + t.shopT(chatId, "shop.receiptDeadline", "Time=="+t.shopDuration(chatId, time.Until(deadline)),
+				"Date=="+deadline.In(t.shopService.Location()).Format("2006-01-02 15:04"))
+		}
+	}
+	if !receipts {
+		// The package is only paid through the buttons, so no receipt is asked for.
+		delete(userStates, chatId)
+		msg += "\r\n\r\n" + t.shopT(chatId, "shop.choosePaymentMethod")
+		t.SendMsgToTgbot(chatId, msg, replyMarkup...)
+		return
+	}
+	msg += "\r\n\r\n" + t.shopMessage(chatId, t.settingService.GetShopMsgPayment, "shop.sendReceiptPhoto", vars)
+	t.SendMsgToTgbot(chatId, msg, replyMarkup...)
+}
+
+// sendShopInvoice sends the Telegram invoice of an order awaiting payment.
+func (t *Tgbot) sendShopInvoice(chatId int64, order *model.ShopOrder) {
+	invoice, err := t.shopService.TgInvoice(order)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+		return
+	}
+	vars := t.shopService.OrderTemplateVars(order)
+	title := t.shopT(chatId, "shop.invoiceTitle", "Order=="+OrderNumber(order))
+	description := vars["package"]
+	if description == "" {
+		description = title
+	}
+	if len([]rune(description)) > 255 {
+		description = string([]rune(description)[:252]) + "..."
+	}
+	_, err = currentBot().SendInvoice(context.Background(), &telego.SendInvoiceParams{
+		ChatID:        tu.ID(chatId),
+		Title:         title,
+		Description:   description,
+		Payload:       invoice.Payload,
+		ProviderToken: invoice.ProviderToken,
+		Currency:      invoice.Currency,
+		Prices:        []telego.LabeledPrice{{Label: title, Amount: invoice.Amount}},
+	})
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("send shop invoice failed")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invoiceFailed"))
+	}
+}
+
+// sendShopLightningInvoice sends a Lightning invoice for an order awaiting
+// payment. The order is approved once the invoice is paid.
+func (t *Tgbot) sendShopLightningInvoice(chatId int64, order *model.ShopOrder) {
+	invoiced, err := t.shopService.OrderLightningInvoice(order)
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("create Lightning invoice failed")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invoiceFailed"))
+		return
+	}
+	msg := t.shopT(chatId, "shop.lightningInvoice", "Order=="+OrderNumber(invoiced), "Sats=="+strconv.FormatInt(invoiced.LightningSats, 10))
+	msg += "\r\n\r\n<code>" + html.EscapeString(invoiced.LightningInvoice) + "</code>"
+	t.SendMsgToTgbot(chatId, msg)
+}
+
+// answerShopPreCheckout lets Telegram charge the customer only while the order
+// still awaits payment of the invoiced amount.
+func (t *Tgbot) answerShopPreCheckout(query *telego.PreCheckoutQuery) {
+	params := &telego.AnswerPreCheckoutQueryParams{PreCheckoutQueryID: query.ID, Ok: true}
+	order, err := t.shopService.TgPaymentOrder(query.InvoicePayload, query.From.ID)
+	if err == nil {
+		err = t.shopService.CheckTgPayment(order, query.Currency, query.TotalAmount)
+	}
+	if err != nil {
+		logger.WithFields(logger.Fields{"payload": query.InvoicePayload, "error": err}).Warning("shop payment declined")
+		params.Ok = false
+		params.ErrorMessage = t.shopT(query.From.ID, "shop.invoiceExpired")
+	}
+	if err := currentBot().AnswerPreCheckoutQuery(context.Background(), params); err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("answer pre-checkout query failed")
+	}
+}
+
+// handleShopPayment approves and provisions an order paid in Telegram. A
+// payment that no longer matches its order is left for the admins to review.
+func (t *Tgbot) handleShopPayment(message *telego.Message) {
+	payment := message.SuccessfulPayment
+	order, err := t.shopService.TgPaymentOrder(payment.InvoicePayload, message.From.ID)
+	if err != nil {
+		logger.WithFields(logger.Fields{"payload": payment.InvoicePayload, "charge": payment.TelegramPaymentChargeID, "error": err}).
+			Error("received a Telegram payment for an unknown order")
+		return
+	}
+	ctx := logger.NewContext(context.Background(), logger.Fields{
+		logger.FieldOrderId: order.Id,
+		"charge":            payment.TelegramPaymentChargeID,
+	})
+	log := logger.FromContext(ctx)
+	matched := t.shopService.CheckTgPayment(order, payment.Currency, payment.TotalAmount) == nil
+	confirmed, err := t.shopService.ConfirmTgPayment(order, payment.TelegramPaymentChargeID)
+	if err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("confirm Telegram payment failed")
+		t.NotifyAdminsOrderPending(order.Id)
+		return
+	}
+	order = confirmed
+	if userStates[message.Chat.ID] == "shop_receipt_"+strconv.Itoa(order.Id) {
+		delete(userStates, message.Chat.ID)
+	}
+	t.SendMsgToTgbot(message.Chat.ID, t.shopT(message.Chat.ID, "shop.paymentReceivedTelegram", "Order=="+OrderNumber(order)))
+	if !matched || order.Status != OrderStatusPendingReview {
+		log.Warning("Telegram payment does not match the order, left for review")
+		t.NotifyAdminsOrderPending(order.Id)
+		return
+	}
+	if err := t.ApproveOrder(ctx, order); err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("approve order paid in Telegram failed")
+		if !errors.Is(err, ErrProvisionQueued) {
+			t.NotifyAdminsOrderPending(order.Id)
+		}
+		return
+	}
+	t.SendOrderFulfillment(order)
+}
+
+// NotifyRenewalDue asks the customer to pay the renewal order of a subscription.
+func (t *Tgbot) NotifyRenewalDue(order *model.ShopOrder) {
+	if order.TelegramId == 0 {
+		t.notifyOrderCustomer(order, t.shopT(0, "shop.renewalDue", "Order=="+OrderNumber(order), "Price=="+t.shopService.FormatPrice(order.Price)))
+		return
+	}
+	if !isRunning {
+		return
+	}
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(t.shopT(order.TelegramId, "shop.sendReceipt")).WithCallbackData(t.encodeQuery("shop_pay " + strconv.Itoa(order.Id))),
+	))
+	t.SendMsgToTgbot(order.TelegramId, t.shopT(order.TelegramId, "shop.renewalDue", "Order=="+OrderNumber(order), "Price=="+t.shopService.FormatPrice(order.Price)), keyboard)
+}
+
+// SendCartReminder reminds a customer of an order they never sent a receipt
+// for, with a button to pick it up again.
+func (t *Tgbot) SendCartReminder(order *model.ShopOrder) {
+	if !isRunning {
+		return
+	}
+	vars := t.shopService.OrderTemplateVars(order)
+	msg := t.shopT(order.TelegramId, "shop.cartReminder", "Order=="+vars["order"], "Package=="+html.EscapeString(vars["package"]), "Price=="+vars["price"])
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(t.shopT(order.TelegramId, "shop.resumeOrder")).WithCallbackData(t.encodeQuery("shop_pay " + strconv.Itoa(order.Id))),
+	))
+	t.SendMsgToTgbot(order.TelegramId, msg, keyboard)
+}
+
+// SendReceiptDeadlineWarning tells the customer of an unpaid order how long
+// is left to send the receipt before the order is cancelled.
+func (t *Tgbot) SendReceiptDeadlineWarning(order *model.ShopOrder, deadline time.Time) {
+	left := t.shopDuration(order.TelegramId, time.Until(deadline))
+	msg := t.shopT(order.TelegramId, "shop.receiptDeadlineWarning", "Order=="+OrderNumber(order), "Time=="+left)
+	if order.TelegramId == 0 {
+		t.notifyOrderCustomer(order, msg)
+		return
+	}
+	if !isRunning {
+		return
+	}
+	keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(t.shopT(order.TelegramId, "shop.sendReceipt")).WithCallbackData(t.encodeQuery("shop_pay " + strconv.Itoa(order.Id))),
+	))
+	t.SendMsgToTgbot(order.TelegramId, msg, keyboard)
+}
+
+// SendOrderCancelled tells the customer an unpaid order was cancelled as no
+// receipt came before the deadline.
+func (t *Tgbot) SendOrderCancelled(order *model.ShopOrder) {
+	msg := t.shopT(order.TelegramId, "shop.orderCancelled", "Order=="+OrderNumber(order))
+	t.notifyOrderCustomer(order, msg)
+}
+
+// shopDuration renders a time span in whole hours and minutes, rounding up so
+// a customer is never told more time is left than there is.
+func (t *Tgbot) shopDuration(chatId int64, d time.Duration) string {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	hours, minutes := minutes/60, minutes%60
+	switch {
+	case hours == 0:
+		return t.shopT(chatId, "shop.durationMinutes", "Minutes=="+strconv.Itoa(minutes))
+	case minutes == 0:
+		return t.shopT(chatId, "shop.durationHours", "Hours=="+strconv.Itoa(hours))
+	default:
+		return t.shopT(chatId, "shop.durationHoursMinutes", "Hours=="+strconv.Itoa(hours), "Minutes=="+strconv.Itoa(minutes))
+	}
+}
+
+// sendShopDataExport sends a customer everything the shop stores about them as
+// a JSON file.
+func (t *Tgbot) sendShopDataExport(chatId int64, tgId int64) {
+	export, err := t.shopService.ExportCustomerData(tgId)
+	if err == nil {
+		var data []byte
+		if data, err = json.MarshalIndent(export, "", "  "); err == nil {
+			document := tu.Document(
+				tu.ID(chatId),
+				tu.FileFromBytes(data, ShopCustomerExportFileName(tgId)),
+			).WithCaption(t.shopT(chatId, "shop.dataExport"))
+			_, err = currentBot().SendDocument(context.Background(), document)
+		}
+	}
+	if err != nil {
+		logger.WithFields(logger.Fields{"telegram_id": tgId, "error": err}).Warning("send customer data export failed")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.dataExportFailed"))
+	}
+}
+
+// askShopErasure asks a customer to confirm deleting their shop data.
+func (t *Tgbot) askShopErasure(chatId int64) {
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.forgetConfirm")).WithCallbackData("shop_forget_confirm"),
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.forgetCancel")).WithCallbackData("shop_forget_cancel"),
+		),
+	)
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.forgetAsk"), keyboard)
+}
+
+// eraseShopCustomer deletes a customer's shop data once they confirmed it and
+// tells the admins.
+func (t *Tgbot) eraseShopCustomer(chatId int64, tgId int64) {
+	// The reply is translated before the customer's language is deleted.
+	done := t.shopT(chatId, "shop.forgotten")
+	erasure, err := t.shopService.EraseCustomerData(tgId)
+	switch {
+	case errors.Is(err, ErrCustomerOrdersOpen):
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.forgetOpenOrders"))
+		return
+	case err != nil:
+		logger.WithFields(logger.Fields{"telegram_id": tgId, "error": err}).Warning("erase customer failed")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.forgetFailed"))
+		return
+	}
+	delete(userStates, chatId)
+	delete(shopDrafts, chatId)
+	t.SendMsgToTgbot(chatId, done)
+	t.SendMsgToTgbotAdmins(fmt.Sprintf("Customer %d deleted their shop data: %d orders and %d clients anonymized, %d receipts and %d tickets removed.",
+		tgId, erasure.Orders, erasure.Clients, erasure.Receipts, erasure.Tickets))
+}
+
+// sendShopRotateClients lists the customer's clients that can get new
+// credentials.
+func (t *Tgbot) sendShopRotateClients(chatId int64, tgId int64) {
+	delete(userStates, chatId)
+	clients, err := t.shopService.ListRotatableClients(tgId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPlansFailed"))
+		return
+	}
+	if len(clients) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.rotateNone"))
+		return
+	}
+	var buttons []telego.InlineKeyboardButton
+	for _, client := range clients {
+		query := fmt.Sprintf("shop_rot %d %s", client.OrderId, client.Email)
+		buttons = append(buttons, tu.InlineKeyboardButton(client.Email).WithCallbackData(t.encodeQuery(query)))
+	}
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.rotateChoose"), keyboard)
+}
+
+// askShopRotation asks a customer to confirm replacing a client's config.
+func (t *Tgbot) askShopRotation(chatId int64, orderId int, email string) {
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.rotateConfirm")).WithCallbackData(t.encodeQuery(fmt.Sprintf("shop_rot_ok %d %s", orderId, email))),
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.rotateCancel")).WithCallbackData("shop_rot_cancel"),
+		),
+	)
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.rotateAsk", "Email=="+html.EscapeString(email)), keyboard)
+}
+
+// shopRotationOrder parses a rotation callback and returns the order if it is
+// the customer's.
+func (t *Tgbot) shopRotationOrder(query string, tgId int64) (*model.ShopOrder, string, bool) {
+	orderRef, email, _ := strings.Cut(query, " ")
+	orderId, err := strconv.Atoi(orderRef)
+	if err != nil || email == "" {
+		return nil, "", false
+	}
+	order, err := t.shopService.GetOrder(orderId)
+	if err != nil || order.TelegramId != tgId || order.Status != OrderStatusApproved {
+		return nil, "", false
+	}
+	return order, email, true
+}
+
+// rotateShopClient rotates a client's credentials once the customer confirmed
+// it and tells the admins.
+func (t *Tgbot) rotateShopClient(chatId int64, order *model.ShopOrder, email string) {
+	if err := t.shopService.CheckRate(order.TelegramId, RateKindRotation); err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.tooManyRotations"))
+		return
+	}
+	if _, err := t.RotateOrderClient(order, email); err != nil {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "client": email, "error": err}).Warning("rotate client failed")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.rotateFailed"))
+		return
+	}
+	t.SendMsgToTgbotAdmins(fmt.Sprintf("Customer %d rotated the credentials of %s (order #%d).", order.TelegramId, html.EscapeString(email), order.Id))
+}
+
+// RotateOrderClient gives a client of an order a new UUID or password and subId
+// and sends the customer the new links.
+func (t *Tgbot) RotateOrderClient(order *model.ShopOrder, email string) (*model.ShopOrderClient, error) {
+	client, needRestart, err := t.shopService.RotateClientCredentials(order, email)
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "client": email}).Info("client credentials rotated")
+	if order.TelegramId != 0 && isRunning {
+		t.sendRotatedClient(order, email)
+	}
+	return client, nil
+}
+
+// sendRotatedClient sends the customer the new links of a rotated client.
+func (t *Tgbot) sendRotatedClient(order *model.ShopOrder, email string) {
+	t.SendMsgToTgbot(order.TelegramId, t.shopT(order.TelegramId, "shop.rotated", "Email=="+html.EscapeString(email)))
+	if _, inbound, err := t.inboundService.GetClientInboundByEmail(email); err == nil && inbound != nil {
+		t.sendOrderClientSubLinks(order, email)
+		t.sendClientIndividualLinks(order.TelegramId, email)
+		t.sendClientConfigFiles(order, email)
+		return
+	}
+	// Clients on remote nodes only have the subscription URL of their node.
+	if fresh, err := t.shopService.GetOrder(order.Id); err == nil {
+		links, _ := t.OrderClientLinks(fresh)
+		for _, link := range links {
+			if link.Email == email && link.Url != "" {
+				t.SendMsgToTgbot(order.TelegramId, t.shopService.ShortenOrderLink(fresh, email, link.Url))
+			}
+		}
+	}
+}
+
+// sendShopPausePlans lists the customer's plans with a button to pause or
+// resume each.
+func (t *Tgbot) sendShopPausePlans(chatId int64, tgId int64) {
+	delete(userStates, chatId)
+	if limit, _ := t.settingService.GetShopPausesPerCycle(); limit <= 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.pauseDisabled"))
+		return
+	}
+	plans, err := t.shopService.ListPausablePlans(tgId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.loadPlansFailed"))
+		return
+	}
+	if len(plans) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.pauseNone"))
+		return
+	}
+	var buttons []telego.InlineKeyboardButton
+	for _, plan := range plans {
+		id := strconv.Itoa(plan.Id)
+		if pause, err := t.shopService.ActiveOrderPause(plan.Id); err == nil && pause != nil {
+			label := t.shopT(chatId, "shop.resumePlan", "Email=="+plan.ClientEmail)
+			buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData("shop_unpause "+id))
+			continue
+		}
+		left, _ := t.shopService.PausesLeft(plan.Id)
+		label := t.shopT(chatId, "shop.pausePlan", "Email=="+plan.ClientEmail, "Left=="+strconv.Itoa(left))
+		buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData("shop_pause "+id))
+	}
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.pauseChoose"), keyboard)
+}
+
+// shopPausePlan returns the plan a pause callback is about if it is one of the
+// customer's current plans.
+func (t *Tgbot) shopPausePlan(ref string, tgId int64) (*model.ShopOrder, bool) {
+	orderId, err := strconv.Atoi(ref)
+	if err != nil {
+		return nil, false
+	}
+	plans, err := t.shopService.ListPausablePlans(tgId)
+	if err != nil {
+		return nil, false
+	}
+	for i := range plans {
+		if plans[i].Id == orderId {
+			return &plans[i], true
+		}
+	}
+	return nil, false
+}
+
+// pauseShopPlan pauses a customer's plan and tells the admins.
+func (t *Tgbot) pauseShopPlan(chatId int64, order *model.ShopOrder) {
+	pause, needRestart, err := t.shopService.PauseOrder(order)
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	switch {
+	case errors.Is(err, ErrPauseLimit):
+		limit, _ := t.settingService.GetShopPausesPerCycle()
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.pauseLimit", "Limit=="+strconv.Itoa(limit)))
+		return
+	case errors.Is(err, ErrOrderPaused):
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.alreadyPaused"))
+		return
+	case err != nil:
+		logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("pause order failed")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.pauseFailed"))
+		return
+	}
+	left, _ := t.shopService.PausesLeft(order.Id)
+	key := "shop.paused"
+	if pause.FreezeExpiry {
+		key = "shop.pausedFrozen"
+	}
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, key, "Email=="+html.EscapeString(order.ClientEmail), "Left=="+strconv.Itoa(left)))
+	t.SendMsgToTgbotAdmins(fmt.Sprintf("Customer %d paused order #%d (%s).", order.TelegramId, order.Id, html.EscapeString(order.ClientEmail)))
+}
+
+// unpauseShopPlan resumes a customer's paused plan and tells the admins.
+func (t *Tgbot) unpauseShopPlan(chatId int64, order *model.ShopOrder) {
+	_, needRestart, err := t.shopService.UnpauseOrder(order)
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	switch {
+	case errors.Is(err, ErrOrderNotPaused):
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.notPaused"))
+		return
+	case errors.Is(err, ErrResumeLapsed):
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.unpausedLapsed", "Email=="+html.EscapeString(order.ClientEmail)))
+		t.SendMsgToTgbotAdmins(fmt.Sprintf("Customer %d resumed order #%d (%s), which stays disabled until renewed.", order.TelegramId, order.Id, html.EscapeString(order.ClientEmail)))
+		return
+	case err != nil:
+		logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("resume paused order failed")
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.pauseFailed"))
+		return
+	}
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.unpaused", "Email=="+html.EscapeString(order.ClientEmail)))
+	t.SendMsgToTgbotAdmins(fmt.Sprintf("Customer %d resumed order #%d (%s).", order.TelegramId, order.Id, html.EscapeString(order.ClientEmail)))
+}
+
+// startShopSupport continues the customer's open ticket, or asks which order a new one is about.
+func (t *Tgbot) startShopSupport(chatId int64, tgId int64) {
+	ticket, err := t.shopService.OpenTicketOf(tgId)
+	if err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportFailed"))
+		return
 	}
-	defer resp.Body.Close()
-	var fileResp tgFileResp
-	if err := json.NewDecoder(resp.Body).Decode(&fileResp); err != nil {
-		return "", err
+	if ticket != nil {
+		userStates[chatId] = "shop_ticket_" + strconv.Itoa(ticket.Id)
+		keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.supportClose")).WithCallbackData("shop_ticket_close " + strconv.Itoa(ticket.Id)),
+		))
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportOpenTicket", "Ticket=="+strconv.Itoa(ticket.Id)), keyboard)
+		return
 	}
-	if !fileResp.Ok || fileResp.Result.FilePath == "" {
-		return "", errors.New("file not found")
+	var buttons []telego.InlineKeyboardButton
+	if orders, err := t.shopService.ListOrdersByTelegramId(tgId); err == nil {
+		for i, order := range orders {
+			if i == 5 {
+				break
+			}
+			label := t.shopT(chatId, "shop.supportOrderLabel", "Order=="+OrderNumber(&order), "Status=="+order.Status)
+			buttons = append(buttons, tu.InlineKeyboardButton(label).WithCallbackData("shop_ticket_new "+strconv.Itoa(order.Id)))
+		}
 	}
-	downloadUrl := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", token, fileResp.Result.FilePath)
-	ext := filepath.Ext(fileResp.Result.FilePath)
-	if ext == "" {
-		ext = ".jpg"
+	buttons = append(buttons, tu.InlineKeyboardButton(t.shopT(chatId, "shop.supportGeneral")).WithCallbackData("shop_ticket_new 0"))
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(1, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportChooseOrder"), keyboard)
+}
+
+// handleShopTicketMessage routes a text message sent while a ticket state is
+// pending: a new ticket or follow-up from a customer, or an admin's reply.
+func (t *Tgbot) handleShopTicketMessage(message *telego.Message, state string) {
+	chatId := message.Chat.ID
+	delete(userStates, chatId)
+	if strings.TrimSpace(message.Text) == "" {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportTextRequired"))
+		return
 	}
-	dir := "/etc/x-ui/receipts"
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return "", err
+
+	if after, ok := strings.CutPrefix(state, "shop_ticket_reply_"); ok {
+		ticketId, err := strconv.Atoi(after)
+		if err != nil || !checkAdmin(message.From.ID) {
+			return
+		}
+		author := message.From.Username
+		if author == "" {
+			author = message.From.FirstName
+		}
+		if _, err := t.ReplyTicket(ticketId, author, message.Text); err != nil {
+			t.SendMsgToTgbot(chatId, "Reply failed: "+err.Error())
+			return
+		}
+		t.SendMsgToTgbot(chatId, fmt.Sprintf("Reply sent to ticket #%d.", ticketId))
+		return
 	}
-	filename := fmt.Sprintf("order-%d-%d%s", orderId, time.Now().Unix(), ext)
-	fullPath := filepath.Join(dir, filename)
 
-	out, err := os.Create(fullPath)
+	var ticket *model.ShopTicket
+	var err error
+	if after, ok := strings.CutPrefix(state, "shop_ticket_new_"); ok {
+		orderId, _ := strconv.Atoi(after)
+		ticket, err = t.shopService.OpenTicket(message.From.ID, orderId, message.Text)
+	} else {
+		ticketId, _ := strconv.Atoi(strings.TrimPrefix(state, "shop_ticket_"))
+		ticket, err = t.shopService.GetTicket(ticketId)
+		if err == nil && ticket.TelegramId != message.From.ID {
+			err = errors.New("ticket not found")
+		}
+		if err == nil {
+			_, err = t.shopService.AddTicketMessage(ticket.Id, false, "", message.Text)
+		}
+	}
 	if err != nil {
-		return "", err
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportFailed"))
+		return
 	}
-	defer out.Close()
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportSent"))
+	t.notifyAdminsTicket(ticket, message.Text)
+}
 
-	fileRespHttp, err := optimizedHTTPClient.Get(downloadUrl)
+// SendOrderHold tells a customer their order is on hold and why, and waits for
+// their answer.
+func (t *Tgbot) SendOrderHold(order *model.ShopOrder) {
+	msg := t.shopT(order.TelegramId, "shop.onHold", "Order=="+OrderNumber(order), "Reason=="+html.EscapeString(order.HoldReason))
+	if order.TelegramId == 0 {
+		t.notifyOrderCustomer(order, msg)
+		return
+	}
+	userStates[order.TelegramId] = "shop_hold_" + strconv.Itoa(order.Id)
+	t.persistShopConversation(order.TelegramId)
+	t.SendMsgToTgbot(order.TelegramId, msg)
+}
+
+// handleShopHoldAnswer takes a customer's answer to the question their order
+// was put on hold for. The text is kept as an order comment and a photo as the
+// order's new receipt, then the order resumes and the admins are told.
+func (t *Tgbot) handleShopHoldAnswer(message *telego.Message, orderRef string) {
+	chatId := message.Chat.ID
+	answer := strings.TrimSpace(message.Text + message.Caption)
+	if answer == "" && len(message.Photo) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportTextRequired"))
+		return
+	}
+	delete(userStates, chatId)
+	orderId, err := strconv.Atoi(orderRef)
 	if err != nil {
-		return "", err
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrderReference"))
+		return
 	}
-	defer fileRespHttp.Body.Close()
-	if _, err := io.Copy(out, fileRespHttp.Body); err != nil {
-		return "", err
+	order, err := t.shopService.GetOrder(orderId)
+	if err != nil || order.TelegramId != message.From.ID || order.Status != OrderStatusOnHold {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+		return
 	}
-	return fullPath, nil
+	author := message.From.Username
+	if author == "" {
+		author = message.From.FirstName
+	}
+	if order, err = t.shopService.AnswerHeldOrder(orderId, author, answer); err != nil {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportFailed"))
+		return
+	}
+	receipt := false
+	if len(message.Photo) > 0 {
+		photo := message.Photo[len(message.Photo)-1]
+		path, err := t.saveReceiptPhoto(orderId, photo.FileID)
+		if err == nil {
+			err = t.shopService.UpdateOrderReceipt(orderId, path, photo.FileID)
+		}
+		if err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: orderId, "error": err}).Warning("save held order receipt failed")
+		} else {
+			order.Status = OrderStatusPendingReview
+			receipt = true
+		}
+	}
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.holdAnswered", "Order=="+t.shopOrderNumber(orderId)))
+
+	msg := fmt.Sprintf("Order #%d is back from hold\r\nTelegram ID: %d", order.Id, order.TelegramId)
+	if answer != "" {
+		msg += "\r\n\r\n" + html.EscapeString(answer)
+	}
+	t.SendMsgToTgbotAdmins(msg)
+	if receipt {
+		t.scanReceiptAndNotify(orderId)
+	} else if order.Status == OrderStatusPendingReview {
+		t.NotifyAdminsOrderPending(orderId)
+	}
+}
+
+// scanReceiptAndNotify runs OCR on an order's new receipt in the background,
+// as the provider may take its time, then asks the admins to review the order
+// with what OCR found.
+func (t *Tgbot) scanReceiptAndNotify(orderId int) {
+	go func() {
+		if err := t.shopService.ScanReceipt(orderId); err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: orderId, "error": err}).Warning("receipt OCR failed")
+		}
+		t.NotifyAdminsOrderPending(orderId)
+	}()
+}
+
+// notifyAdminsTicket relays a customer's ticket message to the admins.
+func (t *Tgbot) notifyAdminsTicket(ticket *model.ShopTicket, body string) {
+	msg := fmt.Sprintf("🆘 Ticket #%d\r\nTelegram ID: %d", ticket.Id, ticket.TelegramId)
+	if ticket.OrderId > 0 {
+		msg += fmt.Sprintf("\r\nOrder: #%d", ticket.OrderId)
+	}
+	msg += "\r\n\r\n" + html.EscapeString(body)
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("Reply").WithCallbackData(t.encodeQuery("shop_ticket_reply "+strconv.Itoa(ticket.Id))),
+			tu.InlineKeyboardButton("Close").WithCallbackData(t.encodeQuery("shop_ticket_close "+strconv.Itoa(ticket.Id))),
+		),
+	)
+	t.SendMsgToTgbotAdmins(msg, keyboard)
 }
 
-func (t *Tgbot) ProvisionOrder(order *model.ShopOrder) (string, string, string, error) {
-	inbound, err := t.inboundService.GetInbound(order.InboundId)
+// ReplyTicket stores an admin reply on a ticket and sends it to the customer.
+func (t *Tgbot) ReplyTicket(ticketId int, author, body string) (*model.ShopTicketMessage, error) {
+	message, err := t.shopService.AddTicketMessage(ticketId, true, author, body)
 	if err != nil {
-		return "", "", "", err
+		return nil, err
+	}
+	if ticket, err := t.shopService.GetTicket(ticketId); err == nil {
+		t.SendMsgToTgbot(ticket.TelegramId, t.shopT(ticket.TelegramId, "shop.supportReply",
+			"Ticket=="+strconv.Itoa(ticket.Id), "Body=="+html.EscapeString(message.Body)))
 	}
+	return message, nil
+}
 
-	dataGB := order.CustomDataGB
-	days := order.CustomDays
-	if order.PackageId != nil {
+// CloseSupportTicket closes a ticket and tells the customer.
+func (t *Tgbot) CloseSupportTicket(ticketId int) error {
+	ticket, err := t.shopService.GetTicket(ticketId)
+	if err != nil {
+		return err
+	}
+	if err := t.shopService.CloseTicket(ticket.Id); err != nil {
+		return err
+	}
+	t.SendMsgToTgbot(ticket.TelegramId, t.shopT(ticket.TelegramId, "shop.supportClosed", "Ticket=="+strconv.Itoa(ticket.Id)))
+	return nil
+}
+
+// shopBroadcastInterval spaces broadcast messages to stay under Telegram's
+// limit of about 30 messages per second.
+const shopBroadcastInterval = 50 * time.Millisecond
+
+// parseBroadcastCommand splits "/broadcast [segment] message" into its segment and
+// message. A saved segment is given as "segment:<id>".
+func parseBroadcastCommand(text string) (string, string) {
+	_, rest, _ := strings.Cut(strings.TrimSpace(text), " ")
+	rest = strings.TrimSpace(rest)
+	first, remainder, _ := strings.Cut(rest, " ")
+	switch first {
+	case BroadcastSegmentAll, BroadcastSegmentActive, BroadcastSegmentExpired, BroadcastSegmentPending:
+		return first, strings.TrimSpace(remainder)
+	}
+	if strings.HasPrefix(first, shopSegmentPrefix) {
+		return first, strings.TrimSpace(remainder)
+	}
+	return BroadcastSegmentAll, rest
+}
+
+// StartBroadcast sends an announcement to a segment of customers in the background
+// and reports the delivery counts to the admins when done.
+func (t *Tgbot) StartBroadcast(segment, message string) (*model.ShopBroadcast, error) {
+	if !isRunning {
+		return nil, errors.New("telegram bot is not running")
+	}
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return nil, errors.New("message is empty")
+	}
+	if segment == "" {
+		segment = BroadcastSegmentAll
+	}
+	recipients, err := t.shopService.BroadcastRecipients(segment)
+	if err != nil {
+		return nil, err
+	}
+	broadcast, err := t.shopService.CreateBroadcast(segment, message, len(recipients))
+	if err != nil {
+		return nil, err
+	}
+	go t.deliverBroadcast(broadcast, recipients)
+	return broadcast, nil
+}
+
+func (t *Tgbot) deliverBroadcast(broadcast *model.ShopBroadcast, recipients []int64) {
+	ticker := time.NewTicker(shopBroadcastInterval)
+	defer ticker.Stop()
+	for _, chatId := range recipients {
+		<-ticker.C
+		// The text is sent as typed, without a parse mode, so stray markup cannot fail the whole run.
+		params := tu.Message(tu.ID(chatId), broadcast.Message)
+		_, err := currentBot().SendMessage(context.Background(), params)
+		var apiErr *ta.Error
+		if errors.As(err, &apiErr) && apiErr.Parameters != nil && apiErr.Parameters.RetryAfter > 0 {
+			time.Sleep(time.Duration(apiErr.Parameters.RetryAfter) * time.Second)
+			_, err = currentBot().SendMessage(context.Background(), params)
+		}
+		if err != nil {
+			broadcast.Failed++
+			logger.Debug("broadcast", broadcast.Id, "to", chatId, "failed:", err)
+			continue
+		}
+		broadcast.Sent++
+	}
+	if err := t.shopService.FinishBroadcast(broadcast); err != nil {
+		logger.WithFields(logger.Fields{"broadcast_id": broadcast.Id, "error": err}).Warning("save broadcast report failed")
+	}
+	t.SendMsgToTgbotAdmins(fmt.Sprintf("Broadcast #%d (%s) finished.\r\nRecipients: %d\r\nSent: %d\r\nFailed: %d",
+		broadcast.Id, html.EscapeString(broadcast.Segment), broadcast.Recipients, broadcast.Sent, broadcast.Failed))
+}
+
+// SendOrderFulfillment sends the approval message and the provisioned client's links.
+// Customers without Telegram get them by phone.
+func (t *Tgbot) SendOrderFulfillment(order *model.ShopOrder) {
+	if order.ContactEmail != "" && t.emailService.IsConfigured() {
+		go func() {
+			if err := t.EmailOrder(order); err != nil {
+				logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("email order failed")
+			}
+		}()
+	}
+	msg, withLinks := t.orderFulfillmentText(order)
+	if order.TelegramId == 0 {
+		if withLinks {
+			for _, link := range t.orderSubLinks(order) {
+				msg += "\n\n" + link
+			}
+		}
+		t.notifyOrderCustomer(order, msg)
+		return
+	}
+	if !isRunning {
+		return
+	}
+	t.SendMsgToTgbot(order.TelegramId, msg)
+	if !withLinks {
+		return
+	}
+	if order.Seats > 1 {
+		t.sendOrderClientList(order)
+		return
+	}
+	if order.NodeId > 0 {
+		for _, link := range t.orderSubLinks(order) {
+			t.SendMsgToTgbot(order.TelegramId, link)
+		}
+		return
+	}
+	emails := t.shopService.OrderClientEmails(order)
+	var names []string
+	if order.ItemCount > 0 {
+		names, _ = t.shopService.OrderItemNames(order.Id)
+	}
+	for i, email := range emails {
+		switch {
+		case len(names) == len(emails):
+			t.SendMsgToTgbot(order.TelegramId, t.shopT(order.TelegramId, "shop.cartItem", "Name=="+html.EscapeString(names[i]), "Index=="+strconv.Itoa(i+1), "Count=="+strconv.Itoa(len(emails))))
+		case len(emails) > 1:
+			t.SendMsgToTgbot(order.TelegramId, t.shopT(order.TelegramId, "shop.device", "Index=="+strconv.Itoa(i+1), "Count=="+strconv.Itoa(len(emails))))
+		}
+		t.sendOrderClientSubLinks(order, email)
+		t.sendClientIndividualLinks(order.TelegramId, email)
+		t.sendClientConfigFiles(order, email)
+	}
+}
+
+// sendClientConfigFiles sends the config files of the templates for the
+// protocol of a client's inbound. Clients on remote nodes get none, as their
+// inbound is not known here.
+func (t *Tgbot) sendClientConfigFiles(order *model.ShopOrder, email string) {
+	log := logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "client": email})
+	_, inbound, err := t.inboundService.GetClientInboundByEmail(email)
+	if err != nil || inbound == nil {
+		return
+	}
+	templates, err := t.shopService.ConfigTemplatesFor(inbound.Protocol)
+	if err != nil {
+		log.WithFields(logger.Fields{"error": err}).Warning("load config templates failed")
+		return
+	}
+	if len(templates) == 0 {
+		return
+	}
+	subURL, _, _ := t.buildSubscriptionURLs(email)
+	vars := ConfigFileVars(inbound, email, subURL)
+	vars["order"] = OrderNumber(order)
+	for i := range templates {
+		file := RenderConfigFile(&templates[i], vars)
+		document := tu.Document(
+			tu.ID(order.TelegramId),
+			tu.FileFromBytes(file.Data, file.Name),
+		).WithCaption(t.shopT(order.TelegramId, "shop.configFile", "Email=="+email))
+		if _, err := currentBot().SendDocument(context.Background(), document); err != nil {
+			log.WithFields(logger.Fields{"error": err}).Warning("send config file failed")
+		}
+	}
+}
+
+// orderFulfillmentText returns the message for an approved order and whether
+// the client's links should follow it.
+func (t *Tgbot) orderFulfillmentText(order *model.ShopOrder) (string, bool) {
+	if order.UpgradeFromOrderId > 0 && order.PackageId != nil {
 		if pkg, err := t.shopService.GetPackage(*order.PackageId); err == nil {
-			dataGB = pkg.DataGB
-			days = pkg.DurationDays
+			return t.shopT(order.TelegramId, "shop.upgraded", "Email=="+html.EscapeString(order.ClientEmail), "Package=="+html.EscapeString(pkg.Name)), false
+		}
+	}
+	if order.SubscriptionId > 0 {
+		if sub, err := t.shopService.GetSubscription(order.SubscriptionId); err == nil {
+			return t.shopT(order.TelegramId, "shop.renewedUntil", "Date=="+sub.NextDueAt.In(t.shopService.Location()).Format("2006-01-02")), false
 		}
+		return t.shopT(order.TelegramId, "shop.renewed"), false
 	}
+	if order.PackageId != nil {
+		if pkg, err := t.shopService.GetPackage(*order.PackageId); err == nil && pkg.Type == PackageTypeTopUp {
+			return t.shopT(order.TelegramId, "shop.topUpApproved", "GB=="+strconv.Itoa(pkg.DataGB), "Email=="+html.EscapeString(order.ClientEmail)), false
+		}
+	}
+	return t.shopMessage(order.TelegramId, t.settingService.GetShopMsgApproved, "shop.approved", t.shopService.OrderTemplateVars(order)), true
+}
 
-	client_Id = uuid.New().String()
-	client_Flow = ""
-	client_Email = fmt.Sprintf("tg-%d-%d@shop", order.TelegramId, order.Id)
-	client_LimitIP = 0
-	client_TotalGB = int64(dataGB) * 1024 * 1024 * 1024
-	if days > 0 {
-		client_ExpiryTime = time.Now().UnixMilli() + int64(days)*86400000
-	} else {
-		client_ExpiryTime = 0
+// orderSubLinks returns the subscription URLs of an order's clients, as short
+// links when those are on.
+func (t *Tgbot) orderSubLinks(order *model.ShopOrder) []string {
+	clients, _ := t.OrderClientLinks(order)
+	var links []string
+	for _, client := range clients {
+		if client.Url != "" {
+			links = append(links, t.shopService.ShortenOrderLink(order, client.Email, client.Url))
+		}
 	}
-	client_Enable = true
-	client_TgID = strconv.FormatInt(order.TelegramId, 10)
-	client_SubID = t.randomLowerAndNum(16)
-	client_Comment = fmt.Sprintf("order:%d", order.Id)
-	client_Reset = 0
-	client_Security = "auto"
-	client_ShPassword = t.randomShadowSocksPassword()
-	client_TrPassword = t.randomLowerAndNum(10)
-	client_Method = ""
+	return links
+}
 
-	if inbound.Protocol == model.Shadowsocks {
-		var settings map[string]any
-		if err := json.Unmarshal([]byte(inbound.Settings), &settings); err == nil {
-			if method, ok := settings["method"].(string); ok {
-				client_Method = method
+// OrderClientLinks returns the clients of an order with their subscription
+// URLs. A client whose URL cannot be built is listed without one.
+func (t *Tgbot) OrderClientLinks(order *model.ShopOrder) ([]ShopClientLink, error) {
+	clients, err := t.shopService.ListOrderClients(order)
+	if err != nil {
+		return nil, err
+	}
+	subURI := ""
+	if order.NodeId > 0 {
+		if node, err := t.shopNodeService.GetNode(order.NodeId); err == nil && node.SubUri != "" {
+			subURI = node.SubUri
+			if !strings.HasSuffix(subURI, "/") {
+				subURI += "/"
+			}
+		}
+	}
+	links := make([]ShopClientLink, 0, len(clients))
+	for _, client := range clients {
+		link := ShopClientLink{Email: client.Email, SubId: client.SubId}
+		if order.NodeId > 0 {
+			if subURI != "" && client.SubId != "" {
+				link.Url = subURI + client.SubId
+			}
+		} else if subURL, _, err := t.buildSubscriptionURLs(client.Email); err == nil {
+			link.Url = subURL
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// sendOrderClientList sends a bulk order's clients to the customer as a CSV file.
+func (t *Tgbot) sendOrderClientList(order *model.ShopOrder) {
+	links, err := t.OrderClientLinks(order)
+	if err != nil {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("list order clients failed")
+		return
+	}
+	data, err := ShopClientLinksCSV(links)
+	if err != nil {
+		return
+	}
+	document := tu.Document(
+		tu.ID(order.TelegramId),
+		tu.FileFromBytes(data, ShopClientLinksFileName(order.Id)),
+	).WithCaption(t.shopT(order.TelegramId, "shop.bulkClients", "Count=="+strconv.Itoa(len(links))))
+	if _, err := currentBot().SendDocument(context.Background(), document); err != nil {
+		logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("send order clients failed")
+	}
+}
+
+// notifyOrderCustomer sends a message to the customer of an order through the
+// shop's notifiers: the bot for Telegram customers, the phone provider for the
+// others. Phone messages go out in the background, as providers may be slow.
+func (t *Tgbot) notifyOrderCustomer(order *model.ShopOrder, msg string) {
+	send := func() {
+		if err := t.shopService.NotifyCustomer(order, msg); err != nil {
+			logger.WithFields(logger.Fields{logger.FieldOrderId: order.Id, "error": err}).Warning("notify order customer failed")
+		}
+	}
+	if order.TelegramId != 0 {
+		send()
+	} else if order.Phone != "" {
+		go send()
+	}
+}
+
+// EmailOrder emails an approved order's message, subscription links with their
+// QR codes and an invoice to the order's contact address.
+func (t *Tgbot) EmailOrder(order *model.ShopOrder) error {
+	if order.ContactEmail == "" {
+		return errors.New("order has no contact email")
+	}
+	tgId := order.TelegramId
+	msg, withLinks := t.orderFulfillmentText(order)
+	body := "<p>" + strings.ReplaceAll(msg, "\n", "<br>") + "</p>"
+
+	var attachments []EmailAttachment
+	if withLinks && order.Seats > 1 {
+		links, err := t.OrderClientLinks(order)
+		if err != nil {
+			return err
+		}
+		data, err := ShopClientLinksCSV(links)
+		if err != nil {
+			return err
+		}
+		body += "<p>" + t.shopT(tgId, "shop.bulkClients", "Count=="+strconv.Itoa(len(links))) + "</p>"
+		attachments = append(attachments, EmailAttachment{
+			Name:        ShopClientLinksFileName(order.Id),
+			ContentType: "text/csv",
+			Data:        data,
+		})
+	} else if withLinks {
+		for i, link := range t.orderSubLinks(order) {
+			escaped := html.EscapeString(link)
+			body += "<p><b>" + t.shopT(tgId, "shop.emailSubscription") + "</b><br><a href=\"" + escaped + "\">" + escaped + "</a></p>"
+			png, err := qrcode.Encode(link, qrcode.Medium, 320)
+			if err != nil {
+				continue
 			}
+			attachments = append(attachments, EmailAttachment{
+				Name:        fmt.Sprintf("subscription-%d.png", i+1),
+				ContentType: "image/png",
+				Data:        png,
+			})
+		}
+	}
+
+	pkgName := t.shopT(tgId, "shop.emailCustom")
+	if order.PackageId != nil {
+		if pkg, err := t.shopService.GetPackage(*order.PackageId); err == nil {
+			pkgName = pkg.Name
 		}
-		if client_Method == "" {
-			return "", "", "", errors.New("shadowsocks method missing")
+	} else if order.ItemCount > 0 {
+		if names, err := t.shopService.OrderItemNames(order.Id); err == nil && len(names) > 0 {
+			pkgName = strings.Join(names, ", ")
 		}
 	}
+	rows := [][2]string{
+		{t.shopT(tgId, "shop.emailOrder"), OrderNumber(order)},
+		{t.shopT(tgId, "shop.emailPackage"), pkgName},
+	}
+	if order.Seats > 1 {
+		rows = append(rows, [2]string{t.shopT(tgId, "shop.emailSeats"), strconv.Itoa(order.Seats)})
+	}
+	rows = append(rows,
+		[2]string{t.shopT(tgId, "shop.emailPrice"), t.shopService.FormatPrice(order.Price)},
+		[2]string{t.shopT(tgId, "shop.emailDate"), order.UpdatedAt.In(t.shopService.Location()).Format("2006-01-02 15:04")},
+	)
+	body += "<h3>" + t.shopT(tgId, "shop.emailInvoice") + "</h3><table cellpadding=\"4\">"
+	for _, row := range rows {
+		body += "<tr><td>" + row[0] + "</td><td>" + html.EscapeString(row[1]) + "</td></tr>"
+	}
+	body += "</table>"
+
+	subject := plainShopText(t.shopT(tgId, "shop.emailSubject", "Order=="+OrderNumber(order)))
+	return t.emailService.Send(order.ContactEmail, subject, body, attachments...)
+}
+
+// SendOrderRejection tells the customer that their order was rejected.
+func (t *Tgbot) SendOrderRejection(orderId int) {
+	order, err := t.shopService.GetOrder(orderId)
+	if err != nil {
+		return
+	}
+	msg := t.shopMessage(order.TelegramId, t.settingService.GetShopMsgRejected, "shop.rejected", t.shopService.OrderTemplateVars(order))
+	t.notifyOrderCustomer(order, msg)
+}
+
+// SendOrderScheduled tells a customer their order is approved and when it will
+// be activated.
+func (t *Tgbot) SendOrderScheduled(order *model.ShopOrder) {
+	msg := t.shopT(order.TelegramId, "shop.scheduled", "Order=="+OrderNumber(order), "Date=="+order.ScheduledAt.In(t.shopService.Location()).Format("2006-01-02 15:04"))
+	t.notifyOrderCustomer(order, msg)
+}
+
+// RecordOrderPayment records an installment paid towards an order and tells
+// the customer what is left to pay. Traffic withheld from the order while it
+// was paid in part is handed out once the rest is paid.
+func (t *Tgbot) RecordOrderPayment(orderId int, amount int64, note, author string) (*model.ShopOrder, error) {
+	order, needRestart, err := t.shopService.RecordOrderPayment(orderId, amount, note, author)
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	if order == nil {
+		return nil, err
+	}
+	params := []string{"Order==" + OrderNumber(order), "Amount==" + t.shopService.FormatPrice(amount)}
+	msg := t.shopT(order.TelegramId, "shop.paymentComplete", params...)
+	if balance := OrderBalance(order); balance > 0 {
+		msg = t.shopT(order.TelegramId, "shop.paymentReceived", append(params, "Balance=="+t.shopService.FormatPrice(balance))...)
+	}
+	t.notifyOrderCustomer(order, msg)
+	return order, err
+}
+
+// ChargebackOrder records that the payment of an order was reversed, which
+// disables its clients, and tells the customer.
+func (t *Tgbot) ChargebackOrder(orderId int, reason string) (*model.ShopOrder, error) {
+	order, needRestart, err := t.shopService.ChargebackOrder(orderId, reason)
+	if needRestart {
+		t.xrayService.SetToNeedRestart()
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg := t.shopT(order.TelegramId, "shop.chargeback", "Order=="+OrderNumber(order))
+	t.notifyOrderCustomer(order, msg)
+	return order, nil
+}
+
+// SendOrderStatusChange tells a customer their order moved to an admin-defined
+// status, with the admin's note when there is one.
+func (t *Tgbot) SendOrderStatusChange(order *model.ShopOrder, status *model.ShopOrderStatus, note string) {
+	msg := t.shopT(order.TelegramId, "shop.statusChanged", "Order=="+OrderNumber(order), "Status=="+html.EscapeString(status.Label))
+	if note != "" {
+		msg += "\n" + t.shopT(order.TelegramId, "shop.statusNote", "Note=="+html.EscapeString(note))
+	}
+	t.notifyOrderCustomer(order, msg)
+}
+
+// shopMessage renders a customer-facing bot text from its settings template.
+// An empty template uses the catalog message key in the customer's language.
+func (t *Tgbot) shopMessage(tgId int64, get func() (string, error), key string, vars map[string]string) string {
+	tmpl, err := get()
+	if err == nil && strings.TrimSpace(tmpl) != "" {
+		return renderShopTemplate(tmpl, vars)
+	}
+	params := make([]string, 0, len(vars))
+	for name, value := range vars {
+		params = append(params, strings.ToUpper(name[:1])+name[1:]+"=="+html.EscapeString(value))
+	}
+	return t.shopT(tgId, key, params...)
+}
+
+// shopT returns a shop catalog message in the customer's language.
+func (t *Tgbot) shopT(tgId int64, key string, params ...string) string {
+	return ShopText(t.shopLanguage(tgId), key, params...)
+}
+
+func (t *Tgbot) shopLanguage(tgId int64) string {
+	if lang := t.shopService.GetCustomerLanguage(tgId); lang != "" {
+		return lang
+	}
+	return shopDefaultLanguage
+}
+
+// sendShopOrderFailed tells a customer which of their inputs were rejected, or
+// just that the order failed when err is not a validation error.
+// askShopCustomAmount asks for a custom order amount, offering the presets as
+// keyboard buttons that send the number back as text. Without presets the
+// keyboard of a previous question is removed.
+func (t *Tgbot) askShopCustomAmount(chatId int64, key string, presets []int) {
+	if len(presets) == 0 {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, key), tu.ReplyKeyboardRemove())
+		return
+	}
+	buttons := make([]telego.KeyboardButton, len(presets))
+	for i, preset := range presets {
+		buttons[i] = tu.KeyboardButton(strconv.Itoa(preset))
+	}
+	keyboard := tu.KeyboardGrid(tu.KeyboardCols(4, buttons...)).WithOneTimeKeyboard().WithResizeKeyboard()
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, key)+"\n"+t.shopT(chatId, "shop.presetHint"), keyboard)
+}
+
+func (t *Tgbot) sendShopOrderFailed(chatId int64, err error) {
+	verr, ok := AsValidationError(err)
+	if !ok {
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.orderFailed"))
+		return
+	}
+	t.SendMsgToTgbot(chatId, strings.Join(verr.Messages(t.shopLanguage(chatId)), "\n"))
+}
 
-	jsonString, err := t.BuildJSONForProtocol(inbound.Protocol)
-	if err != nil {
-		return "", "", "", err
-	}
-	newInbound := &model.Inbound{
-		Id:       inbound.Id,
-		Settings: jsonString,
+// detectShopLanguage stores the catalog language matching a customer's Telegram
+// client, unless they already have one.
+func (t *Tgbot) detectShopLanguage(from *telego.User) {
+	if from == nil || t.shopService.GetCustomerLanguage(from.ID) != "" {
+		return
 	}
-	if _, err := t.inboundService.AddInboundClient(newInbound); err != nil {
-		return "", "", "", err
+	if lang := MatchShopLanguage(from.LanguageCode); lang != "" {
+		if err := t.shopService.SetCustomerLanguage(from.ID, lang); err != nil {
+			logger.WithFields(logger.Fields{"telegram_id": from.ID, "error": err}).Warning("save customer language failed")
+		}
 	}
-	return client_Email, client_Id, client_SubID, nil
 }
 
-func (t *Tgbot) SendOrderFulfillment(chatId int64, email string) {
-	if !isRunning {
-		return
+// sendShopLanguages shows the languages a customer can use the shop in.
+func (t *Tgbot) sendShopLanguages(chatId int64) {
+	var buttons []telego.InlineKeyboardButton
+	for _, lang := range ShopLanguages() {
+		buttons = append(buttons, tu.InlineKeyboardButton(lang.Name).WithCallbackData("shop_lang "+lang.Code))
 	}
-	t.SendMsgToTgbot(chatId, "Your order is approved.")
-	t.sendClientSubLinks(chatId, email)
-	t.sendClientIndividualLinks(chatId, email)
+	keyboard := tu.InlineKeyboardGrid(tu.InlineKeyboardCols(2, buttons...))
+	t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.chooseLanguage"), keyboard)
 }
 
 // answerCallback processes callback queries from inline keyboards.
@@ -1033,7 +3633,7 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 		if len(dataArray) >= 2 && len(dataArray[1]) > 0 {
 			email := dataArray[1]
 			switch dataArray[0] {
-			case "shop_approve":
+			case "shop_approve", "shop_retry":
 				orderId, err := strconv.Atoi(dataArray[1])
 				if err != nil {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Invalid order")
@@ -1044,17 +3644,34 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Order not found")
 					return
 				}
-				if order.Status != OrderStatusPendingReview {
+				wantStatus := OrderStatusPendingReview
+				if dataArray[0] == "shop_retry" {
+					wantStatus = OrderStatusProvisioning
+				}
+				if order.Status != wantStatus {
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Order not ready")
 					return
 				}
-				email, clientId, subId, err := t.ProvisionOrder(order)
-				if err != nil {
-					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Provision failed")
+				ctx := logger.NewContext(context.Background(), logger.Fields{
+					logger.FieldOrderId: orderId,
+					"admin":             callbackQuery.From.ID,
+				})
+				// Approvals are recorded by panel username, which a Telegram
+				// account cannot be told apart from, so orders needing two
+				// admins are approved in the panel.
+				err = t.ApproveOrder(ctx, order)
+				switch {
+				case errors.Is(err, ErrSecondApprovalRequired):
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, "This order needs two admins, approve it in the panel")
+					return
+				case errors.Is(err, ErrProvisionQueued):
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Provisioning failed, queued for retry")
+					return
+				case err != nil:
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Approve failed")
 					return
 				}
-				_ = t.shopService.SetOrderProvisioned(order.Id, email, clientId, subId)
-				t.SendOrderFulfillment(order.TelegramId, email)
+				t.SendOrderFulfillment(order)
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, "Approved")
 				return
 			case "shop_reject":
@@ -1063,9 +3680,35 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Invalid order")
 					return
 				}
-				_ = t.shopService.UpdateOrderStatus(orderId, OrderStatusRejected, "")
+				if err := t.shopService.UpdateOrderStatus(orderId, OrderStatusRejected, ""); err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Reject failed")
+					return
+				}
+				t.SendOrderRejection(orderId)
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, "Rejected")
 				return
+			case "shop_ticket_reply":
+				ticketId, err := strconv.Atoi(dataArray[1])
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Invalid ticket")
+					return
+				}
+				userStates[chatId] = "shop_ticket_reply_" + strconv.Itoa(ticketId)
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, "Reply")
+				t.SendMsgToTgbot(chatId, fmt.Sprintf("Type your reply to ticket #%d:", ticketId))
+				return
+			case "shop_ticket_close":
+				ticketId, err := strconv.Atoi(dataArray[1])
+				if err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Invalid ticket")
+					return
+				}
+				if err := t.CloseSupportTicket(ticketId); err != nil {
+					t.sendCallbackAnswerTgBot(callbackQuery.ID, "Close failed")
+					return
+				}
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, "Closed")
+				return
 			case "get_clients_for_sub":
 				inboundId := dataArray[1]
 				inboundIdInt, err := strconv.Atoi(inboundId)
@@ -2019,13 +4662,34 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 		t.startShopOrder(chatId)
 	case "shop_my_orders":
 		t.sendShopOrders(chatId, callbackQuery.From.ID)
+	case "shop_topups":
+		t.sendShopTopUps(chatId)
+	case "shop_upgrades":
+		t.sendShopUpgradePlans(chatId, callbackQuery.From.ID)
+	case "shop_lang":
+		t.sendShopLanguages(chatId)
+	case "shop_support":
+		t.startShopSupport(chatId, callbackQuery.From.ID)
+	case "shop_cart_checkout":
+		draft := shopDrafts[chatId]
+		if draft == nil || len(draft.Cart) == 0 {
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.cartEmpty"))
+			return
+		}
+		t.startShopCheckout(chatId, callbackQuery.From.Username, shopCheckoutCart)
+	case "shop_cart_clear":
+		if draft := shopDrafts[chatId]; draft != nil {
+			draft.Cart = nil
+		}
+		t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.cartCleared"))
 	case "shop_custom":
 		if draft := shopDrafts[chatId]; draft == nil || draft.InboundId == 0 {
-			t.SendMsgToTgbot(chatId, "Please select an inbound first.")
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.selectInboundFirst"))
 			return
 		}
 		userStates[chatId] = "shop_custom_gb"
-		t.SendMsgToTgbot(chatId, "Enter data amount (GB):")
+		gbPresets, _ := t.shopService.CustomOrderPresets()
+		t.askShopCustomAmount(chatId, "shop.enterGB", gbPresets)
 	case "onlines":
 		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.onlines"))
 		t.onlineClients(chatId)
@@ -2341,10 +5005,149 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			t.sendClientQRLinks(chatId, email)
 			return
 		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_ticket_new "); ok {
+			orderId, err := strconv.Atoi(after)
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			userStates[chatId] = "shop_ticket_new_" + strconv.Itoa(orderId)
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.supportAsk"))
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_rot "); ok {
+			order, email, ok := t.shopRotationOrder(after, callbackQuery.From.ID)
+			if !ok {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.askShopRotation(chatId, order.Id, email)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_rot_ok "); ok {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			order, email, ok := t.shopRotationOrder(after, callbackQuery.From.ID)
+			if !ok {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.rotateShopClient(chatId, order, email)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_dg "); ok {
+			sub, ok := t.shopDowngradeSubscription(after, callbackQuery.From.ID)
+			if !ok {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.sendShopDowngradeOptions(chatId, sub)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_dg_set "); ok {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			subRef, pkgRef, _ := strings.Cut(after, " ")
+			sub, ok := t.shopDowngradeSubscription(subRef, callbackQuery.From.ID)
+			pkgId, err := strconv.Atoi(pkgRef)
+			if !ok || err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			pkg, err := t.shopService.ScheduleDowngrade(sub, pkgId)
+			if err != nil {
+				logger.WithFields(logger.Fields{"subscription_id": sub.Id, "error": err}).Warning("Failed to schedule shop downgrade")
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidPackage"))
+				return
+			}
+			date := sub.NextDueAt.In(t.shopService.Location()).Format("2006-01-02")
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.downgradeScheduled", "Package=="+html.EscapeString(pkg.Name), "Date=="+date))
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_dg_keep "); ok {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			sub, ok := t.shopDowngradeSubscription(after, callbackQuery.From.ID)
+			if !ok {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			if err := t.shopService.CancelDowngrade(sub); err != nil {
+				logger.WithFields(logger.Fields{"subscription_id": sub.Id, "error": err}).Warning("Failed to cancel shop downgrade")
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.downgradeCancelled"))
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_pause "); ok {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			order, ok := t.shopPausePlan(after, callbackQuery.From.ID)
+			if !ok {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.pauseShopPlan(chatId, order)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_unpause "); ok {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			order, ok := t.shopPausePlan(after, callbackQuery.From.ID)
+			if !ok {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.unpauseShopPlan(chatId, order)
+			return
+		}
+		if callbackQuery.Data == "shop_rot_cancel" {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.rotateKept"))
+			return
+		}
+		if callbackQuery.Data == "shop_forget_confirm" {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			t.eraseShopCustomer(chatId, callbackQuery.From.ID)
+			return
+		}
+		if callbackQuery.Data == "shop_forget_cancel" {
+			t.deleteMessageTgBot(chatId, callbackQuery.Message.GetMessageID())
+			t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.forgetKept"))
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_ticket_close "); ok {
+			ticketId, err := strconv.Atoi(after)
+			if err != nil {
+				return
+			}
+			ticket, err := t.shopService.GetTicket(ticketId)
+			if err != nil || ticket.TelegramId != callbackQuery.From.ID {
+				return
+			}
+			if err := t.CloseSupportTicket(ticket.Id); err != nil {
+				logger.WithFields(logger.Fields{"ticket_id": ticket.Id, "error": err}).Warning("close ticket failed")
+			}
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_lang "); ok {
+			if MatchShopLanguage(after) != after {
+				return
+			}
+			if err := t.shopService.SetCustomerLanguage(callbackQuery.From.ID, after); err != nil {
+				logger.WithFields(logger.Fields{"telegram_id": callbackQuery.From.ID, "error": err}).Warning("save customer language failed")
+				return
+			}
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.shopT(chatId, "shop.languageSaved"))
+			t.SendAnswer(chatId, t.shopT(chatId, "shop.languageSaved"), false)
+			return
+		}
 		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_inbound "); ok {
-			inboundId, err := strconv.Atoi(after)
+			inboundRef, nodeRef, _ := strings.Cut(after, "@")
+			inboundId, err := strconv.Atoi(inboundRef)
 			if err != nil {
-				t.SendMsgToTgbot(chatId, "Invalid inbound.")
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidInbound"))
+				return
+			}
+			nodeId, _ := strconv.Atoi(nodeRef)
+			if !t.shopService.IsInboundAvailable(nodeId, inboundId) {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidInbound"))
 				return
 			}
 			draft := shopDrafts[chatId]
@@ -2352,29 +5155,197 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 				draft = &shopDraft{}
 				shopDrafts[chatId] = draft
 			}
+			draft.NodeId = nodeId
 			draft.InboundId = inboundId
-			t.sendShopPackages(chatId)
+			if pkgId := draft.LinkedPkgId; pkgId != 0 {
+				draft.LinkedPkgId = 0
+				if pkg, err := t.shopService.GetPackage(pkgId); err == nil && pkg.IsActive {
+					t.sendShopPackageCard(chatId, pkg)
+					return
+				}
+			}
+			t.sendShopCategories(chatId)
 			return
 		}
-		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_pkg "); ok {
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_cat "); ok {
+			categoryId, err := strconv.Atoi(after)
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidCategory"))
+				return
+			}
+			if draft := shopDrafts[chatId]; draft == nil || draft.InboundId == 0 {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.selectInboundFirst"))
+				return
+			}
+			t.sendShopPackages(chatId, &categoryId)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_pay "); ok {
+			orderId, err := strconv.Atoi(after)
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			order, err := t.shopService.GetOrder(orderId)
+			if err != nil || order.TelegramId != callbackQuery.From.ID || order.Status != OrderStatusPendingReceipt {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.askShopReceipt(chatId, order.Id, t.shopT(chatId, "shop.orderDue", "Order=="+OrderNumber(order), "Price=="+t.shopService.FormatPrice(order.Price-order.PaidAmount)))
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_invoice "); ok {
+			orderId, err := strconv.Atoi(after)
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			order, err := t.shopService.GetOrder(orderId)
+			if err != nil || order.TelegramId != callbackQuery.From.ID {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.sendShopInvoice(chatId, order)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_ln "); ok {
+			orderId, err := strconv.Atoi(after)
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			order, err := t.shopService.GetOrder(orderId)
+			if err != nil || order.TelegramId != callbackQuery.From.ID {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.sendShopLightningInvoice(chatId, order)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_upg_from "); ok {
+			fromId, err := strconv.Atoi(after)
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			from, err := t.shopService.GetOrder(fromId)
+			if err != nil || from.TelegramId != callbackQuery.From.ID || from.Status != OrderStatusApproved {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			t.sendShopUpgradeOptions(chatId, from)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_upg "); ok {
+			fromRef, pkgRef, _ := strings.Cut(after, " ")
+			fromId, err1 := strconv.Atoi(fromRef)
+			pkgId, err2 := strconv.Atoi(pkgRef)
+			if err1 != nil || err2 != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidPackage"))
+				return
+			}
+			from, err := t.shopService.GetOrder(fromId)
+			if err != nil || from.TelegramId != callbackQuery.From.ID || from.Status != OrderStatusApproved {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidOrder"))
+				return
+			}
+			order, err := t.createShopUpgradeOrder(chatId, from, pkgId)
+			if errors.Is(err, ErrUpgradePending) {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.upgradePending"))
+				return
+			}
+			if errors.Is(err, ErrShopClosed) {
+				t.sendShopClosed(chatId)
+				return
+			}
+			if errors.Is(err, ErrRateLimited) {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.tooManyOrders"))
+				return
+			}
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.orderFailed"))
+				return
+			}
+			if order.Status == OrderStatusPendingReview {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.upgradeCovered", "Order=="+OrderNumber(order)))
+				t.NotifyAdminsOrderPending(order.Id)
+				return
+			}
+			t.askShopReceipt(chatId, order.Id, t.shopT(chatId, "shop.orderCreatedPrice", "Order=="+OrderNumber(order), "Price=="+t.shopService.FormatPrice(order.Price)))
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_topup_pkg "); ok {
 			pkgId, err := strconv.Atoi(after)
 			if err != nil {
-				t.SendMsgToTgbot(chatId, "Invalid package.")
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidPackage"))
 				return
 			}
+			t.sendShopTopUpTargets(chatId, callbackQuery.From.ID, pkgId)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_topup "); ok {
+			idx, err := strconv.Atoi(after)
 			draft := shopDrafts[chatId]
-			if draft == nil || draft.InboundId == 0 {
-				t.SendMsgToTgbot(chatId, "Please select an inbound first.")
+			if err != nil || draft == nil || idx < 0 || idx >= len(draft.TopUpEmails) {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.chooseTopUpFirst"))
 				return
 			}
-			draft.PackageId = pkgId
-			orderId, err := t.createShopOrder(chatId, draft, false)
+			orderId, err := t.createShopTopUpOrder(chatId, draft, draft.TopUpEmails[idx])
+			if errors.Is(err, ErrShopClosed) {
+				t.sendShopClosed(chatId)
+				return
+			}
+			if errors.Is(err, ErrRateLimited) {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.tooManyOrders"))
+				return
+			}
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.orderFailed"))
+				return
+			}
+			t.askShopReceipt(chatId, orderId, t.shopT(chatId, "shop.orderCreated", "Order=="+t.shopOrderNumber(orderId)))
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_field "); ok {
+			fieldRef, optionRef, _ := strings.Cut(after, " ")
+			fieldId, _ := strconv.Atoi(fieldRef)
+			option, _ := strconv.Atoi(optionRef)
+			answer := ""
+			if field, err := t.shopService.GetCheckoutField(fieldId); err == nil {
+				if options := CheckoutFieldOptions(field); option >= 0 && option < len(options) {
+					answer = options[option]
+				}
+			}
+			t.answerShopCheckoutField(chatId, callbackQuery.From.Username, fieldId, answer)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_field_skip "); ok {
+			fieldId, _ := strconv.Atoi(after)
+			t.answerShopCheckoutField(chatId, callbackQuery.From.Username, fieldId, "")
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_cart_add "); ok {
+			pkgId, err := strconv.Atoi(after)
+			if err != nil {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidPackage"))
+				return
+			}
+			t.addShopCartPackage(chatId, pkgId)
+			return
+		}
+		if after, ok := strings.CutPrefix(callbackQuery.Data, "shop_pkg "); ok {
+			pkgId, err := strconv.Atoi(after)
 			if err != nil {
-				t.SendMsgToTgbot(chatId, "Failed to create order.")
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.invalidPackage"))
+				return
+			}
+			draft := shopDrafts[chatId]
+			if draft == nil || draft.InboundId == 0 {
+				t.SendMsgToTgbot(chatId, t.shopT(chatId, "shop.selectInboundFirst"))
 				return
 			}
-			userStates[chatId] = "shop_receipt_" + strconv.Itoa(orderId)
-			t.SendMsgToTgbot(chatId, fmt.Sprintf("Order #%d created. Please send receipt photo.", orderId))
+			draft.PackageId = pkgId
+			t.startShopCheckout(chatId, callbackQuery.From.Username, shopCheckoutPackage)
 			return
 		}
 	}
@@ -2581,8 +5552,16 @@ func (t *Tgbot) SendAnswer(chatId int64, msg string, isAdmin bool) {
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.commands")).WithCallbackData(t.encodeQuery("client_commands")),
 		),
 		tu.InlineKeyboardRow(
-			tu.InlineKeyboardButton("🛒 New order").WithCallbackData(t.encodeQuery("shop_new")),
-			tu.InlineKeyboardButton("My orders").WithCallbackData(t.encodeQuery("shop_my_orders")),
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.menu.newOrder")).WithCallbackData(t.encodeQuery("shop_new")),
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.menu.myOrders")).WithCallbackData(t.encodeQuery("shop_my_orders")),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.menu.topUp")).WithCallbackData(t.encodeQuery("shop_topups")),
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.menu.upgrade")).WithCallbackData(t.encodeQuery("shop_upgrades")),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.menu.support")).WithCallbackData("shop_support"),
+			tu.InlineKeyboardButton(t.shopT(chatId, "shop.menu.language")).WithCallbackData("shop_lang"),
 		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("pages.settings.subSettings")).WithCallbackData(t.encodeQuery("client_sub_links")),
@@ -2645,7 +5624,7 @@ func (t *Tgbot) SendMsgToTgbot(chatId int64, msg string, replyMarkup ...telego.R
 		if len(replyMarkup) > 0 && n == (len(allMessages)-1) {
 			params.ReplyMarkup = replyMarkup[0]
 		}
-		_, err := bot.SendMessage(context.Background(), &params)
+		_, err := currentBot().SendMessage(context.Background(), &params)
 		if err != nil {
 			logger.Warning("Error sending telegram message :", err)
 		}
@@ -2721,9 +5700,9 @@ func (t *Tgbot) buildSubscriptionURLs(email string) (string, string, error) {
 	// If pre-configured URIs are available, use them directly
 	if subURI != "" {
 		if !strings.HasSuffix(subURI, "/") {
-			subURI = subURI + "/" 
+			subURI = subURI + "/"
 		}
-		subURL = fmt.Sprintf("%s%s", subURI, client.SubID) 
+		subURL = fmt.Sprintf("%s%s", subURI, client.SubID)
 	} else {
 		subURL = fmt.Sprintf("%s://%s%s%s", scheme, host, subPath, client.SubID)
 	}
@@ -2732,7 +5711,7 @@ func (t *Tgbot) buildSubscriptionURLs(email string) (string, string, error) {
 		if !strings.HasSuffix(subJsonURI, "/") {
 			subJsonURI = subJsonURI + "/"
 		}
-		subJsonURL = fmt.Sprintf("%s%s", subJsonURI, client.SubID) 
+		subJsonURL = fmt.Sprintf("%s%s", subJsonURI, client.SubID)
 	} else {
 
 		subJsonURL = fmt.Sprintf("%s://%s%s%s", scheme, host, subJsonPath, client.SubID)
@@ -2751,6 +5730,27 @@ func (t *Tgbot) sendClientSubLinks(chatId int64, email string) {
 		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
 		return
 	}
+	t.sendSubLinks(chatId, email, subURL, subJsonURL)
+}
+
+// sendOrderClientSubLinks sends the subscription URLs of an order's client, as
+// short links when those are on.
+func (t *Tgbot) sendOrderClientSubLinks(order *model.ShopOrder, email string) {
+	subURL, subJsonURL, err := t.buildSubscriptionURLs(email)
+	if err != nil {
+		t.SendMsgToTgbot(order.TelegramId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
+		return
+	}
+	subURL = t.shopService.ShortenOrderLink(order, email, subURL)
+	if subJsonURL != "" {
+		subJsonURL = t.shopService.ShortenOrderLink(order, email, subJsonURL)
+	}
+	t.sendSubLinks(order.TelegramId, email, subURL, subJsonURL)
+}
+
+// sendSubLinks sends a client's subscription URLs with buttons for its
+// individual links and QR codes.
+func (t *Tgbot) sendSubLinks(chatId int64, email, subURL, subJsonURL string) {
 	msg := "Subscription URL:\r\n<code>" + subURL + "</code>"
 	if subJsonURL != "" {
 		msg += "\r\n\r\nJSON URL:\r\n<code>" + subJsonURL + "</code>"
@@ -2873,7 +5873,7 @@ func (t *Tgbot) sendClientQRLinks(chatId int64, email string) {
 			tu.ID(chatId),
 			tu.FileFromBytes(png, "sub.png"),
 		)
-		_, _ = bot.SendDocument(context.Background(), document)
+		_, _ = currentBot().SendDocument(context.Background(), document)
 	} else {
 		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
 	}
@@ -2885,7 +5885,7 @@ func (t *Tgbot) sendClientQRLinks(chatId int64, email string) {
 				tu.ID(chatId),
 				tu.FileFromBytes(png, "subjson.png"),
 			)
-			_, _ = bot.SendDocument(context.Background(), document)
+			_, _ = currentBot().SendDocument(context.Background(), document)
 		} else {
 			t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.errorOperation")+"\r\n"+err.Error())
 		}
@@ -2931,7 +5931,7 @@ func (t *Tgbot) sendClientQRLinks(chatId int64, email string) {
 							tu.ID(chatId),
 							tu.FileFromBytes(png, filename),
 						)
-						_, _ = bot.SendDocument(context.Background(), document)
+						_, _ = currentBot().SendDocument(context.Background(), document)
 						// Reduced delay for better performance
 						if i < max-1 { // Only delay between documents, not after the last one
 							time.Sleep(50 * time.Millisecond)
@@ -2976,6 +5976,79 @@ func (t *Tgbot) SendReport() {
 	if err == nil && backupEnable {
 		t.SendBackupToAdmins()
 	}
+
+	if shopBackup, err := t.settingService.GetShopTgBackup(); err == nil && shopBackup {
+		t.SendShopBackupToAdmins()
+	}
+}
+
+// SendShopBackupToAdmins sends an encrypted shop backup to admin chats.
+func (t *Tgbot) SendShopBackupToAdmins() {
+	if !t.IsRunning() {
+		return
+	}
+	data, err := t.shopService.Backup("")
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Error("Error in creating shop backup")
+		return
+	}
+	name := t.shopService.BackupFileName()
+	for _, adminId := range adminIds {
+		document := tu.Document(
+			tu.ID(int64(adminId)),
+			tu.FileFromBytes(data, name),
+		)
+		if _, err := currentBot().SendDocument(context.Background(), document); err != nil {
+			logger.WithFields(logger.Fields{"error": err}).Error("Error in uploading shop backup")
+		}
+	}
+}
+
+// SendRevenueGoalReached tells the admins that the month's revenue goal was reached.
+func (t *Tgbot) SendRevenueGoalReached(progress *ShopRevenueGoalProgress) {
+	if !t.IsRunning() {
+		return
+	}
+	t.SendMsgToTgbotAdmins(fmt.Sprintf("🎯 Revenue goal for %s reached\r\nRevenue: %s of %s (%.0f%%)\r\nOrders: %d",
+		progress.Month, t.shopService.FormatPrice(progress.Revenue), t.shopService.FormatPrice(progress.Goal),
+		progress.Percent, progress.Orders))
+}
+
+// SendCapacityAlert warns the admins of a package low on stock or an inbound
+// near its cap.
+func (t *Tgbot) SendCapacityAlert(alert *ShopCapacityAlert) {
+	if !t.IsRunning() {
+		return
+	}
+	if alert.PackageId != 0 {
+		t.SendMsgToTgbotAdmins(fmt.Sprintf("📦 Package %s is low on stock\r\nIts inbounds have room for %d more orders.",
+			html.EscapeString(alert.Package), alert.Stock))
+		return
+	}
+	t.SendMsgToTgbotAdmins(fmt.Sprintf("🔥 Inbound %s is at %.0f%% of its capacity\r\nAdd capacity before sales stall.",
+		html.EscapeString(alert.Inbound), alert.Usage))
+}
+
+// SendWeeklySummary sends the admins the shop's summary of the last week.
+func (t *Tgbot) SendWeeklySummary(summary *ShopWeeklySummary) {
+	if !t.IsRunning() {
+		return
+	}
+	msg := fmt.Sprintf("📊 Shop summary since %s\r\nOrders: %d\r\nRevenue: %s",
+		summary.Since.In(t.shopService.Location()).Format("2006-01-02"), summary.Orders, t.shopService.FormatPrice(summary.Revenue))
+	if summary.TopPackageOrders > 0 {
+		name := summary.TopPackage
+		if name == "" {
+			name = "#" + strconv.Itoa(summary.TopPackageId)
+		}
+		msg += fmt.Sprintf("\r\nTop package: %s (%d orders)", html.EscapeString(name), summary.TopPackageOrders)
+	}
+	msg += fmt.Sprintf("\r\nChurn: %d subscriptions (%.1f%%)", summary.Churned, summary.ChurnRate)
+	if goal := summary.Goal; goal != nil {
+		msg += fmt.Sprintf("\r\nGoal for %s: %s of %s (%.0f%%)",
+			goal.Month, t.shopService.FormatPrice(goal.Revenue), t.shopService.FormatPrice(goal.Goal), goal.Percent)
+	}
+	t.SendMsgToTgbotAdmins(msg)
 }
 
 // SendBackupToAdmins sends a database backup to admin chats.
@@ -3904,6 +6977,53 @@ func (t *Tgbot) notifyExhausted() {
 			}
 		}
 	}
+	t.notifyExhaustedPhones(trDiff, exDiff, now)
+}
+
+// notifyExhaustedPhones warns the customers who ordered without Telegram, by
+// phone, of their clients about to expire or run out of traffic.
+func (t *Tgbot) notifyExhaustedPhones(trDiff, exDiff, now int64) {
+	orders, err := t.shopService.ListPhoneCustomerOrders()
+	if err != nil {
+		logger.WithFields(logger.Fields{"error": err}).Warning("load phone customer orders failed")
+		return
+	}
+	var customers []*model.ShopOrder
+	exhausted := map[string][]xray.ClientTraffic{}
+	seen := map[string]bool{}
+	for i := range orders {
+		order := &orders[i]
+		clients, err := t.shopService.ListOrderClients(order)
+		if err != nil {
+			continue
+		}
+		for _, client := range clients {
+			if seen[client.Email] {
+				continue
+			}
+			seen[client.Email] = true
+			traffic, err := t.inboundService.GetClientTrafficByEmail(client.Email)
+			if err != nil || traffic == nil || !traffic.Enable {
+				continue
+			}
+			if (traffic.ExpiryTime > 0 && (traffic.ExpiryTime-now < exDiff)) ||
+				(traffic.Total > 0 && (traffic.Total-(traffic.Up+traffic.Down) < trDiff)) {
+				if _, ok := exhausted[order.Phone]; !ok {
+					customers = append(customers, order)
+				}
+				exhausted[order.Phone] = append(exhausted[order.Phone], *traffic)
+			}
+		}
+	}
+	for _, order := range customers {
+		traffics := exhausted[order.Phone]
+		output := t.I18nBot("tgbot.messages.depleteSoon", "Deplete=="+strconv.Itoa(len(traffics)))
+		for _, traffic := range traffics {
+			output += t.clientInfoMsg(&traffic, true, false, false, true, true, false)
+			output += "\r\n"
+		}
+		t.notifyOrderCustomer(order, output)
+	}
 }
 
 // int64Contains checks if an int64 slice contains a specific item.
@@ -3968,7 +7088,7 @@ func (t *Tgbot) sendBackup(chatId int64) {
 			tu.ID(chatId),
 			tu.File(file),
 		)
-		_, err = bot.SendDocument(context.Background(), document)
+		_, err = currentBot().SendDocument(context.Background(), document)
 		if err != nil {
 			logger.Error("Error in uploading backup: ", err)
 		}
@@ -3982,7 +7102,7 @@ func (t *Tgbot) sendBackup(chatId int64) {
 			tu.ID(chatId),
 			tu.File(file),
 		)
-		_, err = bot.SendDocument(context.Background(), document)
+		_, err = currentBot().SendDocument(context.Background(), document)
 		if err != nil {
 			logger.Error("Error in uploading config.json: ", err)
 		}
@@ -4007,7 +7127,7 @@ func (t *Tgbot) sendBanLogs(chatId int64, dt bool) {
 				tu.ID(chatId),
 				tu.File(file),
 			)
-			_, err = bot.SendDocument(context.Background(), document)
+			_, err = currentBot().SendDocument(context.Background(), document)
 			if err != nil {
 				logger.Error("Error in uploading IPLimitBannedPrevLog: ", err)
 			}
@@ -4028,7 +7148,7 @@ func (t *Tgbot) sendBanLogs(chatId int64, dt bool) {
 				tu.ID(chatId),
 				tu.File(file),
 			)
-			_, err = bot.SendDocument(context.Background(), document)
+			_, err = currentBot().SendDocument(context.Background(), document)
 			if err != nil {
 				logger.Error("Error in uploading IPLimitBannedLog: ", err)
 			}
@@ -4047,7 +7167,7 @@ func (t *Tgbot) sendCallbackAnswerTgBot(id string, message string) {
 		CallbackQueryID: id,
 		Text:            message,
 	}
-	if err := bot.AnswerCallbackQuery(context.Background(), &params); err != nil {
+	if err := currentBot().AnswerCallbackQuery(context.Background(), &params); err != nil {
 		logger.Warning(err)
 	}
 }
@@ -4059,7 +7179,7 @@ func (t *Tgbot) editMessageCallbackTgBot(chatId int64, messageID int, inlineKeyb
 		MessageID:   messageID,
 		ReplyMarkup: inlineKeyboard,
 	}
-	if _, err := bot.EditMessageReplyMarkup(context.Background(), &params); err != nil {
+	if _, err := currentBot().EditMessageReplyMarkup(context.Background(), &params); err != nil {
 		logger.Warning(err)
 	}
 }
@@ -4075,7 +7195,7 @@ func (t *Tgbot) editMessageTgBot(chatId int64, messageID int, text string, inlin
 	if len(inlineKeyboard) > 0 {
 		params.ReplyMarkup = inlineKeyboard[0]
 	}
-	if _, err := bot.EditMessageText(context.Background(), &params); err != nil {
+	if _, err := currentBot().EditMessageText(context.Background(), &params); err != nil {
 		logger.Warning(err)
 	}
 }
@@ -4089,7 +7209,7 @@ func (t *Tgbot) SendMsgToTgbotDeleteAfter(chatId int64, msg string, delayInSecon
 	}
 
 	// Send the message
-	sentMsg, err := bot.SendMessage(context.Background(), &telego.SendMessageParams{
+	sentMsg, err := currentBot().SendMessage(context.Background(), &telego.SendMessageParams{
 		ChatID:      tu.ID(chatId),
 		Text:        msg,
 		ReplyMarkup: replyMarkupParam, // Use the correct replyMarkup value
@@ -4113,7 +7233,7 @@ func (t *Tgbot) deleteMessageTgBot(chatId int64, messageID int) {
 		ChatID:    tu.ID(chatId),
 		MessageID: messageID,
 	}
-	if err := bot.DeleteMessage(context.Background(), &params); err != nil {
+	if err := currentBot().DeleteMessage(context.Background(), &params); err != nil {
 		logger.Warning("Failed to delete message:", err)
 	} else {
 		logger.Info("Message deleted successfully")
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"runtime"
@@ -213,6 +214,19 @@ func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic,
 	return traffic, clientTraffic, nil
 }
 
+// CheckXrayAPI tells whether Xray is running and its API answers.
+func (s *XrayService) CheckXrayAPI(ctx context.Context) error {
+	if !s.IsXrayRunning() {
+		return errors.New("xray is not running")
+	}
+	var api xray.XrayAPI
+	if err := api.Init(p.GetAPIPort()); err != nil {
+		return err
+	}
+	defer api.Close()
+	return api.Ping(ctx)
+}
+
 // RestartXray restarts the Xray process, optionally forcing a restart even if config unchanged.
 func (s *XrayService) RestartXray(isForce bool) error {
 	lock.Lock()
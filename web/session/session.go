@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/mhsanaei/3x-ui/v2/database/model"
+	"github.com/mhsanaei/3x-ui/v2/util/random"
 
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
@@ -14,6 +15,7 @@ import (
 
 const (
 	loginUserKey = "LOGIN_USER"
+	csrfTokenKey = "CSRF_TOKEN"
 	defaultPath  = "/"
 )
 
@@ -60,6 +62,22 @@ func GetLoginUser(c *gin.Context) *model.User {
 	return &user
 }
 
+// GetCSRFToken returns the token the session's state-changing requests must
+// carry, creating it on first use. It lives as long as the session, so logging
+// out discards it.
+func GetCSRFToken(c *gin.Context) string {
+	s := sessions.Default(c)
+	if token, ok := s.Get(csrfTokenKey).(string); ok && token != "" {
+		return token
+	}
+	token := random.Seq(32)
+	s.Set(csrfTokenKey, token)
+	if err := s.Save(); err != nil {
+		return ""
+	}
+	return token
+}
+
 // IsLogin checks if a user is currently authenticated in the session.
 // Returns true if a valid user session exists, false otherwise.
 func IsLogin(c *gin.Context) bool {
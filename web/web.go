@@ -96,10 +96,15 @@ type Server struct {
 	httpServer *http.Server
 	listener   net.Listener
 
-	index *controller.IndexController
-	panel *controller.XUIController
-	api   *controller.APIController
-	ws    *controller.WebSocketController
+	index    *controller.IndexController
+	panel    *controller.XUIController
+	api      *controller.APIController
+	portal   *controller.PortalController
+	store    *controller.StoreController
+	reseller *controller.ResellerController
+	metrics  *controller.MetricsController
+	tgbot    *controller.TgbotController
+	ws       *controller.WebSocketController
 
 	xrayService    service.XrayService
 	settingService service.SettingService
@@ -181,6 +186,17 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	}
 
 	engine := gin.Default()
+	// Without trusted proxies, gin would take the client address from any
+	// request's X-Forwarded-For, letting clients pass the admin allowlists and
+	// per-IP rate limits with a forged header.
+	proxies, err := s.settingService.GetTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+	if err := engine.SetTrustedProxies(proxies); err != nil {
+		return nil, err
+	}
+	engine.Use(middleware.RequestIdMiddleware())
 
 	webDomain, err := s.settingService.GetWebDomain()
 	if err != nil {
@@ -269,6 +285,11 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 	s.index = controller.NewIndexController(g)
 	s.panel = controller.NewXUIController(g)
 	s.api = controller.NewAPIController(g)
+	s.portal = controller.NewPortalController(g)
+	s.store = controller.NewStoreController(g)
+	s.reseller = controller.NewResellerController(g)
+	s.metrics = controller.NewMetricsController(g)
+	s.tgbot = controller.NewTgbotController(g, &s.tgbotService)
 
 	// Initialize WebSocket hub
 	s.wsHub = websocket.NewHub()
@@ -284,6 +305,8 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		c.JSON(http.StatusOK, gin.H{})
 	})
 
+	s.api.SetRoutes(engine.Routes)
+
 	// Add a catch-all route to handle undefined paths and return 404
 	engine.NoRoute(func(c *gin.Context) {
 		c.AbortWithStatus(http.StatusNotFound)
@@ -321,6 +344,47 @@ func (s *Server) startTask() {
 	// check client ips from log file every 10 sec
 	s.cron.AddJob("@every 10s", job.NewCheckClientIpJob())
 
+	// disable pooled shop clients whose shared traffic is used up
+	s.cron.AddJob("@every 1m", job.NewShopPoolJob())
+
+	// retry provisioning of shop orders that failed
+	s.cron.AddJob("@every 30s", job.NewShopProvisionJob())
+
+	// remind customers of orders they never sent a receipt for
+	s.cron.AddJob("@every 5m", job.NewShopReminderJob())
+
+	// warn about and cancel unpaid shop orders past their receipt deadline
+	s.cron.AddJob("@every 1m", job.NewShopDeadlineJob())
+
+	// provision shop orders whose Lightning invoice was paid
+	s.cron.AddJob("@every 30s", job.NewShopLightningJob())
+
+	// open shop renewal orders and suspend unpaid subscriptions
+	s.cron.AddJob("@every 10m", job.NewShopBillingJob())
+
+	// alert the admins when the month's shop revenue goal is reached
+	s.cron.AddJob("@every 10m", job.NewShopGoalJob())
+
+	// alert the admins of shop packages low on stock and inbounds near their cap
+	s.cron.AddJob("@every 5m", job.NewShopCapacityJob())
+
+	// send the admins a shop summary every Monday morning
+	s.cron.AddJob("0 0 9 * * 1", job.NewShopSummaryJob())
+
+	// delete receipts of closed orders past the retention period
+	s.cron.AddJob("@daily", job.NewShopReceiptJob())
+
+	// encrypt sensitive shop order fields written before they were encrypted,
+	// starting right away
+	go job.NewShopCryptJob().Run()
+	s.cron.AddJob("@every 10m", job.NewShopCryptJob())
+
+	// move long closed orders to the order archive
+	s.cron.AddJob("@daily", job.NewShopArchiveJob())
+
+	// mirror the package catalog of the primary panel
+	s.cron.AddJob("@every 1m", job.NewShopSyncJob())
+
 	// check client ips from log file every day
 	s.cron.AddJob("@daily", job.NewClearLogsJob())
 
@@ -442,6 +506,8 @@ func (s *Server) Start() (err error) {
 
 	s.startTask()
 
+	// the bot keeps the translations to start once it is enabled in the settings
+	s.tgbotService.SetI18nFS(i18nFS)
 	isTgbotenabled, err := s.settingService.GetTgbotEnabled()
 	if (err == nil) && (isTgbotenabled) {
 		tgBot := s.tgbotService.NewTgbot()
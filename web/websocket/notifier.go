@@ -56,6 +56,14 @@ func BroadcastOutbounds(outbounds interface{}) {
 	}
 }
 
+// BroadcastShopOrder broadcasts a new shop order or receipt upload to all connected clients
+func BroadcastShopOrder(event any) {
+	hub := GetHub()
+	if hub != nil {
+		hub.Broadcast(MessageTypeShopOrder, event)
+	}
+}
+
 // BroadcastNotification broadcasts a system notification to all connected clients
 func BroadcastNotification(title, message, level string) {
 	hub := GetHub()
@@ -204,6 +204,15 @@ func (x *XrayAPI) RemoveUser(inboundTag, email string) error {
 	return nil
 }
 
+// Ping checks that the Xray API answers by querying the core's system stats.
+func (x *XrayAPI) Ping(ctx context.Context) error {
+	if x.StatsServiceClient == nil {
+		return common.NewError("xray StatusServiceClient is not initialized")
+	}
+	_, err := (*x.StatsServiceClient).GetSysStats(ctx, &statsService.SysStatsRequest{})
+	return err
+}
+
 // GetTraffic queries traffic statistics from the Xray core, optionally resetting counters.
 func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
 	if x.grpcClient == nil {